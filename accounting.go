@@ -0,0 +1,137 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gomqtt/transport"
+)
+
+// A HeaderConn is a connection that has been established using a HTTP request
+// (e.g. a WebSocket connection) and exposes the headers of that request.
+// Connections that implement HeaderConn allow the broker to use the
+// X-Forwarded-For header if the request originates from a trusted proxy.
+type HeaderConn interface {
+	transport.Conn
+
+	// Header should return the headers of the HTTP request.
+	Header() http.Header
+}
+
+// ParseCIDRs will parse the specified CIDR notations for the usage as
+// Broker.TrustedProxies.
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// AccountingKey returns the key that is used to account resource usage like
+// rate limits and quotas of the specified client. Authenticated clients are
+// accounted by their username ("user:<name>") and anonymous clients by their
+// remote IP address ("ip:<address>"). The username of clients that have
+// been accepted without verifying their credentials is ignored.
+func AccountingKey(client Client) string {
+	key, _ := client.Context().Get("accounting_key").(string)
+	return key
+}
+
+// computes the accounting key of a client
+func accountingKey(username string, remoteIP string) string {
+	if username != "" {
+		return "user:" + username
+	}
+
+	return "ip:" + remoteIP
+}
+
+// returns the ip address of the client behind the connection, the forwarded
+// address is used if the connection has been established by a trusted proxy
+func remoteIP(conn transport.Conn, trusted []*net.IPNet) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+
+	// get host of remote address
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+
+	// check header support
+	headerConn, ok := conn.(HeaderConn)
+	if !ok {
+		return host
+	}
+
+	return forwardedIP(host, headerConn.Header()["X-Forwarded-For"], trusted)
+}
+
+// walks the forwarded addresses from the right while they are trusted and
+// returns the first untrusted address, the header is ignored unless the peer
+// is a trusted proxy and a malformed address ends the walk at the last
+// trusted hop
+func forwardedIP(host string, forwardedFor []string, trusted []*net.IPNet) string {
+	if len(forwardedFor) == 0 || !containsIP(trusted, host) {
+		return host
+	}
+
+	// multiple headers are combined in order
+	addrs := strings.Split(strings.Join(forwardedFor, ","), ",")
+
+	for i := len(addrs) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(addrs[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+
+		host = hop
+
+		if !containsIP(trusted, host) {
+			break
+		}
+	}
+
+	return host
+}
+
+// checks if the ip is contained in one of the networks
+func containsIP(nets []*net.IPNet, host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountingKey(t *testing.T) {
+	assert.Equal(t, "user:foo", accountingKey("foo", "10.0.0.1"))
+	assert.Equal(t, "ip:10.0.0.1", accountingKey("", "10.0.0.1"))
+}
+
+func TestAccountingKeyClaimedUsername(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.Username = "victim"
+
+	broker := New()
+
+	keys := make(chan string, 1)
+	broker.EventHandler = func(event *Event) {
+		if event.Type == ClientConnected {
+			keys <- AccountingKey(event.Client)
+		}
+	}
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+	assert.NotNil(t, conn)
+
+	tools.NewFlow().
+		Send(connect).
+		Skip(). // connack
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	// the username has not been verified
+	assert.Equal(t, "ip:127.0.0.1", <-keys)
+}
+
+func TestForwardedIP(t *testing.T) {
+	trusted, err := ParseCIDRs("10.0.0.0/8", "192.168.1.1/32")
+	assert.NoError(t, err)
+
+	// untrusted remote
+	assert.Equal(t, "1.2.3.4", forwardedIP("1.2.3.4", []string{"5.6.7.8"}, trusted))
+
+	// trusted remote without header
+	assert.Equal(t, "10.0.0.1", forwardedIP("10.0.0.1", nil, trusted))
+
+	// trusted remote with header
+	assert.Equal(t, "5.6.7.8", forwardedIP("10.0.0.1", []string{"5.6.7.8"}, trusted))
+
+	// trusted proxy chain
+	assert.Equal(t, "5.6.7.8", forwardedIP("10.0.0.1", []string{"1.1.1.1, 5.6.7.8, 192.168.1.1"}, trusted))
+
+	// multiple headers
+	assert.Equal(t, "5.6.7.8", forwardedIP("10.0.0.1", []string{"1.1.1.1", "5.6.7.8", "192.168.1.1"}, trusted))
+
+	// malformed hop
+	assert.Equal(t, "192.168.1.1", forwardedIP("10.0.0.1", []string{"1.1.1.1, foo, 192.168.1.1"}, trusted))
+
+	_, err = ParseCIDRs("foo")
+	assert.Error(t, err)
+}
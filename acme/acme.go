@@ -0,0 +1,187 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package acme obtains and renews the certificates of "tls" and "wss"
+// listeners from an ACME certificate authority like Let's Encrypt. It is kept
+// separate from the broker package, so that embedders that do not need it do
+// not depend on golang.org/x/crypto.
+package acme
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gomqtt/broker"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// A Manager obtains certificates for the configured domains on the first
+// handshake, renews them before they expire and keeps them with the account
+// key in the cache directory, so that restarts do not request new ones. It
+// can be attached to a broker as a Subsystem that answers the HTTP-01
+// challenges of the certificate authority.
+type Manager struct {
+	// The domains certificates are obtained for. Handshakes for other server
+	// names are refused.
+	Domains []string
+
+	// The directory the certificates and the account key are cached in.
+	CacheDir string
+
+	// The optional contact email of the account.
+	Email string
+
+	// The directory url of the certificate authority. Defaults to the
+	// production directory of Let's Encrypt.
+	DirectoryURL string
+
+	// The duration before the expiry of a certificate after which it is
+	// renewed. Defaults to 30 days.
+	RenewBefore time.Duration
+
+	// The address the HTTP-01 challenges are answered on, e.g. ":80". If
+	// empty, only the TLS-ALPN-01 challenge is supported, which requires a
+	// listener on port 443.
+	HTTPAddr string
+
+	manager  *autocert.Manager
+	listener net.Listener
+	server   *http.Server
+	mutex    sync.Mutex
+}
+
+// NewManager returns a new Manager that caches the certificates of the
+// domains in the specified directory and answers HTTP-01 challenges on
+// port 80.
+func NewManager(cacheDir string, domains ...string) *Manager {
+	return &Manager{
+		Domains:  domains,
+		CacheDir: cacheDir,
+		HTTPAddr: ":80",
+	}
+}
+
+// returns the lazily created autocert manager
+func (m *Manager) setup() (*autocert.Manager, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.manager != nil {
+		return m.manager, nil
+	}
+
+	// check configuration
+	if len(m.Domains) == 0 {
+		return nil, fmt.Errorf("acme: no domains configured")
+	} else if m.CacheDir == "" {
+		return nil, fmt.Errorf("acme: no cache directory configured")
+	}
+
+	m.manager = &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(m.CacheDir),
+		HostPolicy:  autocert.HostWhitelist(m.Domains...),
+		RenewBefore: m.RenewBefore,
+		Email:       m.Email,
+	}
+
+	if m.DirectoryURL != "" {
+		m.manager.Client = &acme.Client{DirectoryURL: m.DirectoryURL}
+	}
+
+	return m.manager, nil
+}
+
+// TLSConfig returns a config that obtains the certificates of handshakes from
+// the certificate authority, e.g. for the TLSConfig of the broker or of a
+// broker.Listener.
+func (m *Manager) TLSConfig() (*tls.Config, error) {
+	manager, err := m.setup()
+	if err != nil {
+		return nil, err
+	}
+
+	return manager.TLSConfig(), nil
+}
+
+// Listener returns a listener for the "tls" or "wss" url that uses the
+// certificates of the manager.
+func (m *Manager) Listener(url string) (*broker.Listener, error) {
+	config, err := m.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return &broker.Listener{
+		URL:       url,
+		TLSConfig: config,
+	}, nil
+}
+
+// Start will start answering the HTTP-01 challenges if the HTTPAddr is set.
+// Other requests are redirected to https.
+func (m *Manager) Start() error {
+	manager, err := m.setup()
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.HTTPAddr == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", m.HTTPAddr)
+	if err != nil {
+		return err
+	}
+
+	m.listener = listener
+	m.server = &http.Server{Handler: manager.HTTPHandler(nil)}
+
+	go m.server.Serve(listener)
+
+	return nil
+}
+
+// HTTPListener returns the listener of the challenge server once started.
+func (m *Manager) HTTPListener() net.Listener {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.listener
+}
+
+// Stop will close the challenge server.
+func (m *Manager) Stop() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.server == nil {
+		return nil
+	}
+
+	err := m.server.Close()
+	m.server = nil
+	m.listener = nil
+
+	return err
+}
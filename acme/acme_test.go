@@ -0,0 +1,80 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package acme
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManager(t *testing.T) {
+	_, err := NewManager(t.TempDir()).TLSConfig()
+	assert.Error(t, err)
+
+	_, err = NewManager("", "example.com").TLSConfig()
+	assert.Error(t, err)
+
+	manager := NewManager(t.TempDir(), "example.com")
+
+	config, err := manager.TLSConfig()
+	assert.NoError(t, err)
+	assert.NotNil(t, config.GetCertificate)
+	assert.Contains(t, config.NextProtos, "acme-tls/1")
+
+	// other server names are refused
+	_, err = config.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.com"})
+	assert.Error(t, err)
+
+	listener, err := manager.Listener("tls://0.0.0.0:8883")
+	assert.NoError(t, err)
+	assert.NoError(t, listener.Validate())
+}
+
+func TestManagerChallengeServer(t *testing.T) {
+	manager := NewManager(t.TempDir(), "example.com")
+	manager.HTTPAddr = "localhost:0"
+
+	err := manager.Start()
+	assert.NoError(t, err)
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	base := "http://" + manager.HTTPListener().Addr().String()
+
+	req, err := http.NewRequest("GET", base+"/.well-known/acme-challenge/unknown", nil)
+	assert.NoError(t, err)
+	req.Host = "example.com"
+
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	res.Body.Close()
+
+	res, err = client.Get(base + "/")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+	res.Body.Close()
+
+	err = manager.Stop()
+	assert.NoError(t, err)
+	assert.Nil(t, manager.HTTPListener())
+}
@@ -0,0 +1,472 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package admin implements an HTTP API to inspect and control a broker at
+// runtime. It is kept separate from the broker package, so that embedders
+// that do not need it do not pay for it.
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomqtt/broker"
+	"github.com/gomqtt/packet"
+)
+
+// the duration a client id is traced if no duration is requested
+const defaultDebugDuration = 10 * time.Minute
+
+// A Message is the representation of a message in the admin API.
+type Message struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	QOS     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+}
+
+// A Swap is a conditional update of a retained message in the admin API. The
+// message is only retained if the payload of the currently retained message
+// equals the expected payload.
+type Swap struct {
+	Topic    string `json:"topic"`
+	Payload  string `json:"payload"`
+	QOS      byte   `json:"qos"`
+	Expected string `json:"expected"`
+}
+
+// NewHandler returns a http.Handler that exposes an API to inspect and control
+// the broker at runtime. The handler does not authenticate requests and should
+// only be served on a private interface or wrapped by a handler that does. The
+// following endpoints are available:
+//
+//	GET    /clients                   lists the connected clients (see Snapshot)
+//	DELETE /clients/<client-id>       closes the clients with the client id
+//	POST   /publish                   publishes a {topic, payload, qos, retain} message
+//	GET    /routing                   snapshots the subscriptions (see SnapshotRouting)
+//	GET    /retained?filter=<filter>  lists the retained messages matching the filter
+//	DELETE /retained?filter=<filter>  clears the retained messages matching the filter
+//	PUT    /retained                  retains a {topic, payload, qos, expected} message (see Broker.SwapRetained)
+//	GET    /data/<client-id>          exports the data stored about the client id (see ExportClient)
+//	DELETE /data/<client-id>          erases the data stored about the client id (see EraseClient)
+//	GET    /quotas                    lists the usage of the quotas (see QuotaUsage)
+//	GET    /debug                     lists the traced client ids (see DebuggedClients)
+//	PUT    /debug/<client-id>         traces the client id for the ?duration= (see DebugClient)
+//	DELETE /debug/<client-id>         stops tracing the client id
+//
+// The filter defaults to "#" and must be URL encoded. The tracing duration is
+// parsed using time.ParseDuration and defaults to ten minutes. Listing and
+// clearing retained messages requires a Backend that implements the
+// RetainedInspector interface. Conditional updates require a Backend that
+// implements the RetainedSwapper interface and fail with a 409 Conflict if the
+// retained payload does not match the expected payload. Modifying requests are
+// recorded as administrative actions of the broker (see Broker.RecordAction).
+func NewHandler(b *broker.Broker) http.Handler {
+	h := &handler{broker: b}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/clients", h.clients)
+	mux.HandleFunc("/clients/", h.client)
+	mux.HandleFunc("/publish", h.publish)
+	mux.HandleFunc("/routing", h.routing)
+	mux.HandleFunc("/retained", h.retained)
+	mux.HandleFunc("/data/", h.data)
+	mux.HandleFunc("/quotas", h.quotas)
+	mux.HandleFunc("/debug", h.debugged)
+	mux.HandleFunc("/debug/", h.debug)
+
+	return mux
+}
+
+// A Server serves the admin API on a dedicated listener and can be attached to
+// a broker as a Subsystem.
+type Server struct {
+	// The address the server listens on, e.g. "localhost:8081".
+	Addr string
+
+	broker   *broker.Broker
+	listener net.Listener
+	server   *http.Server
+	mutex    sync.Mutex
+}
+
+// NewServer returns a new Server that serves the admin API of the broker on the
+// specified address.
+func NewServer(b *broker.Broker, addr string) *Server {
+	return &Server{
+		Addr:   addr,
+		broker: b,
+	}
+}
+
+// Start will start listening and serving the admin API.
+func (s *Server) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	s.listener = listener
+	s.server = &http.Server{Handler: NewHandler(s.broker)}
+
+	go s.server.Serve(listener)
+
+	return nil
+}
+
+// Listener returns the listener of a started server.
+func (s *Server) Listener() net.Listener {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.listener
+}
+
+// Stop will close the listener and all open connections.
+func (s *Server) Stop() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.server == nil {
+		return nil
+	}
+
+	err := s.server.Close()
+	s.server = nil
+	s.listener = nil
+
+	return err
+}
+
+// the handler of the admin api
+type handler struct {
+	broker *broker.Broker
+}
+
+// lists the connected clients
+func (h *handler) clients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	snapshot, err := h.broker.Snapshot()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	write(w, snapshot)
+}
+
+// closes the clients with the requested client id
+func (h *handler) client(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	clientID := strings.TrimPrefix(r.URL.Path, "/clients/")
+
+	closed := h.broker.CloseClient(clientID)
+	if closed == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("client %s not found", clientID))
+		return
+	}
+
+	write(w, map[string]int{"closed": closed})
+}
+
+// publishes a message on behalf of the broker
+func (h *handler) publish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	// decode message
+	var msg Message
+	err := json.NewDecoder(r.Body).Decode(&msg)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// check message
+	if msg.Topic == "" || strings.ContainsAny(msg.Topic, "+#") {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid topic"))
+		return
+	} else if msg.QOS > 2 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid qos"))
+		return
+	}
+
+	h.broker.RecordAction("publish", msg.Topic)
+
+	err = h.broker.Publish(&packet.Message{
+		Topic:   msg.Topic,
+		Payload: []byte(msg.Payload),
+		QOS:     msg.QOS,
+		Retain:  msg.Retain,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	write(w, msg)
+}
+
+// returns a snapshot of the subscriptions
+func (h *handler) routing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	if _, ok := h.broker.Backend.(broker.RoutingInspector); !ok {
+		writeError(w, http.StatusNotImplemented, fmt.Errorf("backend does not support routing snapshots"))
+		return
+	}
+
+	snapshot, err := h.broker.SnapshotRouting()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	write(w, snapshot)
+}
+
+// lists, clears or conditionally updates the retained messages
+func (h *handler) retained(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		h.swapRetained(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	inspector, ok := h.broker.Backend.(broker.RetainedInspector)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, fmt.Errorf("backend does not support retained inspection"))
+		return
+	}
+
+	// get filter
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		filter = "#"
+	}
+
+	msgs, err := inspector.RetainedMessages(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	list := []Message{}
+	for _, msg := range msgs {
+		list = append(list, Message{
+			Topic:   msg.Topic,
+			Payload: string(msg.Payload),
+			QOS:     msg.QOS,
+			Retain:  true,
+		})
+	}
+
+	// clear messages by publishing empty retained messages
+	if r.Method == http.MethodDelete {
+		h.broker.RecordAction("clear_retained", filter)
+
+		for _, msg := range msgs {
+			err = h.broker.Publish(&packet.Message{
+				Topic:  msg.Topic,
+				Retain: true,
+			})
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+	}
+
+	write(w, list)
+}
+
+// retains the requested message if the expected payload matches
+func (h *handler) swapRetained(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.broker.Backend.(broker.RetainedSwapper); !ok {
+		writeError(w, http.StatusNotImplemented, fmt.Errorf("backend does not support conditional retained updates"))
+		return
+	}
+
+	// decode swap
+	var swap Swap
+	err := json.NewDecoder(r.Body).Decode(&swap)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// check message
+	if swap.Topic == "" || strings.ContainsAny(swap.Topic, "+#") {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid topic"))
+		return
+	} else if swap.QOS > 2 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid qos"))
+		return
+	}
+
+	swapped, err := h.broker.SwapRetained(&packet.Message{
+		Topic:   swap.Topic,
+		Payload: []byte(swap.Payload),
+		QOS:     swap.QOS,
+		Retain:  true,
+	}, []byte(swap.Expected))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if !swapped {
+		writeError(w, http.StatusConflict, fmt.Errorf("retained message does not match"))
+		return
+	}
+
+	write(w, Message{
+		Topic:   swap.Topic,
+		Payload: swap.Payload,
+		QOS:     swap.QOS,
+		Retain:  true,
+	})
+}
+
+// exports or erases the data stored about the requested client id
+func (h *handler) data(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	clientID := strings.TrimPrefix(r.URL.Path, "/data/")
+	if clientID == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing client id"))
+		return
+	}
+
+	// export data
+	if r.Method == http.MethodGet {
+		data, err := h.broker.ExportClient(clientID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		write(w, data)
+		return
+	}
+
+	if _, ok := h.broker.Backend.(broker.DataController); !ok {
+		writeError(w, http.StatusNotImplemented, fmt.Errorf("backend does not support data erasure"))
+		return
+	}
+
+	err := h.broker.EraseClient(clientID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	write(w, map[string]string{"erased": clientID})
+}
+
+// lists the usage of the quotas
+func (h *handler) quotas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	write(w, h.broker.QuotaUsage())
+}
+
+// lists the traced client ids
+func (h *handler) debugged(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	write(w, h.broker.DebuggedClients())
+}
+
+// starts or stops tracing the requested client id
+func (h *handler) debug(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	clientID := strings.TrimPrefix(r.URL.Path, "/debug/")
+	if clientID == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing client id"))
+		return
+	}
+
+	// stop tracing
+	if r.Method == http.MethodDelete {
+		h.broker.DebugClient(clientID, 0)
+		write(w, map[string]string{"undebugged": clientID})
+		return
+	}
+
+	// get duration
+	duration := defaultDebugDuration
+	if value := r.URL.Query().Get("duration"); value != "" {
+		var err error
+		duration, err = time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid duration"))
+			return
+		}
+	}
+
+	write(w, broker.DebuggedClient{
+		ClientID: clientID,
+		Until:    h.broker.DebugClient(clientID, duration),
+	})
+}
+
+// writes the value as json
+func write(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+// writes the error as json with the specified status
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
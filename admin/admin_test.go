@@ -0,0 +1,220 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/broker"
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func adminRequest(t *testing.T, handler http.Handler, method, path, body string, value interface{}) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	if value != nil {
+		err := json.Unmarshal(rec.Body.Bytes(), value)
+		assert.NoError(t, err)
+	}
+
+	return rec.Code
+}
+
+func TestHandler(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+	connect.CleanSession = true
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "foo/#"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	publish := packet.NewPublishPacket()
+	publish.Message = packet.Message{Topic: "foo/bar", Payload: []byte("hello"), Retain: true}
+
+	cleared := packet.NewPublishPacket()
+	cleared.Message = packet.Message{Topic: "foo/bar", Retain: true}
+
+	b := broker.New()
+	handler := NewHandler(b)
+
+	port := tools.NewPort()
+	err := b.Launch(port.URL())
+	assert.NoError(t, err)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Test(t, conn)
+
+	// list clients
+	var snapshot broker.Snapshot
+	code := adminRequest(t, handler, "GET", "/clients", "", &snapshot)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, snapshot.Clients, 1)
+	assert.Equal(t, "test", snapshot.Clients[0].ClientID)
+	assert.Equal(t, []string{"foo/#"}, snapshot.Clients[0].Subscriptions)
+	assert.Equal(t, 0, snapshot.Clients[0].Inflight)
+
+	// inject publish
+	code = adminRequest(t, handler, "POST", "/publish", `{"topic":"foo/bar","payload":"hello","retain":true}`, nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	code = adminRequest(t, handler, "POST", "/publish", `{"topic":"foo/#"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	tools.NewFlow().
+		Receive(publish).
+		Test(t, conn)
+
+	// list retained messages
+	var retained []Message
+	code = adminRequest(t, handler, "GET", "/retained?filter=foo/%2B", "", &retained)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []Message{{Topic: "foo/bar", Payload: "hello", Retain: true}}, retained)
+
+	// clear retained messages
+	code = adminRequest(t, handler, "DELETE", "/retained", "", nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	tools.NewFlow().
+		Receive(cleared).
+		Test(t, conn)
+
+	code = adminRequest(t, handler, "GET", "/retained", "", &retained)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, retained)
+
+	// conditionally update retained messages
+	code = adminRequest(t, handler, "PUT", "/retained", `{"topic":"foo/bar","payload":"hello"}`, nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	code = adminRequest(t, handler, "PUT", "/retained", `{"topic":"foo/bar","payload":"world","expected":"other"}`, nil)
+	assert.Equal(t, http.StatusConflict, code)
+
+	code = adminRequest(t, handler, "PUT", "/retained", `{"topic":"foo/bar","payload":"world","expected":"hello"}`, nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	swapped := packet.NewPublishPacket()
+	swapped.Message = packet.Message{Topic: "foo/bar", Payload: []byte("world"), Retain: true}
+
+	tools.NewFlow().
+		Receive(publish).
+		Receive(swapped).
+		Test(t, conn)
+
+	retained = nil
+	code = adminRequest(t, handler, "GET", "/retained", "", &retained)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []Message{{Topic: "foo/bar", Payload: "world", Retain: true}}, retained)
+
+	// disconnect client
+	code = adminRequest(t, handler, "DELETE", "/clients/foo", "", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code = adminRequest(t, handler, "DELETE", "/clients/test", "", nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	tools.NewFlow().
+		End().
+		Test(t, conn)
+
+	err = b.Close(time.Second)
+	assert.NoError(t, err)
+}
+
+func TestHandlerQuotas(t *testing.T) {
+	b := broker.New()
+	b.Quotas = []broker.Quota{{Window: time.Minute, MaxMessages: 10}}
+	handler := NewHandler(b)
+
+	var usage []broker.QuotaUsage
+	code := adminRequest(t, handler, "GET", "/quotas", "", &usage)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, usage)
+
+	code = adminRequest(t, handler, "POST", "/quotas", "", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
+
+func TestHandlerDebug(t *testing.T) {
+	b := broker.New()
+	handler := NewHandler(b)
+
+	code := adminRequest(t, handler, "PUT", "/debug/test?duration=foo", "", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	var debugged broker.DebuggedClient
+	code = adminRequest(t, handler, "PUT", "/debug/test?duration=1m", "", &debugged)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "test", debugged.ClientID)
+	assert.True(t, debugged.Until.After(time.Now()))
+
+	var list []broker.DebuggedClient
+	code = adminRequest(t, handler, "GET", "/debug", "", &list)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "test", list[0].ClientID)
+
+	code = adminRequest(t, handler, "DELETE", "/debug/test", "", nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	list = nil
+	code = adminRequest(t, handler, "GET", "/debug", "", &list)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, list)
+}
+
+func TestServer(t *testing.T) {
+	b := broker.New()
+
+	server := NewServer(b, "localhost:0")
+	err := b.Attach(server)
+	assert.NoError(t, err)
+
+	err = b.Start()
+	assert.NoError(t, err)
+
+	res, err := http.Get("http://" + server.Listener().Addr().String() + "/clients")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res.Body.Close()
+
+	err = b.Close(time.Second)
+	assert.NoError(t, err)
+	assert.Nil(t, server.Listener())
+}
@@ -0,0 +1,329 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gomqtt/broker"
+)
+
+// An EMQXClient is the representation of a client in the EMQX compatible API.
+type EMQXClient struct {
+	ClientID         string `json:"clientid"`
+	Username         string `json:"username"`
+	IPAddress        string `json:"ip_address"`
+	Node             string `json:"node"`
+	Connected        bool   `json:"connected"`
+	CleanStart       bool   `json:"clean_start"`
+	SubscriptionsCnt int    `json:"subscriptions_cnt"`
+	InflightCnt      int    `json:"inflight_cnt"`
+}
+
+// An EMQXSubscription is the representation of a subscription in the EMQX
+// compatible API.
+type EMQXSubscription struct {
+	ClientID string `json:"clientid"`
+	Topic    string `json:"topic"`
+	QOS      byte   `json:"qos"`
+	Node     string `json:"node"`
+}
+
+// EMQXMeta describes the page of a list in the EMQX compatible API.
+type EMQXMeta struct {
+	Page    int  `json:"page"`
+	Limit   int  `json:"limit"`
+	Count   int  `json:"count"`
+	HasNext bool `json:"hasnext"`
+}
+
+// the default page size of lists
+const emqxLimit = 100
+
+// NewEMQXHandler returns a http.Handler that exposes a subset of the EMQX 5
+// management API, so that existing dashboards and tooling can manage the
+// connected clients of the broker. Like the handler returned by NewHandler,
+// it does not authenticate requests. The following endpoints are available:
+//
+//	GET    /api/v5/clients                            lists the connected clients
+//	GET    /api/v5/clients/<client-id>                returns a connected client
+//	DELETE /api/v5/clients/<client-id>                kicks a connected client
+//	GET    /api/v5/clients/<client-id>/subscriptions  lists the subscriptions of a client
+//	GET    /api/v5/subscriptions                      lists the subscriptions of all clients
+//
+// The lists are paginated using the "page" and "limit" parameters. Clients can
+// be filtered using the "clientid", "username" and "like_clientid" parameters
+// and subscriptions using the "clientid", "topic" and "qos" parameters.
+// Kicking a client is recorded as an administrative action of the broker.
+func NewEMQXHandler(b *broker.Broker) http.Handler {
+	h := &emqxHandler{broker: b}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v5/clients", h.clients)
+	mux.HandleFunc("/api/v5/clients/", h.client)
+	mux.HandleFunc("/api/v5/subscriptions", h.subscriptions)
+
+	return mux
+}
+
+// the handler of the emqx compatible api
+type emqxHandler struct {
+	broker *broker.Broker
+}
+
+// lists the connected clients
+func (h *emqxHandler) clients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeEMQXError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+
+	page, limit, err := emqxPage(query)
+	if err != nil {
+		writeEMQXError(w, http.StatusBadRequest, "BAD_REQUEST", err.Error())
+		return
+	}
+
+	snapshot, err := h.broker.Snapshot()
+	if err != nil {
+		writeEMQXError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+		return
+	}
+
+	list := []EMQXClient{}
+	for _, client := range snapshot.Clients {
+		if id := query.Get("clientid"); id != "" && client.ClientID != id {
+			continue
+		} else if username := query.Get("username"); username != "" && client.Username != username {
+			continue
+		} else if like := query.Get("like_clientid"); like != "" && !strings.Contains(client.ClientID, like) {
+			continue
+		}
+
+		list = append(list, h.client2EMQX(client))
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].ClientID < list[j].ClientID
+	})
+
+	start, end, meta := emqxSlice(len(list), page, limit)
+	writeEMQXList(w, list[start:end], meta)
+}
+
+// returns or kicks a connected client and lists its subscriptions
+func (h *emqxHandler) client(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v5/clients/")
+
+	clientID, subscriptions := path, false
+	if strings.HasSuffix(path, "/subscriptions") {
+		clientID, subscriptions = strings.TrimSuffix(path, "/subscriptions"), true
+	}
+
+	if clientID == "" || strings.Contains(clientID, "/") {
+		writeEMQXError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+		return
+	}
+
+	// kick client
+	if r.Method == http.MethodDelete && !subscriptions {
+		if h.broker.CloseClient(clientID) == 0 {
+			writeEMQXError(w, http.StatusNotFound, "CLIENTID_NOT_FOUND", "Client ID not found")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		writeEMQXError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "method not allowed")
+		return
+	}
+
+	snapshot, err := h.broker.Snapshot()
+	if err != nil {
+		writeEMQXError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+		return
+	}
+
+	// find client
+	var found *broker.ClientSnapshot
+	for _, client := range snapshot.Clients {
+		if client.ClientID == clientID {
+			found = client
+			break
+		}
+	}
+
+	if found == nil {
+		writeEMQXError(w, http.StatusNotFound, "CLIENTID_NOT_FOUND", "Client ID not found")
+		return
+	}
+
+	if subscriptions {
+		write(w, h.subscriptions2EMQX(found))
+		return
+	}
+
+	write(w, h.client2EMQX(found))
+}
+
+// lists the subscriptions of all connected clients
+func (h *emqxHandler) subscriptions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeEMQXError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+
+	page, limit, err := emqxPage(query)
+	if err != nil {
+		writeEMQXError(w, http.StatusBadRequest, "BAD_REQUEST", err.Error())
+		return
+	}
+
+	snapshot, err := h.broker.Snapshot()
+	if err != nil {
+		writeEMQXError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+		return
+	}
+
+	list := []EMQXSubscription{}
+	for _, client := range snapshot.Clients {
+		if id := query.Get("clientid"); id != "" && client.ClientID != id {
+			continue
+		}
+
+		for _, sub := range h.subscriptions2EMQX(client) {
+			if topic := query.Get("topic"); topic != "" && sub.Topic != topic {
+				continue
+			} else if qos := query.Get("qos"); qos != "" && strconv.Itoa(int(sub.QOS)) != qos {
+				continue
+			}
+
+			list = append(list, sub)
+		}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].ClientID != list[j].ClientID {
+			return list[i].ClientID < list[j].ClientID
+		}
+
+		return list[i].Topic < list[j].Topic
+	})
+
+	start, end, meta := emqxSlice(len(list), page, limit)
+	writeEMQXList(w, list[start:end], meta)
+}
+
+// converts a client snapshot
+func (h *emqxHandler) client2EMQX(client *broker.ClientSnapshot) EMQXClient {
+	return EMQXClient{
+		ClientID:         client.ClientID,
+		Username:         client.Username,
+		IPAddress:        client.RemoteIP,
+		Node:             h.broker.NodeID,
+		Connected:        true,
+		CleanStart:       client.Clean,
+		SubscriptionsCnt: len(client.Subscriptions),
+		InflightCnt:      client.Inflight,
+	}
+}
+
+// converts the subscriptions of a client snapshot
+func (h *emqxHandler) subscriptions2EMQX(client *broker.ClientSnapshot) []EMQXSubscription {
+	list := []EMQXSubscription{}
+	for _, topic := range client.Subscriptions {
+		list = append(list, EMQXSubscription{
+			ClientID: client.ClientID,
+			Topic:    topic,
+			QOS:      client.Granted[topic],
+			Node:     h.broker.NodeID,
+		})
+	}
+
+	return list
+}
+
+// parses the pagination parameters
+func emqxPage(query url.Values) (int, int, error) {
+	page, limit := 1, emqxLimit
+
+	if value := query.Get("page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("invalid page %q", value)
+		}
+
+		page = n
+	}
+
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("invalid limit %q", value)
+		}
+
+		limit = n
+	}
+
+	return page, limit, nil
+}
+
+// returns the bounds of the page and its metadata
+func emqxSlice(count, page, limit int) (int, int, EMQXMeta) {
+	start := (page - 1) * limit
+	if start > count {
+		start = count
+	}
+
+	end := start + limit
+	if end > count {
+		end = count
+	}
+
+	return start, end, EMQXMeta{
+		Page:    page,
+		Limit:   limit,
+		Count:   count,
+		HasNext: end < count,
+	}
+}
+
+// writes a paginated list as json
+func writeEMQXList(w http.ResponseWriter, data interface{}, meta EMQXMeta) {
+	write(w, map[string]interface{}{
+		"data": data,
+		"meta": meta,
+	})
+}
+
+// writes an error in the format of the emqx api
+func writeEMQXError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"code": code, "message": message})
+}
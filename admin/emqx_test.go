@@ -0,0 +1,127 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/broker"
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEMQXHandler(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+	connect.Username = "user"
+	connect.CleanSession = true
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "foo/#", QOS: 1}, {Topic: "bar"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{1, 0}
+	suback.PacketID = 1
+
+	b := broker.New()
+	b.NodeID = "node1"
+	handler := NewEMQXHandler(b)
+
+	port := tools.NewPort()
+	err := b.Launch(port.URL())
+	assert.NoError(t, err)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Test(t, conn)
+
+	// list clients
+	var clients struct {
+		Data []EMQXClient `json:"data"`
+		Meta EMQXMeta     `json:"meta"`
+	}
+	code := adminRequest(t, handler, "GET", "/api/v5/clients?username=user", "", &clients)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, EMQXMeta{Page: 1, Limit: 100, Count: 1}, clients.Meta)
+	if assert.Len(t, clients.Data, 1) {
+		assert.Equal(t, "test", clients.Data[0].ClientID)
+		assert.Equal(t, "user", clients.Data[0].Username)
+		assert.Equal(t, "node1", clients.Data[0].Node)
+		assert.True(t, clients.Data[0].Connected)
+		assert.True(t, clients.Data[0].CleanStart)
+		assert.Equal(t, 2, clients.Data[0].SubscriptionsCnt)
+	}
+
+	code = adminRequest(t, handler, "GET", "/api/v5/clients?page=2", "", &clients)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, clients.Data)
+
+	code = adminRequest(t, handler, "GET", "/api/v5/clients?limit=x", "", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// get client
+	var client EMQXClient
+	code = adminRequest(t, handler, "GET", "/api/v5/clients/test", "", &client)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "test", client.ClientID)
+
+	var failure map[string]string
+	code = adminRequest(t, handler, "GET", "/api/v5/clients/foo", "", &failure)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "CLIENTID_NOT_FOUND", failure["code"])
+
+	// list subscriptions
+	var subscriptions []EMQXSubscription
+	code = adminRequest(t, handler, "GET", "/api/v5/clients/test/subscriptions", "", &subscriptions)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, subscriptions, 2)
+
+	var all struct {
+		Data []EMQXSubscription `json:"data"`
+		Meta EMQXMeta           `json:"meta"`
+	}
+	code = adminRequest(t, handler, "GET", "/api/v5/subscriptions?qos=1", "", &all)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []EMQXSubscription{
+		{ClientID: "test", Topic: "foo/#", QOS: 1, Node: "node1"},
+	}, all.Data)
+
+	// kick client
+	code = adminRequest(t, handler, "DELETE", "/api/v5/clients/foo", "", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code = adminRequest(t, handler, "DELETE", "/api/v5/clients/test", "", nil)
+	assert.Equal(t, http.StatusNoContent, code)
+
+	tools.NewFlow().
+		End().
+		Test(t, conn)
+
+	err = b.Close(time.Second)
+	assert.NoError(t, err)
+}
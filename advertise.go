@@ -0,0 +1,74 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"math"
+	"time"
+)
+
+// ConnackPropertiesKey is the context key of the ConnackProperties of a
+// client. They are only stored if a Middleware is used and AdvertiseLimits is
+// set or the client has been assigned a client id.
+const ConnackPropertiesKey = "connack_properties"
+
+// ConnackProperties are the limits of the broker and the assigned client id
+// of a client. The broker does not encode them in the CONNACK, an outbound
+// Middleware may read them from the context when the CONNACK is passed and
+// encode them itself. Zero values should be omitted.
+type ConnackProperties struct {
+	// The number of unacknowledged QOS 1 and 2 publishes a client may send
+	// at once (see Broker.ReceiveMaximum).
+	ReceiveMaximum uint16
+
+	// The maximum size of the packets the broker accepts (see
+	// Broker.MaxPacketSize).
+	MaximumPacketSize uint32
+
+	// The keep alive clients should use in seconds (see
+	// Broker.ServerKeepAlive).
+	ServerKeepAlive uint16
+
+	// The maximum topic alias clients may use (see TopicAliasing.Inbound).
+	TopicAliasMaximum uint16
+
+	// The client id assigned by the broker (see Broker.AssignClientIDs).
+	AssignedClientIdentifier string
+}
+
+// returns the limits that are advertised to clients
+func (b *Broker) connackProperties() ConnackProperties {
+	props := ConnackProperties{
+		ReceiveMaximum:  b.ReceiveMaximum,
+		ServerKeepAlive: uint16(b.ServerKeepAlive / time.Second),
+	}
+
+	if b.ServerKeepAlive > math.MaxUint16*time.Second {
+		props.ServerKeepAlive = math.MaxUint16
+	}
+
+	if b.MaxPacketSize > 0 {
+		props.MaximumPacketSize = uint32(b.MaxPacketSize)
+		if b.MaxPacketSize > math.MaxUint32 {
+			props.MaximumPacketSize = math.MaxUint32
+		}
+	}
+
+	if b.TopicAliasing != nil {
+		props.TopicAliasMaximum = b.TopicAliasing.Inbound
+	}
+
+	return props
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+// records the advertised limits of outgoing connacks
+type connackRecorder struct {
+	props chan interface{}
+}
+
+func (r *connackRecorder) Inbound(client Client, pkt packet.Packet) (packet.Packet, error) {
+	return pkt, nil
+}
+
+func (r *connackRecorder) Outbound(client Client, pkt packet.Packet) (packet.Packet, error) {
+	if _, ok := pkt.(*packet.ConnackPacket); ok {
+		r.props <- client.Context().Get(ConnackPropertiesKey)
+	}
+
+	return pkt, nil
+}
+
+func TestConnackProperties(t *testing.T) {
+	broker := New()
+	broker.ReceiveMaximum = 10
+	broker.MaxPacketSize = math.MaxUint32 + 1
+	broker.ServerKeepAlive = time.Minute
+	broker.TopicAliasing = &TopicAliasing{Inbound: 5}
+
+	assert.Equal(t, ConnackProperties{
+		ReceiveMaximum:    10,
+		MaximumPacketSize: math.MaxUint32,
+		ServerKeepAlive:   60,
+		TopicAliasMaximum: 5,
+	}, broker.connackProperties())
+
+	broker.MaxPacketSize = 0
+	broker.TopicAliasing = nil
+	assert.Equal(t, ConnackProperties{
+		ReceiveMaximum:  10,
+		ServerKeepAlive: 60,
+	}, broker.connackProperties())
+
+	// the keep alive is capped instead of wrapped around
+	broker.ServerKeepAlive = 24 * time.Hour
+	assert.Equal(t, uint16(math.MaxUint16), broker.connackProperties().ServerKeepAlive)
+}
+
+func TestAdvertiseLimits(t *testing.T) {
+	recorder := &connackRecorder{props: make(chan interface{}, 2)}
+
+	broker := New()
+	broker.ReceiveMaximum = 10
+	broker.MaxPacketSize = 1024
+	broker.Use(recorder)
+
+	port, done := runBroker(t, broker, 2)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	// limits are not advertised by default
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(packet.NewConnackPacket()).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	assert.Nil(t, <-recorder.props)
+
+	broker.AdvertiseLimits = true
+
+	conn, err = transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(packet.NewConnackPacket()).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	assert.Equal(t, ConnackProperties{
+		ReceiveMaximum:    10,
+		MaximumPacketSize: 1024,
+	}, <-recorder.props)
+
+	<-done
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import "sync"
+
+// An AffinitySink receives changes of the session ownership in clustered
+// deployments. An external load balancer or DNS layer may use the mapping to
+// steer reconnecting clients to the node that owns their session.
+type AffinitySink interface {
+	// Claim is called when a client with the specified id has connected
+	// and its session is now owned by the specified node.
+	Claim(clientID, node string) error
+
+	// Release is called when the session of the client with the specified
+	// id has been discarded and therefore is no longer owned by the node.
+	Release(clientID, node string) error
+}
+
+// A MemoryAffinitySink keeps the session ownership mapping in memory.
+type MemoryAffinitySink struct {
+	owners map[string]string
+	mutex  sync.Mutex
+}
+
+// NewMemoryAffinitySink returns a new MemoryAffinitySink.
+func NewMemoryAffinitySink() *MemoryAffinitySink {
+	return &MemoryAffinitySink{
+		owners: make(map[string]string),
+	}
+}
+
+// Claim will set the node as the owner of the client id.
+func (s *MemoryAffinitySink) Claim(clientID, node string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.owners[clientID] = node
+
+	return nil
+}
+
+// Release will remove the ownership if the client id is still owned by the
+// specified node.
+func (s *MemoryAffinitySink) Release(clientID, node string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.owners[clientID] == node {
+		delete(s.owners, clientID)
+	}
+
+	return nil
+}
+
+// Owner will return the node that currently owns the client id.
+func (s *MemoryAffinitySink) Owner(clientID string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	node, ok := s.owners[clientID]
+	return node, ok
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gomqtt/packet"
+)
+
+// TopicAliasAnnotation is the metadata key of the TopicAlias of a message
+// (see Broker.Annotate).
+//
+// The broker keeps the alias tables, while encoding the aliases is left to the
+// Middleware. An inbound Middleware attaches the alias of incoming publishes,
+// whose topic is then resolved or recorded before it is rewritten. Outgoing
+// publishes carry the assigned alias, the topic may be omitted once the alias
+// has been established.
+const TopicAliasAnnotation = "topic_alias"
+
+// A TopicAlias is the alias of the topic of a message.
+type TopicAlias struct {
+	// The alias of the topic.
+	Alias uint16
+
+	// Whether the alias has already been sent to the client along with the
+	// topic, only set for outgoing publishes.
+	Established bool
+}
+
+// TopicAliasing configures the per-connection topic aliases.
+type TopicAliasing struct {
+	// The maximum alias clients may use for incoming publishes. A zero value
+	// refuses all incoming aliases.
+	Inbound uint16
+
+	// The Outbound callback returns the maximum alias accepted by the client,
+	// e.g. the announced Topic Alias Maximum. A zero value disables outgoing
+	// aliases for the client.
+	Outbound func(client Client) uint16
+
+	// The number of messages that have to be sent to a topic before it is
+	// assigned an alias. Once all aliases are assigned, further topics are
+	// sent without an alias.
+	Hot int
+
+	// The minimum length of aliased topics.
+	MinLength int
+}
+
+// NewTopicAliasing returns a TopicAliasing with default settings.
+func NewTopicAliasing() *TopicAliasing {
+	return &TopicAliasing{
+		Inbound:   10,
+		Hot:       3,
+		MinLength: 8,
+	}
+}
+
+// the maximum number of tracked topics that have not yet been aliased
+const maxAliasCandidates = 1024
+
+// the aliases of a connection
+type topicAliases struct {
+	config   TopicAliasing
+	inbound  map[uint16]string
+	outbound map[string]uint16
+	counts   map[string]int
+	maximum  uint16
+	resolved bool
+	mutex    sync.Mutex
+}
+
+// returns the aliases of a new connection
+func newTopicAliases(config TopicAliasing) *topicAliases {
+	return &topicAliases{
+		config:   config,
+		inbound:  make(map[uint16]string),
+		outbound: make(map[string]uint16),
+		counts:   make(map[string]int),
+	}
+}
+
+// resolves the topic of an incoming aliased message or records a new alias
+func (a *topicAliases) resolve(msg *packet.Message, alias uint16) error {
+	// check alias
+	if alias == 0 || alias > a.config.Inbound {
+		return fmt.Errorf("invalid topic alias %d", alias)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// record alias
+	if msg.Topic != "" {
+		a.inbound[alias] = msg.Topic
+		return nil
+	}
+
+	// lookup alias
+	topic, ok := a.inbound[alias]
+	if !ok {
+		return fmt.Errorf("unknown topic alias %d", alias)
+	}
+
+	msg.Topic = topic
+
+	return nil
+}
+
+// returns the alias of an outgoing topic and assigns a new alias to hot
+// topics if there are aliases left
+func (a *topicAliases) assign(client Client, topic string) (TopicAlias, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// get maximum of client
+	if !a.resolved {
+		a.resolved = true
+		if a.config.Outbound != nil {
+			a.maximum = a.config.Outbound(client)
+		}
+	}
+
+	// check if aliasing is possible
+	if a.maximum == 0 || len(topic) < a.config.MinLength {
+		return TopicAlias{}, false
+	}
+
+	// use established alias
+	if alias, ok := a.outbound[topic]; ok {
+		return TopicAlias{Alias: alias, Established: true}, true
+	}
+
+	// check if aliases are left
+	if len(a.outbound) >= int(a.maximum) {
+		return TopicAlias{}, false
+	}
+
+	// count topic and bound the candidates
+	if _, ok := a.counts[topic]; !ok && len(a.counts) >= maxAliasCandidates {
+		a.counts = make(map[string]int)
+	}
+	a.counts[topic]++
+	if a.counts[topic] < a.config.Hot {
+		return TopicAlias{}, false
+	}
+
+	// assign alias
+	delete(a.counts, topic)
+	alias := uint16(len(a.outbound) + 1)
+	a.outbound[topic] = alias
+
+	return TopicAlias{Alias: alias}, true
+}
+
+// resolves the topic of an incoming publish that carries an alias
+func (c *remoteClient) resolveAlias(msg *packet.Message) error {
+	value, ok := c.broker.Annotations(msg)[TopicAliasAnnotation]
+	if !ok {
+		return nil
+	}
+
+	// the alias is not passed to the receivers
+	c.broker.annotations().unset(msg, TopicAliasAnnotation)
+
+	alias, ok := value.(TopicAlias)
+	if !ok {
+		return fmt.Errorf("invalid topic alias annotation")
+	} else if c.aliases == nil {
+		return fmt.Errorf("topic aliases are disabled")
+	}
+
+	return c.aliases.resolve(msg, alias.Alias)
+}
+
+// attaches the alias of the topic to an outgoing publish
+func (c *remoteClient) attachAlias(msg *packet.Message) {
+	if c.aliases == nil {
+		return
+	}
+
+	if alias, ok := c.aliases.assign(c, msg.Topic); ok {
+		c.broker.Annotate(msg, TopicAliasAnnotation, alias)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+// a middleware that encodes aliases in topics like "topic@alias" and "@alias"
+type aliasMiddleware struct {
+	broker *Broker
+}
+
+func (m *aliasMiddleware) Inbound(client Client, pkt packet.Packet) (packet.Packet, error) {
+	if p, ok := pkt.(*packet.PublishPacket); ok {
+		if i := strings.LastIndex(p.Message.Topic, "@"); i >= 0 {
+			alias, err := strconv.Atoi(p.Message.Topic[i+1:])
+			if err != nil {
+				return nil, err
+			}
+
+			p.Message.Topic = p.Message.Topic[:i]
+			m.broker.Annotate(&p.Message, TopicAliasAnnotation, TopicAlias{Alias: uint16(alias)})
+		}
+	}
+
+	return pkt, nil
+}
+
+func (m *aliasMiddleware) Outbound(client Client, pkt packet.Packet) (packet.Packet, error) {
+	if p, ok := pkt.(*packet.PublishPacket); ok {
+		if alias, ok := m.broker.Annotations(&p.Message)[TopicAliasAnnotation].(TopicAlias); ok {
+			if alias.Established {
+				p.Message.Topic = ""
+			}
+
+			p.Message.Topic = fmt.Sprintf("%s@%d", p.Message.Topic, alias.Alias)
+		}
+	}
+
+	return pkt, nil
+}
+
+func TestTopicAliases(t *testing.T) {
+	config := NewTopicAliasing()
+	config.Inbound = 2
+	config.Outbound = func(Client) uint16 {
+		return 1
+	}
+	config.Hot = 2
+
+	aliases := newTopicAliases(*config)
+
+	// inbound
+	msg := &packet.Message{Topic: "foo/bar/baz"}
+	assert.NoError(t, aliases.resolve(msg, 1))
+
+	msg = &packet.Message{}
+	assert.NoError(t, aliases.resolve(msg, 1))
+	assert.Equal(t, "foo/bar/baz", msg.Topic)
+
+	assert.Error(t, aliases.resolve(&packet.Message{}, 2))
+	assert.Error(t, aliases.resolve(&packet.Message{Topic: "foo"}, 0))
+	assert.Error(t, aliases.resolve(&packet.Message{Topic: "foo"}, 3))
+
+	// outbound
+	client := newFakeClient()
+
+	_, ok := aliases.assign(client, "short")
+	assert.False(t, ok)
+
+	_, ok = aliases.assign(client, "foo/bar/baz")
+	assert.False(t, ok)
+
+	alias, ok := aliases.assign(client, "foo/bar/baz")
+	assert.True(t, ok)
+	assert.Equal(t, TopicAlias{Alias: 1}, alias)
+
+	alias, ok = aliases.assign(client, "foo/bar/baz")
+	assert.True(t, ok)
+	assert.Equal(t, TopicAlias{Alias: 1, Established: true}, alias)
+
+	// all aliases are assigned
+	aliases.assign(client, "foo/bar/qux")
+	_, ok = aliases.assign(client, "foo/bar/qux")
+	assert.False(t, ok)
+}
+
+func TestTopicAliasing(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "sensors/#"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	publish1 := packet.NewPublishPacket()
+	publish1.Message.Topic = "sensors/temperature@1"
+	publish1.Message.Payload = []byte("1")
+
+	delivered1 := packet.NewPublishPacket()
+	delivered1.Message.Topic = "sensors/temperature@1"
+	delivered1.Message.Payload = []byte("1")
+
+	publish2 := packet.NewPublishPacket()
+	publish2.Message.Topic = "@1"
+	publish2.Message.Payload = []byte("2")
+
+	delivered2 := packet.NewPublishPacket()
+	delivered2.Message.Topic = "@1"
+	delivered2.Message.Payload = []byte("2")
+
+	broker := New()
+	broker.TopicAliasing = NewTopicAliasing()
+	broker.TopicAliasing.Outbound = func(Client) uint16 {
+		return 10
+	}
+	broker.TopicAliasing.Hot = 1
+	broker.Use(&aliasMiddleware{broker: broker})
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(publish1).
+		Receive(delivered1).
+		Send(publish2).
+		Receive(delivered2).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+}
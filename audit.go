@@ -0,0 +1,395 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// An AuditRecord is an entry of the audit trail.
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+
+	// The recorded action: "connect", "disconnect", "authentication_failed",
+	// "subscribe", "unsubscribe", "subscription_revoked", "session_taken_over"
+	// or the name of an administrative action (see RecordAction).
+	Action string `json:"action"`
+
+	// The identity of the client, if any.
+	UUID     string `json:"uuid,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	RemoteIP string `json:"remote_ip,omitempty"`
+
+	// The topic filter or the target of an administrative action, if any.
+	Target string `json:"target,omitempty"`
+}
+
+// An AuditSink stores the records of the audit trail. Sinks that implement
+// io.Closer are closed when the Auditor is stopped.
+type AuditSink interface {
+	// Write should durably store the record.
+	Write(record AuditRecord) error
+}
+
+// An Auditor records an audit trail of the connects, disconnects,
+// authentication failures and subscription changes of clients as well as the
+// administrative actions carried out on the broker and writes it to the
+// sinks. Unlike the Logger, which traces the processing of packets for
+// debugging, the audit trail describes who did what and when. The Auditor can
+// be attached to a broker as a Subsystem.
+type Auditor struct {
+	// The sinks that receive every record.
+	Sinks []AuditSink
+
+	// The maximum number of records that wait to be written. Further records
+	// are dropped as the auditor must not block the broker.
+	QueueSize int
+
+	Logger Logger
+
+	broker  *Broker
+	remove  func()
+	queue   chan AuditRecord
+	dropped int64
+
+	tomb tomb.Tomb
+}
+
+// NewAuditor returns a new Auditor that writes the audit trail of the broker
+// to the specified sinks.
+func NewAuditor(broker *Broker, sinks ...AuditSink) *Auditor {
+	return &Auditor{
+		Sinks:     sinks,
+		QueueSize: 1000,
+		broker:    broker,
+	}
+}
+
+// Start will start recording the events of the broker and launch the
+// goroutine that writes the records.
+func (a *Auditor) Start() error {
+	a.queue = make(chan AuditRecord, a.QueueSize)
+	a.remove = a.broker.OnEvent(a.enqueue)
+
+	a.tomb.Go(a.writer)
+
+	return nil
+}
+
+// Stop will stop recording, write the remaining records and close the sinks.
+func (a *Auditor) Stop() error {
+	a.remove()
+
+	a.tomb.Kill(nil)
+	a.tomb.Wait()
+
+	var err error
+
+	for _, sink := range a.Sinks {
+		if closer, ok := sink.(io.Closer); ok {
+			_err := closer.Close()
+			if err == nil {
+				err = _err
+			}
+		}
+	}
+
+	return err
+}
+
+// Dropped returns the number of records that have been dropped because the
+// queue was full.
+func (a *Auditor) Dropped() int64 {
+	return atomic.LoadInt64(&a.dropped)
+}
+
+// converts and queues an audited event
+func (a *Auditor) enqueue(event *Event) {
+	record := AuditRecord{
+		Time:   time.Now(),
+		Target: event.Topic,
+	}
+
+	switch event.Type {
+	case ClientConnected:
+		record.Action = "connect"
+	case ClientDisconnected:
+		record.Action = "disconnect"
+	case AuthenticationFailed:
+		record.Action = "authentication_failed"
+	case Subscribed:
+		record.Action = "subscribe"
+	case Unsubscribed:
+		record.Action = "unsubscribe"
+	case SubscriptionRevoked:
+		record.Action = "subscription_revoked"
+	case SessionTakenOver:
+		record.Action = "session_taken_over"
+	case AdministrativeAction:
+		record.Action = event.Action
+		record.Target = event.Target
+	default:
+		return
+	}
+
+	// add identity
+	if event.Client != nil {
+		ctx := event.Client.Context()
+		record.UUID, _ = ctx.Get("uuid").(string)
+		record.ClientID, _ = ctx.Get("client_id").(string)
+		record.Username, _ = ctx.Get("username").(string)
+		record.RemoteIP, _ = ctx.Get("remote_ip").(string)
+	}
+
+	select {
+	case a.queue <- record:
+	default:
+		atomic.AddInt64(&a.dropped, 1)
+		a.log(LogWarn, "audit_record_dropped", map[string]interface{}{
+			"action": record.Action,
+		})
+	}
+}
+
+// writes the queued records to the sinks
+func (a *Auditor) writer() error {
+	for {
+		select {
+		case record := <-a.queue:
+			a.write(record)
+		case <-a.tomb.Dying():
+			// write remaining records
+			for len(a.queue) > 0 {
+				a.write(<-a.queue)
+			}
+
+			return tomb.ErrDying
+		}
+	}
+}
+
+// writes a record to all sinks
+func (a *Auditor) write(record AuditRecord) {
+	for _, sink := range a.Sinks {
+		err := sink.Write(record)
+		if err != nil {
+			a.log(LogError, "audit_write_failed", map[string]interface{}{
+				"action": record.Action,
+				"error":  err,
+			})
+		}
+	}
+}
+
+func (a *Auditor) log(level LogLevel, event string, fields map[string]interface{}) {
+	logEvent(a.Logger, level, event, fields)
+}
+
+// RecordAction will emit an AdministrativeAction event for an action that has
+// been carried out on the broker, e.g. by an admin API. The operations of the
+// broker like Drain, CloseClient and EraseClient are recorded automatically.
+func (b *Broker) RecordAction(action, target string) {
+	b.emit(&Event{
+		Type:   AdministrativeAction,
+		Action: action,
+		Target: target,
+	})
+}
+
+// A FileAuditSink writes the records as JSON lines to a file. The file is
+// rotated once it exceeds MaxSize bytes, the previous files are kept with the
+// suffixes ".1" (newest) to ".<Backups>" (oldest).
+type FileAuditSink struct {
+	Path    string
+	MaxSize int64
+	Backups int
+
+	file  *os.File
+	size  int64
+	mutex sync.Mutex
+}
+
+// NewFileAuditSink returns a new FileAuditSink that writes to the file at the
+// specified path and rotates it at 100 MB keeping 5 backups.
+func NewFileAuditSink(path string) *FileAuditSink {
+	return &FileAuditSink{
+		Path:    path,
+		MaxSize: 100 << 20,
+		Backups: 5,
+	}
+}
+
+// Write will append the record to the file and rotate the file if needed.
+func (s *FileAuditSink) Write(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// rotate full file
+	if s.MaxSize > 0 && s.size > 0 && s.size+int64(len(line))+1 > s.MaxSize {
+		err = s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	// open file lazily
+	if s.file == nil {
+		err = s.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(append(line, '\n'))
+	s.size += int64(n)
+
+	return err
+}
+
+// Rotate will close the current file and shift the backups, the next record
+// is written to a new file. It may be used as the LogRotator of a broker.
+func (s *FileAuditSink) Rotate() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.rotate()
+}
+
+// Close will close the current file.
+func (s *FileAuditSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+
+	return err
+}
+
+// opens the file for appending
+func (s *FileAuditSink) open() error {
+	file, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+
+	return nil
+}
+
+// closes the file and shifts the backups, the mutex must be held
+func (s *FileAuditSink) rotate() error {
+	if s.file != nil {
+		err := s.file.Close()
+		s.file = nil
+		if err != nil {
+			return err
+		}
+	}
+
+	s.size = 0
+
+	// drop current file if no backups are kept
+	if s.Backups <= 0 {
+		err := os.Remove(s.Path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	// shift backups, the oldest is overwritten
+	for i := s.Backups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.Path, i), fmt.Sprintf("%s.%d", s.Path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	err := os.Rename(s.Path, s.Path+".1")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// A WebhookAuditSink posts every record as JSON to a URL.
+type WebhookAuditSink struct {
+	URL string
+
+	// The client used for the requests, defaults to a client with a timeout
+	// of ten seconds.
+	Client *http.Client
+}
+
+// NewWebhookAuditSink returns a new WebhookAuditSink that posts to the url.
+func NewWebhookAuditSink(url string) *WebhookAuditSink {
+	return &WebhookAuditSink{
+		URL:    url,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Write will post the record and return an error if the response does not
+// indicate success.
+func (s *WebhookAuditSink) Write(record AuditRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.Client.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("audit webhook responded with status %d", res.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package broker
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+// A SyslogAuditSink writes the records as JSON to syslog.
+type SyslogAuditSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogAuditSink will connect to the syslog daemon at the address using
+// the network, e.g. "udp" and "localhost:514", or to the local daemon if the
+// network is empty. The records are written with the info severity of the
+// auth facility and the specified tag.
+func NewSyslogAuditSink(network, raddr, tag string) (*SyslogAuditSink, error) {
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SyslogAuditSink{writer: writer}, nil
+}
+
+// Write will send the record to syslog.
+func (s *SyslogAuditSink) Write(record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return s.writer.Info(string(data))
+}
+
+// Close will close the connection to the syslog daemon.
+func (s *SyslogAuditSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryAuditSink struct {
+	records []AuditRecord
+	mutex   sync.Mutex
+}
+
+func (s *memoryAuditSink) Write(record AuditRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.records = append(s.records, record)
+	return nil
+}
+
+func TestAuditor(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+	connect.Username = "user"
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	sink := &memoryAuditSink{}
+
+	broker := New()
+
+	err := broker.Attach(NewAuditor(broker, sink))
+	assert.NoError(t, err)
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return len(broker.currentClients()) == 0
+	})
+
+	broker.CloseClient("other")
+
+	err = broker.Close(time.Second)
+	assert.NoError(t, err)
+
+	var actions []string
+	for _, record := range sink.records {
+		actions = append(actions, record.Action)
+	}
+
+	assert.Equal(t, []string{"connect", "subscribe", "disconnect", "close_client"}, actions)
+	assert.Equal(t, "test", sink.records[0].ClientID)
+	assert.Equal(t, "user", sink.records[0].Username)
+	assert.NotEmpty(t, sink.records[0].RemoteIP)
+	assert.Equal(t, "test", sink.records[1].Target)
+	assert.Equal(t, "other", sink.records[3].Target)
+	assert.Empty(t, sink.records[3].ClientID)
+}
+
+func TestFileAuditSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+
+	sink := NewFileAuditSink(path)
+	sink.MaxSize = 50
+	sink.Backups = 2
+
+	for _, action := range []string{"a", "b", "c", "d"} {
+		err = sink.Write(AuditRecord{Action: action})
+		assert.NoError(t, err)
+	}
+
+	err = sink.Close()
+	assert.NoError(t, err)
+
+	// every record exceeds half of the size
+	read := func(path string) string {
+		data, err := ioutil.ReadFile(path)
+		assert.NoError(t, err)
+
+		var record AuditRecord
+		err = json.Unmarshal(data, &record)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, strings.Count(string(data), "\n"))
+
+		return record.Action
+	}
+
+	assert.Equal(t, "d", read(path))
+	assert.Equal(t, "c", read(path+".1"))
+	assert.Equal(t, "b", read(path+".2"))
+
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWebhookAuditSink(t *testing.T) {
+	received := make(chan AuditRecord, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var record AuditRecord
+		err := json.NewDecoder(r.Body).Decode(&record)
+		assert.NoError(t, err)
+
+		if record.Action == "fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		received <- record
+	}))
+	defer server.Close()
+
+	sink := NewWebhookAuditSink(server.URL)
+
+	err := sink.Write(AuditRecord{Action: "connect", ClientID: "test"})
+	assert.NoError(t, err)
+	assert.Equal(t, "test", (<-received).ClientID)
+
+	err = sink.Write(AuditRecord{Action: "fail"})
+	assert.Error(t, err)
+}
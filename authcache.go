@@ -0,0 +1,142 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// a cached authorization decision
+type authDecision struct {
+	ok      bool
+	expires time.Time
+}
+
+// the cache of the authorization decisions of a client by action and topic
+type authCache struct {
+	ttl        time.Duration
+	limit      int
+	decisions  [PublishAction + 1]map[string]authDecision
+	size       int
+	generation uint64
+	mutex      sync.Mutex
+}
+
+// returns the authorization cache of a new connection
+func newAuthCache(ttl time.Duration, limit int) *authCache {
+	a := &authCache{
+		ttl:   ttl,
+		limit: limit,
+	}
+
+	a.reset()
+
+	return a
+}
+
+// authorizes the action on the topic using the cached decision if available
+// or otherwise the backend, errors are not cached
+func (a *authCache) authorize(backend Backend, client Client, topic string, action Action) (bool, error) {
+	now := time.Now()
+
+	// get cached decision
+	a.mutex.Lock()
+	decision, ok := a.decisions[action][topic]
+	generation := a.generation
+	a.mutex.Unlock()
+
+	// check decision
+	if ok && now.Before(decision.expires) {
+		return decision.ok, nil
+	}
+
+	// ask backend
+	allowed, err := backend.Authorize(client, topic, action)
+	if err != nil {
+		return false, err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// skip decisions that have been invalidated in the meantime
+	if a.generation != generation {
+		return allowed, nil
+	}
+
+	// drop all decisions if full
+	if _, ok := a.decisions[action][topic]; !ok {
+		if a.limit > 0 && a.size >= a.limit {
+			a.reset()
+		}
+
+		a.size++
+	}
+
+	a.decisions[action][topic] = authDecision{
+		ok:      allowed,
+		expires: now.Add(a.ttl),
+	}
+
+	return allowed, nil
+}
+
+// drops all cached decisions
+func (a *authCache) invalidate() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.reset()
+	a.generation++
+}
+
+// replaces the decisions, the mutex must be held
+func (a *authCache) reset() {
+	for i := range a.decisions {
+		a.decisions[i] = make(map[string]authDecision)
+	}
+
+	a.size = 0
+}
+
+// InvalidateAuthorizations will drop the authorization decisions cached for
+// the connected clients with the specified client ids or for all connected
+// clients if no client id is specified (see AuthorizationCacheTTL). It has to
+// be called whenever the authorization rules of the backend change at runtime,
+// e.g. when an ACL is updated. Reauthorize drops all decisions itself.
+func (b *Broker) InvalidateAuthorizations(clientIDs ...string) {
+	b.RecordAction("invalidate_authorizations", strings.Join(clientIDs, ","))
+
+	for _, c := range b.currentClients() {
+		if c.authCache == nil {
+			continue
+		}
+
+		if len(clientIDs) == 0 {
+			c.authCache.invalidate()
+			continue
+		}
+
+		id, _ := c.Context().Get("client_id").(string)
+		for _, clientID := range clientIDs {
+			if id == clientID && id != "" {
+				c.authCache.invalidate()
+				break
+			}
+		}
+	}
+}
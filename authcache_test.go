@@ -0,0 +1,202 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+type failingAuthorizer struct {
+	Backend
+	calls int
+}
+
+func (f *failingAuthorizer) Authorize(client Client, topic string, action Action) (bool, error) {
+	f.calls++
+	return false, errors.New("failed")
+}
+
+func TestAuthorizationCache(t *testing.T) {
+	calls := 0
+
+	backend := NewMemoryBackend()
+	backend.Authorizer = func(client Client, topic string, action Action) bool {
+		calls++
+		return topic != "deny"
+	}
+
+	client := newFakeClient()
+	cache := newAuthCache(time.Hour, 3)
+
+	authorize := func(topic string, action Action) bool {
+		ok, err := cache.authorize(backend, client, topic, action)
+		assert.NoError(t, err)
+		return ok
+	}
+
+	// cached per topic and action
+	assert.True(t, authorize("foo", PublishAction))
+	assert.True(t, authorize("foo", PublishAction))
+	assert.True(t, authorize("foo", SubscribeAction))
+	assert.Equal(t, 2, calls)
+
+	// denials are cached
+	assert.False(t, authorize("deny", PublishAction))
+	assert.False(t, authorize("deny", PublishAction))
+	assert.Equal(t, 3, calls)
+
+	// full cache is dropped
+	assert.True(t, authorize("bar", PublishAction))
+	assert.True(t, authorize("foo", PublishAction))
+	assert.Equal(t, 5, calls)
+
+	// invalidated cache is dropped
+	cache.invalidate()
+	assert.True(t, authorize("foo", PublishAction))
+	assert.Equal(t, 6, calls)
+
+	// expired decisions are dropped
+	cache = newAuthCache(10*time.Millisecond, 0)
+	assert.True(t, authorize("foo", PublishAction))
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, authorize("foo", PublishAction))
+	assert.Equal(t, 8, calls)
+
+	// errors are not cached
+	failing := &failingAuthorizer{Backend: backend}
+	for i := 0; i < 2; i++ {
+		ok, err := cache.authorize(failing, client, "foo", SubscribeAction)
+		assert.Error(t, err)
+		assert.False(t, ok)
+	}
+	assert.Equal(t, 2, failing.calls)
+}
+
+func TestInvalidateAuthorizations(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "#"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	publish := func(topic string) *packet.PublishPacket {
+		pkt := packet.NewPublishPacket()
+		pkt.Message.Topic = topic
+		pkt.Message.Payload = []byte("test")
+		return pkt
+	}
+
+	var mutex sync.Mutex
+	denied := ""
+	calls := 0
+
+	backend := NewMemoryBackend()
+	backend.Authorizer = func(client Client, topic string, action Action) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls++
+		return action != PublishAction || topic != denied
+	}
+
+	var targets []string
+
+	broker := New()
+	broker.Backend = backend
+	broker.AuthorizationCacheTTL = time.Hour
+	broker.EventHandler = func(event *Event) {
+		if event.Type == AdministrativeAction && event.Action == "invalidate_authorizations" {
+			targets = append(targets, event.Target)
+		}
+	}
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(publish("foo")).
+		Receive(publish("foo")).
+		Test(t, conn)
+
+	// change acl
+	mutex.Lock()
+	denied = "foo"
+	mutex.Unlock()
+
+	// cached decision is used
+	tools.NewFlow().
+		Send(publish("foo")).
+		Receive(publish("foo")).
+		Test(t, conn)
+
+	broker.InvalidateAuthorizations("other")
+	broker.InvalidateAuthorizations("test")
+
+	tools.NewFlow().
+		Send(publish("foo")).
+		Send(publish("bar")).
+		Receive(publish("bar")).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	mutex.Lock()
+	assert.Equal(t, 4, calls)
+	mutex.Unlock()
+
+	assert.Equal(t, []string{"other", "test"}, targets)
+}
+
+func BenchmarkAuthorizationCache(b *testing.B) {
+	backend := NewMemoryBackend()
+	backend.Authorizer = func(client Client, topic string, action Action) bool {
+		return true
+	}
+
+	client := newFakeClient()
+	cache := newAuthCache(time.Hour, 1000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := cache.authorize(backend, client, "hot/topic", PublishAction)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
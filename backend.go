@@ -15,19 +15,79 @@
 package broker
 
 import (
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gomqtt/packet"
 	"github.com/gomqtt/tools"
 )
 
+// An Action describes an operation a client wants to perform on a topic.
+type Action int
+
+const (
+	// SubscribeAction is the action of subscribing to a topic filter.
+	SubscribeAction Action = iota
+
+	// PublishAction is the action of publishing a message to a topic.
+	PublishAction
+)
+
 // A Backend provides effective queuing functionality to a Broker and its Clients.
+//
+// The broker calls the methods of a Backend concurrently from the goroutines
+// of all clients and some methods are also called concurrently for the same
+// client:
+//
+//   - Authenticate, AuthenticateCertificate and Setup are called sequentially
+//     before any other method is called for the client.
+//   - Authorize, Subscribe, Unsubscribe and Publish may be called concurrently
+//     for the same client, e.g. by the reader of the client, the delivery of
+//     deferred retained messages and a Reload of the broker.
+//   - Terminate is the last method called for a client. It may run
+//     concurrently with calls that are still in flight for the client, with
+//     Publish calls of other clients that deliver to the client and with the
+//     Setup of another client that resumes the same session.
+//
+// A Backend must therefore synchronize all of its state. Subscriptions that
+// arrive after Terminate must not leave the client subscribed and messages
+// for a session must neither be lost nor queued twice while the session
+// changes hands.
 type Backend interface {
+	// Start is called once when the broker starts. Start should launch any
+	// background workers (e.g. expiry sweepers or replication) and may preload
+	// caches before the first client is handled.
+	Start(broker *Broker) error
+
+	// Stop is called once when the broker stops. Stop should stop all
+	// background workers that have been launched in Start.
+	Stop() error
+
 	// Authenticate should authenticate the client using the user and password
 	// values and return true if the client is eligible to continue or false
 	// when the broker should terminate the connection.
 	Authenticate(client Client, user, password string) (bool, error)
 
+	// AuthenticateCertificate is called before Authenticate if the client
+	// presented a certificate chain, starting with the leaf certificate.
+	// AuthenticateCertificate should return true if the chain authenticates
+	// the client, in which case Authenticate is not called. It may also store
+	// a username derived from the certificate as "username" in the clients
+	// context. If false is returned, the client is authenticated using
+	// Authenticate.
+	AuthenticateCertificate(client Client, chain []*x509.Certificate) (bool, error)
+
+	// Authorize should return true if the client is allowed to perform the
+	// action on the specified topic. The broker calls Authorize for every
+	// subscription in a SUBSCRIBE packet and for every message that is about to
+	// be published. Denied subscriptions are answered with a failure return code
+	// and denied messages are acknowledged but silently dropped.
+	Authorize(client Client, topic string, action Action) (bool, error)
+
 	// Setup is called when a new client comes online and is successfully
 	// authenticated. Setup should return the already stored session for the
 	// supplied id or create and return a new one. If clean is set to true it
@@ -70,56 +130,423 @@ type Backend interface {
 	// connect.
 	//
 	// Note: The Backend may also cleanup previously allocated resources for
-	// that client as the broker will close the connection when the call
-	// returns.
+	// that client. With the TerminateSync mode, the broker closes the
+	// connection when the call returns, with the TerminateAsync mode the call
+	// may outlive the connection.
 	Terminate(client Client) error
 }
 
+// A PasswordChecker verifies the passwords of users against stored hashes,
+// like the password files of the passwd package.
+type PasswordChecker interface {
+	// CheckPassword should return whether the user is known and whether the
+	// password matches the stored hash of the user.
+	CheckPassword(user, password string) (known, valid bool)
+}
+
 // A MemoryBackend stores everything in memory.
 type MemoryBackend struct {
 	Logins map[string]string
 
-	queue         *tools.Tree
-	retained      *tools.Tree
-	offlineQueue  *tools.Tree
+	// The LoginSecrets provider resolves the passwords of users that are not
+	// listed in Logins, using the username as the secret name.
+	LoginSecrets SecretProvider
+
+	// The Passwords checker verifies the passwords of users that are not
+	// listed in Logins against stored hashes, e.g. a password file of the
+	// passwd package or SCRAMCredentials. Users unknown to the checker are
+	// resolved using the LoginSecrets. A checker that implements the Reloader
+	// interface is reloaded by Reload.
+	Passwords PasswordChecker
+
+	// If CertificateRoots is set, clients presenting a certificate chain that
+	// is valid for client authentication and issued by one of the roots are
+	// authenticated with the identity of the certificate as their username
+	// (see CertificateIdentity). The optional RevocationChecker is consulted
+	// for all certificates of the verified chain.
+	CertificateRoots  *x509.CertPool
+	RevocationChecker RevocationChecker
+
+	// The Authorizer callback decides if a client may perform an action on a
+	// topic. All actions are allowed if no callback is set.
+	Authorizer func(client Client, topic string, action Action) bool
+
+	// Clients are anonymous if they have been accepted without verifying
+	// credentials, because they connected without a username or no
+	// credentials are configured using Logins, Passwords or LoginSecrets.
+	// Clients without a username are refused once credentials are
+	// configured unless AllowAnonymous is set. Without configured
+	// credentials all clients are accepted, which Start reports with an
+	// "anonymous_access" warning unless AllowAnonymous is set explicitly.
+	AllowAnonymous bool
+
+	// The AnonymousAuthorizer callback is the default ACL of anonymous
+	// clients and decides instead of the Authorizer. If AnonymousPrefix is
+	// set, anonymous clients are additionally restricted to the topics and
+	// topic filters starting with the prefix, e.g. "public/".
+	AnonymousAuthorizer func(client Client, topic string, action Action) bool
+	AnonymousPrefix     string
+
+	// The interval in which expired sessions are removed by the reaper that
+	// is launched in Start.
+	ReapInterval time.Duration
+
+	// If RetainedPath is set, retained messages are persisted to an
+	// append-only log at the path that is loaded and compacted in Start.
+	RetainedPath string
+
+	// If SessionPath is set, the stored sessions of clients that connected
+	// with clean=false are persisted to files in the directory at the path
+	// (see FileSession) and restored in Start. The inflight QOS 1 and QOS 2
+	// flows, subscriptions, wills and queued offline messages of these
+	// sessions survive a restart of the broker.
+	SessionPath string
+
+	// The interval in which the retained log is synced to disk and compacted
+	// if necessary. A zero interval syncs after every change.
+	RetainedSyncInterval time.Duration
+
+	// The RetainedQuotas limit the retained messages stored per topic prefix.
+	// Overlapping quotas are all enforced.
+	RetainedQuotas []RetainedQuota
+
+	// The MaxRetainedMessages limit the retained messages stored in total. If
+	// the limit is exceeded, the oldest retained messages are evicted.
+	MaxRetainedMessages int
+
+	// If RetainedTTL is set, retained messages are purged by a sweeper that
+	// runs in the RetainedSweepInterval once they have been retained for
+	// longer than the TTL. Messages loaded from the retained log are retained
+	// from the time they have been loaded.
+	RetainedTTL           time.Duration
+	RetainedSweepInterval time.Duration
+
+	// The RetainedSearchBudget limits the nodes of the retained tree that are
+	// visited while looking up the retained messages of a subscription. The
+	// lookup is aborted with ErrSearchBudget once the budget is exhausted.
+	// Subscribe rejects the subscription in that case, while the retained
+	// messages of subscriptions that are loaded after the SUBACK using
+	// LoadRetained are skipped. A zero budget disables the limit.
+	RetainedSearchBudget int
+
+	// The CleanPolicy defines how the queued offline messages and the
+	// unacknowledged messages of a stored session are handled if its client
+	// reconnects with a clean session. The DeadLetterHandler receives the
+	// messages if the CleanDeadLetter policy is set. It is called
+	// synchronously during Setup and must not call the backend.
+	CleanPolicy       CleanPolicy
+	DeadLetterHandler func(client Client, msgs []*packet.Message)
+
+	// The PacketIDs callback returns the packet id sequence of new sessions.
+	// Defaults to a sequence starting at one.
+	PacketIDs func() Sequence
+
+	// If HistorySize is set, the last HistorySize messages of every topic are
+	// kept and replayed to clients that request them (see HistoryStore).
+	HistorySize int
+
+	// If Tenants is set, every client is isolated in the namespace of the
+	// tenant returned by the callback (see TenantByUsername,
+	// TenantByCertificate and TenantByContext). The topics of isolated clients
+	// are prefixed with "<TenantPrefix><tenant>/" and the prefix is removed on
+	// delivery, so tenants cannot see each other's topics. Clients without a
+	// tenant are isolated in the DefaultTenant, which defaults to "default".
+	// Only the system client and the clients accepted by TenantAdmins are not
+	// isolated and see the prefixed topics of all tenants, local clients like
+	// the KafkaExporter have to be accepted explicitly.
+	Tenants       func(client Client) string
+	TenantPrefix  string
+	DefaultTenant string
+	TenantAdmins  func(client Client) bool
+
+	// The TenantQuota limits the resources of every tenant that is not listed
+	// in TenantQuotas.
+	TenantQuota  TenantQuota
+	TenantQuotas map[string]TenantQuota
+
+	// If DeliveryWorkers is set, Publish does not write to the subscribers
+	// directly, but queues the messages per subscriber for a pool of workers
+	// of that size, so that a subscriber whose connection blocks does not
+	// stall the delivery to the other subscribers. The DeliveryQueue limits
+	// the messages queued or being delivered per subscriber and defaults to
+	// 1000. If the queue is full, QOS 0 messages are dropped while
+	// subscribers of QOS 1 and 2 messages are closed and the messages are
+	// added to their session.
+	DeliveryWorkers int
+	DeliveryQueue   int
+
+	queue        *shardedTree
+	retained     *retainedTree
+	offlineQueue *shardedTree
+
+	retainedLog    *retainedLog
+	quotas         retainedQuotas
+	retainedAt     map[string]time.Time
+	retainedExpiry map[string]time.Time
+	retainedStats  RetainedStats
+	trackedTenants map[string]bool
+	publishers     map[string]string
+	versions       map[string]uint64
+	version        uint64
+	subscribedAt   map[Client]map[string]uint64
+	retainedMutex  sync.Mutex
+
+	history      *tools.Tree
+	historyMutex sync.Mutex
+
+	routes      map[Client]map[string]bool
+	options     map[Client]map[string]SubscriptionOptions
+	optioned    int64
+	routesMutex sync.Mutex
 
 	sessions      map[string]*MemorySession
+	tenantClients map[string]map[Client]bool
 	sessionsMutex sync.Mutex
+
+	// the offline mutex serializes the queueing of missed messages with the
+	// handover of sessions, it is acquired after the sessions mutex and
+	// changes of the current client of a session must hold both
+	offlineMutex sync.RWMutex
+
+	// the clients mutex prevents subscriptions of terminated clients
+	clientsMutex sync.RWMutex
+
+	// the queued callback is called without holding any lock for every
+	// message that has been added to an offline session
+	queued func(session *MemorySession, msg *packet.Message, deadline time.Time) error
+
+	broker     *Broker
+	dispatcher *dispatcher
+	quit       chan struct{}
 }
 
 // NewMemoryBackend returns a new MemoryBackend.
 func NewMemoryBackend() *MemoryBackend {
 	return &MemoryBackend{
-		queue:        tools.NewTree(),
-		retained:     tools.NewTree(),
-		offlineQueue: tools.NewTree(),
-		sessions:     make(map[string]*MemorySession),
+		ReapInterval:          time.Minute,
+		RetainedSyncInterval:  time.Second,
+		RetainedSweepInterval: time.Minute,
+		TenantPrefix:          "tenants/",
+		queue:                 newShardedTree(),
+		retained:              newRetainedTree(),
+		offlineQueue:          newShardedTree(),
+		history:               tools.NewTree(),
+		sessions:              make(map[string]*MemorySession),
+	}
+}
+
+// Start will restore the persisted sessions if SessionPath is set and launch
+// the reaper that periodically removes expired sessions if ReapInterval is
+// positive. If RetainedPath is set, it will also load the persisted retained
+// messages and launch the syncer that periodically syncs and compacts the log.
+// If RetainedSweepInterval is set, it will also launch the sweeper that purges
+// retained messages that exceeded the RetainedTTL or their expiry interval.
+// If DeliveryWorkers is set, it will also launch the delivery workers.
+func (m *MemoryBackend) Start(broker *Broker) error {
+	m.sessionsMutex.Lock()
+	defer m.sessionsMutex.Unlock()
+
+	// check if already started
+	if m.quit != nil {
+		return fmt.Errorf("backend already started")
+	}
+
+	// restore sessions
+	if m.SessionPath != "" {
+		err := m.loadSessions(broker)
+		if err != nil {
+			return err
+		}
+	}
+
+	// load retained messages
+	if m.RetainedPath != "" {
+		err := m.loadRetained()
+		if err != nil {
+			return err
+		}
+	}
+
+	// report implicit anonymous access
+	if broker != nil && !m.AllowAnonymous && !m.credentials() && m.CertificateRoots == nil {
+		broker.log(LogWarn, "anonymous_access", map[string]interface{}{
+			"reason": "no credentials configured",
+		})
+	}
+
+	m.broker = broker
+	m.quit = make(chan struct{})
+	if m.ReapInterval > 0 {
+		go m.reap(m.quit)
+	}
+
+	if m.retainedLog != nil && m.RetainedSyncInterval > 0 {
+		go m.syncer(m.quit)
+	}
+
+	if m.RetainedSweepInterval > 0 {
+		go m.sweeper(m.quit)
 	}
+
+	if m.DeliveryWorkers > 0 {
+		if m.dispatcher == nil {
+			m.dispatcher = newDispatcher(m, m.DeliveryWorkers, m.DeliveryQueue)
+		}
+
+		m.dispatcher.start()
+	}
+
+	return nil
+}
+
+// Stop will stop the reaper and close the retained log if available. The
+// delivery workers exit once they delivered the queued messages.
+func (m *MemoryBackend) Stop() error {
+	m.sessionsMutex.Lock()
+	defer m.sessionsMutex.Unlock()
+
+	// check if started
+	if m.quit == nil {
+		return fmt.Errorf("backend not started")
+	}
+
+	close(m.quit)
+	m.quit = nil
+
+	if m.dispatcher != nil {
+		m.dispatcher.stop()
+	}
+
+	m.retainedMutex.Lock()
+	defer m.retainedMutex.Unlock()
+
+	// close retained log
+	if m.retainedLog != nil {
+		err := m.retainedLog.close()
+		m.retainedLog = nil
+		return err
+	}
+
+	return nil
+}
+
+// Reload will reload the Passwords if they implement the Reloader interface.
+func (m *MemoryBackend) Reload() error {
+	if reloader, ok := m.Passwords.(Reloader); ok {
+		return reloader.Reload()
+	}
+
+	return nil
 }
 
 // Authenticate authenticates a clients credentials by matching them to the
-// saved Logins map.
+// saved Logins map, the hashes of the Passwords checker or the passwords
+// resolved using LoginSecrets. Errors of the LoginSecrets provider other than
+// ErrSecretNotFound are returned.
 func (m *MemoryBackend) Authenticate(client Client, user, password string) (bool, error) {
-	// allow all if there are no logins
-	if m.Logins == nil {
+	// allow all if there are no logins and anonymous clients if allowed
+	if !m.credentials() || (user == "" && m.AllowAnonymous) {
+		client.Context().Set("anonymous", true)
 		return true, nil
 	}
 
 	// check login
-	if pw, ok := m.Logins[user]; ok && pw == password {
-		return true, nil
+	if pw, ok := m.Logins[user]; ok {
+		return subtle.ConstantTimeCompare([]byte(pw), []byte(password)) == 1, nil
+	}
+
+	// check password hash
+	if m.Passwords != nil {
+		known, valid := m.Passwords.CheckPassword(user, password)
+		if known {
+			return valid, nil
+		}
+	}
+
+	// check secret
+	if m.LoginSecrets != nil {
+		secret, err := m.LoginSecrets.Secret(user)
+		if err == ErrSecretNotFound {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		return subtle.ConstantTimeCompare(secret, []byte(password)) == 1, nil
 	}
 
 	return false, nil
 }
 
+// AuthenticateCertificate will verify the chain against the CertificateRoots
+// and store the identity of the leaf certificate as "username" in the clients
+// context. It will return false if no roots are configured or the chain is not
+// valid.
+func (m *MemoryBackend) AuthenticateCertificate(client Client, chain []*x509.Certificate) (bool, error) {
+	// check roots
+	if m.CertificateRoots == nil || len(chain) == 0 {
+		return false, nil
+	}
+
+	// verify chain
+	ok, err := verifyCertificate(chain, m.CertificateRoots, m.RevocationChecker)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	client.Context().Set("username", CertificateIdentity(chain[0]))
+
+	return true, nil
+}
+
+// Authorize will call the configured Authorizer callback to authorize the
+// action. It will allow all actions if no callback has been set. Topics of
+// isolated clients are passed without the namespace of their tenant.
+// Subscriptions exceeding the MaxSubscriptions quota of the tenant are denied.
+func (m *MemoryBackend) Authorize(client Client, topic string, action Action) (bool, error) {
+	// check subscription quota of tenant
+	if action == SubscribeAction && !m.admitSubscription(client, topic) {
+		return false, nil
+	}
+
+	// apply the default acl of anonymous clients
+	if anonymous(client) {
+		if !strings.HasPrefix(topic, m.AnonymousPrefix) {
+			return false, nil
+		}
+
+		if m.AnonymousAuthorizer != nil {
+			return m.AnonymousAuthorizer(client, topic, action), nil
+		}
+	}
+
+	// allow all if there is no authorizer
+	if m.Authorizer == nil {
+		return true, nil
+	}
+
+	return m.Authorizer(client, topic, action), nil
+}
+
+// returns whether credentials are configured
+func (m *MemoryBackend) credentials() bool {
+	return m.Logins != nil || m.Passwords != nil || m.LoginSecrets != nil
+}
+
+// returns whether the client has been accepted without verifying credentials
+func anonymous(client Client) bool {
+	ok, _ := client.Context().Get("anonymous").(bool)
+	return ok
+}
+
 // Setup returns the already stored session for the supplied id or creates
 // and returns a new one. If clean is set to true it will additionally reset
 // the session. If the supplied id has a zero length, a new session is returned
 // that is not stored further. If an existing session has been found it will
 // retrieve all stored messages from offline subscriptions and begin with
 // forwarding them in a separate goroutine. Furthermore, it will disconnect
-// any client connected with the same client id.
+// any client connected with the same client id. Sessions that have expired
+// but have not yet been removed by the reaper are not resumed.
 func (m *MemoryBackend) Setup(client Client, id string, clean bool) (Session, bool, error) {
 	m.sessionsMutex.Lock()
 	defer m.sessionsMutex.Unlock()
@@ -129,14 +556,40 @@ func (m *MemoryBackend) Setup(client Client, id string, clean bool) (Session, bo
 
 	// return a new temporary session if id is zero
 	if len(id) == 0 {
-		sess := NewMemorySession()
+		err := m.admit(client, nil)
+		if err != nil {
+			return nil, false, err
+		}
+
+		sess := m.newSession()
+		sess.namespace = m.namespace(client)
 		client.Context().Set("session", sess)
 		return sess, false, nil
 	}
 
+	// sessions are separated by tenant
+	id = m.sessionKey(client, id)
+
 	// retrieve stored session
 	sess, ok := m.sessions[id]
 
+	// remove session if already expired
+	if ok && sess.expired(time.Now()) {
+		m.remove(id, sess)
+		ok = false
+	}
+
+	// check tenant
+	var replaced Client
+	if ok {
+		replaced = sess.currentClient
+	}
+
+	err := m.admit(client, replaced)
+	if err != nil {
+		return nil, false, err
+	}
+
 	// when found
 	if ok {
 		// check if session already has a client
@@ -144,33 +597,80 @@ func (m *MemoryBackend) Setup(client Client, id string, clean bool) (Session, bo
 			sess.currentClient.Close(true)
 		}
 
+		m.offlineMutex.Lock()
+
 		// set current client
 		sess.currentClient = client
 
-		// reset session if clean is true
+		// stop expiry
+		sess.expiresAt = time.Time{}
+
+		// discard messages and reset session if clean is true
+		var summary DiscardSummary
+		var discarded []*packet.Message
 		if clean {
+			summary, discarded = m.discard(sess)
 			sess.Reset()
 		}
 
 		// remove all session from the offline queue
 		m.offlineQueue.Clear(sess)
+		now := time.Now()
+		msgs, deadlines := sess.missedUntil(now)
+
+		m.offlineMutex.Unlock()
 
-		// send all missed messages in another goroutine
+		// handle discarded messages
+		m.discarded(client, summary, discarded)
+
+		// send all missed messages with their remaining expiry as a batch in
+		// another goroutine
 		go func() {
-			for _, msg := range sess.missed() {
-				client.Publish(msg)
+			for i, msg := range msgs {
+				msgs[i] = m.withExpiry(msg, deadlines[i], now)
+			}
+
+			n, err := PublishBatch(client, msgs)
+			if err == ErrClientOffline {
+				for _, msg := range msgs[n:] {
+					m.miss(client, msg)
+				}
+			}
+
+			for i, msg := range msgs {
+				if !deadlines[i].IsZero() {
+					m.annotations().release(msg)
+				}
 			}
 		}()
 
+		// persist session
+		if m.SessionPath != "" && !clean {
+			err = m.persistSession(id, sess)
+			if err != nil {
+				return nil, false, err
+			}
+		}
+
 		// returned stored session
 		client.Context().Set("session", sess)
 		return sess, true, nil
 	}
 
 	// create fresh session
-	sess = NewMemorySession()
+	sess = m.newSession()
+	sess.key = id
+	sess.namespace = m.namespace(client)
 	sess.currentClient = client
 
+	// persist session
+	if m.SessionPath != "" && !clean {
+		err = m.persistSession(id, sess)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
 	// save session
 	m.sessions[id] = sess
 
@@ -179,82 +679,156 @@ func (m *MemoryBackend) Setup(client Client, id string, clean bool) (Session, bo
 	return sess, false, nil
 }
 
+// SessionExists will return whether an unexpired session is stored for the
+// client id in the tenant of the client.
+func (m *MemoryBackend) SessionExists(client Client, id string) (bool, error) {
+	m.sessionsMutex.Lock()
+	defer m.sessionsMutex.Unlock()
+
+	sess, ok := m.sessions[m.sessionKey(client, id)]
+	return ok && !sess.expired(time.Now()), nil
+}
+
 // Subscribe will subscribe the passed client to the specified topic and
 // begin to forward messages by calling the clients Publish method.
 // It will also return the stored retained messages matching the supplied
-// topic.
+// topic. The client is unsubscribed again if the lookup of the retained
+// messages exceeds the RetainedSearchBudget.
 func (m *MemoryBackend) Subscribe(client Client, topic string) ([]*packet.Message, error) {
-	// add client to queue
-	m.queue.Add(topic, client)
-
-	// get retained messages
-	values := m.retained.Search(topic)
-	var msgs []*packet.Message
-
-	// convert types
-	for _, value := range values {
-		if msg, ok := value.(*packet.Message); ok {
-			msgs = append(msgs, msg)
-		}
+	err := m.SubscribeOnly(client, topic)
+	if err != nil {
+		return nil, err
 	}
 
-	return msgs, nil
+	return m.retainedOf(client, topic)
 }
 
 // Unsubscribe will unsubscribe the passed client from the specified topic.
 func (m *MemoryBackend) Unsubscribe(client Client, topic string) error {
+	topic = m.namespace(client) + topic
+
 	// remove client from queue
 	m.queue.Remove(topic, client)
+	m.unroute(client, topic)
 
 	return nil
 }
 
 // Publish will forward the passed message to all other subscribed clients.
-// It will also store the message if Retain is set to true. If the supplied
-// message has additionally a zero length payload, the backend removes the
-// currently retained message. Finally, it will also add the message to all
-// sessions that have an offline subscription.
+// QOS 1 and 2 messages that could not be queued because a client with a
+// persistent session went offline are added to its session. It will also
+// store the message if Retain is set to true. If the supplied message has
+// additionally a zero length payload, the backend removes the currently
+// retained message. Finally, it will also add the message to all sessions that
+// have an offline subscription and record it in the history if HistorySize is
+// set.
 func (m *MemoryBackend) Publish(client Client, msg *packet.Message) error {
+	return m.publish(client, msg, m.retain)
+}
+
+// publishes the message and stores retained messages using the retain
+// function
+func (m *MemoryBackend) publish(client Client, msg *packet.Message, retain func(publisher, tenant string, msg *packet.Message) error) error {
+	// add namespace of tenant
+	if ns := m.namespace(client); ns != "" {
+		original := msg
+		msg = namespaced(ns, msg)
+
+		// the namespaced message carries the metadata while it is published
+		m.annotations().move(original, msg)
+		defer m.annotations().move(msg, original)
+	}
+
 	// check retain flag
 	if msg.Retain {
-		if len(msg.Payload) > 0 {
-			m.retained.Set(msg.Topic, msg)
-		} else {
-			m.retained.Empty(msg.Topic)
+		clientID, _ := client.Context().Get("client_id").(string)
+		err := retain(m.sessionKey(client, clientID), m.tenant(client), msg)
+		if err != nil {
+			return err
 		}
 	}
 
+	// record message
+	m.record(msg)
+
 	// publish directly to clients
+	var err error
+	publisher := client
 	for _, v := range m.queue.Match(msg.Topic) {
 		if client, ok := v.(Client); ok {
-			client.Publish(msg)
+			_err := m.forward(publisher, client, msg)
+			if _err == ErrClientOffline {
+				_err = m.miss(client, msg)
+				if err == nil {
+					err = _err
+				}
+			}
 		}
 	}
 
 	// queue for offline clients
+	var queued []*MemorySession
+	deadline := m.expiryDeadline(msg, time.Now())
+	m.offlineMutex.RLock()
 	for _, v := range m.offlineQueue.Match(msg.Topic) {
 		if session, ok := v.(*MemorySession); ok {
-			session.queue(msg)
+			session.queue(localized(session.namespace, msg), deadline)
+			queued = append(queued, session)
 		}
 	}
+	m.offlineMutex.RUnlock()
 
-	return nil
+	// report queued messages
+	if m.queued != nil {
+		for _, session := range queued {
+			_err := m.queued(session, localized(session.namespace, msg), deadline)
+			if err == nil {
+				err = _err
+			}
+		}
+	}
+
+	return err
 }
 
 // Terminate will unsubscribe the passed client from all previously subscribed
 // topics. If the client connect with clean=true it will also clean the session.
 // Otherwise it will create offline subscriptions for all QOS 1 and QOS 2
-// subscriptions.
+// subscriptions. If the client has a "session_expiry" duration set in its
+// context, the session will be removed by the reaper once it has not been
+// resumed within that duration. Sessions that have already been resumed by
+// another client are left untouched.
 func (m *MemoryBackend) Terminate(client Client) error {
+	_, _, err := m.terminate(client)
+	return err
+}
+
+// terminates the client and returns whether the stored session of the client
+// has been reset or kept as an offline session
+func (m *MemoryBackend) terminate(client Client) (bool, bool, error) {
 	m.sessionsMutex.Lock()
 	defer m.sessionsMutex.Unlock()
 
-	// remove client from queue
+	// remove client from queue and refuse further subscriptions
+	m.clientsMutex.Lock()
+	client.Context().Set("terminated", true)
 	m.queue.Clear(client)
+	m.unroute(client, "")
+	m.clientsMutex.Unlock()
+
+	m.dismiss(client)
+
+	// forget deferred subscriptions
+	m.retainedMutex.Lock()
+	delete(m.subscribedAt, client)
+	m.retainedMutex.Unlock()
 
 	// get session
 	session, ok := client.Context().Get("session").(*MemorySession)
-	if ok {
+	if ok && session.currentClient == client {
+		m.offlineMutex.Lock()
+		defer m.offlineMutex.Unlock()
+
 		// reset stored client
 		session.currentClient = nil
 
@@ -263,23 +837,317 @@ func (m *MemoryBackend) Terminate(client Client) error {
 		if ok && clean {
 			// reset session
 			session.Reset()
-			return nil
+			return true, false, m.unpersistSession(session)
+		}
+
+		// otherwise add session to offline queue
+		err := m.addOffline(session)
+		if err != nil {
+			return false, false, err
+		}
+
+		// schedule expiry
+		expiry, ok := client.Context().Get("session_expiry").(time.Duration)
+		if ok && expiry > 0 {
+			session.expiresAt = time.Now().Add(expiry)
 		}
 
-		// otherwise get stored subscriptions
-		subscriptions, err := session.AllSubscriptions()
+		// persist expiry
+		if file := session.persisted(); file != nil {
+			return false, true, file.describe(session.namespace, session.expiresAt)
+		}
+
+		return false, true, nil
+	}
+
+	return false, false, nil
+}
+
+// adds the session to the offline queue for all of its QOS 1 and QOS 2
+// subscriptions, the offline mutex must be held
+func (m *MemoryBackend) addOffline(session *MemorySession) error {
+	subscriptions, err := session.AllSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range subscriptions {
+		if sub.QOS >= 1 {
+			m.offlineQueue.Add(session.namespace+sub.Topic, session)
+		}
+	}
+
+	return nil
+}
+
+// adds a message that could not be queued to the persistent session of the
+// client that went offline or forwards it to the client that has already
+// resumed the session
+func (m *MemoryBackend) miss(client Client, msg *packet.Message) error {
+	if msg.QOS == 0 {
+		return nil
+	}
+
+	clean, _ := client.Context().Get("clean").(bool)
+	session, ok := client.Context().Get("session").(*MemorySession)
+	if !ok || clean {
+		return nil
+	}
+
+	deadline := m.expiryDeadline(msg, time.Now())
+	if !m.forwardOrQueue(client, session, msg, deadline) {
+		return nil
+	}
+
+	// report queued message
+	if m.queued != nil {
+		return m.queued(session, localized(session.namespace, msg), deadline)
+	}
+
+	return nil
+}
+
+// forwards the message to the client that resumed the session or queues it
+// and returns true if it has been queued
+func (m *MemoryBackend) forwardOrQueue(client Client, session *MemorySession, msg *packet.Message, deadline time.Time) bool {
+	var failed Client
+
+	for {
+		// queue the message while the session is not resumed by another
+		// client or its delivery has failed, the offline mutex keeps the
+		// session from being resumed until the message is queued
+		m.offlineMutex.RLock()
+		current := session.currentClient
+		if current == nil || current == client || current == failed {
+			session.queue(localized(session.namespace, msg), deadline)
+			m.offlineMutex.RUnlock()
+			return true
+		}
+		m.offlineMutex.RUnlock()
+
+		// forward to the client that resumed the session without holding
+		// the mutex, as the delivery may block
+		if clean, _ := current.Context().Get("clean").(bool); clean {
+			return false
+		}
+
+		if m.deliver(current, msg) == nil {
+			return false
+		}
+
+		failed = current
+	}
+}
+
+// stores or clears a retained message of the publishing client id and tenant
+// and appends the change to the log
+func (m *MemoryBackend) retain(publisher, tenant string, msg *packet.Message) error {
+	m.retainedMutex.Lock()
+	defer m.retainedMutex.Unlock()
+
+	return m.storeRetained(publisher, tenant, msg)
+}
+
+// stores or clears a retained message like retain, the retained mutex must be
+// held
+func (m *MemoryBackend) storeRetained(publisher, tenant string, msg *packet.Message) error {
+	// track quota of tenant
+	if tenant != "" {
+		m.trackRetained(tenant)
+	}
+
+	// lazily allocate publishers
+	if m.publishers == nil {
+		m.publishers = make(map[string]string)
+	}
+
+	var evicted []string
+
+	// lazily allocate versions
+	if m.versions == nil {
+		m.versions = make(map[string]uint64)
+	}
+
+	if len(msg.Payload) > 0 {
+		m.retained.Set(msg.Topic, msg)
+		m.publishers[msg.Topic] = publisher
+		m.version++
+		m.versions[msg.Topic] = m.version
+		m.touchRetained(msg.Topic, time.Now())
+		m.expireRetainedAt(msg.Topic, m.expiryDeadline(msg, time.Now()))
+		evicted = m.retainedQuotas().add(msg)
+	} else {
+		m.retained.Empty(msg.Topic)
+		delete(m.publishers, msg.Topic)
+		delete(m.versions, msg.Topic)
+		delete(m.retainedAt, msg.Topic)
+		delete(m.retainedExpiry, msg.Topic)
+		m.retainedQuotas().remove(msg.Topic)
+	}
+
+	// evict messages exceeding a quota
+	for _, topic := range evicted {
+		m.evictRetained(topic)
+	}
+
+	// check log
+	if m.retainedLog == nil {
+		return nil
+	}
+
+	err := m.retainedLog.append(msg)
+	if err != nil {
+		return err
+	}
+
+	for _, topic := range evicted {
+		err = m.retainedLog.append(&packet.Message{Topic: topic})
 		if err != nil {
 			return err
 		}
+	}
+
+	// sync immediately if no interval is set
+	if m.RetainedSyncInterval <= 0 {
+		return m.retainedLog.sync()
+	}
+
+	return nil
+}
+
+// returns a new session using the configured packet id sequence
+func (m *MemoryBackend) newSession() *MemorySession {
+	if m.PacketIDs != nil {
+		return NewMemorySessionWithSequence(m.PacketIDs())
+	}
+
+	return NewMemorySession()
+}
+
+// opens the retained log and loads the persisted messages
+func (m *MemoryBackend) loadRetained() error {
+	m.retainedMutex.Lock()
+	defer m.retainedMutex.Unlock()
+
+	log, msgs, err := openRetainedLog(m.RetainedPath)
+	if err != nil {
+		return err
+	}
+
+	m.retainedLog = log
 
-		// iterate through stored subscriptions
-		for _, sub := range subscriptions {
-			if sub.QOS >= 1 {
-				// session to offline queue
-				m.offlineQueue.Add(sub.Topic, session)
+	now := time.Now()
+
+	for _, msg := range msgs {
+		m.retained.Set(msg.Topic, msg)
+		m.touchRetained(msg.Topic, now)
+
+		// evict messages exceeding a changed quota
+		for _, topic := range m.retainedQuotas().add(msg) {
+			m.evictRetained(topic)
+
+			err = log.append(&packet.Message{Topic: topic})
+			if err != nil {
+				return err
 			}
 		}
 	}
 
 	return nil
 }
+
+// returns the usage of the retained quotas, the mutex must be held
+func (m *MemoryBackend) retainedQuotas() retainedQuotas {
+	if m.quotas == nil && (len(m.RetainedQuotas) > 0 || m.MaxRetainedMessages > 0) {
+		quotas := append([]RetainedQuota{}, m.RetainedQuotas...)
+
+		// the global limit is a quota without a prefix
+		if m.MaxRetainedMessages > 0 {
+			quotas = append(quotas, RetainedQuota{MaxMessages: m.MaxRetainedMessages})
+		}
+
+		m.quotas = newRetainedQuotas(quotas)
+	}
+
+	return m.quotas
+}
+
+// syncer will periodically sync and compact the retained log until quit is
+// closed
+func (m *MemoryBackend) syncer(quit chan struct{}) {
+	ticker := time.NewTicker(m.RetainedSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			m.syncRetained()
+		}
+	}
+}
+
+// syncs the retained log and compacts it if necessary
+func (m *MemoryBackend) syncRetained() error {
+	m.retainedMutex.Lock()
+	defer m.retainedMutex.Unlock()
+
+	// check log
+	if m.retainedLog == nil {
+		return nil
+	}
+
+	// compact log
+	if m.retainedLog.obsolete() {
+		var msgs []*packet.Message
+		for _, value := range m.retained.All() {
+			if msg, ok := value.(*packet.Message); ok {
+				msgs = append(msgs, msg)
+			}
+		}
+
+		return m.retainedLog.compact(msgs)
+	}
+
+	return m.retainedLog.sync()
+}
+
+// reap will periodically remove expired sessions until quit is closed
+func (m *MemoryBackend) reap(quit chan struct{}) {
+	ticker := time.NewTicker(m.ReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case now := <-ticker.C:
+			m.removeExpired(now)
+		}
+	}
+}
+
+// removes all sessions that have expired before the specified time
+func (m *MemoryBackend) removeExpired(now time.Time) {
+	m.sessionsMutex.Lock()
+	defer m.sessionsMutex.Unlock()
+
+	for id, sess := range m.sessions {
+		if sess.expired(now) {
+			m.remove(id, sess)
+		}
+	}
+}
+
+// removes a session and its offline subscriptions and messages
+func (m *MemoryBackend) remove(id string, sess *MemorySession) {
+	m.offlineMutex.Lock()
+	defer m.offlineMutex.Unlock()
+
+	delete(m.sessions, id)
+	m.offlineQueue.Clear(sess)
+	sess.missed()
+	sess.Reset()
+	m.unpersistSession(sess)
+}
@@ -1,7 +1,9 @@
 package broker
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gomqtt/packet"
 	"github.com/stretchr/testify/assert"
@@ -25,6 +27,19 @@ func BackendSpec(t *testing.T, builder func() Backend) {
 
 	t.Log("Running Backend Retained Messages Test")
 	backendRetainedMessagesTest(t, builder())
+
+	t.Log("Running Backend Concurrency Test")
+	backendConcurrencyTest(t, builder())
+}
+
+// AuthorizationSpec will test the authorization of a Backend implementation
+// that restricts topics. It is kept separate from the BackendSpec, as Backends
+// are free to authorize all actions. The passed builder callback should always
+// return a fresh instance of the Backend that allows all actions on the
+// "allow" topic and denies all actions on the "deny" topic.
+func AuthorizationSpec(t *testing.T, builder func() Backend) {
+	t.Log("Running Backend Authorization Test")
+	backendAuthorizationTest(t, builder())
 }
 
 func backendAuthenticationTest(t *testing.T, backend Backend) {
@@ -39,6 +54,26 @@ func backendAuthenticationTest(t *testing.T, backend Backend) {
 	assert.NoError(t, err)
 }
 
+func backendAuthorizationTest(t *testing.T, backend Backend) {
+	client := newFakeClient()
+
+	ok, err := backend.Authorize(client, "allow", SubscribeAction)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+
+	ok, err = backend.Authorize(client, "allow", PublishAction)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+
+	ok, err = backend.Authorize(client, "deny", SubscribeAction)
+	assert.False(t, ok)
+	assert.NoError(t, err)
+
+	ok, err = backend.Authorize(client, "deny", PublishAction)
+	assert.False(t, ok)
+	assert.NoError(t, err)
+}
+
 func backendSetupTest(t *testing.T, backend Backend) {
 	client := newFakeClient()
 
@@ -206,3 +241,110 @@ func backendRetainedMessagesTest(t *testing.T, backend Backend) {
 	assert.NoError(t, err)
 	assert.Empty(t, msgs)
 }
+
+func backendConcurrencyTest(t *testing.T, backend Backend) {
+	subscription := &packet.Subscription{Topic: "concurrent", QOS: 1}
+
+	msg := &packet.Message{
+		Topic:   "concurrent",
+		Payload: []byte("test"),
+		QOS:     1,
+	}
+
+	var clients []*fakeClient
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	// clients of the same session take over each other while they subscribe,
+	// publish and terminate concurrently
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			client := newFakeClient()
+
+			mutex.Lock()
+			clients = append(clients, client)
+			mutex.Unlock()
+
+			session, _, err := backend.Setup(client, "concurrent", false)
+			assert.NoError(t, err)
+			assert.NoError(t, session.SaveSubscription(subscription))
+
+			_, err = backend.Subscribe(client, "concurrent")
+			assert.NoError(t, err)
+
+			var inner sync.WaitGroup
+			inner.Add(3)
+
+			go func() {
+				defer inner.Done()
+
+				for j := 0; j < 50; j++ {
+					assert.NoError(t, backend.Publish(client, msg))
+				}
+			}()
+
+			go func() {
+				defer inner.Done()
+
+				_, err := backend.Subscribe(client, "concurrent/#")
+				assert.NoError(t, err)
+			}()
+
+			go func() {
+				defer inner.Done()
+
+				assert.NoError(t, backend.Terminate(client))
+			}()
+
+			inner.Wait()
+		}()
+	}
+
+	wg.Wait()
+
+	// terminated clients must not receive messages
+	var received []int
+	for _, client := range clients {
+		received = append(received, len(client.received()))
+	}
+
+	final := &packet.Message{
+		Topic:   "concurrent",
+		Payload: []byte("final"),
+		QOS:     1,
+	}
+
+	assert.NoError(t, backend.Publish(newFakeClient(), final))
+
+	for i, client := range clients {
+		assert.Equal(t, received[i], len(client.received()))
+	}
+
+	// the message must have been queued in the session
+	client := newFakeClient()
+
+	_, resumed, err := backend.Setup(client, "concurrent", false)
+	assert.NoError(t, err)
+	assert.True(t, resumed)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		msgs := client.received()
+		if len(msgs) > 0 && msgs[len(msgs)-1].Topic == final.Topic && string(msgs[len(msgs)-1].Payload) == "final" {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	msgs := client.received()
+	if assert.NotEmpty(t, msgs) {
+		assert.Equal(t, final, msgs[len(msgs)-1])
+	}
+
+	assert.NoError(t, backend.Terminate(client))
+}
@@ -14,7 +14,19 @@
 
 package broker
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
 
 func TestMemoryBackend(t *testing.T) {
 	BackendSpec(t, func() Backend {
@@ -22,4 +34,499 @@ func TestMemoryBackend(t *testing.T) {
 		backend.Logins = map[string]string{"allow": "allow"}
 		return backend
 	})
+
+	AuthorizationSpec(t, func() Backend {
+		backend := NewMemoryBackend()
+		backend.Authorizer = func(client Client, topic string, action Action) bool {
+			return topic != "deny"
+		}
+		return backend
+	})
+}
+
+func TestMemoryBackendAnonymous(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.AnonymousPrefix = "public/"
+
+	// all clients are anonymous without credentials
+	client := newFakeClient()
+	ok, err := backend.Authenticate(client, "foo", "bar")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, anonymous(client))
+
+	for topic, allowed := range map[string]bool{"public/foo": true, "public/#": true, "private": false, "#": false} {
+		ok, err = backend.Authorize(client, topic, SubscribeAction)
+		assert.NoError(t, err)
+		assert.Equal(t, allowed, ok, topic)
+	}
+
+	// anonymous clients are refused once logins are configured
+	backend.Logins = map[string]string{"allow": "allow"}
+
+	ok, err = backend.Authenticate(newFakeClient(), "", "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	backend.AllowAnonymous = true
+	backend.AnonymousAuthorizer = func(client Client, topic string, action Action) bool {
+		return action == SubscribeAction
+	}
+
+	client = newFakeClient()
+	ok, err = backend.Authenticate(client, "", "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, anonymous(client))
+
+	ok, err = backend.Authorize(client, "public/foo", SubscribeAction)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = backend.Authorize(client, "public/foo", PublishAction)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// authenticated clients are not restricted
+	client = newFakeClient()
+	ok, err = backend.Authenticate(client, "allow", "allow")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, anonymous(client))
+
+	ok, err = backend.Authorize(client, "private", PublishAction)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestMemoryBackendAnonymousWarning(t *testing.T) {
+	logger := &recordingLogger{}
+
+	broker := New()
+	broker.Logger = logger
+
+	backend := NewMemoryBackend()
+	assert.NoError(t, backend.Start(broker))
+	assert.NoError(t, backend.Stop())
+	assert.NotNil(t, logger.find("anonymous_access"))
+
+	logger = &recordingLogger{}
+	broker.Logger = logger
+
+	backend.AllowAnonymous = true
+	assert.NoError(t, backend.Start(broker))
+	assert.NoError(t, backend.Stop())
+	assert.Nil(t, logger.find("anonymous_access"))
+}
+
+func TestMemoryBackendSessionExpiry(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	client := newFakeClient()
+	client.Context().Set("session_expiry", time.Minute)
+
+	session1, resumed, err := backend.Setup(client, "foo", false)
+	assert.NoError(t, err)
+	assert.False(t, resumed)
+
+	err = session1.SaveSubscription(&packet.Subscription{Topic: "foo", QOS: 1})
+	assert.NoError(t, err)
+
+	err = backend.Terminate(client)
+	assert.NoError(t, err)
+
+	// not yet expired
+
+	backend.removeExpired(time.Now())
+
+	session2, resumed, err := backend.Setup(client, "foo", false)
+	assert.NoError(t, err)
+	assert.True(t, resumed)
+	assert.True(t, session1 == session2)
+
+	err = backend.Terminate(client)
+	assert.NoError(t, err)
+
+	// expired
+
+	backend.removeExpired(time.Now().Add(2 * time.Minute))
+
+	err = backend.Publish(client, &packet.Message{Topic: "foo", Payload: []byte("foo")})
+	assert.NoError(t, err)
+	assert.Empty(t, session1.(*MemorySession).missed())
+
+	session3, resumed, err := backend.Setup(client, "foo", false)
+	assert.NoError(t, err)
+	assert.False(t, resumed)
+	assert.True(t, session1 != session3)
+}
+
+func TestMemoryBackendCleanPolicy(t *testing.T) {
+	setup := func(backend *MemoryBackend) {
+		client := newFakeClient()
+
+		session, _, err := backend.Setup(client, "foo", false)
+		assert.NoError(t, err)
+
+		err = session.SaveSubscription(&packet.Subscription{Topic: "foo", QOS: 1})
+		assert.NoError(t, err)
+
+		publish := packet.NewPublishPacket()
+		publish.PacketID = 1
+		publish.Message = packet.Message{Topic: "foo", Payload: []byte("1"), QOS: 1}
+
+		err = session.SavePacket(outgoing, publish)
+		assert.NoError(t, err)
+
+		err = backend.Terminate(client)
+		assert.NoError(t, err)
+
+		err = backend.Publish(client, &packet.Message{Topic: "foo", Payload: []byte("2"), QOS: 1})
+		assert.NoError(t, err)
+	}
+
+	// discard
+
+	backend := NewMemoryBackend()
+	setup(backend)
+
+	client := newFakeClient()
+	session, resumed, err := backend.Setup(client, "foo", true)
+	assert.NoError(t, err)
+	assert.True(t, resumed)
+	assert.Empty(t, session.(*MemorySession).missed())
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, client.received())
+
+	// dead letter
+
+	var deadLetters []string
+
+	backend = NewMemoryBackend()
+	backend.CleanPolicy = CleanDeadLetter
+	backend.DeadLetterHandler = func(client Client, msgs []*packet.Message) {
+		for _, msg := range msgs {
+			deadLetters = append(deadLetters, string(msg.Payload))
+		}
+	}
+	setup(backend)
+
+	_, _, err = backend.Setup(newFakeClient(), "foo", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2", "1"}, deadLetters)
+
+	// notify
+
+	var events []*Event
+
+	broker := New()
+	broker.EventHandler = func(event *Event) {
+		events = append(events, event)
+	}
+
+	backend = NewMemoryBackend()
+	backend.CleanPolicy = CleanNotify
+	setup(backend)
+
+	err = backend.Start(broker)
+	assert.NoError(t, err)
+
+	_, _, err = backend.Setup(newFakeClient(), "foo", true)
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, SessionDiscarded, events[0].Type)
+	assert.Equal(t, DiscardSummary{Offline: 1, Unacknowledged: 1}, events[0].Discarded)
+
+	err = backend.Stop()
+	assert.NoError(t, err)
+}
+
+func TestMemoryBackendReaper(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.ReapInterval = 10 * time.Millisecond
+
+	err := backend.Start(New())
+	assert.NoError(t, err)
+
+	client := newFakeClient()
+	client.Context().Set("session_expiry", time.Millisecond)
+
+	_, _, err = backend.Setup(client, "foo", false)
+	assert.NoError(t, err)
+
+	err = backend.Terminate(client)
+	assert.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+
+	backend.sessionsMutex.Lock()
+	assert.Empty(t, backend.sessions)
+	backend.sessionsMutex.Unlock()
+
+	err = backend.Stop()
+	assert.NoError(t, err)
+
+	err = backend.Stop()
+	assert.Error(t, err)
+}
+
+func TestMemoryBackendWithoutReaper(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.ReapInterval = 0
+
+	// brokers start their backend lazily without validating it
+	broker := New()
+	broker.Backend = backend
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(packet.NewConnackPacket()).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+}
+
+func TestMemoryBackendRetainedPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-broker")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "retained.log")
+	client := newFakeClient()
+
+	backend1 := NewMemoryBackend()
+	backend1.RetainedPath = path
+
+	err = backend1.Start(New())
+	assert.NoError(t, err)
+
+	for _, msg := range []*packet.Message{
+		{Topic: "foo", Payload: []byte("foo"), Retain: true},
+		{Topic: "bar", Payload: []byte("bar"), Retain: true},
+		{Topic: "foo", Retain: true},
+	} {
+		err = backend1.Publish(client, msg)
+		assert.NoError(t, err)
+	}
+
+	err = backend1.Stop()
+	assert.NoError(t, err)
+
+	// restart
+
+	backend2 := NewMemoryBackend()
+	backend2.RetainedPath = path
+
+	err = backend2.Start(New())
+	assert.NoError(t, err)
+
+	msgs, err := backend2.Subscribe(client, "#")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, "bar", msgs[0].Topic)
+
+	err = backend2.Stop()
+	assert.NoError(t, err)
+}
+
+func TestRetainedLogCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-broker")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, msgs, err := openRetainedLog(filepath.Join(dir, "retained.log"))
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	msg := &packet.Message{Topic: "foo", Payload: []byte("foo")}
+
+	for i := 0; i < retainedLogSlack+3; i++ {
+		err = log.append(msg)
+		assert.NoError(t, err)
+	}
+
+	assert.True(t, log.obsolete())
+
+	err = log.compact([]*packet.Message{msg})
+	assert.NoError(t, err)
+	assert.False(t, log.obsolete())
+
+	err = log.close()
+	assert.NoError(t, err)
+}
+
+func TestMemoryBackendRetainedQuotas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-broker")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "retained.log")
+	client := newFakeClient()
+
+	backend1 := NewMemoryBackend()
+	backend1.RetainedPath = path
+	backend1.RetainedQuotas = []RetainedQuota{
+		{Prefix: "a/", MaxMessages: 2},
+		{Prefix: "b/", MaxBytes: 10},
+	}
+
+	err = backend1.Start(New())
+	assert.NoError(t, err)
+
+	retained := func(backend *MemoryBackend, filter string) []string {
+		msgs, err := backend.RetainedMessages(filter)
+		assert.NoError(t, err)
+
+		var topics []string
+		for _, msg := range msgs {
+			topics = append(topics, msg.Topic)
+		}
+
+		sort.Strings(topics)
+
+		return topics
+	}
+
+	for _, msg := range []*packet.Message{
+		{Topic: "a/1", Payload: []byte("1"), Retain: true},
+		{Topic: "a/2", Payload: []byte("2"), Retain: true},
+		{Topic: "a/3", Payload: []byte("3"), Retain: true},
+		{Topic: "a/2", Payload: []byte("2"), Retain: true},
+		{Topic: "a/4", Payload: []byte("4"), Retain: true},
+		{Topic: "b/1", Payload: []byte("12345"), Retain: true},
+		{Topic: "b/2", Payload: []byte("1"), Retain: true},
+		{Topic: "c/1", Payload: []byte("1"), Retain: true},
+		{Topic: "c/2", Payload: []byte("2"), Retain: true},
+		{Topic: "c/3", Payload: []byte("3"), Retain: true},
+	} {
+		err = backend1.Publish(client, msg)
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, []string{"a/2", "a/4"}, retained(backend1, "a/#"))
+	assert.Equal(t, []string{"b/2"}, retained(backend1, "b/#"))
+	assert.Equal(t, []string{"c/1", "c/2", "c/3"}, retained(backend1, "c/#"))
+
+	// cleared messages free their quota
+	err = backend1.Publish(client, &packet.Message{Topic: "a/2", Retain: true})
+	assert.NoError(t, err)
+
+	err = backend1.Publish(client, &packet.Message{Topic: "a/5", Payload: []byte("5"), Retain: true})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"a/4", "a/5"}, retained(backend1, "a/#"))
+
+	err = backend1.Stop()
+	assert.NoError(t, err)
+
+	// restart with a lower quota
+
+	backend2 := NewMemoryBackend()
+	backend2.RetainedPath = path
+	backend2.RetainedQuotas = []RetainedQuota{
+		{Prefix: "a/", MaxMessages: 1},
+	}
+
+	err = backend2.Start(New())
+	assert.NoError(t, err)
+
+	assert.Len(t, retained(backend2, "a/#"), 1)
+	assert.Equal(t, []string{"b/2"}, retained(backend2, "b/#"))
+
+	err = backend2.Stop()
+	assert.NoError(t, err)
+}
+
+func TestMemoryBackendRetainedLimits(t *testing.T) {
+	client := newFakeClient()
+
+	backend := NewMemoryBackend()
+	backend.MaxRetainedMessages = 3
+	backend.RetainedQuotas = []RetainedQuota{
+		{Prefix: "a/", MaxMessages: 1},
+	}
+	backend.RetainedTTL = 50 * time.Millisecond
+	backend.RetainedSweepInterval = 10 * time.Millisecond
+
+	err := backend.Start(New())
+	assert.NoError(t, err)
+
+	for _, topic := range []string{"a/1", "a/2", "b/1", "b/2", "b/3"} {
+		err = backend.Publish(client, &packet.Message{Topic: topic, Payload: []byte("1"), Retain: true})
+		assert.NoError(t, err)
+	}
+
+	msgs, err := backend.RetainedMessages("#")
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 3)
+	assert.Equal(t, RetainedStats{Messages: 3, Evicted: 2}, backend.RetainedStats())
+
+	time.Sleep(100 * time.Millisecond)
+
+	msgs, err = backend.RetainedMessages("#")
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+	assert.Equal(t, RetainedStats{Evicted: 2, Expired: 3}, backend.RetainedStats())
+
+	err = backend.Stop()
+	assert.NoError(t, err)
+}
+
+// a blocked client that reports the first write
+type enteredClient struct {
+	*blockedClient
+	entered chan struct{}
+}
+
+func (c *enteredClient) Publish(msg *packet.Message) error {
+	close(c.entered)
+	return c.blockedClient.Publish(msg)
+}
+
+func TestMemoryBackendForwardWithoutLock(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	previous := newFakeClient()
+	_, _, err := backend.Setup(previous, "foo", false)
+	assert.NoError(t, err)
+
+	blocked := &enteredClient{
+		blockedClient: &blockedClient{fakeClient: newFakeClient(), unblock: make(chan struct{})},
+		entered:       make(chan struct{}),
+	}
+	_, _, err = backend.Setup(blocked, "foo", false)
+	assert.NoError(t, err)
+
+	// a missed message of the previous client is forwarded to the resumed one
+	forwarded := make(chan error, 1)
+	go func() {
+		forwarded <- backend.miss(previous, &packet.Message{Topic: "test", QOS: 1})
+	}()
+
+	<-blocked.entered
+
+	// the session can be resumed while the forward blocks
+	resumed := make(chan error, 1)
+	go func() {
+		_, _, err := backend.Setup(newFakeClient(), "foo", false)
+		resumed <- err
+	}()
+
+	select {
+	case err = <-resumed:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "setup blocked by forward")
+	}
+
+	close(blocked.unblock)
+	assert.NoError(t, <-forwarded)
 }
@@ -0,0 +1,144 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gomqtt/packet"
+)
+
+// A BatchClient is a Client that accepts multiple messages at once. The
+// MemoryBackend and SQLBackend use it to deliver the missed messages of a
+// resumed session in a single batch.
+type BatchClient interface {
+	Client
+
+	// PublishBatch will send the messages to the client in order and return
+	// the number of messages that have been handled before the client went
+	// offline. Messages that are dropped because of backpressure are counted
+	// as handled and the first such error is returned once all messages have
+	// been handled.
+	PublishBatch(msgs []*packet.Message) (int, error)
+}
+
+// A BatchConn is a connection that supports buffered writes. Outgoing
+// publishes that are waiting in the buffer of a client are written with
+// BufferedSend and then flushed together, so that a burst of messages is sent
+// with a single write. Send must write any previously buffered packets first
+// and all methods must be safe for concurrent use.
+type BatchConn interface {
+	// BufferedSend should add the packet to the write buffer. The packet and
+	// the metadata of its message are kept until the buffer has been flushed.
+	BufferedSend(pkt packet.Packet) error
+
+	// Flush should write the buffered packets.
+	Flush() error
+}
+
+// PublishBatch will send the messages to the client in order using the
+// PublishBatch method of a BatchClient or by calling Publish for each message.
+func PublishBatch(client Client, msgs []*packet.Message) (int, error) {
+	if batch, ok := client.(BatchClient); ok {
+		return batch.PublishBatch(msgs)
+	}
+
+	return publishEach(client, msgs)
+}
+
+// publishes the messages one by one until the client goes offline
+func publishEach(client Client, msgs []*packet.Message) (int, error) {
+	var first error
+
+	for i, msg := range msgs {
+		err := client.Publish(msg)
+		if err == ErrClientOffline {
+			return i, err
+		} else if err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return len(msgs), first
+}
+
+// PublishBatch will queue the messages in order. If the connection is a
+// BatchConn, the sender buffers the writes of the messages and flushes them
+// once the batch has been queued and the outgoing buffer has been drained.
+func (c *remoteClient) PublishBatch(msgs []*packet.Message) (int, error) {
+	atomic.AddInt32(&c.batching, 1)
+	defer func() {
+		atomic.AddInt32(&c.batching, -1)
+
+		// wake the sender to flush the batch
+		select {
+		case c.batched <- struct{}{}:
+		default:
+		}
+	}()
+
+	return publishEach(c, msgs)
+}
+
+// PublishBatch will pass the messages to the callback.
+func (c *LocalClient) PublishBatch(msgs []*packet.Message) (int, error) {
+	for _, msg := range msgs {
+		c.callback(msg)
+	}
+
+	return len(msgs), nil
+}
+
+// flushes the buffered packets of the sender
+func (c *remoteClient) flush() error {
+	if !c.unflushed {
+		return nil
+	}
+
+	c.unflushed = false
+
+	// track blocking writes
+	atomic.StoreInt64(&c.sendingSince, time.Now().UnixNano())
+	err := c.conn.(BatchConn).Flush()
+	atomic.StoreInt64(&c.sendingSince, 0)
+	if err != nil {
+		c.disconnectAs(DisconnectNetwork)
+
+		// the connection may still reference the packets
+		for _, publish := range c.buffered {
+			c.broker.annotations().release(&publish.Message)
+		}
+
+		c.buffered = nil
+
+		return err
+	}
+
+	// release the written packets
+	for _, publish := range c.buffered {
+		c.recycle(publish)
+	}
+
+	c.buffered = c.buffered[:0]
+
+	return nil
+}
+
+// releases the metadata of a written publish and reuses the packet
+func (c *remoteClient) recycle(publish *packet.PublishPacket) {
+	c.broker.annotations().release(&publish.Message)
+	c.broker.releasePublish(publish)
+}
@@ -0,0 +1,299 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+// a connection that buffers writes and records the size of the flushes
+type batchConn struct {
+	transport.Conn
+
+	buffer  []packet.Packet
+	flushes []int
+	mutex   sync.Mutex
+}
+
+func (c *batchConn) Send(pkt packet.Packet) error {
+	err := c.Flush()
+	if err != nil {
+		return err
+	}
+
+	return c.Conn.Send(pkt)
+}
+
+func (c *batchConn) BufferedSend(pkt packet.Packet) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.buffer = append(c.buffer, pkt)
+	return nil
+}
+
+func (c *batchConn) Flush() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.buffer) == 0 {
+		return nil
+	}
+
+	c.flushes = append(c.flushes, len(c.buffer))
+
+	for _, pkt := range c.buffer {
+		err := c.Conn.Send(pkt)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.buffer = nil
+	return nil
+}
+
+// a connection that records the metadata of the buffered publishes when they
+// are flushed
+type annotatedConn struct {
+	*batchConn
+
+	broker *Broker
+	values []interface{}
+}
+
+func (c *annotatedConn) Flush() error {
+	c.mutex.Lock()
+	for _, pkt := range c.buffer {
+		c.values = append(c.values, c.broker.Annotations(&pkt.(*packet.PublishPacket).Message)["test"])
+	}
+	c.mutex.Unlock()
+
+	return c.batchConn.Flush()
+}
+
+func TestPublishBatch(t *testing.T) {
+	msgs := []*packet.Message{
+		{Topic: "test", Payload: []byte("1")},
+		{Topic: "test", Payload: []byte("2")},
+	}
+
+	var received []*packet.Message
+	local := NewLocalClient(func(msg *packet.Message) {
+		received = append(received, msg)
+	})
+
+	n, err := PublishBatch(local, msgs)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, msgs, received)
+
+	client := newFakeClient()
+
+	n, err = PublishBatch(client, msgs)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, msgs, client.in)
+
+	client.Close(false)
+
+	n, err = PublishBatch(client, msgs)
+	assert.Equal(t, ErrClientOffline, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestBatchedResume(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+	connect.CleanSession = false
+
+	connack := packet.NewConnackPacket()
+
+	resumed := packet.NewConnackPacket()
+	resumed.SessionPresent = true
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test", QOS: 1}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{1}
+	suback.PacketID = 1
+
+	broker := New()
+	port := tools.NewPort()
+
+	server, err := transport.Launch(port.URL())
+	assert.NoError(t, err)
+
+	conns := make(chan *batchConn, 2)
+
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+
+			batch := &batchConn{Conn: conn}
+			conns <- batch
+			broker.Handle(batch)
+		}
+	}()
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-conns
+
+	// queue messages for the offline session
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return len(broker.currentClients()) == 0
+	})
+
+	for i := 0; i < 10; i++ {
+		err = broker.Publish(&packet.Message{
+			Topic:   "test",
+			Payload: []byte("test"),
+			QOS:     1,
+		})
+		assert.NoError(t, err)
+	}
+
+	conn, err = transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	flow := tools.NewFlow().
+		Send(connect).
+		Receive(resumed)
+
+	for i := 1; i <= 10; i++ {
+		publish := packet.NewPublishPacket()
+		publish.Message = packet.Message{
+			Topic:   "test",
+			Payload: []byte("test"),
+			QOS:     1,
+		}
+		publish.PacketID = uint16(i)
+
+		flow.Receive(publish)
+	}
+
+	flow.Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	batch := <-conns
+
+	batch.mutex.Lock()
+	assert.Equal(t, []int{10}, batch.flushes)
+	batch.mutex.Unlock()
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
+
+func TestBatchedQOS0(t *testing.T) {
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	broker := New()
+	port := tools.NewPort()
+
+	server, err := transport.Launch(port.URL())
+	assert.NoError(t, err)
+
+	conns := make(chan *annotatedConn, 1)
+
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+
+		batch := &annotatedConn{batchConn: &batchConn{Conn: conn}, broker: broker}
+		conns <- batch
+		broker.Handle(batch)
+	}()
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(packet.NewConnackPacket()).
+		Send(subscribe).
+		Receive(suback).
+		Test(t, conn)
+
+	var msgs []*packet.Message
+	for i, payload := range []string{"1", "2", "3", "4", "5"} {
+		msg := &packet.Message{Topic: "test", Payload: []byte(payload)}
+		broker.Annotate(msg, "test", i)
+		msgs = append(msgs, msg)
+	}
+
+	// buffered packets and their metadata are kept until they are flushed
+	n, err := PublishBatch(broker.currentClients()[0], msgs)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+
+	flow := tools.NewFlow()
+
+	for _, msg := range msgs {
+		publish := packet.NewPublishPacket()
+		publish.Message = *msg
+
+		flow.Receive(publish)
+	}
+
+	flow.Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	batch := <-conns
+
+	batch.mutex.Lock()
+	assert.Equal(t, []interface{}{0, 1, 2, 3, 4}, batch.values)
+	batch.mutex.Unlock()
+
+	for _, msg := range msgs {
+		broker.annotations().release(msg)
+	}
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
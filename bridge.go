@@ -0,0 +1,410 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomqtt/client"
+	"github.com/gomqtt/packet"
+	"gopkg.in/tomb.v2"
+)
+
+// A BridgeDirection describes in which direction messages are mirrored.
+type BridgeDirection int
+
+const (
+	// BridgeIn mirrors messages from the remote broker to the local broker.
+	BridgeIn BridgeDirection = iota
+
+	// BridgeOut mirrors messages from the local broker to the remote broker.
+	BridgeOut
+
+	// BridgeBoth mirrors messages in both directions.
+	BridgeBoth
+)
+
+// A BridgeTopic describes a topic filter that is mirrored by a Bridge.
+type BridgeTopic struct {
+	// The topic filter relative to the prefixes.
+	Filter string
+
+	// The direction in which messages are mirrored.
+	Direction BridgeDirection
+
+	// The maximum QOS level of mirrored messages.
+	QOS byte
+
+	// The prefixes that are prepended to the filter on the local and the
+	// remote broker, which allows remapping topics between the brokers.
+	LocalPrefix  string
+	RemotePrefix string
+}
+
+// A Bridge connects a Broker as a client to a remote broker and mirrors
+// messages between the two brokers.
+type Bridge struct {
+	// The url and the options used to connect to the remote broker.
+	URL     string
+	Options *client.Options
+
+	// The mirrored topics.
+	Topics []BridgeTopic
+
+	// The delay between reconnection attempts.
+	ReconnectDelay time.Duration
+
+	Logger Logger
+
+	broker *Broker
+	local  *LocalClient
+
+	remote      *client.Client
+	remoteMutex sync.Mutex
+	errors      chan error
+
+	echoes      map[string]int
+	inbound     map[*packet.Message]bool
+	echoesMutex sync.Mutex
+
+	tomb tomb.Tomb
+}
+
+// NewBridge returns a new Bridge that mirrors the specified topics between the
+// broker and the remote broker available at the specified url.
+func NewBridge(broker *Broker, url string, topics ...BridgeTopic) *Bridge {
+	return &Bridge{
+		URL:            url,
+		Options:        client.NewOptions(),
+		Topics:         topics,
+		ReconnectDelay: time.Second,
+		broker:         broker,
+		errors:         make(chan error, 1),
+		echoes:         make(map[string]int),
+		inbound:        make(map[*packet.Message]bool),
+	}
+}
+
+// Start will subscribe the bridge to the outgoing topics on the local broker
+// and start connecting to the remote broker. Lost connections are
+// automatically reestablished.
+func (b *Bridge) Start() error {
+	b.local = NewLocalClient(b.forward)
+
+	// setup local client
+	_, _, err := b.broker.Backend.Setup(b.local, "", true)
+	if err != nil {
+		return err
+	}
+
+	// subscribe to outgoing topics, messages published by the bridge and
+	// retained messages are skipped if the backend supports options
+	subscriber, optioned := b.broker.Backend.(OptionsSubscriber)
+	for _, topic := range b.Topics {
+		if topic.Direction == BridgeIn {
+			continue
+		}
+
+		if optioned {
+			_, err = subscriber.SubscribeWithOptions(b.local, topic.LocalPrefix+topic.Filter, SubscriptionOptions{
+				RetainHandling:    RetainSendNever,
+				NoLocal:           true,
+				RetainAsPublished: true,
+			})
+		} else {
+			_, err = b.broker.Backend.Subscribe(b.local, topic.LocalPrefix+topic.Filter)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	b.tomb.Go(b.connector)
+
+	return nil
+}
+
+// Stop will disconnect from the remote broker and unsubscribe the bridge from
+// the local broker.
+func (b *Bridge) Stop() error {
+	b.tomb.Kill(nil)
+	b.tomb.Wait()
+
+	return b.broker.Backend.Terminate(b.local)
+}
+
+// maintains the connection to the remote broker
+func (b *Bridge) connector() error {
+	for {
+		// connect to remote broker
+		remote, err := b.connect()
+		if err != nil {
+			b.log(LogWarn, "bridge_connect_failed", map[string]interface{}{
+				"error": err,
+			})
+		} else {
+			b.log(LogInfo, "bridge_connected", nil)
+
+			// wait for an error or stop
+			select {
+			case err = <-b.errors:
+				b.log(LogWarn, "bridge_connection_lost", map[string]interface{}{
+					"error": err,
+				})
+			case <-b.tomb.Dying():
+				b.setRemote(nil)
+				remote.Disconnect()
+				return tomb.ErrDying
+			}
+
+			b.setRemote(nil)
+			remote.Close()
+		}
+
+		// wait until next attempt
+		select {
+		case <-time.After(b.ReconnectDelay):
+		case <-b.tomb.Dying():
+			return tomb.ErrDying
+		}
+	}
+}
+
+// connects to the remote broker and subscribes to the incoming topics
+func (b *Bridge) connect() (*client.Client, error) {
+	remote := client.New()
+	remote.Callback = b.callback
+
+	// clear previous errors
+	select {
+	case <-b.errors:
+	default:
+	}
+
+	// connect
+	connectFuture, err := remote.Connect(b.URL, b.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	err = connectFuture.Wait()
+	if err != nil {
+		remote.Close()
+		return nil, err
+	}
+
+	// check return code
+	if connectFuture.ReturnCode != packet.ConnectionAccepted {
+		remote.Close()
+		return nil, fmt.Errorf("connection refused: %s", connectFuture.ReturnCode)
+	}
+
+	// prepare subscriptions
+	var subs []packet.Subscription
+	for _, topic := range b.Topics {
+		if topic.Direction == BridgeOut {
+			continue
+		}
+
+		subs = append(subs, packet.Subscription{
+			Topic: topic.RemotePrefix + topic.Filter,
+			QOS:   topic.QOS,
+		})
+	}
+
+	// subscribe to incoming topics
+	if len(subs) > 0 {
+		subscribeFuture, err := remote.SubscribeMultiple(subs)
+		if err != nil {
+			remote.Close()
+			return nil, err
+		}
+
+		err = subscribeFuture.Wait()
+		if err != nil {
+			remote.Close()
+			return nil, err
+		}
+	}
+
+	b.setRemote(remote)
+
+	return remote, nil
+}
+
+// handles incoming messages and errors of the remote client
+func (b *Bridge) callback(msg *packet.Message, err error) {
+	if err != nil {
+		select {
+		case b.errors <- err:
+		default:
+		}
+
+		return
+	}
+
+	// drop echoes of outgoing messages
+	if b.echo(msg, false) {
+		return
+	}
+
+	// find topic
+	topic, ok := b.match(msg.Topic, false)
+	if !ok {
+		return
+	}
+
+	// remap message
+	local := *msg
+	local.Topic = topic.LocalPrefix + strings.TrimPrefix(msg.Topic, topic.RemotePrefix)
+	local.QOS = minQOS(msg.QOS, topic.QOS)
+
+	// mark message to prevent forwarding it back
+	b.echoesMutex.Lock()
+	b.inbound[&local] = true
+	b.echoesMutex.Unlock()
+
+	err = b.broker.Backend.Publish(b.local, &local)
+	if err != nil {
+		b.log(LogError, "bridge_publish_failed", map[string]interface{}{
+			"topic": local.Topic,
+			"error": err,
+		})
+	}
+
+	b.echoesMutex.Lock()
+	delete(b.inbound, &local)
+	b.echoesMutex.Unlock()
+}
+
+// forwards outgoing messages to the remote broker
+func (b *Bridge) forward(msg *packet.Message) {
+	// skip messages published by the bridge itself
+	b.echoesMutex.Lock()
+	skip := b.inbound[msg]
+	b.echoesMutex.Unlock()
+
+	if skip {
+		return
+	}
+
+	// find topic
+	topic, ok := b.match(msg.Topic, true)
+	if !ok {
+		return
+	}
+
+	// get remote client
+	b.remoteMutex.Lock()
+	remote := b.remote
+	b.remoteMutex.Unlock()
+
+	// drop message if not connected
+	if remote == nil {
+		return
+	}
+
+	// remap message
+	out := *msg
+	out.Topic = topic.RemotePrefix + strings.TrimPrefix(msg.Topic, topic.LocalPrefix)
+	out.QOS = minQOS(msg.QOS, topic.QOS)
+
+	// remember message to drop its echo
+	if topic.Direction == BridgeBoth {
+		b.echo(&out, true)
+	}
+
+	_, err := remote.PublishMessage(&out)
+	if err != nil {
+		b.log(LogError, "bridge_publish_failed", map[string]interface{}{
+			"topic": out.Topic,
+			"error": err,
+		})
+	}
+}
+
+// returns the first topic matching the local or remote topic
+func (b *Bridge) match(topic string, local bool) (BridgeTopic, bool) {
+	for _, t := range b.Topics {
+		if local && t.Direction != BridgeIn && matchFilter(t.LocalPrefix+t.Filter, topic) {
+			return t, true
+		}
+
+		if !local && t.Direction != BridgeOut && matchFilter(t.RemotePrefix+t.Filter, topic) {
+			return t, true
+		}
+	}
+
+	return BridgeTopic{}, false
+}
+
+// records an outgoing message or reports and consumes the echo of a
+// previously recorded message
+func (b *Bridge) echo(msg *packet.Message, record bool) bool {
+	b.echoesMutex.Lock()
+	defer b.echoesMutex.Unlock()
+
+	key := msg.Topic + "\x00" + string(msg.Payload)
+
+	if record {
+		b.echoes[key]++
+		return false
+	}
+
+	if b.echoes[key] > 0 {
+		b.echoes[key]--
+		if b.echoes[key] == 0 {
+			delete(b.echoes, key)
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// sets the current remote client
+func (b *Bridge) setRemote(remote *client.Client) {
+	b.remoteMutex.Lock()
+	b.remote = remote
+	b.remoteMutex.Unlock()
+}
+
+// logs an event with the url of the remote broker
+func (b *Bridge) log(level LogLevel, event string, fields map[string]interface{}) {
+	if b.Logger == nil {
+		return
+	}
+
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+
+	fields["url"] = b.URL
+
+	logEvent(b.Logger, level, event, fields)
+}
+
+// returns the lower of both qos levels
+func minQOS(a, b byte) byte {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomqtt/client"
+	"github.com/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBridgeMatch(t *testing.T) {
+	bridge := NewBridge(New(), "tcp://localhost:1883",
+		BridgeTopic{Filter: "in/#", Direction: BridgeIn, RemotePrefix: "remote/"},
+		BridgeTopic{Filter: "out/#", Direction: BridgeOut, LocalPrefix: "local/"},
+	)
+
+	topic, ok := bridge.match("remote/in/foo", false)
+	assert.True(t, ok)
+	assert.Equal(t, "in/#", topic.Filter)
+
+	_, ok = bridge.match("remote/in/foo", true)
+	assert.False(t, ok)
+
+	topic, ok = bridge.match("local/out/foo", true)
+	assert.True(t, ok)
+	assert.Equal(t, "out/#", topic.Filter)
+
+	_, ok = bridge.match("local/out/foo", false)
+	assert.False(t, ok)
+}
+
+func TestBridgeEcho(t *testing.T) {
+	bridge := NewBridge(New(), "tcp://localhost:1883")
+
+	msg := &packet.Message{Topic: "foo", Payload: []byte("bar")}
+
+	assert.False(t, bridge.echo(msg, false))
+
+	bridge.echo(msg, true)
+	assert.True(t, bridge.echo(msg, false))
+	assert.False(t, bridge.echo(msg, false))
+}
+
+func TestBridge(t *testing.T) {
+	remotePort, remoteDone := runBroker(t, New(), 2)
+
+	local := New()
+	localPort, localDone := runBroker(t, local, 1)
+
+	bridge := NewBridge(local, remotePort.URL(), BridgeTopic{
+		Filter:       "#",
+		Direction:    BridgeBoth,
+		QOS:          1,
+		LocalPrefix:  "local/",
+		RemotePrefix: "remote/",
+	})
+	bridge.ReconnectDelay = 10 * time.Millisecond
+
+	err := bridge.Start()
+	assert.NoError(t, err)
+
+	// wait for connection
+	for i := 0; i < 100; i++ {
+		bridge.remoteMutex.Lock()
+		connected := bridge.remote != nil
+		bridge.remoteMutex.Unlock()
+
+		if connected {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	received := make(chan *packet.Message, 1)
+
+	remoteClient := client.New()
+	remoteClient.Callback = func(msg *packet.Message, err error) {
+		assert.NoError(t, err)
+		received <- msg
+	}
+
+	connectFuture, err := remoteClient.Connect(remotePort.URL(), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait())
+
+	subscribeFuture, err := remoteClient.Subscribe("remote/#", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, subscribeFuture.Wait())
+
+	localClient := client.New()
+	localClient.Callback = errorCallback(t)
+
+	connectFuture, err = localClient.Connect(localPort.URL(), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait())
+
+	publishFuture, err := localClient.Publish("local/foo", []byte("bar"), 0, false)
+	assert.NoError(t, err)
+	assert.NoError(t, publishFuture.Wait())
+
+	msg := <-received
+	assert.Equal(t, "remote/foo", msg.Topic)
+	assert.Equal(t, []byte("bar"), msg.Payload)
+
+	err = localClient.Disconnect()
+	assert.NoError(t, err)
+
+	err = remoteClient.Disconnect()
+	assert.NoError(t, err)
+
+	err = bridge.Stop()
+	assert.NoError(t, err)
+
+	<-localDone
+	<-remoteDone
+}
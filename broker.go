@@ -15,31 +15,813 @@
 package broker
 
 import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/gomqtt/packet"
 	"github.com/gomqtt/transport"
 )
 
-// The Logger callback handles incoming log messages.
-type Logger func(msg string)
+// An EventType describes the kind of an Event.
+type EventType int
+
+const (
+	// RetainedMessageCleared is emitted when a client clears a retained
+	// message by publishing a retained message with a zero length payload.
+	// Backends that implement the RetainedClearer interface only report
+	// messages that actually removed a retained message.
+	RetainedMessageCleared EventType = iota
+
+	// CertificateRotated is emitted when a client presents a different
+	// certificate than before that maps to the identity already bound to its
+	// client id. The new fingerprint is available in the clients context.
+	CertificateRotated
+
+	// ClientStalled is emitted when a message could not be handed over to
+	// the writer of a client within the StallTimeout, typically because the
+	// peer is not reading from its connection.
+	ClientStalled
+
+	// SubscriptionRevoked is emitted when an existing subscription of a client
+	// is removed because it is no longer authorized (see Reauthorize).
+	SubscriptionRevoked
+
+	// SlowConsumer is emitted when a client is disconnected because its
+	// outgoing buffer reached the HighWatermark.
+	SlowConsumer
+
+	// ClientConnected is emitted when a client has been acknowledged.
+	ClientConnected
+
+	// ClientDisconnected is emitted when an acknowledged client has been
+	// terminated (see TerminateMode).
+	ClientDisconnected
+
+	// Subscribed is emitted for every granted subscription of a client.
+	Subscribed
+
+	// Unsubscribed is emitted for every topic filter a client unsubscribed
+	// from.
+	Unsubscribed
+
+	// MessagePublished is emitted for every message a client has published,
+	// including wills.
+	MessagePublished
+
+	// SessionTakenOver is emitted for a client whose session is taken over
+	// by a new client with the same client id.
+	SessionTakenOver
+
+	// SessionDiscarded is emitted by a MemoryBackend with the CleanNotify
+	// policy when a client reconnects with a clean session and discards the
+	// messages of its stored session.
+	SessionDiscarded
+
+	// UsageReported is emitted at the end of every UsageInterval for every
+	// subscription of a client that received messages during the interval.
+	UsageReported
+
+	// AuthenticationFailed is emitted when a client is refused because its
+	// credentials or certificate have not been accepted.
+	AuthenticationFailed
+
+	// AdministrativeAction is emitted for every administrative action carried
+	// out on the broker (see RecordAction).
+	AdministrativeAction
+
+	// SheddingChanged is emitted when the LoadShedding starts, escalates or
+	// stops shedding traffic.
+	SheddingChanged
+)
+
+// An Event describes a notable occurrence inside the broker.
+type Event struct {
+	// The type of the event.
+	Type EventType
+
+	// The client that caused the event.
+	Client Client
+
+	// The message related to the event, if any.
+	Message *packet.Message
+
+	// The topic filter related to the event, if any.
+	Topic string
+
+	// The discarded messages of a SessionDiscarded event.
+	Discarded DiscardSummary
+
+	// The delivered messages of a UsageReported event.
+	Usage SubscriptionUsage
+
+	// The name and the target of an AdministrativeAction event, e.g.
+	// "close_client" and the client id.
+	Action string
+	Target string
+
+	// The new shedding decision of a SheddingChanged event.
+	Shedding SheddingStatus
+}
+
+// The EventHandler callback handles emitted events.
+type EventHandler func(event *Event)
 
 // The Broker handles incoming connections and connects them to the backend.
 type Broker struct {
-	Backend Backend
-	Logger  Logger
+	Backend      Backend
+	Logger       Logger
+	EventHandler EventHandler
+
+	// The ErrorHandler receives all errors that terminate a connection, like
+	// read and write failures, protocol violations and backend errors, along
+	// with the affected client. Errors that are not related to a single
+	// client, like a failed start of the backend, are passed with a nil
+	// client. If no handler is set, the errors are written to the optional
+	// ErrorLog similar to the http.Server.
+	ErrorHandler func(client Client, err error)
+	ErrorLog     *log.Logger
 
 	ConnectTimeout time.Duration
+
+	// The default duration after which a persistent session of a disconnected
+	// client expires. A zero duration keeps sessions forever.
+	SessionExpiry time.Duration
+
+	// The default interval after which messages that are queued for offline
+	// sessions or retained expire, if no interval has been attached (see
+	// MessageExpiryAnnotation). A zero interval keeps messages forever.
+	MessageExpiry time.Duration
+
+	// Connections from TrustedProxies are accounted using the address in the
+	// X-Forwarded-For header, if the connection provides it (see HeaderConn).
+	TrustedProxies []*net.IPNet
+
+	// The TLSConfig is used by Launch for "tls" and "wss" urls, e.g. the
+	// config of an acme.Manager that obtains the certificates automatically.
+	TLSConfig *tls.Config
+
+	// Clients using the legacy MQTT 3.1 protocol (protocol name "MQIsdp" and
+	// level 3) are served with the quirks of the protocol: the CONNACK never
+	// signals a present session, as the flag is reserved in MQTT 3.1, and
+	// empty client ids are refused with an "identifier rejected" return code.
+	// If DisableMQTT31 is set to true, these clients are refused with an
+	// "invalid protocol version" return code instead.
+	DisableMQTT31 bool
+
+	// The maximum length of MQTT 3.1 client ids. The specification limits
+	// client ids to 23 characters, but many devices send longer ids. Longer
+	// ids are refused with an "identifier rejected" return code. A zero value
+	// disables the limit.
+	MQTT31ClientIDLength int
+
+	// The ClientIDPolicy restricts the client ids of connecting clients.
+	ClientIDPolicy *ClientIDPolicy
+
+	// Clients that connect with an empty client id and a persistent session
+	// are refused with an "identifier rejected" return code as required by
+	// MQTT 3.1.1. If AssignClientIDs is set, clients that connect with an
+	// empty client id and a clean session are assigned the id returned by the
+	// ClientIDGenerator, which defaults to "auto-" and the uuid of the client.
+	// Clients are refused if the generated id is empty or used by another
+	// client. The assigned id is also stored in the ConnackProperties for the
+	// middleware (see ConnackPropertiesKey). MQTT 3.1 clients are never
+	// assigned a client id.
+	AssignClientIDs   bool
+	ClientIDGenerator func(client Client) string
+
+	// If AuthorizationCacheTTL is set, the authorization decisions of the
+	// backend are cached per client, action and topic for the duration, which
+	// keeps the authorization of publishes to hot topics cheap. Errors are not
+	// cached. Every client caches up to AuthorizationCacheSize decisions and
+	// drops all of them once the limit is reached. A zero size does not limit
+	// the cache. Cached decisions must be dropped using
+	// InvalidateAuthorizations or Reauthorize when the rules change.
+	AuthorizationCacheTTL  time.Duration
+	AuthorizationCacheSize int
+
+	// The maximum number of simultaneously connected clients. Further
+	// connections are refused with a "server unavailable" return code.
+	// Clients that have not completed their handshake are not counted. A zero
+	// value disables the limit.
+	MaxConnections int
+
+	// The maximum number of accepted connections that have not yet completed
+	// the CONNECT handshake. Further connections are closed immediately,
+	// which prevents half-open handshakes from exhausting goroutines and file
+	// descriptors. A zero value disables the limit.
+	MaxPendingConnects int
+
+	// If set, refusals because of the MaxConnections limit are delayed by a
+	// random duration between half and the full RefusalDelay. As MQTT 3.1.1
+	// has no way to send a retry hint, the delay spreads the retries of
+	// clients that immediately reconnect after being refused.
+	RefusalDelay time.Duration
+
+	// The maximum number of messages per second that may be published by all
+	// connections sharing the same accounting key (see AccountingKey). Clients
+	// exceeding the rate are throttled or disconnected if RateLimitDisconnect
+	// is set. A zero value disables the limit.
+	MaxPublishRate      float64
+	RateLimitDisconnect bool
+
+	// The maximum payload size of published messages. Clients publishing
+	// larger payloads are disconnected. A zero value disables the limit.
+	MaxPayloadSize int
+
+	// The maximum size of incoming packets. Connections sending larger
+	// packets are closed. A zero value disables the limit.
+	MaxPacketSize int64
+
+	// The Quotas limit the messages and payload bytes published per sliding
+	// window by an account or client id. Over-quota publishes are still
+	// acknowledged, but their messages are dropped or the client is
+	// disconnected (see Quota). The usage is reported by QuotaUsage.
+	Quotas []Quota
+
+	// The maximum number of unacknowledged outgoing QOS 1 and 2 messages per
+	// client. Further messages are queued in order until a slot is released
+	// by an acknowledgement, which also holds back the publishers of the
+	// messages subject to the StallTimeout. A zero value disables the limit.
+	MaxInflight int
+
+	// If AdvertiseLimits is set, the limits of the broker are stored as the
+	// ConnackProperties in the context of accepted clients before the CONNACK
+	// is sent, so that a Middleware is able to encode them, which is required
+	// (see ConnackPropertiesKey). The ReceiveMaximum and the ServerKeepAlive
+	// are only advertised. Clients that adopt the server keep alive still have
+	// their connections closed according to the keep alive of their CONNECT.
+	AdvertiseLimits bool
+	ReceiveMaximum  uint16
+	ServerKeepAlive time.Duration
+
+	// If WillDelay is set, the will of a client that lost its connection is
+	// published after the delay. The pending will is canceled if a client with
+	// the same client id connects in the meantime.
+	WillDelay time.Duration
+
+	// The TerminateMode defines whether the teardown of connections waits
+	// for Backend.Terminate. Defaults to TerminateSync.
+	TerminateMode TerminateMode
+
+	// The TakeoverPolicy defines how a client is handled that connects with
+	// the client id of a connected client. Defaults to CloseOld.
+	TakeoverPolicy TakeoverPolicy
+
+	// The TakeoverTimeout bounds the wait for a closed client to store its
+	// messages when using CloseOldAndMigrate. Once elapsed, the session is
+	// resumed without the messages that have not been stored yet.
+	TakeoverTimeout time.Duration
+
+	// The SubscriptionOptions callback returns the options of the
+	// subscriptions of remote clients, which cannot transfer them using MQTT
+	// 3.1.1, e.g. to enable NoLocal for the bridges of other brokers. It is
+	// only used with a Backend that implements the OptionsSubscriber
+	// interface.
+	SubscriptionOptions func(client Client, sub packet.Subscription) SubscriptionOptions
+
+	// The SubscriptionIdentifier callback returns the MQTT 5 identifier of
+	// the subscriptions of remote clients, or zero if the subscription has
+	// none. It is only used with sessions that implement the
+	// IdentifierSession interface (see SubscriptionIdentifiersAnnotation).
+	SubscriptionIdentifier func(client Client, sub packet.Subscription) uint32
+
+	// If StallTimeout is set, clients whose writer does not accept a message
+	// within the timeout are considered stalled and handled according to the
+	// StallPolicy. Otherwise, publishing to a stalled client blocks.
+	StallTimeout time.Duration
+	StallPolicy  StallPolicy
+
+	// The number of outgoing messages buffered per client. If LowWatermark is
+	// set, QOS 0 messages are dropped while the buffer holds at least
+	// LowWatermark messages. If HighWatermark is set, clients whose buffer
+	// holds HighWatermark messages are disconnected as slow consumers. Buffered
+	// QOS 1 and 2 messages of persistent sessions are sent when the session is
+	// resumed.
+	OutgoingBuffer int
+	LowWatermark   int
+	HighWatermark  int
+
+	// If AutoTuning is set, the outgoing buffer and the inflight window of
+	// every client are adjusted to its delivery rate within the bounds of the
+	// AutoTuning, which replace the OutgoingBuffer and MaxInflight settings.
+	AutoTuning *AutoTuning
+
+	// If LoadShedding is set, incoming publishes are dropped or deferred
+	// according to their topic class while the broker is overloaded.
+	LoadShedding *LoadShedding
+
+	// If TopicAliasing is set, every connection keeps a table of topic aliases
+	// for the Middleware, which is required (see TopicAliasAnnotation).
+	TopicAliasing *TopicAliasing
+
+	// The IdentityMapper derives the identity of clients that present a
+	// certificate (see CertificateConn). Client ids are bound to the identity
+	// on first use and connections presenting a certificate of a different
+	// identity are refused. Defaults to CertificateIdentity.
+	IdentityMapper IdentityMapper
+
+	// The NodeID identifies the broker in clustered deployments and defaults
+	// to the hostname.
+	NodeID string
+
+	// The Provenance mode defines whether the messages published by clients,
+	// including wills, are stamped with their origin (see Provenance).
+	// Defaults to ProvenanceOff.
+	Provenance ProvenanceMode
+
+	// The number of recent connections recorded per client id that are
+	// included in data exports (see ExportClient). A zero value disables the
+	// records. Defaults to 10.
+	ConnectionHistory int
+
+	// The AffinitySink is notified about session ownership changes.
+	AffinitySink AffinitySink
+
+	// The DisconnectHandler is called with a summary of the messages every
+	// client left behind when it was terminated (see DisconnectObserver).
+	DisconnectHandler func(client Client, summary DisconnectSummary)
+
+	// The Tracer starts spans for the lifecycle of incoming messages.
+	Tracer Tracer
+
+	// The PublishHook is called with the incoming messages and wills of
+	// remote clients once they have been authorized and before they are
+	// passed to the backend. It may veto a message or rewrite its retain flag
+	// and QOS level according to a policy (see PublishRewrite and
+	// StripRetain).
+	PublishHook func(client Client, msg *packet.Message) PublishRewrite
+
+	// The Rewriter remaps the topics of incoming packets after they have
+	// passed the middleware (see TopicRewriter).
+	Rewriter *TopicRewriter
+
+	// Subscriptions to filters that begin with the ReplayPrefix request the
+	// recent messages of the remaining filter if the backend implements the
+	// HistoryStore interface. Defaults to "$replay/".
+	ReplayPrefix string
+
+	// The Random source is used for jitter like the RefusalDelay and defaults
+	// to the global source of math/rand. The UUIDs callback generates the
+	// "uuid" of new clients and defaults to time-based UUIDs. Tests may set
+	// both to deterministic sources (see NewRandom and NewUUIDs).
+	Random Random
+	UUIDs  func() string
+
+	// If SystemNotifications is set to true, the broker will additionally
+	// publish notifications about events to the "$SYS/broker/" topic space.
+	SystemNotifications bool
+
+	// If CanaryInterval is set, the broker publishes a message to the
+	// CanaryTopic at the interval and measures the time until it is routed
+	// back by the backend. Round trips that take longer than the CanaryTimeout
+	// (defaults to the interval) are counted as failures (see Ready and
+	// Canary).
+	CanaryInterval time.Duration
+	CanaryTimeout  time.Duration
+	CanaryTopic    string
+
+	// If UsageInterval is set, the messages and payload bytes delivered to
+	// every subscription are aggregated and emitted as UsageReported events
+	// at the end of every interval, e.g. to bill clients by consumption.
+	UsageInterval time.Duration
+
+	// If CheckOnStart is set to true, the consistency of the backend is
+	// checked and repaired when the broker starts (see Checker).
+	CheckOnStart bool
+
+	// The callbacks used to carry out the runtime operations (see Operations).
+	ConfigReloader func() error
+	LogRotator     func() error
+	StatsFlusher   func() error
+
+	middleware      []Middleware
+	middlewareStats []*hookStats
+	hooks           hookRegistry
+	subsystems      []Subsystem
+	canary          canary
+	usage           usageMeter
+	wills           willScheduler
+	identities      identityRegistry
+	connections     connectionLog
+	limiters        rateLimiters
+	takeovers       takeoverLocks
+	system          systemIdentity
+	terminations    sync.WaitGroup
+	shedder         shedder
+	events          eventRegistry
+	churn           churnRegistry
+	debugs          debugRegistry
+	quotas          quotaEngine
+
+	reservations reservations
+
+	counters      Counters
+	countersMutex sync.Mutex
+
+	listeners    []*Listener
+	clients      map[string]*remoteClient
+	pending      int
+	connected    int
+	clientsMutex sync.Mutex
+	draining     bool
+	started      bool
+
+	// serializes starting and stopping of the broker
+	startMutex sync.Mutex
+
+	metadata annotationRegistry
 }
 
 // New returns a new Broker with a basic MemoryBackend.
 func New() *Broker {
+	hostname, _ := os.Hostname()
+
 	return &Broker{
-		Backend:        NewMemoryBackend(),
-		ConnectTimeout: 10 * time.Second,
+		Backend:                NewMemoryBackend(),
+		ConnectTimeout:         10 * time.Second,
+		TakeoverTimeout:        10 * time.Second,
+		NodeID:                 hostname,
+		CanaryTopic:            "$SYS/broker/canary",
+		ReplayPrefix:           "$replay/",
+		ConnectionHistory:      10,
+		AuthorizationCacheSize: 1000,
+		clients:                make(map[string]*remoteClient),
+		reservations:           reservations{list: defaultReservations()},
+	}
+}
+
+// Start will validate the configuration and start the backend. Calling Start
+// is optional as the broker will start itself when handling the first
+// connection, but allows backends to finish their warm-up before connections
+// are accepted.
+func (b *Broker) Start() error {
+	b.startMutex.Lock()
+	defer b.startMutex.Unlock()
+
+	// check state
+	b.clientsMutex.Lock()
+	started := b.started
+	b.clientsMutex.Unlock()
+	if started {
+		return fmt.Errorf("broker already started")
+	}
+
+	// validate configuration
+	err := b.Validate()
+	if err != nil {
+		return err
+	}
+
+	return b.start()
+}
+
+// Stop will stop the backend. Connected clients are not closed and should be
+// drained beforehand (see Drain).
+func (b *Broker) Stop() error {
+	b.startMutex.Lock()
+	defer b.startMutex.Unlock()
+
+	// check state
+	b.clientsMutex.Lock()
+	started := b.started
+	b.clientsMutex.Unlock()
+	if !started {
+		return fmt.Errorf("broker not started")
 	}
+
+	return b.stop()
 }
 
-// Handle takes over responsibility and handles a transport.Conn.
+// Close will gracefully shut down the broker. It stops accepting new
+// connections, closes all launched listeners, waits for the in-flight QOS
+// messages of connected clients to be acknowledged and sends a
+// DisconnectPacket to every client. Clients that have not disconnected when
+// the timeout is reached are closed forcefully. Finally, the wills of closed
+// clients and pending delayed wills are published and the backend is stopped.
+// The shutdown is always completed and the first error is returned.
+func (b *Broker) Close(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	// stop accepting connections
+	b.clientsMutex.Lock()
+	b.draining = true
+	b.clientsMutex.Unlock()
+
+	// close launched listeners
+	err := b.closeListeners()
+
+	// wait for in-flight messages
+	b.await(deadline, func() bool {
+		for _, c := range b.currentClients() {
+			if c.inflight() > 0 {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	// notify clients
+	for _, c := range b.currentClients() {
+		c.disconnectAs(DisconnectShutdown)
+		c.disconnect()
+	}
+
+	// wait for clients to close their connections
+	b.await(deadline, func() bool {
+		return len(b.currentClients()) == 0
+	})
+
+	// force close remaining clients
+	for _, c := range b.currentClients() {
+		c.disconnectAs(DisconnectShutdown)
+		c.Close(false)
+	}
+
+	// wait for the cleanup of closed clients
+	b.await(time.Now().Add(time.Second), func() bool {
+		return len(b.currentClients()) == 0
+	})
+
+	// publish pending wills
+	b.wills.flush()
+
+	b.startMutex.Lock()
+	defer b.startMutex.Unlock()
+
+	b.clientsMutex.Lock()
+	started := b.started
+	b.clientsMutex.Unlock()
+
+	// stop backend if started
+	if started {
+		_err := b.stop()
+		if err == nil {
+			err = _err
+		}
+	}
+
+	// drop metadata that has not been released
+	b.metadata.reset()
+
+	return err
+}
+
+// polls the condition until it returns true or the deadline is reached
+func (b *Broker) await(deadline time.Time, condition func() bool) {
+	for !condition() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// starts the broker unless it is already started or draining
+func (b *Broker) ensureStarted() error {
+	b.startMutex.Lock()
+	defer b.startMutex.Unlock()
+
+	b.clientsMutex.Lock()
+	skip := b.started || b.draining
+	b.clientsMutex.Unlock()
+	if skip {
+		return nil
+	}
+
+	return b.start()
+}
+
+// starts the backend, recovers orphaned wills and eventually checks the
+// backend before the subsystems are started, the start mutex must be held
+// while the clients mutex is only acquired to mark the broker as started
+func (b *Broker) start() error {
+	err := b.Backend.Start(b)
+	if err != nil {
+		return err
+	}
+
+	err = b.RecoverWills()
+	if err != nil {
+		return err
+	}
+
+	// check and repair backend
+	if b.CheckOnStart {
+		problems, err := b.Check(true)
+		if err != nil {
+			return err
+		}
+
+		for _, problem := range problems {
+			b.log(LogWarn, "inconsistency_repaired", map[string]interface{}{
+				"problem": problem,
+			})
+		}
+	}
+
+	b.clientsMutex.Lock()
+	defer b.clientsMutex.Unlock()
+
+	b.started = true
+
+	b.startCanary()
+	b.startUsage()
+
+	return b.startSubsystems()
+}
+
+// stops the subsystems, the canary, the usage loop and the backend once all
+// pending terminations have finished, the start mutex must be held while the
+// clients mutex is released before waiting for the terminations
+func (b *Broker) stop() error {
+	b.clientsMutex.Lock()
+
+	err := b.stopSubsystems()
+
+	b.stopCanary()
+	b.stopUsage()
+
+	b.started = false
+
+	b.clientsMutex.Unlock()
+
+	// wait for pending terminations
+	b.terminations.Wait()
+
+	_err := b.Backend.Stop()
+	if err == nil {
+		err = _err
+	}
+
+	return err
+}
+
+// Handle takes over responsibility and handles a transport.Conn. The
+// connection is closed immediately if the broker is draining or the backend
+// fails to start.
 func (b *Broker) Handle(conn transport.Conn) {
-	newRemoteClient(b, conn)
+	b.handle(conn, nil)
+}
+
+// handles a connection that has been accepted by the optional listener
+func (b *Broker) handle(conn transport.Conn, l *Listener) {
+	// start broker if necessary
+	err := b.ensureStarted()
+	if err != nil {
+		b.log(LogError, "backend_start_failed", map[string]interface{}{
+			"error": err,
+		})
+
+		b.reportError(nil, err)
+
+		b.refuse(conn, l)
+		return
+	}
+
+	b.clientsMutex.Lock()
+	defer b.clientsMutex.Unlock()
+
+	// refuse connection if draining or stopped in the meantime
+	if b.draining || !b.started {
+		b.refuse(conn, l)
+		return
+	}
+
+	// lazily allocate registry for manually constructed brokers
+	if b.clients == nil {
+		b.clients = make(map[string]*remoteClient)
+	}
+
+	// check pending connects
+	if b.MaxPendingConnects > 0 && b.pending >= b.MaxPendingConnects {
+		b.count(&b.counters.RefusedHandshakes)
+		b.refuse(conn, l)
+		return
+	}
+
+	b.pending++
+
+	c := newRemoteClient(b, conn, l)
+	b.clients[c.Context().Get("uuid").(string)] = c
+}
+
+// PendingConnects returns the number of connections that have not yet
+// completed the CONNECT handshake.
+func (b *Broker) PendingConnects() int {
+	b.clientsMutex.Lock()
+	defer b.clientsMutex.Unlock()
+
+	return b.pending
+}
+
+// marks the handshake of the client as completed
+func (b *Broker) handshaked(c *remoteClient) {
+	b.clientsMutex.Lock()
+	defer b.clientsMutex.Unlock()
+
+	if !c.handshaked {
+		c.handshaked = true
+		b.pending--
+	}
+
+	// record connection
+	clientID, _ := c.Context().Get("client_id").(string)
+	remoteIP, _ := c.Context().Get("remote_ip").(string)
+	b.connections.open(clientID, c.Context().Get("uuid").(string), remoteIP, b.ConnectionHistory)
+}
+
+// closes a connection that will not be handled
+func (b *Broker) refuse(conn transport.Conn, l *Listener) {
+	conn.Close()
+	b.churn.refused(l)
+
+	if l != nil {
+		l.release()
+	}
+}
+
+// removes a client from the registry
+func (b *Broker) remove(c *remoteClient) {
+	b.clientsMutex.Lock()
+	defer b.clientsMutex.Unlock()
+
+	delete(b.clients, c.Context().Get("uuid").(string))
+
+	// close connection record
+	clientID, _ := c.Context().Get("client_id").(string)
+	b.connections.close(clientID, c.Context().Get("uuid").(string))
+
+	// release pending connect
+	if !c.handshaked {
+		c.handshaked = true
+		b.pending--
+	}
+
+	// free connection slot
+	if c.reserved {
+		c.reserved = false
+		b.connected--
+	}
+
+	// free listener slot
+	if c.listener != nil {
+		c.listener.release()
+	}
+}
+
+// returns a list of all currently registered clients
+func (b *Broker) currentClients() []*remoteClient {
+	b.clientsMutex.Lock()
+	defer b.clientsMutex.Unlock()
+
+	list := make([]*remoteClient, 0, len(b.clients))
+	for _, c := range b.clients {
+		list = append(list, c)
+	}
+
+	return list
+}
+
+// reserves a connection slot for the client and returns false if the
+// MaxConnections limit has been reached
+func (b *Broker) reserveConnection(c *remoteClient) bool {
+	b.clientsMutex.Lock()
+	defer b.clientsMutex.Unlock()
+
+	if c.reserved {
+		return true
+	} else if b.MaxConnections > 0 && b.connected >= b.MaxConnections {
+		return false
+	}
+
+	c.reserved = true
+	b.connected++
+
+	return true
+}
+
+// frees the connection slot of the client if it has been reserved
+func (b *Broker) releaseConnection(c *remoteClient) {
+	b.clientsMutex.Lock()
+	defer b.clientsMutex.Unlock()
+
+	if c.reserved {
+		c.reserved = false
+		b.connected--
+	}
+}
+
+// emit will pass the event to the event handler if available and to all
+// registered handlers
+func (b *Broker) emit(event *Event) {
+	if b.EventHandler != nil {
+		b.EventHandler(event)
+	}
+
+	for _, handler := range b.events.all() {
+		handler(event)
+	}
 }
@@ -18,8 +18,14 @@ import (
 // parameter the broker should only allow the "allow:allow" login.
 // If offline=true the broker will also be tested for proper support of QOS 1
 // and QOS 2 offline subscriptions. If unique=true the broker will also be tested
-// for properly disconnecting previous clients with the same client id.
+// for properly handling clients with the same client id according to the
+// takeover policies.
+//
+// Brokers that do not already use injected sources get a seeded Random and
+// sequential UUIDs to keep the runs deterministic.
 func Spec(t *testing.T, builder func(bool) *Broker, offline, unique bool) {
+	builder = deterministic(builder)
+
 	t.Log("Running Broker Publish Subscribe Test (QOS 0)")
 	brokerPublishSubscribeTest(t, builder(false), "test", "test", 0, 0)
 
@@ -74,6 +80,15 @@ func Spec(t *testing.T, builder func(bool) *Broker, offline, unique bool) {
 	t.Log("Running Broker Retained Message Test (Wildcard Some)")
 	brokerRetainedMessageTest(t, builder(false), "foo/bar", "#", 0, 0)
 
+	t.Log("Running Broker Retained Message Test (QOS Downgrade 1->0)")
+	brokerRetainedMessageTest(t, builder(false), "test", "test", 0, 1)
+
+	t.Log("Running Broker Retained Message Test (QOS Downgrade 2->0)")
+	brokerRetainedMessageTest(t, builder(false), "test", "test", 0, 2)
+
+	t.Log("Running Broker Retained Message Test (QOS Downgrade 2->1)")
+	brokerRetainedMessageTest(t, builder(false), "test", "test", 1, 2)
+
 	t.Log("Running Broker Clear Retained Message Test")
 	brokerClearRetainedMessageTest(t, builder(false))
 
@@ -86,11 +101,17 @@ func Spec(t *testing.T, builder func(bool) *Broker, offline, unique bool) {
 	t.Log("Running Broker Will Test (QOS 2)")
 	brokerWillTest(t, builder(false), 2, 2)
 
-	// TODO: Test Clean Disconnect without forwarding the will.
+	t.Log("Running Broker Clean Disconnect Will Test")
+	brokerCleanDisconnectWillTest(t, builder(false))
 
 	t.Log("Running Broker Retained Will Test)")
 	brokerRetainedWillTest(t, builder(false))
 
+	if broker := builder(false); isWillStore(broker) {
+		t.Log("Running Optional Broker Recover Wills Test")
+		brokerRecoverWillsTest(t, broker)
+	}
+
 	t.Log("Running Broker Authentication Test")
 	brokerAuthenticationTest(t, builder(true))
 
@@ -135,11 +156,45 @@ func Spec(t *testing.T, builder func(bool) *Broker, offline, unique bool) {
 	if unique {
 		t.Log("Running Optional Broker Unique Client ID Test")
 		brokerUniqueClientIDTest(t, builder(false))
+
+		t.Log("Running Optional Broker Takeover Reject New Test")
+		brokerTakeoverRejectNewTest(t, builder(false))
+
+		t.Log("Running Optional Broker Takeover Migrate Test")
+		brokerTakeoverMigrateTest(t, builder(false))
 	}
 }
 
-// TODO: Delivers old Wills in case of a crash.
-// TODO: Add Reboot Persistence Test?
+// RestartSpec will test a Broker with a persistent Backend and Session
+// implementation to resume the QOS 2 flows of stored sessions after a restart
+// and deliver the messages exactly once. The builder callback is called with
+// nil for the first broker and with the closed broker when restarting, so it
+// can return a broker whose backend loads the state persisted by the closed
+// broker.
+func RestartSpec(t *testing.T, builder func(previous *Broker) *Broker) {
+	t.Log("Running Broker Restart Test (Awaiting PUBREL)")
+	brokerRestartPubrelTest(t, builder)
+
+	t.Log("Running Broker Restart Test (Awaiting PUBCOMP)")
+	brokerRestartPubcompTest(t, builder)
+}
+
+// wraps the builder to inject deterministic sources
+func deterministic(builder func(bool) *Broker) func(bool) *Broker {
+	return func(restricted bool) *Broker {
+		broker := builder(restricted)
+
+		if broker.Random == nil {
+			broker.Random = NewRandom(1)
+		}
+
+		if broker.UUIDs == nil {
+			broker.UUIDs = NewUUIDs("spec-")
+		}
+
+		return broker
+	}
+}
 
 func runBroker(t *testing.T, broker *Broker, num int) (*tools.Port, chan struct{}) {
 	port := tools.NewPort()
@@ -410,6 +465,69 @@ func brokerWillTest(t *testing.T, broker *Broker, sub, pub uint8) {
 	<-done
 }
 
+func brokerCleanDisconnectWillTest(t *testing.T, broker *Broker) {
+	port, done := runBroker(t, broker, 2)
+
+	// client1 connects with a will
+
+	client1 := client.New()
+	client1.Callback = errorCallback(t)
+
+	opts := client.NewOptions()
+	opts.Will = &packet.Message{
+		Topic:   "test",
+		Payload: []byte("will"),
+	}
+
+	connectFuture1, err := client1.Connect(port.URL(), opts)
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture1.Wait())
+	assert.Equal(t, packet.ConnectionAccepted, connectFuture1.ReturnCode)
+	assert.False(t, connectFuture1.SessionPresent)
+
+	// client2 subscribes to the wills topic
+
+	client2 := client.New()
+	wait := make(chan struct{})
+
+	client2.Callback = func(msg *packet.Message, err error) {
+		assert.NoError(t, err)
+		assert.Equal(t, "test", msg.Topic)
+		assert.Equal(t, []byte("test"), msg.Payload)
+
+		close(wait)
+	}
+
+	connectFuture2, err := client2.Connect(port.URL(), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture2.Wait())
+	assert.Equal(t, packet.ConnectionAccepted, connectFuture2.ReturnCode)
+	assert.False(t, connectFuture2.SessionPresent)
+
+	subscribeFuture, err := client2.Subscribe("test", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, subscribeFuture.Wait())
+	assert.Equal(t, []uint8{0}, subscribeFuture.ReturnCodes)
+
+	// client1 disconnects cleanly
+
+	err = client1.Disconnect()
+	assert.NoError(t, err)
+
+	// client2 publishes a message that must arrive before any will
+
+	publishFuture, err := client2.Publish("test", []byte("test"), 0, false)
+	assert.NoError(t, err)
+	assert.NoError(t, publishFuture.Wait())
+
+	<-wait
+
+	err = client2.Disconnect()
+	assert.NoError(t, err)
+
+	<-done
+}
+
 func brokerRetainedWillTest(t *testing.T, broker *Broker) {
 	port, done := runBroker(t, broker, 2)
 
@@ -469,6 +587,71 @@ func brokerRetainedWillTest(t *testing.T, broker *Broker) {
 	<-done
 }
 
+func isWillStore(broker *Broker) bool {
+	_, ok := broker.Backend.(WillStore)
+	return ok
+}
+
+func brokerRecoverWillsTest(t *testing.T, broker *Broker) {
+	store := broker.Backend.(WillStore)
+
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test", QOS: 1}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{1}
+	suback.PacketID = 1
+
+	will := packet.NewPublishPacket()
+	will.Message = packet.Message{Topic: "test", Payload: []byte("test"), QOS: 1}
+	will.PacketID = 1
+
+	puback := packet.NewPubackPacket()
+	puback.PacketID = 1
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	// client subscribes to the wills topic
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Test(t, conn)
+
+	// a will is left behind by a client that was connected during a crash
+
+	err = store.StoreWill("crashed", &will.Message)
+	assert.NoError(t, err)
+
+	err = broker.RecoverWills()
+	assert.NoError(t, err)
+
+	// client should receive the will
+
+	tools.NewFlow().
+		Receive(will).
+		Send(puback).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	wills, err := store.StoredWills()
+	assert.NoError(t, err)
+	assert.Empty(t, wills)
+
+	<-done
+}
+
 func brokerUnsubscribeTest(t *testing.T, broker *Broker, qos uint8) {
 	port, done := runBroker(t, broker, 1)
 
@@ -988,7 +1171,7 @@ func brokerPubrelResendTestQOS2(t *testing.T, broker *Broker) {
 
 	disconnect := packet.NewDisconnectPacket()
 
-	port, done := runBroker(t, broker, 2)
+	port, done := runBroker(t, broker, 3)
 
 	conn1, err := transport.Dial(port.URL())
 	assert.NoError(t, err)
@@ -999,10 +1182,24 @@ func brokerPubrelResendTestQOS2(t *testing.T, broker *Broker) {
 		Skip(). // connack
 		Send(subscribe).
 		Skip(). // suback
+		Test(t, conn1)
+
+	conn0, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+	assert.NotNil(t, conn0)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Skip(). // connack
 		Send(publishOut).
 		Skip(). // pubrec
 		Send(pubrelOut).
 		Skip(). // pubcomp
+		Send(disconnect).
+		Close().
+		Test(t, conn0)
+
+	tools.NewFlow().
 		Receive(publishIn).
 		Send(pubrecIn).
 		Close().
@@ -1026,6 +1223,227 @@ func brokerPubrelResendTestQOS2(t *testing.T, broker *Broker) {
 	<-done
 }
 
+// closes the broker after its clients have disconnected and builds the
+// restarted broker
+func restartBroker(t *testing.T, builder func(*Broker) *Broker, broker *Broker) *Broker {
+	err := broker.Close(time.Second)
+	assert.NoError(t, err)
+
+	return builder(broker)
+}
+
+func brokerRestartPubrelTest(t *testing.T, builder func(*Broker) *Broker) {
+	connect := packet.NewConnectPacket()
+	connect.CleanSession = false
+	connect.ClientID = "publisher"
+
+	connack := packet.NewConnackPacket()
+
+	resumed := packet.NewConnackPacket()
+	resumed.SessionPresent = true
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.PacketID = 1
+	subscribe.Subscriptions = []packet.Subscription{
+		{Topic: "test", QOS: 2},
+	}
+
+	suback := packet.NewSubackPacket()
+	suback.PacketID = 1
+	suback.ReturnCodes = []uint8{2}
+
+	publish := packet.NewPublishPacket()
+	publish.PacketID = 1
+	publish.Message = packet.Message{Topic: "test", Payload: []byte("test"), QOS: 2}
+
+	pubrec := packet.NewPubrecPacket()
+	pubrec.PacketID = 1
+
+	pubrel := packet.NewPubrelPacket()
+	pubrel.PacketID = 1
+
+	pubcomp := packet.NewPubcompPacket()
+	pubcomp.PacketID = 1
+
+	broker := builder(nil)
+
+	port, done := runBroker(t, broker, 1)
+
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	// the broker restarts before the publisher has released the message
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(publish).
+		Receive(pubrec).
+		Close().
+		Test(t, conn1)
+
+	<-done
+
+	broker = restartBroker(t, builder, broker)
+
+	port, done = runBroker(t, broker, 2)
+
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Test(t, conn2)
+
+	conn3, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	// the publisher releases the message twice as the first PUBCOMP might
+	// have been lost
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(resumed).
+		Send(pubrel).
+		Receive(pubcomp).
+		Send(pubrel).
+		Receive(pubcomp).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn3)
+
+	// the subscriber receives the message exactly once
+
+	tools.NewFlow().
+		Receive(publish).
+		Send(pubrec).
+		Receive(pubrel).
+		Send(pubcomp).
+		Send(packet.NewPingreqPacket()).
+		Receive(packet.NewPingrespPacket()).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn2)
+
+	<-done
+
+	err = broker.Close(time.Second)
+	assert.NoError(t, err)
+}
+
+func brokerRestartPubcompTest(t *testing.T, builder func(*Broker) *Broker) {
+	connect := packet.NewConnectPacket()
+	connect.CleanSession = false
+	connect.ClientID = "subscriber"
+
+	connack := packet.NewConnackPacket()
+
+	resumed := packet.NewConnackPacket()
+	resumed.SessionPresent = true
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.PacketID = 1
+	subscribe.Subscriptions = []packet.Subscription{
+		{Topic: "test", QOS: 2},
+	}
+
+	suback := packet.NewSubackPacket()
+	suback.PacketID = 1
+	suback.ReturnCodes = []uint8{2}
+
+	publish := packet.NewPublishPacket()
+	publish.PacketID = 1
+	publish.Message = packet.Message{Topic: "test", Payload: []byte("test"), QOS: 2}
+
+	pubrec := packet.NewPubrecPacket()
+	pubrec.PacketID = 1
+
+	pubrel := packet.NewPubrelPacket()
+	pubrel.PacketID = 1
+
+	pubcomp := packet.NewPubcompPacket()
+	pubcomp.PacketID = 1
+
+	broker := builder(nil)
+
+	port, done := runBroker(t, broker, 2)
+
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Test(t, conn1)
+
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(connack).
+		Send(publish).
+		Receive(pubrec).
+		Send(pubrel).
+		Receive(pubcomp).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn2)
+
+	// the broker restarts before the subscriber has completed the flow
+
+	tools.NewFlow().
+		Receive(publish).
+		Send(pubrec).
+		Receive(pubrel).
+		Close().
+		Test(t, conn1)
+
+	<-done
+
+	broker = restartBroker(t, builder, broker)
+
+	port, done = runBroker(t, broker, 2)
+
+	conn3, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	// the resumed flow is released again instead of resending the message
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(resumed).
+		Receive(pubrel).
+		Send(pubcomp).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn3)
+
+	conn4, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	// the completed flow is not resumed again
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(resumed).
+		Send(packet.NewPingreqPacket()).
+		Receive(packet.NewPingrespPacket()).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn4)
+
+	<-done
+
+	err = broker.Close(time.Second)
+	assert.NoError(t, err)
+}
+
 func brokerOfflineSubscriptionTest(t *testing.T, broker *Broker, qos uint8) {
 	port, done := runBroker(t, broker, 3)
 
@@ -1140,3 +1558,115 @@ func brokerUniqueClientIDTest(t *testing.T, broker *Broker) {
 
 	<-done
 }
+
+func brokerTakeoverRejectNewTest(t *testing.T, broker *Broker) {
+	broker.TakeoverPolicy = RejectNew
+
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+
+	connack := packet.NewConnackPacket()
+
+	rejected := packet.NewConnackPacket()
+	rejected.ReturnCode = packet.ErrIdentifierRejected
+
+	port, done := runBroker(t, broker, 2)
+
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+	assert.NotNil(t, conn1)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Test(t, conn1)
+
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+	assert.NotNil(t, conn2)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(rejected).
+		End().
+		Test(t, conn2)
+
+	// the connected client is kept
+	tools.NewFlow().
+		Send(packet.NewPingreqPacket()).
+		Receive(packet.NewPingrespPacket()).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn1)
+
+	<-done
+}
+
+func brokerTakeoverMigrateTest(t *testing.T, broker *Broker) {
+	broker.TakeoverPolicy = CloseOldAndMigrate
+
+	connect := packet.NewConnectPacket()
+	connect.CleanSession = false
+	connect.ClientID = "test"
+
+	connack := packet.NewConnackPacket()
+	connack.SessionPresent = true
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.PacketID = 1
+	subscribe.Subscriptions = []packet.Subscription{
+		{Topic: "test", QOS: 1},
+	}
+
+	publishOut := packet.NewPublishPacket()
+	publishOut.PacketID = 2
+	publishOut.Message.Topic = "test"
+	publishOut.Message.QOS = 1
+
+	publishIn := packet.NewPublishPacket()
+	publishIn.PacketID = 1
+	publishIn.Message.Topic = "test"
+	publishIn.Message.QOS = 1
+
+	pubackIn := packet.NewPubackPacket()
+	pubackIn.PacketID = 1
+
+	port, done := runBroker(t, broker, 2)
+
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+	assert.NotNil(t, conn1)
+
+	tools.NewFlow().
+		Send(connect).
+		Skip(). // connack
+		Send(subscribe).
+		Skip(). // suback
+		Send(publishOut).
+		Skip(). // puback
+		Receive(publishIn).
+		Test(t, conn1)
+
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+	assert.NotNil(t, conn2)
+
+	// the unacknowledged message is handed over to the new client
+	publishIn.Dup = true
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Receive(publishIn).
+		Send(pubackIn).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn2)
+
+	// the previous client has been closed
+	tools.NewFlow().
+		End().
+		Test(t, conn1)
+
+	<-done
+}
@@ -15,7 +15,9 @@
 package broker
 
 import (
+	"fmt"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -44,6 +46,19 @@ func TestBroker(t *testing.T) {
 	}, true, true)
 }
 
+func TestBrokerRestart(t *testing.T) {
+	RestartSpec(t, func(previous *Broker) *Broker {
+		broker := New()
+
+		// the memory backend outlives the broker
+		if previous != nil {
+			broker.Backend = previous.Backend
+		}
+
+		return broker
+	})
+}
+
 func TestConnectTimeout(t *testing.T) {
 	broker := New()
 	broker.ConnectTimeout = 10 * time.Millisecond
@@ -122,3 +137,898 @@ func TestKeepAliveTimeout(t *testing.T) {
 
 	<-done
 }
+
+func TestRetainedMessageClearedEvent(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.PacketID = 1
+	subscribe.Subscriptions = []packet.Subscription{
+		{Topic: "$SYS/broker/retained/cleared", QOS: 0},
+	}
+
+	suback := packet.NewSubackPacket()
+	suback.PacketID = 1
+	suback.ReturnCodes = []uint8{0}
+
+	retain := packet.NewPublishPacket()
+	retain.Message.Topic = "test"
+	retain.Message.Payload = []byte("test")
+	retain.Message.Retain = true
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+	publish.Message.Retain = true
+
+	broker := New()
+	broker.SystemNotifications = true
+
+	events := make(chan *Event, 2)
+	notifications := make(chan *Event, 2)
+	broker.EventHandler = func(event *Event) {
+		if event.Type == RetainedMessageCleared {
+			events <- event
+		} else if event.Type == MessagePublished && event.Message.Topic == "$SYS/broker/retained/cleared" {
+			notifications <- event
+		}
+	}
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+	assert.NotNil(t, conn)
+
+	tools.NewFlow().
+		Send(connect).
+		Skip(). // connack
+		Send(subscribe).
+		Receive(suback).
+		Send(retain).
+		Send(publish).
+		Skip(). // notification
+		Send(publish).
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	event := <-events
+	assert.Equal(t, RetainedMessageCleared, event.Type)
+	assert.Equal(t, "test", event.Message.Topic)
+	assert.Equal(t, "test", event.Client.Context().Get("client_id"))
+
+	// clearing a missing message is not reported
+	assert.Len(t, events, 0)
+
+	// notifications are published by the system client
+	event = <-notifications
+	assert.True(t, IsSystemClient(event.Client))
+	assert.Len(t, notifications, 0)
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.Username = "user"
+	connect.Password = "secret"
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.PacketID = 1
+	subscribe.Subscriptions = []packet.Subscription{
+		{Topic: "test", QOS: 0},
+	}
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("test")
+
+	// record
+
+	recorder := NewRecorder()
+	recorder.Anonymize = true
+
+	// brokers that require the login
+	newBroker := func() *Broker {
+		backend := NewMemoryBackend()
+		backend.Logins = map[string]string{"user": "secret"}
+
+		broker := New()
+		broker.Backend = backend
+
+		return broker
+	}
+
+	broker := newBroker()
+	port := tools.NewPort()
+
+	server, err := transport.Launch(port.URL())
+	assert.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+
+			broker.Handle(recorder.Wrap(conn))
+		}
+	}()
+
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Skip(). // connack
+		Send(subscribe).
+		Skip(). // suback
+		Test(t, conn1)
+
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Skip(). // connack
+		Send(publish).
+		Close().
+		Test(t, conn2)
+
+	tools.NewFlow().
+		Skip(). // publish
+		Close().
+		Test(t, conn1)
+
+	time.Sleep(50 * time.Millisecond)
+
+	err = server.Close()
+	assert.NoError(t, err)
+
+	trace := recorder.Trace()
+	assert.NotEmpty(t, trace.Records)
+	assert.Equal(t, 1, len(deliveredMessages(trace)[1]))
+
+	// replay without the unrecorded password is refused
+
+	refusing := newBroker()
+	port = tools.NewPort()
+
+	refusingServer, err := transport.Launch(port.URL())
+	assert.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := refusingServer.Accept()
+			if err != nil {
+				return
+			}
+
+			refusing.Handle(conn)
+		}
+	}()
+
+	// the refused connection is closed and may fail the replay early
+	result, err := Replay(port.URL(), trace, 100*time.Millisecond, nil)
+	if err == nil {
+		assert.NotEmpty(t, CompareRoutes(trace, result))
+	}
+
+	assert.NoError(t, refusingServer.Close())
+
+	// replay with substitute credentials
+
+	port, done := runBroker(t, newBroker(), 2)
+
+	var usernames []string
+	result, err = Replay(port.URL(), trace, time.Second, func(conn int, username string) (string, string) {
+		usernames = append(usernames, username)
+		return "user", "secret"
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, CompareRoutes(trace, result))
+
+	// the usernames have been anonymized consistently
+	assert.Len(t, usernames, 2)
+	assert.NotEqual(t, "user", usernames[0])
+	assert.Equal(t, usernames[0], usernames[1])
+
+	<-done
+}
+
+func TestRecordCredentials(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.Username = "user"
+	connect.Password = "secret"
+
+	data, err := encodeTracePacket(connect, nil)
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(string(data), `"user"`))
+	assert.False(t, strings.Contains(string(data), "secret"))
+
+	key := newTraceKey()
+	data, err = encodeTracePacket(connect, key)
+	assert.NoError(t, err)
+	assert.False(t, strings.Contains(string(data), `"user"`))
+	assert.False(t, strings.Contains(string(data), "secret"))
+
+	// anonymized values depend on the key
+	same, err := encodeTracePacket(connect, key)
+	assert.NoError(t, err)
+	assert.Equal(t, string(data), string(same))
+
+	other, err := encodeTracePacket(connect, newTraceKey())
+	assert.NoError(t, err)
+	assert.NotEqual(t, string(data), string(other))
+
+	// the recorded packet is left untouched
+	assert.Equal(t, "secret", connect.Password)
+}
+
+func TestAuthorization(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.PacketID = 1
+	subscribe.Subscriptions = []packet.Subscription{
+		{Topic: "#", QOS: 0},
+		{Topic: "deny", QOS: 0},
+	}
+
+	suback := packet.NewSubackPacket()
+	suback.PacketID = 1
+	suback.ReturnCodes = []uint8{0, packet.QOSFailure}
+
+	publish1 := packet.NewPublishPacket()
+	publish1.PacketID = 2
+	publish1.Message.Topic = "deny"
+	publish1.Message.QOS = 1
+
+	puback := packet.NewPubackPacket()
+	puback.PacketID = 2
+
+	publish2 := packet.NewPublishPacket()
+	publish2.Message.Topic = "allow"
+
+	backend := NewMemoryBackend()
+	backend.Authorizer = func(client Client, topic string, action Action) bool {
+		return topic != "deny"
+	}
+
+	broker := New()
+	broker.Backend = backend
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+	assert.NotNil(t, conn)
+
+	tools.NewFlow().
+		Send(connect).
+		Skip(). // connack
+		Send(subscribe).
+		Receive(suback).
+		Send(publish1).
+		Receive(puback).
+		Send(publish2).
+		Receive(publish2).
+		Close().
+		Test(t, conn)
+
+	<-done
+}
+
+func TestReauthorize(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.PacketID = 1
+	subscribe.Subscriptions = []packet.Subscription{
+		{Topic: "foo", QOS: 0},
+		{Topic: "bar", QOS: 0},
+	}
+
+	suback := packet.NewSubackPacket()
+	suback.PacketID = 1
+	suback.ReturnCodes = []uint8{0, 0}
+
+	var mutex sync.Mutex
+	denied := ""
+
+	backend := NewMemoryBackend()
+	backend.Authorizer = func(client Client, topic string, action Action) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return topic != denied
+	}
+
+	var revoked []string
+
+	broker := New()
+	broker.Backend = backend
+	broker.EventHandler = func(event *Event) {
+		if event.Type == SubscriptionRevoked {
+			revoked = append(revoked, event.Topic)
+		}
+	}
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Test(t, conn)
+
+	// change acl
+	mutex.Lock()
+	denied = "foo"
+	mutex.Unlock()
+
+	err = broker.Reauthorize()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, revoked)
+
+	snapshot, err := broker.Snapshot()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bar"}, snapshot.Clients[0].Subscriptions)
+
+	tools.NewFlow().
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+}
+
+func TestDrainAndSnapshot(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+
+	connack := packet.NewConnackPacket()
+
+	broker := New()
+
+	port, done := runBroker(t, broker, 2)
+
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Test(t, conn1)
+
+	snapshot, err := broker.Snapshot()
+	assert.NoError(t, err)
+	assert.False(t, snapshot.Draining)
+	assert.Equal(t, 1, len(snapshot.Clients))
+	assert.Equal(t, "test", snapshot.Clients[0].ClientID)
+
+	err = broker.Drain()
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		End().
+		Test(t, conn1)
+
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		End().
+		Test(t, conn2)
+
+	<-done
+
+	snapshot, err = broker.Snapshot()
+	assert.NoError(t, err)
+	assert.True(t, snapshot.Draining)
+	assert.Empty(t, snapshot.Clients)
+}
+
+func TestClose(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+
+	connack := packet.NewConnackPacket()
+
+	disconnect := packet.NewDisconnectPacket()
+
+	broker := New()
+
+	port, done := runBroker(t, broker, 2)
+
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Test(t, conn1)
+
+	go func() {
+		tools.NewFlow().
+			Receive(disconnect).
+			Close().
+			Test(t, conn1)
+	}()
+
+	err = broker.Close(time.Second)
+	assert.NoError(t, err)
+
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		End().
+		Test(t, conn2)
+
+	<-done
+
+	assert.Empty(t, broker.currentClients())
+}
+
+type failingServer struct {
+	transport.Server
+}
+
+func (s *failingServer) Close() error {
+	s.Server.Close()
+	return fmt.Errorf("failed")
+}
+
+func TestCloseListenerError(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+
+	connack := packet.NewConnackPacket()
+
+	disconnect := packet.NewDisconnectPacket()
+
+	broker := New()
+
+	port, done := runBroker(t, broker, 1)
+
+	server, err := transport.Launch(tools.NewPort().URL())
+	assert.NoError(t, err)
+
+	broker.listeners = append(broker.listeners, &Listener{
+		server: &failingServer{Server: server},
+	})
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Test(t, conn)
+
+	go func() {
+		tools.NewFlow().
+			Receive(disconnect).
+			Close().
+			Test(t, conn)
+	}()
+
+	err = broker.Close(time.Second)
+	assert.Error(t, err)
+
+	<-done
+
+	assert.Empty(t, broker.currentClients())
+	assert.False(t, broker.started)
+}
+
+func TestAffinitySink(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+	connect.CleanSession = true
+
+	connack := packet.NewConnackPacket()
+
+	sink := NewMemoryAffinitySink()
+
+	broker := New()
+	broker.NodeID = "node1"
+	broker.AffinitySink = sink
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Test(t, conn)
+
+	node, ok := sink.Owner("test")
+	assert.True(t, ok)
+	assert.Equal(t, "node1", node)
+
+	tools.NewFlow().
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return len(broker.currentClients()) == 0
+	})
+
+	_, ok = sink.Owner("test")
+	assert.False(t, ok)
+}
+
+func TestStallDetection(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	stalled := make(chan Client, 1)
+
+	broker := New()
+	broker.StallTimeout = 50 * time.Millisecond
+	broker.StallPolicy = StallClose
+	broker.EventHandler = func(event *Event) {
+		if event.Type == ClientStalled {
+			stalled <- event.Client
+		}
+	}
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Test(t, conn)
+
+	// publish until the writer stalls as the client is not reading
+	publisher := NewLocalClient(func(*packet.Message) {})
+	for i := 0; i < 1000 && len(stalled) == 0; i++ {
+		err = broker.Backend.Publish(publisher, &packet.Message{
+			Topic:   "test",
+			Payload: []byte("test"),
+		})
+		assert.NoError(t, err)
+	}
+
+	<-stalled
+	<-done
+
+	assert.Equal(t, int64(1), broker.Counters().StalledClients)
+}
+
+func TestOutgoingWatermarks(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test", QOS: 1}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{1}
+	suback.PacketID = 1
+
+	slow := make(chan Client, 1)
+
+	broker := New()
+	broker.OutgoingBuffer = 10
+	broker.LowWatermark = 5
+	broker.HighWatermark = 10
+	broker.EventHandler = func(event *Event) {
+		if event.Type == SlowConsumer {
+			slow <- event.Client
+		}
+	}
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Test(t, conn)
+
+	client := broker.currentClients()[0]
+
+	// qos 0 messages are dropped above the low watermark
+	var dropped error
+	for i := 0; i < 1000 && dropped == nil; i++ {
+		dropped = client.Publish(&packet.Message{
+			Topic:   "test",
+			Payload: []byte("test"),
+		})
+	}
+
+	assert.Equal(t, ErrBackpressure, dropped)
+
+	// slow consumers are disconnected at the high watermark
+	publisher := NewLocalClient(func(*packet.Message) {})
+	for i := 0; i < 1000 && len(slow) == 0; i++ {
+		err = broker.Backend.Publish(publisher, &packet.Message{
+			Topic:   "test",
+			Payload: []byte("test"),
+			QOS:     1,
+		})
+		assert.NoError(t, err)
+	}
+
+	<-slow
+	<-done
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return len(broker.currentClients()) == 0
+	})
+
+	assert.Equal(t, ErrClientOffline, client.Publish(&packet.Message{Topic: "test"}))
+	assert.Equal(t, int64(1), broker.Counters().SlowConsumers)
+	assert.True(t, broker.Counters().DroppedMessages > 0)
+}
+
+func TestRetainedMessageWatermarks(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test/#"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	broker := New()
+	broker.OutgoingBuffer = 10
+	broker.LowWatermark = 5
+
+	publisher := NewLocalClient(func(*packet.Message) {})
+	for i := 0; i < 1000; i++ {
+		err := broker.Backend.Publish(publisher, &packet.Message{
+			Topic:   fmt.Sprintf("test/%d", i),
+			Payload: []byte("test"),
+			Retain:  true,
+		})
+		assert.NoError(t, err)
+	}
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Test(t, conn)
+
+	// retained messages are dropped like live messages
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return broker.Counters().DroppedMessages > 0
+	})
+
+	assert.True(t, broker.Counters().DroppedMessages > 0)
+	assert.NoError(t, conn.Close())
+
+	<-done
+}
+
+func TestQOS2Completion(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+	connect.CleanSession = false
+
+	connack := packet.NewConnackPacket()
+
+	pubrel := packet.NewPubrelPacket()
+	pubrel.PacketID = 5
+
+	pubcomp := packet.NewPubcompPacket()
+	pubcomp.PacketID = 5
+
+	pubrec := packet.NewPubrecPacket()
+	pubrec.PacketID = 6
+
+	pubrelOut := packet.NewPubrelPacket()
+	pubrelOut.PacketID = 6
+
+	broker := New()
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	// already completed flows are completed again without storing them
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(pubrel).
+		Receive(pubcomp).
+		Send(pubrec).
+		Receive(pubrelOut).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	session := broker.Backend.(*MemoryBackend).sessions["test"]
+	pkts, err := session.AllPackets(outgoing)
+	assert.NoError(t, err)
+	assert.Empty(t, pkts)
+}
+
+func TestPacketIDReuse(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	// store an unfinished flow that uses the first packet id
+	session, _, err := backend.Setup(newFakeClient(), "test", false)
+	assert.NoError(t, err)
+
+	stored := packet.NewPublishPacket()
+	stored.PacketID = 1
+	stored.Message = packet.Message{Topic: "other", Payload: []byte("test"), QOS: 1}
+
+	err = session.SavePacket(outgoing, stored)
+	assert.NoError(t, err)
+
+	err = backend.Terminate(session.(*MemorySession).currentClient)
+	assert.NoError(t, err)
+
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+	connect.CleanSession = false
+
+	connack := packet.NewConnackPacket()
+	connack.SessionPresent = true
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test", QOS: 1}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{1}
+	suback.PacketID = 1
+
+	publish := packet.NewPublishPacket()
+	publish.PacketID = 10
+	publish.Message = packet.Message{Topic: "test", Payload: []byte("test"), QOS: 1}
+
+	puback := packet.NewPubackPacket()
+	puback.PacketID = 10
+
+	delivered := packet.NewPublishPacket()
+	delivered.PacketID = 2
+	delivered.Message = publish.Message
+
+	broker := New()
+	broker.Backend = backend
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	resent := *stored
+	resent.Dup = true
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Receive(&resent).
+		Send(subscribe).
+		Receive(suback).
+		Send(publish).
+		Receive(puback).
+		Receive(delivered).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+}
+
+func TestMQTT31(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.Version = packet.Version31
+	connect.ClientID = "legacy"
+	connect.CleanSession = false
+
+	connack := packet.NewConnackPacket()
+
+	anonymous := packet.NewConnectPacket()
+	anonymous.Version = packet.Version31
+	anonymous.CleanSession = true
+
+	long := packet.NewConnectPacket()
+	long.Version = packet.Version31
+	long.ClientID = strings.Repeat("x", 24)
+
+	rejected := packet.NewConnackPacket()
+	rejected.ReturnCode = packet.ErrIdentifierRejected
+
+	broker := New()
+	broker.MQTT31ClientIDLength = 23
+
+	port, done := runBroker(t, broker, 4)
+
+	// the resumed session is not signaled
+	for i := 0; i < 2; i++ {
+		conn, err := transport.Dial(port.URL())
+		assert.NoError(t, err)
+
+		tools.NewFlow().
+			Send(connect).
+			Receive(connack).
+			Send(packet.NewDisconnectPacket()).
+			Close().
+			Test(t, conn)
+	}
+
+	for _, pkt := range []*packet.ConnectPacket{anonymous, long} {
+		conn, err := transport.Dial(port.URL())
+		assert.NoError(t, err)
+
+		tools.NewFlow().
+			Send(pkt).
+			Receive(rejected).
+			End().
+			Test(t, conn)
+	}
+
+	<-done
+
+	refused := packet.NewConnackPacket()
+	refused.ReturnCode = packet.ErrInvalidProtocolVersion
+
+	broker = New()
+	broker.DisableMQTT31 = true
+
+	port, done = runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(refused).
+		End().
+		Test(t, conn)
+
+	<-done
+}
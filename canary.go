@@ -0,0 +1,228 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomqtt/packet"
+)
+
+// CanaryStatus describes the outcome of the canary round trips.
+type CanaryStatus struct {
+	// The latency of the last successful round trip.
+	Latency time.Duration
+
+	// The time of the last successful round trip.
+	LastSuccess time.Time
+
+	// The number of consecutive failed round trips.
+	Failures int
+}
+
+// the state of the canary loop
+type canary struct {
+	status CanaryStatus
+	probed bool
+	quit   chan struct{}
+	done   chan struct{}
+	mutex  sync.Mutex
+}
+
+// Canary returns the status of the canary round trips.
+func (b *Broker) Canary() CanaryStatus {
+	b.canary.mutex.Lock()
+	defer b.canary.mutex.Unlock()
+
+	return b.canary.status
+}
+
+// Ready returns an error if the broker is not able to serve clients. A broker
+// is ready when it has been started, is not draining and the last canary
+// round trip succeeded if CanaryInterval is set.
+func (b *Broker) Ready() error {
+	b.clientsMutex.Lock()
+	started, draining := b.started, b.draining
+	b.clientsMutex.Unlock()
+
+	// check state
+	if !started {
+		return fmt.Errorf("broker not started")
+	} else if draining {
+		return fmt.Errorf("broker draining")
+	}
+
+	// check canary
+	if b.CanaryInterval > 0 {
+		b.canary.mutex.Lock()
+		defer b.canary.mutex.Unlock()
+
+		if !b.canary.probed {
+			return fmt.Errorf("canary pending")
+		} else if b.canary.status.Failures > 0 {
+			return fmt.Errorf("canary failed %d times", b.canary.status.Failures)
+		}
+	}
+
+	return nil
+}
+
+// starts the canary loop if enabled
+func (b *Broker) startCanary() {
+	if b.CanaryInterval <= 0 {
+		return
+	}
+
+	b.canary.mutex.Lock()
+	b.canary.status = CanaryStatus{}
+	b.canary.probed = false
+	b.canary.quit = make(chan struct{})
+	b.canary.done = make(chan struct{})
+	quit, done := b.canary.quit, b.canary.done
+	b.canary.mutex.Unlock()
+
+	go b.runCanary(quit, done)
+}
+
+// stops the canary loop and waits until it has returned
+func (b *Broker) stopCanary() {
+	b.canary.mutex.Lock()
+	quit, done := b.canary.quit, b.canary.done
+	b.canary.quit = nil
+	b.canary.done = nil
+	b.canary.mutex.Unlock()
+
+	if quit == nil {
+		return
+	}
+
+	close(quit)
+	<-done
+}
+
+// periodically publishes a message to the canary topic and measures the time
+// until it is received again
+func (b *Broker) runCanary(quit, done chan struct{}) {
+	defer close(done)
+
+	received := make(chan string, 1)
+
+	client := NewLocalClient(func(msg *packet.Message) {
+		select {
+		case received <- string(msg.Payload):
+		default:
+		}
+	})
+
+	// setup client
+	_, _, err := b.Backend.Setup(client, "", true)
+	if err == nil {
+		_, err = b.Backend.Subscribe(client, b.CanaryTopic)
+	}
+	if err != nil {
+		b.log(LogError, "canary_setup_failed", map[string]interface{}{
+			"error": err,
+		})
+
+		return
+	}
+
+	defer b.Backend.Terminate(client)
+
+	ticker := time.NewTicker(b.CanaryInterval)
+	defer ticker.Stop()
+
+	for {
+		b.probeCanary(client, received, quit)
+
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// performs a single round trip and records its outcome
+func (b *Broker) probeCanary(client *LocalClient, received chan string, quit chan struct{}) {
+	timeout := b.CanaryTimeout
+	if timeout <= 0 {
+		timeout = b.CanaryInterval
+	}
+
+	// drop stale messages of earlier rounds
+	select {
+	case <-received:
+	default:
+	}
+
+	start := time.Now()
+	nonce := strconv.FormatInt(start.UnixNano(), 10)
+
+	err := b.Backend.Publish(client, &packet.Message{
+		Topic:   b.CanaryTopic,
+		Payload: []byte(nonce),
+	})
+
+	// wait for the message, late messages of earlier rounds are skipped
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for err == nil {
+		select {
+		case payload := <-received:
+			if payload != nonce {
+				continue
+			}
+
+			b.recordCanary(time.Since(start), nil)
+			return
+		case <-timer.C:
+			err = fmt.Errorf("canary timed out after %s", timeout)
+		case <-quit:
+			return
+		}
+	}
+
+	b.recordCanary(0, err)
+}
+
+// records the outcome of a round trip
+func (b *Broker) recordCanary(latency time.Duration, err error) {
+	b.canary.mutex.Lock()
+	b.canary.probed = true
+
+	if err == nil {
+		b.canary.status.Latency = latency
+		b.canary.status.LastSuccess = time.Now()
+		b.canary.status.Failures = 0
+	} else {
+		b.canary.status.Failures++
+	}
+
+	b.canary.mutex.Unlock()
+
+	if err != nil {
+		b.count(&b.counters.CanaryFailures)
+
+		b.log(LogWarn, "canary_failed", map[string]interface{}{
+			"topic": b.CanaryTopic,
+			"error": err,
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+type silentBackend struct {
+	Backend
+}
+
+func (b *silentBackend) Publish(client Client, msg *packet.Message) error {
+	return nil
+}
+
+func TestCanary(t *testing.T) {
+	broker := New()
+	broker.CanaryInterval = 10 * time.Millisecond
+
+	assert.Error(t, broker.Ready())
+
+	err := broker.Start()
+	assert.NoError(t, err)
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return broker.Ready() == nil
+	})
+
+	assert.NoError(t, broker.Ready())
+	assert.False(t, broker.Canary().LastSuccess.IsZero())
+	assert.Equal(t, 0, broker.Canary().Failures)
+
+	err = broker.Close(time.Second)
+	assert.NoError(t, err)
+	assert.Error(t, broker.Ready())
+}
+
+func TestCanaryFailure(t *testing.T) {
+	broker := New()
+	broker.Backend = &silentBackend{Backend: broker.Backend}
+	broker.CanaryInterval = 10 * time.Millisecond
+
+	err := broker.Start()
+	assert.NoError(t, err)
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return broker.Canary().Failures >= 2
+	})
+
+	assert.Error(t, broker.Ready())
+	assert.True(t, broker.Canary().LastSuccess.IsZero())
+	assert.True(t, broker.Counters().CanaryFailures >= 2)
+
+	err = broker.Stop()
+	assert.NoError(t, err)
+}
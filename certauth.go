@@ -0,0 +1,164 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gomqtt/transport"
+)
+
+// A RevocationChecker checks whether a client certificate has been revoked.
+type RevocationChecker interface {
+	// Revoked should return true if the certificate signed by the specified
+	// issuer has been revoked. It should return an error if the revocation
+	// status cannot be determined.
+	Revoked(cert, issuer *x509.Certificate) (bool, error)
+}
+
+// A CRLChecker is a RevocationChecker that checks certificates against a set
+// of certificate revocation lists.
+type CRLChecker struct {
+	lists []*pkix.CertificateList
+	mutex sync.Mutex
+}
+
+// NewCRLChecker returns a new and empty CRLChecker.
+func NewCRLChecker() *CRLChecker {
+	return &CRLChecker{}
+}
+
+// Add will parse the PEM or DER encoded revocation list and add it to the
+// checker. Already added lists of the same issuer are replaced.
+func (c *CRLChecker) Add(data []byte) error {
+	list, err := x509.ParseCRL(data)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// replace previous list of the same issuer
+	issuer := list.TBSCertList.Issuer.String()
+	for i, l := range c.lists {
+		if l.TBSCertList.Issuer.String() == issuer {
+			c.lists[i] = list
+			return nil
+		}
+	}
+
+	c.lists = append(c.lists, list)
+
+	return nil
+}
+
+// Revoked will return true if the certificate is listed in the revocation list
+// of the issuer. An error is returned if no valid list of the issuer is
+// available.
+func (c *CRLChecker) Revoked(cert, issuer *x509.Certificate) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, list := range c.lists {
+		// check issuer and signature
+		if issuer.CheckCRLSignature(list) != nil {
+			continue
+		}
+
+		// check expiry
+		if list.HasExpired(time.Now()) {
+			return false, fmt.Errorf("revocation list of %s has expired", issuer.Subject)
+		}
+
+		// check serial
+		for _, revoked := range list.TBSCertList.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}
+
+	return false, fmt.Errorf("no revocation list for %s", issuer.Subject)
+}
+
+// verifies the chain against the roots and checks the revocation status of
+// all certificates in the verified chain
+func verifyCertificate(chain []*x509.Certificate, roots *x509.CertPool, checker RevocationChecker) (bool, error) {
+	// prepare intermediates
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	// verify chain
+	verified, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return false, nil
+	}
+
+	if checker == nil {
+		return true, nil
+	}
+
+	// check revocation of all but the root certificate
+	path := verified[0]
+	for i := 0; i < len(path)-1; i++ {
+		revoked, err := checker.Revoked(path[i], path[i+1])
+		if err != nil {
+			return false, err
+		} else if revoked {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// returns the certificate chain presented by the client of a CertificateConn
+// or a connection that is based on a TLS connection
+func peerCertificates(conn transport.Conn) []*x509.Certificate {
+	// check certificate connection
+	if certConn, ok := conn.(CertificateConn); ok {
+		return certConn.PeerCertificates()
+	}
+
+	// check underlying tls connection
+	netConn, ok := conn.(interface {
+		UnderlyingConn() net.Conn
+	})
+	if !ok {
+		return nil
+	}
+
+	tlsConn, ok := netConn.UnderlyingConn().(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	return tlsConn.ConnectionState().PeerCertificates
+}
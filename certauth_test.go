@@ -0,0 +1,210 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+type tlsConn struct {
+	transport.Conn
+	conn net.Conn
+}
+
+func (c *tlsConn) UnderlyingConn() net.Conn {
+	return c.conn
+}
+
+func generateCertificate(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+
+	data, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(data)
+	assert.NoError(t, err)
+
+	return cert, key
+}
+
+func generateClientCertificate(t *testing.T, name string, serial int64, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	return generateCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+}
+
+func generateCA(t *testing.T) (*x509.CertPool, *x509.Certificate, *ecdsa.PrivateKey) {
+	ca, caKey := generateCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil, nil)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	return pool, ca, caKey
+}
+
+func TestMemoryBackendAuthenticateCertificate(t *testing.T) {
+	roots, ca, caKey := generateCA(t)
+	cert, _ := generateClientCertificate(t, "device-1", 2, ca, caKey)
+
+	_, otherCA, otherKey := generateCA(t)
+	foreign, _ := generateClientCertificate(t, "device-1", 2, otherCA, otherKey)
+
+	backend := NewMemoryBackend()
+
+	// without roots
+	ok, err := backend.AuthenticateCertificate(newFakeClient(), []*x509.Certificate{cert})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	backend.CertificateRoots = roots
+
+	// valid certificate
+	client := newFakeClient()
+
+	ok, err = backend.AuthenticateCertificate(client, []*x509.Certificate{cert})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "device-1", client.Context().Get("username"))
+
+	// foreign certificate
+	ok, err = backend.AuthenticateCertificate(newFakeClient(), []*x509.Certificate{foreign})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestCRLChecker(t *testing.T) {
+	roots, ca, caKey := generateCA(t)
+	valid, _ := generateClientCertificate(t, "device-1", 2, ca, caKey)
+	revoked, _ := generateClientCertificate(t, "device-2", 3, ca, caKey)
+
+	checker := NewCRLChecker()
+
+	backend := NewMemoryBackend()
+	backend.CertificateRoots = roots
+	backend.RevocationChecker = checker
+
+	// missing list
+	ok, err := backend.AuthenticateCertificate(newFakeClient(), []*x509.Certificate{valid})
+	assert.Error(t, err)
+	assert.False(t, ok)
+
+	crl, err := ca.CreateCRL(rand.Reader, caKey, []pkix.RevokedCertificate{
+		{SerialNumber: big.NewInt(3), RevocationTime: time.Now()},
+	}, time.Now(), time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+
+	err = checker.Add(crl)
+	assert.NoError(t, err)
+
+	// valid certificate
+	ok, err = backend.AuthenticateCertificate(newFakeClient(), []*x509.Certificate{valid})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// revoked certificate
+	ok, err = backend.AuthenticateCertificate(newFakeClient(), []*x509.Certificate{revoked})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// expired list
+	crl, err = ca.CreateCRL(rand.Reader, caKey, nil, time.Now().Add(-time.Hour), time.Now().Add(-time.Minute))
+	assert.NoError(t, err)
+
+	err = checker.Add(crl)
+	assert.NoError(t, err)
+
+	ok, err = backend.AuthenticateCertificate(newFakeClient(), []*x509.Certificate{valid})
+	assert.Error(t, err)
+	assert.False(t, ok)
+}
+
+func TestPeerCertificates(t *testing.T) {
+	roots, ca, caKey := generateCA(t)
+	cert, key := generateClientCertificate(t, "device-1", 2, ca, caKey)
+	serverCert, serverKey := generateCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil, nil)
+
+	serverConn, clientConn := net.Pipe()
+
+	server := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	})
+
+	client := tls.Client(clientConn, &tls.Config{
+		Certificates:       []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+		InsecureSkipVerify: true,
+	})
+
+	// without handshake
+	assert.Empty(t, peerCertificates(&tlsConn{conn: server}))
+
+	done := make(chan error)
+	go func() {
+		done <- client.Handshake()
+	}()
+
+	assert.NoError(t, server.Handshake())
+	assert.NoError(t, <-done)
+
+	// after handshake
+	certs := peerCertificates(&tlsConn{conn: server})
+	assert.Len(t, certs, 1)
+	assert.Equal(t, cert.Raw, certs[0].Raw)
+
+	// other connections
+	assert.Empty(t, peerCertificates(&tlsConn{conn: serverConn}))
+
+	serverConn.Close()
+	clientConn.Close()
+}
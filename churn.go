@@ -0,0 +1,217 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gomqtt/packet"
+)
+
+// A DisconnectReason describes why the connection of a client has been lost.
+type DisconnectReason int
+
+const (
+	// DisconnectUnknown is reported if the reason could not be determined.
+	DisconnectUnknown DisconnectReason = iota
+
+	// DisconnectClean is reported if the client sent a DisconnectPacket.
+	DisconnectClean
+
+	// DisconnectNetwork is reported if the connection failed or has been
+	// closed by the client without a DisconnectPacket.
+	DisconnectNetwork
+
+	// DisconnectProtocol is reported if the client violated the protocol.
+	DisconnectProtocol
+
+	// DisconnectRefused is reported if the ConnectPacket has been refused
+	// with a ConnackPacket return code.
+	DisconnectRefused
+
+	// DisconnectClosed is reported if the client has been closed using Close,
+	// e.g. by CloseClient or the admin API.
+	DisconnectClosed
+
+	// DisconnectTakeover is reported if another client took over the session.
+	DisconnectTakeover
+
+	// DisconnectSlowConsumer is reported if the client has been disconnected
+	// because of the HighWatermark or the StallPolicy.
+	DisconnectSlowConsumer
+
+	// DisconnectIdle is reported if the client did not send its first message
+	// within the FirstMessageTimeout of its listener.
+	DisconnectIdle
+
+	// DisconnectLimit is reported if the client exceeded the MaxPayloadSize,
+	// the MaxPublishRate or a Quota.
+	DisconnectLimit
+
+	// DisconnectShutdown is reported if the broker has been closed or drained.
+	DisconnectShutdown
+
+	// DisconnectError is reported if the client has been closed because of an
+	// internal or backend error.
+	DisconnectError
+)
+
+// String returns the name of the reason.
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectClean:
+		return "clean"
+	case DisconnectNetwork:
+		return "network"
+	case DisconnectProtocol:
+		return "protocol"
+	case DisconnectRefused:
+		return "refused"
+	case DisconnectClosed:
+		return "closed"
+	case DisconnectTakeover:
+		return "takeover"
+	case DisconnectSlowConsumer:
+		return "slow_consumer"
+	case DisconnectIdle:
+		return "idle"
+	case DisconnectLimit:
+		return "limit"
+	case DisconnectShutdown:
+		return "shutdown"
+	case DisconnectError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// ChurnStats break down the connects and disconnects of a listener.
+type ChurnStats struct {
+	// The URL of the listener or an empty string for connections that have
+	// been passed to Handle.
+	Listener string
+
+	// The number of connections that have been closed before the handshake,
+	// because the broker was draining, the backend failed to start or a
+	// connection limit has been reached.
+	Refused int64
+
+	// The number of ConnackPackets sent by return code.
+	Connacks map[packet.ConnackCode]int64
+
+	// The number of lost connections by reason.
+	Disconnects map[DisconnectReason]int64
+}
+
+// the churn statistics of all listeners
+type churnRegistry struct {
+	stats map[string]*ChurnStats
+	mutex sync.Mutex
+}
+
+// returns the statistics of the listener, the mutex must be held
+func (r *churnRegistry) get(l *Listener) *ChurnStats {
+	name := ""
+	if l != nil {
+		name = l.URL
+	}
+
+	if r.stats == nil {
+		r.stats = make(map[string]*ChurnStats)
+	}
+
+	stats, ok := r.stats[name]
+	if !ok {
+		stats = &ChurnStats{
+			Listener:    name,
+			Connacks:    make(map[packet.ConnackCode]int64),
+			Disconnects: make(map[DisconnectReason]int64),
+		}
+
+		r.stats[name] = stats
+	}
+
+	return stats
+}
+
+// records a connection that has been refused before the handshake
+func (r *churnRegistry) refused(l *Listener) {
+	r.mutex.Lock()
+	r.get(l).Refused++
+	r.mutex.Unlock()
+}
+
+// records a sent connack
+func (r *churnRegistry) connack(l *Listener, code packet.ConnackCode) {
+	r.mutex.Lock()
+	r.get(l).Connacks[code]++
+	r.mutex.Unlock()
+}
+
+// records a lost connection
+func (r *churnRegistry) disconnected(l *Listener, reason DisconnectReason) {
+	r.mutex.Lock()
+	r.get(l).Disconnects[reason]++
+	r.mutex.Unlock()
+}
+
+// ChurnStats returns the connection churn of every listener that has seen a
+// connection, sorted by the listener URL.
+func (b *Broker) ChurnStats() []ChurnStats {
+	b.churn.mutex.Lock()
+	defer b.churn.mutex.Unlock()
+
+	var list []ChurnStats
+	for _, stats := range b.churn.stats {
+		copied := *stats
+		copied.Connacks = make(map[packet.ConnackCode]int64, len(stats.Connacks))
+		for code, n := range stats.Connacks {
+			copied.Connacks[code] = n
+		}
+
+		copied.Disconnects = make(map[DisconnectReason]int64, len(stats.Disconnects))
+		for reason, n := range stats.Disconnects {
+			copied.Disconnects[reason] = n
+		}
+
+		list = append(list, copied)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Listener < list[j].Listener
+	})
+
+	return list
+}
+
+// records the reason the client is going to be disconnected unless a reason
+// has already been recorded
+func (c *remoteClient) disconnectAs(reason DisconnectReason) {
+	atomic.CompareAndSwapInt32(&c.reason, int32(DisconnectUnknown), int32(reason))
+}
+
+// returns the recorded reason or derives it from the error the client died
+// with
+func (c *remoteClient) disconnectReason(err error) DisconnectReason {
+	reason := DisconnectReason(atomic.LoadInt32(&c.reason))
+	if reason == DisconnectUnknown && err != nil {
+		return DisconnectError
+	}
+
+	return reason
+}
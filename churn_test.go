@@ -0,0 +1,146 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChurnStats(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.Logins = map[string]string{"allow": "allow"}
+
+	broker := New()
+	broker.Backend = backend
+
+	port, done := runBroker(t, broker, 3)
+
+	// refused with bad credentials
+	connect := packet.NewConnectPacket()
+	connect.Username = "deny"
+	connect.Password = "deny"
+
+	connack := packet.NewConnackPacket()
+	connack.ReturnCode = packet.ErrNotAuthorized
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		End().
+		Test(t, conn)
+
+	// clean disconnect
+	connect.Username = "allow"
+	connect.Password = "allow"
+
+	connack = packet.NewConnackPacket()
+
+	conn, err = transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	// network failure
+	conn, err = transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return len(broker.currentClients()) == 0
+	})
+
+	stats := broker.ChurnStats()
+	if assert.Len(t, stats, 1) {
+		assert.Equal(t, "", stats[0].Listener)
+		assert.Equal(t, map[packet.ConnackCode]int64{
+			packet.ConnectionAccepted: 2,
+			packet.ErrNotAuthorized:   1,
+		}, stats[0].Connacks)
+		assert.Equal(t, map[DisconnectReason]int64{
+			DisconnectRefused: 1,
+			DisconnectClean:   1,
+			DisconnectNetwork: 1,
+		}, stats[0].Disconnects)
+	}
+}
+
+func TestChurnStatsListener(t *testing.T) {
+	listener := &Listener{
+		URL:            tools.NewPort().URL(),
+		MaxConnections: 1,
+	}
+
+	broker := New()
+
+	err := broker.Listen(listener)
+	assert.NoError(t, err)
+
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+
+	conn1, err := transport.Dial(listener.URL)
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(packet.NewConnackPacket()).
+		Test(t, conn1)
+
+	// refused because of the connection limit
+	conn2, err := transport.Dial(listener.URL)
+	assert.NoError(t, err)
+
+	_, err = conn2.Receive()
+	assert.Error(t, err)
+
+	// closed by the broker
+	assert.Equal(t, 1, broker.CloseClient("test"))
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return len(broker.currentClients()) == 0
+	})
+
+	stats := broker.ChurnStats()
+	if assert.Len(t, stats, 1) {
+		assert.Equal(t, listener.URL, stats[0].Listener)
+		assert.Equal(t, int64(1), stats[0].Refused)
+		assert.Equal(t, map[DisconnectReason]int64{
+			DisconnectClosed: 1,
+		}, stats[0].Disconnects)
+	}
+
+	err = broker.Close(time.Second)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import "github.com/gomqtt/packet"
+
+// A CleanPolicy defines how a MemoryBackend handles the queued offline
+// messages and the unacknowledged outgoing messages of a stored session if its
+// client reconnects with a clean session.
+type CleanPolicy int
+
+const (
+	// CleanDiscard silently discards the messages.
+	CleanDiscard CleanPolicy = iota
+
+	// CleanDeadLetter passes the messages to the DeadLetterHandler before they
+	// are discarded.
+	CleanDeadLetter
+
+	// CleanNotify discards the messages and emits a SessionDiscarded event
+	// that carries the counts of the discarded messages.
+	CleanNotify
+)
+
+// A DiscardSummary counts the messages of a stored session that have been
+// discarded because its client reconnected with a clean session.
+type DiscardSummary struct {
+	// The number of queued offline messages.
+	Offline int
+
+	// The number of sent QOS 1 and 2 messages that had not yet been
+	// acknowledged.
+	Unacknowledged int
+}
+
+// drains the offline and unacknowledged messages of the session, the offline
+// mutex must be held
+func (m *MemoryBackend) discard(sess *MemorySession) (DiscardSummary, []*packet.Message) {
+	msgs := sess.missed()
+	summary := DiscardSummary{
+		Offline: len(msgs),
+	}
+
+	for _, pkt := range sess.store.All(outgoing) {
+		if publish, ok := pkt.(*packet.PublishPacket); ok {
+			msgs = append(msgs, &publish.Message)
+			summary.Unacknowledged++
+		}
+	}
+
+	return summary, msgs
+}
+
+// handles the discarded messages of the client according to the clean policy
+func (m *MemoryBackend) discarded(client Client, summary DiscardSummary, msgs []*packet.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+
+	switch m.CleanPolicy {
+	case CleanDeadLetter:
+		if m.DeadLetterHandler != nil {
+			m.DeadLetterHandler(client, msgs)
+		}
+	case CleanNotify:
+		if m.broker != nil {
+			m.broker.emit(&Event{
+				Type:      SessionDiscarded,
+				Client:    client,
+				Discarded: summary,
+			})
+		}
+	}
+}
@@ -15,20 +15,27 @@
 package broker
 
 import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gomqtt/packet"
 	"github.com/gomqtt/transport"
-	"github.com/satori/go.uuid"
 	"gopkg.in/tomb.v2"
 )
 
 // A Client represents a remote client that is connected to the broker.
 type Client interface {
-	// Publish will send a Message to the client and initiate QOS flows.
-	Publish(msg *packet.Message) bool
+	// Publish will send a Message to the client and initiate QOS flows. It
+	// returns nil if the message has been queued, ErrClientOffline if the
+	// client went offline and ErrBackpressure if the message has been dropped
+	// because the client does not keep up with its messages.
+	Publish(msg *packet.Message) error
 
 	// Close will immediately close the connection. When clean=true the client
 	// will be marked as cleanly disconnected, and the will messages will not
@@ -39,6 +46,14 @@ type Client interface {
 	Context() *Context
 }
 
+// ErrClientOffline is returned by Client.Publish if the message could not be
+// queued because the client went offline.
+var ErrClientOffline = errors.New("client offline")
+
+// ErrBackpressure is returned by Client.Publish if the message has been dropped
+// because the client does not keep up with its messages.
+var ErrBackpressure = errors.New("client backpressure")
+
 const (
 	clientConnecting byte = iota
 	clientConnected
@@ -46,31 +61,76 @@ const (
 )
 
 type remoteClient struct {
-	broker *Broker
-	conn   transport.Conn
+	sendingSince int64
+	reason       int32
+
+	broker   *Broker
+	conn     transport.Conn
+	listener *Listener
 
 	session Session
 	context *Context
 
-	out   chan *packet.Message
+	firstMessage *time.Timer
+	handshaked   bool
+	reserved     bool
+
+	out   chan *MessageCopy
+	acked chan struct{}
 	state *state
+	tuner *tuner
+
+	aliases   *topicAliases
+	authCache *authCache
+
+	batching  int32
+	batched   chan struct{}
+	unflushed bool
+	buffered  []*packet.PublishPacket
 
 	tomb   tomb.Tomb
 	mutex  sync.Mutex
 	finish sync.Once
 }
 
-// newRemoteClient takes over a connection and returns a remoteClient
-func newRemoteClient(broker *Broker, conn transport.Conn) *remoteClient {
+// newRemoteClient takes over a connection that has been accepted by the
+// optional listener and returns a remoteClient
+func newRemoteClient(broker *Broker, conn transport.Conn, listener *Listener) *remoteClient {
 	c := &remoteClient{
-		broker:  broker,
-		conn:    conn,
-		context: NewContext(),
-		out:     make(chan *packet.Message),
-		state:   newState(clientConnecting),
+		broker:   broker,
+		conn:     conn,
+		listener: listener,
+		context:  NewContext(),
+		acked:    make(chan struct{}, 1),
+		batched:  make(chan struct{}, 1),
+		state:    newState(clientConnecting),
+	}
+
+	// prepare outgoing buffer
+	if broker.AutoTuning != nil {
+		c.tuner = newTuner(*broker.AutoTuning)
+		c.out = make(chan *MessageCopy, broker.AutoTuning.MaxBuffer)
+	} else {
+		c.out = make(chan *MessageCopy, broker.OutgoingBuffer)
+	}
+
+	// prepare topic aliases
+	if broker.TopicAliasing != nil {
+		c.aliases = newTopicAliases(*broker.TopicAliasing)
+	}
+
+	// prepare authorization cache
+	if broker.AuthorizationCacheTTL > 0 {
+		c.authCache = newAuthCache(broker.AuthorizationCacheTTL, broker.AuthorizationCacheSize)
 	}
 
-	c.Context().Set("uuid", uuid.NewV1().String())
+	c.Context().Set("uuid", broker.newUUID())
+	c.Context().Set("remote_ip", remoteIP(conn, broker.TrustedProxies))
+
+	// limit packet size
+	if broker.MaxPacketSize > 0 {
+		conn.SetReadLimit(broker.MaxPacketSize)
+	}
 
 	// start processor
 	c.tomb.Go(c.processor)
@@ -79,23 +139,188 @@ func newRemoteClient(broker *Broker, conn transport.Conn) *remoteClient {
 }
 
 // Context returns the associated context. Every client will already have the
-// "uuid" value set in the context.
+// "uuid" and "remote_ip" values set in the context. Clients that presented a
+// certificate chain will also have the "certificates" value set once the
+// ConnectPacket has been received.
 func (c *remoteClient) Context() *Context {
 	return c.context
 }
 
-// Publish will send a Message to the client and initiate QOS flows.
-func (c *remoteClient) Publish(msg *packet.Message) bool {
+// Publish will send a Message to the client and initiate QOS flows. Messages
+// are buffered according to the brokers OutgoingBuffer and dropped or cause a
+// disconnect if the buffer reaches the LowWatermark or HighWatermark. If the
+// brokers StallTimeout is set and the writer does not accept the message in
+// time, the StallPolicy is applied. The QOS level is downgraded to the
+// subscription without modifying the shared message.
+func (c *remoteClient) Publish(msg *packet.Message) error {
+	// carry metadata with a private copy of the message
+	msg = c.broker.annotations().fork(msg)
+
+	// trace delivery
+	if c.broker.Tracer != nil {
+		if parent := c.broker.parentSpan(msg); parent != nil {
+			span := c.broker.startSpan("deliver", parent, spanAttributes(msg, c))
+			defer span.End()
+		}
+	}
+
+	// respect maximum qos of the subscription
+	view := CopyMessage(msg)
+	if max, ok := c.maxQOS(msg.Topic); ok {
+		view.Downgrade(max)
+	}
+
+	err := c.enqueue(view)
+	if err != nil {
+		c.broker.annotations().release(msg)
+		view.Release()
+	}
+
+	return err
+}
+
+// returns the maximum qos of the subscription matching the topic
+func (c *remoteClient) maxQOS(topic string) (byte, bool) {
+	c.mutex.Lock()
+	sess := c.session
+	c.mutex.Unlock()
+
+	if sess == nil {
+		return 0, false
+	}
+
+	sub, err := sess.LookupSubscription(topic)
+	if err != nil || sub == nil {
+		return 0, false
+	}
+
+	return sub.QOS, true
+}
+
+// hands the message to the sender
+func (c *remoteClient) enqueue(view *MessageCopy) error {
+	msg := view.Message()
+
+	// check if client is going away
+	select {
+	case <-c.tomb.Dying():
+		return ErrClientOffline
+	default:
+	}
+
+	// check buffer
+	err := c.checkBuffer(msg)
+	if err != nil {
+		return err
+	}
+
+	// wait forever if stall detection is disabled
+	if c.broker.StallTimeout <= 0 {
+		select {
+		case c.out <- view:
+			return nil
+		case <-c.tomb.Dying():
+			return ErrClientOffline
+		}
+	}
+
+	timer := acquireTimer(c.broker.StallTimeout)
+	defer releaseTimer(timer)
+
 	select {
-	case c.out <- msg:
-		return true
+	case c.out <- view:
+		return nil
 	case <-c.tomb.Dying():
-		return false
+		return ErrClientOffline
+	case <-timer.C:
+	}
+
+	c.broker.count(&c.broker.counters.StalledClients)
+	c.broker.emit(&Event{
+		Type:    ClientStalled,
+		Client:  c,
+		Message: msg,
+	})
+
+	c.log(LogWarn, "client_stalled", map[string]interface{}{
+		"writer_blocked": c.writerBlocked().String(),
+	})
+
+	// drop qos 0 messages
+	if c.broker.StallPolicy == StallDropQOS0 && msg.QOS == 0 {
+		c.broker.count(&c.broker.counters.DroppedMessages)
+		c.log(LogWarn, "packet_dropped", map[string]interface{}{
+			"reason": "stalled",
+			"topic":  msg.Topic,
+		})
+
+		return ErrBackpressure
+	}
+
+	// close connection
+	if c.broker.StallPolicy == StallClose {
+		c.disconnectAs(DisconnectSlowConsumer)
+		c.Close(false)
+		return ErrBackpressure
+	}
+
+	// continue waiting
+	select {
+	case c.out <- view:
+		return nil
+	case <-c.tomb.Dying():
+		return ErrClientOffline
+	}
+}
+
+// applies the watermarks to the outgoing buffer
+func (c *remoteClient) checkBuffer(msg *packet.Message) error {
+	buffered := len(c.out)
+
+	// disconnect slow consumer
+	if c.broker.HighWatermark > 0 && buffered >= c.broker.HighWatermark {
+		c.broker.count(&c.broker.counters.SlowConsumers)
+		c.broker.emit(&Event{
+			Type:    SlowConsumer,
+			Client:  c,
+			Message: msg,
+		})
+
+		c.log(LogWarn, "slow_consumer", map[string]interface{}{
+			"buffered": buffered,
+		})
+
+		c.disconnectAs(DisconnectSlowConsumer)
+		c.Close(false)
+		return ErrBackpressure
 	}
+
+	// apply tuned buffer size
+	low := c.broker.LowWatermark
+	if c.tuner != nil {
+		if size, _ := c.tuner.sizes(); low <= 0 || size < low {
+			low = size
+		}
+	}
+
+	// drop qos 0 messages
+	if low > 0 && buffered >= low && msg.QOS == 0 {
+		c.broker.count(&c.broker.counters.DroppedMessages)
+		c.log(LogDebug, "packet_dropped", map[string]interface{}{
+			"reason": "backpressure",
+			"topic":  msg.Topic,
+		})
+
+		return ErrBackpressure
+	}
+
+	return nil
 }
 
 // Close will immediately close the connection.
 func (c *remoteClient) Close(clean bool) {
+	c.disconnectAs(DisconnectClosed)
+
 	if clean {
 		// mark client as cleanly disconnected
 		c.state.set(clientDisconnected)
@@ -103,6 +328,9 @@ func (c *remoteClient) Close(clean bool) {
 
 	// close underlying connection (triggers cleanup)
 	c.conn.Close()
+
+	// interrupt pending waits
+	c.tomb.Kill(nil)
 }
 
 /* processor goroutine */
@@ -111,7 +339,7 @@ func (c *remoteClient) Close(clean bool) {
 func (c *remoteClient) processor() error {
 	first := true
 
-	c.log("%s - New Connection", c.Context().Get("uuid"))
+	c.log(LogInfo, "connection_accepted", nil)
 
 	// set initial read timeout
 	c.conn.SetReadTimeout(c.broker.ConnectTimeout)
@@ -125,20 +353,59 @@ func (c *remoteClient) processor() error {
 			}
 
 			// die on any other error
+			c.disconnectAs(DisconnectNetwork)
 			return c.die(err, false)
 		}
 
-		c.log("%s - Received: %s", c.Context().Get("uuid"), pkt.String())
+		if c.broker.Logger != nil {
+			c.log(LogDebug, "packet_received", map[string]interface{}{
+				"packet": pkt.String(),
+			})
+		}
+
+		// pass packet through middleware
+		received := pkt
+		pkt, err = c.broker.inbound(c, pkt)
+		if err != nil {
+			return c.die(err, true)
+		} else if pkt == nil {
+			if publish, ok := received.(*packet.PublishPacket); ok {
+				c.broker.annotations().release(&publish.Message)
+			}
+
+			c.log(LogWarn, "packet_dropped", map[string]interface{}{
+				"reason": "middleware",
+				"packet": received.String(),
+			})
+
+			continue
+		}
+
+		// resolve topic alias
+		if publish, ok := pkt.(*packet.PublishPacket); ok {
+			err = c.resolveAlias(&publish.Message)
+			if err != nil {
+				c.disconnectAs(DisconnectProtocol)
+				return c.die(err, true)
+			}
+		}
+
+		// rewrite topics
+		if c.broker.Rewriter != nil {
+			c.broker.Rewriter.apply(pkt)
+		}
 
 		if first {
 			// get connect
 			connect, ok := pkt.(*packet.ConnectPacket)
 			if !ok {
+				c.disconnectAs(DisconnectProtocol)
 				return c.die(fmt.Errorf("expected connect"), true)
 			}
 
 			// process connect
 			err = c.processConnect(connect)
+			c.broker.handshaked(c)
 			first = false
 		}
 
@@ -167,6 +434,9 @@ func (c *remoteClient) processor() error {
 		if err != nil {
 			return err // error has already been cleaned
 		}
+
+		// pass processed packet to observers
+		c.broker.hooks.dispatch(c, pkt)
 	}
 }
 
@@ -176,32 +446,167 @@ func (c *remoteClient) processConnect(pkt *packet.ConnectPacket) error {
 	connack.ReturnCode = packet.ConnectionAccepted
 	connack.SessionPresent = false
 
-	// authenticate
-	ok, err := c.broker.Backend.Authenticate(c, pkt.Username, pkt.Password)
-	if err != nil {
-		c.die(err, true)
+	// save client id, clean flag, username and session expiry
+	c.Context().Set("client_id", pkt.ClientID)
+	c.Context().Set("clean", pkt.CleanSession)
+	c.Context().Set("username", pkt.Username)
+	c.Context().Set("session_expiry", c.broker.SessionExpiry)
+
+	// check protocol version
+	if c.listener != nil && !c.listener.allows(pkt.Version) {
+		return c.refuse(connack, packet.ErrInvalidProtocolVersion)
+	}
+
+	// check client id, clean sessions may be assigned one after authentication
+	assign := false
+	if len(pkt.ClientID) == 0 && !pkt.CleanSession {
+		return c.refuse(connack, packet.ErrIdentifierRejected)
+	} else if len(pkt.ClientID) == 0 && c.broker.AssignClientIDs && pkt.Version != packet.Version31 {
+		assign = true
+	} else if !c.broker.allowsClientID(pkt.ClientID) {
+		return c.refuse(connack, packet.ErrIdentifierRejected)
+	}
+
+	// check legacy protocol
+	if pkt.Version == packet.Version31 {
+		if c.broker.DisableMQTT31 {
+			return c.refuse(connack, packet.ErrInvalidProtocolVersion)
+		} else if !c.broker.legacyClientID(pkt.ClientID) {
+			return c.refuse(connack, packet.ErrIdentifierRejected)
+		}
+	}
+
+	// save presented certificates, the tls handshake is complete by now
+	chain := peerCertificates(c.conn)
+	if len(chain) > 0 {
+		c.Context().Set("certificates", chain)
+	}
+
+	// authenticate certificate
+	ok := false
+	var err error
+	if len(chain) > 0 {
+		ok, err = c.broker.Backend.AuthenticateCertificate(c, chain)
+		if err != nil {
+			return c.die(err, true)
+		}
+	}
+
+	// authenticate credentials
+	if !ok {
+		ok, err = c.broker.Backend.Authenticate(c, pkt.Username, pkt.Password)
+		if err != nil {
+			return c.die(err, true)
+		}
 	}
 
 	// check authentication
 	if !ok {
-		// set state
-		c.state.set(clientDisconnected)
+		c.broker.emit(&Event{
+			Type:   AuthenticationFailed,
+			Client: c,
+		})
+
+		c.log(LogWarn, "authentication_failed", map[string]interface{}{
+			"username":     pkt.Username,
+			"certificates": len(chain),
+		})
 
-		// set return code
-		connack.ReturnCode = packet.ErrNotAuthorized
+		return c.refuse(connack, packet.ErrNotAuthorized)
+	}
+
+	// assign a client id that is neither connected nor stored
+	assigned := ""
+	if assign {
+		assigned = c.broker.assignClientID(c)
 
-		// send connack
-		err = c.send(connack)
+		ok, err = c.broker.assignableClientID(c, assigned)
 		if err != nil {
-			return c.die(err, false)
+			return c.die(err, true)
+		} else if !ok {
+			c.log(LogWarn, "client_id_unassignable", map[string]interface{}{
+				"client_id": assigned,
+			})
+
+			return c.refuse(connack, packet.ErrIdentifierRejected)
+		}
+
+		pkt.ClientID = assigned
+		c.Context().Set("client_id", pkt.ClientID)
+	}
+
+	// reserve a connection slot, which is freed unless the client is
+	// connected in the end
+	accepted := false
+	defer func() {
+		if !accepted {
+			c.broker.releaseConnection(c)
+		}
+	}()
+
+	if !c.broker.reserveConnection(c) {
+		c.broker.count(&c.broker.counters.RejectedConnections)
+
+		// delay refusal unless the client is closed
+		select {
+		case <-time.After(c.broker.refusalDelay()):
+		case <-c.tomb.Dying():
+			return c.die(nil, false)
+		}
+
+		return c.refuse(connack, packet.ErrServerUnavailable)
+	}
+
+	// check certificate identity
+	if cert := peerCertificate(c.conn); cert != nil {
+		ok, err = c.bindCertificate(pkt.ClientID, cert)
+		if err != nil {
+			return c.die(err, true)
+		} else if !ok {
+			return c.refuse(connack, packet.ErrNotAuthorized)
+		}
+	}
+
+	// serialize takeovers of the same client id until the session is set up
+	unlock := c.broker.takeovers.lock(pkt.ClientID)
+	defer unlock()
+
+	// keep a connected client with the same client id
+	if c.broker.TakeoverPolicy == RejectNew && len(pkt.ClientID) > 0 {
+		for _, other := range c.broker.currentClients() {
+			if id, _ := other.Context().Get("client_id").(string); other != c && id == pkt.ClientID && other.state.get() == clientConnected {
+				c.log(LogInfo, "takeover_rejected", map[string]interface{}{
+					"current_uuid": other.Context().Get("uuid"),
+				})
+
+				return c.refuse(connack, packet.ErrIdentifierRejected)
+			}
 		}
+	}
 
-		// close client
-		c.die(nil, true)
+	// cancel pending will of a previous connection
+	if len(pkt.ClientID) > 0 {
+		c.broker.wills.cancel(pkt.ClientID)
 	}
 
 	// set state
 	c.state.set(clientConnected)
+	accepted = true
+
+	// set accounting key, the username of clients that have been accepted
+	// without verifying credentials is only claimed and thus ignored
+	ip, _ := c.Context().Get("remote_ip").(string)
+	username, _ := c.Context().Get("username").(string)
+	if anonymous(c) {
+		username = ""
+	}
+
+	c.Context().Set("accounting_key", accountingKey(username, ip))
+
+	// acquire rate limiter
+	if c.broker.MaxPublishRate > 0 {
+		c.broker.limiters.acquire(AccountingKey(c), c.broker.MaxPublishRate)
+	}
 
 	// set keep alive
 	if pkt.KeepAlive > 0 {
@@ -210,17 +615,55 @@ func (c *remoteClient) processConnect(pkt *packet.ConnectPacket) error {
 		c.conn.SetReadTimeout(0)
 	}
 
+	// log clients whose session is taken over
+	if len(pkt.ClientID) > 0 {
+		for _, other := range c.broker.currentClients() {
+			if id, _ := other.Context().Get("client_id").(string); other != c && id == pkt.ClientID {
+				c.broker.emit(&Event{
+					Type:   SessionTakenOver,
+					Client: other,
+				})
+
+				c.log(LogInfo, "session_taken_over", map[string]interface{}{
+					"previous_uuid":        other.Context().Get("uuid"),
+					"previous_remote_addr": other.conn.RemoteAddr().String(),
+				})
+
+				connected := other.state.get() == clientConnected
+				other.disconnectAs(DisconnectTakeover)
+
+				// wait until the buffered messages have been stored
+				if c.broker.TakeoverPolicy == CloseOldAndMigrate && connected {
+					other.Close(true)
+
+					select {
+					case <-other.tomb.Dead():
+					case <-time.After(c.broker.TakeoverTimeout):
+						c.log(LogWarn, "takeover_timeout", map[string]interface{}{
+							"previous_uuid": other.Context().Get("uuid"),
+						})
+					case <-c.tomb.Dying():
+						return c.die(nil, false)
+					}
+				}
+			}
+		}
+	}
+
 	// retrieve session
 	sess, resumed, err := c.broker.Backend.Setup(c, pkt.ClientID, pkt.CleanSession)
+	unlock()
 	if err != nil {
 		return c.die(err, true)
 	}
 
 	// set session present
-	connack.SessionPresent = !pkt.CleanSession && resumed
+	connack.SessionPresent = !pkt.CleanSession && resumed && pkt.Version != packet.Version31
 
 	// assign session
+	c.mutex.Lock()
 	c.session = sess
+	c.mutex.Unlock()
 
 	// save will if present
 	if pkt.Will != nil {
@@ -228,6 +671,26 @@ func (c *remoteClient) processConnect(pkt *packet.ConnectPacket) error {
 		if err != nil {
 			return c.die(err, true)
 		}
+
+		// store will durably if supported
+		if store, ok := c.broker.Backend.(WillStore); ok {
+			err = store.StoreWill(c.Context().Get("uuid").(string), pkt.Will)
+			if err != nil {
+				return c.die(err, true)
+			}
+		}
+	}
+
+	// provide the limits and the assigned client id to the middleware
+	if len(c.broker.middleware) > 0 && (c.broker.AdvertiseLimits || assigned != "") {
+		var props ConnackProperties
+		if c.broker.AdvertiseLimits {
+			props = c.broker.connackProperties()
+		}
+
+		props.AssignedClientIdentifier = assigned
+
+		c.Context().Set(ConnackPropertiesKey, props)
 	}
 
 	// send connack
@@ -236,6 +699,35 @@ func (c *remoteClient) processConnect(pkt *packet.ConnectPacket) error {
 		return c.die(err, false)
 	}
 
+	c.broker.churn.connack(c.listener, packet.ConnectionAccepted)
+
+	// claim session ownership
+	if c.broker.AffinitySink != nil && len(pkt.ClientID) > 0 {
+		err = c.broker.AffinitySink.Claim(pkt.ClientID, c.broker.NodeID)
+		if err != nil {
+			return c.die(err, true)
+		}
+	}
+
+	c.broker.emit(&Event{
+		Type:   ClientConnected,
+		Client: c,
+	})
+
+	c.log(LogInfo, "client_connected", map[string]interface{}{
+		"username":        pkt.Username,
+		"clean_session":   pkt.CleanSession,
+		"keep_alive":      pkt.KeepAlive,
+		"session_present": connack.SessionPresent,
+	})
+
+	// require first message
+	if c.listener != nil && c.listener.FirstMessageTimeout > 0 {
+		c.mutex.Lock()
+		c.firstMessage = time.AfterFunc(c.listener.FirstMessageTimeout, c.closeIdle)
+		c.mutex.Unlock()
+	}
+
 	// start sender
 	c.tomb.Go(c.sender)
 
@@ -268,12 +760,85 @@ func (c *remoteClient) processConnect(pkt *packet.ConnectPacket) error {
 	// restore subscriptions
 	for _, sub := range subs {
 		// TODO: Handle incoming retained messages.
-		c.broker.Backend.Subscribe(c, sub.Topic)
+		_, err = c.subscribe(*sub)
+		if err != nil {
+			return c.die(err, true)
+		}
 	}
 
 	return nil
 }
 
+// sends a refusing ConnackPacket with the specified return code and closes
+// the client
+func (c *remoteClient) refuse(connack *packet.ConnackPacket, code packet.ConnackCode) error {
+	// set state
+	c.state.set(clientDisconnected)
+
+	// set return code
+	connack.ReturnCode = code
+
+	c.log(LogWarn, "connection_refused", map[string]interface{}{
+		"return_code": byte(code),
+	})
+
+	c.disconnectAs(DisconnectRefused)
+	c.broker.churn.connack(c.listener, code)
+
+	// send connack
+	err := c.send(connack)
+	if err != nil {
+		return c.die(err, false)
+	}
+
+	// close client
+	return c.die(nil, true)
+}
+
+// binds the identity of the certificate to the client id and emits an event
+// if the certificate of an already bound identity has been rotated
+func (c *remoteClient) bindCertificate(clientID string, cert *x509.Certificate) (bool, error) {
+	mapper := c.broker.IdentityMapper
+	if mapper == nil {
+		mapper = CertificateIdentity
+	}
+
+	identity := mapper(cert)
+	fingerprint := certificateFingerprint(cert)
+
+	// save identity and fingerprint
+	c.Context().Set("identity", identity)
+	c.Context().Set("certificate_fingerprint", fingerprint)
+
+	// anonymous sessions are not bound
+	if len(clientID) == 0 {
+		return true, nil
+	}
+
+	ok, rotated := c.broker.identities.bind(clientID, identity, fingerprint)
+	if !ok {
+		return false, nil
+	}
+
+	if rotated {
+		c.broker.emit(&Event{
+			Type:   CertificateRotated,
+			Client: c,
+		})
+
+		if c.broker.SystemNotifications {
+			return true, c.notify("certificate/rotated", map[string]interface{}{
+				"identity":    identity,
+				"fingerprint": fingerprint,
+				"client_id":   clientID,
+				"uuid":        c.Context().Get("uuid"),
+			})
+		}
+	}
+
+	return true, nil
+}
+
 // handle an incoming PingreqPacket
 func (c *remoteClient) processPingreq() error {
 	err := c.send(packet.NewPingrespPacket())
@@ -286,30 +851,133 @@ func (c *remoteClient) processPingreq() error {
 
 // handle an incoming SubscribePacket
 func (c *remoteClient) processSubscribe(pkt *packet.SubscribePacket) error {
+	c.engage()
+
 	suback := packet.NewSubackPacket()
 	suback.ReturnCodes = make([]byte, len(pkt.Subscriptions))
 	suback.PacketID = pkt.PacketID
 
-	var retainedMessages []*packet.Message
+	var retainedMessages []*MessageCopy
+	var deferredSubscriptions []packet.Subscription
+
+	// check if retained messages can be delivered after the suback, options
+	// are applied while subscribing
+	loader, deferred := c.broker.Backend.(RetainedLoader)
+	deferred = deferred && !c.optioned()
+
+	for i := range pkt.Subscriptions {
+		// the session keeps a pointer to the saved subscription
+		subscription := pkt.Subscriptions[i]
+
+		// check for replay request
+		filter, n, replay := c.broker.parseReplay(subscription.Topic)
+		if replay && n == 0 {
+			suback.ReturnCodes[i] = packet.QOSFailure
+			continue
+		}
+
+		subscription.Topic = filter
+
+		// reject subscriptions to reserved topics
+		if !c.broker.reservations.allowed(subscription.Topic, SubscribeAction) {
+			c.log(LogWarn, "subscription_denied", map[string]interface{}{
+				"reason": "reserved",
+				"topic":  subscription.Topic,
+			})
+
+			suback.ReturnCodes[i] = packet.QOSFailure
+			continue
+		}
+
+		// authorize subscription
+		ok, err := c.authorize(subscription.Topic, SubscribeAction)
+		if err != nil {
+			return c.die(err, true)
+		}
+
+		// reject subscription if not authorized
+		if !ok {
+			c.log(LogWarn, "subscription_denied", map[string]interface{}{
+				"topic": subscription.Topic,
+			})
+
+			suback.ReturnCodes[i] = packet.QOSFailure
+			continue
+		}
 
-	for i, subscription := range pkt.Subscriptions {
 		// save subscription in session
-		err := c.session.SaveSubscription(&subscription)
+		err = c.session.SaveSubscription(&subscription)
 		if err != nil {
 			return c.die(err, true)
 		}
 
-		// subscribe client to queue
-		msgs, err := c.broker.Backend.Subscribe(c, subscription.Topic)
+		// save subscription identifier
+		err = c.saveIdentifier(subscription)
 		if err != nil {
 			return c.die(err, true)
 		}
 
-		// cache retained messages
-		retainedMessages = append(retainedMessages, msgs...)
+		// subscribe client to queue and defer retained messages
+		if deferred && !replay {
+			err = loader.SubscribeOnly(c, subscription.Topic)
+			if err != nil {
+				return c.die(err, true)
+			}
+
+			deferredSubscriptions = append(deferredSubscriptions, subscription)
+			suback.ReturnCodes[i] = subscription.QOS
+			c.broker.emit(&Event{
+				Type:   Subscribed,
+				Client: c,
+				Topic:  subscription.Topic,
+			})
+			continue
+		}
+
+		// subscribe client to queue
+		msgs, err := c.subscribe(subscription)
+		if err == ErrSearchBudget {
+			c.broker.count(&c.broker.counters.AbortedSearches)
+			c.log(LogWarn, "subscription_denied", map[string]interface{}{
+				"reason": "search_budget",
+				"topic":  subscription.Topic,
+			})
+
+			// remove subscription from session
+			err = c.session.DeleteSubscription(subscription.Topic)
+			if err != nil {
+				return c.die(err, true)
+			}
+
+			suback.ReturnCodes[i] = packet.QOSFailure
+			continue
+		} else if err != nil {
+			return c.die(err, true)
+		}
+
+		// replace retained messages with recent messages
+		if replay {
+			msgs, err = c.broker.Backend.(HistoryStore).History(c, filter, n)
+			if err != nil {
+				return c.die(err, true)
+			}
+		}
+
+		// cache retained messages at the granted qos
+		for _, msg := range msgs {
+			view := CopyMessage(msg)
+			view.Downgrade(subscription.QOS)
+			retainedMessages = append(retainedMessages, view)
+		}
 
 		// save granted qos
 		suback.ReturnCodes[i] = subscription.QOS
+
+		c.broker.emit(&Event{
+			Type:   Subscribed,
+			Client: c,
+			Topic:  subscription.Topic,
+		})
 	}
 
 	// send suback
@@ -318,31 +986,105 @@ func (c *remoteClient) processSubscribe(pkt *packet.SubscribePacket) error {
 		return c.die(err, false)
 	}
 
-	// send messages
-	for _, msg := range retainedMessages {
-		c.out <- msg
+	// queue messages like live messages, dropped messages are released
+	for i, view := range retainedMessages {
+		err = c.enqueue(view)
+		if err == ErrClientOffline {
+			for _, view := range retainedMessages[i:] {
+				view.Release()
+			}
+
+			return nil
+		} else if err != nil {
+			view.Release()
+		}
+	}
+
+	// deliver deferred retained messages
+	if len(deferredSubscriptions) > 0 {
+		go c.deliverRetained(loader, deferredSubscriptions)
 	}
 
 	return nil
 }
 
-// handle an incoming UnsubscribePacket
-func (c *remoteClient) processUnsubscribe(pkt *packet.UnsubscribePacket) error {
-	unsuback := packet.NewUnsubackPacket()
-	unsuback.PacketID = pkt.PacketID
+// returns whether the subscriptions of the client are made with options
+func (c *remoteClient) optioned() bool {
+	_, ok := c.broker.Backend.(OptionsSubscriber)
+	return ok && c.broker.SubscriptionOptions != nil
+}
 
-	for _, topic := range pkt.Topics {
-		// unsubscribe client from queue
-		err := c.broker.Backend.Unsubscribe(c, topic)
-		if err != nil {
-			return c.die(err, true)
-		}
+// subscribes the client using the options of the subscription if available
+func (c *remoteClient) subscribe(sub packet.Subscription) ([]*packet.Message, error) {
+	if !c.optioned() {
+		return c.broker.Backend.Subscribe(c, sub.Topic)
+	}
+
+	options := c.broker.SubscriptionOptions(c, sub)
+
+	return c.broker.Backend.(OptionsSubscriber).SubscribeWithOptions(c, sub.Topic, options)
+}
+
+// looks up and delivers the retained messages of acknowledged subscriptions
+// at their granted qos
+func (c *remoteClient) deliverRetained(loader RetainedLoader, subscriptions []packet.Subscription) {
+	for _, sub := range subscriptions {
+		msgs, err := loader.LoadRetained(c, sub.Topic)
+		if err == ErrSearchBudget {
+			c.broker.count(&c.broker.counters.AbortedSearches)
+			c.log(LogWarn, "retained_search_aborted", map[string]interface{}{
+				"topic": sub.Topic,
+			})
+
+			continue
+		} else if err != nil {
+			c.die(err, true)
+			return
+		}
+
+		for _, msg := range msgs {
+			view := CopyMessage(msg)
+			view.Downgrade(sub.QOS)
+
+			// queue message like live messages
+			err = c.enqueue(view)
+			if err != nil {
+				view.Release()
+			}
+
+			if err == ErrClientOffline {
+				return
+			}
+		}
+	}
+}
+
+// handle an incoming UnsubscribePacket
+func (c *remoteClient) processUnsubscribe(pkt *packet.UnsubscribePacket) error {
+	unsuback := packet.NewUnsubackPacket()
+	unsuback.PacketID = pkt.PacketID
+
+	for _, topic := range pkt.Topics {
+		// replay subscriptions are stored using the remaining filter
+		topic, _, _ = c.broker.parseReplay(topic)
+
+		// unsubscribe client from queue
+		err := c.broker.Backend.Unsubscribe(c, topic)
+		if err != nil {
+			return c.die(err, true)
+		}
 
 		// remove subscription from session
 		err = c.session.DeleteSubscription(topic)
 		if err != nil {
 			return c.die(err, true)
 		}
+
+		c.broker.emit(&Event{
+			Type:   Unsubscribed,
+			Client: c,
+			Topic:  topic,
+		})
 	}
 
 	err := c.send(unsuback)
@@ -355,6 +1097,66 @@ func (c *remoteClient) processUnsubscribe(pkt *packet.UnsubscribePacket) error {
 
 // handle an incoming PublishPacket
 func (c *remoteClient) processPublish(publish *packet.PublishPacket) error {
+	c.engage()
+
+	// check payload size
+	if c.broker.MaxPayloadSize > 0 && len(publish.Message.Payload) > c.broker.MaxPayloadSize {
+		c.broker.count(&c.broker.counters.DisconnectedClients)
+		c.disconnectAs(DisconnectLimit)
+		return c.die(fmt.Errorf("payload size limit exceeded"), true)
+	}
+
+	// check publish rate
+	if c.broker.MaxPublishRate > 0 {
+		wait := c.broker.limiters.take(AccountingKey(c))
+		if wait > 0 && c.broker.RateLimitDisconnect {
+			c.broker.count(&c.broker.counters.DisconnectedClients)
+			c.disconnectAs(DisconnectLimit)
+			return c.die(fmt.Errorf("publish rate limit exceeded"), true)
+		} else if wait > 0 {
+			c.broker.count(&c.broker.counters.ThrottledPublishes)
+			time.Sleep(wait)
+		}
+	}
+
+	// shed traffic under overload
+	if c.broker.LoadShedding != nil {
+		drop, deferred := c.broker.shed(publish.Message.Topic, publish.Message.QOS)
+		if drop {
+			c.broker.annotations().release(&publish.Message)
+			c.log(LogDebug, "packet_dropped", map[string]interface{}{
+				"reason": "shedding",
+				"topic":  publish.Message.Topic,
+			})
+
+			return nil
+		} else if deferred {
+			time.Sleep(c.broker.LoadShedding.DeferDelay)
+		}
+	}
+
+	// check quotas, over-quota messages are acknowledged but dropped
+	dropped := false
+	if len(c.broker.Quotas) > 0 {
+		if q := c.broker.quotas.take(c.broker.Quotas, c, len(publish.Message.Payload)); q != nil {
+			c.broker.count(&c.broker.counters.OverQuotaPublishes)
+
+			if q.Disconnect {
+				c.broker.count(&c.broker.counters.DisconnectedClients)
+				c.disconnectAs(DisconnectLimit)
+				return c.die(fmt.Errorf("publish quota exceeded"), true)
+			}
+
+			c.broker.annotations().release(&publish.Message)
+			c.log(LogDebug, "packet_dropped", map[string]interface{}{
+				"reason": "quota",
+				"topic":  publish.Message.Topic,
+			})
+
+			dropped = true
+		}
+	}
+
 	if publish.Message.QOS == 1 {
 		puback := packet.NewPubackPacket()
 		puback.PacketID = publish.PacketID
@@ -367,25 +1169,28 @@ func (c *remoteClient) processPublish(publish *packet.PublishPacket) error {
 	}
 
 	if publish.Message.QOS == 2 {
-		// store packet
-		err := c.session.SavePacket(incoming, publish)
-		if err != nil {
-			return c.die(err, true)
+		// store packet, the release of a dropped packet is completed without
+		// publishing it
+		if !dropped {
+			err := c.session.SavePacket(incoming, publish)
+			if err != nil {
+				return c.die(err, true)
+			}
 		}
 
 		pubrec := packet.NewPubrecPacket()
 		pubrec.PacketID = publish.PacketID
 
 		// signal qos 2 publish
-		err = c.send(pubrec)
+		err := c.send(pubrec)
 		if err != nil {
 			return c.die(err, false)
 		}
 	}
 
-	if publish.Message.QOS <= 1 {
+	if publish.Message.QOS <= 1 && !dropped {
 		// publish packet to others
-		err := c.broker.Backend.Publish(c, &publish.Message)
+		err := c.publish(&publish.Message)
 		if err != nil {
 			return c.die(err, true)
 		}
@@ -397,24 +1202,33 @@ func (c *remoteClient) processPublish(publish *packet.PublishPacket) error {
 // handle an incoming PubackPacket or PubcompPacket
 func (c *remoteClient) processPubackAndPubcomp(packetID uint16) error {
 	// remove packet from store
-	c.session.DeletePacket(outgoing, packetID)
+	err := c.session.DeletePacket(outgoing, packetID)
+	if err != nil {
+		return c.die(err, true)
+	}
+
+	// signal released inflight slot
+	select {
+	case c.acked <- struct{}{}:
+	default:
+	}
 
 	return nil
 }
 
 // handle an incoming PubrecPacket
 func (c *remoteClient) processPubrec(packetID uint16) error {
-	// allocate packet
-	pubrel := packet.NewPubrelPacket()
-	pubrel.PacketID = packetID
-
-	// overwrite stored PublishPacket with PubrelPacket
-	err := c.session.SavePacket(outgoing, pubrel)
+	// move the stored PublishPacket to the pubrel stage
+	err := c.release(packetID)
 	if err != nil {
 		return c.die(err, true)
 	}
 
-	// send packet
+	// allocate packet
+	pubrel := packet.NewPubrelPacket()
+	pubrel.PacketID = packetID
+
+	// send packet, also for unknown ids as the receiver completes them
 	err = c.send(pubrel)
 	if err != nil {
 		return c.die(err, false)
@@ -423,6 +1237,44 @@ func (c *remoteClient) processPubrec(packetID uint16) error {
 	return nil
 }
 
+// replaces the stored outgoing PublishPacket with the id by a PubrelPacket
+func (c *remoteClient) release(packetID uint16) error {
+	// use the dedicated api if available
+	if store, ok := c.session.(ReleaseSession); ok {
+		_, err := store.ReleasePacket(packetID)
+		return err
+	}
+
+	pkt, err := c.session.LookupPacket(outgoing, packetID)
+	if err != nil {
+		return err
+	}
+
+	pubrel, ok := releasedPacket(pkt)
+	if !ok || pubrel == nil {
+		return nil
+	}
+
+	return c.session.SavePacket(outgoing, pubrel)
+}
+
+// returns the next packet id that is not used by a stored outgoing packet,
+// which prevents a wrapped sequence from overwriting unfinished flows
+func (c *remoteClient) packetID() (uint16, error) {
+	for i := 0; i < math.MaxUint16; i++ {
+		id := c.session.PacketID()
+
+		pkt, err := c.session.LookupPacket(outgoing, id)
+		if err != nil {
+			return 0, err
+		} else if pkt == nil {
+			return id, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no free packet id")
+}
+
 // handle an incoming PubrelPacket
 func (c *remoteClient) processPubrel(packetID uint16) error {
 	// get packet from store
@@ -431,19 +1283,28 @@ func (c *remoteClient) processPubrel(packetID uint16) error {
 		return c.die(err, true)
 	}
 
+	pubcomp := packet.NewPubcompPacket()
+	pubcomp.PacketID = packetID
+
 	// get packet from store
 	publish, ok := pkt.(*packet.PublishPacket)
 	if !ok {
-		return nil // ignore a wrongly sent PubrelPacket
-	}
+		// complete a flow that has already been released before, as the
+		// PubcompPacket might not have reached the client
+		err = c.send(pubcomp)
+		if err != nil {
+			return c.die(err, false)
+		}
 
-	pubcomp := packet.NewPubcompPacket()
-	pubcomp.PacketID = publish.PacketID
+		return nil
+	}
 
-	// acknowledge PublishPacket
-	err = c.send(pubcomp)
+	// publish packet to others before the flow is completed, so that a
+	// restart before the PubcompPacket has been sent does not lose the
+	// message as the client will release the stored packet again
+	err = c.publish(&publish.Message)
 	if err != nil {
-		return c.die(err, false)
+		return c.die(err, true)
 	}
 
 	// remove packet from store
@@ -452,10 +1313,10 @@ func (c *remoteClient) processPubrel(packetID uint16) error {
 		return c.die(err, true)
 	}
 
-	// publish packet to others
-	err = c.broker.Backend.Publish(c, &publish.Message)
+	// acknowledge PublishPacket
+	err = c.send(pubcomp)
 	if err != nil {
-		return c.die(err, true)
+		return c.die(err, false)
 	}
 
 	return nil
@@ -465,6 +1326,7 @@ func (c *remoteClient) processPubrel(packetID uint16) error {
 func (c *remoteClient) processDisconnect() error {
 	// mark client as cleanly disconnected
 	c.state.set(clientDisconnected)
+	c.disconnectAs(DisconnectClean)
 
 	// clear will
 	err := c.session.ClearWill()
@@ -483,41 +1345,39 @@ func (c *remoteClient) sender() error {
 		select {
 		case <-c.tomb.Dying():
 			return tomb.ErrDying
-		case msg := <-c.out:
-			publish := packet.NewPublishPacket()
-			publish.Message = *msg
+		case view := <-c.out:
+			publish := acquirePublish()
+			publish.Message = *view.Message()
 
-			// get stored subscription
-			sub, err := c.session.LookupSubscription(publish.Message.Topic)
-			if err != nil {
-				return c.die(err, true)
-			}
+			// carry metadata to the sent packet
+			c.broker.annotations().move(view.shared, &publish.Message)
+			view.Release()
 
-			// check subscription
-			if sub == nil {
-				return c.die(fmt.Errorf("subscription not found in session"), true)
-			}
+			// attach topic alias
+			c.attachAlias(&publish.Message)
 
-			// respect maximum qos
-			if publish.Message.QOS > sub.QOS {
-				publish.Message.QOS = sub.QOS
+			err := c.forward(publish)
+			if err != nil {
+				c.broker.annotations().release(&publish.Message)
+				return err
 			}
 
-			// set packet id
-			if publish.Message.QOS > 0 {
-				publish.PacketID = c.session.PacketID()
+			// release packet once it has been written
+			if c.unflushed {
+				c.buffered = append(c.buffered, publish)
+			} else {
+				c.recycle(publish)
 			}
 
-			// store packet if at least qos 1
-			if publish.Message.QOS > 0 {
-				err := c.session.SavePacket(outgoing, publish)
+			// write the batch once the buffer has been drained
+			if len(c.out) == 0 && atomic.LoadInt32(&c.batching) == 0 {
+				err = c.flush()
 				if err != nil {
-					return c.die(err, true)
+					return c.die(err, false)
 				}
 			}
-
-			// send packet
-			err = c.send(publish)
+		case <-c.batched:
+			err := c.flush()
 			if err != nil {
 				return c.die(err, false)
 			}
@@ -525,10 +1385,96 @@ func (c *remoteClient) sender() error {
 	}
 }
 
+// sends an outgoing PublishPacket, buffered writes are flushed by the sender
+func (c *remoteClient) forward(publish *packet.PublishPacket) error {
+	// get stored subscription
+	sub, err := c.session.LookupSubscription(publish.Message.Topic)
+	if err != nil {
+		return c.die(err, true)
+	}
+
+	// check subscription
+	if sub == nil {
+		return c.die(fmt.Errorf("subscription not found in session"), true)
+	}
+
+	// respect maximum qos
+	if publish.Message.QOS > sub.QOS {
+		publish.Message.QOS = sub.QOS
+	}
+
+	// attach subscription identifiers
+	err = c.attachIdentifiers(&publish.Message)
+	if err != nil {
+		return c.die(err, true)
+	}
+
+	// wait for a free slot in the inflight window
+	blocked := false
+	for publish.Message.QOS > 0 && c.maxInflight() > 0 && c.inflight() >= c.maxInflight() {
+		blocked = true
+
+		// acknowledgements require the buffered packets
+		err = c.flush()
+		if err != nil {
+			return c.die(err, false)
+		}
+
+		select {
+		case <-c.acked:
+		case <-c.tomb.Dying():
+			return tomb.ErrDying
+		}
+	}
+
+	// set packet id
+	if publish.Message.QOS > 0 {
+		id, err := c.packetID()
+		if err != nil {
+			return c.die(err, true)
+		}
+
+		publish.PacketID = id
+	}
+
+	// store packet if at least qos 1
+	if publish.Message.QOS > 0 {
+		err := c.session.SavePacket(outgoing, publish)
+		if err != nil {
+			return c.die(err, true)
+		}
+	}
+
+	// send packet
+	err = c.write(publish, true)
+	if err != nil {
+		return c.die(err, false)
+	}
+
+	// account delivery
+	if c.broker.UsageInterval > 0 {
+		c.broker.usage.record(c, sub.Topic, len(publish.Message.Payload))
+	}
+
+	// record delivery
+	if c.tuner != nil && c.tuner.record(time.Now(), c.inflight(), blocked) {
+		buffer, inflight := c.tuner.sizes()
+		c.log(LogDebug, "client_tuned", map[string]interface{}{
+			"buffer":   buffer,
+			"inflight": inflight,
+		})
+	}
+
+	return nil
+}
+
 /* helpers */
 
 // will try to cleanup as many resources as possible
 func (c *remoteClient) cleanup(err error, close bool) error {
+	clientID, _ := c.Context().Get("client_id").(string)
+	delayed := false
+
 	// check session
 	if c.session != nil && c.state.get() != clientDisconnected {
 		// get will
@@ -537,17 +1483,59 @@ func (c *remoteClient) cleanup(err error, close bool) error {
 			err = _err
 		}
 
-		// publish will message
-		if will != nil {
-			_err = c.broker.Backend.Publish(c, will)
+		// delay or publish will message
+		if will != nil && c.broker.WillDelay > 0 && len(clientID) > 0 {
+			c.broker.wills.schedule(clientID, c.broker.WillDelay, func() {
+				c.publishWill(will)
+			}, func() {
+				c.discardWill()
+			})
+
+			delayed = true
+		} else if will != nil {
+			_err = c.publish(will)
 			if err == nil {
 				err = _err
 			}
 		}
 	}
 
-	// remove client from the queue
-	_err := c.broker.Backend.Terminate(c)
+	// release metadata of unreleased qos 2 messages
+	if c.session != nil {
+		packets, _ := c.session.AllPackets(incoming)
+		for _, pkt := range packets {
+			if publish, ok := pkt.(*packet.PublishPacket); ok {
+				c.broker.annotations().release(&publish.Message)
+			}
+		}
+	}
+
+	// discard durably stored will
+	if c.session != nil && !delayed {
+		_err := c.discardWill()
+		if err == nil {
+			err = _err
+		}
+	}
+
+	// stop first message timeout
+	c.engage()
+
+	// release rate limiter if acquired
+	if c.broker.MaxPublishRate > 0 && AccountingKey(c) != "" {
+		c.broker.limiters.release(AccountingKey(c))
+	}
+
+	// keep buffered messages
+	summary, _err := c.salvage()
+	if err == nil {
+		err = _err
+	}
+
+	c.broker.disconnected(c, summary)
+
+	// terminate client in the backend
+	_err = c.terminate(clientID)
 	if err == nil {
 		err = _err
 	}
@@ -560,40 +1548,484 @@ func (c *remoteClient) cleanup(err error, close bool) error {
 		}
 	}
 
-	c.log("%s - Lost Connection", c.Context().Get("uuid"))
+	// record churn
+	reason := c.disconnectReason(err)
+	c.broker.churn.disconnected(c.listener, reason)
+
+	c.log(LogInfo, "connection_lost", map[string]interface{}{
+		"reason": reason.String(),
+	})
 
 	return err
 }
 
+// stores the buffered QOS 1 and 2 messages in a persistent session, so that
+// they are sent when the session is resumed, and returns the summary of the
+// messages left behind
+func (c *remoteClient) salvage() (DisconnectSummary, error) {
+	var summary DisconnectSummary
+
+	clean, _ := c.Context().Get("clean").(bool)
+
+	// count unacknowledged messages
+	if c.session != nil {
+		packets, err := c.session.AllPackets(outgoing)
+		if err != nil {
+			return summary, err
+		}
+
+		for _, pkt := range packets {
+			if _, ok := pkt.(*packet.PublishPacket); ok {
+				summary.Unacknowledged++
+			}
+		}
+	}
+
+	for {
+		var view *MessageCopy
+
+		select {
+		case view = <-c.out:
+		default:
+			return summary, nil
+		}
+
+		msg := *view.Message()
+		c.broker.annotations().release(view.shared)
+		view.Release()
+
+		summary.PendingBytes += len(msg.Payload)
+
+		// drop qos 0 messages
+		if msg.QOS == 0 {
+			summary.DroppedQOS0++
+			continue
+		}
+
+		// skip messages that are not kept
+		if c.session == nil || clean {
+			summary.DroppedQOS12++
+			continue
+		}
+
+		// get stored subscription
+		sub, err := c.session.LookupSubscription(msg.Topic)
+		if err != nil {
+			return summary, err
+		} else if sub == nil || sub.QOS == 0 {
+			summary.DroppedQOS12++
+			continue
+		}
+
+		publish := packet.NewPublishPacket()
+		publish.Message = msg
+
+		// respect maximum qos
+		if publish.Message.QOS > sub.QOS {
+			publish.Message.QOS = sub.QOS
+		}
+
+		publish.PacketID, err = c.packetID()
+		if err != nil {
+			return summary, err
+		}
+
+		err = c.session.SavePacket(outgoing, publish)
+		if err != nil {
+			return summary, err
+		}
+
+		summary.MovedOffline++
+	}
+}
+
+// publishes a delayed will and discards its durable copy
+func (c *remoteClient) publishWill(will *packet.Message) {
+	err := c.publish(will)
+	if err == nil {
+		err = c.discardWill()
+	}
+
+	if err != nil {
+		c.log(LogError, "will_failed", map[string]interface{}{
+			"topic": will.Topic,
+			"error": err,
+		})
+
+		c.broker.reportError(c, err)
+	}
+}
+
+// discards the durably stored will if supported
+func (c *remoteClient) discardWill() error {
+	store, ok := c.broker.Backend.(WillStore)
+	if !ok {
+		return nil
+	}
+
+	return store.DiscardWill(c.Context().Get("uuid").(string))
+}
+
+// stops the first message timeout
+func (c *remoteClient) engage() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.firstMessage != nil {
+		c.firstMessage.Stop()
+	}
+}
+
+// closes a client that did not send its first message in time
+func (c *remoteClient) closeIdle() {
+	c.broker.count(&c.broker.counters.IdleClients)
+	c.log(LogWarn, "idle_connection_closed", nil)
+	c.disconnectAs(DisconnectIdle)
+	c.Close(false)
+}
+
 // used for closing and cleaning up from inside internal goroutines
 func (c *remoteClient) die(err error, close bool) error {
 	c.finish.Do(func() {
 		err = c.cleanup(err, close)
 
+		// unregister client
+		c.broker.remove(c)
+
 		// report error
 		if err != nil {
-			c.log("%s - Internal Error: %s", c.Context().Get("uuid"), err)
+			c.log(LogError, "internal_error", map[string]interface{}{
+				"error": err,
+			})
+
+			c.broker.reportError(c, err)
 		}
 	})
 
 	return err
 }
 
+// publishes a message to the backend and emits related events, messages that
+// are not authorized get silently dropped
+func (c *remoteClient) publish(msg *packet.Message) (err error) {
+	// trace message
+	var span Span = nopSpan{}
+	if c.broker.Tracer != nil {
+		span = c.broker.startSpan("publish", c.broker.parentSpan(msg), spanAttributes(msg, c))
+		defer func() {
+			if err != nil {
+				span.SetError(err)
+			}
+
+			span.End()
+		}()
+	}
+
+	// drop messages to reserved topics
+	if !c.broker.reservations.allowed(msg.Topic, PublishAction) {
+		c.log(LogWarn, "packet_dropped", map[string]interface{}{
+			"reason": "reserved",
+			"topic":  msg.Topic,
+		})
+
+		return nil
+	}
+
+	// authorize message
+	authorize := c.broker.startSpan("authorize", span, nil)
+	ok, err := c.authorize(msg.Topic, PublishAction)
+	if err != nil {
+		authorize.SetError(err)
+	}
+	authorize.End()
+	if err != nil {
+		return err
+	} else if !ok {
+		c.log(LogWarn, "packet_dropped", map[string]interface{}{
+			"reason": "unauthorized",
+			"topic":  msg.Topic,
+		})
+
+		return nil
+	}
+
+	// apply publish hook
+	if !c.rewritePublish(msg) {
+		c.broker.annotations().release(msg)
+		return nil
+	}
+
+	// attach default expiry
+	c.broker.defaultExpiry(msg)
+
+	// stamp origin
+	err = c.broker.stamp(c, msg)
+	if err != nil {
+		return err
+	}
+
+	// pass span to the receivers
+	if c.broker.Tracer != nil {
+		c.broker.Annotate(msg, SpanAnnotation, span)
+	}
+
+	// fanout is synchronous, metadata is not needed afterwards
+	cleared, err := c.broker.publishClearing(c, msg)
+	c.broker.annotations().release(msg)
+	if err != nil {
+		return err
+	}
+
+	c.broker.emit(&Event{
+		Type:    MessagePublished,
+		Client:  c,
+		Message: msg,
+	})
+
+	// check if a retained message has been cleared
+	if cleared {
+		c.broker.emit(&Event{
+			Type:    RetainedMessageCleared,
+			Client:  c,
+			Message: msg,
+		})
+
+		if c.broker.SystemNotifications {
+			return c.notify("retained/cleared", map[string]interface{}{
+				"topic":     msg.Topic,
+				"client_id": c.Context().Get("client_id"),
+				"uuid":      c.Context().Get("uuid"),
+			})
+		}
+	}
+
+	return nil
+}
+
+// publishes a system notification to the "$SYS/broker/" topic space on
+// behalf of the system client
+func (c *remoteClient) notify(topic string, data map[string]interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return c.broker.Publish(&packet.Message{
+		Topic:   "$SYS/broker/" + topic,
+		Payload: payload,
+	})
+}
+
+// returns the number of outgoing packets that have not yet been acknowledged
+func (c *remoteClient) inflight() int {
+	c.mutex.Lock()
+	sess := c.session
+	c.mutex.Unlock()
+
+	// check session
+	if sess == nil {
+		return 0
+	}
+
+	packets, err := sess.AllPackets(outgoing)
+	if err != nil {
+		return 0
+	}
+
+	return len(packets)
+}
+
+// returns the tuned or configured inflight window
+func (c *remoteClient) maxInflight() int {
+	if c.tuner != nil {
+		_, inflight := c.tuner.sizes()
+		return inflight
+	}
+
+	return c.broker.MaxInflight
+}
+
+// returns the subscribed topic filters and their granted qos levels
+func (c *remoteClient) subscriptions() ([]string, map[string]byte) {
+	c.mutex.Lock()
+	sess := c.session
+	c.mutex.Unlock()
+
+	list := []string{}
+	granted := make(map[string]byte)
+
+	// check session
+	if sess == nil {
+		return list, granted
+	}
+
+	subs, err := sess.AllSubscriptions()
+	if err != nil {
+		return list, granted
+	}
+
+	for _, sub := range subs {
+		list = append(list, sub.Topic)
+		granted[sub.Topic] = sub.QOS
+	}
+
+	return list, granted
+}
+
+// authorizes the action on the topic using the authorization cache if enabled
+func (c *remoteClient) authorize(topic string, action Action) (bool, error) {
+	if c.authCache == nil {
+		return c.broker.Backend.Authorize(c, topic, action)
+	}
+
+	return c.authCache.authorize(c.broker.Backend, c, topic, action)
+}
+
+// revokes all subscriptions that are no longer authorized
+func (c *remoteClient) reauthorize() error {
+	c.mutex.Lock()
+	sess := c.session
+	c.mutex.Unlock()
+
+	// check session
+	if sess == nil {
+		return nil
+	}
+
+	// drop cached decisions
+	if c.authCache != nil {
+		c.authCache.invalidate()
+	}
+
+	subs, err := sess.AllSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range subs {
+		// authorize subscription
+		ok, err := c.authorize(sub.Topic, SubscribeAction)
+		if err != nil {
+			return err
+		} else if ok {
+			continue
+		}
+
+		// unsubscribe client from queue
+		err = c.broker.Backend.Unsubscribe(c, sub.Topic)
+		if err != nil {
+			return err
+		}
+
+		// remove subscription from session
+		err = sess.DeleteSubscription(sub.Topic)
+		if err != nil {
+			return err
+		}
+
+		c.broker.emit(&Event{
+			Type:   SubscriptionRevoked,
+			Client: c,
+			Topic:  sub.Topic,
+		})
+
+		c.log(LogWarn, "subscription_revoked", map[string]interface{}{
+			"topic": sub.Topic,
+		})
+
+		if c.broker.SystemNotifications {
+			err = c.notify("subscriptions/revoked", map[string]interface{}{
+				"topic":     sub.Topic,
+				"client_id": c.Context().Get("client_id"),
+				"uuid":      c.Context().Get("uuid"),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// returns for how long the current write has been blocked
+func (c *remoteClient) writerBlocked() time.Duration {
+	since := atomic.LoadInt64(&c.sendingSince)
+	if since == 0 {
+		return 0
+	}
+
+	return time.Since(time.Unix(0, since))
+}
+
+// sends a DisconnectPacket to notify the client about the shutdown
+func (c *remoteClient) disconnect() {
+	c.send(packet.NewDisconnectPacket())
+}
+
 // sends packet
 func (c *remoteClient) send(pkt packet.Packet) error {
-	err := c.conn.Send(pkt)
+	return c.write(pkt, false)
+}
+
+// sends the packet or buffers it until the next flush if the connection
+// supports buffered writes
+func (c *remoteClient) write(pkt packet.Packet, buffered bool) error {
+	// pass packet through middleware
+	pkt, err := c.broker.outbound(c, pkt)
+	if err != nil {
+		c.conn.Close()
+		return err
+	} else if pkt == nil {
+		return nil
+	}
+
+	// track blocking writes
+	atomic.StoreInt64(&c.sendingSince, time.Now().UnixNano())
+	if conn, ok := c.conn.(BatchConn); ok && buffered {
+		err = conn.BufferedSend(pkt)
+		c.unflushed = true
+	} else {
+		err = c.conn.Send(pkt)
+	}
+	atomic.StoreInt64(&c.sendingSince, 0)
 	if err != nil {
+		c.disconnectAs(DisconnectNetwork)
 		return err
 	}
 
-	c.log("%s - Sent: %s", c.Context().Get("uuid"), pkt.String())
+	if c.broker.Logger != nil {
+		c.log(LogDebug, "packet_sent", map[string]interface{}{
+			"packet": pkt.String(),
+		})
+	}
 
 	return nil
 }
 
-// log a message
-func (c *remoteClient) log(format string, a ...interface{}) {
-	if c.broker.Logger != nil {
-		c.broker.Logger(fmt.Sprintf(format, a...))
+// logs an event with the uuid, client id and remote address of the client
+func (c *remoteClient) log(level LogLevel, event string, fields map[string]interface{}) {
+	if c.broker.Logger == nil {
+		return
 	}
+
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+
+	fields["uuid"] = c.Context().Get("uuid")
+	fields["remote_addr"] = c.conn.RemoteAddr().String()
+
+	clientID, _ := c.Context().Get("client_id").(string)
+	if clientID != "" {
+		fields["client_id"] = clientID
+	}
+
+	// raise debug events of traced clients
+	if level == LogDebug && c.broker.debugs.traced(clientID) {
+		level = LogInfo
+		fields["debug"] = true
+	}
+
+	c.broker.log(level, event, fields)
 }
@@ -0,0 +1,110 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ClientIDAlphanumeric is the character set that MQTT 3.1.1 guarantees to be
+// accepted by every broker.
+const ClientIDAlphanumeric = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// A ClientIDPolicy restricts the client ids of connecting clients. Clients
+// with an id that violates the policy are refused with an "identifier
+// rejected" return code. Empty and assigned client ids are not checked.
+type ClientIDPolicy struct {
+	// The maximum length of client ids in bytes. A zero value disables the
+	// limit.
+	MaxLength int
+
+	// The characters client ids may contain, e.g. ClientIDAlphanumeric. An
+	// empty set allows all characters.
+	Charset string
+
+	// If Pattern is set, client ids must match the regular expression.
+	Pattern *regexp.Regexp
+}
+
+// Allows returns whether the client id complies with the policy.
+func (p *ClientIDPolicy) Allows(id string) bool {
+	if p.MaxLength > 0 && len(id) > p.MaxLength {
+		return false
+	}
+
+	if p.Charset != "" {
+		for _, r := range id {
+			if !strings.ContainsRune(p.Charset, r) {
+				return false
+			}
+		}
+	}
+
+	if p.Pattern != nil && !p.Pattern.MatchString(id) {
+		return false
+	}
+
+	return true
+}
+
+// A SessionInspector is a Backend that is able to tell whether a session is
+// stored for a client id. The broker uses it to avoid assigning the id of an
+// existing session to a new client.
+type SessionInspector interface {
+	// SessionExists should return whether a session is stored for the client
+	// id as seen from the specified client.
+	SessionExists(client Client, id string) (bool, error)
+}
+
+// returns whether the client id complies with the optional policy
+func (b *Broker) allowsClientID(id string) bool {
+	return b.ClientIDPolicy == nil || id == "" || b.ClientIDPolicy.Allows(id)
+}
+
+// returns a server-generated client id for the client
+func (b *Broker) assignClientID(client Client) string {
+	if b.ClientIDGenerator != nil {
+		return b.ClientIDGenerator(client)
+	}
+
+	uuid, _ := client.Context().Get("uuid").(string)
+	return "auto-" + uuid
+}
+
+// returns whether the generated client id is not empty, not used by another
+// client and does not belong to a stored session
+func (b *Broker) assignableClientID(client Client, id string) (bool, error) {
+	if id == "" {
+		return false, nil
+	}
+
+	for _, other := range b.currentClients() {
+		if other != client && other.Context().Get("client_id") == id {
+			return false, nil
+		}
+	}
+
+	if inspector, ok := b.Backend.(SessionInspector); ok {
+		exists, err := inspector.SessionExists(client, id)
+		if err != nil {
+			return false, err
+		}
+
+		return !exists, nil
+	}
+
+	return true, nil
+}
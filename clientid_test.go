@@ -0,0 +1,274 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIDPolicy(t *testing.T) {
+	policy := &ClientIDPolicy{
+		MaxLength: 10,
+		Charset:   ClientIDAlphanumeric + "-",
+		Pattern:   regexp.MustCompile(`^device-`),
+	}
+
+	assert.True(t, policy.Allows("device-1"))
+	assert.False(t, policy.Allows("device-1234"))
+	assert.False(t, policy.Allows("device/1"))
+	assert.False(t, policy.Allows("sensor-1"))
+
+	assert.True(t, (&ClientIDPolicy{}).Allows(strings.Repeat("ü", 100)))
+}
+
+func TestClientIDPolicyConnect(t *testing.T) {
+	allowed := packet.NewConnectPacket()
+	allowed.ClientID = "device1"
+
+	denied := packet.NewConnectPacket()
+	denied.ClientID = "device/1"
+
+	connack := packet.NewConnackPacket()
+
+	rejected := packet.NewConnackPacket()
+	rejected.ReturnCode = packet.ErrIdentifierRejected
+
+	broker := New()
+	broker.ClientIDPolicy = &ClientIDPolicy{Charset: ClientIDAlphanumeric}
+
+	port, done := runBroker(t, broker, 3)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(allowed).
+		Receive(connack).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	// empty ids are not checked
+	conn, err = transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(connack).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	conn, err = transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(denied).
+		Receive(rejected).
+		End().
+		Test(t, conn)
+
+	<-done
+}
+
+func TestAssignClientIDs(t *testing.T) {
+	persistent := packet.NewConnectPacket()
+	persistent.CleanSession = false
+
+	connack := packet.NewConnackPacket()
+
+	rejected := packet.NewConnackPacket()
+	rejected.ReturnCode = packet.ErrIdentifierRejected
+
+	recorder := &connackRecorder{props: make(chan interface{}, 6)}
+
+	broker := New()
+	broker.UUIDs = NewUUIDs("test-")
+	broker.Use(recorder)
+
+	port, done := runBroker(t, broker, 6)
+
+	// clean sessions without an id are not assigned one by default
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(connack).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	assert.Nil(t, <-recorder.props)
+
+	broker.AssignClientIDs = true
+
+	// persistent sessions without an id are always rejected
+	conn, err = transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(persistent).
+		Receive(rejected).
+		End().
+		Test(t, conn)
+
+	assert.Nil(t, <-recorder.props)
+
+	conn, err = transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(connack).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	assert.Equal(t, ConnackProperties{AssignedClientIdentifier: "auto-test-3"}, <-recorder.props)
+
+	// the generator is pluggable
+	broker.ClientIDGenerator = func(client Client) string {
+		return "generated"
+	}
+
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(connack).
+		Test(t, conn1)
+
+	assert.Equal(t, ConnackProperties{AssignedClientIdentifier: "generated"}, <-recorder.props)
+
+	// colliding ids are rejected
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(rejected).
+		End().
+		Test(t, conn2)
+
+	assert.Nil(t, <-recorder.props)
+
+	tools.NewFlow().
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn1)
+
+	// empty ids are rejected
+	broker.ClientIDGenerator = func(client Client) string {
+		return ""
+	}
+
+	conn, err = transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(rejected).
+		End().
+		Test(t, conn)
+
+	assert.Nil(t, <-recorder.props)
+
+	<-done
+}
+
+func TestAssignClientIDsStoredSessions(t *testing.T) {
+	stored := packet.NewConnectPacket()
+	stored.ClientID = "stored"
+	stored.CleanSession = false
+	stored.Username = "user"
+	stored.Password = "secret"
+
+	connect := packet.NewConnectPacket()
+	connect.Username = "user"
+	connect.Password = "secret"
+
+	invalid := packet.NewConnectPacket()
+	invalid.Username = "user"
+	invalid.Password = "invalid"
+
+	connack := packet.NewConnackPacket()
+
+	rejected := packet.NewConnackPacket()
+	rejected.ReturnCode = packet.ErrIdentifierRejected
+
+	unauthorized := packet.NewConnackPacket()
+	unauthorized.ReturnCode = packet.ErrNotAuthorized
+
+	backend := NewMemoryBackend()
+	backend.Logins = map[string]string{"user": "secret"}
+
+	var generated int32
+	broker := New()
+	broker.Backend = backend
+	broker.AssignClientIDs = true
+	broker.ClientIDGenerator = func(client Client) string {
+		atomic.AddInt32(&generated, 1)
+		return "stored"
+	}
+
+	port, done := runBroker(t, broker, 3)
+
+	// store a persistent session
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(stored).
+		Receive(connack).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	// ids of stored sessions are not assigned
+	conn, err = transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(rejected).
+		End().
+		Test(t, conn)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&generated))
+
+	// ids are only generated for authenticated clients
+	conn, err = transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(invalid).
+		Receive(unauthorized).
+		End().
+		Test(t, conn)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&generated))
+
+	<-done
+}
@@ -0,0 +1,575 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package coap implements a CoAP server that maps requests on resource paths
+// to the topics of a broker, so that constrained devices interoperate with
+// MQTT clients. It is kept separate from the broker package, so that embedders
+// that do not need it do not pay for it.
+package coap
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomqtt/broker"
+	"github.com/gomqtt/packet"
+)
+
+// the time after which a retransmitted confirmable request is considered new
+const exchangeLifetime = 247 * time.Second
+
+// a cached response to a confirmable request
+type exchange struct {
+	key      string
+	response []byte
+	created  time.Time
+}
+
+// an observation of a topic filter by a remote endpoint
+type observer struct {
+	addr      net.Addr
+	token     []byte
+	client    *broker.LocalClient
+	sequence  uint32
+	messageID uint16
+}
+
+// A Server serves CoAP requests on a UDP socket and can be attached to a
+// broker as a Subsystem. The path of a request is prefixed with the
+// TopicPrefix and mapped to a topic of the broker:
+//
+//	GET    <path>              returns the retained message of the topic
+//	GET    <path> Observe: 0   observes the messages published to the topic
+//	GET    <path> Observe: 1   cancels the observation
+//	PUT    <path>              publishes the payload as a retained message
+//	POST   <path>              publishes the payload
+//	DELETE <path>              clears the retained message of the topic
+//
+// Observations support the "+" and "#" wildcards and last until they are
+// cancelled, a notification is reset or the server is stopped. Publishes use
+// QOS 0 unless the query sets another level, e.g. "?qos=1". Requests are
+// authorized by the Backend using a client that has the "coap_addr" value set
+// to the remote address in its context.
+//
+// The responses to confirmable requests are cached to answer retransmissions.
+// The cache and the observations of a single endpoint are limited, so that
+// spoofed or misbehaving endpoints cannot exhaust the memory of the server.
+type Server struct {
+	// The address the server listens on, e.g. "localhost:5683".
+	Addr string
+
+	// The prefix added to the paths of requests, e.g. "coap/".
+	TopicPrefix string
+
+	// The maximum number of cached responses. The oldest response is evicted
+	// when the limit is reached. A zero value disables the limit.
+	MaxExchanges int
+
+	// The maximum number of observations per remote address. Further
+	// observations are refused with a "service unavailable" response. A zero
+	// value disables the limit.
+	MaxObservers int
+
+	broker    *broker.Broker
+	conn      net.PacketConn
+	observers map[string]*observer
+	exchanges map[string]exchange
+	history   []exchange
+	messageID uint16
+	done      chan struct{}
+	mutex     sync.Mutex
+}
+
+// NewServer returns a new Server that maps the requests received on the
+// specified address to the broker.
+func NewServer(b *broker.Broker, addr string) *Server {
+	return &Server{
+		Addr:         addr,
+		MaxExchanges: 10000,
+		MaxObservers: 16,
+		broker:       b,
+	}
+}
+
+// Start will start listening and serving requests.
+func (s *Server) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	conn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	s.conn = conn
+	s.observers = make(map[string]*observer)
+	s.exchanges = make(map[string]exchange)
+	s.history = nil
+	s.done = make(chan struct{})
+
+	go s.serve(conn, s.done)
+
+	return nil
+}
+
+// LocalAddr returns the address of a started server.
+func (s *Server) LocalAddr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	return s.conn.LocalAddr()
+}
+
+// Stop will close the socket and cancel all observations.
+func (s *Server) Stop() error {
+	s.mutex.Lock()
+
+	if s.conn == nil {
+		s.mutex.Unlock()
+		return nil
+	}
+
+	err := s.conn.Close()
+	done := s.done
+	s.conn = nil
+
+	var clients []*broker.LocalClient
+	for key, o := range s.observers {
+		clients = append(clients, o.client)
+		delete(s.observers, key)
+	}
+
+	s.mutex.Unlock()
+
+	<-done
+
+	// terminate observers
+	for _, client := range clients {
+		_err := s.broker.Backend.Terminate(client)
+		if err == nil {
+			err = _err
+		}
+	}
+
+	return err
+}
+
+// reads and handles messages until the socket is closed
+func (s *Server) serve(conn net.PacketConn, done chan struct{}) {
+	defer close(done)
+
+	buf := make([]byte, 65536)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		// ignore malformed messages
+		msg, err := Decode(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		s.handle(conn, addr, msg)
+	}
+}
+
+// handles a single message
+func (s *Server) handle(conn net.PacketConn, addr net.Addr, msg *Message) {
+	switch {
+	case msg.Type == Reset:
+		s.reset(addr, msg.MessageID)
+		return
+	case msg.Type == Acknowledgement:
+		return
+	case msg.Code == Empty:
+		// answer pings with a reset
+		if msg.Type == Confirmable {
+			s.write(conn, addr, &Message{Type: Reset, MessageID: msg.MessageID})
+		}
+
+		return
+	}
+
+	key := addr.String() + "/" + strconv.Itoa(int(msg.MessageID))
+
+	// resend the response of a retransmitted request
+	if msg.Type == Confirmable {
+		s.mutex.Lock()
+		cached, ok := s.exchanges[key]
+		s.mutex.Unlock()
+
+		if ok {
+			conn.WriteTo(cached.response, addr)
+			return
+		}
+	}
+
+	res, after := s.process(addr, msg)
+	res.Token = msg.Token
+
+	// piggyback the response on the acknowledgement
+	if msg.Type == Confirmable {
+		res.Type = Acknowledgement
+		res.MessageID = msg.MessageID
+	} else {
+		res.Type = NonConfirmable
+		res.MessageID = s.nextMessageID()
+	}
+
+	data, err := res.Encode()
+	if err != nil {
+		return
+	}
+
+	// cache the response
+	if msg.Type == Confirmable {
+		s.cache(key, data)
+	}
+
+	conn.WriteTo(data, addr)
+
+	if after != nil {
+		after()
+	}
+}
+
+// processes a request and returns the response and an optional function that
+// is called after the response has been sent
+func (s *Server) process(addr net.Addr, req *Message) (*Message, func()) {
+	topic := s.TopicPrefix + req.Path()
+	if req.Path() == "" {
+		return &Message{Code: BadRequest}, nil
+	}
+
+	// check observe option
+	observe, observing := req.Option(ObserveOption)
+	if req.Code == GET && observing && decodeUint(observe) == 0 {
+		return s.observe(addr, req.Token, topic)
+	} else if req.Code == GET && observing {
+		s.cancel(observerKey(addr, req.Token))
+	}
+
+	// observations are the only requests that support wildcards
+	if strings.ContainsAny(topic, "+#") {
+		return &Message{Code: BadRequest}, nil
+	}
+
+	client := s.client(addr, nil)
+
+	switch req.Code {
+	case GET:
+		return s.get(client, topic), nil
+	case PUT:
+		return s.publish(client, req, topic, true), nil
+	case POST:
+		return s.publish(client, req, topic, false), nil
+	case DELETE:
+		return s.publish(client, req, topic, true), nil
+	}
+
+	return &Message{Code: MethodNotAllowed}, nil
+}
+
+// returns the retained message of the topic
+func (s *Server) get(client *broker.LocalClient, topic string) *Message {
+	ok, err := s.broker.Backend.Authorize(client, topic, broker.SubscribeAction)
+	if err != nil {
+		return &Message{Code: InternalServerError}
+	} else if !ok {
+		return &Message{Code: Forbidden}
+	}
+
+	// look up the retained messages using a temporary subscription
+	_, _, err = s.broker.Backend.Setup(client, "", true)
+	if err != nil {
+		return &Message{Code: InternalServerError}
+	}
+
+	msgs, err := s.broker.Backend.Subscribe(client, topic)
+	_err := s.broker.Backend.Terminate(client)
+	if err != nil || _err != nil {
+		return &Message{Code: InternalServerError}
+	}
+
+	if len(msgs) == 0 {
+		return &Message{Code: NotFound}
+	}
+
+	return &Message{Code: Content, Payload: msgs[0].Payload}
+}
+
+// publishes the payload of the request to the topic
+func (s *Server) publish(client *broker.LocalClient, req *Message, topic string, retain bool) *Message {
+	qos := uint8(0)
+	if value, ok := req.Query("qos"); ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 2 {
+			return &Message{Code: BadRequest}
+		}
+
+		qos = uint8(n)
+	}
+
+	ok, err := s.broker.Backend.Authorize(client, topic, broker.PublishAction)
+	if err != nil {
+		return &Message{Code: InternalServerError}
+	} else if !ok {
+		return &Message{Code: Forbidden}
+	}
+
+	// a retained message without a payload clears the retained message
+	payload := req.Payload
+	if req.Code == DELETE {
+		payload = nil
+	}
+
+	err = s.broker.Backend.Publish(client, &packet.Message{
+		Topic:   topic,
+		Payload: payload,
+		QOS:     qos,
+		Retain:  retain,
+	})
+	if err != nil {
+		return &Message{Code: InternalServerError}
+	}
+
+	if req.Code == DELETE {
+		return &Message{Code: Deleted}
+	}
+
+	return &Message{Code: Changed}
+}
+
+// registers an observation and returns the current state of the topic and a
+// function that notifies about further retained messages
+func (s *Server) observe(addr net.Addr, token []byte, topic string) (*Message, func()) {
+	key := observerKey(addr, token)
+
+	// replace an existing observation
+	s.cancel(key)
+
+	// limit the observations of the endpoint
+	if !s.admitObserver(addr) {
+		return &Message{Code: ServiceUnavailable}, nil
+	}
+
+	o := &observer{
+		addr:  addr,
+		token: token,
+	}
+
+	o.client = s.client(addr, func(msg *packet.Message) {
+		s.notify(o, msg)
+	})
+
+	ok, err := s.broker.Backend.Authorize(o.client, topic, broker.SubscribeAction)
+	if err != nil {
+		return &Message{Code: InternalServerError}, nil
+	} else if !ok {
+		return &Message{Code: Forbidden}, nil
+	}
+
+	// register before subscribing as messages may arrive immediately
+	s.mutex.Lock()
+	s.observers[key] = o
+	s.mutex.Unlock()
+
+	_, _, err = s.broker.Backend.Setup(o.client, "", true)
+	if err != nil {
+		s.cancel(key)
+		return &Message{Code: InternalServerError}, nil
+	}
+
+	msgs, err := s.broker.Backend.Subscribe(o.client, topic)
+	if err != nil {
+		s.cancel(key)
+		return &Message{Code: InternalServerError}, nil
+	}
+
+	s.mutex.Lock()
+	sequence := o.sequence
+	s.mutex.Unlock()
+
+	res := &Message{
+		Code:    Content,
+		Options: []Option{{Number: ObserveOption, Value: encodeUint(sequence)}},
+	}
+
+	if len(msgs) == 0 {
+		return res, nil
+	}
+
+	// respond with the first retained message and notify about the others
+	res.Payload = msgs[0].Payload
+
+	return res, func() {
+		for _, msg := range msgs[1:] {
+			s.notify(o, msg)
+		}
+	}
+}
+
+// sends a notification about the message to the observer
+func (s *Server) notify(o *observer, msg *packet.Message) {
+	s.mutex.Lock()
+	conn := s.conn
+	if conn == nil || s.observers[observerKey(o.addr, o.token)] != o {
+		s.mutex.Unlock()
+		return
+	}
+
+	o.sequence = (o.sequence + 1) & 0xffffff
+	o.messageID = s.nextMessageIDLocked()
+
+	notification := &Message{
+		Type:      NonConfirmable,
+		Code:      Content,
+		MessageID: o.messageID,
+		Token:     o.token,
+		Options:   []Option{{Number: ObserveOption, Value: encodeUint(o.sequence)}},
+		Payload:   msg.Payload,
+	}
+	s.mutex.Unlock()
+
+	s.write(conn, o.addr, notification)
+}
+
+// returns whether the endpoint may add another observation
+func (s *Server) admitObserver(addr net.Addr) bool {
+	if s.MaxObservers <= 0 {
+		return true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	count := 0
+	for _, o := range s.observers {
+		if o.addr.String() == addr.String() {
+			count++
+		}
+	}
+
+	return count < s.MaxObservers
+}
+
+// cancels the observation whose last notification has been reset
+func (s *Server) reset(addr net.Addr, messageID uint16) {
+	s.mutex.Lock()
+	var key string
+	for k, o := range s.observers {
+		if o.addr.String() == addr.String() && o.messageID == messageID {
+			key = k
+		}
+	}
+	s.mutex.Unlock()
+
+	if key != "" {
+		s.cancel(key)
+	}
+}
+
+// cancels and terminates an observation
+func (s *Server) cancel(key string) {
+	s.mutex.Lock()
+	o, ok := s.observers[key]
+	delete(s.observers, key)
+	s.mutex.Unlock()
+
+	if ok {
+		s.broker.Backend.Terminate(o.client)
+	}
+}
+
+// returns a client for the remote address that passes messages to the
+// callback
+func (s *Server) client(addr net.Addr, callback func(msg *packet.Message)) *broker.LocalClient {
+	if callback == nil {
+		callback = func(*packet.Message) {}
+	}
+
+	client := broker.NewLocalClient(callback)
+	client.Context().Set("coap_addr", addr.String())
+
+	return client
+}
+
+// caches the response of a confirmable request and evicts expired and, if
+// the cache is full, the oldest responses
+func (s *Server) cache(key string, response []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+
+	// the history is ordered by creation
+	for len(s.history) > 0 {
+		oldest := s.history[0]
+		if now.Sub(oldest.created) <= exchangeLifetime && (s.MaxExchanges <= 0 || len(s.exchanges) < s.MaxExchanges) {
+			break
+		}
+
+		delete(s.exchanges, oldest.key)
+		s.history[0] = exchange{}
+		s.history = s.history[1:]
+	}
+
+	e := exchange{
+		key:      key,
+		response: response,
+		created:  now,
+	}
+
+	s.exchanges[key] = e
+	s.history = append(s.history, e)
+}
+
+// returns the next message id for messages sent by the server
+func (s *Server) nextMessageID() uint16 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.nextMessageIDLocked()
+}
+
+// returns the next message id, the mutex must be held
+func (s *Server) nextMessageIDLocked() uint16 {
+	s.messageID++
+	return s.messageID
+}
+
+// encodes and writes a message to the address
+func (s *Server) write(conn net.PacketConn, addr net.Addr, msg *Message) {
+	data, err := msg.Encode()
+	if err != nil {
+		return
+	}
+
+	conn.WriteTo(data, addr)
+}
+
+// returns the key of an observation
+func observerKey(addr net.Addr, token []byte) string {
+	return addr.String() + "/" + string(token)
+}
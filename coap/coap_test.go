@@ -0,0 +1,249 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coap
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/broker"
+	"github.com/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessage(t *testing.T) {
+	msg := &Message{
+		Type:      Confirmable,
+		Code:      GET,
+		MessageID: 42,
+		Token:     []byte{1, 2},
+		Options: []Option{
+			{Number: URIQueryOption, Value: []byte("qos=1")},
+			{Number: ObserveOption, Value: encodeUint(0)},
+			{Number: 300, Value: make([]byte, 20)},
+		},
+		Payload: []byte("test"),
+	}
+	msg.SetPath("sensors/temperature")
+
+	data, err := msg.Encode()
+	assert.NoError(t, err)
+
+	decoded, err := Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, Confirmable, decoded.Type)
+	assert.Equal(t, GET, decoded.Code)
+	assert.Equal(t, uint16(42), decoded.MessageID)
+	assert.Equal(t, []byte{1, 2}, decoded.Token)
+	assert.Equal(t, "sensors/temperature", decoded.Path())
+	assert.Equal(t, []byte("test"), decoded.Payload)
+
+	qos, ok := decoded.Query("qos")
+	assert.True(t, ok)
+	assert.Equal(t, "1", qos)
+
+	value, ok := decoded.Option(300)
+	assert.True(t, ok)
+	assert.Len(t, value, 20)
+
+	assert.Equal(t, "2.05", Content.String())
+	assert.Equal(t, uint32(70000), decodeUint(encodeUint(70000)))
+
+	_, err = Decode([]byte{0x80, 0, 0, 0})
+	assert.Error(t, err)
+
+	_, err = Decode(append(data[:len(data)-5], 0xff))
+	assert.Error(t, err)
+}
+
+// sends a request and returns the response
+func request(t *testing.T, conn net.Conn, req *Message) *Message {
+	data, err := req.Encode()
+	assert.NoError(t, err)
+
+	_, err = conn.Write(data)
+	assert.NoError(t, err)
+
+	return receive(t, conn)
+}
+
+// receives the next message
+func receive(t *testing.T, conn net.Conn) *Message {
+	buf := make([]byte, 1500)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if !assert.NoError(t, err) {
+		return &Message{}
+	}
+
+	msg, err := Decode(buf[:n])
+	assert.NoError(t, err)
+
+	return msg
+}
+
+func TestServer(t *testing.T) {
+	b := broker.New()
+
+	server := NewServer(b, "127.0.0.1:0")
+	server.TopicPrefix = "coap/"
+
+	err := b.Attach(server)
+	assert.NoError(t, err)
+
+	err = b.Start()
+	assert.NoError(t, err)
+
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	assert.NoError(t, err)
+
+	// publish retained message
+	put := &Message{Type: Confirmable, Code: PUT, MessageID: 1, Token: []byte{1}, Payload: []byte("21")}
+	put.SetPath("sensors/temperature")
+
+	res := request(t, conn, put)
+	assert.Equal(t, Acknowledgement, res.Type)
+	assert.Equal(t, Changed, res.Code)
+	assert.Equal(t, uint16(1), res.MessageID)
+	assert.Equal(t, []byte{1}, res.Token)
+
+	// retransmitted requests are answered from the cache
+	res = request(t, conn, put)
+	assert.Equal(t, Changed, res.Code)
+
+	// read retained message
+	get := &Message{Type: NonConfirmable, Code: GET, MessageID: 2, Token: []byte{2}}
+	get.SetPath("sensors/temperature")
+
+	res = request(t, conn, get)
+	assert.Equal(t, NonConfirmable, res.Type)
+	assert.Equal(t, Content, res.Code)
+	assert.Equal(t, []byte("21"), res.Payload)
+
+	// observe topic
+	observe := &Message{Type: Confirmable, Code: GET, MessageID: 3, Token: []byte{3}}
+	observe.Options = []Option{{Number: ObserveOption}}
+	observe.SetPath("sensors/+")
+
+	res = request(t, conn, observe)
+	assert.Equal(t, Content, res.Code)
+	assert.Equal(t, []byte("21"), res.Payload)
+
+	_, ok := res.Option(ObserveOption)
+	assert.True(t, ok)
+
+	// receive notification about mqtt publish
+	err = b.Backend.Publish(broker.NewLocalClient(func(*packet.Message) {}), &packet.Message{
+		Topic:   "coap/sensors/humidity",
+		Payload: []byte("50"),
+	})
+	assert.NoError(t, err)
+
+	notification := receive(t, conn)
+	assert.Equal(t, NonConfirmable, notification.Type)
+	assert.Equal(t, Content, notification.Code)
+	assert.Equal(t, []byte{3}, notification.Token)
+	assert.Equal(t, []byte("50"), notification.Payload)
+
+	sequence, _ := notification.Option(ObserveOption)
+	assert.Equal(t, uint32(1), decodeUint(sequence))
+
+	// resetting a notification cancels the observation
+	reset, err := (&Message{Type: Reset, MessageID: notification.MessageID}).Encode()
+	assert.NoError(t, err)
+
+	_, err = conn.Write(reset)
+	assert.NoError(t, err)
+
+	// clear retained message
+	del := &Message{Type: Confirmable, Code: DELETE, MessageID: 4, Token: []byte{4}}
+	del.SetPath("sensors/temperature")
+
+	res = request(t, conn, del)
+	assert.Equal(t, Deleted, res.Code)
+
+	// the reset observation and the cleared message are gone
+	get.MessageID = 5
+	res = request(t, conn, get)
+	assert.Equal(t, NotFound, res.Code)
+
+	// wildcards are only supported for observations
+	post := &Message{Type: Confirmable, Code: POST, MessageID: 6, Payload: []byte("1")}
+	post.SetPath("sensors/#")
+
+	res = request(t, conn, post)
+	assert.Equal(t, BadRequest, res.Code)
+
+	err = b.Close(time.Second)
+	assert.NoError(t, err)
+	assert.Nil(t, server.LocalAddr())
+}
+
+func TestServerLimits(t *testing.T) {
+	b := broker.New()
+
+	server := NewServer(b, "127.0.0.1:0")
+	server.MaxExchanges = 2
+	server.MaxObservers = 1
+
+	err := b.Attach(server)
+	assert.NoError(t, err)
+
+	err = b.Start()
+	assert.NoError(t, err)
+
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	assert.NoError(t, err)
+
+	// the oldest cached responses are evicted
+	for i := 1; i <= 3; i++ {
+		put := &Message{Type: Confirmable, Code: PUT, MessageID: uint16(i), Payload: []byte("1")}
+		put.SetPath("test")
+
+		res := request(t, conn, put)
+		assert.Equal(t, Changed, res.Code)
+	}
+
+	server.mutex.Lock()
+	assert.Len(t, server.exchanges, 2)
+	assert.Len(t, server.history, 2)
+	_, ok := server.exchanges[conn.LocalAddr().String()+"/1"]
+	assert.False(t, ok)
+	server.mutex.Unlock()
+
+	// the observations of an endpoint are limited
+	observe := &Message{Type: Confirmable, Code: GET, MessageID: 4, Token: []byte{1}}
+	observe.Options = []Option{{Number: ObserveOption}}
+	observe.SetPath("test")
+
+	res := request(t, conn, observe)
+	assert.Equal(t, Content, res.Code)
+
+	observe.MessageID = 5
+	observe.Token = []byte{2}
+	res = request(t, conn, observe)
+	assert.Equal(t, ServiceUnavailable, res.Code)
+
+	// replacing an observation is allowed
+	observe.MessageID = 6
+	observe.Token = []byte{1}
+	res = request(t, conn, observe)
+	assert.Equal(t, Content, res.Code)
+
+	err = b.Close(time.Second)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,308 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A Type is the type of a CoAP message.
+type Type uint8
+
+const (
+	// Confirmable messages are acknowledged by the receiver.
+	Confirmable Type = iota
+
+	// NonConfirmable messages are not acknowledged.
+	NonConfirmable
+
+	// Acknowledgement messages acknowledge confirmable messages and may carry
+	// the response.
+	Acknowledgement
+
+	// Reset messages reject messages that could not be processed.
+	Reset
+)
+
+// A Code is the method of a request or the status of a response.
+type Code uint8
+
+// The supported request and response codes.
+const (
+	Empty               Code = 0
+	GET                 Code = 1
+	POST                Code = 2
+	PUT                 Code = 3
+	DELETE              Code = 4
+	Deleted             Code = 2<<5 | 2
+	Changed             Code = 2<<5 | 4
+	Content             Code = 2<<5 | 5
+	BadRequest          Code = 4<<5 | 0
+	Forbidden           Code = 4<<5 | 3
+	NotFound            Code = 4<<5 | 4
+	MethodNotAllowed    Code = 4<<5 | 5
+	InternalServerError Code = 5<<5 | 0
+	ServiceUnavailable  Code = 5<<5 | 3
+)
+
+// String returns the code in the dotted form, e.g. "2.05".
+func (c Code) String() string {
+	return fmt.Sprintf("%d.%02d", c>>5, c&0x1f)
+}
+
+// The supported option numbers.
+const (
+	ObserveOption       uint16 = 6
+	URIPathOption       uint16 = 11
+	ContentFormatOption uint16 = 12
+	URIQueryOption      uint16 = 15
+)
+
+// An Option is a single option of a message.
+type Option struct {
+	Number uint16
+	Value  []byte
+}
+
+// A Message is a CoAP message as described in RFC 7252.
+type Message struct {
+	Type      Type
+	Code      Code
+	MessageID uint16
+	Token     []byte
+	Options   []Option
+	Payload   []byte
+}
+
+// Option returns the value of the first option with the number.
+func (m *Message) Option(number uint16) ([]byte, bool) {
+	for _, option := range m.Options {
+		if option.Number == number {
+			return option.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// Path returns the joined Uri-Path options, e.g. "sensors/temperature".
+func (m *Message) Path() string {
+	var segments []string
+	for _, option := range m.Options {
+		if option.Number == URIPathOption {
+			segments = append(segments, string(option.Value))
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// Query returns the value of the Uri-Query option with the key, e.g. "1" for
+// the option "qos=1".
+func (m *Message) Query(key string) (string, bool) {
+	for _, option := range m.Options {
+		if option.Number == URIQueryOption {
+			pair := strings.SplitN(string(option.Value), "=", 2)
+			if pair[0] == key && len(pair) == 2 {
+				return pair[1], true
+			} else if pair[0] == key {
+				return "", true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// SetPath will replace the Uri-Path options with the segments of the path.
+func (m *Message) SetPath(path string) {
+	var options []Option
+	for _, option := range m.Options {
+		if option.Number != URIPathOption {
+			options = append(options, option)
+		}
+	}
+
+	for _, segment := range strings.Split(path, "/") {
+		options = append(options, Option{Number: URIPathOption, Value: []byte(segment)})
+	}
+
+	m.Options = options
+}
+
+// Encode will return the binary form of the message. The options are sorted
+// by their number.
+func (m *Message) Encode() ([]byte, error) {
+	if len(m.Token) > 8 {
+		return nil, fmt.Errorf("token too long")
+	}
+
+	buf := make([]byte, 4, 4+len(m.Token)+len(m.Payload)+16)
+	buf[0] = 1<<6 | byte(m.Type)<<4 | byte(len(m.Token))
+	buf[1] = byte(m.Code)
+	binary.BigEndian.PutUint16(buf[2:], m.MessageID)
+	buf = append(buf, m.Token...)
+
+	options := append([]Option{}, m.Options...)
+	sort.SliceStable(options, func(i, j int) bool {
+		return options[i].Number < options[j].Number
+	})
+
+	last := uint16(0)
+	for _, option := range options {
+		delta, deltaExt := optionNibble(int(option.Number - last))
+		length, lengthExt := optionNibble(len(option.Value))
+
+		buf = append(buf, delta<<4|length)
+		buf = append(buf, deltaExt...)
+		buf = append(buf, lengthExt...)
+		buf = append(buf, option.Value...)
+
+		last = option.Number
+	}
+
+	if len(m.Payload) > 0 {
+		buf = append(buf, 0xff)
+		buf = append(buf, m.Payload...)
+	}
+
+	return buf, nil
+}
+
+// Decode will parse the binary form of a message.
+func Decode(data []byte) (*Message, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("message too short")
+	} else if data[0]>>6 != 1 {
+		return nil, fmt.Errorf("unsupported version %d", data[0]>>6)
+	}
+
+	tokenLength := int(data[0] & 0x0f)
+	if tokenLength > 8 || len(data) < 4+tokenLength {
+		return nil, fmt.Errorf("invalid token length")
+	}
+
+	m := &Message{
+		Type:      Type(data[0] >> 4 & 0x03),
+		Code:      Code(data[1]),
+		MessageID: binary.BigEndian.Uint16(data[2:]),
+		Token:     append([]byte{}, data[4:4+tokenLength]...),
+	}
+
+	data = data[4+tokenLength:]
+	number := 0
+
+	for len(data) > 0 {
+		// check payload marker
+		if data[0] == 0xff {
+			if len(data) == 1 {
+				return nil, fmt.Errorf("empty payload")
+			}
+
+			m.Payload = append([]byte{}, data[1:]...)
+			break
+		}
+
+		header := data[0]
+		data = data[1:]
+
+		delta, rest, err := optionValue(header>>4, data)
+		if err != nil {
+			return nil, err
+		}
+
+		length, rest, err := optionValue(header&0x0f, rest)
+		if err != nil {
+			return nil, err
+		} else if len(rest) < length {
+			return nil, fmt.Errorf("option too long")
+		}
+
+		number += delta
+		if number > 0xffff {
+			return nil, fmt.Errorf("invalid option number")
+		}
+
+		m.Options = append(m.Options, Option{
+			Number: uint16(number),
+			Value:  append([]byte{}, rest[:length]...),
+		})
+
+		data = rest[length:]
+	}
+
+	return m, nil
+}
+
+// returns the nibble and the extended bytes of an option delta or length
+func optionNibble(value int) (byte, []byte) {
+	switch {
+	case value < 13:
+		return byte(value), nil
+	case value < 269:
+		return 13, []byte{byte(value - 13)}
+	default:
+		ext := make([]byte, 2)
+		binary.BigEndian.PutUint16(ext, uint16(value-269))
+		return 14, ext
+	}
+}
+
+// reads an option delta or length using the nibble and the extended bytes
+func optionValue(nibble byte, data []byte) (int, []byte, error) {
+	switch nibble {
+	case 13:
+		if len(data) < 1 {
+			return 0, nil, fmt.Errorf("truncated option")
+		}
+
+		return int(data[0]) + 13, data[1:], nil
+	case 14:
+		if len(data) < 2 {
+			return 0, nil, fmt.Errorf("truncated option")
+		}
+
+		return int(binary.BigEndian.Uint16(data)) + 269, data[2:], nil
+	case 15:
+		return 0, nil, fmt.Errorf("reserved option nibble")
+	}
+
+	return int(nibble), data, nil
+}
+
+// encodes an unsigned option value without leading zeros
+func encodeUint(value uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, value)
+
+	for len(buf) > 0 && buf[0] == 0 {
+		buf = buf[1:]
+	}
+
+	return buf
+}
+
+// decodes an unsigned option value
+func decodeUint(value []byte) uint32 {
+	var n uint32
+	for _, b := range value {
+		n = n<<8 | uint32(b)
+	}
+
+	return n
+}
@@ -0,0 +1,386 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/transport"
+)
+
+// A CompatibilityCheck exercises a known client behavior against a broker.
+type CompatibilityCheck struct {
+	// The name of the check, e.g. "empty_client_id".
+	Name string
+
+	// The function that runs the check against the broker at the url and
+	// returns an error describing the failure.
+	Run func(url string, timeout time.Duration) error
+}
+
+// A CompatibilityResult is the outcome of a CompatibilityCheck.
+type CompatibilityResult struct {
+	Name     string
+	Error    error
+	Duration time.Duration
+}
+
+// Passed returns whether the check has passed.
+func (r CompatibilityResult) Passed() bool {
+	return r.Error == nil
+}
+
+// CompatibilityChecks returns the matrix of known client behaviors that are
+// checked by CheckCompatibility:
+//
+//	empty_client_id             a clean session with an empty client id is accepted
+//	empty_client_id_persistent  a persistent session with an empty client id is refused
+//	qos2_duplicate_publish      a retransmitted QOS 2 publish is delivered once
+//	qos2_unknown_pubrel         a PUBREL for an unknown packet id is completed
+//	large_keep_alive            the maximum keep alive is accepted
+//	rapid_reconnect             rapid reconnects take over the previous connection
+func CompatibilityChecks() []CompatibilityCheck {
+	return []CompatibilityCheck{
+		{Name: "empty_client_id", Run: checkEmptyClientID},
+		{Name: "empty_client_id_persistent", Run: checkPersistentEmptyClientID},
+		{Name: "qos2_duplicate_publish", Run: checkQOS2DuplicatePublish},
+		{Name: "qos2_unknown_pubrel", Run: checkQOS2UnknownPubrel},
+		{Name: "large_keep_alive", Run: checkLargeKeepAlive},
+		{Name: "rapid_reconnect", Run: checkRapidReconnect},
+	}
+}
+
+// CheckCompatibility will run the specified checks or all CompatibilityChecks
+// against the running broker at the url, e.g. "tcp://localhost:1883", and
+// return their results. Every expected packet must be received within the
+// timeout. As the checks only use the public protocol, they may be run
+// against any broker, e.g. before rolling out firmware with a new client
+// library. The checks use client ids that begin with "gomqtt-compat-".
+func CheckCompatibility(url string, timeout time.Duration, checks ...CompatibilityCheck) []CompatibilityResult {
+	if len(checks) == 0 {
+		checks = CompatibilityChecks()
+	}
+
+	results := make([]CompatibilityResult, 0, len(checks))
+
+	for _, check := range checks {
+		start := time.Now()
+		err := check.Run(url, timeout)
+
+		results = append(results, CompatibilityResult{
+			Name:     check.Name,
+			Error:    err,
+			Duration: time.Since(start),
+		})
+	}
+
+	return results
+}
+
+// a connection used by the compatibility checks
+type compatConn struct {
+	conn    transport.Conn
+	timeout time.Duration
+}
+
+// dials a connection to the broker
+func dialCompat(url string, timeout time.Duration) (*compatConn, error) {
+	conn, err := transport.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compatConn{conn: conn, timeout: timeout}, nil
+}
+
+// sends a packet
+func (c *compatConn) send(pkt packet.Packet) error {
+	err := c.conn.Send(pkt)
+	if err != nil {
+		return fmt.Errorf("failed to send %s: %v", pkt.Type(), err)
+	}
+
+	return nil
+}
+
+// receives the next packet and checks its type
+func (c *compatConn) expect(t packet.Type) (packet.Packet, error) {
+	c.conn.SetReadTimeout(c.timeout)
+
+	pkt, err := c.conn.Receive()
+	if err != nil {
+		return nil, fmt.Errorf("expected %s: %v", t, err)
+	} else if pkt.Type() != t {
+		return nil, fmt.Errorf("expected %s, received %s", t, pkt.Type())
+	}
+
+	return pkt, nil
+}
+
+// sends a ConnectPacket and returns the ConnackPacket
+func (c *compatConn) connect(clientID string, clean bool, keepAlive uint16) (*packet.ConnackPacket, error) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = clientID
+	connect.CleanSession = clean
+	connect.KeepAlive = keepAlive
+
+	err := c.send(connect)
+	if err != nil {
+		return nil, err
+	}
+
+	pkt, err := c.expect(packet.CONNACK)
+	if err != nil {
+		return nil, err
+	}
+
+	return pkt.(*packet.ConnackPacket), nil
+}
+
+// sends a ConnectPacket and checks that the connection is accepted
+func (c *compatConn) accept(clientID string, clean bool, keepAlive uint16) error {
+	connack, err := c.connect(clientID, clean, keepAlive)
+	if err != nil {
+		return err
+	} else if connack.ReturnCode != packet.ConnectionAccepted {
+		return fmt.Errorf("connection refused with return code %d", byte(connack.ReturnCode))
+	}
+
+	return nil
+}
+
+// sends a PingreqPacket and expects the PingrespPacket as the next packet
+func (c *compatConn) ping() error {
+	err := c.send(packet.NewPingreqPacket())
+	if err != nil {
+		return err
+	}
+
+	_, err = c.expect(packet.PINGRESP)
+	return err
+}
+
+// disconnects and closes the connection
+func (c *compatConn) close() error {
+	err := c.send(packet.NewDisconnectPacket())
+	_err := c.conn.Close()
+	if err == nil {
+		err = _err
+	}
+
+	return err
+}
+
+// returns a qos 2 PublishPacket
+func compatPublish(topic string, id uint16, dup bool) *packet.PublishPacket {
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = topic
+	publish.Message.Payload = []byte("compat")
+	publish.Message.QOS = 2
+	publish.PacketID = id
+	publish.Dup = dup
+
+	return publish
+}
+
+func checkEmptyClientID(url string, timeout time.Duration) error {
+	conn, err := dialCompat(url, timeout)
+	if err != nil {
+		return err
+	}
+
+	err = conn.accept("", true, 30)
+	if err != nil {
+		conn.conn.Close()
+		return err
+	}
+
+	return conn.close()
+}
+
+func checkPersistentEmptyClientID(url string, timeout time.Duration) error {
+	conn, err := dialCompat(url, timeout)
+	if err != nil {
+		return err
+	}
+
+	defer conn.conn.Close()
+
+	// brokers may refuse or close the connection
+	connack, err := conn.connect("", false, 30)
+	if err != nil {
+		return nil
+	} else if connack.ReturnCode != packet.ErrIdentifierRejected {
+		return fmt.Errorf("expected identifier rejected, received return code %d", byte(connack.ReturnCode))
+	}
+
+	return nil
+}
+
+func checkQOS2DuplicatePublish(url string, timeout time.Duration) error {
+	topic := "gomqtt-compat/qos2"
+
+	conn, err := dialCompat(url, timeout)
+	if err != nil {
+		return err
+	}
+
+	defer conn.conn.Close()
+
+	err = conn.accept("gomqtt-compat-qos2", true, 30)
+	if err != nil {
+		return err
+	}
+
+	// subscribe with qos 0 to receive plain deliveries
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: topic}}
+	subscribe.PacketID = 1
+
+	err = conn.send(subscribe)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.expect(packet.SUBACK)
+	if err != nil {
+		return err
+	}
+
+	// publish and retransmit
+	for _, dup := range []bool{false, true} {
+		err = conn.send(compatPublish(topic, 2, dup))
+		if err != nil {
+			return err
+		}
+
+		_, err = conn.expect(packet.PUBREC)
+		if err != nil {
+			return err
+		}
+	}
+
+	pubrel := packet.NewPubrelPacket()
+	pubrel.PacketID = 2
+
+	err = conn.send(pubrel)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.expect(packet.PUBCOMP)
+	if err != nil {
+		return err
+	}
+
+	// expect exactly one delivery
+	_, err = conn.expect(packet.PUBLISH)
+	if err != nil {
+		return err
+	}
+
+	err = conn.ping()
+	if err != nil {
+		return fmt.Errorf("duplicate delivery: %v", err)
+	}
+
+	return conn.close()
+}
+
+func checkQOS2UnknownPubrel(url string, timeout time.Duration) error {
+	conn, err := dialCompat(url, timeout)
+	if err != nil {
+		return err
+	}
+
+	defer conn.conn.Close()
+
+	err = conn.accept("gomqtt-compat-pubrel", true, 30)
+	if err != nil {
+		return err
+	}
+
+	pubrel := packet.NewPubrelPacket()
+	pubrel.PacketID = 42
+
+	err = conn.send(pubrel)
+	if err != nil {
+		return err
+	}
+
+	pkt, err := conn.expect(packet.PUBCOMP)
+	if err != nil {
+		return err
+	} else if id := pkt.(*packet.PubcompPacket).PacketID; id != 42 {
+		return fmt.Errorf("expected packet id 42, received %d", id)
+	}
+
+	return conn.close()
+}
+
+func checkLargeKeepAlive(url string, timeout time.Duration) error {
+	conn, err := dialCompat(url, timeout)
+	if err != nil {
+		return err
+	}
+
+	defer conn.conn.Close()
+
+	err = conn.accept("gomqtt-compat-keep-alive", true, 65535)
+	if err != nil {
+		return err
+	}
+
+	err = conn.ping()
+	if err != nil {
+		return err
+	}
+
+	return conn.close()
+}
+
+func checkRapidReconnect(url string, timeout time.Duration) error {
+	var previous *compatConn
+
+	for i := 0; i < 5; i++ {
+		conn, err := dialCompat(url, timeout)
+		if err != nil {
+			return err
+		}
+
+		err = conn.accept("gomqtt-compat-reconnect", true, 30)
+		if err != nil {
+			conn.conn.Close()
+			return fmt.Errorf("reconnect %d: %v", i, err)
+		}
+
+		// the previous connection must have been closed
+		if previous != nil {
+			previous.conn.SetReadTimeout(timeout)
+			_, err = previous.conn.Receive()
+			previous.conn.Close()
+			if err == nil {
+				conn.conn.Close()
+				return fmt.Errorf("reconnect %d: previous connection not closed", i)
+			}
+		}
+
+		previous = conn
+	}
+
+	return previous.close()
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/tools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckCompatibility(t *testing.T) {
+	port := tools.NewPort()
+
+	broker := New()
+
+	err := broker.Listen(&Listener{URL: port.URL()})
+	assert.NoError(t, err)
+
+	results := CheckCompatibility(port.URL(), time.Second)
+	assert.Len(t, results, len(CompatibilityChecks()))
+
+	for _, result := range results {
+		assert.True(t, result.Passed(), "%s: %v", result.Name, result.Error)
+	}
+
+	// failed checks are reported
+	results = CheckCompatibility(port.URL(), time.Second, CompatibilityCheck{
+		Name: "failing",
+		Run: func(string, time.Duration) error {
+			return fmt.Errorf("failed")
+		},
+	})
+	assert.Equal(t, "failing", results[0].Name)
+	assert.False(t, results[0].Passed())
+
+	err = broker.Close(time.Second)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import "fmt"
+
+// A Checker is a Backend that is able to verify the consistency of its
+// internal state.
+type Checker interface {
+	// Check should cross-check the stored state for dangling references and
+	// return a description of every found inconsistency. If repair is set to
+	// true, the found inconsistencies should be repaired as well.
+	Check(repair bool) ([]string, error)
+}
+
+// Check will run the consistency check of the backend if it implements the
+// Checker interface. If repair is set to true, found inconsistencies are
+// repaired as well.
+func (b *Broker) Check(repair bool) ([]string, error) {
+	checker, ok := b.Backend.(Checker)
+	if !ok {
+		return nil, nil
+	}
+
+	return checker.Check(repair)
+}
+
+// Check will cross-check the subscriptions, sessions and offline queues and
+// report clients that are still subscribed although their stored session
+// belongs to another client, offline subscriptions of sessions that have been
+// removed or are online, and sessions that reference a client which uses a
+// different session.
+func (m *MemoryBackend) Check(repair bool) ([]string, error) {
+	m.sessionsMutex.Lock()
+	defer m.sessionsMutex.Unlock()
+
+	m.offlineMutex.Lock()
+	defer m.offlineMutex.Unlock()
+
+	var problems []string
+
+	// collect stored sessions
+	stored := make(map[*MemorySession]string)
+	for id, sess := range m.sessions {
+		stored[sess] = id
+	}
+
+	// check subscribed clients
+	for _, value := range m.queue.All() {
+		client, ok := value.(Client)
+		if !ok {
+			continue
+		}
+
+		sess, ok := client.Context().Get("session").(*MemorySession)
+		if !ok {
+			continue
+		}
+
+		if id, ok := stored[sess]; ok && sess.currentClient != client {
+			problems = append(problems, fmt.Sprintf("client %s is subscribed but session %q belongs to another client", client.Context().Get("uuid"), id))
+
+			if repair {
+				m.queue.Clear(client)
+				m.unroute(client, "")
+			}
+		}
+	}
+
+	// check offline sessions
+	for _, value := range m.offlineQueue.All() {
+		sess, ok := value.(*MemorySession)
+		if !ok {
+			continue
+		}
+
+		id, ok := stored[sess]
+		if !ok {
+			problems = append(problems, "offline queue references a removed session")
+		} else if sess.currentClient != nil {
+			problems = append(problems, fmt.Sprintf("offline queue references the online session %q", id))
+		} else {
+			continue
+		}
+
+		if repair {
+			m.offlineQueue.Clear(sess)
+		}
+	}
+
+	// check session clients
+	for id, sess := range m.sessions {
+		if sess.currentClient == nil {
+			continue
+		}
+
+		if current, ok := sess.currentClient.Context().Get("session").(*MemorySession); ok && current != sess {
+			problems = append(problems, fmt.Sprintf("session %q references a client that uses another session", id))
+
+			if repair {
+				sess.currentClient = nil
+			}
+		}
+	}
+
+	return problems, nil
+}
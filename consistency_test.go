@@ -0,0 +1,56 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryBackendCheck(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	client1 := newFakeClient()
+	client2 := newFakeClient()
+
+	// consistent state
+	sess, _, err := backend.Setup(client1, "foo", false)
+	assert.NoError(t, err)
+
+	err = sess.SaveSubscription(&packet.Subscription{Topic: "foo", QOS: 1})
+	assert.NoError(t, err)
+
+	_, err = backend.Subscribe(client1, "foo")
+	assert.NoError(t, err)
+
+	problems, err := backend.Check(false)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	// dangling subscription and offline queue entry
+	client2.Context().Set("session", sess)
+	backend.queue.Add("bar", client2)
+	backend.offlineQueue.Add("foo", sess)
+
+	problems, err = backend.Check(true)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(problems))
+
+	problems, err = backend.Check(false)
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+}
@@ -0,0 +1,299 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The environment variables read by Container.LoadEnv.
+const (
+	// EnvURLs is a comma separated list of listener urls, e.g.
+	// "tcp://0.0.0.0:1883,ws://0.0.0.0:8080". It takes precedence over
+	// EnvHost and EnvPort.
+	EnvURLs = "GOMQTT_URLS"
+
+	// EnvHost and EnvPort select the address of a single tcp listener and
+	// default to "0.0.0.0" and "1883".
+	EnvHost = "GOMQTT_HOST"
+	EnvPort = "GOMQTT_PORT"
+
+	// EnvDrainTimeout and EnvReadyTimeout are parsed using time.ParseDuration.
+	EnvDrainTimeout = "GOMQTT_DRAIN_TIMEOUT"
+	EnvReadyTimeout = "GOMQTT_READY_TIMEOUT"
+
+	// EnvHealthAddr is the address of the health server, e.g. ":8081".
+	EnvHealthAddr = "GOMQTT_HEALTH_ADDR"
+)
+
+// A Container runs a broker as the main process of a container. It starts the
+// broker, waits until the broker is ready before the listeners are launched
+// and closes the broker gracefully when the process receives one of the
+// Signals. The standalone binary uses the same Container, so embedders get
+// the same behavior.
+type Container struct {
+	// The URLs of the launched listeners, defaults to "tcp://0.0.0.0:1883".
+	URLs []string
+
+	// The DrainTimeout is passed to Broker.Close when the container is
+	// terminated. Defaults to ten seconds.
+	DrainTimeout time.Duration
+
+	// The ReadyTimeout is the maximum time to wait for the broker to become
+	// ready (see Broker.Ready) before the listeners are launched. Defaults to
+	// 30 seconds.
+	ReadyTimeout time.Duration
+
+	// If HealthAddr is set, a health server is started that responds to
+	// "/live" once the container runs and to "/ready" while the listeners
+	// are launched and the broker is ready, which may be used by liveness and
+	// readiness probes.
+	HealthAddr string
+
+	// The Signals that terminate the container, defaults to SIGINT and
+	// SIGTERM.
+	Signals []os.Signal
+
+	broker    *Broker
+	launched  bool
+	health    *http.Server
+	listener  net.Listener
+	terminate chan struct{}
+	once      sync.Once
+	mutex     sync.Mutex
+}
+
+// NewContainer returns a new Container that runs the specified broker.
+func NewContainer(broker *Broker) *Container {
+	return &Container{
+		URLs:         []string{"tcp://0.0.0.0:1883"},
+		DrainTimeout: 10 * time.Second,
+		ReadyTimeout: 30 * time.Second,
+		Signals:      []os.Signal{os.Interrupt, syscall.SIGTERM},
+		broker:       broker,
+		terminate:    make(chan struct{}),
+	}
+}
+
+// LoadEnv will override the configuration with the environment variables
+// that are set (see EnvURLs and the other variables).
+func (c *Container) LoadEnv() error {
+	// get urls
+	if urls := os.Getenv(EnvURLs); urls != "" {
+		c.URLs = nil
+		for _, url := range strings.Split(urls, ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				c.URLs = append(c.URLs, url)
+			}
+		}
+	} else if host, port := os.Getenv(EnvHost), os.Getenv(EnvPort); host != "" || port != "" {
+		if host == "" {
+			host = "0.0.0.0"
+		}
+
+		if port == "" {
+			port = "1883"
+		}
+
+		c.URLs = []string{"tcp://" + net.JoinHostPort(host, port)}
+	}
+
+	// get timeouts
+	for name, timeout := range map[string]*time.Duration{
+		EnvDrainTimeout: &c.DrainTimeout,
+		EnvReadyTimeout: &c.ReadyTimeout,
+	} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+
+		*timeout = duration
+	}
+
+	if addr := os.Getenv(EnvHealthAddr); addr != "" {
+		c.HealthAddr = addr
+	}
+
+	return nil
+}
+
+// Run will start the broker, wait until it is ready, launch the listeners and
+// block until the container is terminated by a signal or Terminate. The
+// broker is then closed using the DrainTimeout. A termination while waiting
+// for the broker to become ready closes the broker immediately.
+func (c *Container) Run() error {
+	// catch signals early to not miss a termination during the startup
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, c.Signals...)
+	defer signal.Stop(signals)
+
+	// start health server
+	err := c.startHealth()
+	if err != nil {
+		return err
+	}
+
+	defer c.stopHealth()
+
+	// start broker
+	err = c.broker.Start()
+	if err != nil {
+		return err
+	}
+
+	// wait until ready
+	deadline := time.Now().Add(c.ReadyTimeout)
+	for {
+		err = c.broker.Ready()
+		if err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			c.broker.Close(0)
+			return fmt.Errorf("broker not ready: %v", err)
+		}
+
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-signals:
+			return c.broker.Close(0)
+		case <-c.terminate:
+			return c.broker.Close(0)
+		}
+	}
+
+	// launch listeners
+	err = c.broker.Launch(c.URLs...)
+	if err != nil {
+		c.broker.Close(0)
+		return err
+	}
+
+	c.mutex.Lock()
+	c.launched = true
+	c.mutex.Unlock()
+
+	c.broker.log(LogInfo, "container_started", map[string]interface{}{
+		"urls": c.URLs,
+	})
+
+	// wait for termination
+	select {
+	case sig := <-signals:
+		c.broker.log(LogInfo, "container_terminating", map[string]interface{}{
+			"signal": sig.String(),
+		})
+	case <-c.terminate:
+		c.broker.log(LogInfo, "container_terminating", nil)
+	}
+
+	c.mutex.Lock()
+	c.launched = false
+	c.mutex.Unlock()
+
+	return c.broker.Close(c.DrainTimeout)
+}
+
+// Terminate will terminate a running container like a signal.
+func (c *Container) Terminate() {
+	c.once.Do(func() {
+		close(c.terminate)
+	})
+}
+
+// Ready returns an error if the listeners have not been launched or the
+// broker is not ready.
+func (c *Container) Ready() error {
+	c.mutex.Lock()
+	launched := c.launched
+	c.mutex.Unlock()
+
+	if !launched {
+		return fmt.Errorf("listeners not launched")
+	}
+
+	return c.broker.Ready()
+}
+
+// HealthListener returns the listener of the health server while the
+// container runs.
+func (c *Container) HealthListener() net.Listener {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.listener
+}
+
+// starts the health server if configured
+func (c *Container) startHealth() error {
+	if c.HealthAddr == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", c.HealthAddr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		err := c.Ready()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	c.mutex.Lock()
+	c.health = &http.Server{Handler: mux}
+	c.listener = listener
+	server := c.health
+	c.mutex.Unlock()
+
+	go server.Serve(listener)
+
+	return nil
+}
+
+// stops the health server if started
+func (c *Container) stopHealth() {
+	c.mutex.Lock()
+	server := c.health
+	c.health = nil
+	c.listener = nil
+	c.mutex.Unlock()
+
+	if server != nil {
+		server.Close()
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContainerLoadEnv(t *testing.T) {
+	defer os.Unsetenv(EnvURLs)
+	defer os.Unsetenv(EnvPort)
+	defer os.Unsetenv(EnvDrainTimeout)
+	defer os.Unsetenv(EnvHealthAddr)
+
+	container := NewContainer(New())
+	assert.NoError(t, container.LoadEnv())
+	assert.Equal(t, []string{"tcp://0.0.0.0:1883"}, container.URLs)
+
+	os.Setenv(EnvPort, "1884")
+	os.Setenv(EnvDrainTimeout, "30s")
+	os.Setenv(EnvHealthAddr, ":8081")
+	assert.NoError(t, container.LoadEnv())
+	assert.Equal(t, []string{"tcp://0.0.0.0:1884"}, container.URLs)
+	assert.Equal(t, 30*time.Second, container.DrainTimeout)
+	assert.Equal(t, 30*time.Second, container.ReadyTimeout)
+	assert.Equal(t, ":8081", container.HealthAddr)
+
+	os.Setenv(EnvURLs, "tcp://localhost:1883, ws://localhost:8080")
+	assert.NoError(t, container.LoadEnv())
+	assert.Equal(t, []string{"tcp://localhost:1883", "ws://localhost:8080"}, container.URLs)
+
+	os.Setenv(EnvDrainTimeout, "foo")
+	assert.Error(t, container.LoadEnv())
+}
+
+func TestContainer(t *testing.T) {
+	port := tools.NewPort()
+
+	broker := New()
+
+	container := NewContainer(broker)
+	container.URLs = []string{port.URL()}
+	container.HealthAddr = "localhost:0"
+
+	result := make(chan error, 1)
+	go func() {
+		result <- container.Run()
+	}()
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return container.Ready() == nil
+	})
+	assert.NoError(t, container.Ready())
+
+	// check probes
+	for _, path := range []string{"/live", "/ready"} {
+		res, err := http.Get("http://" + container.HealthListener().Addr().String() + path)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		res.Body.Close()
+	}
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(packet.NewConnackPacket()).
+		Test(t, conn)
+
+	// clients are disconnected gracefully
+	container.Terminate()
+
+	tools.NewFlow().
+		Receive(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	assert.NoError(t, <-result)
+	assert.Error(t, container.Ready())
+	assert.Nil(t, container.HealthListener())
+}
+
+func TestContainerReadyTimeout(t *testing.T) {
+	broker := New()
+	assert.NoError(t, broker.Drain())
+
+	container := NewContainer(broker)
+	container.URLs = []string{tools.NewPort().URL()}
+	container.ReadyTimeout = 50 * time.Millisecond
+
+	err := container.Run()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "broker draining")
+}
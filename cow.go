@@ -0,0 +1,119 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sync"
+
+	"github.com/gomqtt/packet"
+)
+
+// A MessageCopy is a copy-on-write view of a shared message that allows
+// adjusting a message for a single subscriber, e.g. downgrading its QOS,
+// without mutating the message that is delivered to other subscribers. The
+// shared message is returned until a setter changes a field, which copies the
+// message once using a pool. A MessageCopy is not safe for concurrent use,
+// but any number of them may share the same message.
+type MessageCopy struct {
+	shared *packet.Message
+	copied *packet.Message
+}
+
+var copyPool = sync.Pool{
+	New: func() interface{} {
+		return &MessageCopy{}
+	},
+}
+
+var messagePool = sync.Pool{
+	New: func() interface{} {
+		return &packet.Message{}
+	},
+}
+
+// CopyMessage returns a pooled MessageCopy of the shared message that must be
+// released once it is no longer needed.
+func CopyMessage(msg *packet.Message) *MessageCopy {
+	c := copyPool.Get().(*MessageCopy)
+	c.shared = msg
+
+	return c
+}
+
+// Message returns the shared message or the private copy if a field has been
+// changed. The returned message must not be modified.
+func (c *MessageCopy) Message() *packet.Message {
+	if c.copied != nil {
+		return c.copied
+	}
+
+	return c.shared
+}
+
+// Copied returns whether a private copy has been made.
+func (c *MessageCopy) Copied() bool {
+	return c.copied != nil
+}
+
+// SetTopic will change the topic of the message.
+func (c *MessageCopy) SetTopic(topic string) {
+	if c.Message().Topic != topic {
+		c.write().Topic = topic
+	}
+}
+
+// SetQOS will change the QOS level of the message.
+func (c *MessageCopy) SetQOS(qos byte) {
+	if c.Message().QOS != qos {
+		c.write().QOS = qos
+	}
+}
+
+// Downgrade will lower the QOS level of the message to the specified maximum.
+func (c *MessageCopy) Downgrade(max byte) {
+	if c.Message().QOS > max {
+		c.write().QOS = max
+	}
+}
+
+// SetRetain will change the retain flag of the message.
+func (c *MessageCopy) SetRetain(retain bool) {
+	if c.Message().Retain != retain {
+		c.write().Retain = retain
+	}
+}
+
+// Release will return the copy to the pool. The message returned by Message
+// must not be used afterwards.
+func (c *MessageCopy) Release() {
+	if c.copied != nil {
+		*c.copied = packet.Message{}
+		messagePool.Put(c.copied)
+	}
+
+	c.shared = nil
+	c.copied = nil
+	copyPool.Put(c)
+}
+
+// returns the private copy and copies the shared message if necessary
+func (c *MessageCopy) write() *packet.Message {
+	if c.copied == nil {
+		c.copied = messagePool.Get().(*packet.Message)
+		*c.copied = *c.shared
+	}
+
+	return c.copied
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageCopy(t *testing.T) {
+	shared := &packet.Message{Topic: "foo", Payload: []byte("foo"), QOS: 1, Retain: true}
+
+	view := CopyMessage(shared)
+	view.Downgrade(2)
+	view.SetRetain(true)
+	assert.False(t, view.Copied())
+	assert.True(t, view.Message() == shared)
+
+	view.Downgrade(0)
+	view.SetRetain(false)
+	view.SetTopic("bar")
+	assert.True(t, view.Copied())
+	assert.Equal(t, &packet.Message{Topic: "bar", Payload: []byte("foo")}, view.Message())
+	assert.Equal(t, &packet.Message{Topic: "foo", Payload: []byte("foo"), QOS: 1, Retain: true}, shared)
+
+	view.Release()
+}
+
+func TestMessageCopyRace(t *testing.T) {
+	shared := &packet.Message{Topic: "foo", Payload: []byte("foo"), QOS: 2, Retain: true}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		qos := byte(i % 3)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 1000; j++ {
+				view := CopyMessage(shared)
+				view.Downgrade(qos)
+				view.SetRetain(false)
+				assert.Equal(t, qos, view.Message().QOS)
+				view.Release()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, &packet.Message{Topic: "foo", Payload: []byte("foo"), QOS: 2, Retain: true}, shared)
+}
+
+func TestQOSDowngrade(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	subscribe0 := packet.NewSubscribePacket()
+	subscribe0.Subscriptions = []packet.Subscription{{Topic: "test"}}
+	subscribe0.PacketID = 1
+
+	suback0 := packet.NewSubackPacket()
+	suback0.ReturnCodes = []uint8{0}
+	suback0.PacketID = 1
+
+	subscribe1 := packet.NewSubscribePacket()
+	subscribe1.Subscriptions = []packet.Subscription{{Topic: "test", QOS: 1}}
+	subscribe1.PacketID = 1
+
+	suback1 := packet.NewSubackPacket()
+	suback1.ReturnCodes = []uint8{1}
+	suback1.PacketID = 1
+
+	publish0 := packet.NewPublishPacket()
+	publish0.Message = packet.Message{Topic: "test", Payload: []byte("test")}
+
+	publish1 := packet.NewPublishPacket()
+	publish1.Message = packet.Message{Topic: "test", Payload: []byte("test"), QOS: 1}
+	publish1.PacketID = 1
+
+	broker := New()
+
+	port, done := runBroker(t, broker, 2)
+
+	conn0, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe0).
+		Receive(suback0).
+		Test(t, conn0)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe1).
+		Receive(suback1).
+		Test(t, conn1)
+
+	shared := &packet.Message{Topic: "test", Payload: []byte("test"), QOS: 1}
+
+	err = broker.Backend.Publish(NewLocalClient(func(*packet.Message) {}), shared)
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Receive(publish0).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn0)
+
+	tools.NewFlow().
+		Receive(publish1).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn1)
+
+	<-done
+
+	assert.Equal(t, byte(1), shared.QOS)
+}
@@ -0,0 +1,307 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gomqtt/packet"
+)
+
+// ClientData describes everything stored about a client id. It is returned by
+// ExportClient to fulfill data-protection requests.
+type ClientData struct {
+	ClientID string `json:"client_id"`
+
+	// The subscriptions stored in the session of the client.
+	Subscriptions []SubscriptionRecord `json:"subscriptions"`
+
+	// The messages that are queued for the offline session or awaiting an
+	// acknowledgement. The payloads are not included.
+	QueuedMessages []MessageRecord `json:"queued_messages"`
+
+	// The retained messages that have been set by the client.
+	RetainedMessages []MessageRecord `json:"retained_messages"`
+
+	// The identity of the certificate bound to the client id, if any.
+	CertificateIdentity string `json:"certificate_identity,omitempty"`
+
+	// The recent connections of the client (see ConnectionHistory).
+	Connections []ConnectionRecord `json:"connections"`
+}
+
+// A SubscriptionRecord describes a stored subscription.
+type SubscriptionRecord struct {
+	Topic string `json:"topic"`
+	QOS   byte   `json:"qos"`
+}
+
+// A MessageRecord describes a stored message.
+type MessageRecord struct {
+	Topic   string `json:"topic"`
+	QOS     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+	Size    int    `json:"size"`
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// A ConnectionRecord describes a connection of a client.
+type ConnectionRecord struct {
+	UUID         string    `json:"uuid"`
+	RemoteIP     string    `json:"remote_ip"`
+	Connected    time.Time `json:"connected"`
+	Disconnected time.Time `json:"disconnected"`
+}
+
+// A DataController is a Backend that is able to export and erase the data it
+// stores about a client id.
+type DataController interface {
+	// ExportClient should return the stored subscriptions, queued messages and
+	// retained messages of the client id.
+	ExportClient(clientID string) (*ClientData, error)
+
+	// EraseClient should remove the session of the client id and the retained
+	// messages it has set.
+	EraseClient(clientID string) error
+}
+
+// ExportClient will return everything the broker and its backend store about
+// the client id. Only the backend data is included if the backend does not
+// implement the DataController interface.
+func (b *Broker) ExportClient(clientID string) (*ClientData, error) {
+	data := &ClientData{ClientID: clientID}
+
+	// get backend data
+	if controller, ok := b.Backend.(DataController); ok {
+		exported, err := controller.ExportClient(clientID)
+		if err != nil {
+			return nil, err
+		}
+
+		data = exported
+		data.ClientID = clientID
+	}
+
+	data.CertificateIdentity = b.identities.lookup(clientID)
+	data.Connections = b.connections.list(clientID)
+
+	return data, nil
+}
+
+// EraseClient will close the connected clients with the client id, discard
+// their pending wills and remove everything the broker and its backend store
+// about the client id. It returns an error if the backend does not implement
+// the DataController interface.
+func (b *Broker) EraseClient(clientID string) error {
+	controller, ok := b.Backend.(DataController)
+	if !ok {
+		return fmt.Errorf("backend does not support data erasure")
+	}
+
+	b.RecordAction("erase_client", clientID)
+
+	// close connected clients and wait until their sessions are terminated
+	for _, c := range b.currentClients() {
+		if id, _ := c.Context().Get("client_id").(string); id == clientID {
+			c.Close(false)
+			<-c.tomb.Dead()
+		}
+	}
+
+	b.wills.cancel(clientID)
+	b.identities.unbind(clientID)
+	b.connections.erase(clientID)
+
+	return controller.EraseClient(clientID)
+}
+
+// ExportClient will return the session data and the retained messages that
+// have been set by the client id. Retained messages loaded from the retained
+// log are not attributed to their publishers.
+func (m *MemoryBackend) ExportClient(clientID string) (*ClientData, error) {
+	data := &ClientData{
+		ClientID:         clientID,
+		Subscriptions:    []SubscriptionRecord{},
+		QueuedMessages:   []MessageRecord{},
+		RetainedMessages: []MessageRecord{},
+	}
+
+	m.sessionsMutex.Lock()
+	sess, ok := m.sessions[clientID]
+	m.sessionsMutex.Unlock()
+
+	if ok {
+		subs, err := sess.AllSubscriptions()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sub := range subs {
+			data.Subscriptions = append(data.Subscriptions, SubscriptionRecord{
+				Topic: sub.Topic,
+				QOS:   sub.QOS,
+			})
+		}
+
+		packets, err := sess.AllPackets(outgoing)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pkt := range packets {
+			if publish, ok := pkt.(*packet.PublishPacket); ok {
+				data.QueuedMessages = append(data.QueuedMessages, messageRecord(&publish.Message, false))
+			}
+		}
+
+		queued, _ := sess.queued()
+		for _, msg := range queued {
+			data.QueuedMessages = append(data.QueuedMessages, messageRecord(msg, false))
+		}
+	}
+
+	m.retainedMutex.Lock()
+	defer m.retainedMutex.Unlock()
+
+	for topic, publisher := range m.publishers {
+		if publisher != clientID {
+			continue
+		}
+
+		for _, value := range m.retained.Get(topic) {
+			if msg, ok := value.(*packet.Message); ok {
+				data.RetainedMessages = append(data.RetainedMessages, messageRecord(msg, true))
+			}
+		}
+	}
+
+	return data, nil
+}
+
+// EraseClient will remove the session of the client id and clear the retained
+// messages that have been set by the client id.
+func (m *MemoryBackend) EraseClient(clientID string) error {
+	m.sessionsMutex.Lock()
+	if sess, ok := m.sessions[clientID]; ok {
+		m.remove(clientID, sess)
+	}
+	m.sessionsMutex.Unlock()
+
+	// collect retained messages
+	m.retainedMutex.Lock()
+	var topics []string
+	for topic, publisher := range m.publishers {
+		if publisher == clientID {
+			topics = append(topics, topic)
+		}
+	}
+	m.retainedMutex.Unlock()
+
+	// clear retained messages
+	for _, topic := range topics {
+		err := m.retain("", "", &packet.Message{Topic: topic, Retain: true})
+		if err != nil {
+			return err
+		}
+
+		m.record(&packet.Message{Topic: topic, Retain: true})
+	}
+
+	return nil
+}
+
+// converts a message to a record
+func messageRecord(msg *packet.Message, payload bool) MessageRecord {
+	record := MessageRecord{
+		Topic:  msg.Topic,
+		QOS:    msg.QOS,
+		Retain: msg.Retain,
+		Size:   len(msg.Payload),
+	}
+
+	if payload {
+		record.Payload = msg.Payload
+	}
+
+	return record
+}
+
+// keeps the recent connections by client id
+type connectionLog struct {
+	records map[string][]*ConnectionRecord
+	mutex   sync.Mutex
+}
+
+// records a new connection and drops the oldest records exceeding the size
+func (l *connectionLog) open(clientID, uuid, remoteIP string, size int) {
+	if size <= 0 || clientID == "" {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// lazily allocate records
+	if l.records == nil {
+		l.records = make(map[string][]*ConnectionRecord)
+	}
+
+	records := append(l.records[clientID], &ConnectionRecord{
+		UUID:      uuid,
+		RemoteIP:  remoteIP,
+		Connected: time.Now(),
+	})
+
+	if len(records) > size {
+		records = append([]*ConnectionRecord{}, records[len(records)-size:]...)
+	}
+
+	l.records[clientID] = records
+}
+
+// marks the connection as disconnected
+func (l *connectionLog) close(clientID, uuid string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, record := range l.records[clientID] {
+		if record.UUID == uuid && record.Disconnected.IsZero() {
+			record.Disconnected = time.Now()
+		}
+	}
+}
+
+// returns a copy of the records of the client id
+func (l *connectionLog) list(clientID string) []ConnectionRecord {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	list := []ConnectionRecord{}
+	for _, record := range l.records[clientID] {
+		list = append(list, *record)
+	}
+
+	return list
+}
+
+// removes all records of the client id
+func (l *connectionLog) erase(clientID string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.records, clientID)
+}
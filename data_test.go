@@ -0,0 +1,111 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportAndEraseClient(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+	connect.CleanSession = false
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "foo", QOS: 1}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{1}
+	suback.PacketID = 1
+
+	retained := packet.NewPublishPacket()
+	retained.Message = packet.Message{Topic: "bar", Payload: []byte("bar"), Retain: true}
+
+	publish := packet.NewPublishPacket()
+	publish.Message = packet.Message{Topic: "foo", Payload: []byte("foo"), QOS: 1}
+	publish.PacketID = 1
+
+	puback := packet.NewPubackPacket()
+	puback.PacketID = 1
+
+	broker := New()
+
+	port, done := runBroker(t, broker, 2)
+
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(retained).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn1)
+
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(connack).
+		Send(publish).
+		Receive(puback).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn2)
+
+	<-done
+
+	// export
+	data, err := broker.ExportClient("test")
+	assert.NoError(t, err)
+	assert.Equal(t, "test", data.ClientID)
+	assert.Equal(t, []SubscriptionRecord{{Topic: "foo", QOS: 1}}, data.Subscriptions)
+	assert.Equal(t, []MessageRecord{{Topic: "foo", QOS: 1, Size: 3}}, data.QueuedMessages)
+	assert.Equal(t, []MessageRecord{{Topic: "bar", Retain: true, Size: 3, Payload: []byte("bar")}}, data.RetainedMessages)
+	assert.Len(t, data.Connections, 1)
+	assert.False(t, data.Connections[0].Disconnected.IsZero())
+
+	// export does not consume the queued messages
+	export, err := broker.ExportClient("test")
+	assert.NoError(t, err)
+	assert.Len(t, export.QueuedMessages, 1)
+
+	// erase
+	err = broker.EraseClient("test")
+	assert.NoError(t, err)
+
+	export, err = broker.ExportClient("test")
+	assert.NoError(t, err)
+	assert.Empty(t, export.Subscriptions)
+	assert.Empty(t, export.QueuedMessages)
+	assert.Empty(t, export.RetainedMessages)
+	assert.Empty(t, export.Connections)
+
+	msgs, err := broker.Backend.(RetainedInspector).RetainedMessages("#")
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+}
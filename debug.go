@@ -0,0 +1,130 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A DebuggedClient is a client id that is currently traced (see DebugClient).
+type DebuggedClient struct {
+	ClientID string    `json:"client_id"`
+	Until    time.Time `json:"until"`
+}
+
+// the registry of traced client ids
+type debugRegistry struct {
+	active  int32
+	clients map[string]time.Time
+	mutex   sync.RWMutex
+}
+
+// DebugClient will enable verbose tracing for the clients with the specified
+// client id until the duration has elapsed, which allows debugging a single
+// client without enabling debug logging globally. The debug events of traced
+// clients, like the sent and received packets, are passed to the Logger as
+// info events with a "debug" field. It returns the time the tracing expires.
+// A zero or negative duration disables the tracing immediately.
+func (b *Broker) DebugClient(clientID string, duration time.Duration) time.Time {
+	b.RecordAction("debug_client", clientID)
+
+	b.debugs.mutex.Lock()
+	defer b.debugs.mutex.Unlock()
+
+	// disable tracing
+	if duration <= 0 {
+		if _, ok := b.debugs.clients[clientID]; ok {
+			delete(b.debugs.clients, clientID)
+			atomic.AddInt32(&b.debugs.active, -1)
+		}
+
+		return time.Time{}
+	}
+
+	if b.debugs.clients == nil {
+		b.debugs.clients = make(map[string]time.Time)
+	}
+
+	if _, ok := b.debugs.clients[clientID]; !ok {
+		atomic.AddInt32(&b.debugs.active, 1)
+	}
+
+	until := time.Now().Add(duration)
+	b.debugs.clients[clientID] = until
+
+	return until
+}
+
+// DebuggedClients returns the currently traced client ids sorted by their id.
+func (b *Broker) DebuggedClients() []DebuggedClient {
+	b.debugs.prune(time.Now())
+
+	b.debugs.mutex.RLock()
+	defer b.debugs.mutex.RUnlock()
+
+	list := make([]DebuggedClient, 0, len(b.debugs.clients))
+	for clientID, until := range b.debugs.clients {
+		list = append(list, DebuggedClient{
+			ClientID: clientID,
+			Until:    until,
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ClientID < list[j].ClientID
+	})
+
+	return list
+}
+
+// returns whether the client id is currently traced
+func (r *debugRegistry) traced(clientID string) bool {
+	// fast path if no client is traced
+	if clientID == "" || atomic.LoadInt32(&r.active) == 0 {
+		return false
+	}
+
+	r.mutex.RLock()
+	until, ok := r.clients[clientID]
+	r.mutex.RUnlock()
+
+	if !ok {
+		return false
+	}
+
+	// expire tracing
+	if now := time.Now(); !now.Before(until) {
+		r.prune(now)
+		return false
+	}
+
+	return true
+}
+
+// removes all expired client ids
+func (r *debugRegistry) prune(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for clientID, until := range r.clients {
+		if !now.Before(until) {
+			delete(r.clients, clientID)
+			atomic.AddInt32(&r.active, -1)
+		}
+	}
+}
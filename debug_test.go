@@ -0,0 +1,88 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugClient(t *testing.T) {
+	connect1 := packet.NewConnectPacket()
+	connect1.ClientID = "traced"
+
+	connect2 := packet.NewConnectPacket()
+	connect2.ClientID = "other"
+
+	connack := packet.NewConnackPacket()
+
+	logger := &recordingLogger{}
+
+	broker := New()
+	broker.Logger = logger
+
+	broker.DebugClient("traced", time.Minute)
+	assert.Len(t, broker.DebuggedClients(), 1)
+	assert.Equal(t, "traced", broker.DebuggedClients()[0].ClientID)
+
+	port, done := runBroker(t, broker, 2)
+
+	for _, connect := range []*packet.ConnectPacket{connect1, connect2} {
+		conn, err := transport.Dial(port.URL())
+		assert.NoError(t, err)
+
+		tools.NewFlow().
+			Send(connect).
+			Receive(connack).
+			Send(packet.NewDisconnectPacket()).
+			Close().
+			Test(t, conn)
+	}
+
+	<-done
+
+	// only the debug events of the traced client are raised
+	logger.mutex.Lock()
+	levels := make(map[string]LogLevel)
+	for _, entry := range logger.entries {
+		if entry.event == "packet_sent" {
+			levels[entry.fields["client_id"].(string)] = entry.level
+			assert.Equal(t, entry.level == LogInfo, entry.fields["debug"] == true)
+		}
+	}
+	logger.mutex.Unlock()
+
+	assert.Equal(t, map[string]LogLevel{
+		"traced": LogInfo,
+		"other":  LogDebug,
+	}, levels)
+
+	// disable tracing
+	broker.DebugClient("traced", 0)
+	assert.Empty(t, broker.DebuggedClients())
+	assert.False(t, broker.debugs.traced("traced"))
+
+	// expire tracing
+	broker.DebugClient("traced", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	assert.False(t, broker.debugs.traced("traced"))
+	assert.Empty(t, broker.DebuggedClients())
+	assert.Equal(t, int32(0), broker.debugs.active)
+}
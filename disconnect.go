@@ -0,0 +1,57 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+// A DisconnectSummary quantifies the messages a client left behind when it
+// was terminated.
+type DisconnectSummary struct {
+	// The number of buffered QOS 0 messages that have been dropped.
+	DroppedQOS0 int
+
+	// The number of buffered QOS 1 and 2 messages that have been dropped,
+	// because the client had no persistent session or is no longer
+	// subscribed to their topics.
+	DroppedQOS12 int
+
+	// The number of buffered QOS 1 and 2 messages that have been moved to
+	// the persistent session, which sends them when the session is resumed.
+	MovedOffline int
+
+	// The number of sent QOS 1 and 2 messages that had not yet been
+	// acknowledged by the client.
+	Unacknowledged int
+
+	// The total payload size of all buffered messages.
+	PendingBytes int
+}
+
+// A DisconnectObserver is a Backend that is notified about the messages every
+// terminated client left behind.
+type DisconnectObserver interface {
+	// Disconnected is called with the summary of the client before the client
+	// is terminated.
+	Disconnected(client Client, summary DisconnectSummary)
+}
+
+// notifies the backend and the handler about the summary of the client
+func (b *Broker) disconnected(client Client, summary DisconnectSummary) {
+	if observer, ok := b.Backend.(DisconnectObserver); ok {
+		observer.Disconnected(client, summary)
+	}
+
+	if b.DisconnectHandler != nil {
+		b.DisconnectHandler(client, summary)
+	}
+}
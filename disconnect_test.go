@@ -0,0 +1,84 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDisconnectSummary(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+	connect.CleanSession = false
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test", QOS: 1}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{1}
+	suback.PacketID = 1
+
+	summaries := make(chan DisconnectSummary, 1)
+
+	broker := New()
+	broker.OutgoingBuffer = 10
+	broker.HighWatermark = 10
+	broker.DisconnectHandler = func(client Client, summary DisconnectSummary) {
+		summaries <- summary
+	}
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Test(t, conn)
+
+	// fill the buffer of the client that does not read
+	publisher := NewLocalClient(func(*packet.Message) {})
+	for i := 0; i < 1000 && len(summaries) == 0; i++ {
+		err = broker.Backend.Publish(publisher, &packet.Message{
+			Topic:   "test",
+			Payload: []byte("test"),
+			QOS:     1,
+		})
+		assert.NoError(t, err)
+
+		time.Sleep(time.Millisecond)
+	}
+
+	summary := <-summaries
+	<-done
+
+	assert.True(t, summary.MovedOffline > 0)
+	assert.Equal(t, 0, summary.DroppedQOS0)
+	assert.Equal(t, 0, summary.DroppedQOS12)
+	assert.Equal(t, 4*summary.MovedOffline, summary.PendingBytes)
+	assert.True(t, summary.Unacknowledged > 0)
+}
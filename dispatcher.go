@@ -0,0 +1,218 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sync"
+
+	"github.com/gomqtt/packet"
+)
+
+// the default number of messages queued per subscriber by the dispatcher
+const defaultDeliveryQueue = 1000
+
+// the messages queued for a subscriber along with the number of messages
+// that are currently delivered by a worker
+type deliveryQueue struct {
+	client   Client
+	msgs     []*packet.Message
+	inflight int
+}
+
+// A dispatcher decouples the publishing of messages from the writes to the
+// subscribers. Messages are queued per subscriber and delivered in order by a
+// bounded pool of workers, so that a subscriber whose connection blocks only
+// occupies a single worker.
+type dispatcher struct {
+	backend *MemoryBackend
+	workers int
+	depth   int
+
+	queues  map[Client]*deliveryQueue
+	pending []*deliveryQueue
+	running int
+	stopped bool
+	cond    *sync.Cond
+	mutex   sync.Mutex
+}
+
+// returns a new dispatcher for the backend
+func newDispatcher(backend *MemoryBackend, workers, depth int) *dispatcher {
+	if depth <= 0 {
+		depth = defaultDeliveryQueue
+	}
+
+	d := &dispatcher{
+		backend: backend,
+		workers: workers,
+		depth:   depth,
+		queues:  make(map[Client]*deliveryQueue),
+	}
+
+	d.cond = sync.NewCond(&d.mutex)
+
+	return d
+}
+
+// launches the workers that are not running
+func (d *dispatcher) start() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.stopped = false
+
+	for ; d.running < d.workers; d.running++ {
+		go d.worker()
+	}
+}
+
+// lets the workers exit once the queued messages have been delivered,
+// messages dispatched afterwards are delivered synchronously
+func (d *dispatcher) stop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.stopped = true
+	d.cond.Broadcast()
+}
+
+// queues a message for the client, a message that does not fit the queue of
+// the client is rejected with ErrBackpressure if it is a QOS 0 message while
+// the client is closed and ErrClientOffline is returned for QOS 1 and 2
+// messages, so that they are added to the session of the client
+func (d *dispatcher) dispatch(client Client, msg *packet.Message) error {
+	d.mutex.Lock()
+
+	// deliver synchronously if stopped
+	if d.stopped {
+		d.mutex.Unlock()
+		return client.Publish(msg)
+	}
+
+	// get queue
+	queue, ok := d.queues[client]
+	if !ok {
+		queue = &deliveryQueue{client: client}
+		d.queues[client] = queue
+		d.pending = append(d.pending, queue)
+		d.cond.Signal()
+	}
+
+	// check depth including the messages that are being delivered
+	if len(queue.msgs)+queue.inflight >= d.depth {
+		d.mutex.Unlock()
+		return d.overflow(client, msg)
+	}
+
+	// the queued copy carries the metadata until it has been delivered
+	queued := d.backend.annotations().fork(msg)
+	if queued == msg {
+		copied := *msg
+		queued = &copied
+	}
+
+	queue.msgs = append(queue.msgs, queued)
+	d.mutex.Unlock()
+
+	return nil
+}
+
+// handles a message that does not fit the queue of the client
+func (d *dispatcher) overflow(client Client, msg *packet.Message) error {
+	if msg.QOS == 0 {
+		if d.backend.broker != nil {
+			d.backend.broker.count(&d.backend.broker.counters.DroppedMessages)
+		}
+
+		return ErrBackpressure
+	}
+
+	if c, ok := client.(*remoteClient); ok {
+		c.log(LogWarn, "slow_consumer", map[string]interface{}{
+			"queued": d.depth,
+		})
+
+		c.disconnectAs(DisconnectSlowConsumer)
+	}
+
+	client.Close(false)
+
+	return ErrClientOffline
+}
+
+// delivers the queued messages until the dispatcher is stopped
+func (d *dispatcher) worker() {
+	for {
+		d.mutex.Lock()
+
+		for len(d.pending) == 0 && !d.stopped {
+			d.cond.Wait()
+		}
+
+		// exit once all queues have been drained
+		if len(d.pending) == 0 {
+			d.running--
+			d.mutex.Unlock()
+			return
+		}
+
+		// take the messages of the next queue
+		queue := d.pending[0]
+		d.pending = d.pending[1:]
+		msgs := queue.msgs
+		queue.msgs = nil
+		queue.inflight = len(msgs)
+
+		d.mutex.Unlock()
+
+		d.deliver(queue.client, msgs)
+
+		// reschedule or remove the queue
+		d.mutex.Lock()
+		queue.inflight = 0
+		if len(queue.msgs) > 0 {
+			d.pending = append(d.pending, queue)
+			d.cond.Signal()
+		} else {
+			delete(d.queues, queue.client)
+		}
+		d.mutex.Unlock()
+	}
+}
+
+// delivers the messages as a batch and adds the messages that could not be
+// delivered to the session of the client
+func (d *dispatcher) deliver(client Client, msgs []*packet.Message) {
+	n, err := PublishBatch(client, msgs)
+	if err == ErrClientOffline {
+		for _, msg := range msgs[n:] {
+			d.backend.miss(client, msg)
+		}
+	}
+
+	for _, msg := range msgs {
+		d.backend.annotations().release(msg)
+	}
+}
+
+// publishes the message using the dispatcher or directly, local clients keep
+// receiving their messages synchronously
+func (m *MemoryBackend) dispatch(client Client, msg *packet.Message) error {
+	if _, ok := client.(*LocalClient); m.dispatcher != nil && !ok {
+		return m.dispatcher.dispatch(client, msg)
+	}
+
+	return client.Publish(msg)
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+// a client whose writes block until it is unblocked
+type blockedClient struct {
+	*fakeClient
+	unblock chan struct{}
+}
+
+func (c *blockedClient) Publish(msg *packet.Message) error {
+	<-c.unblock
+	return c.fakeClient.Publish(msg)
+}
+
+// waits until the condition is met
+func eventually(condition func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for !condition() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return condition()
+}
+
+func TestMemoryBackendDeliveryWorkers(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.DeliveryWorkers = 2
+
+	err := backend.Start(New())
+	assert.NoError(t, err)
+
+	blocked := &blockedClient{fakeClient: newFakeClient(), unblock: make(chan struct{})}
+	other := newFakeClient()
+
+	_, err = backend.Subscribe(blocked, "test")
+	assert.NoError(t, err)
+
+	_, err = backend.Subscribe(other, "test")
+	assert.NoError(t, err)
+
+	// a blocked subscriber does not stall the others
+	for i := 0; i < 3; i++ {
+		err = backend.Publish(newFakeClient(), &packet.Message{Topic: "test", Payload: []byte{byte(i)}})
+		assert.NoError(t, err)
+	}
+
+	assert.True(t, eventually(func() bool {
+		return len(other.received()) == 3
+	}))
+	assert.Empty(t, blocked.received())
+
+	// the blocked subscriber receives its messages in order
+	close(blocked.unblock)
+
+	assert.True(t, eventually(func() bool {
+		return len(blocked.received()) == 3
+	}))
+	for i, msg := range blocked.received() {
+		assert.Equal(t, []byte{byte(i)}, msg.Payload)
+	}
+
+	err = backend.Stop()
+	assert.NoError(t, err)
+}
+
+func TestDispatcherOverflow(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.broker = New()
+
+	d := newDispatcher(backend, 1, 2)
+	d.start()
+	defer d.stop()
+
+	blocked := &blockedClient{fakeClient: newFakeClient(), unblock: make(chan struct{})}
+	defer close(blocked.unblock)
+
+	// the first message occupies the worker and the second the queue, which
+	// reaches the limit as the delivered message counts towards the depth
+	assert.NoError(t, d.dispatch(blocked, &packet.Message{Topic: "test"}))
+	assert.True(t, eventually(func() bool {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		return len(d.pending) == 0
+	}))
+	assert.NoError(t, d.dispatch(blocked, &packet.Message{Topic: "test"}))
+
+	// qos 0 messages are dropped
+	assert.Equal(t, ErrBackpressure, d.dispatch(blocked, &packet.Message{Topic: "test"}))
+	assert.Equal(t, int64(1), backend.broker.Counters().DroppedMessages)
+
+	// subscribers of qos 1 messages are closed
+	assert.Equal(t, ErrClientOffline, d.dispatch(blocked, &packet.Message{Topic: "test", QOS: 1}))
+	assert.True(t, blocked.closed)
+}
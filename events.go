@@ -0,0 +1,118 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import "sync"
+
+// the handlers registered using OnEvent
+type eventRegistry struct {
+	handlers map[uint64]EventHandler
+	next     uint64
+	mutex    sync.RWMutex
+}
+
+// adds a handler and returns its id
+func (r *eventRegistry) add(handler EventHandler) uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// lazily allocate handlers
+	if r.handlers == nil {
+		r.handlers = make(map[uint64]EventHandler)
+	}
+
+	r.next++
+	r.handlers[r.next] = handler
+
+	return r.next
+}
+
+// removes a handler
+func (r *eventRegistry) remove(id uint64) {
+	r.mutex.Lock()
+	delete(r.handlers, id)
+	r.mutex.Unlock()
+}
+
+// returns all registered handlers
+func (r *eventRegistry) all() []EventHandler {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if len(r.handlers) == 0 {
+		return nil
+	}
+
+	list := make([]EventHandler, 0, len(r.handlers))
+	for _, handler := range r.handlers {
+		list = append(list, handler)
+	}
+
+	return list
+}
+
+// OnEvent will register the handler, which is called synchronously with every
+// emitted event in addition to the EventHandler. Handlers must not block and
+// must not modify the events. The returned function removes the handler.
+func (b *Broker) OnEvent(handler EventHandler) func() {
+	id := b.events.add(handler)
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			b.events.remove(id)
+		})
+	}
+}
+
+// Events returns a channel that receives a copy of every emitted event and a
+// function that stops the delivery and closes the channel. Events are dropped
+// and counted as DroppedEvents while the channel holds size events, as the
+// broker must not block on slow readers.
+func (b *Broker) Events(size int) (<-chan Event, func()) {
+	events := make(chan Event, size)
+	closed := false
+
+	var mutex sync.Mutex
+
+	remove := b.OnEvent(func(event *Event) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		// check channel
+		if closed {
+			return
+		}
+
+		select {
+		case events <- *event:
+		default:
+			b.count(&b.counters.DroppedEvents)
+		}
+	})
+
+	return events, func() {
+		remove()
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if !closed {
+			closed = true
+			close(events)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvents(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("test")
+
+	unsubscribe := packet.NewUnsubscribePacket()
+	unsubscribe.Topics = []string{"test"}
+	unsubscribe.PacketID = 2
+
+	unsuback := packet.NewUnsubackPacket()
+	unsuback.PacketID = 2
+
+	broker := New()
+
+	events, cancel := broker.Events(10)
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(publish).
+		Receive(publish).
+		Send(unsubscribe).
+		Receive(unsuback).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	var types []EventType
+	for len(types) < 5 {
+		types = append(types, (<-events).Type)
+	}
+
+	cancel()
+
+	assert.Equal(t, []EventType{
+		ClientConnected,
+		Subscribed,
+		MessagePublished,
+		Unsubscribed,
+		ClientDisconnected,
+	}, types)
+
+	// a second cancel is a no-op
+	cancel()
+}
+
+func TestEventsFull(t *testing.T) {
+	broker := New()
+
+	var handled []EventType
+	remove := broker.OnEvent(func(event *Event) {
+		handled = append(handled, event.Type)
+	})
+
+	events, cancel := broker.Events(1)
+
+	broker.emit(&Event{Type: ClientConnected})
+	broker.emit(&Event{Type: ClientDisconnected})
+
+	remove()
+	cancel()
+
+	broker.emit(&Event{Type: Subscribed})
+
+	assert.Equal(t, []EventType{ClientConnected, ClientDisconnected}, handled)
+	assert.Equal(t, ClientConnected, (<-events).Type)
+	assert.Equal(t, int64(1), broker.Counters().DroppedEvents)
+}
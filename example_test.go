@@ -16,31 +16,20 @@ package broker
 
 import (
 	"fmt"
+	"time"
 
-	"github.com/gomqtt/transport"
 	"github.com/gomqtt/client"
 	"github.com/gomqtt/packet"
 )
 
 func Example() {
-	server, err := transport.Launch("tcp://localhost:8080")
+	broker := New()
+
+	err := broker.Launch("tcp://localhost:8080")
 	if err != nil {
 		panic(err)
 	}
 
-	broker := New()
-
-	go func() {
-		for {
-			conn, err := server.Accept()
-			if err != nil {
-				return
-			}
-
-			broker.Handle(conn)
-		}
-	}()
-
 	client := client.New()
 	wait := make(chan struct{})
 
@@ -81,7 +70,7 @@ func Example() {
 		panic(err)
 	}
 
-	err = server.Close()
+	err = broker.Close(time.Second)
 	if err != nil {
 		panic(err)
 	}
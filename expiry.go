@@ -0,0 +1,95 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"time"
+
+	"github.com/gomqtt/packet"
+)
+
+// MessageExpiryAnnotation is the metadata key of the expiry interval of a
+// message (see Broker.Annotate). The value is a time.Duration.
+//
+// Messages without an interval expire after the MessageExpiry of the broker.
+// The MemoryBackend drops expired messages that are queued for offline
+// sessions or retained, and updates the interval to the remaining time when
+// it delivers them later.
+const MessageExpiryAnnotation = "message_expiry"
+
+// MessageExpiryInterval will return the expiry interval attached to the
+// message.
+func (b *Broker) MessageExpiryInterval(msg *packet.Message) (time.Duration, bool) {
+	expiry, ok := b.Annotations(msg)[MessageExpiryAnnotation].(time.Duration)
+	return expiry, ok && expiry > 0
+}
+
+// attaches the default expiry interval to messages that carry none
+func (b *Broker) defaultExpiry(msg *packet.Message) {
+	if b.MessageExpiry <= 0 {
+		return
+	}
+
+	if _, ok := b.MessageExpiryInterval(msg); !ok {
+		b.Annotate(msg, MessageExpiryAnnotation, b.MessageExpiry)
+	}
+}
+
+// returns the time the message expires or the zero time if it does not expire
+func (m *MemoryBackend) expiryDeadline(msg *packet.Message, now time.Time) time.Time {
+	expiry, ok := m.broker.MessageExpiryInterval(msg)
+	if !ok {
+		return time.Time{}
+	}
+
+	return now.Add(expiry)
+}
+
+// returns a copy of the message that carries the remaining expiry interval or
+// the message itself if it does not expire, the metadata of a copy must be
+// released
+func (m *MemoryBackend) withExpiry(msg *packet.Message, deadline, now time.Time) *packet.Message {
+	if deadline.IsZero() {
+		return msg
+	}
+
+	copied := *msg
+	m.broker.Annotate(&copied, MessageExpiryAnnotation, deadline.Sub(now))
+
+	return &copied
+}
+
+// records the time a retained message expires, the retained mutex must be
+// held
+func (m *MemoryBackend) expireRetainedAt(topic string, deadline time.Time) {
+	if deadline.IsZero() {
+		delete(m.retainedExpiry, topic)
+		return
+	}
+
+	// lazily allocate expiry times
+	if m.retainedExpiry == nil {
+		m.retainedExpiry = make(map[string]time.Time)
+	}
+
+	m.retainedExpiry[topic] = deadline
+}
+
+// returns whether the retained message of the topic has expired, the retained
+// mutex must be held
+func (m *MemoryBackend) retainedExpired(topic string, now time.Time) bool {
+	deadline, ok := m.retainedExpiry[topic]
+	return ok && !now.Before(deadline)
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageExpiryDefault(t *testing.T) {
+	broker := New()
+	broker.MessageExpiry = time.Minute
+
+	msg := &packet.Message{Topic: "foo"}
+	broker.defaultExpiry(msg)
+
+	expiry, ok := broker.MessageExpiryInterval(msg)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, expiry)
+	broker.annotations().release(msg)
+
+	// the interval of the publisher is kept
+	msg = &packet.Message{Topic: "foo"}
+	broker.Annotate(msg, MessageExpiryAnnotation, time.Second)
+	broker.defaultExpiry(msg)
+
+	expiry, ok = broker.MessageExpiryInterval(msg)
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, expiry)
+	broker.annotations().release(msg)
+}
+
+func TestMemoryBackendMessageExpiry(t *testing.T) {
+	broker := New()
+	backend := NewMemoryBackend()
+	backend.broker = broker
+
+	// publishes a message that expires after the interval
+	publish := func(topic, payload string, retain bool, expiry time.Duration) {
+		msg := &packet.Message{Topic: topic, Payload: []byte(payload), QOS: 1, Retain: retain}
+		if expiry > 0 {
+			broker.Annotate(msg, MessageExpiryAnnotation, expiry)
+		}
+
+		assert.NoError(t, backend.Publish(newFakeClient(), msg))
+		broker.annotations().release(msg)
+	}
+
+	// create offline session
+	client1 := newFakeClient()
+	client1.Context().Set("client_id", "client")
+
+	session, _, err := backend.Setup(client1, "client", false)
+	assert.NoError(t, err)
+	assert.NoError(t, session.SaveSubscription(&packet.Subscription{Topic: "foo", QOS: 1}))
+	_, err = backend.Subscribe(client1, "foo")
+	assert.NoError(t, err)
+	assert.NoError(t, backend.Terminate(client1))
+
+	publish("foo", "short", false, 10*time.Millisecond)
+	publish("foo", "long", false, time.Hour)
+	publish("foo", "plain", false, 0)
+	publish("bar", "short", true, 10*time.Millisecond)
+	publish("baz", "long", true, time.Hour)
+
+	time.Sleep(20 * time.Millisecond)
+
+	// resume session
+	var mutex sync.Mutex
+	expiries := make(map[string]time.Duration)
+	client2 := NewLocalClient(func(msg *packet.Message) {
+		expiry, _ := broker.MessageExpiryInterval(msg)
+
+		mutex.Lock()
+		expiries[string(msg.Payload)] = expiry
+		mutex.Unlock()
+	})
+
+	_, resumed, err := backend.Setup(client2, "client", false)
+	assert.NoError(t, err)
+	assert.True(t, resumed)
+
+	snapshot := func() map[string]time.Duration {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		copied := make(map[string]time.Duration)
+		for payload, expiry := range expiries {
+			copied[payload] = expiry
+		}
+
+		return copied
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(snapshot()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	received := snapshot()
+	assert.Len(t, received, 2)
+	assert.Equal(t, time.Duration(0), received["plain"])
+	assert.True(t, received["long"] > 59*time.Minute && received["long"] <= time.Hour)
+
+	// expired retained messages are skipped
+	msgs, err := backend.Subscribe(newFakeClient(), "#")
+	assert.NoError(t, err)
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, "baz", msgs[0].Topic)
+
+		expiry, ok := broker.MessageExpiryInterval(msgs[0])
+		assert.True(t, ok)
+		assert.True(t, expiry > 59*time.Minute && expiry <= time.Hour)
+		broker.annotations().release(msgs[0])
+	}
+
+	retained, err := backend.RetainedMessages("#")
+	assert.NoError(t, err)
+	assert.Len(t, retained, 1)
+
+	// expired retained messages are purged
+	assert.NoError(t, backend.expireRetained(time.Now()))
+	assert.Equal(t, RetainedStats{Messages: 1, Expired: 1}, backend.RetainedStats())
+}
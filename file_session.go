@@ -0,0 +1,814 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+)
+
+// the maximum number of missed messages kept in a FileSession
+const fileSessionMissedLimit = 100
+
+// the number of changes appended to the file of a FileSession before it is
+// compacted into a single snapshot
+const fileSessionSlack = 1000
+
+// the serialized form of a stored packet
+type fileSessionPacket struct {
+	Type     string          `json:"type"`
+	PacketID uint16          `json:"packet_id"`
+	Dup      bool            `json:"dup,omitempty"`
+	Message  *packet.Message `json:"message,omitempty"`
+}
+
+// the serialized form of a FileSession
+type fileSessionState struct {
+	Counter       uint16                         `json:"counter"`
+	Packets       map[string][]fileSessionPacket `json:"packets"`
+	Subscriptions []*packet.Subscription         `json:"subscriptions"`
+	Will          *packet.Message                `json:"will,omitempty"`
+	Missed        []*packet.Message              `json:"missed,omitempty"`
+	Deadlines     []time.Time                    `json:"deadlines,omitempty"`
+	Namespace     string                         `json:"namespace,omitempty"`
+	Expires       *time.Time                     `json:"expires,omitempty"`
+}
+
+// a single change to a FileSession that is appended to its file
+type fileSessionChange struct {
+	Op           string               `json:"op"`
+	Direction    string               `json:"direction,omitempty"`
+	Counter      uint16               `json:"counter,omitempty"`
+	Packet       *fileSessionPacket   `json:"packet,omitempty"`
+	PacketID     uint16               `json:"packet_id,omitempty"`
+	Subscription *packet.Subscription `json:"subscription,omitempty"`
+	Topic        string               `json:"topic,omitempty"`
+	Message      *packet.Message      `json:"message,omitempty"`
+	Deadline     *time.Time           `json:"deadline,omitempty"`
+	Namespace    string               `json:"namespace,omitempty"`
+	Expires      *time.Time           `json:"expires,omitempty"`
+
+	// the original packet, which is only available before encoding
+	pkt packet.Packet
+}
+
+// A FileSession stores packets, subscriptions, the will and missed messages
+// in memory and persists every change to a file on disk. A FileSession that
+// is opened from an existing file will restore its previous state, which
+// allows QOS 1 and QOS 2 flows to survive a restart of the broker. The
+// MemoryBackend persists its stored sessions using FileSessions if the
+// SessionPath is set.
+//
+// The file starts with a snapshot of the session that is followed by the
+// changes made since then. Every change is appended and synced before the
+// operation returns, and the file is atomically replaced by a new snapshot
+// once it has accumulated too many changes. A torn change at the end of the
+// file, as left behind by a crash, is ignored when the session is restored.
+// Plain files are used instead of an embedded database like BoltDB to keep
+// the broker package free of dependencies and every session independent of
+// the others.
+type FileSession struct {
+	path    string
+	written bool
+	changes int
+
+	counter       uint16
+	store         *tools.Store
+	subscriptions *tools.Tree
+	will          *packet.Message
+	offlineStore  []*packet.Message
+	deadlines     []time.Time
+	namespace     string
+	expiresAt     time.Time
+
+	mutex sync.Mutex
+}
+
+// OpenFileSession returns a new FileSession that persists its state to the
+// file at the specified path. If the file already exists, the previously
+// persisted state is restored.
+func OpenFileSession(path string) (*FileSession, error) {
+	s := &FileSession{
+		path:          path,
+		store:         tools.NewStore(),
+		subscriptions: tools.NewTree(),
+	}
+
+	// open existing file
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 256*1024*1024)
+
+	// read snapshot
+	if !scanner.Scan() {
+		err = scanner.Err()
+		if err == nil {
+			err = fmt.Errorf("missing snapshot in %s", path)
+		}
+
+		return nil, err
+	}
+
+	var state fileSessionState
+	err = json.Unmarshal(scanner.Bytes(), &state)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.restore(state)
+	if err != nil {
+		return nil, err
+	}
+
+	// replay changes
+	var changes int
+	for scanner.Scan() {
+		var change fileSessionChange
+		err = json.Unmarshal(scanner.Bytes(), &change)
+		if err != nil {
+			// ignore a torn last change after a crash
+			changes++
+			break
+		}
+
+		err = s.apply(change)
+		if err != nil {
+			return nil, err
+		}
+
+		changes++
+	}
+
+	s.written = true
+
+	// rewrite file to drop replayed and torn changes
+	if changes > 0 {
+		err = s.persist()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// restores the snapshot of a session
+func (s *FileSession) restore(state fileSessionState) error {
+	s.counter = state.Counter
+	s.will = state.Will
+	s.offlineStore = state.Missed
+	s.namespace = state.Namespace
+
+	// keep the messages forever if the deadlines are missing
+	if len(state.Deadlines) == len(state.Missed) {
+		s.deadlines = state.Deadlines
+	} else {
+		s.deadlines = make([]time.Time, len(state.Missed))
+	}
+
+	if state.Expires != nil {
+		s.expiresAt = *state.Expires
+	}
+
+	for direction, pkts := range state.Packets {
+		for _, p := range pkts {
+			pkt, err := p.decode()
+			if err != nil {
+				return err
+			}
+
+			s.store.Save(direction, pkt)
+		}
+	}
+
+	for _, sub := range state.Subscriptions {
+		s.subscriptions.Set(sub.Topic, sub)
+	}
+
+	return nil
+}
+
+// PacketID will return the next id for outgoing packets.
+func (s *FileSession) PacketID() uint16 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// increment counter and skip the zero id
+	s.counter++
+	if s.counter == 0 {
+		s.counter = 1
+	}
+
+	// the counter gets persisted along with the packet that uses the id
+	return s.counter
+}
+
+// SavePacket will store a packet in the session. An eventual existing
+// packet with the same id gets quietly overwritten. Only PublishPackets
+// and PubrelPackets can be stored.
+func (s *FileSession) SavePacket(direction string, pkt packet.Packet) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// check type
+	switch pkt.(type) {
+	case *packet.PublishPacket, *packet.PubrelPacket:
+	default:
+		return fmt.Errorf("unsupported packet type %s", pkt.Type())
+	}
+
+	return s.change(fileSessionChange{
+		Op:        "save",
+		Direction: direction,
+		Counter:   s.counter,
+		pkt:       pkt,
+	})
+}
+
+// ReleasePacket will replace the stored outgoing PublishPacket with the
+// specified id by a PubrelPacket and persist the session.
+func (s *FileSession) ReleasePacket(id uint16) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pubrel, ok := releasedPacket(s.store.Lookup(outgoing, id))
+	if !ok || pubrel == nil {
+		return ok, nil
+	}
+
+	return true, s.change(fileSessionChange{
+		Op:        "save",
+		Direction: outgoing,
+		Counter:   s.counter,
+		pkt:       pubrel,
+	})
+}
+
+// LookupPacket will retrieve a packet from the session using a packet id.
+func (s *FileSession) LookupPacket(direction string, id uint16) (packet.Packet, error) {
+	return s.store.Lookup(direction, id), nil
+}
+
+// DeletePacket will remove a packet from the session. The method will not
+// return an error if no packet with the specified id exists.
+func (s *FileSession) DeletePacket(direction string, id uint16) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.change(fileSessionChange{
+		Op:        "delete",
+		Direction: direction,
+		PacketID:  id,
+	})
+}
+
+// AllPackets will return all packets currently saved in the session.
+func (s *FileSession) AllPackets(direction string) ([]packet.Packet, error) {
+	return s.store.All(direction), nil
+}
+
+// SaveSubscription will store the subscription in the session. An eventual
+// subscription with the same topic gets quietly overwritten.
+func (s *FileSession) SaveSubscription(sub *packet.Subscription) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.change(fileSessionChange{
+		Op:           "subscribe",
+		Subscription: sub,
+	})
+}
+
+// LookupSubscription will match a topic against the stored subscriptions and
+// eventually return the first found subscription.
+func (s *FileSession) LookupSubscription(topic string) (*packet.Subscription, error) {
+	values := s.subscriptions.Match(topic)
+
+	if len(values) > 0 {
+		if sub, ok := values[0].(*packet.Subscription); ok {
+			return sub, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// DeleteSubscription will remove the subscription from the session. The
+// method will not return an error if no subscription with the specified
+// topic does exist.
+func (s *FileSession) DeleteSubscription(topic string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.change(fileSessionChange{
+		Op:    "unsubscribe",
+		Topic: topic,
+	})
+}
+
+// AllSubscriptions will return all subscriptions currently saved in the session.
+func (s *FileSession) AllSubscriptions() ([]*packet.Subscription, error) {
+	return s.allSubscriptions(), nil
+}
+
+// SaveWill will store the will message.
+func (s *FileSession) SaveWill(newWill *packet.Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.change(fileSessionChange{
+		Op:      "will",
+		Message: newWill,
+	})
+}
+
+// LookupWill will retrieve the will message.
+func (s *FileSession) LookupWill() (*packet.Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.will, nil
+}
+
+// ClearWill will remove the will message from the store.
+func (s *FileSession) ClearWill() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.change(fileSessionChange{
+		Op: "will",
+	})
+}
+
+// Reset will completely reset the session.
+func (s *FileSession) Reset() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.counter = 0
+	s.store.Reset()
+	s.subscriptions.Reset()
+	s.will = nil
+	s.offlineStore = nil
+	s.deadlines = nil
+
+	return s.persist()
+}
+
+// queues an offline message that expires at the deadline unless it is zero
+func (s *FileSession) queue(msg *packet.Message, deadline time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	change := fileSessionChange{
+		Op:      "queue",
+		Message: msg,
+	}
+
+	if !deadline.IsZero() {
+		change.Deadline = &deadline
+	}
+
+	return s.change(change)
+}
+
+// retrieves and removes all offline messages along with their deadlines
+func (s *FileSession) missed() ([]*packet.Message, []time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	msgs, deadlines := s.offlineStore, s.deadlines
+
+	return msgs, deadlines, s.change(fileSessionChange{
+		Op: "missed",
+	})
+}
+
+// stores the namespace and the time the session expires
+func (s *FileSession) describe(namespace string, expiresAt time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	change := fileSessionChange{
+		Op:        "describe",
+		Namespace: namespace,
+	}
+
+	if !expiresAt.IsZero() {
+		change.Expires = &expiresAt
+	}
+
+	return s.change(change)
+}
+
+// removes the file of the session
+func (s *FileSession) remove() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := os.Remove(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// returns all stored subscriptions
+func (s *FileSession) allSubscriptions() []*packet.Subscription {
+	var all []*packet.Subscription
+
+	for _, value := range s.subscriptions.All() {
+		if sub, ok := value.(*packet.Subscription); ok {
+			all = append(all, sub)
+		}
+	}
+
+	return all
+}
+
+// applies a change to the in-memory state
+func (s *FileSession) apply(change fileSessionChange) error {
+	switch change.Op {
+	case "save":
+		pkt := change.pkt
+		if pkt == nil {
+			if change.Packet == nil {
+				return fmt.Errorf("missing packet in change")
+			}
+
+			var err error
+			pkt, err = change.Packet.decode()
+			if err != nil {
+				return err
+			}
+		}
+
+		s.counter = change.Counter
+		s.store.Save(change.Direction, pkt)
+	case "delete":
+		s.store.Delete(change.Direction, change.PacketID)
+	case "subscribe":
+		if change.Subscription == nil {
+			return fmt.Errorf("missing subscription in change")
+		}
+
+		s.subscriptions.Set(change.Subscription.Topic, change.Subscription)
+	case "unsubscribe":
+		s.subscriptions.Empty(change.Topic)
+	case "will":
+		s.will = change.Message
+	case "queue":
+		if change.Message == nil {
+			return fmt.Errorf("missing message in change")
+		}
+
+		// drop oldest message if full
+		if len(s.offlineStore) >= fileSessionMissedLimit {
+			s.offlineStore = s.offlineStore[1:]
+			s.deadlines = s.deadlines[1:]
+		}
+
+		var deadline time.Time
+		if change.Deadline != nil {
+			deadline = *change.Deadline
+		}
+
+		s.offlineStore = append(s.offlineStore, change.Message)
+		s.deadlines = append(s.deadlines, deadline)
+	case "missed":
+		s.offlineStore = nil
+		s.deadlines = nil
+	case "describe":
+		s.namespace = change.Namespace
+		s.expiresAt = time.Time{}
+		if change.Expires != nil {
+			s.expiresAt = *change.Expires
+		}
+	default:
+		return fmt.Errorf("unknown change %q", change.Op)
+	}
+
+	return nil
+}
+
+// applies a change and appends it to the file, the mutex must be held
+func (s *FileSession) change(change fileSessionChange) error {
+	err := s.apply(change)
+	if err != nil {
+		return err
+	}
+
+	// write a snapshot if the file is missing or has too many changes
+	if !s.written || s.changes >= fileSessionSlack {
+		return s.persist()
+	}
+
+	if change.pkt != nil {
+		p := encodeFileSessionPacket(change.pkt)
+		change.Packet = &p
+	}
+
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(data, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	s.changes++
+
+	return nil
+}
+
+// atomically replaces the file with a snapshot of the current state, the
+// mutex must be held
+func (s *FileSession) persist() error {
+	state := fileSessionState{
+		Counter:       s.counter,
+		Packets:       make(map[string][]fileSessionPacket),
+		Subscriptions: s.allSubscriptions(),
+		Will:          s.will,
+		Missed:        s.offlineStore,
+		Deadlines:     s.deadlines,
+		Namespace:     s.namespace,
+	}
+
+	if !s.expiresAt.IsZero() {
+		state.Expires = &s.expiresAt
+	}
+
+	for _, direction := range []string{incoming, outgoing} {
+		for _, pkt := range s.store.All(direction) {
+			state.Packets[direction] = append(state.Packets[direction], encodeFileSessionPacket(pkt))
+		}
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// write snapshot to a temporary file
+	tmp, err := os.Create(s.path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	// replace file
+	err = os.Rename(s.path+".tmp", s.path)
+	if err != nil {
+		return err
+	}
+
+	// sync directory to persist the rename
+	dir, err := os.Open(filepath.Dir(s.path))
+	if err != nil {
+		return err
+	}
+
+	err = dir.Sync()
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	s.written = true
+	s.changes = 0
+
+	return nil
+}
+
+// converts a supported packet to its serialized form
+func encodeFileSessionPacket(pkt packet.Packet) fileSessionPacket {
+	switch p := pkt.(type) {
+	case *packet.PublishPacket:
+		msg := p.Message
+		return fileSessionPacket{
+			Type:     "publish",
+			PacketID: p.PacketID,
+			Dup:      p.Dup,
+			Message:  &msg,
+		}
+	case *packet.PubrelPacket:
+		return fileSessionPacket{
+			Type:     "pubrel",
+			PacketID: p.PacketID,
+		}
+	}
+
+	return fileSessionPacket{}
+}
+
+// converts the serialized form back to a packet
+func (p fileSessionPacket) decode() (packet.Packet, error) {
+	switch p.Type {
+	case "publish":
+		publish := packet.NewPublishPacket()
+		publish.PacketID = p.PacketID
+		publish.Dup = p.Dup
+
+		if p.Message != nil {
+			publish.Message = *p.Message
+		}
+
+		return publish, nil
+	case "pubrel":
+		pubrel := packet.NewPubrelPacket()
+		pubrel.PacketID = p.PacketID
+		return pubrel, nil
+	}
+
+	return nil, fmt.Errorf("unknown packet type %q", p.Type)
+}
+
+// returns the path of the file that persists the stored session with the key
+func (m *MemoryBackend) sessionFile(key string) string {
+	return filepath.Join(m.SessionPath, base64.RawURLEncoding.EncodeToString([]byte(key))+".json")
+}
+
+// persists the current state of the stored session to a new file, sessions
+// that are already persisted are skipped
+func (m *MemoryBackend) persistSession(key string, sess *MemorySession) error {
+	if sess.persisted() != nil {
+		return nil
+	}
+
+	file := &FileSession{
+		path:          m.sessionFile(key),
+		store:         tools.NewStore(),
+		subscriptions: tools.NewTree(),
+		namespace:     sess.namespace,
+	}
+
+	for _, direction := range []string{incoming, outgoing} {
+		for _, pkt := range sess.store.All(direction) {
+			file.store.Save(direction, pkt)
+		}
+	}
+
+	subs, _ := sess.AllSubscriptions()
+	for _, sub := range subs {
+		file.subscriptions.Set(sub.Topic, sub)
+	}
+
+	file.will, _ = sess.LookupWill()
+
+	file.mutex.Lock()
+	err := file.persist()
+	file.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sess.persist(file)
+
+	return nil
+}
+
+// removes the file of a persisted session
+func (m *MemoryBackend) unpersistSession(sess *MemorySession) error {
+	if file := sess.persist(nil); file != nil {
+		return file.remove()
+	}
+
+	return nil
+}
+
+// restores the sessions persisted in the SessionPath, files that cannot be
+// restored are renamed and skipped, the mutex must be held
+func (m *MemoryBackend) loadSessions(broker *Broker) error {
+	files, err := ioutil.ReadDir(m.SessionPath)
+	if err != nil {
+		return err
+	}
+
+	m.offlineMutex.Lock()
+	defer m.offlineMutex.Unlock()
+
+	for _, info := range files {
+		// skip other and temporary files
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			continue
+		}
+
+		path := filepath.Join(m.SessionPath, name)
+
+		file, err := OpenFileSession(path)
+		if err != nil {
+			// quarantine file to keep the other sessions available
+			_err := os.Rename(path, path+".corrupt")
+
+			if broker != nil {
+				broker.log(LogWarn, "session_corrupt", map[string]interface{}{
+					"path":    path,
+					"error":   err.Error(),
+					"renamed": _err == nil,
+				})
+			}
+
+			continue
+		}
+
+		// restore state
+		sess := m.newSession()
+		sess.key = string(key)
+		sess.namespace = file.namespace
+		sess.expiresAt = file.expiresAt
+
+		for _, direction := range []string{incoming, outgoing} {
+			for _, pkt := range file.store.All(direction) {
+				sess.store.Save(direction, pkt)
+			}
+		}
+
+		for _, sub := range file.allSubscriptions() {
+			sess.subscriptions.Set(sub.Topic, sub)
+
+			// queue messages for the offline session
+			if sub.QOS >= 1 {
+				m.offlineQueue.Add(sess.namespace+sub.Topic, sess)
+			}
+		}
+
+		sess.will = file.will
+
+		for i, msg := range file.offlineStore {
+			sess.queue(msg, file.deadlines[i])
+		}
+
+		sess.persist(file)
+
+		m.sessions[string(key)] = sess
+	}
+
+	return nil
+}
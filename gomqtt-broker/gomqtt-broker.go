@@ -15,19 +15,46 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/gomqtt/broker"
-	"github.com/gomqtt/transport"
+	"github.com/gomqtt/broker/acme"
+	"github.com/gomqtt/broker/admin"
+	"github.com/gomqtt/broker/metrics"
+	"github.com/gomqtt/broker/passwd"
 )
 
-var url = flag.String("url", "tcp://0.0.0.0:1884", "broker url")
+var url = flag.String("url", "tcp://0.0.0.0:1884", "broker url (overrides GOMQTT_URLS)")
+var adminAddr = flag.String("admin", "", "admin api address (e.g. 127.0.0.1:8080)")
+var metricsAddr = flag.String("metrics", "", "metrics address (e.g. 127.0.0.1:9100)")
+var logLevel = flag.String("log", "", "log level (debug, info, warn or error)")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "graceful shutdown timeout (overrides GOMQTT_DRAIN_TIMEOUT)")
+
+var acmeDomains = flag.String("acme-domains", "", "comma separated domains to obtain tls certificates for using acme")
+var acmeEmail = flag.String("acme-email", "", "acme account email")
+var acmeCache = flag.String("acme-cache", "acme-cache", "acme certificate cache directory")
+var acmeHTTP = flag.String("acme-http", ":80", "acme http challenge address (empty to disable)")
+var acmeDirectory = flag.String("acme-directory", "", "acme directory url (defaults to let's encrypt)")
+
+var passwordFile = flag.String("password-file", "", "password file with bcrypt or argon2id hashes (see gomqtt-passwd)")
+var passwordInterval = flag.Duration("password-interval", 5*time.Second, "interval in which the password file is checked for changes")
+
+var allowAnonymous = flag.Bool("allow-anonymous", false, "allow clients without a username if credentials are configured")
+var anonymousPrefix = flag.String("anonymous-prefix", "", "restrict anonymous clients to topics with the prefix (e.g. public/)")
+
+var authURL = flag.String("auth-url", "", "http endpoint that authenticates clients")
+var aclURL = flag.String("acl-url", "", "http endpoint that authorizes publishes and subscriptions")
+var authFailOpen = flag.Bool("auth-fail-open", false, "allow clients if the auth endpoints fail")
+var aclCacheTTL = flag.Duration("acl-cache-ttl", 0, "duration authorization decisions are cached per client (0 disables the cache)")
 
 var cpuProfile = flag.String("cpuprofile", "", "write cpu profile to file")
 var memProfile = flag.String("memprofile", "", "write memory profile to this file")
@@ -47,34 +74,122 @@ func main() {
 
 	// start
 
-	fmt.Printf("Starting broker on url %s... ", *url)
+	logger := newLogger(*logLevel)
+
+	// password file
+
+	memory := broker.NewMemoryBackend()
+	memory.AllowAnonymous = *allowAnonymous
+	memory.AnonymousPrefix = *anonymousPrefix
+
+	var passwords *passwd.File
+	if *passwordFile != "" {
+		var err error
+		passwords, err = passwd.Load(*passwordFile)
+		if err != nil {
+			panic(err)
+		}
+
+		passwords.Interval = *passwordInterval
+		passwords.Logger = logger
+		memory.Passwords = passwords
+	}
+
+	// http auth
+
+	var backend broker.Backend = memory
+
+	if *authURL != "" || *aclURL != "" {
+		auth := broker.NewHTTPAuthBackend(backend, *authURL, *aclURL)
+		auth.FailOpen = *authFailOpen
+		auth.Logger = logger
+		backend = auth
+	}
+
+	broker := broker.New()
+	broker.Backend = backend
+	broker.Logger = logger
+	broker.AuthorizationCacheTTL = *aclCacheTTL
+
+	if passwords != nil {
+		err := broker.Attach(passwords)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// acme
+
+	if *acmeDomains != "" {
+		manager := acme.NewManager(*acmeCache, strings.Split(*acmeDomains, ",")...)
+		manager.Email = *acmeEmail
+		manager.HTTPAddr = *acmeHTTP
+		manager.DirectoryURL = *acmeDirectory
+
+		config, err := manager.TLSConfig()
+		if err != nil {
+			panic(err)
+		}
+
+		broker.TLSConfig = config
+
+		err = broker.Attach(manager)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// container
 
-	server, err := transport.Launch(*url)
+	container, err := newContainer(broker)
 	if err != nil {
 		panic(err)
 	}
 
-	fmt.Println("Done!")
+	fmt.Printf("Starting broker on urls %s...\n", strings.Join(container.URLs, ", "))
 
-	broker := broker.New()
+	// admin
+
+	if *adminAddr != "" {
+		fmt.Printf("Serving admin api on %s...\n", *adminAddr)
+		report("Admin", broker.Attach(admin.NewServer(broker, *adminAddr)))
+	}
+
+	// metrics
+
+	if *metricsAddr != "" {
+		fmt.Printf("Serving metrics on %s...\n", *metricsAddr)
+		report("Metrics", broker.Attach(metrics.NewServer(broker, *metricsAddr)))
+	}
+
+	// operations
+
+	operations := make(chan os.Signal, 1)
+	signal.Notify(operations, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
 
 	go func() {
-		for {
-			conn, err := server.Accept()
-			if err != nil {
-				panic(err)
+		for sig := range operations {
+			switch sig {
+			case syscall.SIGHUP:
+				report("ReloadConfig", broker.ReloadConfig())
+			case syscall.SIGUSR1:
+				report("RotateLogs", broker.RotateLogs())
+			case syscall.SIGUSR2:
+				report("FlushStats", broker.FlushStats())
+
+				snapshot, err := broker.Snapshot()
+				report("Snapshot", err)
+
+				if err == nil {
+					json.NewEncoder(os.Stdout).Encode(snapshot)
+				}
 			}
-
-			broker.Handle(conn)
 		}
 	}()
 
-	// finish
-
-	finish := make(chan os.Signal, 1)
-	signal.Notify(finish, syscall.SIGINT, syscall.SIGTERM)
+	// run until terminated
 
-	<-finish
+	report("Run", container.Run())
 
 	if *memProfile != "" {
 		fmt.Println("Write memprofile!")
@@ -89,3 +204,50 @@ func main() {
 
 	fmt.Println("Exiting...")
 }
+
+func report(operation string, err error) {
+	if err != nil {
+		fmt.Printf("%s failed: %s\n", operation, err)
+		return
+	}
+
+	fmt.Printf("%s done!\n", operation)
+}
+
+func newContainer(b *broker.Broker) (*broker.Container, error) {
+	container := broker.NewContainer(b)
+	container.URLs = []string{*url}
+	container.DrainTimeout = *shutdownTimeout
+
+	err := container.LoadEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// explicitly set flags take precedence over the environment
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "url":
+			container.URLs = []string{*url}
+		case "shutdown-timeout":
+			container.DrainTimeout = *shutdownTimeout
+		}
+	})
+
+	return container, nil
+}
+
+func newLogger(level string) broker.Logger {
+	switch level {
+	case "debug":
+		return broker.NewJSONLogger(os.Stderr, broker.LogDebug)
+	case "info":
+		return broker.NewJSONLogger(os.Stderr, broker.LogInfo)
+	case "warn":
+		return broker.NewJSONLogger(os.Stderr, broker.LogWarn)
+	case "error":
+		return broker.NewJSONLogger(os.Stderr, broker.LogError)
+	}
+
+	return nil
+}
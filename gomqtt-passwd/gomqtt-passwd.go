@@ -0,0 +1,106 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The gomqtt-passwd tool hashes the password that is read from stdin and
+// prints the password file line of the user or updates the line in an
+// existing password file (see the passwd package).
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/gomqtt/broker/passwd"
+)
+
+var file = flag.String("file", "", "password file to update (prints the line if empty)")
+var argon2id = flag.Bool("argon2id", false, "use argon2id instead of bcrypt")
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() != 1 || strings.Contains(flag.Arg(0), ":") {
+		fmt.Fprintln(os.Stderr, "usage: gomqtt-passwd [-file path] [-argon2id] username < password")
+		os.Exit(2)
+	}
+
+	user := flag.Arg(0)
+
+	// read password
+
+	reader := bufio.NewReader(os.Stdin)
+	password, err := reader.ReadString('\n')
+	if err != nil && password == "" {
+		fail(err)
+	}
+
+	password = strings.TrimRight(password, "\r\n")
+
+	// hash password
+
+	algorithm := passwd.Bcrypt
+	if *argon2id {
+		algorithm = passwd.Argon2id
+	}
+
+	hash, err := passwd.Hash(password, algorithm)
+	if err != nil {
+		fail(err)
+	}
+
+	line := user + ":" + hash
+
+	if *file == "" {
+		fmt.Println(line)
+		return
+	}
+
+	// replace or append the line of the user
+
+	data, err := ioutil.ReadFile(*file)
+	if err != nil && !os.IsNotExist(err) {
+		fail(err)
+	}
+
+	var lines []string
+	replaced := false
+	for _, l := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if strings.HasPrefix(l, user+":") {
+			l = line
+			replaced = true
+		}
+
+		if l != "" || len(lines) > 0 {
+			lines = append(lines, l)
+		}
+	}
+
+	if !replaced {
+		lines = append(lines, line)
+	}
+
+	err = ioutil.WriteFile(*file, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	if err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
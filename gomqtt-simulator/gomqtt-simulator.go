@@ -0,0 +1,318 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The gomqtt-simulator drives an in-process broker with a synthetic client
+// population and reports the resource usage and delivery latency, which helps
+// to size hardware before deploying the broker.
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gomqtt/broker"
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/transport"
+)
+
+var url = flag.String("url", "tcp://localhost:1885", "internal broker url")
+var clients = flag.Int("clients", 100, "number of simulated clients")
+var topics = flag.Int("topics", 10, "number of distinct topics")
+var distribution = flag.String("distribution", "uniform", "topic distribution (uniform or zipf)")
+var rate = flag.Float64("rate", 1, "messages per second per client")
+var size = flag.Int("size", 64, "payload size in bytes")
+var churn = flag.Float64("churn", 0, "reconnects per second across all clients")
+var duration = flag.Duration("duration", 10*time.Second, "duration of the simulation")
+
+var sent int64
+var received int64
+var reconnects int64
+
+var latencies []time.Duration
+var latenciesMutex sync.Mutex
+
+var quit = make(chan struct{})
+
+func main() {
+	flag.Parse()
+
+	if *size < 8 {
+		*size = 8
+	}
+
+	fmt.Printf("Simulating %d clients on %d topics (%s) for %s\n", *clients, *topics, *distribution, *duration)
+
+	// start broker
+
+	engine := broker.New()
+
+	err := engine.Launch(*url)
+	if err != nil {
+		panic(err)
+	}
+
+	// start clients
+
+	population := make([]*simulatedClient, *clients)
+
+	for i := range population {
+		population[i] = newSimulatedClient(i)
+		go population[i].run()
+	}
+
+	if *churn > 0 {
+		go churner(population)
+	}
+
+	go func() {
+		finish := make(chan os.Signal, 1)
+		signal.Notify(finish, syscall.SIGINT, syscall.SIGTERM)
+
+		select {
+		case <-finish:
+		case <-time.After(*duration):
+		}
+
+		close(quit)
+	}()
+
+	reporter()
+
+	engine.Close(time.Second)
+}
+
+type simulatedClient struct {
+	id      string
+	topic   string
+	random  *rand.Rand
+	zipf    *rand.Zipf
+	restart chan struct{}
+}
+
+func newSimulatedClient(i int) *simulatedClient {
+	c := &simulatedClient{
+		id:      "gomqtt-simulator/" + strconv.Itoa(i),
+		random:  rand.New(rand.NewSource(int64(i))),
+		restart: make(chan struct{}, 1),
+	}
+
+	if *distribution == "zipf" && *topics > 1 {
+		c.zipf = rand.NewZipf(c.random, 1.1, 1, uint64(*topics-1))
+	}
+
+	c.topic = c.nextTopic()
+
+	return c
+}
+
+func (c *simulatedClient) nextTopic() string {
+	if c.zipf != nil {
+		return "simulator/" + strconv.FormatUint(c.zipf.Uint64(), 10)
+	}
+
+	return "simulator/" + strconv.Itoa(c.random.Intn(*topics))
+}
+
+func (c *simulatedClient) run() {
+	for {
+		conn := c.connect()
+
+		done := make(chan struct{})
+		go c.receive(conn, done)
+
+		c.publish(conn, done)
+
+		conn.Close()
+		<-done
+
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		atomic.AddInt64(&reconnects, 1)
+	}
+}
+
+func (c *simulatedClient) connect() transport.Conn {
+	conn, err := transport.Dial(*url)
+	if err != nil {
+		panic(err)
+	}
+
+	connect := packet.NewConnectPacket()
+	connect.ClientID = c.id
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.PacketID = 1
+	subscribe.Subscriptions = []packet.Subscription{
+		{Topic: c.topic, QOS: 0},
+	}
+
+	for _, pkt := range []packet.Packet{connect, subscribe} {
+		err = conn.Send(pkt)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return conn
+}
+
+func (c *simulatedClient) receive(conn transport.Conn, done chan struct{}) {
+	defer close(done)
+
+	for {
+		pkt, err := conn.Receive()
+		if err != nil {
+			return
+		}
+
+		publish, ok := pkt.(*packet.PublishPacket)
+		if !ok || len(publish.Message.Payload) < 8 {
+			continue
+		}
+
+		nanos := int64(binary.BigEndian.Uint64(publish.Message.Payload))
+		record(time.Duration(time.Now().UnixNano() - nanos))
+	}
+}
+
+func (c *simulatedClient) publish(conn transport.Conn, done chan struct{}) {
+	interval := time.Duration(float64(time.Second) / *rate)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-done:
+			return
+		case <-c.restart:
+			return
+		case <-ticker.C:
+		}
+
+		payload := make([]byte, *size)
+		binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+
+		publish := packet.NewPublishPacket()
+		publish.Message.Topic = c.nextTopic()
+		publish.Message.Payload = payload
+
+		err := conn.Send(publish)
+		if err != nil {
+			return
+		}
+
+		atomic.AddInt64(&sent, 1)
+	}
+}
+
+func churner(population []*simulatedClient) {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	interval := time.Duration(float64(time.Second) / *churn)
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(interval):
+		}
+
+		select {
+		case population[random.Intn(len(population))].restart <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func record(latency time.Duration) {
+	atomic.AddInt64(&received, 1)
+
+	latenciesMutex.Lock()
+	latencies = append(latencies, latency)
+	latenciesMutex.Unlock()
+}
+
+func reporter() {
+	var cpu time.Duration
+	var mem runtime.MemStats
+
+	for {
+		select {
+		case <-quit:
+			fmt.Println("Done!")
+			return
+		case <-time.After(1 * time.Second):
+		}
+
+		// get latencies
+
+		latenciesMutex.Lock()
+		samples := latencies
+		latencies = nil
+		latenciesMutex.Unlock()
+
+		sort.Sort(durations(samples))
+
+		// get cpu time
+
+		var usage syscall.Rusage
+		syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+
+		total := time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+		load := float64(total-cpu) / float64(time.Second) * 100
+		cpu = total
+
+		// get memory
+
+		runtime.ReadMemStats(&mem)
+
+		fmt.Printf("Sent: %d msgs - ", atomic.SwapInt64(&sent, 0))
+		fmt.Printf("Received: %d msgs - ", atomic.SwapInt64(&received, 0))
+		fmt.Printf("Reconnects: %d - ", atomic.SwapInt64(&reconnects, 0))
+		fmt.Printf("Latency: p50=%s p99=%s - ", percentile(samples, 0.5), percentile(samples, 0.99))
+		fmt.Printf("CPU: %.1f%% - ", load)
+		fmt.Printf("Memory: %d KB - ", mem.HeapAlloc/1024)
+		fmt.Printf("Goroutines: %d\n", runtime.NumGoroutine())
+	}
+}
+
+func percentile(samples []time.Duration, p float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+
+	return samples[int(float64(len(samples)-1)*p)]
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
@@ -88,8 +88,10 @@ func (c *Context) Get(key string) interface{} {
 
 // a fake client for testing backend implementations
 type fakeClient struct {
-	in  []*packet.Message
-	ctx *Context
+	in     []*packet.Message
+	ctx    *Context
+	closed bool
+	mutex  sync.Mutex
 }
 
 // returns a new fake client
@@ -102,14 +104,34 @@ func newFakeClient() *fakeClient {
 	}
 }
 
-// publish will append the message to the in slice
-func (c *fakeClient) Publish(msg *packet.Message) bool {
+// publish will append the message to the in slice or return ErrClientOffline
+// if the client has been closed
+func (c *fakeClient) Publish(msg *packet.Message) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return ErrClientOffline
+	}
+
 	c.in = append(c.in, msg)
-	return true
+	return nil
+}
+
+// marks the client as closed
+func (c *fakeClient) Close(clean bool) {
+	c.mutex.Lock()
+	c.closed = true
+	c.mutex.Unlock()
 }
 
-// does nothing atm
-func (c *fakeClient) Close(clean bool) {}
+// returns the received messages
+func (c *fakeClient) received() []*packet.Message {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]*packet.Message{}, c.in...)
+}
 
 // returns the context
 func (c *fakeClient) Context() *Context {
@@ -0,0 +1,140 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gomqtt/packet"
+)
+
+// A HistoryStore is a Backend that keeps the recent messages of topics and is
+// able to replay them to new subscribers.
+//
+// Clients request a replay by subscribing to a filter that begins with the
+// brokers ReplayPrefix followed by the number of messages, e.g.
+// "$replay/10/sensors/+/temperature". The client is then subscribed to the
+// remaining filter and receives up to the requested number of recent messages
+// of every matching topic instead of the retained messages.
+type HistoryStore interface {
+	// History should return up to the last n messages of every topic that
+	// matches the filter and is visible to the client, ordered from oldest to
+	// newest per topic.
+	History(client Client, filter string, n int) ([]*packet.Message, error)
+}
+
+// History will return up to the last n messages of every matching topic. At
+// most HistorySize messages are kept per topic. Isolated clients only receive
+// the messages of their tenant.
+func (m *MemoryBackend) History(client Client, filter string, n int) ([]*packet.Message, error) {
+	m.historyMutex.Lock()
+	defer m.historyMutex.Unlock()
+
+	ns := m.namespace(client)
+
+	var msgs []*packet.Message
+
+	for _, value := range m.history.Search(ns + filter) {
+		history, ok := value.(*topicHistory)
+		if !ok {
+			continue
+		}
+
+		recent := history.messages
+		if len(recent) > n {
+			recent = recent[len(recent)-n:]
+		}
+
+		for _, msg := range recent {
+			// replayed messages are flagged like retained messages
+			replayed := *localized(ns, msg)
+			replayed.Retain = true
+			msgs = append(msgs, &replayed)
+		}
+	}
+
+	return msgs, nil
+}
+
+// the recent messages of a topic, the history mutex must be held
+type topicHistory struct {
+	messages []*packet.Message
+}
+
+// records a published message in the history of its topic, clearing the
+// retained message of a topic also clears its history
+func (m *MemoryBackend) record(msg *packet.Message) {
+	if m.HistorySize <= 0 {
+		return
+	}
+
+	m.historyMutex.Lock()
+	defer m.historyMutex.Unlock()
+
+	if len(msg.Payload) == 0 {
+		if msg.Retain {
+			m.history.Empty(msg.Topic)
+		}
+
+		return
+	}
+
+	// get or create history
+	var history *topicHistory
+	if values := m.history.Get(msg.Topic); len(values) > 0 {
+		history, _ = values[0].(*topicHistory)
+	}
+
+	if history == nil {
+		history = &topicHistory{}
+		m.history.Set(msg.Topic, history)
+	}
+
+	// drop oldest messages
+	if len(history.messages) >= m.HistorySize {
+		history.messages = append([]*packet.Message{}, history.messages[len(history.messages)-m.HistorySize+1:]...)
+	}
+
+	history.messages = append(history.messages, msg)
+}
+
+// parses a replay subscription and returns the remaining filter and the
+// number of requested messages, malformed replay subscriptions return a zero
+// number of messages
+func (b *Broker) parseReplay(filter string) (string, int, bool) {
+	// check if replay is supported
+	if _, ok := b.Backend.(HistoryStore); !ok || b.ReplayPrefix == "" {
+		return filter, 0, false
+	}
+
+	// check prefix
+	if !strings.HasPrefix(filter, b.ReplayPrefix) {
+		return filter, 0, false
+	}
+
+	// split number of messages and filter
+	segments := strings.SplitN(strings.TrimPrefix(filter, b.ReplayPrefix), "/", 2)
+	if len(segments) != 2 || segments[1] == "" {
+		return filter, 0, true
+	}
+
+	n, err := strconv.Atoi(segments[0])
+	if err != nil || n <= 0 {
+		return filter, 0, true
+	}
+
+	return segments[1], n, true
+}
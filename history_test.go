@@ -0,0 +1,167 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryBackendHistory(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.HistorySize = 2
+
+	client := newFakeClient()
+
+	for i := 1; i <= 3; i++ {
+		err := backend.Publish(client, &packet.Message{
+			Topic:   "foo",
+			Payload: []byte(fmt.Sprintf("%d", i)),
+		})
+		assert.NoError(t, err)
+	}
+
+	msgs, err := backend.History(client, "#", 5)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, []byte("2"), msgs[0].Payload)
+	assert.Equal(t, []byte("3"), msgs[1].Payload)
+	assert.True(t, msgs[0].Retain)
+
+	msgs, err = backend.History(client, "foo", 1)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, []byte("3"), msgs[0].Payload)
+
+	// clearing the retained message clears the history
+	err = backend.Publish(client, &packet.Message{Topic: "foo", Retain: true})
+	assert.NoError(t, err)
+
+	msgs, err = backend.History(client, "foo", 1)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+}
+
+func TestParseReplay(t *testing.T) {
+	broker := New()
+
+	filter, n, ok := broker.parseReplay("foo/bar")
+	assert.Equal(t, "foo/bar", filter)
+	assert.Equal(t, 0, n)
+	assert.False(t, ok)
+
+	filter, n, ok = broker.parseReplay("$replay/10/foo/+")
+	assert.Equal(t, "foo/+", filter)
+	assert.Equal(t, 10, n)
+	assert.True(t, ok)
+
+	_, n, ok = broker.parseReplay("$replay/foo/bar")
+	assert.Equal(t, 0, n)
+	assert.True(t, ok)
+
+	_, n, ok = broker.parseReplay("$replay/10")
+	assert.Equal(t, 0, n)
+	assert.True(t, ok)
+}
+
+func TestReplay(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	publish1 := packet.NewPublishPacket()
+	publish1.Message.Topic = "test"
+	publish1.Message.Payload = []byte("1")
+
+	publish2 := packet.NewPublishPacket()
+	publish2.Message.Topic = "test"
+	publish2.Message.Payload = []byte("2")
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "$replay/2/test"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	replayed1 := packet.NewPublishPacket()
+	replayed1.Message = publish1.Message
+	replayed1.Message.Retain = true
+
+	replayed2 := packet.NewPublishPacket()
+	replayed2.Message = publish2.Message
+	replayed2.Message.Retain = true
+
+	invalid := packet.NewSubscribePacket()
+	invalid.Subscriptions = []packet.Subscription{{Topic: "$replay/all/test"}}
+	invalid.PacketID = 2
+
+	failure := packet.NewSubackPacket()
+	failure.ReturnCodes = []uint8{packet.QOSFailure}
+	failure.PacketID = 2
+
+	unsubscribe := packet.NewUnsubscribePacket()
+	unsubscribe.Topics = []string{"$replay/2/test"}
+	unsubscribe.PacketID = 3
+
+	unsuback := packet.NewUnsubackPacket()
+	unsuback.PacketID = 3
+
+	backend := NewMemoryBackend()
+	backend.HistorySize = 5
+
+	broker := New()
+	broker.Backend = backend
+
+	port, done := runBroker(t, broker, 2)
+
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(publish1).
+		Send(publish2).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn1)
+
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Receive(replayed1).
+		Receive(replayed2).
+		Send(invalid).
+		Receive(failure).
+		Send(unsubscribe).
+		Receive(unsuback).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn2)
+
+	<-done
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gomqtt/packet"
+)
+
+// An Observer is an asynchronous hook that observes the packets received from
+// clients (see Observe). Observers must not modify the packets.
+type Observer func(client Client, pkt packet.Packet)
+
+// HookStats describe the calls of a synchronous Middleware or an asynchronous
+// Observer.
+type HookStats struct {
+	// The name of the hook. Middleware is named by its type.
+	Name  string
+	Async bool
+
+	// The number of calls, recovered panics and packets dropped because the
+	// queue of the observer was full.
+	Calls   int64
+	Panics  int64
+	Dropped int64
+
+	// The total and the maximum duration of the calls.
+	Latency    time.Duration
+	MaxLatency time.Duration
+}
+
+// the statistics of a hook
+type hookStats struct {
+	stats HookStats
+	mutex sync.Mutex
+}
+
+// records a call
+func (s *hookStats) record(latency time.Duration, panicked bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.stats.Calls++
+	s.stats.Latency += latency
+	if latency > s.stats.MaxLatency {
+		s.stats.MaxLatency = latency
+	}
+	if panicked {
+		s.stats.Panics++
+	}
+}
+
+// records a dropped packet
+func (s *hookStats) drop() {
+	s.mutex.Lock()
+	s.stats.Dropped++
+	s.mutex.Unlock()
+}
+
+// returns a copy of the statistics
+func (s *hookStats) get() HookStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.stats
+}
+
+// a packet that has been processed for a client
+type observation struct {
+	client Client
+	pkt    packet.Packet
+}
+
+// an asynchronous hook with its queue
+type observer struct {
+	id       uint64
+	observer Observer
+	queue    chan observation
+	quit     chan struct{}
+	done     chan struct{}
+	stats    *hookStats
+}
+
+// the registered asynchronous hooks
+type hookRegistry struct {
+	observers []*observer
+	next      uint64
+	mutex     sync.RWMutex
+}
+
+// Observe will register the observer as an asynchronous hook that is called
+// with every packet received from a client once the packet has been
+// processed, i.e. after the Backend calls caused by the packet have returned
+// and the responses have been sent. Unlike the synchronous Middleware (see
+// Use), which is called before a packet is processed and may mutate or
+// reject it, observers never block the clients.
+//
+// Every observer is called from its own goroutine with the packets in the
+// order they have been processed, which preserves the order of the packets of
+// every client. Packets are dropped while the queue of the observer holds
+// size packets. Panics of the observer are recovered and the observer is
+// called with the next packet. The name identifies the observer in the
+// HookStats. The returned function removes the observer and waits until its
+// current call has returned.
+func (b *Broker) Observe(name string, size int, o Observer) func() {
+	obs := &observer{
+		observer: o,
+		queue:    make(chan observation, size),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+		stats:    &hookStats{stats: HookStats{Name: name, Async: true}},
+	}
+
+	b.hooks.mutex.Lock()
+	b.hooks.next++
+	obs.id = b.hooks.next
+	b.hooks.observers = append(b.hooks.observers, obs)
+	b.hooks.mutex.Unlock()
+
+	go obs.run()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			b.hooks.remove(obs.id)
+			close(obs.quit)
+			<-obs.done
+		})
+	}
+}
+
+// HookStats returns the statistics of the registered Middleware in order
+// followed by the statistics of the registered observers.
+func (b *Broker) HookStats() []HookStats {
+	var list []HookStats
+
+	for _, stats := range b.middlewareStats {
+		list = append(list, stats.get())
+	}
+
+	b.hooks.mutex.RLock()
+	defer b.hooks.mutex.RUnlock()
+
+	for _, obs := range b.hooks.observers {
+		list = append(list, obs.stats.get())
+	}
+
+	return list
+}
+
+// removes an observer
+func (r *hookRegistry) remove(id uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i, obs := range r.observers {
+		if obs.id == id {
+			r.observers = append(r.observers[:i:i], r.observers[i+1:]...)
+			return
+		}
+	}
+}
+
+// queues a processed packet for all observers
+func (r *hookRegistry) dispatch(client Client, pkt packet.Packet) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, obs := range r.observers {
+		select {
+		case obs.queue <- observation{client: client, pkt: pkt}:
+		default:
+			obs.stats.drop()
+		}
+	}
+}
+
+// calls the observer with the queued packets
+func (o *observer) run() {
+	defer close(o.done)
+
+	for {
+		select {
+		case <-o.quit:
+			return
+		case obs := <-o.queue:
+			o.call(obs)
+		}
+	}
+}
+
+// calls the observer and recovers a panic
+func (o *observer) call(obs observation) {
+	start := time.Now()
+	panicked := true
+
+	defer func() {
+		recover()
+		o.stats.record(time.Since(start), panicked)
+	}()
+
+	o.observer(obs.client, obs.pkt)
+	panicked = false
+}
+
+// calls a middleware function, records the latency and converts a panic to an
+// error
+func (s *hookStats) call(fn func() (packet.Packet, error)) (pkt packet.Packet, err error) {
+	start := time.Now()
+	panicked := true
+
+	defer func() {
+		if v := recover(); panicked {
+			pkt, err = nil, fmt.Errorf("middleware panicked: %v", v)
+		}
+
+		s.record(time.Since(start), panicked)
+	}()
+
+	pkt, err = fn()
+	panicked = false
+
+	return pkt, err
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+type panicMiddleware struct{}
+
+func (m *panicMiddleware) Inbound(client Client, pkt packet.Packet) (packet.Packet, error) {
+	if _, ok := pkt.(*packet.PublishPacket); ok {
+		panic("test")
+	}
+
+	return pkt, nil
+}
+
+func (m *panicMiddleware) Outbound(client Client, pkt packet.Packet) (packet.Packet, error) {
+	return pkt, nil
+}
+
+func TestObserve(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("test")
+
+	broker := New()
+
+	observed := make(chan packet.Type, 10)
+	remove1 := broker.Observe("collector", 10, func(client Client, pkt packet.Packet) {
+		observed <- pkt.Type()
+	})
+
+	remove2 := broker.Observe("panicking", 10, func(client Client, pkt packet.Packet) {
+		panic("test")
+	})
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(publish).
+		Receive(publish).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	// packets are observed in order after processing
+	var types []packet.Type
+	for len(types) < 4 {
+		types = append(types, <-observed)
+	}
+
+	assert.Equal(t, []packet.Type{packet.CONNECT, packet.SUBSCRIBE, packet.PUBLISH, packet.DISCONNECT}, types)
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return broker.HookStats()[1].Calls == 4
+	})
+
+	remove1()
+	remove2()
+
+	assert.Empty(t, broker.HookStats())
+}
+
+func TestHookStats(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+
+	broker := New()
+	broker.Use(&panicMiddleware{})
+
+	observed := make(chan struct{})
+	remove := broker.Observe("panicking", 10, func(client Client, pkt packet.Packet) {
+		defer close(observed)
+		panic("test")
+	})
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	// a panicking middleware closes the connection
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(publish).
+		End().
+		Test(t, conn)
+
+	<-done
+	<-observed
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return broker.HookStats()[1].Panics == 1
+	})
+
+	stats := broker.HookStats()
+	assert.Len(t, stats, 2)
+	assert.Equal(t, "*broker.panicMiddleware", stats[0].Name)
+	assert.False(t, stats[0].Async)
+	assert.Equal(t, int64(1), stats[0].Panics)
+	assert.True(t, stats[0].Calls >= 3)
+	assert.True(t, stats[0].MaxLatency <= stats[0].Latency)
+	assert.Equal(t, "panicking", stats[1].Name)
+	assert.True(t, stats[1].Async)
+	assert.Equal(t, int64(1), stats[1].Calls)
+	assert.Equal(t, int64(1), stats[1].Panics)
+
+	remove()
+}
@@ -0,0 +1,326 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The values of the result in an HTTPAuthResponse.
+const (
+	HTTPAuthAllow  = "allow"
+	HTTPAuthDeny   = "deny"
+	HTTPAuthIgnore = "ignore"
+)
+
+// An HTTPAuthRequest is the JSON body posted to the endpoints of an
+// HTTPAuthBackend. The action is "connect" for authentications and "publish"
+// or "subscribe" for authorizations.
+type HTTPAuthRequest struct {
+	Action   string `json:"action"`
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	RemoteIP string `json:"remote_ip,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+}
+
+// An HTTPAuthResponse is the JSON body expected from the endpoints of an
+// HTTPAuthBackend. The result is HTTPAuthAllow, HTTPAuthDeny or HTTPAuthIgnore,
+// which leaves the decision to the wrapped Backend. A response without a body
+// and the status 204 allows the request.
+type HTTPAuthResponse struct {
+	Result string `json:"result"`
+}
+
+// An HTTPAuthBackend wraps another Backend and delegates the authentication
+// and authorization of clients to external HTTP endpoints, which receive an
+// HTTPAuthRequest and answer with an HTTPAuthResponse. The decisions are
+// cached and requests that fail or time out are denied unless FailOpen is set.
+// All other calls are forwarded to the wrapped Backend.
+type HTTPAuthBackend struct {
+	Backend
+
+	// The URLs of the endpoints that decide about authentications and
+	// authorizations. Decisions without an URL are left to the wrapped
+	// Backend.
+	AuthenticateURL string
+	AuthorizeURL    string
+
+	// The client used for the requests, defaults to a client with a timeout
+	// of five seconds.
+	Client *http.Client
+
+	// Decisions are cached for the CacheTTL, which avoids a request for every
+	// publish. The cache is reset once it holds CacheSize decisions. A zero
+	// CacheTTL disables the cache.
+	CacheTTL  time.Duration
+	CacheSize int
+
+	// If FailOpen is set to true, requests that fail, time out or return an
+	// unexpected response are allowed instead of denied.
+	FailOpen bool
+
+	Logger Logger
+
+	cache map[string]httpAuthDecision
+	mutex sync.Mutex
+}
+
+// a cached decision
+type httpAuthDecision struct {
+	result  string
+	expires time.Time
+}
+
+// NewHTTPAuthBackend returns a new HTTPAuthBackend that wraps the specified
+// Backend and posts the authentications and authorizations to the specified
+// URLs.
+func NewHTTPAuthBackend(backend Backend, authenticateURL, authorizeURL string) *HTTPAuthBackend {
+	return &HTTPAuthBackend{
+		Backend:         backend,
+		AuthenticateURL: authenticateURL,
+		AuthorizeURL:    authorizeURL,
+		Client:          &http.Client{Timeout: 5 * time.Second},
+		CacheTTL:        time.Minute,
+		CacheSize:       10000,
+	}
+}
+
+// Authenticate will post the credentials of the client to the
+// AuthenticateURL.
+func (h *HTTPAuthBackend) Authenticate(client Client, user, password string) (bool, error) {
+	if h.AuthenticateURL == "" {
+		return h.Backend.Authenticate(client, user, password)
+	}
+
+	req := h.request(client, "connect")
+	req.Username = user
+	req.Password = password
+
+	switch h.decide(h.AuthenticateURL, req) {
+	case HTTPAuthAllow:
+		return true, nil
+	case HTTPAuthIgnore:
+		return h.Backend.Authenticate(client, user, password)
+	}
+
+	return false, nil
+}
+
+// Authorize will post the action of the client to the AuthorizeURL. Allowed
+// actions must be allowed by the wrapped Backend as well.
+func (h *HTTPAuthBackend) Authorize(client Client, topic string, action Action) (bool, error) {
+	if h.AuthorizeURL == "" {
+		return h.Backend.Authorize(client, topic, action)
+	}
+
+	name := "subscribe"
+	if action == PublishAction {
+		name = "publish"
+	}
+
+	req := h.request(client, name)
+	req.Topic = topic
+
+	if h.decide(h.AuthorizeURL, req) == HTTPAuthDeny {
+		return false, nil
+	}
+
+	return h.Backend.Authorize(client, topic, action)
+}
+
+// Reload will drop the cached decisions and reload the wrapped Backend if it
+// implements the Reloader interface.
+func (h *HTTPAuthBackend) Reload() error {
+	h.mutex.Lock()
+	h.cache = nil
+	h.mutex.Unlock()
+
+	if reloader, ok := h.Backend.(Reloader); ok {
+		return reloader.Reload()
+	}
+
+	return nil
+}
+
+// Validate will check the configuration of the backend and the wrapped
+// Backend and return a ValidationError listing all found problems.
+func (h *HTTPAuthBackend) Validate() error {
+	var problems ValidationError
+
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+
+	if validator, ok := h.Backend.(Validator); ok {
+		err := validator.Validate()
+		if list, ok := err.(ValidationError); ok {
+			problems = append(problems, list...)
+		} else if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	check(h.Backend != nil, "Backend must be set")
+	check(h.Client != nil, "Client must be set")
+	check(h.CacheTTL >= 0, "CacheTTL must not be negative")
+	check(h.CacheTTL == 0 || h.CacheSize > 0, "CacheTTL requires a positive CacheSize")
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	return nil
+}
+
+// returns a request with the identity of the client
+func (h *HTTPAuthBackend) request(client Client, action string) HTTPAuthRequest {
+	ctx := client.Context()
+
+	req := HTTPAuthRequest{Action: action}
+	req.ClientID, _ = ctx.Get("client_id").(string)
+	req.Username, _ = ctx.Get("username").(string)
+	req.RemoteIP, _ = ctx.Get("remote_ip").(string)
+
+	return req
+}
+
+// returns the cached or requested result, failed requests are not cached
+func (h *HTTPAuthBackend) decide(url string, req HTTPAuthRequest) string {
+	key := httpAuthKey(req)
+
+	// check cache
+	if result, ok := h.cached(key); ok {
+		return result
+	}
+
+	result, err := h.post(url, req)
+	if err != nil {
+		h.log(LogError, "http_auth_failed", map[string]interface{}{
+			"action":    req.Action,
+			"client_id": req.ClientID,
+			"topic":     req.Topic,
+			"error":     err,
+		})
+
+		if h.FailOpen {
+			return HTTPAuthAllow
+		}
+
+		return HTTPAuthDeny
+	}
+
+	h.store(key, result)
+
+	return result
+}
+
+// posts the request and returns the result of the response
+func (h *HTTPAuthBackend) post(url string, req HTTPAuthRequest) (string, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := h.Client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	defer res.Body.Close()
+
+	// allow requests without content
+	if res.StatusCode == http.StatusNoContent {
+		return HTTPAuthAllow, nil
+	} else if res.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, res.Body)
+		return "", fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	var response HTTPAuthResponse
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return "", err
+	}
+
+	switch response.Result {
+	case HTTPAuthAllow, HTTPAuthDeny, HTTPAuthIgnore:
+		return response.Result, nil
+	}
+
+	return "", fmt.Errorf("unexpected result %q", response.Result)
+}
+
+// returns a cached result
+func (h *HTTPAuthBackend) cached(key string) (string, bool) {
+	if h.CacheTTL <= 0 {
+		return "", false
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	decision, ok := h.cache[key]
+	if !ok || !time.Now().Before(decision.expires) {
+		return "", false
+	}
+
+	return decision.result, true
+}
+
+// caches a result
+func (h *HTTPAuthBackend) store(key, result string) {
+	if h.CacheTTL <= 0 {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.cache == nil || len(h.cache) >= h.CacheSize {
+		h.cache = make(map[string]httpAuthDecision)
+	}
+
+	h.cache[key] = httpAuthDecision{
+		result:  result,
+		expires: time.Now().Add(h.CacheTTL),
+	}
+}
+
+// logs a backend event
+func (h *HTTPAuthBackend) log(level LogLevel, event string, fields map[string]interface{}) {
+	logEvent(h.Logger, level, event, fields)
+}
+
+// returns the cache key of the request, the password is hashed so that it is
+// not kept in memory
+func httpAuthKey(req HTTPAuthRequest) string {
+	sum := sha256.Sum256([]byte(req.Password))
+
+	return req.Action + "\x00" + req.ClientID + "\x00" + req.Username + "\x00" +
+		req.RemoteIP + "\x00" + req.Topic + "\x00" + hex.EncodeToString(sum[:])
+}
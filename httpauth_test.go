@@ -0,0 +1,136 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPAuthBackend(t *testing.T) {
+	var requests int64
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+
+		var req HTTPAuthRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		assert.NoError(t, err)
+		assert.Equal(t, "test", req.ClientID)
+
+		result := HTTPAuthAllow
+		switch {
+		case req.Action == "connect" && req.Password != "secret":
+			result = HTTPAuthDeny
+		case req.Action == "connect" && req.Username == "legacy":
+			result = HTTPAuthIgnore
+		case req.Action == "publish" && req.Topic == "deny":
+			result = HTTPAuthDeny
+		case req.Action == "subscribe" && req.Topic == "empty":
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		json.NewEncoder(w).Encode(HTTPAuthResponse{Result: result})
+	}))
+	defer server.Close()
+
+	memory := NewMemoryBackend()
+	memory.Logins = map[string]string{"legacy": "secret"}
+
+	backend := NewHTTPAuthBackend(memory, server.URL+"/auth", server.URL+"/acl")
+	assert.NoError(t, backend.Validate())
+
+	client := newFakeClient()
+	client.Context().Set("client_id", "test")
+
+	ok, err := backend.Authenticate(client, "foo", "secret")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = backend.Authenticate(client, "foo", "wrong")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// ignored decisions are left to the wrapped backend
+	ok, err = backend.Authenticate(client, "legacy", "secret")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = backend.Authorize(client, "allow", PublishAction)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = backend.Authorize(client, "deny", PublishAction)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = backend.Authorize(client, "empty", SubscribeAction)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// decisions are cached
+	assert.Equal(t, int64(6), atomic.LoadInt64(&requests))
+
+	ok, err = backend.Authorize(client, "deny", PublishAction)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, int64(6), atomic.LoadInt64(&requests))
+
+	backend.CacheTTL = 0
+
+	ok, err = backend.Authorize(client, "deny", PublishAction)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, int64(7), atomic.LoadInt64(&requests))
+}
+
+func TestHTTPAuthBackendFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	backend := NewHTTPAuthBackend(NewMemoryBackend(), server.URL, server.URL)
+	backend.Client.Timeout = 10 * time.Millisecond
+
+	client := newFakeClient()
+
+	// fail closed
+	ok, err := backend.Authenticate(client, "foo", "bar")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = backend.Authorize(client, "foo", PublishAction)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// fail open
+	backend.FailOpen = true
+
+	ok, err = backend.Authenticate(client, "foo", "bar")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = backend.Authorize(client, "foo", PublishAction)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sort"
+
+	"github.com/gomqtt/packet"
+)
+
+// SubscriptionIdentifiersAnnotation is the metadata key of the MQTT 5
+// subscription identifiers of the subscriptions that matched an outgoing
+// publish (see Broker.Annotate). The value is a sorted []uint32.
+//
+// The identifiers are obtained using the SubscriptionIdentifier callback and
+// stored in sessions that implement the IdentifierSession interface, so that
+// they survive reconnects and imports. An outbound Middleware may encode the
+// attached identifiers.
+const SubscriptionIdentifiersAnnotation = "subscription_identifiers"
+
+// stores the identifier of a saved subscription if enabled
+func (c *remoteClient) saveIdentifier(sub packet.Subscription) error {
+	if c.broker.SubscriptionIdentifier == nil {
+		return nil
+	}
+
+	store, ok := c.session.(IdentifierSession)
+	if !ok {
+		return nil
+	}
+
+	return store.SaveIdentifier(sub.Topic, c.broker.SubscriptionIdentifier(c, sub))
+}
+
+// attaches the identifiers of the matching subscriptions to an outgoing
+// publish
+func (c *remoteClient) attachIdentifiers(msg *packet.Message) error {
+	if c.broker.SubscriptionIdentifier == nil {
+		return nil
+	}
+
+	store, ok := c.session.(IdentifierSession)
+	if !ok {
+		return nil
+	}
+
+	ids, err := store.MatchIdentifiers(msg.Topic)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	c.broker.Annotate(msg, SubscriptionIdentifiersAnnotation, ids)
+
+	return nil
+}
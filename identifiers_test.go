@@ -0,0 +1,111 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+// a middleware that prefixes the payload of outgoing publishes with the
+// subscription identifiers
+type identifiersMiddleware struct {
+	broker *Broker
+}
+
+func (m *identifiersMiddleware) Inbound(client Client, pkt packet.Packet) (packet.Packet, error) {
+	return pkt, nil
+}
+
+func (m *identifiersMiddleware) Outbound(client Client, pkt packet.Packet) (packet.Packet, error) {
+	if p, ok := pkt.(*packet.PublishPacket); ok {
+		ids, _ := m.broker.Annotations(&p.Message)[SubscriptionIdentifiersAnnotation].([]uint32)
+		p.Message.Payload = append([]byte(fmt.Sprintf("%v:", ids)), p.Message.Payload...)
+	}
+
+	return pkt, nil
+}
+
+func TestSubscriptionIdentifiers(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{
+		{Topic: "foo/#"},
+		{Topic: "foo/+"},
+		{Topic: "bar"},
+	}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0, 0, 0}
+	suback.PacketID = 1
+
+	publish1 := packet.NewPublishPacket()
+	publish1.Message.Topic = "foo/bar"
+	publish1.Message.Payload = []byte("test")
+
+	delivered1 := packet.NewPublishPacket()
+	delivered1.Message.Topic = "foo/bar"
+	delivered1.Message.Payload = []byte("[1 2]:test")
+
+	publish2 := packet.NewPublishPacket()
+	publish2.Message.Topic = "bar"
+	publish2.Message.Payload = []byte("test")
+
+	delivered2 := packet.NewPublishPacket()
+	delivered2.Message.Topic = "bar"
+	delivered2.Message.Payload = []byte("[]:test")
+
+	broker := New()
+	broker.SubscriptionIdentifier = func(client Client, sub packet.Subscription) uint32 {
+		switch sub.Topic {
+		case "foo/#":
+			return 2
+		case "foo/+":
+			return 1
+		}
+
+		return 0
+	}
+	broker.Use(&identifiersMiddleware{broker: broker})
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(publish1).
+		Receive(delivered1).
+		Send(publish2).
+		Receive(delivered2).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"sync"
+
+	"github.com/gomqtt/transport"
+)
+
+// A CertificateConn is a connection that has been established using mutual
+// TLS and exposes the certificates presented by the client. Connections that
+// implement CertificateConn allow the broker to bind client ids to the
+// identity of the presented certificate.
+type CertificateConn interface {
+	transport.Conn
+
+	// PeerCertificates should return the certificate chain presented by the
+	// client, starting with the leaf certificate.
+	PeerCertificates() []*x509.Certificate
+}
+
+// The IdentityMapper callback derives a stable identity from a client
+// certificate. Certificates that map to the same identity are treated as
+// rotations of the same certificate.
+type IdentityMapper func(cert *x509.Certificate) string
+
+// CertificateIdentity is the default IdentityMapper. It returns the SPIFFE ID
+// if the certificate has an URI SAN with the "spiffe" scheme and falls back to
+// the common name of the subject.
+func CertificateIdentity(cert *x509.Certificate) string {
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			return uri.String()
+		}
+	}
+
+	return cert.Subject.CommonName
+}
+
+// a bound certificate of a client id
+type certificateBinding struct {
+	identity    string
+	fingerprint string
+}
+
+// keeps track of the certificate identities bound to client ids
+type identityRegistry struct {
+	bindings map[string]certificateBinding
+	mutex    sync.Mutex
+}
+
+// binds the certificate to the client id and returns false if the id is
+// already bound to a different identity, the returned flag reports whether a
+// different certificate of the same identity has been presented
+func (r *identityRegistry) bind(clientID, identity, fingerprint string) (bool, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// lazily allocate bindings
+	if r.bindings == nil {
+		r.bindings = make(map[string]certificateBinding)
+	}
+
+	// check existing binding
+	binding, ok := r.bindings[clientID]
+	if ok && binding.identity != identity {
+		return false, false
+	}
+
+	r.bindings[clientID] = certificateBinding{
+		identity:    identity,
+		fingerprint: fingerprint,
+	}
+
+	return true, ok && binding.fingerprint != fingerprint
+}
+
+// returns the identity bound to the client id
+func (r *identityRegistry) lookup(clientID string) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.bindings[clientID].identity
+}
+
+// removes the binding of the client id
+func (r *identityRegistry) unbind(clientID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.bindings, clientID)
+}
+
+// returns the leaf certificate of the connection if available
+func peerCertificate(conn transport.Conn) *x509.Certificate {
+	certs := peerCertificates(conn)
+	if len(certs) == 0 {
+		return nil
+	}
+
+	return certs[0]
+}
+
+// returns the hex encoded SHA-256 fingerprint of the certificate
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
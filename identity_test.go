@@ -0,0 +1,62 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertificateIdentity(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "device"},
+	}
+
+	assert.Equal(t, "device", CertificateIdentity(cert))
+
+	spiffe, err := url.Parse("spiffe://example.org/device")
+	assert.NoError(t, err)
+
+	cert.URIs = []*url.URL{spiffe}
+	assert.Equal(t, "spiffe://example.org/device", CertificateIdentity(cert))
+}
+
+func TestIdentityRegistry(t *testing.T) {
+	var registry identityRegistry
+
+	// first use
+	ok, rotated := registry.bind("client", "device", "cert1")
+	assert.True(t, ok)
+	assert.False(t, rotated)
+
+	// same certificate
+	ok, rotated = registry.bind("client", "device", "cert1")
+	assert.True(t, ok)
+	assert.False(t, rotated)
+
+	// rotated certificate
+	ok, rotated = registry.bind("client", "device", "cert2")
+	assert.True(t, ok)
+	assert.True(t, rotated)
+
+	// different identity
+	ok, rotated = registry.bind("client", "other", "cert3")
+	assert.False(t, ok)
+	assert.False(t, rotated)
+}
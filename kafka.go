@@ -0,0 +1,284 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"gopkg.in/tomb.v2"
+)
+
+// A KafkaRecord is a message that is produced to Kafka.
+type KafkaRecord struct {
+	Topic string
+	Key   []byte
+	Value []byte
+
+	// The string values of the message metadata (see Broker.Annotate).
+	Headers map[string]string
+
+	// The time the message has been received by the exporter.
+	Time time.Time
+}
+
+// A KafkaProducer writes records to Kafka. The kafka package provides an
+// implementation that is backed by sarama.
+type KafkaProducer interface {
+	// Produce should synchronously write the batch of records and return an
+	// error if the batch has not been acknowledged by the cluster.
+	Produce(records []KafkaRecord) error
+}
+
+// A KafkaExporter subscribes to topic filters on a Broker and produces the
+// matching messages as records to Kafka.
+type KafkaExporter struct {
+	// The exported topic filters.
+	Filters []string
+
+	// The producer that writes the records.
+	Producer KafkaProducer
+
+	// The TopicMapper returns the Kafka topic of a message. Defaults to the
+	// MQTT topic with slashes replaced by dots.
+	TopicMapper func(msg *packet.Message) string
+
+	// The KeyExtractor returns the record key of a message. Defaults to the
+	// MQTT topic, which keeps the messages of a topic in order.
+	KeyExtractor func(msg *packet.Message) []byte
+
+	// Records are produced in batches of up to BatchSize records. A batch is
+	// produced once it is full or the BatchInterval elapsed since its first
+	// record has been added.
+	BatchSize     int
+	BatchInterval time.Duration
+
+	// The maximum number of records that wait to be batched. Further messages
+	// are dropped as the exporter must not block the publishing clients.
+	QueueSize int
+
+	// Failed batches are retried up to MaxRetries times. The delay between
+	// the attempts starts at RetryBackoff and doubles up to MaxBackoff.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+
+	Logger Logger
+
+	broker  *Broker
+	local   *LocalClient
+	queue   chan KafkaRecord
+	dropped int64
+
+	tomb tomb.Tomb
+}
+
+// NewKafkaExporter returns a new KafkaExporter that produces the messages
+// matching the specified filters using the producer.
+func NewKafkaExporter(broker *Broker, producer KafkaProducer, filters ...string) *KafkaExporter {
+	return &KafkaExporter{
+		Filters:       filters,
+		Producer:      producer,
+		TopicMapper:   kafkaTopic,
+		KeyExtractor:  kafkaKey,
+		BatchSize:     100,
+		BatchInterval: 100 * time.Millisecond,
+		QueueSize:     1000,
+		MaxRetries:    5,
+		RetryBackoff:  100 * time.Millisecond,
+		MaxBackoff:    10 * time.Second,
+		broker:        broker,
+	}
+}
+
+// Start will subscribe the exporter to the filters and launch the goroutine
+// that batches and produces the records.
+func (e *KafkaExporter) Start() error {
+	e.queue = make(chan KafkaRecord, e.QueueSize)
+	e.local = NewLocalClient(e.enqueue)
+
+	// setup local client
+	_, _, err := e.broker.Backend.Setup(e.local, "", true)
+	if err != nil {
+		return err
+	}
+
+	// subscribe to filters
+	for _, filter := range e.Filters {
+		_, err = e.broker.Backend.Subscribe(e.local, filter)
+		if err != nil {
+			e.broker.Backend.Terminate(e.local)
+			return err
+		}
+	}
+
+	e.tomb.Go(e.producer)
+
+	return nil
+}
+
+// Stop will unsubscribe the exporter and produce the remaining records. Failed
+// batches are not retried once the exporter is stopping.
+func (e *KafkaExporter) Stop() error {
+	err := e.broker.Backend.Terminate(e.local)
+
+	e.tomb.Kill(nil)
+	e.tomb.Wait()
+
+	return err
+}
+
+// Dropped returns the number of messages that have been dropped because the
+// queue was full or the batch could not be produced.
+func (e *KafkaExporter) Dropped() int64 {
+	return atomic.LoadInt64(&e.dropped)
+}
+
+// converts and queues a matching message
+func (e *KafkaExporter) enqueue(msg *packet.Message) {
+	record := KafkaRecord{
+		Topic: e.TopicMapper(msg),
+		Key:   e.KeyExtractor(msg),
+		Value: msg.Payload,
+		Time:  time.Now(),
+	}
+
+	// carry string metadata as headers
+	for key, value := range e.broker.Annotations(msg) {
+		if str, ok := value.(string); ok {
+			if record.Headers == nil {
+				record.Headers = make(map[string]string)
+			}
+
+			record.Headers[key] = str
+		}
+	}
+
+	select {
+	case e.queue <- record:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+		e.log(LogWarn, "kafka_record_dropped", map[string]interface{}{
+			"topic": msg.Topic,
+		})
+	}
+}
+
+// batches and produces the queued records
+func (e *KafkaExporter) producer() error {
+	var batch []KafkaRecord
+	var timeout <-chan time.Time
+
+	for {
+		select {
+		case record := <-e.queue:
+			batch = append(batch, record)
+
+			// start batch interval
+			if len(batch) == 1 {
+				timeout = time.After(e.BatchInterval)
+			}
+
+			if len(batch) < e.BatchSize {
+				continue
+			}
+		case <-timeout:
+		case <-e.tomb.Dying():
+			// produce remaining records
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+
+			for len(batch) > 0 {
+				n := len(batch)
+				if n > e.BatchSize {
+					n = e.BatchSize
+				}
+
+				e.produce(batch[:n])
+				batch = batch[n:]
+			}
+
+			return tomb.ErrDying
+		}
+
+		e.produce(batch)
+		batch = nil
+		timeout = nil
+	}
+}
+
+// produces a batch and retries with an exponential backoff
+func (e *KafkaExporter) produce(batch []KafkaRecord) {
+	backoff := e.RetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		err := e.Producer.Produce(batch)
+		if err == nil {
+			return
+		}
+
+		// check attempts
+		if attempt >= e.MaxRetries {
+			atomic.AddInt64(&e.dropped, int64(len(batch)))
+			e.log(LogError, "kafka_produce_failed", map[string]interface{}{
+				"records": len(batch),
+				"error":   err,
+			})
+
+			return
+		}
+
+		e.log(LogWarn, "kafka_produce_retried", map[string]interface{}{
+			"attempt": attempt + 1,
+			"error":   err,
+		})
+
+		// wait for next attempt
+		select {
+		case <-time.After(backoff):
+		case <-e.tomb.Dying():
+			atomic.AddInt64(&e.dropped, int64(len(batch)))
+			e.log(LogError, "kafka_produce_failed", map[string]interface{}{
+				"records": len(batch),
+				"error":   err,
+			})
+
+			return
+		}
+
+		backoff *= 2
+		if backoff > e.MaxBackoff {
+			backoff = e.MaxBackoff
+		}
+	}
+}
+
+// logs an exporter event
+func (e *KafkaExporter) log(level LogLevel, event string, fields map[string]interface{}) {
+	logEvent(e.Logger, level, event, fields)
+}
+
+// the default topic mapper
+func kafkaTopic(msg *packet.Message) string {
+	return strings.Replace(msg.Topic, "/", ".", -1)
+}
+
+// the default key extractor
+func kafkaKey(msg *packet.Message) []byte {
+	return []byte(msg.Topic)
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kafka provides a broker.KafkaProducer that is backed by sarama. It
+// is kept separate from the broker package, so that embedders that do not
+// export messages do not depend on github.com/Shopify/sarama.
+package kafka
+
+import (
+	"sort"
+
+	"github.com/Shopify/sarama"
+	"github.com/gomqtt/broker"
+)
+
+// A SyncProducer is the part of sarama.SyncProducer that is used by the
+// Producer.
+type SyncProducer interface {
+	SendMessages(msgs []*sarama.ProducerMessage) error
+	Close() error
+}
+
+// A Producer produces the records of a broker.KafkaExporter using a sarama
+// SyncProducer.
+type Producer struct {
+	producer SyncProducer
+}
+
+// NewProducer returns a new Producer that uses the specified producer.
+func NewProducer(producer SyncProducer) *Producer {
+	return &Producer{
+		producer: producer,
+	}
+}
+
+// Dial will connect a sarama SyncProducer to the specified brokers and return
+// a Producer that uses it. The config defaults to sarama.NewConfig and always
+// returns successes, which the SyncProducer requires. Record headers are only
+// supported if the config's Version is at least sarama.V0_11_0_0.
+func Dial(addrs []string, config *sarama.Config) (*Producer, error) {
+	if config == nil {
+		config = sarama.NewConfig()
+	}
+
+	config.Producer.Return.Successes = true
+
+	producer, err := sarama.NewSyncProducer(addrs, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewProducer(producer), nil
+}
+
+// Produce will synchronously send the records as one batch.
+func (p *Producer) Produce(records []broker.KafkaRecord) error {
+	msgs := make([]*sarama.ProducerMessage, 0, len(records))
+	for _, record := range records {
+		msgs = append(msgs, message(record))
+	}
+
+	return p.producer.SendMessages(msgs)
+}
+
+// Close will close the underlying producer.
+func (p *Producer) Close() error {
+	return p.producer.Close()
+}
+
+// converts a record to a producer message
+func message(record broker.KafkaRecord) *sarama.ProducerMessage {
+	msg := &sarama.ProducerMessage{
+		Topic:     record.Topic,
+		Value:     sarama.ByteEncoder(record.Value),
+		Timestamp: record.Time,
+	}
+
+	// messages without a key are distributed across all partitions
+	if record.Key != nil {
+		msg.Key = sarama.ByteEncoder(record.Key)
+	}
+
+	// sort headers for a stable order
+	keys := make([]string, 0, len(record.Headers))
+	for key := range record.Headers {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{
+			Key:   []byte(key),
+			Value: []byte(record.Headers[key]),
+		})
+	}
+
+	return msg
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/gomqtt/broker"
+	"github.com/stretchr/testify/assert"
+)
+
+type testProducer struct {
+	msgs   []*sarama.ProducerMessage
+	closed bool
+}
+
+func (p *testProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	p.msgs = append(p.msgs, msgs...)
+	return nil
+}
+
+func (p *testProducer) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestProducer(t *testing.T) {
+	var _ broker.KafkaProducer = &Producer{}
+
+	now := time.Now()
+
+	sync := &testProducer{}
+	producer := NewProducer(sync)
+
+	err := producer.Produce([]broker.KafkaRecord{
+		{
+			Topic:   "sensors.1",
+			Key:     []byte("sensors/1"),
+			Value:   []byte("1"),
+			Headers: map[string]string{"tenant": "acme", "region": "eu"},
+			Time:    now,
+		},
+		{
+			Topic: "sensors.2",
+			Value: []byte("2"),
+		},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, sync.msgs, 2)
+
+	assert.Equal(t, "sensors.1", sync.msgs[0].Topic)
+	assert.Equal(t, sarama.ByteEncoder("sensors/1"), sync.msgs[0].Key)
+	assert.Equal(t, sarama.ByteEncoder("1"), sync.msgs[0].Value)
+	assert.Equal(t, now, sync.msgs[0].Timestamp)
+	assert.Equal(t, []sarama.RecordHeader{
+		{Key: []byte("region"), Value: []byte("eu")},
+		{Key: []byte("tenant"), Value: []byte("acme")},
+	}, sync.msgs[0].Headers)
+
+	assert.Equal(t, "sensors.2", sync.msgs[1].Topic)
+	assert.Nil(t, sync.msgs[1].Key)
+	assert.Empty(t, sync.msgs[1].Headers)
+
+	err = producer.Close()
+	assert.NoError(t, err)
+	assert.True(t, sync.closed)
+}
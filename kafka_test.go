@@ -0,0 +1,194 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+type testProducer struct {
+	failures int
+	batches  [][]KafkaRecord
+	mutex    sync.Mutex
+}
+
+func (p *testProducer) Produce(records []KafkaRecord) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.failures > 0 {
+		p.failures--
+		return fmt.Errorf("not available")
+	}
+
+	p.batches = append(p.batches, append([]KafkaRecord{}, records...))
+
+	return nil
+}
+
+func (p *testProducer) produced() [][]KafkaRecord {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.batches
+}
+
+func TestKafkaExporter(t *testing.T) {
+	producer := &testProducer{failures: 1}
+
+	broker := New()
+
+	exporter := NewKafkaExporter(broker, producer, "sensors/#")
+	exporter.BatchSize = 2
+	exporter.BatchInterval = 10 * time.Millisecond
+	exporter.RetryBackoff = time.Millisecond
+
+	err := exporter.Start()
+	assert.NoError(t, err)
+
+	client := NewLocalClient(func(*packet.Message) {})
+
+	msg1 := &packet.Message{Topic: "sensors/1", Payload: []byte("1")}
+	broker.Annotate(msg1, "tenant", "acme")
+
+	for _, msg := range []*packet.Message{
+		msg1,
+		{Topic: "sensors/2", Payload: []byte("2")},
+		{Topic: "other", Payload: []byte("3")},
+		{Topic: "sensors/3", Payload: []byte("4")},
+	} {
+		err = broker.Backend.Publish(client, msg)
+		assert.NoError(t, err)
+	}
+
+	broker.annotations().release(msg1)
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return len(producer.produced()) == 2
+	})
+
+	err = exporter.Stop()
+	assert.NoError(t, err)
+
+	batches := producer.produced()
+	assert.Len(t, batches, 2)
+	assert.Len(t, batches[0], 2)
+	assert.Len(t, batches[1], 1)
+
+	assert.Equal(t, "sensors.1", batches[0][0].Topic)
+	assert.Equal(t, []byte("sensors/1"), batches[0][0].Key)
+	assert.Equal(t, []byte("1"), batches[0][0].Value)
+	assert.Equal(t, map[string]string{"tenant": "acme"}, batches[0][0].Headers)
+	assert.Equal(t, "sensors.3", batches[1][0].Topic)
+	assert.Equal(t, int64(0), exporter.Dropped())
+}
+
+func TestKafkaExporterRetries(t *testing.T) {
+	producer := &testProducer{failures: 10}
+
+	broker := New()
+
+	exporter := NewKafkaExporter(broker, producer, "#")
+	exporter.MaxRetries = 2
+	exporter.RetryBackoff = time.Millisecond
+
+	err := exporter.Start()
+	assert.NoError(t, err)
+
+	err = broker.Backend.Publish(NewLocalClient(func(*packet.Message) {}), &packet.Message{Topic: "foo"})
+	assert.NoError(t, err)
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return exporter.Dropped() == 1
+	})
+
+	err = exporter.Stop()
+	assert.NoError(t, err)
+
+	assert.Empty(t, producer.produced())
+	assert.Equal(t, int64(1), exporter.Dropped())
+	assert.Equal(t, 7, producer.failures)
+}
+
+func TestKafkaExporterStopBackoff(t *testing.T) {
+	producer := &testProducer{failures: 10}
+
+	broker := New()
+
+	exporter := NewKafkaExporter(broker, producer, "#")
+	exporter.BatchInterval = time.Millisecond
+	exporter.RetryBackoff = time.Minute
+
+	err := exporter.Start()
+	assert.NoError(t, err)
+
+	err = broker.Backend.Publish(NewLocalClient(func(*packet.Message) {}), &packet.Message{Topic: "foo"})
+	assert.NoError(t, err)
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		producer.mutex.Lock()
+		defer producer.mutex.Unlock()
+		return producer.failures == 9
+	})
+
+	start := time.Now()
+
+	err = exporter.Stop()
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, int64(1), exporter.Dropped())
+}
+
+// a backend that fails subscriptions to the "fail" filter
+type failingSubscribeBackend struct {
+	*MemoryBackend
+	terminated []Client
+}
+
+func (b *failingSubscribeBackend) Subscribe(client Client, topic string) ([]*packet.Message, error) {
+	if topic == "fail" {
+		return nil, fmt.Errorf("denied")
+	}
+
+	return b.MemoryBackend.Subscribe(client, topic)
+}
+
+func (b *failingSubscribeBackend) Terminate(client Client) error {
+	b.terminated = append(b.terminated, client)
+	return b.MemoryBackend.Terminate(client)
+}
+
+func TestKafkaExporterStartFailure(t *testing.T) {
+	backend := &failingSubscribeBackend{MemoryBackend: NewMemoryBackend()}
+
+	broker := New()
+	broker.Backend = backend
+
+	exporter := NewKafkaExporter(broker, &testProducer{}, "foo", "fail")
+
+	err := exporter.Start()
+	assert.Error(t, err)
+	assert.Equal(t, []Client{exporter.local}, backend.terminated)
+
+	err = broker.Backend.Publish(NewLocalClient(func(*packet.Message) {}), &packet.Message{Topic: "foo"})
+	assert.NoError(t, err)
+	assert.Len(t, exporter.queue, 0)
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+// Counters report how often the broker had to enforce its limits.
+type Counters struct {
+	// The number of connections that have been refused because the
+	// MaxConnections limit has been reached.
+	RejectedConnections int64
+
+	// The number of connections that have been closed because the
+	// MaxPendingConnects limit has been reached.
+	RefusedHandshakes int64
+
+	// The number of publishes that have been delayed because the client
+	// exceeded the MaxPublishRate.
+	ThrottledPublishes int64
+
+	// The number of clients that have been disconnected because they
+	// exceeded the MaxPayloadSize, the MaxPublishRate or a Quota.
+	DisconnectedClients int64
+
+	// The number of times a client has been detected as stalled.
+	StalledClients int64
+
+	// The number of QOS 0 messages dropped because of a stalled client or the
+	// LowWatermark.
+	DroppedMessages int64
+
+	// The number of clients that have been closed because they did not send
+	// their first message within the FirstMessageTimeout of their listener.
+	IdleClients int64
+
+	// The number of canary round trips that failed or timed out.
+	CanaryFailures int64
+
+	// The number of clients that have been disconnected because their
+	// outgoing buffer reached the HighWatermark.
+	SlowConsumers int64
+
+	// The number of events dropped because the channel returned by Events
+	// was full.
+	DroppedEvents int64
+
+	// The number of QOS 0 messages dropped and the number of QOS 1 and 2
+	// publishes deferred because of the LoadShedding.
+	ShedMessages      int64
+	DeferredPublishes int64
+
+	// The number of incoming messages vetoed by the PublishHook and the
+	// number of retain flags and QOS levels it rewrote.
+	VetoedPublishes int64
+	RetainRewrites  int64
+	QOSRewrites     int64
+
+	// The number of retained lookups aborted because they exceeded the
+	// RetainedSearchBudget of the MemoryBackend.
+	AbortedSearches int64
+
+	// The number of publishes that exceeded a Quota and that have been dropped
+	// or caused a disconnect.
+	OverQuotaPublishes int64
+}
+
+// A StallPolicy describes how stalled clients are handled.
+type StallPolicy int
+
+const (
+	// StallClose closes the connection of stalled clients.
+	StallClose StallPolicy = iota
+
+	// StallDropQOS0 drops QOS 0 messages for stalled clients while messages
+	// with a higher QOS level continue to wait for the writer.
+	StallDropQOS0
+)
+
+// Counters returns the current limit counters.
+func (b *Broker) Counters() Counters {
+	b.countersMutex.Lock()
+	defer b.countersMutex.Unlock()
+
+	return b.counters
+}
+
+// increments a counter
+func (b *Broker) count(counter *int64) {
+	b.countersMutex.Lock()
+	*counter++
+	b.countersMutex.Unlock()
+}
+
+// returns a random duration between half and the full refusal delay
+func (b *Broker) refusalDelay() time.Duration {
+	if b.RefusalDelay <= 0 {
+		return 0
+	}
+
+	half := b.RefusalDelay / 2
+	return half + time.Duration(b.random(int64(b.RefusalDelay-half)+1))
+}
+
+// checks if the client id is valid for a MQTT 3.1 client
+func (b *Broker) legacyClientID(id string) bool {
+	if len(id) == 0 {
+		return false
+	}
+
+	return b.MQTT31ClientIDLength <= 0 || len(id) <= b.MQTT31ClientIDLength
+}
+
+// a token bucket that is shared by all clients with the same accounting key
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	refs   int
+}
+
+// takes a token and returns the duration to wait before the token may be
+// used, a zero duration means the token is available immediately
+func (l *rateLimiter) take(now time.Time) time.Duration {
+	// refill bucket
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	l.last = now
+
+	// cap bucket at a burst of one second
+	burst := l.rate
+	if burst < 1 {
+		burst = 1
+	}
+
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+
+	// take token
+	l.tokens--
+
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// manages the rate limiters per accounting key
+type rateLimiters struct {
+	limiters map[string]*rateLimiter
+	mutex    sync.Mutex
+}
+
+// increments the references of the limiter for the key
+func (r *rateLimiters) acquire(key string, rate float64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// lazily allocate limiters
+	if r.limiters == nil {
+		r.limiters = make(map[string]*rateLimiter)
+	}
+
+	l, ok := r.limiters[key]
+	if !ok {
+		l = &rateLimiter{
+			rate:   rate,
+			tokens: rate,
+			last:   time.Now(),
+		}
+
+		r.limiters[key] = l
+	}
+
+	l.refs++
+}
+
+// decrements the references of the limiter for the key and removes it when
+// it is not used anymore
+func (r *rateLimiters) release(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	l, ok := r.limiters[key]
+	if !ok {
+		return
+	}
+
+	l.refs--
+
+	if l.refs <= 0 {
+		delete(r.limiters, key)
+	}
+}
+
+// takes a token from the limiter of the key
+func (r *rateLimiters) take(key string) time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	l, ok := r.limiters[key]
+	if !ok {
+		return 0
+	}
+
+	return l.take(time.Now())
+}
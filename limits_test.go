@@ -0,0 +1,439 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+
+	l := &rateLimiter{rate: 2, tokens: 2, last: now}
+
+	assert.Equal(t, time.Duration(0), l.take(now))
+	assert.Equal(t, time.Duration(0), l.take(now))
+	assert.Equal(t, 500*time.Millisecond, l.take(now))
+
+	// refilled
+	assert.Equal(t, time.Duration(0), l.take(now.Add(2*time.Second)))
+}
+
+func TestMaxConnections(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	refused := packet.NewConnackPacket()
+	refused.ReturnCode = packet.ErrServerUnavailable
+
+	broker := New()
+	broker.MaxConnections = 1
+
+	port, done := runBroker(t, broker, 2)
+
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Test(t, conn1)
+
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(refused).
+		End().
+		Test(t, conn2)
+
+	tools.NewFlow().
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn1)
+
+	<-done
+
+	assert.Equal(t, int64(1), broker.Counters().RejectedConnections)
+}
+
+func TestMaxConnectionsConcurrent(t *testing.T) {
+	broker := New()
+	broker.MaxConnections = 5
+
+	port, done := runBroker(t, broker, 20)
+
+	var conns []transport.Conn
+	for i := 0; i < 20; i++ {
+		conn, err := transport.Dial(port.URL())
+		assert.NoError(t, err)
+		conns = append(conns, conn)
+	}
+
+	// connect all clients at once
+	start := make(chan struct{})
+	codes := make(chan packet.ConnackCode, 20)
+
+	for _, conn := range conns {
+		go func(conn transport.Conn) {
+			<-start
+
+			err := conn.Send(packet.NewConnectPacket())
+			assert.NoError(t, err)
+
+			pkt, err := conn.Receive()
+			assert.NoError(t, err)
+
+			connack, _ := pkt.(*packet.ConnackPacket)
+			if assert.NotNil(t, connack) {
+				codes <- connack.ReturnCode
+			}
+		}(conn)
+	}
+
+	close(start)
+
+	accepted := 0
+	for i := 0; i < 20; i++ {
+		if <-codes == packet.ConnectionAccepted {
+			accepted++
+		}
+	}
+
+	assert.Equal(t, 5, accepted)
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	<-done
+
+	// all slots are freed
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return len(broker.currentClients()) == 0
+	})
+
+	broker.clientsMutex.Lock()
+	assert.Equal(t, 0, broker.connected)
+	broker.clientsMutex.Unlock()
+}
+
+func TestMaxConnectionsPendingHandshake(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	broker := New()
+	broker.MaxConnections = 1
+
+	port, done := runBroker(t, broker, 2)
+
+	// pending handshake
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return broker.PendingConnects() == 1
+	})
+
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn2)
+
+	err = conn1.Close()
+	assert.NoError(t, err)
+
+	<-done
+
+	assert.Equal(t, int64(0), broker.Counters().RejectedConnections)
+}
+
+func TestMaxConnectionsRefusalDelayClose(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	broker := New()
+	broker.MaxConnections = 1
+	broker.RefusalDelay = time.Minute
+
+	port, done := runBroker(t, broker, 2)
+
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Test(t, conn1)
+
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Test(t, conn2)
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return broker.Counters().RejectedConnections == 1
+	})
+
+	start := time.Now()
+
+	err = broker.Close(100 * time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Empty(t, broker.currentClients())
+
+	<-done
+}
+
+func TestMaxPendingConnects(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	broker := New()
+	broker.MaxPendingConnects = 1
+
+	port, done := runBroker(t, broker, 3)
+
+	// pending handshake
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return broker.PendingConnects() == 1
+	})
+
+	assert.Equal(t, 1, broker.PendingConnects())
+
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		End().
+		Test(t, conn2)
+
+	// completed handshake
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Test(t, conn1)
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return broker.PendingConnects() == 0
+	})
+
+	assert.Equal(t, 0, broker.PendingConnects())
+
+	conn3, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn3)
+
+	tools.NewFlow().
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn1)
+
+	<-done
+
+	assert.Equal(t, int64(1), broker.Counters().RefusedHandshakes)
+}
+
+func TestMaxInflight(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test", QOS: 1}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{1}
+	suback.PacketID = 1
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("test")
+	publish.Message.QOS = 1
+	publish.PacketID = 1
+
+	puback := packet.NewPubackPacket()
+	puback.PacketID = 1
+
+	publish1 := packet.NewPublishPacket()
+	publish1.Message = publish.Message
+	publish1.PacketID = 1
+
+	puback1 := packet.NewPubackPacket()
+	puback1.PacketID = 1
+
+	publish2 := packet.NewPublishPacket()
+	publish2.Message = publish.Message
+	publish2.PacketID = 2
+
+	puback2 := packet.NewPubackPacket()
+	puback2.PacketID = 2
+
+	broker := New()
+	broker.MaxInflight = 1
+
+	port, done := runBroker(t, broker, 2)
+
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Test(t, conn1)
+
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(publish).
+		Receive(puback).
+		Send(publish).
+		Receive(puback).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn2)
+
+	tools.NewFlow().
+		Receive(publish1).
+		Test(t, conn1)
+
+	// second message is held back
+	broker.await(time.Now().Add(time.Second), func() bool {
+		snapshot, _ := broker.Snapshot()
+		return snapshot != nil && len(snapshot.Clients) == 1
+	})
+
+	snapshot, err := broker.Snapshot()
+	assert.NoError(t, err)
+	assert.Len(t, snapshot.Clients, 1)
+	assert.Equal(t, 1, snapshot.Clients[0].Inflight)
+
+	tools.NewFlow().
+		Send(puback1).
+		Receive(publish2).
+		Send(puback2).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn1)
+
+	<-done
+}
+
+func TestMaxPayloadSize(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("too large")
+
+	broker := New()
+	broker.MaxPayloadSize = 4
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(publish).
+		End().
+		Test(t, conn)
+
+	<-done
+
+	assert.Equal(t, int64(1), broker.Counters().DisconnectedClients)
+}
+
+func TestMaxPublishRate(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("test")
+
+	broker := New()
+	broker.MaxPublishRate = 1
+	broker.RateLimitDisconnect = true
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(publish).
+		Send(publish).
+		End().
+		Test(t, conn)
+
+	<-done
+
+	assert.Equal(t, int64(1), broker.Counters().DisconnectedClients)
+}
+
+func TestRefusalDelay(t *testing.T) {
+	broker := New()
+	assert.Equal(t, time.Duration(0), broker.refusalDelay())
+
+	broker.RefusalDelay = 100 * time.Millisecond
+
+	for i := 0; i < 100; i++ {
+		delay := broker.refusalDelay()
+		assert.True(t, delay >= 50*time.Millisecond)
+		assert.True(t, delay <= 100*time.Millisecond)
+	}
+}
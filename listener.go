@@ -0,0 +1,257 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomqtt/transport"
+)
+
+// A Listener describes a server that is launched by the broker. Supported
+// url schemes are "tcp", "tls", "ws" and "wss".
+type Listener struct {
+	// The url the listener is launched on, e.g. "tcp://0.0.0.0:1883".
+	URL string
+
+	// The TLSConfig is used for "tls" and "wss" listeners.
+	TLSConfig *tls.Config
+
+	// The maximum number of simultaneous connections accepted by the listener.
+	// Further connections are closed immediately. A zero value disables the
+	// limit.
+	MaxConnections int
+
+	// The protocol versions (e.g. packet.Version311) clients are allowed to
+	// use. Connections using other versions are refused with an "invalid
+	// protocol version" return code. All versions are allowed if empty.
+	ProtocolVersions []byte
+
+	// If FirstMessageTimeout is set, clients must send their first SUBSCRIBE
+	// or PUBLISH packet within the timeout after the connection has been
+	// acknowledged. Clients that connect and then stay idle are closed.
+	// Unlike the keep alive, PINGREQ packets do not extend the timeout.
+	FirstMessageTimeout time.Duration
+
+	server      transport.Server
+	connections int
+	mutex       sync.Mutex
+}
+
+// Addr returns the address the listener is bound to or nil if the listener
+// has not been launched yet.
+func (l *Listener) Addr() net.Addr {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.server == nil {
+		return nil
+	}
+
+	return l.server.Addr()
+}
+
+// Launch will launch listeners with default options on the specified urls
+// and handle all accepted connections. Listeners of "tls" and "wss" urls use
+// the TLSConfig of the broker. If a listener fails to launch, the listeners
+// that have already been launched are closed.
+func (b *Broker) Launch(urls ...string) error {
+	var launched []*Listener
+
+	for _, url := range urls {
+		l := &Listener{URL: url}
+		if strings.HasPrefix(url, "tls://") || strings.HasPrefix(url, "wss://") {
+			l.TLSConfig = b.TLSConfig
+		}
+
+		err := b.Listen(l)
+		if err != nil {
+			for _, l := range launched {
+				b.unlisten(l)
+			}
+
+			return err
+		}
+
+		launched = append(launched, l)
+	}
+
+	return nil
+}
+
+// Listen will validate and launch the specified listener and handle all
+// accepted connections. The listener is closed when the broker is closed.
+func (b *Broker) Listen(l *Listener) error {
+	// validate configuration
+	err := l.Validate()
+	if err != nil {
+		return err
+	}
+
+	launcher := transport.NewLauncher()
+	launcher.TLSConfig = l.TLSConfig
+
+	// launch server
+	server, err := launcher.Launch(l.URL)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	l.server = server
+	l.mutex.Unlock()
+
+	// register listener
+	b.clientsMutex.Lock()
+	b.listeners = append(b.listeners, l)
+	b.clientsMutex.Unlock()
+
+	go b.accept(l)
+
+	return nil
+}
+
+// unregisters and closes a launched listener
+func (b *Broker) unlisten(l *Listener) {
+	b.clientsMutex.Lock()
+	for i, other := range b.listeners {
+		if other == l {
+			b.listeners = append(b.listeners[:i], b.listeners[i+1:]...)
+			break
+		}
+	}
+	b.clientsMutex.Unlock()
+
+	l.server.Close()
+}
+
+// accepts connections until the server is closed, temporary errors like
+// running out of file descriptors are retried with an increasing delay
+func (b *Broker) accept(l *Listener) {
+	var delay time.Duration
+
+	for {
+		conn, err := l.server.Accept()
+		if err != nil && temporary(err) {
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+
+			b.log(LogWarn, "accept_failed", map[string]interface{}{
+				"url":   l.URL,
+				"error": err.Error(),
+				"retry": delay.String(),
+			})
+
+			time.Sleep(delay)
+			continue
+		} else if err != nil {
+			return
+		}
+
+		delay = 0
+
+		// check connection limit
+		if !l.acquire() {
+			conn.Close()
+			b.churn.refused(l)
+			continue
+		}
+
+		b.handle(conn, l)
+	}
+}
+
+// checks if the error or the error it wraps is temporary
+func temporary(err error) bool {
+	for err != nil {
+		if t, ok := err.(interface{ Temporary() bool }); ok && t.Temporary() {
+			return true
+		}
+
+		switch wrapper := err.(type) {
+		case interface{ Err() error }:
+			err = wrapper.Err()
+		case interface{ Unwrap() error }:
+			err = wrapper.Unwrap()
+		default:
+			return false
+		}
+	}
+
+	return false
+}
+
+// closes all launched listeners
+func (b *Broker) closeListeners() error {
+	b.clientsMutex.Lock()
+	listeners := b.listeners
+	b.listeners = nil
+	b.clientsMutex.Unlock()
+
+	var err error
+
+	for _, l := range listeners {
+		_err := l.server.Close()
+		if err == nil {
+			err = _err
+		}
+	}
+
+	return err
+}
+
+// reserves a connection slot and returns false if the limit has been reached
+func (l *Listener) acquire() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.MaxConnections > 0 && l.connections >= l.MaxConnections {
+		return false
+	}
+
+	l.connections++
+
+	return true
+}
+
+// frees a connection slot
+func (l *Listener) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.connections--
+}
+
+// checks if the protocol version is allowed
+func (l *Listener) allows(version byte) bool {
+	if len(l.ProtocolVersions) == 0 {
+		return true
+	}
+
+	for _, v := range l.ProtocolVersions {
+		if v == version {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/tls"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLaunch(t *testing.T) {
+	port := tools.NewPort()
+
+	connect := packet.NewConnectPacket()
+	connect.Version = packet.Version311
+
+	connack := packet.NewConnackPacket()
+
+	broker := New()
+
+	err := broker.Launch(port.URL())
+	assert.NoError(t, err)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	err = broker.Close(time.Second)
+	assert.NoError(t, err)
+}
+
+func TestLaunchFailure(t *testing.T) {
+	port := tools.NewPort()
+
+	broker := New()
+
+	// the launched listeners are closed if a later one fails
+	err := broker.Launch(port.URL(), "foo://localhost:0")
+	assert.Error(t, err)
+
+	broker.clientsMutex.Lock()
+	assert.Empty(t, broker.listeners)
+	broker.clientsMutex.Unlock()
+
+	err = broker.Launch(port.URL())
+	assert.NoError(t, err)
+
+	err = broker.Close(time.Second)
+	assert.NoError(t, err)
+}
+
+// an error that reports whether it is temporary
+type temporaryError bool
+
+func (e temporaryError) Error() string   { return "temporary" }
+func (e temporaryError) Temporary() bool { return bool(e) }
+
+// a server that fails with temporary errors before it accepts connections
+type temporaryServer struct {
+	transport.Server
+
+	failures int
+	calls    int
+}
+
+func (s *temporaryServer) Accept() (transport.Conn, error) {
+	s.calls++
+	if s.calls <= s.failures {
+		return nil, temporaryError(true)
+	}
+
+	return s.Server.Accept()
+}
+
+func TestAcceptTemporaryErrors(t *testing.T) {
+	port := tools.NewPort()
+
+	server, err := transport.Launch(port.URL())
+	assert.NoError(t, err)
+
+	broker := New()
+
+	l := &Listener{URL: port.URL()}
+	l.server = &temporaryServer{Server: server, failures: 3}
+
+	done := make(chan struct{})
+	go func() {
+		broker.accept(l)
+		close(done)
+	}()
+
+	// the connection is accepted after the failures
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(packet.NewConnackPacket()).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	// the loop exits once the server is closed
+	assert.NoError(t, server.Close())
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("accept loop did not exit")
+	}
+
+	assert.NoError(t, broker.Close(time.Second))
+}
+
+func TestLaunchTLS(t *testing.T) {
+	broker := New()
+
+	// tls listeners require a config
+	err := broker.Launch("tls://localhost:0")
+	assert.Error(t, err)
+
+	broker.TLSConfig = &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return nil, fmt.Errorf("not implemented")
+		},
+	}
+
+	err = broker.Launch("tls://localhost:0")
+	assert.NoError(t, err)
+
+	err = broker.Close(time.Second)
+	assert.NoError(t, err)
+}
+
+func TestListenerOptions(t *testing.T) {
+	port := tools.NewPort()
+
+	connect := packet.NewConnectPacket()
+	connect.Version = packet.Version31
+
+	refused := packet.NewConnackPacket()
+	refused.ReturnCode = packet.ErrInvalidProtocolVersion
+
+	broker := New()
+
+	err := broker.Listen(&Listener{
+		URL:              port.URL(),
+		MaxConnections:   1,
+		ProtocolVersions: []byte{packet.Version311},
+	})
+	assert.NoError(t, err)
+
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	// exceeds connection limit
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		End().
+		Test(t, conn2)
+
+	// disallowed version
+	tools.NewFlow().
+		Send(connect).
+		Receive(refused).
+		End().
+		Test(t, conn1)
+
+	err = broker.Close(time.Second)
+	assert.NoError(t, err)
+}
+
+func TestFirstMessageTimeout(t *testing.T) {
+	port := tools.NewPort()
+
+	connect := packet.NewConnectPacket()
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	broker := New()
+
+	err := broker.Listen(&Listener{
+		URL:                 port.URL(),
+		FirstMessageTimeout: 50 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	// idle client
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(packet.NewPingreqPacket()).
+		Receive(packet.NewPingrespPacket()).
+		End().
+		Test(t, conn1)
+
+	assert.Equal(t, int64(1), broker.Counters().IdleClients)
+
+	// active client
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Test(t, conn2)
+
+	time.Sleep(100 * time.Millisecond)
+
+	tools.NewFlow().
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn2)
+
+	assert.Equal(t, int64(1), broker.Counters().IdleClients)
+
+	err = broker.Close(time.Second)
+	assert.NoError(t, err)
+}
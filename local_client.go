@@ -0,0 +1,57 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"github.com/gomqtt/packet"
+	"github.com/satori/go.uuid"
+)
+
+// A LocalClient is an in-process Client that can be directly attached to a
+// Backend. Messages routed to the client by the Backend are passed to the
+// callback.
+type LocalClient struct {
+	callback func(msg *packet.Message)
+	context  *Context
+}
+
+// NewLocalClient returns a new LocalClient that passes all received messages
+// to the specified callback. The callback is called synchronously from the
+// publishing goroutine and should therefore not block.
+func NewLocalClient(callback func(msg *packet.Message)) *LocalClient {
+	c := &LocalClient{
+		callback: callback,
+		context:  NewContext(),
+	}
+
+	c.Context().Set("uuid", uuid.NewV1().String())
+
+	return c
+}
+
+// Publish will pass the message to the callback.
+func (c *LocalClient) Publish(msg *packet.Message) error {
+	c.callback(msg)
+	return nil
+}
+
+// Close does nothing as a LocalClient has no underlying connection.
+func (c *LocalClient) Close(clean bool) {}
+
+// Context returns the associated context. Every client will already have the
+// "uuid" value set in the context.
+func (c *LocalClient) Context() *Context {
+	return c.context
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// A Logger receives structured log events. The event is a short snake case
+// name (e.g. "client_connected") and the fields carry the details like the
+// client id, the remote address or the affected packet.
+type Logger interface {
+	// Debug should handle verbose events like sent and received packets.
+	Debug(event string, fields map[string]interface{})
+
+	// Info should handle regular events like connected clients.
+	Info(event string, fields map[string]interface{})
+
+	// Warn should handle events that hint at misbehaving clients like failed
+	// authentications or dropped packets.
+	Warn(event string, fields map[string]interface{})
+
+	// Error should handle internal errors.
+	Error(event string, fields map[string]interface{})
+}
+
+// A LogLevel describes the severity of a log event.
+type LogLevel int
+
+const (
+	// LogDebug is the level of verbose events.
+	LogDebug LogLevel = iota
+
+	// LogInfo is the level of regular events.
+	LogInfo
+
+	// LogWarn is the level of events caused by misbehaving clients.
+	LogWarn
+
+	// LogError is the level of internal errors.
+	LogError
+)
+
+// String returns the name of the level.
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	}
+
+	return "unknown"
+}
+
+// A JSONLogger is a Logger that writes every event as a single line of JSON.
+type JSONLogger struct {
+	// The writer that receives the lines.
+	Writer io.Writer
+
+	// Events below the level are discarded.
+	Level LogLevel
+
+	mutex sync.Mutex
+}
+
+// NewJSONLogger returns a new JSONLogger that writes all events of at least
+// the specified level to the writer.
+func NewJSONLogger(writer io.Writer, level LogLevel) *JSONLogger {
+	return &JSONLogger{
+		Writer: writer,
+		Level:  level,
+	}
+}
+
+// Debug will write the event if the level is LogDebug.
+func (l *JSONLogger) Debug(event string, fields map[string]interface{}) {
+	l.write(LogDebug, event, fields)
+}
+
+// Info will write the event if the level is LogInfo or lower.
+func (l *JSONLogger) Info(event string, fields map[string]interface{}) {
+	l.write(LogInfo, event, fields)
+}
+
+// Warn will write the event if the level is LogWarn or lower.
+func (l *JSONLogger) Warn(event string, fields map[string]interface{}) {
+	l.write(LogWarn, event, fields)
+}
+
+// Error will always write the event.
+func (l *JSONLogger) Error(event string, fields map[string]interface{}) {
+	l.write(LogError, event, fields)
+}
+
+// writes a line with the event
+func (l *JSONLogger) write(level LogLevel, event string, fields map[string]interface{}) {
+	if level < l.Level {
+		return
+	}
+
+	// prepare line
+	line := make(map[string]interface{}, len(fields)+3)
+	for key, value := range fields {
+		// errors do not encode to json
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+
+		line[key] = value
+	}
+
+	line["time"] = time.Now().Format(time.RFC3339Nano)
+	line["level"] = level.String()
+	line["event"] = event
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		data = []byte(fmt.Sprintf(`{"level":"error","event":"log_failed","error":%q}`, err.Error()))
+	}
+
+	l.mutex.Lock()
+	l.Writer.Write(append(data, '\n'))
+	l.mutex.Unlock()
+}
+
+// passes the event to the logger if available
+func logEvent(logger Logger, level LogLevel, event string, fields map[string]interface{}) {
+	if logger == nil {
+		return
+	}
+
+	switch level {
+	case LogDebug:
+		logger.Debug(event, fields)
+	case LogInfo:
+		logger.Info(event, fields)
+	case LogWarn:
+		logger.Warn(event, fields)
+	default:
+		logger.Error(event, fields)
+	}
+}
+
+// logs a broker event
+func (b *Broker) log(level LogLevel, event string, fields map[string]interface{}) {
+	logEvent(b.Logger, level, event, fields)
+}
+
+// passes an error to the error handler or writes it to the error log
+func (b *Broker) reportError(client Client, err error) {
+	if b.ErrorHandler != nil {
+		b.ErrorHandler(client, err)
+		return
+	}
+
+	if b.ErrorLog == nil {
+		return
+	}
+
+	if client != nil {
+		b.ErrorLog.Printf("broker: client %v: %v", client.Context().Get("uuid"), err)
+	} else {
+		b.ErrorLog.Printf("broker: %v", err)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+type logEntry struct {
+	level  LogLevel
+	event  string
+	fields map[string]interface{}
+}
+
+type recordingLogger struct {
+	entries []logEntry
+	mutex   sync.Mutex
+}
+
+func (l *recordingLogger) record(level LogLevel, event string, fields map[string]interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.entries = append(l.entries, logEntry{level, event, fields})
+}
+
+func (l *recordingLogger) Debug(event string, fields map[string]interface{}) {
+	l.record(LogDebug, event, fields)
+}
+
+func (l *recordingLogger) Info(event string, fields map[string]interface{}) {
+	l.record(LogInfo, event, fields)
+}
+
+func (l *recordingLogger) Warn(event string, fields map[string]interface{}) {
+	l.record(LogWarn, event, fields)
+}
+
+func (l *recordingLogger) Error(event string, fields map[string]interface{}) {
+	l.record(LogError, event, fields)
+}
+
+func (l *recordingLogger) find(event string) *logEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, entry := range l.entries {
+		if entry.event == event {
+			return &entry
+		}
+	}
+
+	return nil
+}
+
+func TestJSONLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	logger := NewJSONLogger(buf, LogInfo)
+	logger.Debug("ignored", nil)
+	logger.Info("client_connected", map[string]interface{}{
+		"client_id": "test",
+	})
+	logger.Error("internal_error", map[string]interface{}{
+		"error": fmt.Errorf("foo"),
+	})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+
+	var line map[string]interface{}
+
+	err := json.Unmarshal([]byte(lines[0]), &line)
+	assert.NoError(t, err)
+	assert.Equal(t, "info", line["level"])
+	assert.Equal(t, "client_connected", line["event"])
+	assert.Equal(t, "test", line["client_id"])
+	assert.NotEmpty(t, line["time"])
+
+	err = json.Unmarshal([]byte(lines[1]), &line)
+	assert.NoError(t, err)
+	assert.Equal(t, "error", line["level"])
+	assert.Equal(t, "foo", line["error"])
+}
+
+func TestBrokerLogging(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+
+	denied := packet.NewConnectPacket()
+	denied.ClientID = "test"
+	denied.Username = "deny"
+
+	connack := packet.NewConnackPacket()
+
+	refused := packet.NewConnackPacket()
+	refused.ReturnCode = packet.ErrNotAuthorized
+
+	backend := NewMemoryBackend()
+	backend.Logins = map[string]string{"": ""}
+
+	logger := &recordingLogger{}
+
+	broker := New()
+	broker.Backend = backend
+	broker.Logger = logger
+
+	port, done := runBroker(t, broker, 2)
+
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(denied).
+		Receive(refused).
+		End().
+		Test(t, conn1)
+
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn2)
+
+	<-done
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return len(broker.currentClients()) == 0
+	})
+
+	entry := logger.find("authentication_failed")
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, LogWarn, entry.level)
+		assert.Equal(t, "deny", entry.fields["username"])
+		assert.Equal(t, "test", entry.fields["client_id"])
+		assert.NotEmpty(t, entry.fields["remote_addr"])
+	}
+
+	entry = logger.find("client_connected")
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, LogInfo, entry.level)
+		assert.Equal(t, "test", entry.fields["client_id"])
+	}
+
+	entry = logger.find("packet_received")
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, LogDebug, entry.level)
+		assert.NotNil(t, entry.fields["packet"])
+	}
+}
+
+// a writer that passes every write to the channel
+type chanWriter chan string
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestErrorHandler(t *testing.T) {
+	type report struct {
+		client Client
+		err    error
+	}
+
+	reports := make(chan report, 1)
+
+	broker := New()
+	broker.ErrorHandler = func(client Client, err error) {
+		reports <- report{client, err}
+	}
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	// protocol violations are reported with the client
+	tools.NewFlow().
+		Send(packet.NewPingreqPacket()).
+		End().
+		Test(t, conn)
+
+	r := <-reports
+	assert.NotNil(t, r.client)
+	assert.EqualError(t, r.err, "expected connect")
+
+	<-done
+}
+
+func TestErrorLog(t *testing.T) {
+	lines := make(chanWriter, 1)
+
+	broker := New()
+	broker.ErrorLog = log.New(lines, "", 0)
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewPingreqPacket()).
+		End().
+		Test(t, conn)
+
+	line := <-lines
+	assert.True(t, strings.HasPrefix(line, "broker: client "))
+	assert.True(t, strings.HasSuffix(line, ": expected connect\n"))
+
+	<-done
+}
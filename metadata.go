@@ -0,0 +1,202 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/gomqtt/packet"
+)
+
+// Metadata holds annotations of a message that are passed through the broker
+// pipeline without being encoded on the wire.
+//
+// Metadata that is attached by an inbound Middleware to the message of a
+// PublishPacket is available to the Backend and to every Client the message
+// is delivered to, including the outbound Middleware of remote clients. The
+// metadata is kept by the broker that handles the message and released once
+// the message has been delivered, messages that are queued for offline
+// sessions or resent later do not carry it. Metadata that has not been
+// released is dropped when the broker is closed.
+type Metadata map[string]interface{}
+
+// Annotate will attach the value to the metadata of the message.
+func (b *Broker) Annotate(msg *packet.Message, key string, value interface{}) {
+	b.annotations().set(msg, key, value)
+}
+
+// Annotations will return a copy of the metadata of the message or nil if the
+// message has not been annotated.
+func (b *Broker) Annotations(msg *packet.Message) Metadata {
+	return b.annotations().get(msg)
+}
+
+// returns the registry of the broker, a nil broker has no registry
+func (b *Broker) annotations() *annotationRegistry {
+	if b == nil {
+		return nil
+	}
+
+	return &b.metadata
+}
+
+// returns the registry of the broker the backend has been started with
+func (m *MemoryBackend) annotations() *annotationRegistry {
+	return m.broker.annotations()
+}
+
+// keeps track of the metadata of annotated messages, a nil registry drops
+// all annotations
+type annotationRegistry struct {
+	table map[*packet.Message]Metadata
+	size  int64
+	mutex sync.RWMutex
+}
+
+// sets an annotation
+func (r *annotationRegistry) set(msg *packet.Message, key string, value interface{}) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// lazily allocate table
+	if r.table == nil {
+		r.table = make(map[*packet.Message]Metadata)
+	}
+
+	meta, ok := r.table[msg]
+	if !ok {
+		meta = make(Metadata)
+		r.table[msg] = meta
+		atomic.AddInt64(&r.size, 1)
+	}
+
+	meta[key] = value
+}
+
+// removes an annotation
+func (r *annotationRegistry) unset(msg *packet.Message, key string) {
+	// skip lookup if no message is annotated
+	if r == nil || atomic.LoadInt64(&r.size) == 0 {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	meta, ok := r.table[msg]
+	if !ok {
+		return
+	}
+
+	delete(meta, key)
+	if len(meta) == 0 {
+		delete(r.table, msg)
+		atomic.AddInt64(&r.size, -1)
+	}
+}
+
+// returns a copy of the metadata
+func (r *annotationRegistry) get(msg *packet.Message) Metadata {
+	// skip lookup if no message is annotated
+	if r == nil || atomic.LoadInt64(&r.size) == 0 {
+		return nil
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	meta, ok := r.table[msg]
+	if !ok {
+		return nil
+	}
+
+	copied := make(Metadata, len(meta))
+	for key, value := range meta {
+		copied[key] = value
+	}
+
+	return copied
+}
+
+// returns the message if it has not been annotated or a copy of the message
+// that carries a copy of the metadata
+func (r *annotationRegistry) fork(msg *packet.Message) *packet.Message {
+	meta := r.get(msg)
+	if meta == nil {
+		return msg
+	}
+
+	forked := *msg
+
+	r.mutex.Lock()
+	if r.table == nil {
+		r.table = make(map[*packet.Message]Metadata)
+	}
+	r.table[&forked] = meta
+	atomic.AddInt64(&r.size, 1)
+	r.mutex.Unlock()
+
+	return &forked
+}
+
+// moves the metadata of the message to the other message
+func (r *annotationRegistry) move(msg, other *packet.Message) {
+	// skip lookup if no message is annotated
+	if r == nil || atomic.LoadInt64(&r.size) == 0 {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if meta, ok := r.table[msg]; ok {
+		delete(r.table, msg)
+		r.table[other] = meta
+	}
+}
+
+// releases the metadata of the message
+func (r *annotationRegistry) release(msg *packet.Message) {
+	// skip lookup if no message is annotated
+	if r == nil || atomic.LoadInt64(&r.size) == 0 {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.table[msg]; ok {
+		delete(r.table, msg)
+		atomic.AddInt64(&r.size, -1)
+	}
+}
+
+// drops the metadata of all messages
+func (r *annotationRegistry) reset() {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.table = nil
+	atomic.StoreInt64(&r.size, 0)
+}
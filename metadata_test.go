@@ -0,0 +1,140 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnnotations(t *testing.T) {
+	broker := New()
+	annotations := broker.annotations()
+
+	msg := &packet.Message{Topic: "test"}
+	assert.Nil(t, broker.Annotations(msg))
+
+	broker.Annotate(msg, "tenant", "acme")
+	assert.Equal(t, Metadata{"tenant": "acme"}, broker.Annotations(msg))
+
+	// returned metadata is a copy
+	broker.Annotations(msg)["tenant"] = "other"
+	assert.Equal(t, Metadata{"tenant": "acme"}, broker.Annotations(msg))
+
+	// metadata is kept per broker
+	assert.Nil(t, New().Annotations(msg))
+
+	forked := annotations.fork(msg)
+	assert.False(t, forked == msg)
+	assert.Equal(t, Metadata{"tenant": "acme"}, broker.Annotations(forked))
+
+	annotations.release(msg)
+	assert.Nil(t, broker.Annotations(msg))
+
+	other := &packet.Message{}
+	annotations.move(forked, other)
+	assert.Nil(t, broker.Annotations(forked))
+	assert.Equal(t, Metadata{"tenant": "acme"}, broker.Annotations(other))
+
+	annotations.release(other)
+	assert.Nil(t, broker.Annotations(other))
+
+	// not annotated messages are not copied
+	assert.True(t, annotations.fork(msg) == msg)
+
+	// metadata that has not been released is dropped on close
+	broker.Annotate(msg, "tenant", "acme")
+	assert.NoError(t, broker.Close(time.Second))
+	assert.Nil(t, broker.Annotations(msg))
+
+	// a missing broker drops all metadata
+	var missing *Broker
+	missing.Annotate(msg, "tenant", "acme")
+	assert.Nil(t, missing.Annotations(msg))
+}
+
+type annotatingMiddleware struct {
+	broker *Broker
+}
+
+func (m *annotatingMiddleware) Inbound(client Client, pkt packet.Packet) (packet.Packet, error) {
+	if p, ok := pkt.(*packet.PublishPacket); ok {
+		m.broker.Annotate(&p.Message, "tenant", "acme")
+	}
+
+	return pkt, nil
+}
+
+func (m *annotatingMiddleware) Outbound(client Client, pkt packet.Packet) (packet.Packet, error) {
+	if p, ok := pkt.(*packet.PublishPacket); ok {
+		p.Message.Payload = []byte(fmt.Sprintf("%v", m.broker.Annotations(&p.Message)["tenant"]))
+	}
+
+	return pkt, nil
+}
+
+func TestMetadata(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("test")
+
+	delivered := packet.NewPublishPacket()
+	delivered.Message.Topic = "test"
+	delivered.Message.Payload = []byte("acme")
+
+	broker := New()
+	broker.Use(&annotatingMiddleware{broker: broker})
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(publish).
+		Receive(delivered).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	// all metadata has been released
+	broker.metadata.mutex.RLock()
+	assert.Empty(t, broker.metadata.table)
+	broker.metadata.mutex.RUnlock()
+}
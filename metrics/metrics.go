@@ -0,0 +1,241 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics exposes the counters and gauges of a broker in the
+// Prometheus text format. It is kept separate from the broker package, so
+// that embedders that do not need it do not pay for it.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomqtt/broker"
+	"github.com/gomqtt/packet"
+)
+
+// a single metric in the exposition
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value int64
+}
+
+// Handler returns a http.Handler that writes the limit counters and the
+// connection gauges of the broker in the Prometheus text format.
+func Handler(b *broker.Broker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		snapshot, err := b.Snapshot()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		draining := int64(0)
+		if snapshot.Draining {
+			draining = 1
+		}
+
+		counters := b.Counters()
+
+		metrics := []metric{
+			{"gomqtt_clients", "gauge", "The number of connected clients.", int64(len(snapshot.Clients))},
+			{"gomqtt_pending_connects", "gauge", "The number of connections that have not yet completed their handshake.", int64(snapshot.Pending)},
+			{"gomqtt_draining", "gauge", "Whether the broker is draining.", draining},
+			{"gomqtt_rejected_connections_total", "counter", "The number of connections refused because of the connection limit.", counters.RejectedConnections},
+			{"gomqtt_refused_handshakes_total", "counter", "The number of connections closed because of the pending connect limit.", counters.RefusedHandshakes},
+			{"gomqtt_throttled_publishes_total", "counter", "The number of publishes delayed because of the publish rate.", counters.ThrottledPublishes},
+			{"gomqtt_disconnected_clients_total", "counter", "The number of clients disconnected because of the payload size, publish rate or a quota.", counters.DisconnectedClients},
+			{"gomqtt_stalled_clients_total", "counter", "The number of times a client has been detected as stalled.", counters.StalledClients},
+			{"gomqtt_dropped_messages_total", "counter", "The number of QOS 0 messages dropped because of a stalled client or the low watermark.", counters.DroppedMessages},
+			{"gomqtt_idle_clients_total", "counter", "The number of clients closed because of the first message timeout.", counters.IdleClients},
+			{"gomqtt_canary_failures_total", "counter", "The number of canary round trips that failed or timed out.", counters.CanaryFailures},
+			{"gomqtt_slow_consumers_total", "counter", "The number of clients disconnected because of the high watermark.", counters.SlowConsumers},
+			{"gomqtt_dropped_events_total", "counter", "The number of events dropped because of a full events channel.", counters.DroppedEvents},
+			{"gomqtt_shed_messages_total", "counter", "The number of QOS 0 messages dropped because of the load shedding.", counters.ShedMessages},
+			{"gomqtt_deferred_publishes_total", "counter", "The number of publishes deferred because of the load shedding.", counters.DeferredPublishes},
+			{"gomqtt_vetoed_publishes_total", "counter", "The number of incoming messages vetoed by the publish hook.", counters.VetoedPublishes},
+			{"gomqtt_retain_rewrites_total", "counter", "The number of retain flags rewritten by the publish hook.", counters.RetainRewrites},
+			{"gomqtt_qos_rewrites_total", "counter", "The number of QOS levels rewritten by the publish hook.", counters.QOSRewrites},
+			{"gomqtt_aborted_searches_total", "counter", "The number of retained lookups aborted because of the search budget.", counters.AbortedSearches},
+			{"gomqtt_over_quota_publishes_total", "counter", "The number of publishes dropped or disconnected because of a quota.", counters.OverQuotaPublishes},
+		}
+
+		// add retained statistics if available
+		if backend, ok := b.Backend.(retainedReporter); ok {
+			stats := backend.RetainedStats()
+
+			metrics = append(metrics, []metric{
+				{"gomqtt_retained_messages", "gauge", "The number of retained messages.", int64(stats.Messages)},
+				{"gomqtt_evicted_retained_messages_total", "counter", "The number of retained messages evicted because of a quota.", stats.Evicted},
+				{"gomqtt_expired_retained_messages_total", "counter", "The number of retained messages purged because of the TTL or their expiry.", stats.Expired},
+			}...)
+		}
+
+		// add hook statistics
+		for _, stats := range b.HookStats() {
+			labels := fmt.Sprintf("{hook=%q}", stats.Name)
+
+			metrics = append(metrics, []metric{
+				{"gomqtt_hook_calls_total" + labels, "counter", "The number of calls of a hook.", stats.Calls},
+				{"gomqtt_hook_panics_total" + labels, "counter", "The number of recovered panics of a hook.", stats.Panics},
+				{"gomqtt_hook_dropped_total" + labels, "counter", "The number of packets dropped because of a full observer queue.", stats.Dropped},
+				{"gomqtt_hook_latency_microseconds_total" + labels, "counter", "The total duration of the calls of a hook.", int64(stats.Latency / time.Microsecond)},
+			}...)
+		}
+
+		// add quota usage
+		for _, usage := range b.QuotaUsage() {
+			labels := fmt.Sprintf("{key=%q,id=%q,window=%q}", usage.Key, usage.ID, usage.Window)
+
+			metrics = append(metrics, []metric{
+				{"gomqtt_quota_messages" + labels, "gauge", "The messages published in the sliding window of a quota.", usage.Messages},
+				{"gomqtt_quota_bytes" + labels, "gauge", "The payload bytes published in the sliding window of a quota.", usage.Bytes},
+			}...)
+		}
+
+		// add connection churn
+		for _, stats := range b.ChurnStats() {
+			listener := fmt.Sprintf("listener=%q", stats.Listener)
+
+			metrics = append(metrics, metric{"gomqtt_refused_connects_total{" + listener + "}", "counter", "The number of connections closed before the handshake.", stats.Refused})
+
+			var codes []int
+			for code := range stats.Connacks {
+				codes = append(codes, int(code))
+			}
+			sort.Ints(codes)
+
+			for _, code := range codes {
+				labels := fmt.Sprintf("{%s,code=\"%d\"}", listener, code)
+				metrics = append(metrics, metric{"gomqtt_connacks_total" + labels, "counter", "The number of sent CONNACK packets by return code.", stats.Connacks[packet.ConnackCode(code)]})
+			}
+
+			var reasons []int
+			for reason := range stats.Disconnects {
+				reasons = append(reasons, int(reason))
+			}
+			sort.Ints(reasons)
+
+			for _, reason := range reasons {
+				labels := fmt.Sprintf("{%s,reason=%q}", listener, broker.DisconnectReason(reason))
+				metrics = append(metrics, metric{"gomqtt_disconnects_total" + labels, "counter", "The number of lost connections by reason.", stats.Disconnects[broker.DisconnectReason(reason)]})
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		write(w, metrics)
+	})
+}
+
+// a backend that reports retained statistics like the MemoryBackend
+type retainedReporter interface {
+	RetainedStats() broker.RetainedStats
+}
+
+// writes the metrics in the text format, the help and type of labeled metrics
+// is written once
+func write(w io.Writer, metrics []metric) {
+	described := map[string]bool{}
+
+	for _, m := range metrics {
+		name := strings.SplitN(m.name, "{", 2)[0]
+
+		if !described[name] {
+			described[name] = true
+			fmt.Fprintf(w, "# HELP %s %s\n", name, m.help)
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, m.kind)
+		}
+
+		fmt.Fprintf(w, "%s %d\n", m.name, m.value)
+	}
+}
+
+// A Server serves the metrics on a dedicated listener and can be attached to a
+// broker as a Subsystem.
+type Server struct {
+	// The address the server listens on, e.g. "localhost:9100".
+	Addr string
+
+	broker   *broker.Broker
+	listener net.Listener
+	server   *http.Server
+	mutex    sync.Mutex
+}
+
+// NewServer returns a new Server that serves the metrics of the broker on the
+// specified address under "/metrics".
+func NewServer(b *broker.Broker, addr string) *Server {
+	return &Server{
+		Addr:   addr,
+		broker: b,
+	}
+}
+
+// Start will start listening and serving the metrics.
+func (s *Server) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(s.broker))
+
+	s.listener = listener
+	s.server = &http.Server{Handler: mux}
+
+	go s.server.Serve(listener)
+
+	return nil
+}
+
+// Listener returns the listener of a started server.
+func (s *Server) Listener() net.Listener {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.listener
+}
+
+// Stop will close the listener and all open connections.
+func (s *Server) Stop() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.server == nil {
+		return nil
+	}
+
+	err := s.server.Close()
+	s.server = nil
+	s.listener = nil
+
+	return err
+}
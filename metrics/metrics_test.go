@@ -0,0 +1,111 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/broker"
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	b := broker.New()
+	defer b.Observe("test", 1, func(broker.Client, packet.Packet) {})()
+	defer b.Observe("other", 1, func(broker.Client, packet.Packet) {})()
+
+	rec := httptest.NewRecorder()
+	Handler(b).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "# TYPE gomqtt_clients gauge\ngomqtt_clients 0\n")
+	assert.Contains(t, rec.Body.String(), "gomqtt_rejected_connections_total 0\n")
+	assert.Contains(t, rec.Body.String(), "gomqtt_retained_messages 0\n")
+	assert.Contains(t, rec.Body.String(), "gomqtt_over_quota_publishes_total 0\n")
+	assert.Contains(t, rec.Body.String(), "# TYPE gomqtt_hook_calls_total counter\ngomqtt_hook_calls_total{hook=\"test\"} 0\n")
+	assert.Contains(t, rec.Body.String(), "gomqtt_hook_calls_total{hook=\"other\"} 0\n")
+	assert.Equal(t, 1, strings.Count(rec.Body.String(), "# TYPE gomqtt_hook_calls_total"))
+}
+
+func TestHandlerChurn(t *testing.T) {
+	b := broker.New()
+
+	port := tools.NewPort()
+	err := b.Launch(port.URL())
+	assert.NoError(t, err)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(packet.NewConnackPacket()).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	// wait for the cleanup of the client
+	var rec *httptest.ResponseRecorder
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		rec = httptest.NewRecorder()
+		Handler(b).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		if strings.Contains(rec.Body.String(), "gomqtt_disconnects_total") {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = b.Close(time.Second)
+	assert.NoError(t, err)
+
+	listener := fmt.Sprintf("listener=%q", port.URL())
+	assert.Contains(t, rec.Body.String(), "gomqtt_refused_connects_total{"+listener+"} 0\n")
+	assert.Contains(t, rec.Body.String(), "gomqtt_connacks_total{"+listener+",code=\"0\"} 1\n")
+	assert.Contains(t, rec.Body.String(), "gomqtt_disconnects_total{"+listener+",reason=\"clean\"} 1\n")
+}
+
+func TestServer(t *testing.T) {
+	b := broker.New()
+
+	server := NewServer(b, "localhost:0")
+	err := b.Attach(server)
+	assert.NoError(t, err)
+
+	err = b.Start()
+	assert.NoError(t, err)
+
+	res, err := http.Get("http://" + server.Listener().Addr().String() + "/metrics")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "gomqtt_draining 0\n")
+	res.Body.Close()
+
+	err = b.Close(time.Second)
+	assert.NoError(t, err)
+	assert.Nil(t, server.Listener())
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+
+	"github.com/gomqtt/packet"
+)
+
+// A Middleware intercepts the packets exchanged between the broker and its
+// clients. It may be used to implement topic rewriting, payload transformation,
+// audit logging or custom validation.
+type Middleware interface {
+	// Inbound is called with every packet received from the client before it
+	// is processed. Inbound should return the packet that is processed instead,
+	// nil to drop the packet or an error to reject the packet and close the
+	// connection.
+	Inbound(client Client, pkt packet.Packet) (packet.Packet, error)
+
+	// Outbound is called with every packet before it is sent to the client.
+	// Outbound should return the packet that is sent instead, nil to drop the
+	// packet or an error to reject the packet and close the connection.
+	Outbound(client Client, pkt packet.Packet) (packet.Packet, error)
+}
+
+// Use will append the middleware to the chain of middleware. Middleware is a
+// synchronous hook that is called on the goroutine of the client and blocks
+// it. Inbound packets pass the chain in order before they are processed, i.e.
+// before any Backend call caused by the packet, and outbound packets pass the
+// chain in reverse order before they are sent. A panic of a middleware is
+// recovered and handled like a returned error (see Observe for asynchronous
+// hooks and HookStats). Use should be called before the broker handles any
+// connections.
+func (b *Broker) Use(middleware Middleware) {
+	b.middleware = append(b.middleware, middleware)
+	b.middlewareStats = append(b.middlewareStats, &hookStats{
+		stats: HookStats{Name: fmt.Sprintf("%T", middleware)},
+	})
+}
+
+// passes an inbound packet through the middleware chain
+func (b *Broker) inbound(client Client, pkt packet.Packet) (packet.Packet, error) {
+	var err error
+
+	for i, m := range b.middleware {
+		in := pkt
+		pkt, err = b.middlewareStats[i].call(func() (packet.Packet, error) {
+			return m.Inbound(client, in)
+		})
+		if err != nil || pkt == nil {
+			return nil, err
+		}
+	}
+
+	return pkt, nil
+}
+
+// passes an outbound packet through the middleware chain
+func (b *Broker) outbound(client Client, pkt packet.Packet) (packet.Packet, error) {
+	var err error
+
+	for i := len(b.middleware) - 1; i >= 0; i-- {
+		m, out := b.middleware[i], pkt
+		pkt, err = b.middlewareStats[i].call(func() (packet.Packet, error) {
+			return m.Outbound(client, out)
+		})
+		if err != nil || pkt == nil {
+			return nil, err
+		}
+	}
+
+	return pkt, nil
+}
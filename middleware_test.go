@@ -0,0 +1,103 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+type testMiddleware struct{}
+
+func (m *testMiddleware) Inbound(client Client, pkt packet.Packet) (packet.Packet, error) {
+	switch p := pkt.(type) {
+	case *packet.PublishPacket:
+		// rewrite topic
+		if p.Message.Topic == "old" {
+			p.Message.Topic = "new"
+		}
+
+		// reject topic
+		if p.Message.Topic == "reject" {
+			return nil, fmt.Errorf("rejected")
+		}
+	case *packet.PingreqPacket:
+		// drop pings
+		return nil, nil
+	}
+
+	return pkt, nil
+}
+
+func (m *testMiddleware) Outbound(client Client, pkt packet.Packet) (packet.Packet, error) {
+	// transform payload
+	if p, ok := pkt.(*packet.PublishPacket); ok {
+		p.Message.Payload = append([]byte("out:"), p.Message.Payload...)
+	}
+
+	return pkt, nil
+}
+
+func TestMiddleware(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "new"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "old"
+	publish.Message.Payload = []byte("test")
+
+	delivered := packet.NewPublishPacket()
+	delivered.Message.Topic = "new"
+	delivered.Message.Payload = []byte("out:test")
+
+	reject := packet.NewPublishPacket()
+	reject.Message.Topic = "reject"
+
+	broker := New()
+	broker.Use(&testMiddleware{})
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(packet.NewPingreqPacket()).
+		Send(publish).
+		Receive(delivered).
+		Send(reject).
+		End().
+		Test(t, conn)
+
+	<-done
+}
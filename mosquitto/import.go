@@ -0,0 +1,184 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mosquitto
+
+import (
+	"fmt"
+
+	"github.com/gomqtt/broker"
+	"github.com/gomqtt/packet"
+)
+
+// the session directions of the broker
+const (
+	outgoing = "out"
+	incoming = "in"
+)
+
+// ImportFile will read the persistence file at the path and import it into
+// the backend (see Import).
+func ImportFile(backend broker.Backend, path string) error {
+	db, err := ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return Import(backend, db)
+}
+
+// Import will retain the retained messages and set up a stored session for
+// every client that contains its subscriptions, its in flight messages and
+// its queued messages of QOS 1 and 2. Unsent messages get new packet ids.
+// Queued messages of QOS 0 cannot be stored in a session and are skipped. The
+// subscription identifiers are only imported if the session implements the
+// IdentifierSession interface.
+//
+// The import should be run after the backend has been started and before
+// clients are served. Existing sessions with the same client ids are resumed
+// and extended.
+func Import(backend broker.Backend, db *DB) error {
+	importer := broker.NewLocalClient(func(*packet.Message) {})
+
+	// retain messages
+	for _, msg := range db.Retained {
+		err := backend.Publish(importer, msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	// set up sessions
+	for _, c := range db.Clients {
+		err := importClient(backend, c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sets up the stored session of the client
+func importClient(backend broker.Backend, c *Client) error {
+	client := broker.NewLocalClient(func(*packet.Message) {})
+	client.Context().Set("client_id", c.ID)
+	client.Context().Set("clean", false)
+	if c.Username != "" {
+		client.Context().Set("username", c.Username)
+	}
+	if c.SessionExpiry > 0 {
+		client.Context().Set("session_expiry", c.SessionExpiry)
+	}
+
+	session, _, err := backend.Setup(client, c.ID, false)
+	if err != nil {
+		return err
+	}
+
+	// save subscriptions
+	for i := range c.Subscriptions {
+		sub := c.Subscriptions[i]
+
+		err = session.SaveSubscription(&sub)
+		if err != nil {
+			return err
+		}
+
+		if id := c.Identifiers[sub.Topic]; id > 0 {
+			if identifiers, ok := session.(broker.IdentifierSession); ok {
+				err = identifiers.SaveIdentifier(sub.Topic, id)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// save in flight messages first to reserve their ids
+	for _, m := range c.Outgoing {
+		if m.ID == 0 {
+			continue
+		}
+
+		var pkt packet.Packet
+		if m.Released {
+			pubrel := packet.NewPubrelPacket()
+			pubrel.PacketID = m.ID
+			pkt = pubrel
+		} else {
+			publish := packet.NewPublishPacket()
+			publish.Message = *m.Message
+			publish.PacketID = m.ID
+			publish.Dup = true
+			pkt = publish
+		}
+
+		err = session.SavePacket(outgoing, pkt)
+		if err != nil {
+			return err
+		}
+	}
+
+	// save queued messages
+	for _, m := range c.Outgoing {
+		if m.ID != 0 || m.Message.QOS == 0 {
+			continue
+		}
+
+		id, err := freePacketID(session)
+		if err != nil {
+			return err
+		}
+
+		publish := packet.NewPublishPacket()
+		publish.Message = *m.Message
+		publish.PacketID = id
+
+		err = session.SavePacket(outgoing, publish)
+		if err != nil {
+			return err
+		}
+	}
+
+	// save incoming messages that wait for a pubrel
+	for _, m := range c.Incoming {
+		publish := packet.NewPublishPacket()
+		publish.Message = *m.Message
+		publish.PacketID = m.ID
+
+		err = session.SavePacket(incoming, publish)
+		if err != nil {
+			return err
+		}
+	}
+
+	return backend.Terminate(client)
+}
+
+// returns the next packet id that is not used by a stored packet
+func freePacketID(session broker.Session) (uint16, error) {
+	for i := 0; i < 1<<16; i++ {
+		id := session.PacketID()
+
+		pkt, err := session.LookupPacket(outgoing, id)
+		if err != nil {
+			return 0, err
+		} else if pkt == nil {
+			return id, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no free packet id")
+}
@@ -0,0 +1,373 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mosquitto reads the persistence files of the Mosquitto broker and
+// imports their retained messages, subscriptions and queued messages into a
+// Backend, which eases the migration from Mosquitto. It is kept separate from
+// the broker package, so that embedders that do not need it do not pay for
+// it.
+package mosquitto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/gomqtt/packet"
+)
+
+// the magic of persistence files
+var magic = []byte("\x00\xB5\x00mosquitto db")
+
+// the chunk types
+const (
+	chunkConfig    = 1
+	chunkMsgStore  = 2
+	chunkClientMsg = 3
+	chunkRetain    = 4
+	chunkSub       = 5
+	chunkClient    = 6
+)
+
+// the fixed sizes of the chunks
+const (
+	sizeMsgStore  = 32
+	sizeClientMsg = 16
+	sizeRetain    = 8
+	sizeSub       = 12
+	sizeClientV5  = 16
+	sizeClientV6  = 24
+)
+
+// the states of client messages that wait for a pubcomp
+const (
+	stateResendPubrel  = 6
+	stateWaitPubcomp   = 9
+	directionIncoming  = 0
+	sessionNeverExpire = math.MaxUint32
+)
+
+// A DB is the content of a persistence file.
+type DB struct {
+	// The version of the file format, 5 is written by Mosquitto 1.6 and 6 by
+	// Mosquitto 2.0.
+	Version uint32
+
+	// The retained messages.
+	Retained []*packet.Message
+
+	// The persistent clients.
+	Clients []*Client
+}
+
+// A Client is a persistent client of a persistence file.
+type Client struct {
+	// The client id and the username, which is only stored by version 6.
+	ID       string
+	Username string
+
+	// The session expiry interval, zero if the session never expires.
+	SessionExpiry time.Duration
+
+	// The subscriptions and their MQTT 5 subscription identifiers.
+	Subscriptions []packet.Subscription
+	Identifiers   map[string]uint32
+
+	// The outgoing messages that are queued or in flight and the incoming
+	// QOS 2 messages that wait for a pubrel.
+	Outgoing []*Message
+	Incoming []*Message
+}
+
+// A Message is a queued or in flight message of a client.
+type Message struct {
+	// The packet id, zero if the message has not been sent yet.
+	ID uint16
+
+	// Whether a pubrec has been received for an outgoing QOS 2 message.
+	Released bool
+
+	// The message, its QOS is the QOS of the delivery.
+	Message *packet.Message
+}
+
+// a stored message and its expiry
+type storedMessage struct {
+	msg    *packet.Message
+	expiry time.Time
+}
+
+// ReadFile will read the persistence file at the path.
+func ReadFile(path string) (*DB, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	return Read(bufio.NewReader(file))
+}
+
+// Read will read a persistence file of version 5 or 6. Messages that have
+// already expired are skipped.
+func Read(r io.Reader) (*DB, error) {
+	// read header
+	header := make([]byte, len(magic)+8)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid header: %v", err)
+	} else if !bytes.Equal(header[:len(magic)], magic) {
+		return nil, fmt.Errorf("not a mosquitto persistence file")
+	}
+
+	db := &DB{
+		Version: binary.BigEndian.Uint32(header[len(magic)+4:]),
+	}
+
+	if db.Version != 5 && db.Version != 6 {
+		return nil, fmt.Errorf("unsupported persistence version %d", db.Version)
+	}
+
+	now := time.Now()
+	store := make(map[uint64]storedMessage)
+	clients := make(map[string]*Client)
+
+	// get client by id
+	client := func(id string) *Client {
+		c, ok := clients[id]
+		if !ok {
+			c = &Client{ID: id}
+			clients[id] = c
+			db.Clients = append(db.Clients, c)
+		}
+
+		return c
+	}
+
+	for {
+		// read chunk header
+		chunk := make([]byte, 8)
+		_, err = io.ReadFull(r, chunk)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid chunk header: %v", err)
+		}
+
+		typ := binary.BigEndian.Uint32(chunk)
+		data := make([]byte, binary.BigEndian.Uint32(chunk[4:]))
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, fmt.Errorf("truncated chunk %d: %v", typ, err)
+		}
+
+		d := &decoder{data: data}
+
+		switch typ {
+		case chunkMsgStore:
+			d.skip(sizeMsgStore)
+			if d.err != nil {
+				break
+			}
+
+			id := binary.BigEndian.Uint64(data)
+			expiry := int64(binary.BigEndian.Uint64(data[8:]))
+			payloadLen := int(binary.BigEndian.Uint32(data[16:]))
+			sourceIDLen := d.uint16At(22)
+			usernameLen := d.uint16At(24)
+			topicLen := d.uint16At(26)
+
+			d.skip(sourceIDLen + usernameLen)
+			msg := &packet.Message{
+				Topic:   string(d.bytes(topicLen)),
+				Payload: d.bytes(payloadLen),
+				QOS:     d.uint8At(30),
+				Retain:  d.uint8At(31) != 0,
+			}
+
+			stored := storedMessage{msg: msg}
+			if expiry > 0 {
+				stored.expiry = time.Unix(expiry, 0)
+			}
+
+			store[id] = stored
+		case chunkRetain:
+			d.skip(sizeRetain)
+			if d.err != nil {
+				break
+			}
+
+			stored, ok := store[binary.BigEndian.Uint64(data)]
+			if ok && !expired(stored, now) {
+				msg := *stored.msg
+				msg.Retain = true
+				db.Retained = append(db.Retained, &msg)
+			}
+		case chunkClient:
+			size := sizeClientV5
+			if db.Version == 6 {
+				size = sizeClientV6
+			}
+
+			d.skip(size)
+			if d.err != nil {
+				break
+			}
+
+			interval := binary.BigEndian.Uint32(d.data[8:])
+			idLen := d.uint16At(14)
+
+			var usernameLen int
+			if db.Version == 6 {
+				usernameLen = d.uint16At(18)
+			}
+
+			c := client(string(d.bytes(idLen)))
+			c.Username = string(d.bytes(usernameLen))
+			if interval != sessionNeverExpire {
+				c.SessionExpiry = time.Duration(interval) * time.Second
+			}
+		case chunkClientMsg:
+			d.skip(sizeClientMsg)
+			if d.err != nil {
+				break
+			}
+
+			stored, ok := store[binary.BigEndian.Uint64(data)]
+			mid := uint16(d.uint16At(8))
+			idLen := d.uint16At(10)
+			qos := d.uint8At(12)
+			state := d.uint8At(13)
+			retain := d.uint8At(14)>>4 != 0
+			direction := d.uint8At(15)
+
+			c := client(string(d.bytes(idLen)))
+			if d.err != nil || !ok || expired(stored, now) {
+				break
+			}
+
+			msg := *stored.msg
+			msg.QOS = qos
+			msg.Retain = retain
+
+			m := &Message{
+				ID:       mid,
+				Released: state == stateResendPubrel || state == stateWaitPubcomp,
+				Message:  &msg,
+			}
+
+			if direction == directionIncoming {
+				c.Incoming = append(c.Incoming, m)
+			} else {
+				c.Outgoing = append(c.Outgoing, m)
+			}
+		case chunkSub:
+			d.skip(sizeSub)
+			if d.err != nil {
+				break
+			}
+
+			identifier := binary.BigEndian.Uint32(data)
+			idLen := d.uint16At(4)
+			topicLen := d.uint16At(6)
+			qos := d.uint8At(8)
+
+			c := client(string(d.bytes(idLen)))
+			topic := string(d.bytes(topicLen))
+			c.Subscriptions = append(c.Subscriptions, packet.Subscription{
+				Topic: topic,
+				QOS:   qos & 0x03,
+			})
+
+			if identifier > 0 {
+				if c.Identifiers == nil {
+					c.Identifiers = make(map[string]uint32)
+				}
+
+				c.Identifiers[topic] = identifier
+			}
+		case chunkConfig:
+			// the configuration is not needed
+		}
+
+		if d.err != nil {
+			return nil, fmt.Errorf("invalid chunk %d: %v", typ, d.err)
+		}
+	}
+
+	return db, nil
+}
+
+// returns whether the stored message has expired
+func expired(stored storedMessage, now time.Time) bool {
+	return !stored.expiry.IsZero() && !stored.expiry.After(now)
+}
+
+// decodes the variable part of a chunk after its fixed part
+type decoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+// skips the fixed part of the chunk
+func (d *decoder) skip(n int) {
+	if d.err != nil {
+		return
+	} else if d.pos+n > len(d.data) {
+		d.err = io.ErrUnexpectedEOF
+		return
+	}
+
+	d.pos += n
+}
+
+// returns the next n bytes
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil || n == 0 {
+		return nil
+	} else if d.pos+n > len(d.data) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	buf := append([]byte{}, d.data[d.pos:d.pos+n]...)
+	d.pos += n
+
+	return buf
+}
+
+// returns the uint16 at the offset of the fixed part
+func (d *decoder) uint16At(offset int) int {
+	if d.err != nil || offset+2 > len(d.data) {
+		return 0
+	}
+
+	return int(binary.BigEndian.Uint16(d.data[offset:]))
+}
+
+// returns the uint8 at the offset of the fixed part
+func (d *decoder) uint8At(offset int) uint8 {
+	if d.err != nil || offset >= len(d.data) {
+		return 0
+	}
+
+	return d.data[offset]
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mosquitto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/broker"
+	"github.com/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+// writes a persistence file of version 6
+type writer struct {
+	bytes.Buffer
+}
+
+func newWriter() *writer {
+	w := &writer{}
+	w.Write(magic)
+	w.uint32(0)
+	w.uint32(6)
+	return w
+}
+
+func (w *writer) uint8(v uint8)   { w.WriteByte(v) }
+func (w *writer) uint16(v uint16) { binary.Write(w, binary.BigEndian, v) }
+func (w *writer) uint32(v uint32) { binary.Write(w, binary.BigEndian, v) }
+func (w *writer) uint64(v uint64) { binary.Write(w, binary.BigEndian, v) }
+
+func (w *writer) chunk(typ uint32, fn func(c *writer)) {
+	c := &writer{}
+	fn(c)
+	w.uint32(typ)
+	w.uint32(uint32(c.Len()))
+	w.Write(c.Bytes())
+}
+
+func (w *writer) msgStore(id uint64, expiry int64, topic, payload string, qos uint8, retain bool) {
+	w.chunk(chunkMsgStore, func(c *writer) {
+		c.uint64(id)
+		c.uint64(uint64(expiry))
+		c.uint32(uint32(len(payload)))
+		c.uint16(0)
+		c.uint16(3)
+		c.uint16(0)
+		c.uint16(uint16(len(topic)))
+		c.uint16(1883)
+		c.uint8(qos)
+		if retain {
+			c.uint8(1)
+		} else {
+			c.uint8(0)
+		}
+		c.WriteString("src")
+		c.WriteString(topic)
+		c.WriteString(payload)
+	})
+}
+
+func (w *writer) clientMsg(id uint64, client string, mid uint16, qos, state, direction uint8) {
+	w.chunk(chunkClientMsg, func(c *writer) {
+		c.uint64(id)
+		c.uint16(mid)
+		c.uint16(uint16(len(client)))
+		c.uint8(qos)
+		c.uint8(state)
+		c.uint8(0)
+		c.uint8(direction)
+		c.WriteString(client)
+	})
+}
+
+func testDB() []byte {
+	w := newWriter()
+
+	w.chunk(chunkConfig, func(c *writer) {
+		c.uint64(4)
+		c.uint8(1)
+		c.uint8(8)
+		c.Write(make([]byte, 6))
+	})
+
+	w.msgStore(1, 0, "status", "online", 1, true)
+	w.msgStore(2, time.Now().Add(-time.Hour).Unix(), "expired", "old", 0, true)
+	w.msgStore(3, 0, "cmd/a", "queued", 1, false)
+	w.msgStore(4, 0, "cmd/b", "inflight", 2, false)
+	w.msgStore(5, 0, "cmd/c", "incoming", 2, false)
+
+	w.chunk(chunkRetain, func(c *writer) { c.uint64(1) })
+	w.chunk(chunkRetain, func(c *writer) { c.uint64(2) })
+
+	w.chunk(chunkClient, func(c *writer) {
+		c.uint64(0)
+		c.uint32(3600)
+		c.uint16(7)
+		c.uint16(4)
+		c.uint16(1883)
+		c.uint16(5)
+		c.uint32(0)
+		c.WriteString("dev1")
+		c.WriteString("alice")
+	})
+
+	w.clientMsg(3, "dev1", 0, 1, 11, 1)
+	w.clientMsg(4, "dev1", 7, 2, stateWaitPubcomp, 1)
+	w.clientMsg(5, "dev1", 9, 2, 7, directionIncoming)
+
+	w.chunk(chunkSub, func(c *writer) {
+		c.uint32(42)
+		c.uint16(4)
+		c.uint16(5)
+		c.uint8(1)
+		c.uint8(0)
+		c.uint16(0)
+		c.WriteString("dev1")
+		c.WriteString("cmd/#")
+	})
+
+	return w.Bytes()
+}
+
+func TestRead(t *testing.T) {
+	db, err := Read(bytes.NewReader(testDB()))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(6), db.Version)
+
+	assert.Equal(t, []*packet.Message{
+		{Topic: "status", Payload: []byte("online"), QOS: 1, Retain: true},
+	}, db.Retained)
+
+	if assert.Len(t, db.Clients, 1) {
+		client := db.Clients[0]
+		assert.Equal(t, "dev1", client.ID)
+		assert.Equal(t, "alice", client.Username)
+		assert.Equal(t, time.Hour, client.SessionExpiry)
+		assert.Equal(t, []packet.Subscription{{Topic: "cmd/#", QOS: 1}}, client.Subscriptions)
+		assert.Equal(t, map[string]uint32{"cmd/#": 42}, client.Identifiers)
+
+		assert.Equal(t, []*Message{
+			{Message: &packet.Message{Topic: "cmd/a", Payload: []byte("queued"), QOS: 1}},
+			{ID: 7, Released: true, Message: &packet.Message{Topic: "cmd/b", Payload: []byte("inflight"), QOS: 2}},
+		}, client.Outgoing)
+
+		assert.Equal(t, []*Message{
+			{ID: 9, Message: &packet.Message{Topic: "cmd/c", Payload: []byte("incoming"), QOS: 2}},
+		}, client.Incoming)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	_, err := Read(bytes.NewReader([]byte("invalid")))
+	assert.Error(t, err)
+
+	w := newWriter()
+	w.chunk(chunkRetain, func(c *writer) { c.uint16(1) })
+	_, err = Read(bytes.NewReader(w.Bytes()))
+	assert.Error(t, err)
+
+	data := testDB()
+	binary.BigEndian.PutUint32(data[len(magic)+4:], 4)
+	_, err = Read(bytes.NewReader(data))
+	assert.Error(t, err)
+}
+
+func TestImport(t *testing.T) {
+	db, err := Read(bytes.NewReader(testDB()))
+	assert.NoError(t, err)
+
+	backend := broker.NewMemoryBackend()
+	assert.NoError(t, backend.Start(broker.New()))
+	defer backend.Stop()
+
+	err = Import(backend, db)
+	assert.NoError(t, err)
+
+	retained, err := backend.RetainedMessages("#")
+	assert.NoError(t, err)
+	if assert.Len(t, retained, 1) {
+		assert.Equal(t, "status", retained[0].Topic)
+	}
+
+	client := broker.NewLocalClient(func(*packet.Message) {})
+	session, resumed, err := backend.Setup(client, "dev1", false)
+	assert.NoError(t, err)
+	assert.True(t, resumed)
+
+	subs, err := session.AllSubscriptions()
+	assert.NoError(t, err)
+	assert.Equal(t, []*packet.Subscription{{Topic: "cmd/#", QOS: 1}}, subs)
+
+	ids, err := session.(broker.IdentifierSession).MatchIdentifiers("cmd/x")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{42}, ids)
+
+	pubrel, err := session.LookupPacket(outgoing, 7)
+	assert.NoError(t, err)
+	_, ok := pubrel.(*packet.PubrelPacket)
+	assert.True(t, ok)
+
+	out, err := session.AllPackets(outgoing)
+	assert.NoError(t, err)
+	assert.Len(t, out, 2)
+
+	in, err := session.LookupPacket(incoming, 9)
+	assert.NoError(t, err)
+	if publish, ok := in.(*packet.PublishPacket); assert.True(t, ok) {
+		assert.Equal(t, "cmd/c", publish.Message.Topic)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ocsp implements a revocation checker that queries OCSP responders.
+// It is kept separate from the broker package, so that embedders that do not
+// check revocations do not depend on golang.org/x/crypto.
+package ocsp
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// a cached ocsp response
+type ocspStatus struct {
+	revoked bool
+	expires time.Time
+}
+
+// A Checker is a broker.RevocationChecker that queries the OCSP responders
+// listed in the checked certificates. Responses are cached until their next
+// update.
+type Checker struct {
+	// The client used to query the responders.
+	Client *http.Client
+
+	statuses map[string]ocspStatus
+	mutex    sync.Mutex
+}
+
+// NewChecker returns a new Checker that queries the responders with
+// the specified timeout.
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{
+		Client:   &http.Client{Timeout: timeout},
+		statuses: make(map[string]ocspStatus),
+	}
+}
+
+// Revoked will return true if a responder of the certificate reports that the
+// certificate has been revoked. An error is returned if the certificate lists
+// no responder or none of them returned a valid response.
+func (c *Checker) Revoked(cert, issuer *x509.Certificate) (bool, error) {
+	key := issuer.Subject.String() + "/" + cert.SerialNumber.String()
+
+	// check cache
+	c.mutex.Lock()
+	status, ok := c.statuses[key]
+	c.mutex.Unlock()
+
+	if ok && time.Now().Before(status.expires) {
+		return status.revoked, nil
+	}
+
+	// check responders
+	if len(cert.OCSPServer) == 0 {
+		return false, fmt.Errorf("no ocsp responder for %s", cert.Subject)
+	}
+
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return false, err
+	}
+
+	// query responders until one succeeds
+	for _, server := range cert.OCSPServer {
+		var res *ocsp.Response
+		res, err = c.query(server, request, cert, issuer)
+		if err != nil {
+			continue
+		} else if res.Status == ocsp.Unknown {
+			err = fmt.Errorf("ocsp status of %s is unknown", cert.Subject)
+			continue
+		}
+
+		status = ocspStatus{
+			revoked: res.Status == ocsp.Revoked,
+			expires: res.NextUpdate,
+		}
+
+		// lazily allocate cache
+		c.mutex.Lock()
+		if c.statuses == nil {
+			c.statuses = make(map[string]ocspStatus)
+		}
+		c.statuses[key] = status
+		c.mutex.Unlock()
+
+		return status.revoked, nil
+	}
+
+	return false, err
+}
+
+// sends the request to the responder and parses the response
+func (c *Checker) query(server string, request []byte, cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Post(server, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	// check status
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ocsp responder returned %s", res.Status)
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return ocsp.ParseResponseForCert(data, cert, issuer)
+}
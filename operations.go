@@ -0,0 +1,218 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import "time"
+
+// Operations are the runtime actions that can be carried out on a running
+// broker. The gomqtt-broker binary maps them to signals, while embedding
+// applications can call them directly on the Broker.
+type Operations interface {
+	// ReloadConfig should reload the configuration.
+	ReloadConfig() error
+
+	// RotateLogs should reopen all log files.
+	RotateLogs() error
+
+	// FlushStats should write out all collected statistics.
+	FlushStats() error
+
+	// Drain should stop accepting new connections and close all connected
+	// clients.
+	Drain() error
+
+	// Snapshot should return a snapshot of the current state.
+	Snapshot() (*Snapshot, error)
+}
+
+// A Reloader is a Backend or a component of a Backend that is able to reload
+// its configuration.
+type Reloader interface {
+	// Reload should reload the configuration.
+	Reload() error
+}
+
+// A Snapshot describes the state of a broker at a point in time.
+type Snapshot struct {
+	Time     time.Time         `json:"time"`
+	Draining bool              `json:"draining"`
+	Pending  int               `json:"pending"`
+	Clients  []*ClientSnapshot `json:"clients"`
+}
+
+// A ClientSnapshot describes a connected client.
+type ClientSnapshot struct {
+	UUID     string `json:"uuid"`
+	ClientID string `json:"client_id"`
+	RemoteIP string `json:"remote_ip"`
+
+	// The username and whether the client connected with a clean session.
+	Username string `json:"username,omitempty"`
+	Clean    bool   `json:"clean"`
+
+	// The subscribed topic filters, their granted QOS levels and the number
+	// of outgoing messages that have not yet been acknowledged.
+	Subscriptions []string        `json:"subscriptions"`
+	Granted       map[string]byte `json:"granted"`
+	Inflight      int             `json:"inflight"`
+
+	// The duration the current write to the client has been blocked.
+	WriterBlocked time.Duration `json:"writer_blocked"`
+
+	// The tuned outgoing buffer and inflight window if AutoTuning is enabled.
+	TunedBuffer   int `json:"tuned_buffer,omitempty"`
+	TunedInflight int `json:"tuned_inflight,omitempty"`
+}
+
+// ReloadConfig will reload the backend if it implements the Reloader
+// interface and call the ConfigReloader callback if available. Afterwards,
+// the subscriptions of all connected clients are reauthorized.
+func (b *Broker) ReloadConfig() error {
+	b.RecordAction("reload_config", "")
+
+	if reloader, ok := b.Backend.(Reloader); ok {
+		err := reloader.Reload()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := call(b.ConfigReloader)
+	if err != nil {
+		return err
+	}
+
+	return b.Reauthorize()
+}
+
+// Reauthorize will check the subscriptions of all connected clients against
+// the backend and revoke the subscriptions that are no longer authorized. It
+// should be called whenever the authorization rules change at runtime and
+// drops the cached authorization decisions (see AuthorizationCacheTTL).
+// Clients are not told about revoked subscriptions, instead every revocation
+// emits a SubscriptionRevoked event and, if enabled, a system notification.
+func (b *Broker) Reauthorize() error {
+	var err error
+
+	for _, c := range b.currentClients() {
+		_err := c.reauthorize()
+		if err == nil {
+			err = _err
+		}
+	}
+
+	return err
+}
+
+// RotateLogs will call the LogRotator callback if available.
+func (b *Broker) RotateLogs() error {
+	b.RecordAction("rotate_logs", "")
+
+	return call(b.LogRotator)
+}
+
+// FlushStats will call the StatsFlusher callback if available.
+func (b *Broker) FlushStats() error {
+	b.RecordAction("flush_stats", "")
+
+	return call(b.StatsFlusher)
+}
+
+// Drain will stop the broker from accepting new connections and close all
+// currently connected clients. Wills of closed clients are dispatched.
+func (b *Broker) Drain() error {
+	b.RecordAction("drain", "")
+
+	b.clientsMutex.Lock()
+	b.draining = true
+	b.clientsMutex.Unlock()
+
+	for _, c := range b.currentClients() {
+		c.disconnectAs(DisconnectShutdown)
+		c.Close(false)
+	}
+
+	return nil
+}
+
+// CloseClient will close the connected clients with the client id and return
+// the number of closed clients.
+func (b *Broker) CloseClient(clientID string) int {
+	b.RecordAction("close_client", clientID)
+
+	closed := 0
+
+	for _, c := range b.currentClients() {
+		if id, _ := c.Context().Get("client_id").(string); id == clientID && id != "" {
+			c.Close(false)
+			closed++
+		}
+	}
+
+	return closed
+}
+
+// Snapshot will return a snapshot of the currently connected clients.
+func (b *Broker) Snapshot() (*Snapshot, error) {
+	b.clientsMutex.Lock()
+	draining, pending := b.draining, b.pending
+	b.clientsMutex.Unlock()
+
+	snapshot := &Snapshot{
+		Time:     time.Now(),
+		Draining: draining,
+		Pending:  pending,
+		Clients:  []*ClientSnapshot{},
+	}
+
+	for _, c := range b.currentClients() {
+		ctx := c.Context()
+
+		clientID, _ := ctx.Get("client_id").(string)
+		remoteIP, _ := ctx.Get("remote_ip").(string)
+		username, _ := ctx.Get("username").(string)
+		clean, _ := ctx.Get("clean").(bool)
+
+		client := &ClientSnapshot{
+			UUID:     ctx.Get("uuid").(string),
+			ClientID: clientID,
+			RemoteIP: remoteIP,
+			Username: username,
+			Clean:    clean,
+
+			Inflight:      c.inflight(),
+			WriterBlocked: c.writerBlocked(),
+		}
+
+		client.Subscriptions, client.Granted = c.subscriptions()
+
+		if c.tuner != nil {
+			client.TunedBuffer, client.TunedInflight = c.tuner.sizes()
+		}
+
+		snapshot.Clients = append(snapshot.Clients, client)
+	}
+
+	return snapshot, nil
+}
+
+// calls an optional callback
+func call(fn func() error) error {
+	if fn == nil {
+		return nil
+	}
+
+	return fn()
+}
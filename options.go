@@ -0,0 +1,178 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sync/atomic"
+
+	"github.com/gomqtt/packet"
+)
+
+// A RetainHandling defines when the retained messages of a subscription are
+// sent.
+type RetainHandling byte
+
+const (
+	// RetainSendAlways sends the retained messages with every subscribe.
+	RetainSendAlways RetainHandling = iota
+
+	// RetainSendNew sends the retained messages only if the subscription did
+	// not already exist.
+	RetainSendNew
+
+	// RetainSendNever does not send retained messages.
+	RetainSendNever
+)
+
+// SubscriptionOptions are the MQTT 5 options of a subscription. MQTT 3.1.1
+// clients cannot transfer them, the options of remote clients may be provided
+// using the SubscriptionOptions callback of the broker instead.
+type SubscriptionOptions struct {
+	// The RetainHandling defines when retained messages are sent.
+	RetainHandling RetainHandling
+
+	// If NoLocal is set, messages published by the subscribed client itself
+	// are not delivered, which prevents echoes of bridges and loops.
+	NoLocal bool
+
+	// If RetainAsPublished is set, the retain flag of delivered messages is
+	// kept as published. Otherwise, it is only set on retained messages that
+	// are sent because of the subscription.
+	RetainAsPublished bool
+}
+
+// An OptionsSubscriber is a Backend that is able to subscribe clients using
+// SubscriptionOptions. Subscriptions made using Subscribe behave like
+// subscriptions with RetainAsPublished set.
+type OptionsSubscriber interface {
+	// SubscribeWithOptions should subscribe the client like Subscribe and
+	// apply the options to the subscription. The returned retained messages
+	// should respect the RetainHandling.
+	SubscribeWithOptions(client Client, topic string, options SubscriptionOptions) ([]*packet.Message, error)
+}
+
+// SubscribeWithOptions will subscribe the passed client to the specified topic
+// like Subscribe and apply the options. The options are kept while the client
+// is connected and are not stored in its session.
+func (m *MemoryBackend) SubscribeWithOptions(client Client, topic string, options SubscriptionOptions) ([]*packet.Message, error) {
+	filter := m.namespace(client) + topic
+
+	// check existing subscription
+	m.routesMutex.Lock()
+	existed := m.routes[client][filter]
+	m.routesMutex.Unlock()
+
+	err := m.subscribeOnly(client, topic, &options)
+	if err != nil {
+		return nil, err
+	}
+
+	// skip retained messages
+	if options.RetainHandling == RetainSendNever || (options.RetainHandling == RetainSendNew && existed) {
+		m.retainedMutex.Lock()
+		delete(m.subscribedAt[client], filter)
+		if len(m.subscribedAt[client]) == 0 {
+			delete(m.subscribedAt, client)
+		}
+		m.retainedMutex.Unlock()
+
+		return nil, nil
+	}
+
+	return m.retainedOf(client, topic)
+}
+
+// removes the options of a subscription or all subscriptions of a client if
+// the filter is empty, the routes mutex must be held
+func (m *MemoryBackend) removeOptions(client Client, filter string) {
+	if m.options[client] == nil {
+		return
+	}
+
+	if filter != "" {
+		delete(m.options[client], filter)
+		if len(m.options[client]) > 0 {
+			return
+		}
+	}
+
+	delete(m.options, client)
+	atomic.AddInt64(&m.optioned, -1)
+}
+
+// returns whether a message published by the publisher is delivered to the
+// subscribed client and whether its retain flag is kept according to the
+// options of the matching subscriptions
+func (m *MemoryBackend) applyOptions(publisher, client Client, topic string) (bool, bool) {
+	// skip lookup if no client has options
+	if atomic.LoadInt64(&m.optioned) == 0 {
+		return true, true
+	}
+
+	m.routesMutex.Lock()
+	defer m.routesMutex.Unlock()
+
+	options, ok := m.options[client]
+	if !ok {
+		return true, true
+	}
+
+	deliver, retain := false, false
+	for filter := range m.routes[client] {
+		if !matchFilter(filter, topic) {
+			continue
+		}
+
+		// subscriptions without options behave as before
+		opts, ok := options[filter]
+		if !ok {
+			return true, true
+		}
+
+		if !opts.NoLocal || publisher != client {
+			deliver = true
+			retain = retain || opts.RetainAsPublished
+		}
+	}
+
+	return deliver, retain
+}
+
+// delivers a message to a subscribed client according to the options of its
+// subscriptions
+func (m *MemoryBackend) forward(publisher, client Client, msg *packet.Message) error {
+	deliver, retain := m.applyOptions(publisher, client, msg.Topic)
+	if !deliver {
+		return nil
+	}
+
+	if !msg.Retain || retain {
+		return m.deliver(client, msg)
+	}
+
+	// the copy carries the metadata until it has been delivered
+	local := m.annotations().fork(msg)
+	if local == msg {
+		copied := *msg
+		local = &copied
+	}
+
+	local.Retain = false
+
+	err := m.deliver(client, local)
+	m.annotations().release(local)
+
+	return err
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryBackendSubscribeWithOptions(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	var received []*packet.Message
+	subscriber := NewLocalClient(func(msg *packet.Message) {
+		received = append(received, msg)
+	})
+
+	publisher := NewLocalClient(func(*packet.Message) {})
+
+	err := backend.Publish(publisher, &packet.Message{Topic: "foo", Payload: []byte("foo"), Retain: true})
+	assert.NoError(t, err)
+
+	// retained messages are only sent for new subscriptions
+	msgs, err := backend.SubscribeWithOptions(subscriber, "foo", SubscriptionOptions{RetainHandling: RetainSendNew})
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+
+	msgs, err = backend.SubscribeWithOptions(subscriber, "foo", SubscriptionOptions{RetainHandling: RetainSendNew})
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	msgs, err = backend.SubscribeWithOptions(subscriber, "#", SubscriptionOptions{RetainHandling: RetainSendNever, NoLocal: true})
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	// the retain flag is cleared unless retained as published
+	err = backend.Publish(publisher, &packet.Message{Topic: "foo", Payload: []byte("bar"), Retain: true})
+	assert.NoError(t, err)
+	assert.Len(t, received, 1)
+	assert.False(t, received[0].Retain)
+
+	_, err = backend.SubscribeWithOptions(subscriber, "foo", SubscriptionOptions{RetainAsPublished: true})
+	assert.NoError(t, err)
+
+	err = backend.Publish(publisher, &packet.Message{Topic: "foo", Payload: []byte("baz"), Retain: true})
+	assert.NoError(t, err)
+	assert.Len(t, received, 2)
+	assert.True(t, received[1].Retain)
+
+	// messages of the subscriber itself are not delivered
+	err = backend.Publish(subscriber, &packet.Message{Topic: "bar", Payload: []byte("bar")})
+	assert.NoError(t, err)
+	assert.Len(t, received, 2)
+
+	err = backend.Publish(publisher, &packet.Message{Topic: "bar", Payload: []byte("bar")})
+	assert.NoError(t, err)
+	assert.Len(t, received, 3)
+
+	// a plain subscription replaces the options
+	_, err = backend.Subscribe(subscriber, "#")
+	assert.NoError(t, err)
+
+	err = backend.Publish(subscriber, &packet.Message{Topic: "bar", Payload: []byte("bar")})
+	assert.NoError(t, err)
+	assert.Len(t, received, 4)
+
+	err = backend.Terminate(subscriber)
+	assert.NoError(t, err)
+	assert.Empty(t, backend.options)
+	assert.Equal(t, int64(0), backend.optioned)
+}
+
+func TestSubscriptionOptions(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	publish := packet.NewPublishPacket()
+	publish.Message = packet.Message{Topic: "test", Payload: []byte("test")}
+
+	broker := New()
+	broker.SubscriptionOptions = func(client Client, sub packet.Subscription) SubscriptionOptions {
+		return SubscriptionOptions{NoLocal: true}
+	}
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	// the published message is not echoed
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(publish).
+		Send(packet.NewPingreqPacket()).
+		Receive(packet.NewPingrespPacket()).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+}
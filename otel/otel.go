@@ -0,0 +1,116 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package otel provides a broker.Tracer that is backed by OpenTelemetry. It is
+// kept separate from the broker package, so that embedders that do not trace
+// messages do not depend on go.opentelemetry.io/otel.
+package otel
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/gomqtt/broker"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A Tracer starts the spans of the broker using an OpenTelemetry tracer.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer returns a new Tracer that uses the specified tracer.
+func NewTracer(tracer trace.Tracer) *Tracer {
+	return &Tracer{
+		tracer: tracer,
+	}
+}
+
+// Start implements the broker.Tracer interface.
+func (t *Tracer) Start(name string, parent broker.Span, attributes map[string]interface{}) broker.Span {
+	// prepare context
+	ctx := context.Background()
+	if span, ok := parent.(*Span); ok {
+		ctx = trace.ContextWithSpan(ctx, span.span)
+	}
+
+	// start span
+	_, span := t.tracer.Start(ctx, name, trace.WithAttributes(convert(attributes)...))
+
+	return &Span{span: span}
+}
+
+// A Span wraps an OpenTelemetry span.
+type Span struct {
+	span trace.Span
+}
+
+// Remote returns a Span for a span context that has been extracted from a
+// message, e.g. by an inbound broker.Middleware, so that it can be attached
+// using broker.SpanAnnotation and becomes the parent of the publish span.
+func Remote(sc trace.SpanContext) *Span {
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), sc)
+	return &Span{span: trace.SpanFromContext(ctx)}
+}
+
+// SpanContext returns the span context, e.g. to inject it into a delivered
+// message using an outbound broker.Middleware.
+func (s *Span) SpanContext() trace.SpanContext {
+	return s.span.SpanContext()
+}
+
+// SetError implements the broker.Span interface.
+func (s *Span) SetError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// End implements the broker.Span interface.
+func (s *Span) End() {
+	s.span.End()
+}
+
+// converts the broker attributes
+func convert(attributes map[string]interface{}) []attribute.KeyValue {
+	// sort keys
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// convert values
+	list := make([]attribute.KeyValue, 0, len(keys))
+	for _, key := range keys {
+		switch value := attributes[key].(type) {
+		case string:
+			list = append(list, attribute.String(key, value))
+		case int:
+			list = append(list, attribute.Int(key, value))
+		case int64:
+			list = append(list, attribute.Int64(key, value))
+		case float64:
+			list = append(list, attribute.Float64(key, value))
+		case bool:
+			list = append(list, attribute.Bool(key, value))
+		default:
+			list = append(list, attribute.String(key, fmt.Sprint(value)))
+		}
+	}
+
+	return list
+}
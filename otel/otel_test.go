@@ -0,0 +1,115 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gomqtt/broker"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type testSpan struct {
+	trace.Span
+
+	name       string
+	parent     trace.Span
+	attributes []attribute.KeyValue
+	errors     []error
+	status     codes.Code
+	ended      bool
+}
+
+func (s *testSpan) RecordError(err error, _ ...trace.EventOption) {
+	s.errors = append(s.errors, err)
+}
+
+func (s *testSpan) SetStatus(code codes.Code, _ string) {
+	s.status = code
+}
+
+func (s *testSpan) End(_ ...trace.SpanEndOption) {
+	s.ended = true
+}
+
+type testTracer struct {
+	trace.Tracer
+
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	config := trace.NewSpanStartConfig(opts...)
+
+	span := &testSpan{
+		name:       name,
+		parent:     trace.SpanFromContext(ctx),
+		attributes: config.Attributes(),
+	}
+	t.spans = append(t.spans, span)
+
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &testTracer{}
+	var _ broker.Tracer = NewTracer(tracer)
+
+	parent := NewTracer(tracer).Start("publish", nil, map[string]interface{}{
+		"messaging.destination.name": "test",
+		"messaging.mqtt.qos":         1,
+		"messaging.mqtt.retain":      true,
+	})
+	child := NewTracer(tracer).Start("authorize", parent, nil)
+
+	child.SetError(errors.New("denied"))
+	child.End()
+	parent.End()
+
+	assert.Len(t, tracer.spans, 2)
+	assert.Equal(t, "publish", tracer.spans[0].name)
+	assert.Equal(t, []attribute.KeyValue{
+		attribute.String("messaging.destination.name", "test"),
+		attribute.Int("messaging.mqtt.qos", 1),
+		attribute.Bool("messaging.mqtt.retain", true),
+	}, tracer.spans[0].attributes)
+	assert.True(t, tracer.spans[0].ended)
+
+	assert.Equal(t, "authorize", tracer.spans[1].name)
+	assert.Equal(t, tracer.spans[0], tracer.spans[1].parent)
+	assert.Equal(t, []error{errors.New("denied")}, tracer.spans[1].errors)
+	assert.Equal(t, codes.Error, tracer.spans[1].status)
+	assert.True(t, tracer.spans[1].ended)
+}
+
+func TestRemote(t *testing.T) {
+	tracer := &testTracer{}
+
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{1},
+		SpanID:  trace.SpanID{1},
+	})
+
+	span := NewTracer(tracer).Start("publish", Remote(sc), nil)
+	assert.Equal(t, sc.TraceID(), tracer.spans[0].parent.SpanContext().TraceID())
+	assert.True(t, tracer.spans[0].parent.SpanContext().IsRemote())
+
+	span.End()
+}
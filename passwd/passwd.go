@@ -0,0 +1,377 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package passwd authenticates clients using Mosquitto-style password files
+// that contain bcrypt or argon2id hashes. It is kept separate from the broker
+// package, so that embedders that do not need it do not depend on
+// golang.org/x/crypto.
+package passwd
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomqtt/broker"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// An Algorithm selects the hash function used by Hash.
+type Algorithm int
+
+// The available algorithms.
+const (
+	Bcrypt Algorithm = iota
+	Argon2id
+)
+
+// the parameters of new argon2id hashes
+const (
+	argon2Time    = 1
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// Hash will return the encoded hash of the password, which can be stored in a
+// password file. Bcrypt hashes use the default cost and argon2id hashes are
+// encoded in the PHC string format, e.g. "$argon2id$v=19$m=65536,t=1,p=4$...".
+func Hash(password string, algorithm Algorithm) (string, error) {
+	switch algorithm {
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+
+		return string(hash), nil
+	case Argon2id:
+		salt := make([]byte, argon2SaltLen)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+			argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+
+	return "", fmt.Errorf("unknown algorithm %d", algorithm)
+}
+
+// Compare will return whether the password matches the encoded bcrypt or
+// argon2id hash. An error is returned if the hash is malformed or uses an
+// unsupported algorithm.
+func Compare(hash, password string) (bool, error) {
+	switch {
+	case isBcrypt(hash):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		params, err := decodeArgon2(hash)
+		if err != nil {
+			return false, err
+		}
+
+		key := argon2.IDKey([]byte(password), params.salt, params.time, params.memory, params.threads, uint32(len(params.key)))
+
+		return subtle.ConstantTimeCompare(key, params.key) == 1, nil
+	}
+
+	return false, fmt.Errorf("unsupported hash")
+}
+
+// returns whether the hash uses one of the bcrypt prefixes
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// checks the format of a hash without the costly comparison
+func check(hash string) error {
+	switch {
+	case isBcrypt(hash):
+		if len(hash) != 60 {
+			return fmt.Errorf("malformed bcrypt hash")
+		}
+
+		return nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		_, err := decodeArgon2(hash)
+		return err
+	}
+
+	return fmt.Errorf("unsupported hash")
+}
+
+// the decoded parameters of an argon2id hash
+type argon2Params struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// decodes a hash in the PHC string format
+func decodeArgon2(hash string) (*argon2Params, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("malformed argon2id hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version")
+	}
+
+	params := &argon2Params{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads)
+	if err != nil {
+		return nil, fmt.Errorf("malformed argon2id parameters")
+	}
+
+	params.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, fmt.Errorf("malformed argon2id salt")
+	}
+
+	params.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(params.key) == 0 {
+		return nil, fmt.Errorf("malformed argon2id key")
+	}
+
+	return params, nil
+}
+
+// Parse will read a password file that lists a "username:hash" pair per line
+// and return the hashes by username. Empty lines and lines starting with "#"
+// are skipped. An error is returned for lines with hashes that cannot be
+// compared, like the SHA512 hashes of older mosquitto_passwd versions.
+func Parse(r io.Reader) (map[string]string, error) {
+	hashes := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		i := strings.Index(text, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: missing username", line)
+		}
+
+		user, hash := text[:i], text[i+1:]
+
+		err := check(hash)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		hashes[user] = hash
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+// A File is a broker.PasswordChecker that verifies passwords against the
+// hashes of a password file (see Parse). The file is reloaded by Reload, which
+// is called by the MemoryBackend and SQLBackend when the broker reloads its
+// configuration, e.g. on SIGHUP. Attached to the broker as a subsystem the
+// file is also reloaded when it changes.
+type File struct {
+	// The path of the password file.
+	Path string
+
+	// The interval in which the file is checked for changes once started. A
+	// zero interval disables the watching.
+	Interval time.Duration
+
+	// The optional Logger receives the events of reloads that have been
+	// triggered by changes.
+	Logger broker.Logger
+
+	hashes  map[string]string
+	modTime time.Time
+	size    int64
+	quit    chan struct{}
+	mutex   sync.RWMutex
+}
+
+// Load will return a new File that has been loaded from the path.
+func Load(path string) (*File, error) {
+	f := &File{
+		Path: path,
+	}
+
+	err := f.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Reload will read the file again. The current hashes are kept if the file
+// cannot be read or parsed.
+func (f *File) Reload() error {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	hashes, err := Parse(file)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// the version is also recorded if invalid, so that the watcher only
+	// retries once the file changes again
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.Path, err)
+	}
+
+	f.hashes = hashes
+
+	return nil
+}
+
+// CheckPassword will return whether the user is listed in the file and
+// whether the password matches its hash.
+func (f *File) CheckPassword(user, password string) (bool, bool) {
+	f.mutex.RLock()
+	hash, ok := f.hashes[user]
+	f.mutex.RUnlock()
+
+	if !ok {
+		return false, false
+	}
+
+	valid, err := Compare(hash, password)
+	if err != nil {
+		return true, false
+	}
+
+	return true, valid
+}
+
+// Start will launch the watcher if the Interval is set.
+func (f *File) Start() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.Interval <= 0 || f.quit != nil {
+		return nil
+	}
+
+	f.quit = make(chan struct{})
+	go f.watch(f.quit)
+
+	return nil
+}
+
+// Stop will stop the watcher.
+func (f *File) Stop() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.quit != nil {
+		close(f.quit)
+		f.quit = nil
+	}
+
+	return nil
+}
+
+// reloads the file whenever its modification time or size changes
+func (f *File) watch(quit chan struct{}) {
+	ticker := time.NewTicker(f.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			if !f.changed() {
+				continue
+			}
+
+			err := f.Reload()
+			if f.Logger == nil {
+				continue
+			}
+
+			if err != nil {
+				f.Logger.Warn("password_file_reload_failed", map[string]interface{}{
+					"path":  f.Path,
+					"error": err,
+				})
+			} else {
+				f.Logger.Info("password_file_reloaded", map[string]interface{}{
+					"path": f.Path,
+				})
+			}
+		}
+	}
+}
+
+// returns whether the file has changed since it has been loaded
+func (f *File) changed() bool {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return false
+	}
+
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+}
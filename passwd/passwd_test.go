@@ -0,0 +1,196 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package passwd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/broker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHash(t *testing.T) {
+	for _, algorithm := range []Algorithm{Bcrypt, Argon2id} {
+		hash, err := Hash("secret", algorithm)
+		assert.NoError(t, err)
+		assert.NoError(t, check(hash))
+
+		ok, err := Compare(hash, "secret")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = Compare(hash, "wrong")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	}
+
+	hash, err := Hash("secret", Argon2id)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=1,p=4$"))
+
+	_, err = Hash("secret", Algorithm(7))
+	assert.Error(t, err)
+}
+
+func TestCompareInvalid(t *testing.T) {
+	for _, hash := range []string{
+		"secret",
+		"$6$salt$hash",
+		"$argon2id$v=19$m=65536,t=1,p=4$salt",
+		"$argon2id$v=16$m=65536,t=1,p=4$c2FsdA$a2V5",
+		"$argon2id$v=19$m=65536$c2FsdA$a2V5",
+		"$argon2id$v=19$m=65536,t=1,p=4$c2FsdA$",
+	} {
+		_, err := Compare(hash, "secret")
+		assert.Error(t, err, hash)
+	}
+}
+
+func TestParse(t *testing.T) {
+	hash, err := Hash("secret", Argon2id)
+	assert.NoError(t, err)
+
+	hashes, err := Parse(strings.NewReader("# users\n\nfoo:" + hash + "\n  bar:" + hash + "  \n"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"foo": hash, "bar": hash}, hashes)
+
+	_, err = Parse(strings.NewReader("foo:" + hash + "\nbar:$6$salt$hash\n"))
+	assert.EqualError(t, err, "line 2: unsupported hash")
+
+	_, err = Parse(strings.NewReader(":" + hash))
+	assert.EqualError(t, err, "line 1: missing username")
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "passwd")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "passwd")
+	write(t, path, "foo", "foo")
+
+	file, err := Load(path)
+	assert.NoError(t, err)
+
+	known, valid := file.CheckPassword("foo", "foo")
+	assert.True(t, known)
+	assert.True(t, valid)
+
+	known, valid = file.CheckPassword("foo", "bar")
+	assert.True(t, known)
+	assert.False(t, valid)
+
+	known, valid = file.CheckPassword("bar", "bar")
+	assert.False(t, known)
+	assert.False(t, valid)
+
+	// reload changed file
+	write(t, path, "bar", "bar")
+	assert.NoError(t, file.Reload())
+
+	known, _ = file.CheckPassword("foo", "foo")
+	assert.False(t, known)
+
+	_, valid = file.CheckPassword("bar", "bar")
+	assert.True(t, valid)
+
+	// invalid files keep the current hashes
+	assert.NoError(t, ioutil.WriteFile(path, []byte("baz:baz\n"), 0600))
+	assert.Error(t, file.Reload())
+
+	_, valid = file.CheckPassword("bar", "bar")
+	assert.True(t, valid)
+
+	_, err = Load(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestFileWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "passwd")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "passwd")
+	write(t, path, "foo", "foo")
+
+	file, err := Load(path)
+	assert.NoError(t, err)
+
+	file.Interval = 10 * time.Millisecond
+	assert.NoError(t, file.Start())
+	defer file.Stop()
+
+	write(t, path, "foobar", "foobar")
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if known, _ := file.CheckPassword("foobar", "foobar"); known {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, valid := file.CheckPassword("foobar", "foobar")
+	assert.True(t, valid)
+
+	known, _ := file.CheckPassword("foo", "foo")
+	assert.False(t, known)
+}
+
+func TestMemoryBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "passwd")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "passwd")
+	write(t, path, "allow", "allow")
+
+	file, err := Load(path)
+	assert.NoError(t, err)
+
+	backend := broker.NewMemoryBackend()
+	backend.Passwords = file
+
+	ok, err := backend.Authenticate(nil, "allow", "allow")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = backend.Authenticate(nil, "allow", "deny")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// the file is reloaded with the backend
+	write(t, path, "other", "other")
+	assert.NoError(t, backend.Reload())
+
+	ok, err = backend.Authenticate(nil, "other", "other")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+// writes a password file with a single user
+func write(t *testing.T, path, user, password string) {
+	hash, err := Hash(password, Bcrypt)
+	assert.NoError(t, err)
+
+	err = ioutil.WriteFile(path, []byte(user+":"+hash+"\n"), 0600)
+	assert.NoError(t, err)
+}
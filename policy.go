@@ -0,0 +1,107 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"github.com/gomqtt/packet"
+)
+
+// A RetainRewrite describes how a PublishHook changes the retain flag.
+type RetainRewrite int
+
+const (
+	// RetainUnchanged keeps the retain flag of the message.
+	RetainUnchanged RetainRewrite = iota
+
+	// RetainStrip clears the retain flag, so that the message is delivered
+	// but not retained.
+	RetainStrip
+
+	// RetainForce sets the retain flag, so that the message is retained.
+	RetainForce
+)
+
+// A PublishRewrite is the decision of a PublishHook about an incoming
+// message. The zero value publishes the message unchanged.
+type PublishRewrite struct {
+	// Veto drops the message silently, like an unauthorized message.
+	Veto bool
+
+	// Retain changes the retain flag of the message.
+	Retain RetainRewrite
+
+	// If SetQOS is set, the message is published with the QOS level. It does
+	// not change the acknowledgement of the publish, which continues to use
+	// the QOS level of the publish packet.
+	SetQOS bool
+	QOS    byte
+}
+
+// StripRetain returns a PublishHook that strips the retain flag of the
+// messages published by clients that are not allowed to retain messages,
+// e.g. because only gateway clients may retain.
+func StripRetain(allowed func(client Client) bool) func(Client, *packet.Message) PublishRewrite {
+	return func(client Client, msg *packet.Message) PublishRewrite {
+		if msg.Retain && !allowed(client) {
+			return PublishRewrite{Retain: RetainStrip}
+		}
+
+		return PublishRewrite{}
+	}
+}
+
+// applies the publish hook to the message and returns false if the message
+// has been vetoed
+func (c *remoteClient) rewritePublish(msg *packet.Message) bool {
+	if c.broker.PublishHook == nil {
+		return true
+	}
+
+	rewrite := c.broker.PublishHook(c, msg)
+
+	// check veto
+	if rewrite.Veto {
+		c.broker.count(&c.broker.counters.VetoedPublishes)
+
+		c.log(LogWarn, "packet_dropped", map[string]interface{}{
+			"reason": "vetoed",
+			"topic":  msg.Topic,
+		})
+
+		return false
+	}
+
+	// rewrite retain flag
+	retain := msg.Retain
+	switch rewrite.Retain {
+	case RetainStrip:
+		retain = false
+	case RetainForce:
+		retain = true
+	}
+
+	if retain != msg.Retain {
+		msg.Retain = retain
+		c.broker.count(&c.broker.counters.RetainRewrites)
+	}
+
+	// rewrite qos
+	if rewrite.SetQOS && rewrite.QOS != msg.QOS {
+		msg.QOS = rewrite.QOS
+		c.broker.count(&c.broker.counters.QOSRewrites)
+	}
+
+	return true
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishHook(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.Username = "sensor"
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "#", QOS: 1}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{1}
+	suback.PacketID = 1
+
+	retained := packet.NewPublishPacket()
+	retained.Message = packet.Message{Topic: "state", Payload: []byte("1"), Retain: true}
+
+	stripped := packet.NewPublishPacket()
+	stripped.Message = packet.Message{Topic: "state", Payload: []byte("1")}
+
+	blocked := packet.NewPublishPacket()
+	blocked.Message = packet.Message{Topic: "blocked", Payload: []byte("1")}
+
+	upgrade := packet.NewPublishPacket()
+	upgrade.Message = packet.Message{Topic: "important", Payload: []byte("1")}
+
+	upgraded := packet.NewPublishPacket()
+	upgraded.Message = packet.Message{Topic: "important", Payload: []byte("1"), QOS: 1}
+	upgraded.PacketID = 1
+
+	puback := packet.NewPubackPacket()
+	puback.PacketID = 1
+
+	backend := NewMemoryBackend()
+
+	broker := New()
+	broker.Backend = backend
+
+	strip := StripRetain(func(client Client) bool {
+		return client.Context().Get("username") == "gateway"
+	})
+
+	broker.PublishHook = func(client Client, msg *packet.Message) PublishRewrite {
+		switch msg.Topic {
+		case "blocked":
+			return PublishRewrite{Veto: true}
+		case "important":
+			return PublishRewrite{SetQOS: true, QOS: 1}
+		}
+
+		return strip(client, msg)
+	}
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(retained).
+		Receive(stripped).
+		Send(blocked).
+		Send(upgrade).
+		Receive(upgraded).
+		Send(puback).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	msgs, err := backend.RetainedMessages("#")
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	counters := broker.Counters()
+	assert.Equal(t, int64(1), counters.VetoedPublishes)
+	assert.Equal(t, int64(1), counters.RetainRewrites)
+	assert.Equal(t, int64(1), counters.QOSRewrites)
+}
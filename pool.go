@@ -0,0 +1,72 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gomqtt/packet"
+)
+
+// The outgoing QOS 0 publish packets are not stored in the session and are
+// reused once they have been written, which is after the flush for packets
+// buffered by a BatchConn. As middleware may keep a reference to the
+// packets it is passed, the packets are only reused if no middleware is used.
+var publishPool = sync.Pool{
+	New: func() interface{} {
+		return packet.NewPublishPacket()
+	},
+}
+
+// the timers used to detect stalled clients
+var timerPool sync.Pool
+
+// returns an empty publish packet from the pool
+func acquirePublish() *packet.PublishPacket {
+	return publishPool.Get().(*packet.PublishPacket)
+}
+
+// returns the sent publish packet to the pool if it may be reused
+func (b *Broker) releasePublish(publish *packet.PublishPacket) {
+	if publish.Message.QOS > 0 || len(b.middleware) > 0 {
+		return
+	}
+
+	*publish = packet.PublishPacket{}
+	publishPool.Put(publish)
+}
+
+// returns a started timer from the pool
+func acquireTimer(timeout time.Duration) *time.Timer {
+	if timer, ok := timerPool.Get().(*time.Timer); ok {
+		timer.Reset(timeout)
+		return timer
+	}
+
+	return time.NewTimer(timeout)
+}
+
+// stops the timer and returns it to the pool
+func releaseTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+
+	timerPool.Put(timer)
+}
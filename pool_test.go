@@ -0,0 +1,174 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishPool(t *testing.T) {
+	broker := New()
+
+	publish := acquirePublish()
+	publish.Message = packet.Message{Topic: "test", Payload: []byte("test")}
+	broker.releasePublish(publish)
+	assert.Equal(t, packet.PublishPacket{}, *publish)
+
+	// packets stored in the session are not reused
+	publish = acquirePublish()
+	publish.Message = packet.Message{Topic: "test", QOS: 1}
+	broker.releasePublish(publish)
+	assert.Equal(t, byte(1), publish.Message.QOS)
+
+	timer := acquireTimer(time.Millisecond)
+	<-timer.C
+	releaseTimer(timer)
+
+	timer = acquireTimer(time.Hour)
+	releaseTimer(timer)
+}
+
+// connects a client that is subscribed to the topic
+func benchmarkClient(b *testing.B, port *tools.Port, topic string, qos byte) transport.Conn {
+	conn, err := transport.Dial(port.URL())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: topic, QOS: qos}}
+	subscribe.PacketID = 1
+
+	for _, pkt := range []packet.Packet{packet.NewConnectPacket(), subscribe} {
+		err = conn.Send(pkt)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		_, err = conn.Receive()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return conn
+}
+
+// receives a packet or fails
+func benchmarkReceive(b *testing.B, conn transport.Conn) packet.Packet {
+	pkt, err := conn.Receive()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return pkt
+}
+
+func BenchmarkFanOut(b *testing.B) {
+	broker := New()
+
+	port := tools.NewPort()
+
+	err := broker.Launch(port.URL())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var subscribers []transport.Conn
+	for i := 0; i < 10; i++ {
+		subscribers = append(subscribers, benchmarkClient(b, port, "fanout", 0))
+	}
+
+	publisher := benchmarkClient(b, port, "other", 0)
+
+	publish := packet.NewPublishPacket()
+	publish.Message = packet.Message{Topic: "fanout", Payload: []byte("test")}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err = publisher.Send(publish)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for _, subscriber := range subscribers {
+			benchmarkReceive(b, subscriber)
+		}
+	}
+
+	b.StopTimer()
+
+	err = broker.Close(time.Second)
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkQoS1RoundTrip(b *testing.B) {
+	broker := New()
+
+	port := tools.NewPort()
+
+	err := broker.Launch(port.URL())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	conn := benchmarkClient(b, port, "roundtrip", 1)
+
+	publish := packet.NewPublishPacket()
+	publish.Message = packet.Message{Topic: "roundtrip", Payload: []byte("test"), QOS: 1}
+
+	puback := packet.NewPubackPacket()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		publish.PacketID = uint16(i%65535) + 1
+
+		err = conn.Send(publish)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		// receive the puback and the delivered message in any order
+		for received := 0; received < 2; received++ {
+			if delivered, ok := benchmarkReceive(b, conn).(*packet.PublishPacket); ok {
+				puback.PacketID = delivered.PacketID
+
+				err = conn.Send(puback)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+
+	b.StopTimer()
+
+	err = broker.Close(time.Second)
+	if err != nil {
+		b.Fatal(err)
+	}
+}
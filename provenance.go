@@ -0,0 +1,115 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gomqtt/packet"
+)
+
+// ProvenanceAnnotation is the metadata key of the Provenance of a stamped
+// message (see Broker.Annotations).
+const ProvenanceAnnotation = "provenance"
+
+// A ProvenanceMode defines how the messages published by clients are stamped
+// with their origin.
+type ProvenanceMode int
+
+const (
+	// ProvenanceOff does not stamp messages.
+	ProvenanceOff ProvenanceMode = iota
+
+	// ProvenanceMetadata attaches the Provenance to the metadata of the
+	// message, which makes it available to the Backend, the outbound
+	// Middleware and local clients while the message is delivered.
+	ProvenanceMetadata
+
+	// ProvenanceEnvelope additionally wraps the payload in an Envelope, which
+	// makes the Provenance available to remote subscribers. Empty payloads
+	// that clear retained messages are not wrapped.
+	ProvenanceEnvelope
+)
+
+// A Provenance describes the origin of a message as seen by the broker. It
+// cannot be forged by the publishing client, as it is stamped at ingress after
+// the client has been authenticated.
+type Provenance struct {
+	ClientID string    `json:"client_id,omitempty"`
+	Username string    `json:"username,omitempty"`
+	NodeID   string    `json:"node_id,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// An Envelope wraps the payload of a message stamped using the
+// ProvenanceEnvelope mode. It is encoded as JSON with the payload encoded
+// using base64.
+type Envelope struct {
+	Provenance Provenance `json:"provenance"`
+	Payload    []byte     `json:"payload"`
+}
+
+// OpenEnvelope will decode the envelope of a payload that has been wrapped
+// using the ProvenanceEnvelope mode.
+func OpenEnvelope(payload []byte) (*Envelope, error) {
+	var envelope Envelope
+	err := json.Unmarshal(payload, &envelope)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envelope: %v", err)
+	}
+
+	return &envelope, nil
+}
+
+// MessageProvenance will return the Provenance a message has been stamped
+// with while it is delivered or nil if it has not been stamped.
+func (b *Broker) MessageProvenance(msg *packet.Message) *Provenance {
+	provenance, _ := b.Annotations(msg)[ProvenanceAnnotation].(*Provenance)
+	return provenance
+}
+
+// stamps the message published by the client according to the provenance mode
+func (b *Broker) stamp(client Client, msg *packet.Message) error {
+	if b.Provenance == ProvenanceOff {
+		return nil
+	}
+
+	provenance := &Provenance{
+		NodeID: b.NodeID,
+		Time:   time.Now(),
+	}
+
+	provenance.ClientID, _ = client.Context().Get("client_id").(string)
+	provenance.Username, _ = client.Context().Get("username").(string)
+
+	b.Annotate(msg, ProvenanceAnnotation, provenance)
+
+	// wrap payload
+	if b.Provenance == ProvenanceEnvelope && !(msg.Retain && len(msg.Payload) == 0) {
+		payload, err := json.Marshal(Envelope{
+			Provenance: *provenance,
+			Payload:    msg.Payload,
+		})
+		if err != nil {
+			return err
+		}
+
+		msg.Payload = payload
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvenance(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+	connect.Username = "user"
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	publish := packet.NewPublishPacket()
+	publish.Message = packet.Message{Topic: "test", Payload: []byte("hello")}
+
+	cleared := packet.NewPublishPacket()
+	cleared.Message = packet.Message{Topic: "test", Retain: true}
+
+	broker := New()
+	broker.NodeID = "node"
+	broker.Provenance = ProvenanceEnvelope
+
+	// observe metadata using a local client
+	received := make(chan *packet.Message, 2)
+	provenances := make(chan *Provenance, 2)
+	local := NewLocalClient(func(msg *packet.Message) {
+		received <- msg
+		provenances <- broker.MessageProvenance(msg)
+	})
+
+	_, _, err := broker.Backend.Setup(local, "", true)
+	assert.NoError(t, err)
+
+	_, err = broker.Backend.Subscribe(local, "test")
+	assert.NoError(t, err)
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(publish).
+		Test(t, conn)
+
+	// remote subscribers receive the envelope
+	pkt, err := conn.Receive()
+	assert.NoError(t, err)
+
+	envelope, err := OpenEnvelope(pkt.(*packet.PublishPacket).Message.Payload)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), envelope.Payload)
+	assert.Equal(t, "test", envelope.Provenance.ClientID)
+	assert.Equal(t, "user", envelope.Provenance.Username)
+	assert.Equal(t, "node", envelope.Provenance.NodeID)
+	assert.False(t, envelope.Provenance.Time.IsZero())
+
+	assert.Equal(t, pkt.(*packet.PublishPacket).Message.Payload, (<-received).Payload)
+
+	provenance := <-provenances
+	assert.Equal(t, envelope.Provenance.Time.Unix(), provenance.Time.Unix())
+	assert.Equal(t, "test", provenance.ClientID)
+	assert.Equal(t, "user", provenance.Username)
+	assert.Equal(t, "node", provenance.NodeID)
+
+	// cleared retained messages are not wrapped
+	tools.NewFlow().
+		Send(cleared).
+		Skip(). // publish
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	assert.Empty(t, (<-received).Payload)
+	assert.NotNil(t, <-provenances)
+
+	<-done
+
+	_, err = OpenEnvelope([]byte("hello"))
+	assert.Error(t, err)
+}
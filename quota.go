@@ -0,0 +1,263 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A QuotaKey selects how the publishes of clients are accounted by a Quota.
+type QuotaKey int
+
+const (
+	// QuotaAccount accounts the publishes of all clients sharing the same
+	// accounting key (see AccountingKey), i.e. the username or the remote IP
+	// address of anonymous clients.
+	QuotaAccount QuotaKey = iota
+
+	// QuotaClientID accounts the publishes of all clients with the same client
+	// id. Clients without a client id are accounted per connection.
+	QuotaClientID
+)
+
+// String returns the name of the key.
+func (k QuotaKey) String() string {
+	switch k {
+	case QuotaAccount:
+		return "account"
+	case QuotaClientID:
+		return "client_id"
+	}
+
+	return "unknown"
+}
+
+// A Quota limits the messages and payload bytes that may be published within
+// a sliding window. Publishes exceeding the quota are still acknowledged, but
+// their messages are dropped or the client is disconnected if Disconnect is
+// set.
+type Quota struct {
+	// The Key selects how the publishes are accounted.
+	Key QuotaKey
+
+	// The duration of the sliding window, e.g. one hour.
+	Window time.Duration
+
+	// The maximum number of messages and payload bytes per window. A zero
+	// value disables the respective limit.
+	MaxMessages int64
+	MaxBytes    int64
+
+	// If set, over-quota clients are disconnected instead of dropping their
+	// messages.
+	Disconnect bool
+}
+
+// A QuotaUsage is the current usage of a Quota by an account or client id.
+type QuotaUsage struct {
+	// The Key of the quota and the accounted username, address or client id.
+	Key string `json:"key"`
+	ID  string `json:"id"`
+
+	// The estimated messages and payload bytes published in the current
+	// sliding window and the limits of the quota.
+	Messages    int64         `json:"messages"`
+	Bytes       int64         `json:"bytes"`
+	MaxMessages int64         `json:"max_messages"`
+	MaxBytes    int64         `json:"max_bytes"`
+	Window      time.Duration `json:"window"`
+}
+
+// identifies the usage of a quota
+type quotaID struct {
+	quota int
+	id    string
+}
+
+// a sliding window that weights the usage of the previous window by the
+// remaining overlap with the current window
+type quotaWindow struct {
+	start        time.Time
+	messages     int64
+	bytes        int64
+	prevMessages int64
+	prevBytes    int64
+}
+
+// moves the window forward to the specified time
+func (w *quotaWindow) advance(now time.Time, window time.Duration) {
+	elapsed := now.Sub(w.start)
+
+	if elapsed >= 2*window {
+		*w = quotaWindow{start: now}
+	} else if elapsed >= window {
+		w.prevMessages, w.prevBytes = w.messages, w.bytes
+		w.messages, w.bytes = 0, 0
+		w.start = w.start.Add(window)
+	}
+}
+
+// returns the estimated usage of the sliding window
+func (w *quotaWindow) usage(now time.Time, window time.Duration) (int64, int64) {
+	weight := 1 - float64(now.Sub(w.start))/float64(window)
+	if weight < 0 {
+		weight = 0
+	}
+
+	messages := w.messages + int64(float64(w.prevMessages)*weight)
+	bytes := w.bytes + int64(float64(w.prevBytes)*weight)
+
+	return messages, bytes
+}
+
+// the usage of all configured quotas
+type quotaEngine struct {
+	windows map[quotaID]*quotaWindow
+	swept   time.Time
+	mutex   sync.Mutex
+}
+
+// accounts a publish of the client and returns the first exceeded quota, the
+// publish is not accounted if a quota is exceeded
+func (e *quotaEngine) take(quotas []Quota, client Client, bytes int) *Quota {
+	now := time.Now()
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// lazily allocate windows
+	if e.windows == nil {
+		e.windows = make(map[quotaID]*quotaWindow)
+		e.swept = now
+	}
+
+	e.sweep(quotas, now)
+
+	// check quotas
+	windows := make([]*quotaWindow, len(quotas))
+	for i := range quotas {
+		q := &quotas[i]
+
+		key := quotaID{quota: i, id: quotaKey(q.Key, client)}
+
+		w, ok := e.windows[key]
+		if !ok {
+			w = &quotaWindow{start: now}
+			e.windows[key] = w
+		}
+
+		w.advance(now, q.Window)
+
+		messages, used := w.usage(now, q.Window)
+		if q.MaxMessages > 0 && messages+1 > q.MaxMessages {
+			return q
+		} else if q.MaxBytes > 0 && used+int64(bytes) > q.MaxBytes {
+			return q
+		}
+
+		windows[i] = w
+	}
+
+	// account publish
+	for _, w := range windows {
+		w.messages++
+		w.bytes += int64(bytes)
+	}
+
+	return nil
+}
+
+// removes the windows that have been idle for two windows, the mutex must be
+// held
+func (e *quotaEngine) sweep(quotas []Quota, now time.Time) {
+	// sweep at most once per shortest window
+	interval := time.Duration(0)
+	for _, q := range quotas {
+		if interval == 0 || q.Window < interval {
+			interval = q.Window
+		}
+	}
+
+	if now.Sub(e.swept) < interval {
+		return
+	}
+
+	e.swept = now
+
+	for key, w := range e.windows {
+		if key.quota >= len(quotas) || now.Sub(w.start) >= 2*quotas[key.quota].Window {
+			delete(e.windows, key)
+		}
+	}
+}
+
+// returns the accounted id of the client
+func quotaKey(key QuotaKey, client Client) string {
+	if key == QuotaClientID {
+		if id, _ := client.Context().Get("client_id").(string); id != "" {
+			return id
+		}
+
+		uuid, _ := client.Context().Get("uuid").(string)
+		return uuid
+	}
+
+	return AccountingKey(client)
+}
+
+// QuotaUsage returns the current usage of the configured Quotas sorted by
+// key and id.
+func (b *Broker) QuotaUsage() []QuotaUsage {
+	now := time.Now()
+
+	b.quotas.mutex.Lock()
+	defer b.quotas.mutex.Unlock()
+
+	list := []QuotaUsage{}
+	for key, w := range b.quotas.windows {
+		if key.quota >= len(b.Quotas) {
+			continue
+		}
+
+		q := b.Quotas[key.quota]
+
+		w.advance(now, q.Window)
+		messages, bytes := w.usage(now, q.Window)
+
+		list = append(list, QuotaUsage{
+			Key:         q.Key.String(),
+			ID:          key.id,
+			Messages:    messages,
+			Bytes:       bytes,
+			MaxMessages: q.MaxMessages,
+			MaxBytes:    q.MaxBytes,
+			Window:      q.Window,
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Key != list[j].Key {
+			return list[i].Key < list[j].Key
+		} else if list[i].ID != list[j].ID {
+			return list[i].ID < list[j].ID
+		}
+
+		return list[i].Window < list[j].Window
+	})
+
+	return list
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaWindow(t *testing.T) {
+	start := time.Now()
+
+	w := &quotaWindow{start: start}
+	w.messages, w.bytes = 10, 100
+
+	// the previous window is weighted by the remaining overlap
+	w.advance(start.Add(time.Minute+15*time.Second), time.Minute)
+	assert.Equal(t, int64(0), w.messages)
+	assert.Equal(t, int64(10), w.prevMessages)
+
+	messages, bytes := w.usage(start.Add(time.Minute+15*time.Second), time.Minute)
+	assert.Equal(t, int64(7), messages)
+	assert.Equal(t, int64(75), bytes)
+
+	// idle windows are reset
+	w.advance(start.Add(3*time.Minute), time.Minute)
+	messages, bytes = w.usage(start.Add(3*time.Minute), time.Minute)
+	assert.Equal(t, int64(0), messages)
+	assert.Equal(t, int64(0), bytes)
+}
+
+func TestQuotas(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	publish1 := packet.NewPublishPacket()
+	publish1.Message = packet.Message{Topic: "test", Payload: []byte("1"), QOS: 1}
+	publish1.PacketID = 2
+
+	puback1 := packet.NewPubackPacket()
+	puback1.PacketID = 2
+
+	publish2 := packet.NewPublishPacket()
+	publish2.Message = packet.Message{Topic: "test", Payload: []byte("2"), QOS: 1}
+	publish2.PacketID = 3
+
+	puback2 := packet.NewPubackPacket()
+	puback2.PacketID = 3
+
+	publish3 := packet.NewPublishPacket()
+	publish3.Message = packet.Message{Topic: "test", Payload: []byte("3"), QOS: 2}
+	publish3.PacketID = 4
+
+	pubrec3 := packet.NewPubrecPacket()
+	pubrec3.PacketID = 4
+
+	pubrel3 := packet.NewPubrelPacket()
+	pubrel3.PacketID = 4
+
+	pubcomp3 := packet.NewPubcompPacket()
+	pubcomp3.PacketID = 4
+
+	delivered1 := packet.NewPublishPacket()
+	delivered1.Message = packet.Message{Topic: "test", Payload: []byte("1")}
+
+	broker := New()
+	broker.Quotas = []Quota{
+		{Key: QuotaClientID, Window: time.Minute, MaxMessages: 1},
+	}
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	// over-quota publishes are acknowledged but not delivered
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(publish1).
+		Receive(puback1).
+		Receive(delivered1).
+		Send(publish2).
+		Receive(puback2).
+		Send(publish3).
+		Receive(pubrec3).
+		Send(pubrel3).
+		Receive(pubcomp3).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	assert.Equal(t, int64(2), broker.Counters().OverQuotaPublishes)
+	assert.Equal(t, []QuotaUsage{{
+		Key:         "client_id",
+		ID:          "test",
+		Messages:    1,
+		Bytes:       1,
+		MaxMessages: 1,
+		Window:      time.Minute,
+	}}, broker.QuotaUsage())
+}
+
+func TestQuotaDisconnect(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.Username = "foo"
+
+	connack := packet.NewConnackPacket()
+
+	publish := packet.NewPublishPacket()
+	publish.Message = packet.Message{Topic: "test", Payload: []byte("foobar")}
+
+	broker := New()
+	broker.Quotas = []Quota{
+		{Key: QuotaAccount, Window: time.Minute, MaxBytes: 5, Disconnect: true},
+	}
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(publish).
+		End().
+		Test(t, conn)
+
+	<-done
+
+	assert.Equal(t, int64(1), broker.Counters().OverQuotaPublishes)
+	assert.Equal(t, int64(1), broker.Counters().DisconnectedClients)
+}
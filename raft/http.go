@@ -0,0 +1,93 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gomqtt/broker"
+)
+
+// A Forwarder is a broker.ReplicationForwarder that posts the commands of
+// followers to the Handler of the leader.
+type Forwarder struct {
+	// The Resolver returns the URL of the leader's Handler for the raft
+	// address of the leader, e.g. by mapping the raft port to an HTTP port.
+	Resolver func(leader string) string
+
+	// The Client used to post the commands. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// NewForwarder returns a new Forwarder that uses the specified resolver.
+func NewForwarder(resolver func(leader string) string) *Forwarder {
+	return &Forwarder{
+		Resolver: resolver,
+	}
+}
+
+// Forward will post the command to the leader and return once the leader has
+// submitted it.
+func (f *Forwarder) Forward(leader string, cmd []byte) error {
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Post(f.Resolver(leader), "application/json", bytes.NewReader(cmd))
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	// check status
+	if res.StatusCode != http.StatusNoContent {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("forward failed with %d: %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
+
+// NewHandler returns an HTTP handler that submits the commands posted by a
+// Forwarder to the backend. It should only be reachable by the nodes of the
+// cluster.
+func NewHandler(backend *broker.ReplicatedBackend) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		cmd, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = backend.Submit(cmd)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package raft replicates a broker.ReplicatedBackend using hashicorp/raft. It
+// is kept separate from the broker package, so that embedders that do not run
+// a cluster do not depend on github.com/hashicorp/raft.
+//
+// The raft server IDs must match the node IDs of the backends. As the FSM
+// applies to the backend and the backend appends to the log, the backend is
+// created first and its Log is set once the raft node has been started:
+//
+//	backend := broker.NewReplicatedBackend(id, nil, raft.NewForwarder(resolve))
+//	node, err := hraft.NewRaft(config, raft.NewFSM(backend), logs, stable, snaps, trans)
+//	backend.Log = raft.NewLog(node)
+package raft
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/gomqtt/broker"
+	hraft "github.com/hashicorp/raft"
+)
+
+// A Node is the part of a hraft.Raft that is used by the Log.
+type Node interface {
+	State() hraft.RaftState
+	LeaderWithID() (hraft.ServerAddress, hraft.ServerID)
+	Apply(cmd []byte, timeout time.Duration) hraft.ApplyFuture
+	GetConfiguration() hraft.ConfigurationFuture
+}
+
+// A Log is a broker.ReplicationLog and broker.ReplicationMembership that
+// appends the commands of the backend to a raft node.
+type Log struct {
+	node Node
+}
+
+// NewLog returns a new Log that uses the specified node.
+func NewLog(node Node) *Log {
+	return &Log{
+		node: node,
+	}
+}
+
+// Leader returns whether the node is the leader or the address of the current
+// leader otherwise.
+func (l *Log) Leader() (bool, string) {
+	if l.node.State() == hraft.Leader {
+		return true, ""
+	}
+
+	addr, _ := l.node.LeaderWithID()
+
+	return false, string(addr)
+}
+
+// Append will apply the command and return the error of the FSM if the
+// command could not be applied by the local backend.
+func (l *Log) Append(cmd []byte, timeout time.Duration) error {
+	future := l.node.Apply(cmd, timeout)
+	err := future.Error()
+	if err != nil {
+		return err
+	}
+
+	// the response is the result of the FSM
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+
+	return nil
+}
+
+// Members returns the server IDs of the current configuration.
+func (l *Log) Members() []string {
+	future := l.node.GetConfiguration()
+	if future.Error() != nil {
+		return nil
+	}
+
+	var members []string
+	for _, server := range future.Configuration().Servers {
+		members = append(members, string(server.ID))
+	}
+
+	return members
+}
+
+// An FSM is a hraft.FSM that applies the committed commands to the backend.
+type FSM struct {
+	backend *broker.ReplicatedBackend
+}
+
+// NewFSM returns a new FSM for the specified backend.
+func NewFSM(backend *broker.ReplicatedBackend) *FSM {
+	return &FSM{
+		backend: backend,
+	}
+}
+
+// Apply will apply the command to the backend and return the error, which is
+// reported to the node that appended it.
+func (f *FSM) Apply(log *hraft.Log) interface{} {
+	if log.Type != hraft.LogCommand {
+		return nil
+	}
+
+	return f.backend.Apply(log.Data)
+}
+
+// Snapshot will capture the state of the backend. It is not called
+// concurrently with Apply, the returned snapshot is persisted in the
+// background.
+func (f *FSM) Snapshot() (hraft.FSMSnapshot, error) {
+	var buf bytes.Buffer
+	err := f.backend.Snapshot(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshot{data: buf.Bytes()}, nil
+}
+
+// Restore will replace the state of the backend with the snapshot.
+func (f *FSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	return f.backend.Restore(rc)
+}
+
+// a captured state of the backend
+type snapshot struct {
+	data []byte
+}
+
+// writes the captured state to the sink
+func (s *snapshot) Persist(sink hraft.SnapshotSink) error {
+	_, err := sink.Write(s.data)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+// nothing to release
+func (s *snapshot) Release() {}
@@ -0,0 +1,212 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/broker"
+	"github.com/gomqtt/packet"
+	hraft "github.com/hashicorp/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+// a cluster that commits commands synchronously on all nodes
+type testCluster struct {
+	fsms   []*FSM
+	leader int
+	mutex  sync.Mutex
+}
+
+// a node of the test cluster
+type testNode struct {
+	cluster *testCluster
+	index   int
+}
+
+// a completed future
+type testFuture struct {
+	response      interface{}
+	configuration hraft.Configuration
+}
+
+func (f *testFuture) Error() error {
+	return nil
+}
+
+func (f *testFuture) Index() uint64 {
+	return 0
+}
+
+func (f *testFuture) Response() interface{} {
+	return f.response
+}
+
+func (f *testFuture) Configuration() hraft.Configuration {
+	return f.configuration
+}
+
+func (n *testNode) State() hraft.RaftState {
+	if n.index == n.cluster.leader {
+		return hraft.Leader
+	}
+
+	return hraft.Follower
+}
+
+func (n *testNode) LeaderWithID() (hraft.ServerAddress, hraft.ServerID) {
+	id := fmt.Sprintf("node-%d", n.cluster.leader)
+	return hraft.ServerAddress(id), hraft.ServerID(id)
+}
+
+func (n *testNode) Apply(cmd []byte, timeout time.Duration) hraft.ApplyFuture {
+	n.cluster.mutex.Lock()
+	defer n.cluster.mutex.Unlock()
+
+	future := &testFuture{}
+	for i, fsm := range n.cluster.fsms {
+		res := fsm.Apply(&hraft.Log{Type: hraft.LogCommand, Data: cmd})
+		if i == n.index {
+			future.response = res
+		}
+	}
+
+	return future
+}
+
+func (n *testNode) GetConfiguration() hraft.ConfigurationFuture {
+	future := &testFuture{}
+	for i := range n.cluster.fsms {
+		id := fmt.Sprintf("node-%d", i)
+		future.configuration.Servers = append(future.configuration.Servers, hraft.Server{
+			ID:      hraft.ServerID(id),
+			Address: hraft.ServerAddress(id),
+		})
+	}
+
+	return future
+}
+
+// a snapshot sink that writes to a buffer
+type testSink struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (s *testSink) ID() string {
+	return "test"
+}
+
+func (s *testSink) Cancel() error {
+	return nil
+}
+
+func (s *testSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func newTestCluster(n int, forwarder broker.ReplicationForwarder) (*testCluster, []*broker.ReplicatedBackend) {
+	cluster := &testCluster{}
+
+	var backends []*broker.ReplicatedBackend
+	for i := 0; i < n; i++ {
+		backend := broker.NewReplicatedBackend(fmt.Sprintf("node-%d", i), nil, forwarder)
+		cluster.fsms = append(cluster.fsms, NewFSM(backend))
+		backend.Log = NewLog(&testNode{cluster: cluster, index: i})
+		backends = append(backends, backend)
+	}
+
+	return cluster, backends
+}
+
+func TestReplication(t *testing.T) {
+	var server *httptest.Server
+
+	forwarder := NewForwarder(func(leader string) string {
+		assert.Equal(t, "node-0", leader)
+		return server.URL
+	})
+
+	_, backends := newTestCluster(2, forwarder)
+
+	server = httptest.NewServer(NewHandler(backends[0]))
+	defer server.Close()
+
+	ok, addr := backends[1].Log.Leader()
+	assert.False(t, ok)
+	assert.Equal(t, "node-0", addr)
+
+	ok, _ = backends[0].Log.Leader()
+	assert.True(t, ok)
+
+	assert.Equal(t, []string{"node-0", "node-1"}, backends[0].Log.(*Log).Members())
+
+	// mutations of the follower are forwarded
+	client1 := broker.NewLocalClient(func(*packet.Message) {})
+	client1.Context().Set("client_id", "client")
+
+	session, _, err := backends[1].Setup(client1, "client", false)
+	assert.NoError(t, err)
+	assert.NoError(t, session.SaveSubscription(&packet.Subscription{Topic: "foo", QOS: 1}))
+	assert.NoError(t, backends[1].Terminate(client1))
+
+	// resume session on the leader
+	client2 := broker.NewLocalClient(func(*packet.Message) {})
+	client2.Context().Set("client_id", "client")
+
+	session, resumed, err := backends[0].Setup(client2, "client", false)
+	assert.NoError(t, err)
+	assert.True(t, resumed)
+
+	sub, err := session.LookupSubscription("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, &packet.Subscription{Topic: "foo", QOS: 1}, sub)
+
+	// errors of the fsm are returned
+	err = backends[0].Submit([]byte("invalid"))
+	assert.Error(t, err)
+
+	err = backends[1].Submit([]byte("invalid"))
+	assert.Error(t, err)
+}
+
+func TestSnapshot(t *testing.T) {
+	cluster, backends := newTestCluster(1, nil)
+
+	retained := &packet.Message{Topic: "foo", Payload: []byte("foo"), Retain: true}
+	assert.NoError(t, backends[0].Publish(broker.NewLocalClient(nil), retained))
+
+	snapshot, err := cluster.fsms[0].Snapshot()
+	assert.NoError(t, err)
+
+	sink := &testSink{}
+	assert.NoError(t, snapshot.Persist(sink))
+	assert.True(t, sink.closed)
+	snapshot.Release()
+
+	other, otherBackends := newTestCluster(1, nil)
+	assert.NoError(t, other.fsms[0].Restore(ioutil.NopCloser(&sink.Buffer)))
+
+	msgs, err := otherBackends[0].Subscribe(broker.NewLocalClient(nil), "#")
+	assert.NoError(t, err)
+	assert.Equal(t, []*packet.Message{retained}, msgs)
+}
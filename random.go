@@ -0,0 +1,133 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/satori/go.uuid"
+)
+
+// A Random is a source of randomness used for jitter. Implementations must be
+// safe for concurrent use.
+type Random interface {
+	// Int63n should return a non-negative random number less than n.
+	Int63n(n int64) int64
+}
+
+// NewRandom returns a Random that is safe for concurrent use and generates a
+// deterministic sequence for the specified seed.
+func NewRandom(seed int64) Random {
+	return &lockedRandom{
+		rand: rand.New(rand.NewSource(seed)),
+	}
+}
+
+// a random that synchronizes the access to its source
+type lockedRandom struct {
+	rand  *rand.Rand
+	mutex sync.Mutex
+}
+
+// Int63n will return a random number less than n.
+func (r *lockedRandom) Int63n(n int64) int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.rand.Int63n(n)
+}
+
+// A Sequence generates the packet ids of a session.
+type Sequence interface {
+	// Next should return the next packet id and skip the zero id.
+	Next() uint16
+
+	// Reset should restart the sequence.
+	Reset()
+}
+
+// NewSequence returns a Sequence that starts at the specified packet id.
+func NewSequence(start uint16) Sequence {
+	if start == 0 {
+		start = 1
+	}
+
+	return &sequence{start: start, next: start}
+}
+
+// a sequence that starts at a fixed id
+type sequence struct {
+	start uint16
+	next  uint16
+	mutex sync.Mutex
+}
+
+// Next will return the next packet id.
+func (s *sequence) Next() uint16 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	id := s.next
+
+	s.next++
+	if s.next == 0 {
+		s.next = 1
+	}
+
+	return id
+}
+
+// Reset will restart the sequence at its start.
+func (s *sequence) Reset() {
+	s.mutex.Lock()
+	s.next = s.start
+	s.mutex.Unlock()
+}
+
+// NewUUIDs returns a generator for the UUIDs setting of the broker that
+// returns deterministic ids with the specified prefix and an increasing
+// counter.
+func NewUUIDs(prefix string) func() string {
+	var counter uint64
+	var mutex sync.Mutex
+
+	return func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		counter++
+		return fmt.Sprintf("%s%d", prefix, counter)
+	}
+}
+
+// returns a random number less than n using the configured source
+func (b *Broker) random(n int64) int64 {
+	if b.Random != nil {
+		return b.Random.Int63n(n)
+	}
+
+	return rand.Int63n(n)
+}
+
+// returns the uuid of a new client using the configured generator
+func (b *Broker) newUUID() string {
+	if b.UUIDs != nil {
+		return b.UUIDs()
+	}
+
+	return uuid.NewV1().String()
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRandom(t *testing.T) {
+	broker1 := New()
+	broker1.RefusalDelay = time.Second
+	broker1.Random = NewRandom(42)
+
+	broker2 := New()
+	broker2.RefusalDelay = time.Second
+	broker2.Random = NewRandom(42)
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, broker1.refusalDelay(), broker2.refusalDelay())
+	}
+}
+
+func TestSequence(t *testing.T) {
+	sequence := NewSequence(math.MaxUint16)
+	assert.Equal(t, uint16(math.MaxUint16), sequence.Next())
+	assert.Equal(t, uint16(1), sequence.Next())
+
+	sequence.Reset()
+	assert.Equal(t, uint16(math.MaxUint16), sequence.Next())
+
+	backend := NewMemoryBackend()
+	backend.PacketIDs = func() Sequence {
+		return NewSequence(100)
+	}
+
+	session, _, err := backend.Setup(newFakeClient(), "test", false)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(100), session.PacketID())
+	assert.Equal(t, uint16(101), session.PacketID())
+}
+
+func TestUUIDs(t *testing.T) {
+	uuids := NewUUIDs("test-")
+	assert.Equal(t, "test-1", uuids())
+	assert.Equal(t, "test-2", uuids())
+
+	broker := New()
+	broker.UUIDs = NewUUIDs("client-")
+	assert.Equal(t, "client-1", broker.newUUID())
+}
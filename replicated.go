@@ -0,0 +1,924 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomqtt/packet"
+)
+
+// A ReplicationLog is a replicated log that is kept consistent across the
+// nodes of a cluster using a consensus protocol like Raft. It passes committed
+// commands to Apply and snapshots to Snapshot and Restore of the
+// ReplicatedBackend. The raft package provides an implementation that is
+// backed by hashicorp/raft.
+type ReplicationLog interface {
+	// Leader should return true if the local node is the leader or the
+	// address of the current leader otherwise. The address is empty if there
+	// is no leader.
+	Leader() (bool, string)
+
+	// Append should append the command to the log and return once it has
+	// been committed and applied on the local node. It is only called on the
+	// leader.
+	Append(cmd []byte, timeout time.Duration) error
+}
+
+// A ReplicationForwarder forwards commands from followers to the leader, which
+// calls Submit with the forwarded commands.
+type ReplicationForwarder interface {
+	// Forward should send the command to the leader at the specified address
+	// and return once the leader has submitted it.
+	Forward(leader string, cmd []byte) error
+}
+
+// ReplicationVersion is the version of the replication protocol spoken by the
+// local node. Commands of nodes with a newer version that are not understood
+// are skipped, nodes older than version 2 do not announce themselves.
+const ReplicationVersion = 2
+
+// The capabilities a node may advertise (see ReplicatedBackend.Supports).
+const (
+	// ReplicationSwapRetained denotes the support of conditional retained
+	// updates, which are compared in the order of the log on every node.
+	ReplicationSwapRetained = "swap_retained"
+)
+
+// A ReplicationMembership is a ReplicationLog that is able to list the nodes
+// of the cluster. It allows the ReplicatedBackend to take nodes into account
+// that have not announced themselves, e.g. because they run an older version.
+type ReplicationMembership interface {
+	// Members should return the ids of all nodes of the cluster.
+	Members() []string
+}
+
+// A ReplicationPeer describes the protocol version and the capabilities a node
+// of the cluster has announced.
+type ReplicationPeer struct {
+	Node         string   `json:"node"`
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// the replicated mutations
+const (
+	replicateHello        = "hello"
+	replicateSetup        = "setup"
+	replicateSavePacket   = "save_packet"
+	replicateDeletePacket = "delete_packet"
+	replicateSubscribe    = "subscribe"
+	replicateUnsubscribe  = "unsubscribe"
+	replicateWill         = "will"
+	replicateClearWill    = "clear_will"
+	replicateReset        = "reset"
+	replicateRetain       = "retain"
+	replicateSwap         = "swap"
+	replicateOffline      = "offline"
+	replicateQueue        = "queue"
+)
+
+// a replicated mutation of the session and retained state
+type replicationCommand struct {
+	Op           string               `json:"op"`
+	Node         string               `json:"node"`
+	Version      int                  `json:"version,omitempty"`
+	Capabilities []string             `json:"capabilities,omitempty"`
+	ID           string               `json:"id,omitempty"`
+	Expected     []byte               `json:"expected,omitempty"`
+	Session      string               `json:"session,omitempty"`
+	Namespace    string               `json:"namespace,omitempty"`
+	Clean        bool                 `json:"clean,omitempty"`
+	Direction    string               `json:"direction,omitempty"`
+	Packet       *fileSessionPacket   `json:"packet,omitempty"`
+	PacketID     uint16               `json:"packet_id,omitempty"`
+	Subscription *packet.Subscription `json:"subscription,omitempty"`
+	Topic        string               `json:"topic,omitempty"`
+	Message      *packet.Message      `json:"message,omitempty"`
+	Deadline     *time.Time           `json:"deadline,omitempty"`
+	Publisher    string               `json:"publisher,omitempty"`
+	Tenant       string               `json:"tenant,omitempty"`
+}
+
+// the serialized state of a ReplicatedBackend
+type replicationSnapshot struct {
+	Sessions []replicatedSessionState `json:"sessions"`
+	Retained []replicatedRetained     `json:"retained"`
+	Peers    []ReplicationPeer        `json:"peers,omitempty"`
+}
+
+// the serialized form of a stored session
+type replicatedSessionState struct {
+	ID            string                         `json:"id"`
+	Namespace     string                         `json:"namespace,omitempty"`
+	Packets       map[string][]fileSessionPacket `json:"packets"`
+	Subscriptions []*packet.Subscription         `json:"subscriptions"`
+	Will          *packet.Message                `json:"will,omitempty"`
+	Offline       bool                           `json:"offline,omitempty"`
+	Missed        []*packet.Message              `json:"missed,omitempty"`
+	Deadlines     []time.Time                    `json:"deadlines,omitempty"`
+}
+
+// the serialized form of a retained message
+type replicatedRetained struct {
+	Publisher string          `json:"publisher"`
+	Message   *packet.Message `json:"message"`
+}
+
+// A ReplicatedBackend is a MemoryBackend that replicates the stored sessions
+// and the retained messages to all nodes of a cluster using a ReplicationLog,
+// so that persistent sessions survive the failure of a node and can be resumed
+// on any other node. All mutations are submitted to the leader, followers
+// forward them using the Forwarder. Session mutations are applied locally
+// right away and by the other nodes once they have been committed, retained
+// messages are stored once they have been committed.
+//
+// The connected clients and their subscriptions are routed locally like in the
+// MemoryBackend. Once a persistent session goes offline, every node queues the
+// matching messages published by its clients and replicates them to the other
+// nodes, so that the session receives them on whichever node it is resumed.
+//
+// To support rolling upgrades, every node announces its protocol version and
+// capabilities using Announce. Features that change the replicated commands
+// are only used once all nodes support them and are disabled otherwise.
+type ReplicatedBackend struct {
+	*MemoryBackend
+
+	// The NodeID identifies the local node in the cluster.
+	NodeID string
+
+	// The Log replicates the mutations.
+	Log ReplicationLog
+
+	// The Forwarder sends the mutations of followers to the leader.
+	Forwarder ReplicationForwarder
+
+	// The Timeout of appending a mutation to the log. Defaults to five
+	// seconds.
+	Timeout time.Duration
+
+	// The Capabilities announced by the local node. Defaults to all
+	// capabilities of this version. Removing a capability and announcing
+	// again disables the feature before downgrading the node.
+	Capabilities []string
+
+	wrapped      map[string]*replicatedSession
+	wrappedMutex sync.Mutex
+
+	peers      map[string]ReplicationPeer
+	peersMutex sync.Mutex
+
+	pending      map[string]chan error
+	pendingMutex sync.Mutex
+	swaps        uint64
+}
+
+// NewReplicatedBackend returns a new ReplicatedBackend for the local node.
+func NewReplicatedBackend(nodeID string, log ReplicationLog, forwarder ReplicationForwarder) *ReplicatedBackend {
+	r := &ReplicatedBackend{
+		MemoryBackend: NewMemoryBackend(),
+		NodeID:        nodeID,
+		Log:           log,
+		Forwarder:     forwarder,
+		Timeout:       5 * time.Second,
+		Capabilities:  []string{ReplicationSwapRetained},
+	}
+
+	// replicate offline messages
+	r.queued = r.replicateQueued
+
+	return r
+}
+
+// Setup will set up the session like the MemoryBackend and replicate it. If
+// the session is connected to another node, the other node closes its client
+// once the mutation has been applied. The returned session replicates all of
+// its changes.
+func (r *ReplicatedBackend) Setup(client Client, id string, clean bool) (Session, bool, error) {
+	session, resumed, err := r.MemoryBackend.Setup(client, id, clean)
+	if err != nil || len(id) == 0 {
+		return session, resumed, err
+	}
+
+	sess := session.(*MemorySession)
+	key := r.sessionKey(client, id)
+
+	err = r.submit(&replicationCommand{
+		Op:        replicateSetup,
+		Session:   key,
+		Namespace: sess.namespace,
+		Clean:     clean,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return r.wrap(key, sess), resumed, nil
+}
+
+// Publish will forward the message like the MemoryBackend and submit retained
+// messages to the log, which stores them on all nodes once committed.
+func (r *ReplicatedBackend) Publish(client Client, msg *packet.Message) error {
+	return r.publish(client, msg, func(publisher, tenant string, msg *packet.Message) error {
+		return r.submit(&replicationCommand{
+			Op:        replicateRetain,
+			Publisher: publisher,
+			Tenant:    tenant,
+			Message:   msg,
+		})
+	})
+}
+
+// SwapRetained will submit the conditional update to the log and wait until it
+// has been applied locally. The condition is checked by every node in the order
+// of the log, which prevents lost updates of writers connected to different
+// nodes. It returns an error if not all nodes support conditional updates.
+func (r *ReplicatedBackend) SwapRetained(client Client, msg *packet.Message, expected []byte) (bool, error) {
+	if !msg.Retain {
+		return false, fmt.Errorf("message is not retained")
+	} else if !r.Supports(ReplicationSwapRetained) {
+		return false, fmt.Errorf("conditional retained updates are not supported by all nodes")
+	}
+
+	err := r.publish(client, msg, func(publisher, tenant string, msg *packet.Message) error {
+		// register result
+		id := fmt.Sprintf("%s-%d", r.NodeID, atomic.AddUint64(&r.swaps, 1))
+		result := make(chan error, 1)
+		r.pendingMutex.Lock()
+		if r.pending == nil {
+			r.pending = make(map[string]chan error)
+		}
+		r.pending[id] = result
+		r.pendingMutex.Unlock()
+
+		defer func() {
+			r.pendingMutex.Lock()
+			delete(r.pending, id)
+			r.pendingMutex.Unlock()
+		}()
+
+		err := r.submit(&replicationCommand{
+			Op:        replicateSwap,
+			ID:        id,
+			Publisher: publisher,
+			Tenant:    tenant,
+			Message:   msg,
+			Expected:  expected,
+		})
+		if err != nil {
+			return err
+		}
+
+		// wait until applied locally
+		select {
+		case err = <-result:
+			return err
+		case <-time.After(r.Timeout):
+			return fmt.Errorf("conditional retained update has not been applied in time")
+		}
+	})
+	if err == errRetainedMismatch {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Announce will submit the protocol version and the capabilities of the local
+// node to the log. It should be called once the node has joined the cluster
+// and again after changing the capabilities.
+func (r *ReplicatedBackend) Announce() error {
+	return r.submit(&replicationCommand{
+		Op:           replicateHello,
+		Capabilities: r.Capabilities,
+	})
+}
+
+// Peers returns the nodes that have announced themselves, including the local
+// node.
+func (r *ReplicatedBackend) Peers() []ReplicationPeer {
+	r.peersMutex.Lock()
+	defer r.peersMutex.Unlock()
+
+	var peers []ReplicationPeer
+	for _, peer := range r.peers {
+		peers = append(peers, peer)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Node < peers[j].Node
+	})
+
+	return peers
+}
+
+// Supports returns whether the local node and all other nodes have announced
+// the capability. If the Log implements the ReplicationMembership interface,
+// nodes that have not announced themselves disable the capability, otherwise
+// only the announced nodes are taken into account.
+func (r *ReplicatedBackend) Supports(capability string) bool {
+	if !hasCapability(r.Capabilities, capability) {
+		return false
+	}
+
+	r.peersMutex.Lock()
+	defer r.peersMutex.Unlock()
+
+	// the local node must have been announced
+	if _, ok := r.peers[r.NodeID]; !ok {
+		return false
+	}
+
+	// get nodes
+	var nodes []string
+	if membership, ok := r.Log.(ReplicationMembership); ok {
+		nodes = membership.Members()
+	} else {
+		for node := range r.peers {
+			nodes = append(nodes, node)
+		}
+	}
+
+	for _, node := range nodes {
+		if node == r.NodeID {
+			continue
+		}
+
+		peer, ok := r.peers[node]
+		if !ok || !hasCapability(peer.Capabilities, capability) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Terminate will terminate the client like the MemoryBackend and replicate the
+// reset of the session if the client connected with clean=true. Otherwise, all
+// nodes start to queue messages for the offline session.
+func (r *ReplicatedBackend) Terminate(client Client) error {
+	reset, offline, err := r.terminate(client)
+	if err != nil || (!reset && !offline) {
+		return err
+	}
+
+	id, _ := client.Context().Get("client_id").(string)
+
+	op := replicateReset
+	if offline {
+		op = replicateOffline
+	}
+
+	return r.submit(&replicationCommand{
+		Op:      op,
+		Session: r.sessionKey(client, id),
+	})
+}
+
+// Submit will append the command to the log if the local node is the leader
+// or forward it to the leader otherwise. The leader should call Submit with
+// the commands forwarded by the followers.
+func (r *ReplicatedBackend) Submit(cmd []byte) error {
+	leader, addr := r.Log.Leader()
+	if leader {
+		return r.Log.Append(cmd, r.Timeout)
+	}
+
+	// check leader
+	if addr == "" {
+		return fmt.Errorf("no leader available")
+	} else if r.Forwarder == nil {
+		return fmt.Errorf("no forwarder available")
+	}
+
+	return r.Forwarder.Forward(addr, cmd)
+}
+
+// Apply will apply a committed command to the local state. It should be called
+// by the ReplicationLog on every node in the order of the log.
+func (r *ReplicatedBackend) Apply(data []byte) error {
+	var cmd replicationCommand
+	err := json.Unmarshal(data, &cmd)
+	if err != nil {
+		return err
+	}
+
+	// store retained message
+	if cmd.Op == replicateRetain {
+		if cmd.Message == nil {
+			return fmt.Errorf("missing message")
+		}
+
+		return r.retain(cmd.Publisher, cmd.Tenant, cmd.Message)
+	}
+
+	// swap retained message and report the result to the origin
+	if cmd.Op == replicateSwap {
+		if cmd.Message == nil {
+			return fmt.Errorf("missing message")
+		}
+
+		err := r.swapRetained(cmd.Publisher, cmd.Tenant, cmd.Message, cmd.Expected)
+		if err != nil && err != errRetainedMismatch {
+			return err
+		}
+
+		if cmd.Node == r.NodeID {
+			r.pendingMutex.Lock()
+			select {
+			case r.pending[cmd.ID] <- err:
+			default:
+			}
+			r.pendingMutex.Unlock()
+		}
+
+		return nil
+	}
+
+	// track announced peer
+	if cmd.Op == replicateHello {
+		r.peersMutex.Lock()
+		defer r.peersMutex.Unlock()
+
+		if r.peers == nil {
+			r.peers = make(map[string]ReplicationPeer)
+		}
+
+		r.peers[cmd.Node] = ReplicationPeer{
+			Node:         cmd.Node,
+			Version:      cmd.Version,
+			Capabilities: cmd.Capabilities,
+		}
+
+		return nil
+	}
+
+	// session mutations have already been applied by the origin
+	if cmd.Node == r.NodeID {
+		return nil
+	}
+
+	r.sessionsMutex.Lock()
+	defer r.sessionsMutex.Unlock()
+
+	sess := r.sessions[cmd.Session]
+
+	// create or take over session
+	if cmd.Op == replicateSetup {
+		if sess == nil {
+			sess = r.newSession()
+			sess.key = cmd.Session
+			sess.namespace = cmd.Namespace
+			r.sessions[cmd.Session] = sess
+		}
+
+		r.offlineMutex.Lock()
+		defer r.offlineMutex.Unlock()
+
+		// the session has been resumed on another node
+		if sess.currentClient != nil {
+			sess.currentClient.Close(true)
+			sess.currentClient = nil
+		}
+
+		r.offlineQueue.Clear(sess)
+		sess.missed()
+
+		if cmd.Clean {
+			sess.Reset()
+		}
+
+		return nil
+	}
+
+	// ignore sessions that are not known yet
+	if sess == nil {
+		return nil
+	}
+
+	switch cmd.Op {
+	case replicateSavePacket:
+		if cmd.Packet == nil {
+			return fmt.Errorf("missing packet")
+		}
+
+		pkt, err := cmd.Packet.decode()
+		if err != nil {
+			return err
+		}
+
+		return sess.SavePacket(cmd.Direction, pkt)
+	case replicateDeletePacket:
+		return sess.DeletePacket(cmd.Direction, cmd.PacketID)
+	case replicateSubscribe:
+		if cmd.Subscription == nil {
+			return fmt.Errorf("missing subscription")
+		}
+
+		return sess.SaveSubscription(cmd.Subscription)
+	case replicateUnsubscribe:
+		return sess.DeleteSubscription(cmd.Topic)
+	case replicateWill:
+		return sess.SaveWill(cmd.Message)
+	case replicateClearWill:
+		return sess.ClearWill()
+	case replicateReset:
+		r.offlineMutex.Lock()
+		r.offlineQueue.Clear(sess)
+		r.offlineMutex.Unlock()
+
+		return sess.Reset()
+	case replicateOffline:
+		r.offlineMutex.Lock()
+		defer r.offlineMutex.Unlock()
+
+		// the session may have been resumed locally in the meantime
+		if sess.currentClient != nil {
+			return nil
+		}
+
+		return r.addOffline(sess)
+	case replicateQueue:
+		if cmd.Message == nil {
+			return fmt.Errorf("missing message")
+		}
+
+		var deadline time.Time
+		if cmd.Deadline != nil {
+			deadline = *cmd.Deadline
+		}
+
+		sess.queue(cmd.Message, deadline)
+
+		return nil
+	}
+
+	// skip commands of newer nodes instead of failing the log
+	if cmd.Version > ReplicationVersion {
+		return nil
+	}
+
+	return fmt.Errorf("unknown command %q", cmd.Op)
+}
+
+// Snapshot will write the stored sessions, their offline messages and the
+// retained messages to the writer. It must not be called concurrently with
+// Apply.
+func (r *ReplicatedBackend) Snapshot(w io.Writer) error {
+	var snapshot replicationSnapshot
+
+	r.sessionsMutex.Lock()
+
+	// collect offline sessions
+	offline := make(map[*MemorySession]bool)
+	r.offlineMutex.RLock()
+	for _, value := range r.offlineQueue.All() {
+		if sess, ok := value.(*MemorySession); ok {
+			offline[sess] = true
+		}
+	}
+	r.offlineMutex.RUnlock()
+
+	for id, sess := range r.sessions {
+		state := replicatedSessionState{
+			ID:        id,
+			Namespace: sess.namespace,
+			Packets:   make(map[string][]fileSessionPacket),
+		}
+
+		for _, direction := range []string{incoming, outgoing} {
+			for _, pkt := range sess.store.All(direction) {
+				if p := encodeFileSessionPacket(pkt); p.Type != "" {
+					state.Packets[direction] = append(state.Packets[direction], p)
+				}
+			}
+		}
+
+		state.Subscriptions, _ = sess.AllSubscriptions()
+		state.Will, _ = sess.LookupWill()
+		state.Offline = offline[sess]
+		state.Missed, state.Deadlines = sess.queued()
+
+		snapshot.Sessions = append(snapshot.Sessions, state)
+	}
+
+	r.sessionsMutex.Unlock()
+
+	r.retainedMutex.Lock()
+
+	for _, value := range r.retained.All() {
+		if msg, ok := value.(*packet.Message); ok {
+			snapshot.Retained = append(snapshot.Retained, replicatedRetained{
+				Publisher: r.publishers[msg.Topic],
+				Message:   msg,
+			})
+		}
+	}
+
+	r.retainedMutex.Unlock()
+
+	snapshot.Peers = r.Peers()
+
+	return json.NewEncoder(w).Encode(snapshot)
+}
+
+// Restore will replace the stored sessions and retained messages with the
+// snapshot read from the reader. Sessions that are connected to the local node
+// are kept. It must not be called concurrently with Apply.
+func (r *ReplicatedBackend) Restore(rd io.Reader) error {
+	var snapshot replicationSnapshot
+	err := json.NewDecoder(rd).Decode(&snapshot)
+	if err != nil {
+		return err
+	}
+
+	r.sessionsMutex.Lock()
+
+	// remove offline sessions
+	for id, sess := range r.sessions {
+		if sess.currentClient == nil {
+			r.remove(id, sess)
+		}
+	}
+
+	// restore sessions
+	for _, state := range snapshot.Sessions {
+		if r.sessions[state.ID] != nil {
+			continue
+		}
+
+		sess := r.newSession()
+		sess.key = state.ID
+		sess.namespace = state.Namespace
+
+		for direction, pkts := range state.Packets {
+			for _, p := range pkts {
+				pkt, err := p.decode()
+				if err != nil {
+					r.sessionsMutex.Unlock()
+					return err
+				}
+
+				sess.SavePacket(direction, pkt)
+			}
+		}
+
+		for _, sub := range state.Subscriptions {
+			sess.SaveSubscription(sub)
+		}
+
+		if state.Will != nil {
+			sess.SaveWill(state.Will)
+		}
+
+		for i, msg := range state.Missed {
+			var deadline time.Time
+			if i < len(state.Deadlines) {
+				deadline = state.Deadlines[i]
+			}
+
+			sess.queue(msg, deadline)
+		}
+
+		if state.Offline {
+			r.offlineMutex.Lock()
+			r.addOffline(sess)
+			r.offlineMutex.Unlock()
+		}
+
+		r.sessions[state.ID] = sess
+	}
+
+	r.sessionsMutex.Unlock()
+
+	// restore peers
+	r.peersMutex.Lock()
+	r.peers = make(map[string]ReplicationPeer)
+	for _, peer := range snapshot.Peers {
+		r.peers[peer.Node] = peer
+	}
+	r.peersMutex.Unlock()
+
+	// collect current retained messages
+	r.retainedMutex.Lock()
+	var topics []string
+	for _, value := range r.retained.All() {
+		if msg, ok := value.(*packet.Message); ok {
+			topics = append(topics, msg.Topic)
+		}
+	}
+	r.retainedMutex.Unlock()
+
+	// replace retained messages
+	for _, topic := range topics {
+		err = r.retain("", "", &packet.Message{Topic: topic})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, retained := range snapshot.Retained {
+		err = r.retain(retained.Publisher, "", retained.Message)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// returns the replicating session for the stored session
+func (r *ReplicatedBackend) wrap(key string, sess *MemorySession) *replicatedSession {
+	r.wrappedMutex.Lock()
+	defer r.wrappedMutex.Unlock()
+
+	// lazily allocate wrapped sessions
+	if r.wrapped == nil {
+		r.wrapped = make(map[string]*replicatedSession)
+	}
+
+	// reuse session unless it has been replaced
+	wrapped, ok := r.wrapped[key]
+	if !ok || wrapped.MemorySession != sess {
+		wrapped = &replicatedSession{
+			MemorySession: sess,
+			backend:       r,
+			key:           key,
+		}
+
+		r.wrapped[key] = wrapped
+	}
+
+	return wrapped
+}
+
+// replicates a message that has been queued for an offline session
+func (r *ReplicatedBackend) replicateQueued(sess *MemorySession, msg *packet.Message, deadline time.Time) error {
+	cmd := &replicationCommand{
+		Op:      replicateQueue,
+		Session: sess.key,
+		Message: msg,
+	}
+
+	if !deadline.IsZero() {
+		cmd.Deadline = &deadline
+	}
+
+	return r.submit(cmd)
+}
+
+// encodes and submits a mutation of the local node
+func (r *ReplicatedBackend) submit(cmd *replicationCommand) error {
+	cmd.Node = r.NodeID
+	cmd.Version = ReplicationVersion
+
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	return r.Submit(data)
+}
+
+// a session that replicates all changes of a MemorySession
+type replicatedSession struct {
+	*MemorySession
+
+	backend *ReplicatedBackend
+	key     string
+}
+
+// SavePacket will store and replicate the packet.
+func (s *replicatedSession) SavePacket(direction string, pkt packet.Packet) error {
+	s.MemorySession.SavePacket(direction, pkt)
+
+	// only publish and pubrel packets are stored
+	p := encodeFileSessionPacket(pkt)
+	if p.Type == "" {
+		return nil
+	}
+
+	return s.backend.submit(&replicationCommand{
+		Op:        replicateSavePacket,
+		Session:   s.key,
+		Direction: direction,
+		Packet:    &p,
+	})
+}
+
+// ReleasePacket will replace the stored PublishPacket by a PubrelPacket and
+// replicate the change.
+func (s *replicatedSession) ReleasePacket(id uint16) (bool, error) {
+	ok, _ := s.MemorySession.ReleasePacket(id)
+	if !ok {
+		return false, nil
+	}
+
+	pubrel := packet.NewPubrelPacket()
+	pubrel.PacketID = id
+
+	p := encodeFileSessionPacket(pubrel)
+
+	return true, s.backend.submit(&replicationCommand{
+		Op:        replicateSavePacket,
+		Session:   s.key,
+		Direction: outgoing,
+		Packet:    &p,
+	})
+}
+
+// DeletePacket will remove the packet and replicate the removal.
+func (s *replicatedSession) DeletePacket(direction string, id uint16) error {
+	s.MemorySession.DeletePacket(direction, id)
+
+	return s.backend.submit(&replicationCommand{
+		Op:        replicateDeletePacket,
+		Session:   s.key,
+		Direction: direction,
+		PacketID:  id,
+	})
+}
+
+// SaveSubscription will store and replicate the subscription.
+func (s *replicatedSession) SaveSubscription(sub *packet.Subscription) error {
+	s.MemorySession.SaveSubscription(sub)
+
+	return s.backend.submit(&replicationCommand{
+		Op:           replicateSubscribe,
+		Session:      s.key,
+		Subscription: sub,
+	})
+}
+
+// DeleteSubscription will remove the subscription and replicate the removal.
+func (s *replicatedSession) DeleteSubscription(topic string) error {
+	s.MemorySession.DeleteSubscription(topic)
+
+	return s.backend.submit(&replicationCommand{
+		Op:      replicateUnsubscribe,
+		Session: s.key,
+		Topic:   topic,
+	})
+}
+
+// SaveWill will store and replicate the will message.
+func (s *replicatedSession) SaveWill(msg *packet.Message) error {
+	s.MemorySession.SaveWill(msg)
+
+	return s.backend.submit(&replicationCommand{
+		Op:      replicateWill,
+		Session: s.key,
+		Message: msg,
+	})
+}
+
+// ClearWill will remove the will message and replicate the removal.
+func (s *replicatedSession) ClearWill() error {
+	s.MemorySession.ClearWill()
+
+	return s.backend.submit(&replicationCommand{
+		Op:      replicateClearWill,
+		Session: s.key,
+	})
+}
+
+// Reset will reset the session and replicate the reset.
+func (s *replicatedSession) Reset() error {
+	s.MemorySession.Reset()
+
+	return s.backend.submit(&replicationCommand{
+		Op:      replicateReset,
+		Session: s.key,
+	})
+}
+
+// returns whether the capability is contained in the list
+func hasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,382 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+// a cluster that commits commands synchronously on all nodes
+type fakeCluster struct {
+	nodes  []*ReplicatedBackend
+	leader int
+	mutex  sync.Mutex
+}
+
+// a node of the fake cluster
+type fakeReplicationLog struct {
+	cluster *fakeCluster
+	index   int
+}
+
+func newFakeCluster(n int) *fakeCluster {
+	cluster := &fakeCluster{}
+
+	for i := 0; i < n; i++ {
+		log := &fakeReplicationLog{cluster: cluster, index: i}
+		cluster.nodes = append(cluster.nodes, NewReplicatedBackend(fmt.Sprintf("node-%d", i), log, cluster))
+	}
+
+	return cluster
+}
+
+func (c *fakeCluster) Forward(leader string, cmd []byte) error {
+	for _, node := range c.nodes {
+		if node.NodeID == leader {
+			return node.Submit(cmd)
+		}
+	}
+
+	return fmt.Errorf("unknown leader %q", leader)
+}
+
+func (l *fakeReplicationLog) Leader() (bool, string) {
+	return l.index == l.cluster.leader, l.cluster.nodes[l.cluster.leader].NodeID
+}
+
+func (l *fakeReplicationLog) Append(cmd []byte, timeout time.Duration) error {
+	l.cluster.mutex.Lock()
+	defer l.cluster.mutex.Unlock()
+
+	for _, node := range l.cluster.nodes {
+		err := node.Apply(cmd)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestReplicatedBackend(t *testing.T) {
+	BackendSpec(t, func() Backend {
+		backend := newFakeCluster(3).nodes[1]
+		backend.Logins = map[string]string{"allow": "allow"}
+		return backend
+	})
+
+	AuthorizationSpec(t, func() Backend {
+		backend := newFakeCluster(3).nodes[1]
+		backend.Authorizer = func(client Client, topic string, action Action) bool {
+			return topic != "deny"
+		}
+		return backend
+	})
+}
+
+func TestReplicatedBackendFailover(t *testing.T) {
+	cluster := newFakeCluster(3)
+
+	retained := &packet.Message{Topic: "foo", Payload: []byte("foo"), Retain: true}
+	will := &packet.Message{Topic: "will", Payload: []byte("will")}
+
+	publish := packet.NewPublishPacket()
+	publish.PacketID = 1
+	publish.Message = packet.Message{Topic: "foo", Payload: []byte("bar"), QOS: 1}
+
+	// connect to a follower
+	client1 := newFakeClient()
+	client1.Context().Set("client_id", "client")
+
+	session1, resumed, err := cluster.nodes[1].Setup(client1, "client", false)
+	assert.NoError(t, err)
+	assert.False(t, resumed)
+
+	assert.NoError(t, session1.SaveSubscription(&packet.Subscription{Topic: "foo", QOS: 1}))
+	assert.NoError(t, session1.SaveWill(will))
+	assert.NoError(t, session1.SavePacket(outgoing, publish))
+	assert.NoError(t, cluster.nodes[1].Publish(client1, retained))
+
+	// all nodes have the state
+	for _, node := range cluster.nodes {
+		msgs, err := node.Subscribe(newFakeClient(), "foo")
+		assert.NoError(t, err)
+		assert.Equal(t, []*packet.Message{retained}, msgs)
+	}
+
+	// resume session on another node
+	client2 := newFakeClient()
+	client2.Context().Set("client_id", "client")
+
+	session2, resumed, err := cluster.nodes[2].Setup(client2, "client", false)
+	assert.NoError(t, err)
+	assert.True(t, resumed)
+
+	sub, err := session2.LookupSubscription("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, &packet.Subscription{Topic: "foo", QOS: 1}, sub)
+
+	storedWill, err := session2.LookupWill()
+	assert.NoError(t, err)
+	assert.Equal(t, will, storedWill)
+
+	pkt, err := session2.LookupPacket(outgoing, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, publish, pkt)
+
+	// the previous client has been closed
+	assert.Equal(t, ErrClientOffline, client1.Publish(retained))
+
+	// terminating the previous client keeps the session
+	assert.NoError(t, cluster.nodes[1].Terminate(client1))
+
+	sub, err = session2.LookupSubscription("foo")
+	assert.NoError(t, err)
+	assert.NotNil(t, sub)
+
+	// a clean disconnect resets the session on all nodes
+	client2.Context().Set("clean", true)
+	assert.NoError(t, cluster.nodes[2].Terminate(client2))
+
+	for _, node := range cluster.nodes {
+		sess := node.sessions["client"]
+		subs, err := sess.AllSubscriptions()
+		assert.NoError(t, err)
+		assert.Empty(t, subs)
+	}
+}
+
+func TestReplicatedBackendSnapshot(t *testing.T) {
+	cluster := newFakeCluster(1)
+	backend := cluster.nodes[0]
+
+	client := newFakeClient()
+
+	session, _, err := backend.Setup(client, "client", false)
+	assert.NoError(t, err)
+	assert.NoError(t, session.SaveSubscription(&packet.Subscription{Topic: "foo", QOS: 2}))
+
+	retained := &packet.Message{Topic: "foo", Payload: []byte("foo"), Retain: true}
+	assert.NoError(t, backend.Publish(client, retained))
+
+	var buf bytes.Buffer
+	assert.NoError(t, backend.Snapshot(&buf))
+
+	// restore snapshot on a node with stale state
+	other := newFakeCluster(1).nodes[0]
+	assert.NoError(t, other.Publish(newFakeClient(), &packet.Message{Topic: "bar", Payload: []byte("bar"), Retain: true}))
+	assert.NoError(t, other.Restore(&buf))
+
+	msgs, err := other.Subscribe(newFakeClient(), "#")
+	assert.NoError(t, err)
+	assert.Equal(t, []*packet.Message{retained}, msgs)
+
+	session, resumed, err := other.Setup(newFakeClient(), "client", false)
+	assert.NoError(t, err)
+	assert.True(t, resumed)
+
+	sub, err := session.LookupSubscription("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, &packet.Subscription{Topic: "foo", QOS: 2}, sub)
+}
+
+func TestReplicatedBackendOffline(t *testing.T) {
+	cluster := newFakeCluster(3)
+
+	// connect to a follower and go offline
+	client1 := newFakeClient()
+	client1.Context().Set("client_id", "client")
+
+	session1, _, err := cluster.nodes[1].Setup(client1, "client", false)
+	assert.NoError(t, err)
+	assert.NoError(t, session1.SaveSubscription(&packet.Subscription{Topic: "foo", QOS: 1}))
+	assert.NoError(t, cluster.nodes[1].SubscribeOnly(client1, "foo"))
+	assert.NoError(t, cluster.nodes[1].Terminate(client1))
+
+	// messages published on any node are queued
+	msg1 := &packet.Message{Topic: "foo", Payload: []byte("1"), QOS: 1}
+	msg2 := &packet.Message{Topic: "foo", Payload: []byte("2"), QOS: 1}
+	assert.NoError(t, cluster.nodes[0].Publish(newFakeClient(), msg1))
+	assert.NoError(t, cluster.nodes[1].Publish(newFakeClient(), msg2))
+	assert.NoError(t, cluster.nodes[2].Publish(newFakeClient(), &packet.Message{Topic: "bar", QOS: 1}))
+
+	for _, node := range cluster.nodes {
+		queued, _ := node.sessions["client"].queued()
+		assert.Equal(t, []*packet.Message{msg1, msg2}, queued)
+	}
+
+	// the failed node keeps the messages in snapshots
+	var buf bytes.Buffer
+	assert.NoError(t, cluster.nodes[0].Snapshot(&buf))
+
+	other := newFakeCluster(1).nodes[0]
+	assert.NoError(t, other.Restore(&buf))
+
+	queued, _ := other.sessions["client"].queued()
+	assert.Equal(t, []*packet.Message{msg1, msg2}, queued)
+
+	msg3 := &packet.Message{Topic: "foo", Payload: []byte("3"), QOS: 1}
+	assert.NoError(t, other.Publish(newFakeClient(), msg3))
+
+	queued, _ = other.sessions["client"].queued()
+	assert.Equal(t, []*packet.Message{msg1, msg2, msg3}, queued)
+
+	// resume session on another node
+	client2 := newFakeClient()
+	client2.Context().Set("client_id", "client")
+
+	_, resumed, err := cluster.nodes[2].Setup(client2, "client", false)
+	assert.NoError(t, err)
+	assert.True(t, resumed)
+
+	for i := 0; i < 100 && len(client2.received()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, []*packet.Message{msg1, msg2}, client2.received())
+
+	// the other nodes stop queueing
+	assert.NoError(t, cluster.nodes[0].Publish(newFakeClient(), msg3))
+
+	for _, node := range cluster.nodes {
+		queued, _ := node.sessions["client"].queued()
+		assert.Empty(t, queued)
+	}
+}
+
+func TestReplicatedBackendNoLeader(t *testing.T) {
+	cluster := newFakeCluster(2)
+	cluster.nodes[1].Forwarder = nil
+
+	_, _, err := cluster.nodes[1].Setup(newFakeClient(), "client", false)
+	assert.Error(t, err)
+
+	_, _, err = cluster.nodes[0].Setup(newFakeClient(), "client", false)
+	assert.NoError(t, err)
+}
+
+// a node of the fake cluster that lists a fixed set of members
+type fakeMembershipLog struct {
+	*fakeReplicationLog
+	members []string
+}
+
+func (l *fakeMembershipLog) Members() []string {
+	return l.members
+}
+
+func TestReplicatedBackendHandshake(t *testing.T) {
+	cluster := newFakeCluster(3)
+
+	// disabled until announced
+	assert.False(t, cluster.nodes[0].Supports(ReplicationSwapRetained))
+
+	// an older node does not advertise the capability
+	cluster.nodes[2].Capabilities = nil
+
+	for _, node := range cluster.nodes {
+		assert.NoError(t, node.Announce())
+	}
+
+	peers := cluster.nodes[1].Peers()
+	assert.Len(t, peers, 3)
+	assert.Equal(t, ReplicationPeer{
+		Node:         "node-0",
+		Version:      ReplicationVersion,
+		Capabilities: []string{ReplicationSwapRetained},
+	}, peers[0])
+
+	for _, node := range cluster.nodes {
+		assert.False(t, node.Supports(ReplicationSwapRetained))
+	}
+
+	_, err := cluster.nodes[0].SwapRetained(newFakeClient(), &packet.Message{Topic: "foo", Retain: true}, nil)
+	assert.Error(t, err)
+
+	// the upgraded node enables the capability
+	cluster.nodes[2].Capabilities = []string{ReplicationSwapRetained}
+	assert.NoError(t, cluster.nodes[2].Announce())
+
+	for _, node := range cluster.nodes {
+		assert.True(t, node.Supports(ReplicationSwapRetained))
+	}
+
+	// members that have not announced themselves disable the capability
+	node := cluster.nodes[0]
+	node.Log = &fakeMembershipLog{
+		fakeReplicationLog: node.Log.(*fakeReplicationLog),
+		members:            []string{"node-0", "node-1", "node-2", "node-3"},
+	}
+	assert.False(t, node.Supports(ReplicationSwapRetained))
+
+	// peers are kept in snapshots
+	var buf bytes.Buffer
+	assert.NoError(t, cluster.nodes[1].Snapshot(&buf))
+
+	other := newFakeCluster(1).nodes[0]
+	assert.NoError(t, other.Restore(&buf))
+	assert.Equal(t, cluster.nodes[1].Peers(), other.Peers())
+}
+
+func TestReplicatedBackendUnknownCommand(t *testing.T) {
+	cluster := newFakeCluster(2)
+
+	_, _, err := cluster.nodes[1].Setup(newFakeClient(), "client", false)
+	assert.NoError(t, err)
+
+	// commands of newer nodes are skipped
+	err = cluster.nodes[0].Apply([]byte(`{"op":"future","node":"node-1","version":3,"session":"client"}`))
+	assert.NoError(t, err)
+
+	err = cluster.nodes[0].Apply([]byte(`{"op":"future","node":"node-1","version":2,"session":"client"}`))
+	assert.Error(t, err)
+}
+
+func TestReplicatedBackendSwapRetained(t *testing.T) {
+	cluster := newFakeCluster(3)
+
+	for _, node := range cluster.nodes {
+		assert.NoError(t, node.Announce())
+	}
+
+	client := newFakeClient()
+
+	// swap on a follower
+	ok, err := cluster.nodes[1].SwapRetained(client, &packet.Message{Topic: "foo", Payload: []byte("1"), Retain: true}, nil)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// the condition is checked against the replicated state
+	ok, err = cluster.nodes[2].SwapRetained(client, &packet.Message{Topic: "foo", Payload: []byte("2"), Retain: true}, nil)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = cluster.nodes[0].SwapRetained(client, &packet.Message{Topic: "foo", Payload: []byte("2"), Retain: true}, []byte("1"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	for _, node := range cluster.nodes {
+		msgs, err := node.Subscribe(newFakeClient(), "foo")
+		assert.NoError(t, err)
+		assert.Equal(t, []*packet.Message{{Topic: "foo", Payload: []byte("2"), Retain: true}}, msgs)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// A Reservation reserves a topic prefix for broker-internal or administrative
+// use. Clients may only publish to and subscribe to reserved topics if the
+// reservation allows it. Topics beginning with "$" are rejected for clients
+// unless their prefix has been reserved, which keeps the special topic spaces
+// safe while allowing new ones like "$share/" or "$delayed/" to be added.
+// Messages published by the broker itself are not affected.
+type Reservation struct {
+	// The reserved prefix, e.g. "$SYS/".
+	Prefix string
+
+	// Whether clients may publish messages to topics with the prefix.
+	Publish bool
+
+	// Whether clients may subscribe to topic filters with the prefix.
+	Subscribe bool
+}
+
+// the registry of reserved prefixes
+type reservations struct {
+	list  []Reservation
+	mutex sync.RWMutex
+}
+
+// returns the default reservations
+func defaultReservations() []Reservation {
+	return []Reservation{
+		{Prefix: "$SYS/", Subscribe: true},
+	}
+}
+
+// checks if clients may perform the action on the topic, the longest reserved
+// prefix decides
+func (r *reservations) allowed(topic string, action Action) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var match *Reservation
+	for i, reservation := range r.list {
+		if strings.HasPrefix(topic, reservation.Prefix) && (match == nil || len(reservation.Prefix) > len(match.Prefix)) {
+			match = &r.list[i]
+		}
+	}
+
+	// reject unknown special prefixes
+	if match == nil {
+		return !strings.HasPrefix(topic, "$")
+	}
+
+	if action == PublishAction {
+		return match.Publish
+	}
+
+	return match.Subscribe
+}
+
+// Reserve will reserve the topic prefix described by the reservation. An
+// existing reservation of the same prefix is replaced.
+func (b *Broker) Reserve(reservation Reservation) error {
+	if reservation.Prefix == "" {
+		return fmt.Errorf("reservation without a prefix")
+	}
+
+	b.reservations.mutex.Lock()
+	defer b.reservations.mutex.Unlock()
+
+	for i, existing := range b.reservations.list {
+		if existing.Prefix == reservation.Prefix {
+			b.reservations.list[i] = reservation
+			return nil
+		}
+	}
+
+	b.reservations.list = append(b.reservations.list, reservation)
+
+	return nil
+}
+
+// Unreserve will remove the reservation of the topic prefix.
+func (b *Broker) Unreserve(prefix string) {
+	b.reservations.mutex.Lock()
+	defer b.reservations.mutex.Unlock()
+
+	for i, existing := range b.reservations.list {
+		if existing.Prefix == prefix {
+			b.reservations.list = append(b.reservations.list[:i], b.reservations.list[i+1:]...)
+			return
+		}
+	}
+}
+
+// Reservations returns the current reservations.
+func (b *Broker) Reservations() []Reservation {
+	b.reservations.mutex.RLock()
+	defer b.reservations.mutex.RUnlock()
+
+	return append([]Reservation{}, b.reservations.list...)
+}
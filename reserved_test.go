@@ -0,0 +1,103 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReservations(t *testing.T) {
+	broker := New()
+
+	assert.True(t, broker.reservations.allowed("foo/bar", PublishAction))
+	assert.True(t, broker.reservations.allowed("$SYS/broker/foo", SubscribeAction))
+	assert.False(t, broker.reservations.allowed("$SYS/broker/foo", PublishAction))
+	assert.False(t, broker.reservations.allowed("$foo/bar", SubscribeAction))
+
+	err := broker.Reserve(Reservation{})
+	assert.Error(t, err)
+
+	err = broker.Reserve(Reservation{Prefix: "admin/"})
+	assert.NoError(t, err)
+	assert.False(t, broker.reservations.allowed("admin/foo", PublishAction))
+
+	// the longest prefix decides
+	err = broker.Reserve(Reservation{Prefix: "$SYS/custom/", Publish: true})
+	assert.NoError(t, err)
+	assert.True(t, broker.reservations.allowed("$SYS/custom/foo", PublishAction))
+	assert.False(t, broker.reservations.allowed("$SYS/custom/foo", SubscribeAction))
+
+	broker.Unreserve("admin/")
+	assert.True(t, broker.reservations.allowed("admin/foo", PublishAction))
+	assert.Equal(t, []Reservation{
+		{Prefix: "$SYS/", Subscribe: true},
+		{Prefix: "$SYS/custom/", Publish: true},
+	}, broker.Reservations())
+}
+
+func TestReservedTopics(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{
+		{Topic: "$unknown/#"},
+		{Topic: "$SYS/#"},
+		{Topic: "$queue/test"},
+	}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{packet.QOSFailure, 0, 0}
+	suback.PacketID = 1
+
+	publish1 := packet.NewPublishPacket()
+	publish1.Message.Topic = "$SYS/test"
+	publish1.Message.Payload = []byte("test")
+
+	publish2 := packet.NewPublishPacket()
+	publish2.Message.Topic = "$queue/test"
+	publish2.Message.Payload = []byte("test")
+
+	broker := New()
+
+	err := broker.Reserve(Reservation{Prefix: "$queue/", Publish: true, Subscribe: true})
+	assert.NoError(t, err)
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(publish1).
+		Send(publish2).
+		Receive(publish2).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+}
@@ -0,0 +1,271 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gomqtt/packet"
+)
+
+// ErrSearchBudget is returned by the MemoryBackend if the retained messages
+// of a subscription could not be looked up within the RetainedSearchBudget.
+var ErrSearchBudget = errors.New("retained search budget exceeded")
+
+// A RetainedInspector is a Backend that is able to list its retained messages.
+type RetainedInspector interface {
+	// RetainedMessages should return all retained messages that match the
+	// specified topic filter.
+	RetainedMessages(filter string) ([]*packet.Message, error)
+}
+
+// RetainedMessages will return all retained messages that match the specified
+// topic filter.
+func (m *MemoryBackend) RetainedMessages(filter string) ([]*packet.Message, error) {
+	m.retainedMutex.Lock()
+	defer m.retainedMutex.Unlock()
+
+	now := time.Now()
+
+	var list []*packet.Message
+	for _, value := range m.retained.Search(filter) {
+		if msg, ok := value.(*packet.Message); ok && !m.retainedExpired(msg.Topic, now) {
+			list = append(list, msg)
+		}
+	}
+
+	return list, nil
+}
+
+// A RetainedSwapper is a Backend that is able to conditionally update retained
+// messages, which prevents lost updates if multiple writers update the same
+// topic, e.g. controllers writing device configurations.
+type RetainedSwapper interface {
+	// SwapRetained should publish the retained message like Publish only if
+	// the payload of the currently retained message on its topic equals the
+	// expected payload. An empty expected payload requires that no message is
+	// retained. It should return false if the condition is not met.
+	SwapRetained(client Client, msg *packet.Message, expected []byte) (bool, error)
+}
+
+// a sentinel error that aborts publishing a swapped retained message
+var errRetainedMismatch = fmt.Errorf("retained message mismatch")
+
+// SwapRetained will publish the retained message if the payload of the
+// currently retained message equals the expected payload. The comparison and
+// the update are carried out atomically.
+func (m *MemoryBackend) SwapRetained(client Client, msg *packet.Message, expected []byte) (bool, error) {
+	if !msg.Retain {
+		return false, fmt.Errorf("message is not retained")
+	}
+
+	err := m.publish(client, msg, func(publisher, tenant string, msg *packet.Message) error {
+		return m.swapRetained(publisher, tenant, msg, expected)
+	})
+	if err == errRetainedMismatch {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// stores the retained message if the payload of the currently retained message
+// equals the expected payload and returns errRetainedMismatch otherwise
+func (m *MemoryBackend) swapRetained(publisher, tenant string, msg *packet.Message, expected []byte) error {
+	m.retainedMutex.Lock()
+	defer m.retainedMutex.Unlock()
+
+	// compare current payload
+	var current []byte
+	for _, value := range m.retained.Get(msg.Topic) {
+		if retained, ok := value.(*packet.Message); ok {
+			current = retained.Payload
+		}
+	}
+	if !bytes.Equal(current, expected) {
+		return errRetainedMismatch
+	}
+
+	return m.storeRetained(publisher, tenant, msg)
+}
+
+// SwapRetained will publish the retained message using a local client if the
+// payload of the currently retained message equals the expected payload and
+// return whether it has been published. It returns an error if the backend
+// does not implement the RetainedSwapper interface.
+func (b *Broker) SwapRetained(msg *packet.Message, expected []byte) (bool, error) {
+	swapper, ok := b.Backend.(RetainedSwapper)
+	if !ok {
+		return false, fmt.Errorf("backend does not support conditional retained updates")
+	}
+
+	b.RecordAction("swap_retained", msg.Topic)
+
+	return swapper.SwapRetained(NewLocalClient(func(*packet.Message) {}), msg, expected)
+}
+
+// A RetainedClearer is a Backend that reports whether an empty retained message
+// removed a retained message, which allows the broker to emit the
+// RetainedMessageCleared event only for actual removals.
+type RetainedClearer interface {
+	// ClearRetained should publish the empty retained message like Publish
+	// and return whether a retained message has been removed.
+	ClearRetained(client Client, msg *packet.Message) (bool, error)
+}
+
+// ClearRetained will publish the empty retained message and return whether an
+// unexpired retained message has been removed.
+func (m *MemoryBackend) ClearRetained(client Client, msg *packet.Message) (bool, error) {
+	if !msg.Retain || len(msg.Payload) > 0 {
+		return false, fmt.Errorf("message does not clear a retained message")
+	}
+
+	removed := false
+
+	err := m.publish(client, msg, func(publisher, tenant string, msg *packet.Message) error {
+		m.retainedMutex.Lock()
+		defer m.retainedMutex.Unlock()
+
+		removed = len(m.retained.Get(msg.Topic)) > 0 && !m.retainedExpired(msg.Topic, time.Now())
+
+		return m.storeRetained(publisher, tenant, msg)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return removed, nil
+}
+
+// publishes the message and returns whether it cleared a retained message,
+// which is assumed for empty retained messages if the backend does not
+// implement the RetainedClearer interface
+func (b *Broker) publishClearing(client Client, msg *packet.Message) (bool, error) {
+	if !msg.Retain || len(msg.Payload) > 0 {
+		return false, b.Backend.Publish(client, msg)
+	}
+
+	if clearer, ok := b.Backend.(RetainedClearer); ok {
+		return clearer.ClearRetained(client, msg)
+	}
+
+	return true, b.Backend.Publish(client, msg)
+}
+
+// A RetainedLoader is a Backend that is able to look up the retained messages
+// of a subscription separately. The broker then subscribes clients using
+// SubscribeOnly, acknowledges the subscriptions and delivers the retained
+// messages afterwards, which keeps searching large retained sets off the
+// critical path of SUBSCRIBE processing.
+type RetainedLoader interface {
+	// SubscribeOnly should subscribe the client like Subscribe without looking
+	// up the retained messages.
+	SubscribeOnly(client Client, topic string) error
+
+	// LoadRetained should return the stored retained messages matching the
+	// specified topic like Subscribe. Messages that have been retained after
+	// the subscription should be skipped, as they have already been delivered
+	// to the subscribed client.
+	LoadRetained(client Client, topic string) ([]*packet.Message, error)
+}
+
+// SubscribeOnly will subscribe the passed client to the specified topic
+// without looking up the retained messages.
+func (m *MemoryBackend) SubscribeOnly(client Client, topic string) error {
+	return m.subscribeOnly(client, topic, nil)
+}
+
+// subscribes the client and applies the options if available
+func (m *MemoryBackend) subscribeOnly(client Client, topic string, options *SubscriptionOptions) error {
+	m.clientsMutex.RLock()
+	defer m.clientsMutex.RUnlock()
+
+	// ignore subscriptions that arrive after the client has been terminated
+	if terminated, _ := client.Context().Get("terminated").(bool); terminated {
+		return nil
+	}
+
+	topic = m.namespace(client) + topic
+
+	// remember the current version of the retained messages
+	m.retainedMutex.Lock()
+	if m.subscribedAt == nil {
+		m.subscribedAt = make(map[Client]map[string]uint64)
+	}
+	if m.subscribedAt[client] == nil {
+		m.subscribedAt[client] = make(map[string]uint64)
+	}
+	m.subscribedAt[client][topic] = m.version
+	m.retainedMutex.Unlock()
+
+	// add client to queue
+	m.queue.Add(topic, client)
+	m.route(client, topic, options)
+
+	return nil
+}
+
+// loads the retained messages of a new subscription and removes the
+// subscription if the search budget has been exceeded
+func (m *MemoryBackend) retainedOf(client Client, topic string) ([]*packet.Message, error) {
+	msgs, err := m.LoadRetained(client, topic)
+	if err == ErrSearchBudget {
+		m.Unsubscribe(client, topic)
+	}
+
+	return msgs, err
+}
+
+// LoadRetained will return the stored retained messages matching the supplied
+// topic that have been retained before the client subscribed to the topic.
+func (m *MemoryBackend) LoadRetained(client Client, topic string) ([]*packet.Message, error) {
+	ns := m.namespace(client)
+	topic = ns + topic
+
+	// get version of subscription
+	m.retainedMutex.Lock()
+	version, deferred := m.subscribedAt[client][topic]
+	delete(m.subscribedAt[client], topic)
+	if len(m.subscribedAt[client]) == 0 {
+		delete(m.subscribedAt, client)
+	}
+	m.retainedMutex.Unlock()
+
+	// get retained messages
+	values, ok := m.retained.search(topic, m.RetainedSearchBudget)
+	if !ok {
+		return nil, ErrSearchBudget
+	}
+
+	var msgs []*packet.Message
+
+	// convert types, skip newer and expired messages and attach the
+	// remaining expiry
+	now := time.Now()
+	m.retainedMutex.Lock()
+	for _, value := range values {
+		if msg, ok := value.(*packet.Message); ok && (!deferred || m.versions[msg.Topic] <= version) && !m.retainedExpired(msg.Topic, now) {
+			msgs = append(msgs, m.withExpiry(localized(ns, msg), m.retainedExpiry[msg.Topic], now))
+		}
+	}
+	m.retainedMutex.Unlock()
+
+	return msgs, nil
+}
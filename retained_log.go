@@ -0,0 +1,215 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/gomqtt/packet"
+)
+
+// the number of obsolete records tolerated before the log is compacted
+const retainedLogSlack = 1000
+
+// a single record in the retained log, a missing message clears the topic
+type retainedRecord struct {
+	Topic   string          `json:"topic"`
+	Message *packet.Message `json:"message,omitempty"`
+}
+
+// an append-only log of retained message changes
+type retainedLog struct {
+	path    string
+	file    *os.File
+	records int
+	live    map[string]bool
+	mutex   sync.Mutex
+}
+
+// opens the log at the specified path and returns the currently retained
+// messages, a missing file is treated as an empty log
+func openRetainedLog(path string) (*retainedLog, []*packet.Message, error) {
+	l := &retainedLog{
+		path: path,
+		live: make(map[string]bool),
+	}
+
+	// replay existing records
+	msgs := make(map[string]*packet.Message)
+
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	} else if err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 256*1024*1024)
+
+		for scanner.Scan() {
+			var record retainedRecord
+			err = json.Unmarshal(scanner.Bytes(), &record)
+			if err != nil {
+				// ignore a torn last record after a crash
+				break
+			}
+
+			if record.Message != nil {
+				msgs[record.Topic] = record.Message
+			} else {
+				delete(msgs, record.Topic)
+			}
+		}
+
+		file.Close()
+	}
+
+	// collect messages
+	var list []*packet.Message
+	for _, msg := range msgs {
+		list = append(list, msg)
+	}
+
+	// rewrite log to drop obsolete and torn records
+	err = l.compact(list)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return l, list, nil
+}
+
+// appends a record for the message, a zero length payload clears the topic
+func (l *retainedLog) append(msg *packet.Message) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	record := retainedRecord{
+		Topic: msg.Topic,
+	}
+
+	if len(msg.Payload) > 0 {
+		record.Message = msg
+		l.live[msg.Topic] = true
+	} else {
+		delete(l.live, msg.Topic)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+
+	l.records++
+
+	return nil
+}
+
+// reports whether the log contains enough obsolete records to be compacted
+func (l *retainedLog) obsolete() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.records-len(l.live) > len(l.live)+retainedLogSlack
+}
+
+// replaces the log with a snapshot of the specified messages
+func (l *retainedLog) compact(msgs []*packet.Message) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// write snapshot to a temporary file
+	tmp, err := os.Create(l.path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	live := make(map[string]bool)
+
+	for _, msg := range msgs {
+		data, err := json.Marshal(retainedRecord{
+			Topic:   msg.Topic,
+			Message: msg,
+		})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+
+		writer.Write(append(data, '\n'))
+		live[msg.Topic] = true
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	tmp.Close()
+
+	// replace log
+	err = os.Rename(l.path+".tmp", l.path)
+	if err != nil {
+		return err
+	}
+
+	// reopen log for appending
+	if l.file != nil {
+		l.file.Close()
+	}
+
+	l.file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	l.records = len(msgs)
+	l.live = live
+
+	return nil
+}
+
+// flushes the log to stable storage
+func (l *retainedLog) sync() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.file.Sync()
+}
+
+// syncs and closes the log
+func (l *retainedLog) close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	err := l.file.Sync()
+	if err != nil {
+		l.file.Close()
+		return err
+	}
+
+	return l.file.Close()
+}
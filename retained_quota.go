@@ -0,0 +1,239 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"container/list"
+	"strings"
+	"time"
+
+	"github.com/gomqtt/packet"
+)
+
+// A RetainedQuota limits the retained messages stored for topics that begin
+// with the prefix. If a limit is exceeded, the oldest retained messages of
+// the prefix are evicted. A zero value disables the respective limit.
+type RetainedQuota struct {
+	// The topic prefix, e.g. "tenants/acme/".
+	Prefix string
+
+	// The maximum number of retained messages.
+	MaxMessages int
+
+	// The maximum number of bytes of all retained topics and payloads.
+	MaxBytes int
+}
+
+// the usage of a single quota
+type quotaUsage struct {
+	quota    RetainedQuota
+	order    *list.List
+	elements map[string]*list.Element
+	sizes    map[string]int
+	bytes    int
+}
+
+// tracks the usage of all quotas, the retained mutex must be held
+type retainedQuotas []*quotaUsage
+
+// returns the usage trackers for the specified quotas
+func newRetainedQuotas(quotas []RetainedQuota) retainedQuotas {
+	var usages retainedQuotas
+
+	for _, quota := range quotas {
+		usages = append(usages, &quotaUsage{
+			quota:    quota,
+			order:    list.New(),
+			elements: make(map[string]*list.Element),
+			sizes:    make(map[string]int),
+		})
+	}
+
+	return usages
+}
+
+// records the retained message and returns the topics that have to be evicted
+func (q retainedQuotas) add(msg *packet.Message) []string {
+	var evicted []string
+
+	for _, usage := range q {
+		if !strings.HasPrefix(msg.Topic, usage.quota.Prefix) {
+			continue
+		}
+
+		// the updated message becomes the newest message
+		usage.remove(msg.Topic)
+		usage.elements[msg.Topic] = usage.order.PushBack(msg.Topic)
+		usage.sizes[msg.Topic] = len(msg.Topic) + len(msg.Payload)
+		usage.bytes += usage.sizes[msg.Topic]
+
+		// evict oldest messages
+		for usage.exceeded() {
+			evicted = append(evicted, usage.order.Front().Value.(string))
+			q.remove(evicted[len(evicted)-1])
+		}
+	}
+
+	return evicted
+}
+
+// removes the topic from all quotas
+func (q retainedQuotas) remove(topic string) {
+	for _, usage := range q {
+		usage.remove(topic)
+	}
+}
+
+// removes the topic from the quota
+func (u *quotaUsage) remove(topic string) {
+	element, ok := u.elements[topic]
+	if !ok {
+		return
+	}
+
+	u.order.Remove(element)
+	u.bytes -= u.sizes[topic]
+
+	delete(u.elements, topic)
+	delete(u.sizes, topic)
+}
+
+// checks if a limit of the quota is exceeded
+func (u *quotaUsage) exceeded() bool {
+	if u.order.Len() == 0 {
+		return false
+	}
+
+	return (u.quota.MaxMessages > 0 && u.order.Len() > u.quota.MaxMessages) ||
+		(u.quota.MaxBytes > 0 && u.bytes > u.quota.MaxBytes)
+}
+
+// RetainedStats describes the retained messages of a MemoryBackend.
+type RetainedStats struct {
+	// The number of currently retained messages.
+	Messages int
+
+	// The number of retained messages evicted because a RetainedQuota, a
+	// TenantQuota or MaxRetainedMessages has been exceeded.
+	Evicted int64
+
+	// The number of retained messages purged because of the RetainedTTL or
+	// their expiry interval.
+	Expired int64
+}
+
+// RetainedStats will return the current retained message statistics.
+func (m *MemoryBackend) RetainedStats() RetainedStats {
+	m.retainedMutex.Lock()
+	defer m.retainedMutex.Unlock()
+
+	stats := m.retainedStats
+	stats.Messages = len(m.retained.All())
+
+	return stats
+}
+
+// records the time the topic has been retained if a ttl is set, the retained
+// mutex must be held
+func (m *MemoryBackend) touchRetained(topic string, now time.Time) {
+	if m.RetainedTTL <= 0 {
+		return
+	}
+
+	// lazily allocate retained times
+	if m.retainedAt == nil {
+		m.retainedAt = make(map[string]time.Time)
+	}
+
+	m.retainedAt[topic] = now
+}
+
+// removes a retained message that exceeded a quota, the retained mutex must be
+// held
+func (m *MemoryBackend) evictRetained(topic string) {
+	m.retained.Empty(topic)
+	delete(m.publishers, topic)
+	delete(m.versions, topic)
+	delete(m.retainedAt, topic)
+	delete(m.retainedExpiry, topic)
+
+	m.retainedStats.Evicted++
+}
+
+// sweeper will periodically purge expired retained messages until quit is
+// closed
+func (m *MemoryBackend) sweeper(quit chan struct{}) {
+	ticker := time.NewTicker(m.RetainedSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case now := <-ticker.C:
+			m.expireRetained(now)
+		}
+	}
+}
+
+// purges all retained messages that have expired before the specified time
+// and appends the removals to the log
+func (m *MemoryBackend) expireRetained(now time.Time) error {
+	m.retainedMutex.Lock()
+	defer m.retainedMutex.Unlock()
+
+	expired := make(map[string]bool)
+	for topic, retainedAt := range m.retainedAt {
+		if now.Sub(retainedAt) >= m.RetainedTTL {
+			expired[topic] = true
+		}
+	}
+
+	for topic := range m.retainedExpiry {
+		if m.retainedExpired(topic, now) {
+			expired[topic] = true
+		}
+	}
+
+	for topic := range expired {
+		m.retained.Empty(topic)
+		delete(m.publishers, topic)
+		delete(m.versions, topic)
+		delete(m.retainedAt, topic)
+		delete(m.retainedExpiry, topic)
+		m.retainedQuotas().remove(topic)
+
+		m.retainedStats.Expired++
+	}
+
+	// check log
+	if m.retainedLog == nil || len(expired) == 0 {
+		return nil
+	}
+
+	for topic := range expired {
+		err := m.retainedLog.append(&packet.Message{Topic: topic})
+		if err != nil {
+			return err
+		}
+	}
+
+	// sync immediately if no interval is set
+	if m.RetainedSyncInterval <= 0 {
+		return m.retainedLog.sync()
+	}
+
+	return nil
+}
@@ -0,0 +1,358 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+// hides the RetainedLoader implementation of the wrapped backend
+type syncBackend struct {
+	Backend
+}
+
+func TestMemoryBackendLoadRetained(t *testing.T) {
+	backend := NewMemoryBackend()
+	client := newFakeClient()
+
+	err := backend.Publish(client, &packet.Message{Topic: "foo", Payload: []byte("foo"), Retain: true})
+	assert.NoError(t, err)
+
+	err = backend.SubscribeOnly(client, "#")
+	assert.NoError(t, err)
+
+	// messages retained after the subscription are skipped
+	err = backend.Publish(client, &packet.Message{Topic: "bar", Payload: []byte("bar"), Retain: true})
+	assert.NoError(t, err)
+
+	msgs, err := backend.LoadRetained(client, "#")
+	assert.NoError(t, err)
+	assert.Equal(t, []*packet.Message{{Topic: "foo", Payload: []byte("foo"), Retain: true}}, msgs)
+}
+
+func TestMemoryBackendSwapRetained(t *testing.T) {
+	backend := NewMemoryBackend()
+	client := newFakeClient()
+
+	// require that no message is retained
+	ok, err := backend.SwapRetained(client, &packet.Message{Topic: "foo", Payload: []byte("1"), Retain: true}, nil)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = backend.SwapRetained(client, &packet.Message{Topic: "foo", Payload: []byte("2"), Retain: true}, nil)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// replace the current payload
+	ok, err = backend.SwapRetained(client, &packet.Message{Topic: "foo", Payload: []byte("2"), Retain: true}, []byte("1"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = backend.SwapRetained(client, &packet.Message{Topic: "foo", Payload: []byte("3"), Retain: true}, []byte("1"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	msgs, err := backend.RetainedMessages("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []*packet.Message{{Topic: "foo", Payload: []byte("2"), Retain: true}}, msgs)
+
+	// clear the current payload
+	ok, err = backend.SwapRetained(client, &packet.Message{Topic: "foo", Retain: true}, []byte("2"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	msgs, err = backend.RetainedMessages("foo")
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	_, err = backend.SwapRetained(client, &packet.Message{Topic: "foo"}, nil)
+	assert.Error(t, err)
+}
+
+func TestSwapRetainedConcurrently(t *testing.T) {
+	broker := New()
+
+	ok, err := broker.SwapRetained(&packet.Message{Topic: "foo", Payload: []byte("0"), Retain: true}, nil)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// concurrent writers that read and then update the same version
+	results := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			ok, err := broker.SwapRetained(&packet.Message{
+				Topic:   "foo",
+				Payload: []byte(fmt.Sprintf("%d", i+1)),
+				Retain:  true,
+			}, []byte("0"))
+			assert.NoError(t, err)
+			results <- ok
+		}(i)
+	}
+
+	swapped := 0
+	for i := 0; i < 10; i++ {
+		if <-results {
+			swapped++
+		}
+	}
+
+	assert.Equal(t, 1, swapped)
+}
+
+func TestRetainedSearchBudget(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.RetainedSearchBudget = 10
+
+	publisher := NewLocalClient(func(*packet.Message) {})
+	for i := 0; i < 10; i++ {
+		err := backend.Publish(publisher, &packet.Message{
+			Topic:   fmt.Sprintf("retained/%d/state", i),
+			Payload: []byte("test"),
+			Retain:  true,
+		})
+		assert.NoError(t, err)
+	}
+
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{
+		{Topic: "+/+/state"},
+		{Topic: "retained/1/state"},
+	}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{packet.QOSFailure, 0}
+	suback.PacketID = 1
+
+	retained := packet.NewPublishPacket()
+	retained.Message = packet.Message{
+		Topic:   "retained/1/state",
+		Payload: []byte("test"),
+		Retain:  true,
+	}
+
+	broker := New()
+	broker.Backend = &syncBackend{Backend: backend}
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Receive(retained).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	assert.Equal(t, int64(1), broker.Counters().AbortedSearches)
+
+	// deferred lookups skip the retained messages
+	client := newFakeClient()
+
+	err = backend.SubscribeOnly(client, "+/+/state")
+	assert.NoError(t, err)
+
+	_, err = backend.LoadRetained(client, "+/+/state")
+	assert.Equal(t, ErrSearchBudget, err)
+}
+
+func TestRetainedQOSDowngrade(t *testing.T) {
+	for _, deferred := range []bool{false, true} {
+		backend := NewMemoryBackend()
+
+		err := backend.Publish(NewLocalClient(func(*packet.Message) {}), &packet.Message{
+			Topic:   "test/a",
+			Payload: []byte("test"),
+			QOS:     2,
+			Retain:  true,
+		})
+		assert.NoError(t, err)
+
+		connect := packet.NewConnectPacket()
+
+		connack := packet.NewConnackPacket()
+
+		subscribe1 := packet.NewSubscribePacket()
+		subscribe1.Subscriptions = []packet.Subscription{{Topic: "test/+", QOS: 1}}
+		subscribe1.PacketID = 1
+
+		suback1 := packet.NewSubackPacket()
+		suback1.ReturnCodes = []uint8{1}
+		suback1.PacketID = 1
+
+		subscribe2 := packet.NewSubscribePacket()
+		subscribe2.Subscriptions = []packet.Subscription{{Topic: "test/a", QOS: 0}}
+		subscribe2.PacketID = 2
+
+		suback2 := packet.NewSubackPacket()
+		suback2.ReturnCodes = []uint8{0}
+		suback2.PacketID = 2
+
+		// retained messages are delivered at the qos granted to the
+		// subscription that requested them
+		retained1 := packet.NewPublishPacket()
+		retained1.Message = packet.Message{Topic: "test/a", Payload: []byte("test"), QOS: 1, Retain: true}
+		retained1.PacketID = 1
+
+		puback1 := packet.NewPubackPacket()
+		puback1.PacketID = 1
+
+		retained2 := packet.NewPublishPacket()
+		retained2.Message = packet.Message{Topic: "test/a", Payload: []byte("test"), Retain: true}
+
+		broker := New()
+		broker.Backend = backend
+		if !deferred {
+			broker.Backend = &syncBackend{Backend: backend}
+		}
+
+		port, done := runBroker(t, broker, 1)
+
+		conn, err := transport.Dial(port.URL())
+		assert.NoError(t, err)
+
+		tools.NewFlow().
+			Send(connect).
+			Receive(connack).
+			Send(subscribe1).
+			Receive(suback1).
+			Receive(retained1).
+			Send(puback1).
+			Send(subscribe2).
+			Receive(suback2).
+			Receive(retained2).
+			Send(packet.NewDisconnectPacket()).
+			Close().
+			Test(t, conn)
+
+		<-done
+	}
+}
+
+func BenchmarkSubscribeRetained(b *testing.B) {
+	for _, deferred := range []bool{false, true} {
+		b.Run(fmt.Sprintf("deferred=%v", deferred), func(b *testing.B) {
+			benchmarkSubscribeRetained(b, 10000, deferred)
+		})
+	}
+}
+
+// measures the latency from SUBSCRIBE to SUBACK with a large retained set
+func benchmarkSubscribeRetained(b *testing.B, retained int, deferred bool) {
+	backend := NewMemoryBackend()
+
+	publisher := NewLocalClient(func(*packet.Message) {})
+	for i := 0; i < retained; i++ {
+		err := backend.Publish(publisher, &packet.Message{
+			Topic:   fmt.Sprintf("retained/%d", i),
+			Payload: []byte("test"),
+			Retain:  true,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	broker := New()
+	broker.Backend = backend
+	if !deferred {
+		broker.Backend = &syncBackend{Backend: backend}
+	}
+
+	port := tools.NewPort()
+
+	err := broker.Launch(port.URL())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "#"}}
+	subscribe.PacketID = 1
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+
+		conn, err := transport.Dial(port.URL())
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		err = conn.Send(packet.NewConnectPacket())
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		_, err = conn.Receive()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.StartTimer()
+
+		err = conn.Send(subscribe)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		// skip retained messages sent before the suback
+		for {
+			pkt, err := conn.Receive()
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			if _, ok := pkt.(*packet.SubackPacket); ok {
+				break
+			}
+		}
+
+		b.StopTimer()
+
+		conn.Close()
+
+		// wait for the cleanup of the client
+		broker.await(time.Now().Add(time.Second), func() bool {
+			return len(broker.currentClients()) == 0
+		})
+
+		b.StartTimer()
+	}
+
+	b.StopTimer()
+
+	broker.Close(0)
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gomqtt/packet"
+)
+
+// A RewriteRule remaps topics that match a template or a regular expression.
+type RewriteRule struct {
+	// The template that is matched against topics and topic filters. A "+"
+	// level captures a single level and a trailing "#" level captures the
+	// remaining levels, e.g. "old/+/x". If Regexp is set, Match is a regular
+	// expression instead.
+	Match  string
+	Regexp bool
+
+	// The replacement that references the captures using "$1" or "${1}",
+	// e.g. "new/$1/x".
+	Replace string
+}
+
+// a rule with its compiled expression
+type compiledRule struct {
+	expr    *regexp.Regexp
+	replace string
+}
+
+// A TopicRewriter rewrites the topics of incoming publishes and wills and the
+// filters of incoming subscribes and unsubscribes. The first matching rule is
+// applied. Delivered messages keep the rewritten topic.
+type TopicRewriter struct {
+	rules []compiledRule
+	mutex sync.RWMutex
+}
+
+// NewTopicRewriter returns a new TopicRewriter that applies the rules.
+func NewTopicRewriter(rules ...RewriteRule) (*TopicRewriter, error) {
+	r := &TopicRewriter{}
+
+	err := r.Update(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Update will atomically replace the rules, which allows reloading them at
+// runtime. The current rules are kept if a rule is invalid.
+func (r *TopicRewriter) Update(rules []RewriteRule) error {
+	var compiled []compiledRule
+
+	for _, rule := range rules {
+		pattern := rule.Match
+		if !rule.Regexp {
+			pattern = templatePattern(rule.Match)
+		}
+
+		expr, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid rewrite rule %q: %v", rule.Match, err)
+		}
+
+		compiled = append(compiled, compiledRule{
+			expr:    expr,
+			replace: rule.Replace,
+		})
+	}
+
+	r.mutex.Lock()
+	r.rules = compiled
+	r.mutex.Unlock()
+
+	return nil
+}
+
+// Rewrite will return the topic rewritten by the first matching rule or the
+// unchanged topic if no rule matches.
+func (r *TopicRewriter) Rewrite(topic string) string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, rule := range r.rules {
+		if rule.expr.MatchString(topic) {
+			return rule.expr.ReplaceAllString(topic, rule.replace)
+		}
+	}
+
+	return topic
+}
+
+// rewrites the topics of an incoming packet
+func (r *TopicRewriter) apply(pkt packet.Packet) {
+	switch p := pkt.(type) {
+	case *packet.ConnectPacket:
+		if p.Will != nil {
+			p.Will.Topic = r.Rewrite(p.Will.Topic)
+		}
+	case *packet.PublishPacket:
+		p.Message.Topic = r.Rewrite(p.Message.Topic)
+	case *packet.SubscribePacket:
+		for i := range p.Subscriptions {
+			p.Subscriptions[i].Topic = r.Rewrite(p.Subscriptions[i].Topic)
+		}
+	case *packet.UnsubscribePacket:
+		for i := range p.Topics {
+			p.Topics[i] = r.Rewrite(p.Topics[i])
+		}
+	}
+}
+
+// converts a template to an anchored regular expression
+func templatePattern(template string) string {
+	levels := strings.Split(template, "/")
+
+	for i, level := range levels {
+		switch {
+		case level == "+":
+			levels[i] = "([^/]+)"
+		case level == "#" && i == len(levels)-1:
+			levels[i] = "(.*)"
+		default:
+			levels[i] = regexp.QuoteMeta(level)
+		}
+	}
+
+	return "^" + strings.Join(levels, "/") + "$"
+}
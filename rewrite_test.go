@@ -0,0 +1,95 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicRewriter(t *testing.T) {
+	rewriter, err := NewTopicRewriter(
+		RewriteRule{Match: "old/+/x", Replace: "new/$1/x"},
+		RewriteRule{Match: "legacy/#", Replace: "current/$1"},
+		RewriteRule{Match: `^devices/(\d+)$`, Regexp: true, Replace: "things/${1}/state"},
+	)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "new/a/x", rewriter.Rewrite("old/a/x"))
+	assert.Equal(t, "new/+/x", rewriter.Rewrite("old/+/x"))
+	assert.Equal(t, "old/a/y", rewriter.Rewrite("old/a/y"))
+	assert.Equal(t, "current/a/b", rewriter.Rewrite("legacy/a/b"))
+	assert.Equal(t, "things/42/state", rewriter.Rewrite("devices/42"))
+	assert.Equal(t, "devices/foo", rewriter.Rewrite("devices/foo"))
+
+	// invalid rules keep the current rules
+	err = rewriter.Update([]RewriteRule{{Match: "(", Regexp: true}})
+	assert.Error(t, err)
+	assert.Equal(t, "new/a/x", rewriter.Rewrite("old/a/x"))
+
+	err = rewriter.Update(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "old/a/x", rewriter.Rewrite("old/a/x"))
+}
+
+func TestTopicRewriting(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "old/+/x"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "old/a/x"
+	publish.Message.Payload = []byte("test")
+
+	delivered := packet.NewPublishPacket()
+	delivered.Message.Topic = "new/a/x"
+	delivered.Message.Payload = []byte("test")
+
+	rewriter, err := NewTopicRewriter(RewriteRule{Match: "old/+/x", Replace: "new/$1/x"})
+	assert.NoError(t, err)
+
+	broker := New()
+	broker.Rewriter = rewriter
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(publish).
+		Receive(delivered).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// A RoutingSnapshot describes the subscriptions of a backend at a point in
+// time. Two snapshots can be compared using Diff to find subscription leaks.
+type RoutingSnapshot struct {
+	Time time.Time `json:"time"`
+
+	// The number of subscribed online clients by topic filter.
+	Subscribers map[string]int `json:"subscribers"`
+
+	// The number of offline sessions by topic filter.
+	Offline map[string]int `json:"offline"`
+}
+
+// A RoutingDiff describes the changes between two routing snapshots.
+type RoutingDiff struct {
+	Subscribers FilterDiff `json:"subscribers"`
+	Offline     FilterDiff `json:"offline"`
+}
+
+// A FilterDiff describes the changes of the subscriber counts by topic filter.
+type FilterDiff struct {
+	// The filters that are only present in the newer snapshot and their count.
+	Added map[string]int `json:"added"`
+
+	// The filters that are only present in the older snapshot and their count.
+	Removed map[string]int `json:"removed"`
+
+	// The filters that are present in both snapshots with a different count
+	// and the change of the count.
+	Changed map[string]int `json:"changed"`
+}
+
+// Empty returns whether the diff contains no changes.
+func (d *RoutingDiff) Empty() bool {
+	return d.Subscribers.empty() && d.Offline.empty()
+}
+
+// checks if there are no changes
+func (d FilterDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Diff will return the changes from the snapshot to the newer snapshot.
+func (s *RoutingSnapshot) Diff(newer *RoutingSnapshot) *RoutingDiff {
+	return &RoutingDiff{
+		Subscribers: diffFilters(s.Subscribers, newer.Subscribers),
+		Offline:     diffFilters(s.Offline, newer.Offline),
+	}
+}
+
+// compares two filter counts
+func diffFilters(older, newer map[string]int) FilterDiff {
+	diff := FilterDiff{
+		Added:   make(map[string]int),
+		Removed: make(map[string]int),
+		Changed: make(map[string]int),
+	}
+
+	for filter, count := range newer {
+		before, ok := older[filter]
+		if !ok {
+			diff.Added[filter] = count
+		} else if count != before {
+			diff.Changed[filter] = count - before
+		}
+	}
+
+	for filter, count := range older {
+		if _, ok := newer[filter]; !ok {
+			diff.Removed[filter] = count
+		}
+	}
+
+	return diff
+}
+
+// A RoutingInspector is a Backend that is able to snapshot its subscriptions.
+type RoutingInspector interface {
+	// SnapshotRouting should return the current number of subscribers and
+	// offline sessions by topic filter.
+	SnapshotRouting() (*RoutingSnapshot, error)
+}
+
+// SnapshotRouting will return a snapshot of the subscriptions of the backend.
+// It returns an error if the backend does not implement the RoutingInspector
+// interface.
+func (b *Broker) SnapshotRouting() (*RoutingSnapshot, error) {
+	inspector, ok := b.Backend.(RoutingInspector)
+	if !ok {
+		return nil, fmt.Errorf("backend does not support routing snapshots")
+	}
+
+	return inspector.SnapshotRouting()
+}
+
+// SnapshotRouting will count the subscribed clients and the offline sessions
+// by topic filter.
+func (m *MemoryBackend) SnapshotRouting() (*RoutingSnapshot, error) {
+	snapshot := &RoutingSnapshot{
+		Time:        time.Now(),
+		Subscribers: make(map[string]int),
+		Offline:     make(map[string]int),
+	}
+
+	// count subscribers
+	m.routesMutex.Lock()
+	for _, filters := range m.routes {
+		for filter := range filters {
+			snapshot.Subscribers[filter]++
+		}
+	}
+	m.routesMutex.Unlock()
+
+	// count offline sessions
+	m.sessionsMutex.Lock()
+	defer m.sessionsMutex.Unlock()
+
+	for _, sess := range m.sessions {
+		if sess.currentClient != nil {
+			continue
+		}
+
+		subs, err := sess.AllSubscriptions()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sub := range subs {
+			if sub.QOS >= 1 {
+				snapshot.Offline[sub.Topic]++
+			}
+		}
+	}
+
+	return snapshot, nil
+}
+
+// records the subscription of a client and its options if available
+func (m *MemoryBackend) route(client Client, filter string, options *SubscriptionOptions) {
+	m.routesMutex.Lock()
+	defer m.routesMutex.Unlock()
+
+	// lazily allocate routes
+	if m.routes == nil {
+		m.routes = make(map[Client]map[string]bool)
+	}
+
+	if m.routes[client] == nil {
+		m.routes[client] = make(map[string]bool)
+	}
+
+	m.routes[client][filter] = true
+
+	// a plain subscription replaces the options
+	if options == nil {
+		m.removeOptions(client, filter)
+		return
+	}
+
+	// lazily allocate options
+	if m.options == nil {
+		m.options = make(map[Client]map[string]SubscriptionOptions)
+	}
+
+	if m.options[client] == nil {
+		m.options[client] = make(map[string]SubscriptionOptions)
+		atomic.AddInt64(&m.optioned, 1)
+	}
+
+	m.options[client][filter] = *options
+}
+
+// removes a recorded subscription or all subscriptions of a client if the
+// filter is empty
+func (m *MemoryBackend) unroute(client Client, filter string) {
+	m.routesMutex.Lock()
+	defer m.routesMutex.Unlock()
+
+	m.removeOptions(client, filter)
+
+	if filter == "" {
+		delete(m.routes, client)
+		return
+	}
+
+	delete(m.routes[client], filter)
+	if len(m.routes[client]) == 0 {
+		delete(m.routes, client)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutingSnapshot(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	broker := New()
+	broker.Backend = backend
+
+	client1 := newFakeClient()
+	client2 := newFakeClient()
+
+	before, err := broker.SnapshotRouting()
+	assert.NoError(t, err)
+	assert.Empty(t, before.Subscribers)
+	assert.Empty(t, before.Offline)
+
+	// subscribe clients
+	sess, _, err := backend.Setup(client1, "client1", false)
+	assert.NoError(t, err)
+
+	err = sess.SaveSubscription(&packet.Subscription{Topic: "a", QOS: 1})
+	assert.NoError(t, err)
+
+	_, err = backend.Subscribe(client1, "a")
+	assert.NoError(t, err)
+
+	_, _, err = backend.Setup(client2, "", true)
+	assert.NoError(t, err)
+
+	_, err = backend.Subscribe(client2, "a")
+	assert.NoError(t, err)
+
+	_, err = backend.Subscribe(client2, "b")
+	assert.NoError(t, err)
+
+	after, err := broker.SnapshotRouting()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 2, "b": 1}, after.Subscribers)
+
+	diff := before.Diff(after)
+	assert.False(t, diff.Empty())
+	assert.Equal(t, map[string]int{"a": 2, "b": 1}, diff.Subscribers.Added)
+	assert.Empty(t, diff.Subscribers.Removed)
+	assert.Empty(t, diff.Subscribers.Changed)
+
+	// unsubscribe and terminate clients
+	err = backend.Unsubscribe(client2, "b")
+	assert.NoError(t, err)
+
+	err = backend.Terminate(client1)
+	assert.NoError(t, err)
+
+	last, err := broker.SnapshotRouting()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 1}, last.Subscribers)
+	assert.Equal(t, map[string]int{"a": 1}, last.Offline)
+
+	diff = after.Diff(last)
+	assert.Empty(t, diff.Subscribers.Added)
+	assert.Equal(t, map[string]int{"b": 1}, diff.Subscribers.Removed)
+	assert.Equal(t, map[string]int{"a": -1}, diff.Subscribers.Changed)
+	assert.Equal(t, map[string]int{"a": 1}, diff.Offline.Added)
+
+	err = backend.Terminate(client2)
+	assert.NoError(t, err)
+
+	assert.True(t, before.Diff(before).Empty())
+}
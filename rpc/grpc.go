@@ -0,0 +1,88 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpc
+
+import (
+	"context"
+
+	"github.com/gomqtt/broker/rpc/pb"
+	"google.golang.org/grpc"
+)
+
+// A Server is a pb.BrokerServer that serves a Service.
+type Server struct {
+	service *Service
+}
+
+// NewServer returns a new Server for the specified service.
+func NewServer(service *Service) *Server {
+	return &Server{
+		service: service,
+	}
+}
+
+// Register will register a Server for the service on the gRPC server.
+func Register(server *grpc.Server, service *Service) {
+	pb.RegisterBrokerServer(server, NewServer(service))
+}
+
+// Publish will publish the message using the service.
+func (s *Server) Publish(ctx context.Context, msg *pb.Message) (*pb.PublishResponse, error) {
+	err := s.service.Publish(ctx, &Message{
+		Topic:   msg.Topic,
+		Payload: msg.Payload,
+		QOS:     byte(msg.Qos),
+		Retain:  msg.Retain,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.PublishResponse{}, nil
+}
+
+// Subscribe will stream the messages of the subscription until the call is
+// canceled.
+func (s *Server) Subscribe(req *pb.SubscribeRequest, stream pb.Broker_SubscribeServer) error {
+	return s.service.Subscribe(stream.Context(), req.Filters, func(msg *Message) error {
+		return stream.Send(&pb.Message{
+			Topic:   msg.Topic,
+			Payload: msg.Payload,
+			Qos:     uint32(msg.QOS),
+			Retain:  msg.Retain,
+		})
+	})
+}
+
+// ListClients will list the connected clients using the service.
+func (s *Server) ListClients(ctx context.Context, req *pb.ListClientsRequest) (*pb.ListClientsResponse, error) {
+	clients, err := s.service.ListClients(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.ListClientsResponse{}
+	for _, c := range clients {
+		res.Clients = append(res.Clients, &pb.Client{
+			Uuid:          c.UUID,
+			ClientId:      c.ClientID,
+			RemoteIp:      c.RemoteIP,
+			Subscriptions: c.Subscriptions,
+			Inflight:      int64(c.Inflight),
+		})
+	}
+
+	return res, nil
+}
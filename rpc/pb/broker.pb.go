@@ -0,0 +1,267 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pb contains the messages and the gRPC bindings of the Broker service
+// described by rpc/broker.proto. The messages use the struct tag layout of
+// protoc-gen-go, which the protobuf runtime marshals without a compiled file
+// descriptor, and must be kept in sync with broker.proto by hand.
+package pb
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// A Message is a published message.
+type Message struct {
+	Topic   string `protobuf:"bytes,1,opt,name=topic,proto3" json:"topic,omitempty"`
+	Payload []byte `protobuf:"bytes,2,opt,name=payload,proto3" json:"payload,omitempty"`
+	Qos     uint32 `protobuf:"varint,3,opt,name=qos,proto3" json:"qos,omitempty"`
+	Retain  bool   `protobuf:"varint,4,opt,name=retain,proto3" json:"retain,omitempty"`
+}
+
+func (m *Message) Reset()         { *m = Message{} }
+func (m *Message) String() string { return proto.CompactTextString(m) }
+func (*Message) ProtoMessage()    {}
+
+// A PublishResponse acknowledges a published message.
+type PublishResponse struct{}
+
+func (m *PublishResponse) Reset()         { *m = PublishResponse{} }
+func (m *PublishResponse) String() string { return proto.CompactTextString(m) }
+func (*PublishResponse) ProtoMessage()    {}
+
+// A SubscribeRequest lists the topic filters of a subscription.
+type SubscribeRequest struct {
+	Filters []string `protobuf:"bytes,1,rep,name=filters,proto3" json:"filters,omitempty"`
+}
+
+func (m *SubscribeRequest) Reset()         { *m = SubscribeRequest{} }
+func (m *SubscribeRequest) String() string { return proto.CompactTextString(m) }
+func (*SubscribeRequest) ProtoMessage()    {}
+
+// A ListClientsRequest requests the connected clients.
+type ListClientsRequest struct{}
+
+func (m *ListClientsRequest) Reset()         { *m = ListClientsRequest{} }
+func (m *ListClientsRequest) String() string { return proto.CompactTextString(m) }
+func (*ListClientsRequest) ProtoMessage()    {}
+
+// A ListClientsResponse lists the connected clients.
+type ListClientsResponse struct {
+	Clients []*Client `protobuf:"bytes,1,rep,name=clients,proto3" json:"clients,omitempty"`
+}
+
+func (m *ListClientsResponse) Reset()         { *m = ListClientsResponse{} }
+func (m *ListClientsResponse) String() string { return proto.CompactTextString(m) }
+func (*ListClientsResponse) ProtoMessage()    {}
+
+// A Client is a connected client.
+type Client struct {
+	Uuid          string   `protobuf:"bytes,1,opt,name=uuid,proto3" json:"uuid,omitempty"`
+	ClientId      string   `protobuf:"bytes,2,opt,name=client_id,json=clientId,proto3" json:"client_id,omitempty"`
+	RemoteIp      string   `protobuf:"bytes,3,opt,name=remote_ip,json=remoteIp,proto3" json:"remote_ip,omitempty"`
+	Subscriptions []string `protobuf:"bytes,4,rep,name=subscriptions,proto3" json:"subscriptions,omitempty"`
+	Inflight      int64    `protobuf:"varint,5,opt,name=inflight,proto3" json:"inflight,omitempty"`
+}
+
+func (m *Client) Reset()         { *m = Client{} }
+func (m *Client) String() string { return proto.CompactTextString(m) }
+func (*Client) ProtoMessage()    {}
+
+func init() {
+	proto.RegisterType((*Message)(nil), "gomqtt.broker.Message")
+	proto.RegisterType((*PublishResponse)(nil), "gomqtt.broker.PublishResponse")
+	proto.RegisterType((*SubscribeRequest)(nil), "gomqtt.broker.SubscribeRequest")
+	proto.RegisterType((*ListClientsRequest)(nil), "gomqtt.broker.ListClientsRequest")
+	proto.RegisterType((*ListClientsResponse)(nil), "gomqtt.broker.ListClientsResponse")
+	proto.RegisterType((*Client)(nil), "gomqtt.broker.Client")
+}
+
+// BrokerClient is the client API of the Broker service.
+type BrokerClient interface {
+	Publish(ctx context.Context, in *Message, opts ...grpc.CallOption) (*PublishResponse, error)
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Broker_SubscribeClient, error)
+	ListClients(ctx context.Context, in *ListClientsRequest, opts ...grpc.CallOption) (*ListClientsResponse, error)
+}
+
+type brokerClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewBrokerClient returns a client of the Broker service.
+func NewBrokerClient(cc *grpc.ClientConn) BrokerClient {
+	return &brokerClient{cc}
+}
+
+func (c *brokerClient) Publish(ctx context.Context, in *Message, opts ...grpc.CallOption) (*PublishResponse, error) {
+	out := new(PublishResponse)
+	err := c.cc.Invoke(ctx, "/gomqtt.broker.Broker/Publish", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (c *brokerClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Broker_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &brokerServiceDesc.Streams[0], "/gomqtt.broker.Broker/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	x := &brokerSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	return x, nil
+}
+
+// Broker_SubscribeClient receives the messages of a subscription.
+type Broker_SubscribeClient interface {
+	Recv() (*Message, error)
+	grpc.ClientStream
+}
+
+type brokerSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *brokerSubscribeClient) Recv() (*Message, error) {
+	m := new(Message)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (c *brokerClient) ListClients(ctx context.Context, in *ListClientsRequest, opts ...grpc.CallOption) (*ListClientsResponse, error) {
+	out := new(ListClientsResponse)
+	err := c.cc.Invoke(ctx, "/gomqtt.broker.Broker/ListClients", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// BrokerServer is the server API of the Broker service.
+type BrokerServer interface {
+	Publish(context.Context, *Message) (*PublishResponse, error)
+	Subscribe(*SubscribeRequest, Broker_SubscribeServer) error
+	ListClients(context.Context, *ListClientsRequest) (*ListClientsResponse, error)
+}
+
+// RegisterBrokerServer registers the implementation of the Broker service.
+func RegisterBrokerServer(s *grpc.Server, srv BrokerServer) {
+	s.RegisterService(&brokerServiceDesc, srv)
+}
+
+func brokerPublishHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Message)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+
+	if interceptor == nil {
+		return srv.(BrokerServer).Publish(ctx, in)
+	}
+
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gomqtt.broker.Broker/Publish",
+	}
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).Publish(ctx, req.(*Message))
+	}
+
+	return interceptor(ctx, in, info, handler)
+}
+
+func brokerSubscribeHandler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	return srv.(BrokerServer).Subscribe(m, &brokerSubscribeServer{stream})
+}
+
+// Broker_SubscribeServer sends the messages of a subscription.
+type Broker_SubscribeServer interface {
+	Send(*Message) error
+	grpc.ServerStream
+}
+
+type brokerSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *brokerSubscribeServer) Send(m *Message) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func brokerListClientsHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListClientsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+
+	if interceptor == nil {
+		return srv.(BrokerServer).ListClients(ctx, in)
+	}
+
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/gomqtt.broker.Broker/ListClients",
+	}
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).ListClients(ctx, req.(*ListClientsRequest))
+	}
+
+	return interceptor(ctx, in, info, handler)
+}
+
+var brokerServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gomqtt.broker.Broker",
+	HandlerType: (*BrokerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Publish",
+			Handler:    brokerPublishHandler,
+		},
+		{
+			MethodName: "ListClients",
+			Handler:    brokerListClientsHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       brokerSubscribeHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "broker.proto",
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rpc implements the Broker service described by broker.proto, which
+// exposes the message plane of a broker to services that do not speak MQTT.
+// The Service is served on a gRPC server using Register:
+//
+//	server := grpc.NewServer()
+//	rpc.Register(server, rpc.NewService(b))
+//	server.Serve(listener)
+//
+// It is kept separate from the broker package, so that embedders that do not
+// need it do not depend on google.golang.org/grpc.
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gomqtt/broker"
+	"github.com/gomqtt/packet"
+)
+
+// ErrSlowSubscriber is returned by Subscribe if the stream did not keep up
+// with the messages published to the topic filters.
+var ErrSlowSubscriber = fmt.Errorf("slow subscriber")
+
+// A Message is the representation of a message in the service.
+type Message struct {
+	Topic   string
+	Payload []byte
+	QOS     byte
+	Retain  bool
+}
+
+// A Client is the representation of a connected client in the service.
+type Client struct {
+	UUID          string
+	ClientID      string
+	RemoteIP      string
+	Subscriptions []string
+	Inflight      int
+}
+
+// A Service implements the Broker service on a broker. The service does not
+// authenticate or authorize requests and should only be served to trusted
+// services.
+type Service struct {
+	// The number of messages buffered per Subscribe stream. Streams that fall
+	// behind by more messages are ended with ErrSlowSubscriber.
+	Buffer int
+
+	broker *broker.Broker
+}
+
+// NewService returns a new Service for the specified broker.
+func NewService(b *broker.Broker) *Service {
+	return &Service{
+		Buffer: 100,
+		broker: b,
+	}
+}
+
+// Publish will publish the message as the system client of the broker (see
+// Broker.Publish). Reserved topics starting with "$" are refused.
+func (s *Service) Publish(ctx context.Context, msg *Message) error {
+	// check message
+	if msg.Topic == "" || strings.ContainsAny(msg.Topic, "+#") || strings.HasPrefix(msg.Topic, "$") {
+		return fmt.Errorf("invalid topic")
+	} else if msg.QOS > 2 {
+		return fmt.Errorf("invalid qos")
+	}
+
+	return s.broker.Publish(&packet.Message{
+		Topic:   msg.Topic,
+		Payload: msg.Payload,
+		QOS:     msg.QOS,
+		Retain:  msg.Retain,
+	})
+}
+
+// Subscribe will pass the retained messages and then all messages published
+// to the topic filters to the send function until the context is canceled or
+// a send fails. The messages are not acknowledged and subscriptions are
+// removed when Subscribe returns.
+func (s *Service) Subscribe(ctx context.Context, filters []string, send func(msg *Message) error) error {
+	// check filters
+	if len(filters) == 0 {
+		return fmt.Errorf("missing filters")
+	}
+
+	for _, filter := range filters {
+		if filter == "" {
+			return fmt.Errorf("invalid filter")
+		}
+	}
+
+	messages := make(chan *packet.Message, s.Buffer)
+	overflow := make(chan struct{})
+
+	var once sync.Once
+
+	// the callback must not block the publisher
+	client := broker.NewLocalClient(func(msg *packet.Message) {
+		select {
+		case messages <- msg:
+		default:
+			once.Do(func() {
+				close(overflow)
+			})
+		}
+	})
+
+	_, _, err := s.broker.Backend.Setup(client, "", true)
+	if err != nil {
+		return err
+	}
+
+	defer s.broker.Backend.Terminate(client)
+
+	// subscribe to filters
+	var retained []*packet.Message
+	for _, filter := range filters {
+		msgs, err := s.broker.Backend.Subscribe(client, filter)
+		if err != nil {
+			return err
+		}
+
+		retained = append(retained, msgs...)
+	}
+
+	// send retained messages
+	for _, msg := range retained {
+		err = send(convert(msg))
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-overflow:
+			return ErrSlowSubscriber
+		case msg := <-messages:
+			err = send(convert(msg))
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ListClients will return the connected clients.
+func (s *Service) ListClients(ctx context.Context) ([]*Client, error) {
+	snapshot, err := s.broker.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*Client, 0, len(snapshot.Clients))
+	for _, c := range snapshot.Clients {
+		list = append(list, &Client{
+			UUID:          c.UUID,
+			ClientID:      c.ClientID,
+			RemoteIP:      c.RemoteIP,
+			Subscriptions: c.Subscriptions,
+			Inflight:      c.Inflight,
+		})
+	}
+
+	return list, nil
+}
+
+// converts a message of the broker
+func convert(msg *packet.Message) *Message {
+	return &Message{
+		Topic:   msg.Topic,
+		Payload: msg.Payload,
+		QOS:     msg.QOS,
+		Retain:  msg.Retain,
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/broker"
+	"github.com/gomqtt/broker/rpc/pb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func TestService(t *testing.T) {
+	b := broker.New()
+
+	var published []string
+	b.OnEvent(func(event *broker.Event) {
+		if event.Type == broker.MessagePublished {
+			published = append(published, event.Message.Topic)
+		}
+	})
+
+	err := b.Start()
+	assert.NoError(t, err)
+
+	service := NewService(b)
+
+	err = service.Publish(context.Background(), &Message{Topic: "foo/bar", Payload: []byte("retained"), Retain: true})
+	assert.NoError(t, err)
+
+	err = service.Publish(context.Background(), &Message{Topic: "foo/+"})
+	assert.Error(t, err)
+
+	err = service.Publish(context.Background(), &Message{Topic: "$SYS/foo"})
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan *Message, 10)
+	done := make(chan error)
+
+	go func() {
+		done <- service.Subscribe(ctx, []string{"foo/#"}, func(msg *Message) error {
+			received <- msg
+			return nil
+		})
+	}()
+
+	msg := <-received
+	assert.Equal(t, "foo/bar", msg.Topic)
+	assert.Equal(t, []byte("retained"), msg.Payload)
+	assert.True(t, msg.Retain)
+
+	err = service.Publish(context.Background(), &Message{Topic: "foo/baz", Payload: []byte("test"), QOS: 1})
+	assert.NoError(t, err)
+
+	msg = <-received
+	assert.Equal(t, "foo/baz", msg.Topic)
+	assert.Equal(t, []byte("test"), msg.Payload)
+	assert.Equal(t, byte(1), msg.QOS)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+
+	// messages are published by the broker
+	assert.Equal(t, []string{"foo/bar", "foo/baz"}, published)
+
+	clients, err := service.ListClients(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, clients)
+
+	err = b.Close(time.Second)
+	assert.NoError(t, err)
+}
+
+func TestServiceSlowSubscriber(t *testing.T) {
+	b := broker.New()
+
+	err := b.Start()
+	assert.NoError(t, err)
+
+	service := NewService(b)
+	service.Buffer = 1
+
+	err = service.Publish(context.Background(), &Message{Topic: "foo", Payload: []byte("1"), Retain: true})
+	assert.NoError(t, err)
+
+	blocked := make(chan struct{}, 1)
+	release := make(chan struct{})
+	done := make(chan error)
+
+	go func() {
+		done <- service.Subscribe(context.Background(), []string{"foo"}, func(msg *Message) error {
+			select {
+			case blocked <- struct{}{}:
+			default:
+			}
+
+			<-release
+			return nil
+		})
+	}()
+
+	// the retained message blocks the stream
+	<-blocked
+
+	for i := 0; i < 3; i++ {
+		err = service.Publish(context.Background(), &Message{Topic: "foo", Payload: []byte("2")})
+		assert.NoError(t, err)
+	}
+
+	close(release)
+	assert.Equal(t, ErrSlowSubscriber, <-done)
+
+	err = b.Close(time.Second)
+	assert.NoError(t, err)
+}
+
+// a subscribe stream that collects the sent messages
+type testStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	messages chan *pb.Message
+}
+
+func (s *testStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testStream) Send(msg *pb.Message) error {
+	s.messages <- msg
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	b := broker.New()
+
+	err := b.Start()
+	assert.NoError(t, err)
+
+	server := NewServer(NewService(b))
+
+	_, err = server.Publish(context.Background(), &pb.Message{Topic: "foo", Payload: []byte("foo"), Qos: 1, Retain: true})
+	assert.NoError(t, err)
+
+	_, err = server.Publish(context.Background(), &pb.Message{Topic: "foo", Qos: 3})
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &testStream{ctx: ctx, messages: make(chan *pb.Message, 10)}
+	done := make(chan error)
+
+	go func() {
+		done <- server.Subscribe(&pb.SubscribeRequest{Filters: []string{"#"}}, stream)
+	}()
+
+	assert.Equal(t, &pb.Message{Topic: "foo", Payload: []byte("foo"), Qos: 1, Retain: true}, <-stream.messages)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+
+	res, err := server.ListClients(context.Background(), &pb.ListClientsRequest{})
+	assert.NoError(t, err)
+	assert.Empty(t, res.Clients)
+
+	err = b.Close(time.Second)
+	assert.NoError(t, err)
+}
+
+func TestRegister(t *testing.T) {
+	server := grpc.NewServer()
+	Register(server, NewService(broker.New()))
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+)
+
+// A SCRAMCredential is the stored credential of a SCRAM-SHA-256 user. It is
+// derived from the password, which does not need to be stored.
+type SCRAMCredential struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewSCRAMCredential will derive the credential of the password using a
+// random salt. The iterations default to 4096.
+func NewSCRAMCredential(password string, iterations int) (*SCRAMCredential, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return DeriveSCRAMCredential(password, salt, iterations), nil
+}
+
+// DeriveSCRAMCredential will derive the credential of the password using the
+// specified salt. The iterations default to 4096.
+func DeriveSCRAMCredential(password string, salt []byte, iterations int) *SCRAMCredential {
+	if iterations <= 0 {
+		iterations = 4096
+	}
+
+	salted := pbkdf2([]byte(password), salt, iterations)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	return &SCRAMCredential{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(salted, "Server Key"),
+	}
+}
+
+// SCRAMCredentials are the stored SCRAM-SHA-256 credentials of users that
+// implement the PasswordChecker interface, so that credentials shared with
+// other SCRAM services can authenticate clients using their plain password.
+// The challenge exchange of SCRAM requires the AUTH packet of MQTT 5 and is
+// not supported.
+type SCRAMCredentials map[string]*SCRAMCredential
+
+// CheckPassword will derive the keys of the password using the salt and
+// iterations of the credential of the user and compare them to the stored
+// keys.
+func (c SCRAMCredentials) CheckPassword(user, password string) (known, valid bool) {
+	credential, ok := c[user]
+	if !ok || credential == nil {
+		return false, false
+	}
+
+	derived := DeriveSCRAMCredential(password, credential.Salt, credential.Iterations)
+
+	storedKey := subtle.ConstantTimeCompare(derived.StoredKey, credential.StoredKey)
+	serverKey := subtle.ConstantTimeCompare(derived.ServerKey, credential.ServerKey)
+
+	return true, storedKey&serverKey == 1
+}
+
+// returns the hmac of the message
+func scramHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// derives a single block key using pbkdf2 with hmac-sha256
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+
+	var block [4]byte
+	binary.BigEndian.PutUint32(block[:], 1)
+
+	mac.Write(salt)
+	mac.Write(block[:])
+	u := mac.Sum(nil)
+
+	key := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+
+	return key
+}
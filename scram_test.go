@@ -0,0 +1,67 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSCRAMCredential(t *testing.T) {
+	credential, err := NewSCRAMCredential("secret", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 4096, credential.Iterations)
+	assert.Len(t, credential.Salt, 16)
+	assert.Equal(t, credential, DeriveSCRAMCredential("secret", credential.Salt, 4096))
+
+	// the test vector of RFC 7677
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	credential = DeriveSCRAMCredential("pencil", salt, 4096)
+	assert.Equal(t, "WG5d8oPm3OtcPnkdi4Uo7BkeZkBFzpcXkuLmtbsT4qY=", base64.StdEncoding.EncodeToString(credential.StoredKey))
+	assert.Equal(t, "wfPLwcE6nTWhTAmQ7tl2KeoiWGPlZqQxSrmfPwDl2dU=", base64.StdEncoding.EncodeToString(credential.ServerKey))
+}
+
+func TestSCRAMCredentials(t *testing.T) {
+	credential, err := NewSCRAMCredential("secret", 0)
+	assert.NoError(t, err)
+
+	credentials := SCRAMCredentials{"user": credential}
+
+	known, valid := credentials.CheckPassword("user", "secret")
+	assert.True(t, known)
+	assert.True(t, valid)
+
+	known, valid = credentials.CheckPassword("user", "wrong")
+	assert.True(t, known)
+	assert.False(t, valid)
+
+	known, valid = credentials.CheckPassword("other", "secret")
+	assert.False(t, known)
+	assert.False(t, valid)
+
+	// the credentials are used by the backend
+	backend := NewMemoryBackend()
+	backend.Passwords = credentials
+
+	ok, err := backend.Authenticate(nil, "user", "secret")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = backend.Authenticate(nil, "user", "wrong")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
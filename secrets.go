@@ -0,0 +1,161 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"sync"
+	"time"
+)
+
+// A SecretProvider resolves secrets like passwords and keys from an external
+// store (e.g. Vault or AWS Secrets Manager).
+type SecretProvider interface {
+	// Secret should return the current value of the secret with the specified
+	// name, ErrSecretNotFound if the secret does not exist or another error if
+	// it cannot be retrieved.
+	Secret(name string) ([]byte, error)
+}
+
+// ErrSecretNotFound should be returned by a SecretProvider if the requested
+// secret does not exist.
+var ErrSecretNotFound = errors.New("secret not found")
+
+// StaticSecrets is a SecretProvider that serves secrets from memory.
+type StaticSecrets map[string][]byte
+
+// Secret will return the secret with the specified name.
+func (s StaticSecrets) Secret(name string) ([]byte, error) {
+	value, ok := s[name]
+	if !ok {
+		return nil, ErrSecretNotFound
+	}
+
+	return value, nil
+}
+
+// a cached secret value
+type cachedSecret struct {
+	value   []byte
+	fetched time.Time
+}
+
+// A SecretCache wraps another SecretProvider and caches the resolved secrets
+// for the configured TTL.
+type SecretCache struct {
+	// The wrapped provider.
+	Provider SecretProvider
+
+	// The duration a resolved secret is cached.
+	TTL time.Duration
+
+	// The OnRotate callback is called when a secret has been resolved again
+	// and its value has changed.
+	OnRotate func(name string)
+
+	secrets map[string]*cachedSecret
+	mutex   sync.Mutex
+}
+
+// NewSecretCache returns a new SecretCache that caches the secrets of the
+// specified provider for the specified TTL.
+func NewSecretCache(provider SecretProvider, ttl time.Duration) *SecretCache {
+	return &SecretCache{
+		Provider: provider,
+		TTL:      ttl,
+		secrets:  make(map[string]*cachedSecret),
+	}
+}
+
+// Secret will return the cached secret or resolve it using the wrapped
+// provider if it is missing or expired. If the secret cannot be resolved, a
+// previously cached value is returned until the provider recovers.
+func (c *SecretCache) Secret(name string) ([]byte, error) {
+	c.mutex.Lock()
+
+	// check cache
+	cached, ok := c.secrets[name]
+	if ok && time.Since(cached.fetched) < c.TTL {
+		c.mutex.Unlock()
+		return cached.value, nil
+	}
+
+	// resolve secret
+	value, err := c.Provider.Secret(name)
+	if err != nil {
+		c.mutex.Unlock()
+
+		if ok {
+			return cached.value, nil
+		}
+
+		return nil, err
+	}
+
+	// lazily allocate cache
+	if c.secrets == nil {
+		c.secrets = make(map[string]*cachedSecret)
+	}
+
+	// update cache
+	c.secrets[name] = &cachedSecret{
+		value:   value,
+		fetched: time.Now(),
+	}
+
+	c.mutex.Unlock()
+
+	// check rotation
+	if ok && !bytes.Equal(cached.value, value) && c.OnRotate != nil {
+		c.OnRotate(name)
+	}
+
+	return value, nil
+}
+
+// Invalidate will remove the secret with the specified name from the cache.
+func (c *SecretCache) Invalidate(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.secrets, name)
+}
+
+// SecretCertificate returns a callback for tls.Config.GetCertificate that
+// loads the PEM encoded certificate and key from the specified secrets. The
+// provider should be wrapped in a SecretCache as the callback is called for
+// every TLS handshake. Rotated certificates are picked up for new handshakes.
+func SecretCertificate(provider SecretProvider, certName, keyName string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		certPEM, err := provider.Secret(certName)
+		if err != nil {
+			return nil, err
+		}
+
+		keyPEM, err := provider.Secret(keyName)
+		if err != nil {
+			return nil, err
+		}
+
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+
+		return &cert, nil
+	}
+}
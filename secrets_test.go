@@ -0,0 +1,143 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretCache(t *testing.T) {
+	secrets := StaticSecrets{"foo": []byte("bar")}
+
+	var rotated []string
+
+	cache := NewSecretCache(secrets, time.Hour)
+	cache.OnRotate = func(name string) {
+		rotated = append(rotated, name)
+	}
+
+	value, err := cache.Secret("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), value)
+
+	// cached
+	secrets["foo"] = []byte("baz")
+
+	value, err = cache.Secret("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bar"), value)
+
+	// rotated
+	cache.TTL = 0
+
+	value, err = cache.Secret("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("baz"), value)
+	assert.Equal(t, []string{"foo"}, rotated)
+
+	// provider failure keeps cached value
+	delete(secrets, "foo")
+
+	value, err = cache.Secret("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("baz"), value)
+
+	// missing
+	cache.Invalidate("foo")
+
+	_, err = cache.Secret("foo")
+	assert.Error(t, err)
+}
+
+func TestMemoryBackendLoginSecrets(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.LoginSecrets = StaticSecrets{"allow": []byte("allow")}
+
+	ok, err := backend.Authenticate(newFakeClient(), "allow", "allow")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = backend.Authenticate(newFakeClient(), "allow", "deny")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = backend.Authenticate(newFakeClient(), "deny", "deny")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// provider failure
+	backend.LoginSecrets = failingSecrets{}
+
+	ok, err = backend.Authenticate(newFakeClient(), "allow", "allow")
+	assert.Error(t, err)
+	assert.False(t, ok)
+}
+
+// a secret provider that is unavailable
+type failingSecrets struct{}
+
+func (failingSecrets) Secret(name string) ([]byte, error) {
+	return nil, errors.New("unavailable")
+}
+
+// a password checker with plain passwords that counts the reloads
+type fakePasswords struct {
+	passwords map[string]string
+	reloads   int
+}
+
+func (p *fakePasswords) CheckPassword(user, password string) (bool, bool) {
+	pw, ok := p.passwords[user]
+	return ok, ok && pw == password
+}
+
+func (p *fakePasswords) Reload() error {
+	p.reloads++
+	return nil
+}
+
+func TestMemoryBackendPasswords(t *testing.T) {
+	passwords := &fakePasswords{passwords: map[string]string{"hashed": "hashed"}}
+
+	backend := NewMemoryBackend()
+	backend.Logins = map[string]string{"allow": "allow"}
+	backend.Passwords = passwords
+	backend.LoginSecrets = StaticSecrets{"secret": []byte("secret")}
+
+	for user, password := range map[string]string{"allow": "allow", "hashed": "hashed", "secret": "secret"} {
+		ok, err := backend.Authenticate(newFakeClient(), user, password)
+		assert.NoError(t, err)
+		assert.True(t, ok, user)
+
+		ok, err = backend.Authenticate(newFakeClient(), user, "deny")
+		assert.NoError(t, err)
+		assert.False(t, ok, user)
+	}
+
+	ok, err := backend.Authenticate(newFakeClient(), "deny", "deny")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// the checker is reloaded with the backend and the wrapping backends
+	broker := New()
+	broker.Backend = NewHTTPAuthBackend(backend, "", "")
+
+	assert.NoError(t, broker.ReloadConfig())
+	assert.Equal(t, 1, passwords.reloads)
+}
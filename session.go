@@ -16,6 +16,7 @@ package broker
 
 import (
 	"sync"
+	"time"
 
 	"github.com/gomqtt/packet"
 	"github.com/gomqtt/tools"
@@ -76,25 +77,75 @@ type Session interface {
 	Reset() error
 }
 
+// A ReleaseSession is a Session that stores the pubrel stage of outgoing QOS 2
+// flows separately from the general packet storage. The broker uses it to
+// record a received PUBREC instead of overwriting the stored PublishPacket
+// using SavePacket, which allows implementations to update the stage in place.
+type ReleaseSession interface {
+	// ReleasePacket should atomically replace the stored outgoing
+	// PublishPacket with the specified id by a PubrelPacket and return
+	// whether a packet with the id is stored. A stored PubrelPacket should
+	// be left untouched. The PubrelPacket should be returned by LookupPacket
+	// and AllPackets until it is deleted, so that it is resent when the
+	// session is resumed.
+	ReleasePacket(id uint16) (bool, error)
+}
+
+// An IdentifierSession is a Session that stores the MQTT 5 subscription
+// identifiers of its subscriptions (see SubscriptionIdentifiersAnnotation).
+type IdentifierSession interface {
+	// SaveIdentifier should store the identifier of the subscription with the
+	// specified topic. A zero identifier should remove a stored identifier.
+	// Identifiers should be removed with their subscription.
+	SaveIdentifier(topic string, id uint32) error
+
+	// MatchIdentifiers should return the identifiers of all stored
+	// subscriptions that match the topic.
+	MatchIdentifiers(topic string) ([]uint32, error)
+}
+
 // A MemorySession stores packets, subscriptions and the will in memory.
 type MemorySession struct {
-	counter       *tools.Counter
+	counter       Sequence
 	store         *tools.Store
 	subscriptions *tools.Tree
+	identifiers   *tools.Tree
 	offlineStore  *tools.Queue
+	releaseMutex  sync.Mutex
+
+	lookups      map[string]*packet.Subscription
+	generation   uint64
+	lookupsMutex sync.RWMutex
+
+	deadlines      map[*packet.Message]time.Time
+	pruneAt        int
+	deadlinesMutex sync.Mutex
 
 	will      *packet.Message
 	willMutex sync.Mutex
 
 	currentClient Client
+	expiresAt     time.Time
+	namespace     string
+	key           string
+
+	file      *FileSession
+	fileMutex sync.RWMutex
 }
 
 // NewMemorySession returns a new MemorySession.
 func NewMemorySession() *MemorySession {
+	return NewMemorySessionWithSequence(tools.NewCounter())
+}
+
+// NewMemorySessionWithSequence returns a new MemorySession that uses the
+// sequence to generate packet ids.
+func NewMemorySessionWithSequence(sequence Sequence) *MemorySession {
 	return &MemorySession{
-		counter:       tools.NewCounter(),
+		counter:       sequence,
 		store:         tools.NewStore(),
 		subscriptions: tools.NewTree(),
+		identifiers:   tools.NewTree(),
 		offlineStore:  tools.NewQueue(100),
 	}
 }
@@ -108,9 +159,35 @@ func (s *MemorySession) PacketID() uint16 {
 // packet with the same id gets quietly overwritten.
 func (s *MemorySession) SavePacket(direction string, pkt packet.Packet) error {
 	s.store.Save(direction, pkt)
+
+	if file := s.persisted(); file != nil {
+		return file.SavePacket(direction, pkt)
+	}
+
 	return nil
 }
 
+// ReleasePacket will replace the stored outgoing PublishPacket with the
+// specified id by a PubrelPacket.
+func (s *MemorySession) ReleasePacket(id uint16) (bool, error) {
+	s.releaseMutex.Lock()
+	defer s.releaseMutex.Unlock()
+
+	pubrel, ok := releasedPacket(s.store.Lookup(outgoing, id))
+	if !ok || pubrel == nil {
+		return ok, nil
+	}
+
+	s.store.Save(outgoing, pubrel)
+
+	if file := s.persisted(); file != nil {
+		_, err := file.ReleasePacket(id)
+		return true, err
+	}
+
+	return true, nil
+}
+
 // LookupPacket will retrieve a packet from the session using a packet id.
 func (s *MemorySession) LookupPacket(direction string, id uint16) (packet.Packet, error) {
 	return s.store.Lookup(direction, id), nil
@@ -120,6 +197,11 @@ func (s *MemorySession) LookupPacket(direction string, id uint16) (packet.Packet
 // return an error if no packet with the specified id exists.
 func (s *MemorySession) DeletePacket(direction string, id uint16) error {
 	s.store.Delete(direction, id)
+
+	if file := s.persisted(); file != nil {
+		return file.DeletePacket(direction, id)
+	}
+
 	return nil
 }
 
@@ -132,21 +214,57 @@ func (s *MemorySession) AllPackets(direction string) ([]packet.Packet, error) {
 // subscription with the same topic gets quietly overwritten.
 func (s *MemorySession) SaveSubscription(sub *packet.Subscription) error {
 	s.subscriptions.Set(sub.Topic, sub)
+	s.invalidate()
+
+	if file := s.persisted(); file != nil {
+		return file.SaveSubscription(sub)
+	}
+
 	return nil
 }
 
 // LookupSubscription will match a topic against the stored subscriptions and
-// eventually return the first found subscription.
+// eventually return the first found subscription. The results are cached
+// until the subscriptions change, as every delivered message is looked up.
 func (s *MemorySession) LookupSubscription(topic string) (*packet.Subscription, error) {
-	values := s.subscriptions.Match(topic)
+	// check cache
+	s.lookupsMutex.RLock()
+	sub, ok := s.lookups[topic]
+	generation := s.generation
+	s.lookupsMutex.RUnlock()
+	if ok {
+		return sub, nil
+	}
 
+	sub = nil
+	values := s.subscriptions.Match(topic)
 	if len(values) > 0 {
-		if sub, ok := values[0].(*packet.Subscription); ok {
-			return sub, nil
+		sub, _ = values[0].(*packet.Subscription)
+	}
+
+	// cache result if the subscriptions did not change in the meantime
+	s.lookupsMutex.Lock()
+	if s.generation == generation {
+		if s.lookups == nil || len(s.lookups) >= maxCachedLookups {
+			s.lookups = make(map[string]*packet.Subscription)
 		}
+
+		s.lookups[topic] = sub
 	}
+	s.lookupsMutex.Unlock()
 
-	return nil, nil
+	return sub, nil
+}
+
+// the maximum number of cached subscription lookups per session
+const maxCachedLookups = 1024
+
+// clears the cached subscription lookups
+func (s *MemorySession) invalidate() {
+	s.lookupsMutex.Lock()
+	s.lookups = nil
+	s.generation++
+	s.lookupsMutex.Unlock()
 }
 
 // DeleteSubscription will remove the subscription from the session. The
@@ -154,6 +272,13 @@ func (s *MemorySession) LookupSubscription(topic string) (*packet.Subscription,
 // topic does exist.
 func (s *MemorySession) DeleteSubscription(topic string) error {
 	s.subscriptions.Empty(topic)
+	s.identifiers.Empty(topic)
+	s.invalidate()
+
+	if file := s.persisted(); file != nil {
+		return file.DeleteSubscription(topic)
+	}
+
 	return nil
 }
 
@@ -170,6 +295,32 @@ func (s *MemorySession) AllSubscriptions() ([]*packet.Subscription, error) {
 	return all, nil
 }
 
+// SaveIdentifier will store the identifier of the subscription with the
+// specified topic or remove it if the identifier is zero.
+func (s *MemorySession) SaveIdentifier(topic string, id uint32) error {
+	if id == 0 {
+		s.identifiers.Empty(topic)
+	} else {
+		s.identifiers.Set(topic, id)
+	}
+
+	return nil
+}
+
+// MatchIdentifiers will return the identifiers of all stored subscriptions
+// that match the topic.
+func (s *MemorySession) MatchIdentifiers(topic string) ([]uint32, error) {
+	var ids []uint32
+
+	for _, value := range s.identifiers.Match(topic) {
+		if id, ok := value.(uint32); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
 // SaveWill will store the will message.
 func (s *MemorySession) SaveWill(newWill *packet.Message) error {
 	s.willMutex.Lock()
@@ -177,6 +328,10 @@ func (s *MemorySession) SaveWill(newWill *packet.Message) error {
 
 	s.will = newWill
 
+	if file := s.persisted(); file != nil {
+		return file.SaveWill(newWill)
+	}
+
 	return nil
 }
 
@@ -195,6 +350,10 @@ func (s *MemorySession) ClearWill() error {
 
 	s.will = nil
 
+	if file := s.persisted(); file != nil {
+		return file.ClearWill()
+	}
+
 	return nil
 }
 
@@ -203,17 +362,150 @@ func (s *MemorySession) Reset() error {
 	s.counter.Reset()
 	s.store.Reset()
 	s.subscriptions.Reset()
-	s.ClearWill()
+	s.identifiers.Reset()
+	s.invalidate()
+
+	s.willMutex.Lock()
+	s.will = nil
+	s.willMutex.Unlock()
+
+	if file := s.persisted(); file != nil {
+		return file.Reset()
+	}
 
 	return nil
 }
 
-// called by the backend to queue an offline message
-func (s *MemorySession) queue(msg *packet.Message) {
+// returns the file the session is persisted to, if any
+func (s *MemorySession) persisted() *FileSession {
+	s.fileMutex.RLock()
+	defer s.fileMutex.RUnlock()
+
+	return s.file
+}
+
+// sets or removes the file the session is persisted to and returns the
+// previous file
+func (s *MemorySession) persist(file *FileSession) *FileSession {
+	s.fileMutex.Lock()
+	defer s.fileMutex.Unlock()
+
+	previous := s.file
+	s.file = file
+
+	return previous
+}
+
+// returns the PubrelPacket that replaces a stored PublishPacket, a nil packet
+// if the stored packet already is a PubrelPacket and false if no packet is
+// stored
+func releasedPacket(stored packet.Packet) (*packet.PubrelPacket, bool) {
+	switch p := stored.(type) {
+	case *packet.PublishPacket:
+		pubrel := packet.NewPubrelPacket()
+		pubrel.PacketID = p.PacketID
+		return pubrel, true
+	case *packet.PubrelPacket:
+		return nil, true
+	}
+
+	return nil, false
+}
+
+// called by the backend to queue an offline message that expires at the
+// deadline unless it is zero
+func (s *MemorySession) queue(msg *packet.Message, deadline time.Time) {
 	s.offlineStore.Push(msg)
+
+	// the message is kept in memory if it cannot be persisted
+	if file := s.persisted(); file != nil {
+		file.queue(msg, deadline)
+	}
+
+	if deadline.IsZero() {
+		return
+	}
+
+	s.deadlinesMutex.Lock()
+	defer s.deadlinesMutex.Unlock()
+
+	// lazily allocate deadlines
+	if s.deadlines == nil {
+		s.deadlines = make(map[*packet.Message]time.Time)
+	}
+
+	s.deadlines[msg] = deadline
+
+	// forget expired messages, which includes messages dropped by the
+	// full queue
+	if len(s.deadlines) > s.pruneAt {
+		now := time.Now()
+		for msg, deadline := range s.deadlines {
+			if !now.Before(deadline) {
+				delete(s.deadlines, msg)
+			}
+		}
+
+		s.pruneAt = 2 * len(s.deadlines)
+		if s.pruneAt < 256 {
+			s.pruneAt = 256
+		}
+	}
 }
 
-// called by the backend to retrieve all offline messsges
+// removes the expired messages and returns the remaining messages along with
+// their deadlines, which are forgotten if drain is true
+func (s *MemorySession) unexpired(msgs []*packet.Message, now time.Time, drain bool) ([]*packet.Message, []time.Time) {
+	s.deadlinesMutex.Lock()
+	defer s.deadlinesMutex.Unlock()
+
+	var kept []*packet.Message
+	var deadlines []time.Time
+	for _, msg := range msgs {
+		deadline := s.deadlines[msg]
+		if !deadline.IsZero() && !now.Before(deadline) {
+			continue
+		}
+
+		kept = append(kept, msg)
+		deadlines = append(deadlines, deadline)
+	}
+
+	if drain {
+		s.deadlines = nil
+	}
+
+	return kept, deadlines
+}
+
+// called by the backend to check if the session has expired
+func (s *MemorySession) expired(now time.Time) bool {
+	return s.currentClient == nil && !s.expiresAt.IsZero() && now.After(s.expiresAt)
+}
+
+// called by the backend to list the unexpired offline messages along with
+// the times they expire without removing them
+func (s *MemorySession) queued() ([]*packet.Message, []time.Time) {
+	msgs := s.offlineStore.All()
+	for _, msg := range msgs {
+		s.offlineStore.Push(msg)
+	}
+
+	return s.unexpired(msgs, time.Now(), false)
+}
+
+// called by the backend to retrieve all unexpired offline messsges
 func (s *MemorySession) missed() []*packet.Message {
-	return s.offlineStore.All()
+	msgs, _ := s.missedUntil(time.Now())
+	return msgs
+}
+
+// called by the backend to retrieve all unexpired offline messages along with
+// the times they expire
+func (s *MemorySession) missedUntil(now time.Time) ([]*packet.Message, []time.Time) {
+	if file := s.persisted(); file != nil {
+		file.missed()
+	}
+
+	return s.unexpired(s.offlineStore.All(), now, true)
 }
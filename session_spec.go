@@ -36,6 +36,11 @@ func SessionSpec(t *testing.T, builder func() Session) {
 
 	t.Log("Running Will Store Test")
 	sessionWillStoreTest(t, builder())
+
+	if _, ok := builder().(ReleaseSession); ok {
+		t.Log("Running Optional Release Test")
+		sessionReleaseTest(t, builder())
+	}
 }
 
 func sessionPacketIDTest(t *testing.T, session Session) {
@@ -181,3 +186,44 @@ func sessionWillStoreTest(t *testing.T, session Session) {
 	assert.Nil(t, will)
 	assert.NoError(t, err)
 }
+
+func sessionReleaseTest(t *testing.T, session Session) {
+	store := session.(ReleaseSession)
+
+	ok, err := store.ReleasePacket(1)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	publish := packet.NewPublishPacket()
+	publish.PacketID = 1
+	publish.Message.Topic = "test"
+	publish.Message.QOS = 2
+
+	err = session.SavePacket(outgoing, publish)
+	assert.NoError(t, err)
+
+	pubrel := packet.NewPubrelPacket()
+	pubrel.PacketID = 1
+
+	// the pubrel stage replaces the publish packet
+	for i := 0; i < 2; i++ {
+		ok, err = store.ReleasePacket(1)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		pkt, err := session.LookupPacket(outgoing, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, pubrel, pkt)
+
+		pkts, err := session.AllPackets(outgoing)
+		assert.NoError(t, err)
+		assert.Equal(t, []packet.Packet{pubrel}, pkts)
+	}
+
+	err = session.DeletePacket(outgoing, 1)
+	assert.NoError(t, err)
+
+	ok, err = store.ReleasePacket(1)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
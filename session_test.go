@@ -14,10 +14,331 @@
 
 package broker
 
-import "testing"
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
 
 func TestMemorySession(t *testing.T) {
 	SessionSpec(t, func() Session {
 		return NewMemorySession()
 	})
 }
+
+func TestMemorySessionIdentifiers(t *testing.T) {
+	session := NewMemorySession()
+
+	assert.NoError(t, session.SaveSubscription(&packet.Subscription{Topic: "foo/#"}))
+	assert.NoError(t, session.SaveIdentifier("foo/#", 1))
+	assert.NoError(t, session.SaveSubscription(&packet.Subscription{Topic: "foo/+"}))
+	assert.NoError(t, session.SaveIdentifier("foo/+", 2))
+	assert.NoError(t, session.SaveSubscription(&packet.Subscription{Topic: "bar"}))
+	assert.NoError(t, session.SaveIdentifier("bar", 0))
+
+	ids, err := session.MatchIdentifiers("foo/bar")
+	assert.NoError(t, err)
+	assert.Len(t, ids, 2)
+	assert.Contains(t, ids, uint32(1))
+	assert.Contains(t, ids, uint32(2))
+
+	ids, err = session.MatchIdentifiers("bar")
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+
+	// identifiers are removed with their subscription
+	assert.NoError(t, session.DeleteSubscription("foo/+"))
+
+	ids, err = session.MatchIdentifiers("foo/bar")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{1}, ids)
+
+	assert.NoError(t, session.Reset())
+
+	ids, err = session.MatchIdentifiers("foo/bar")
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+}
+
+func TestMemorySessionLookupCache(t *testing.T) {
+	session := NewMemorySession()
+
+	sub, err := session.LookupSubscription("foo/bar")
+	assert.NoError(t, err)
+	assert.Nil(t, sub)
+
+	// cached lookups are invalidated by changes
+	subscription := &packet.Subscription{Topic: "foo/#", QOS: 1}
+	assert.NoError(t, session.SaveSubscription(subscription))
+
+	sub, err = session.LookupSubscription("foo/bar")
+	assert.NoError(t, err)
+	assert.Equal(t, subscription, sub)
+
+	assert.NoError(t, session.DeleteSubscription("foo/#"))
+
+	sub, err = session.LookupSubscription("foo/bar")
+	assert.NoError(t, err)
+	assert.Nil(t, sub)
+
+	assert.NoError(t, session.SaveSubscription(subscription))
+	assert.NoError(t, session.Reset())
+
+	sub, err = session.LookupSubscription("foo/bar")
+	assert.NoError(t, err)
+	assert.Nil(t, sub)
+}
+
+func TestFileSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-broker")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	i := 0
+
+	SessionSpec(t, func() Session {
+		i++
+
+		session, err := OpenFileSession(filepath.Join(dir, strconv.Itoa(i)))
+		assert.NoError(t, err)
+
+		return session
+	})
+}
+
+func TestFileSessionRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-broker")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "session")
+
+	session1, err := OpenFileSession(path)
+	assert.NoError(t, err)
+
+	publish := packet.NewPublishPacket()
+	publish.PacketID = session1.PacketID()
+	publish.Message = packet.Message{Topic: "test", Payload: []byte("test"), QOS: 1}
+
+	pubrel := packet.NewPubrelPacket()
+	pubrel.PacketID = session1.PacketID()
+
+	subscription := &packet.Subscription{Topic: "test", QOS: 2}
+	will := &packet.Message{Topic: "will", Payload: []byte("will")}
+	missed := &packet.Message{Topic: "test", Payload: []byte("missed"), QOS: 1}
+
+	assert.NoError(t, session1.SavePacket(outgoing, publish))
+	assert.NoError(t, session1.SavePacket(incoming, pubrel))
+	assert.NoError(t, session1.SaveSubscription(subscription))
+	assert.NoError(t, session1.SaveWill(will))
+	deadline := time.Now().Add(time.Hour).Round(0)
+	assert.NoError(t, session1.queue(missed, deadline))
+	assert.NoError(t, session1.describe("tenant/", deadline))
+
+	session2, err := OpenFileSession(path)
+	assert.NoError(t, err)
+
+	pkt, err := session2.LookupPacket(outgoing, publish.PacketID)
+	assert.NoError(t, err)
+	assert.Equal(t, publish, pkt)
+
+	pkt, err = session2.LookupPacket(incoming, pubrel.PacketID)
+	assert.NoError(t, err)
+	assert.Equal(t, pubrel, pkt)
+
+	sub, err := session2.LookupSubscription("test")
+	assert.NoError(t, err)
+	assert.Equal(t, subscription, sub)
+
+	msg, err := session2.LookupWill()
+	assert.NoError(t, err)
+	assert.Equal(t, will, msg)
+
+	msgs, deadlines, err := session2.missed()
+	assert.NoError(t, err)
+	assert.Equal(t, []*packet.Message{missed}, msgs)
+	assert.True(t, deadline.Equal(deadlines[0]))
+	assert.Equal(t, "tenant/", session2.namespace)
+	assert.True(t, deadline.Equal(session2.expiresAt))
+
+	assert.Equal(t, uint16(3), session2.PacketID())
+}
+
+func TestFileSessionTornChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-broker")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "session")
+
+	session1, err := OpenFileSession(path)
+	assert.NoError(t, err)
+	assert.NoError(t, session1.SaveSubscription(&packet.Subscription{Topic: "foo", QOS: 1}))
+	assert.NoError(t, session1.SaveSubscription(&packet.Subscription{Topic: "bar", QOS: 1}))
+	assert.NoError(t, session1.DeleteSubscription("foo"))
+
+	// simulate a crash while appending a change
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	_, err = file.Write([]byte(`{"op":"subscribe","subscription":{"top`))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	session2, err := OpenFileSession(path)
+	assert.NoError(t, err)
+
+	subs, err := session2.AllSubscriptions()
+	assert.NoError(t, err)
+	assert.Equal(t, []*packet.Subscription{{Topic: "bar", QOS: 1}}, subs)
+
+	// changes after the torn change survive
+	assert.NoError(t, session2.SaveWill(&packet.Message{Topic: "will", Payload: []byte("will")}))
+
+	session3, err := OpenFileSession(path)
+	assert.NoError(t, err)
+
+	will, err := session3.LookupWill()
+	assert.NoError(t, err)
+	assert.Equal(t, &packet.Message{Topic: "will", Payload: []byte("will")}, will)
+}
+
+func TestMemoryBackendSessionPath(t *testing.T) {
+	var dir string
+
+	RestartSpec(t, func(previous *Broker) *Broker {
+		// every test starts with an empty directory
+		if previous == nil {
+			var err error
+			dir, err = ioutil.TempDir("", "gomqtt-broker")
+			assert.NoError(t, err)
+		}
+
+		backend := NewMemoryBackend()
+		backend.SessionPath = dir
+
+		broker := New()
+		broker.Backend = backend
+
+		return broker
+	})
+
+	os.RemoveAll(dir)
+}
+
+func TestMemoryBackendSessionPathCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-broker")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	backend1 := NewMemoryBackend()
+	backend1.SessionPath = dir
+	assert.NoError(t, backend1.Start(nil))
+
+	for _, id := range []string{"good", "bad"} {
+		client := newFakeClient()
+		client.Context().Set("session_expiry", time.Hour)
+
+		session, _, err := backend1.Setup(client, id, false)
+		assert.NoError(t, err)
+		assert.NoError(t, session.SaveSubscription(&packet.Subscription{Topic: id, QOS: 1}))
+		assert.NoError(t, backend1.Terminate(client))
+	}
+
+	assert.NoError(t, backend1.Stop())
+
+	// truncate the snapshot of one of the files
+	path := backend1.sessionFile("bad")
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, data[:bytes.IndexByte(data, '\n')/2], 0600))
+
+	backend2 := NewMemoryBackend()
+	backend2.SessionPath = dir
+	assert.NoError(t, backend2.Start(nil))
+
+	backend2.sessionsMutex.Lock()
+	assert.Len(t, backend2.sessions, 1)
+	assert.NotNil(t, backend2.sessions["good"])
+	backend2.sessionsMutex.Unlock()
+
+	// the corrupt file is kept aside
+	_, err = os.Stat(path + ".corrupt")
+	assert.NoError(t, err)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, backend2.Stop())
+}
+
+func TestMemoryBackendSessionPathOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-broker")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	backend1 := NewMemoryBackend()
+	backend1.SessionPath = dir
+	assert.NoError(t, backend1.Start(nil))
+
+	subscriber := newFakeClient()
+	subscriber.Context().Set("session_expiry", time.Hour)
+
+	session, resumed, err := backend1.Setup(subscriber, "subscriber", false)
+	assert.NoError(t, err)
+	assert.False(t, resumed)
+	assert.NoError(t, session.SaveSubscription(&packet.Subscription{Topic: "test", QOS: 1}))
+	assert.NoError(t, backend1.Terminate(subscriber))
+
+	msg := &packet.Message{Topic: "test", Payload: []byte("test"), QOS: 1}
+	assert.NoError(t, backend1.Publish(newFakeClient(), msg))
+	assert.NoError(t, backend1.Stop())
+
+	// clean sessions are not persisted
+	clean := newFakeClient()
+	_, _, err = backend1.Setup(clean, "clean", true)
+	assert.NoError(t, err)
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	// the restarted backend queues the message of the offline session
+
+	backend2 := NewMemoryBackend()
+	backend2.SessionPath = dir
+	assert.NoError(t, backend2.Start(nil))
+
+	other := &packet.Message{Topic: "test", Payload: []byte("other"), QOS: 1}
+	assert.NoError(t, backend2.Publish(newFakeClient(), other))
+
+	subscriber = newFakeClient()
+	session, resumed, err = backend2.Setup(subscriber, "subscriber", false)
+	assert.NoError(t, err)
+	assert.True(t, resumed)
+
+	subs, err := session.AllSubscriptions()
+	assert.NoError(t, err)
+	assert.Equal(t, []*packet.Subscription{{Topic: "test", QOS: 1}}, subs)
+
+	for i := 0; i < 100 && len(subscriber.received()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, []*packet.Message{msg, other}, subscriber.received())
+
+	// removed sessions are deleted
+
+	assert.NoError(t, backend2.Terminate(subscriber))
+	assert.NoError(t, backend2.EraseClient("subscriber"))
+
+	files, err = ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 0)
+
+	assert.NoError(t, backend2.Stop())
+}
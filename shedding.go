@@ -0,0 +1,273 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// A TopicClass describes how the messages of a topic are treated under
+// overload (see LoadShedding).
+type TopicClass int
+
+const (
+	// NormalClass messages are shed once the broker is severely overloaded.
+	NormalClass TopicClass = iota
+
+	// CriticalClass messages are never shed.
+	CriticalClass
+
+	// BulkClass messages are shed first once the broker is overloaded.
+	BulkClass
+)
+
+// A TopicClassRule assigns a class to the topics matching the filter.
+type TopicClassRule struct {
+	Filter string
+	Class  TopicClass
+}
+
+// A ShedLevel describes which traffic is currently shed.
+type ShedLevel int
+
+const (
+	// ShedNone sheds no traffic.
+	ShedNone ShedLevel = iota
+
+	// ShedBulk sheds BulkClass traffic.
+	ShedBulk
+
+	// ShedNormal sheds BulkClass and NormalClass traffic.
+	ShedNormal
+)
+
+// String returns the name of the level.
+func (l ShedLevel) String() string {
+	switch l {
+	case ShedBulk:
+		return "bulk"
+	case ShedNormal:
+		return "normal"
+	default:
+		return "none"
+	}
+}
+
+// LoadShedding configures the shedding of incoming publishes while the broker
+// is overloaded. The pressure is the fill level of the outgoing buffers of
+// all clients or the value of the Load callback, whichever is higher. Once
+// the pressure reaches the BulkThreshold, QOS 0 messages of the BulkClass are
+// dropped and QOS 1 and 2 messages of the BulkClass are deferred by the
+// DeferDelay before they are acknowledged, which holds back their
+// publishers. Once the pressure reaches the NormalThreshold, the NormalClass
+// is shed as well. Messages of the CriticalClass are never shed. Every change
+// of the level is emitted as a SheddingChanged event.
+type LoadShedding struct {
+	// The rules that classify topics. The first matching rule applies and
+	// topics that match no rule belong to the NormalClass.
+	Classes []TopicClassRule
+
+	// The Load callback may return an additional measure of the load
+	// between zero and one, e.g. the CPU utilization.
+	Load func() float64
+
+	// The pressures at which the bulk and the normal traffic is shed.
+	BulkThreshold   float64
+	NormalThreshold float64
+
+	// The delay of deferred QOS 1 and 2 messages.
+	DeferDelay time.Duration
+
+	// The interval after which the pressure is measured again.
+	Interval time.Duration
+}
+
+// NewLoadShedding returns a LoadShedding with default thresholds that
+// classifies topics using the rules.
+func NewLoadShedding(classes ...TopicClassRule) *LoadShedding {
+	return &LoadShedding{
+		Classes:         classes,
+		BulkThreshold:   0.7,
+		NormalThreshold: 0.9,
+		DeferDelay:      100 * time.Millisecond,
+		Interval:        time.Second,
+	}
+}
+
+// Classify will return the class of the topic.
+func (s *LoadShedding) Classify(topic string) TopicClass {
+	for _, rule := range s.Classes {
+		if matchFilter(rule.Filter, topic) {
+			return rule.Class
+		}
+	}
+
+	return NormalClass
+}
+
+// A SheddingStatus describes the current shedding decision.
+type SheddingStatus struct {
+	// The current and the previous level and the last measured pressure.
+	Level    ShedLevel
+	Previous ShedLevel
+	Pressure float64
+
+	// The number of messages dropped and deferred since the level has been
+	// entered.
+	Dropped  int64
+	Deferred int64
+
+	// The time the level has been entered.
+	Since time.Time
+}
+
+// the state of the load shedding
+type shedder struct {
+	status  SheddingStatus
+	checked time.Time
+	mutex   sync.Mutex
+}
+
+// Shedding returns the current shedding status.
+func (b *Broker) Shedding() SheddingStatus {
+	if b.LoadShedding == nil {
+		return SheddingStatus{}
+	}
+
+	b.shedLevel()
+
+	b.shedder.mutex.Lock()
+	defer b.shedder.mutex.Unlock()
+
+	return b.shedder.status
+}
+
+// returns the current level and measures the pressure again if the interval
+// has elapsed
+func (b *Broker) shedLevel() ShedLevel {
+	s := b.LoadShedding
+
+	b.shedder.mutex.Lock()
+
+	now := time.Now()
+	if now.Sub(b.shedder.checked) < s.Interval {
+		level := b.shedder.status.Level
+		b.shedder.mutex.Unlock()
+		return level
+	}
+
+	b.shedder.checked = now
+
+	// get level
+	pressure := b.pressure()
+	level := ShedNone
+	if pressure >= s.NormalThreshold {
+		level = ShedNormal
+	} else if pressure >= s.BulkThreshold {
+		level = ShedBulk
+	}
+
+	// keep level
+	if level == b.shedder.status.Level {
+		b.shedder.status.Pressure = pressure
+		b.shedder.mutex.Unlock()
+		return level
+	}
+
+	previous := b.shedder.status
+	b.shedder.status = SheddingStatus{
+		Level:    level,
+		Previous: previous.Level,
+		Pressure: pressure,
+		Since:    now,
+	}
+	status := b.shedder.status
+
+	b.shedder.mutex.Unlock()
+
+	b.log(LogWarn, "shedding_changed", map[string]interface{}{
+		"level":    level.String(),
+		"previous": previous.Level.String(),
+		"pressure": pressure,
+		"dropped":  previous.Dropped,
+		"deferred": previous.Deferred,
+	})
+
+	b.emit(&Event{
+		Type:     SheddingChanged,
+		Shedding: status,
+	})
+
+	return level
+}
+
+// returns the fill level of all outgoing buffers or the reported load
+func (b *Broker) pressure() float64 {
+	var buffered, capacity int
+
+	b.clientsMutex.Lock()
+	for _, client := range b.clients {
+		buffered += len(client.out)
+		capacity += cap(client.out)
+	}
+	b.clientsMutex.Unlock()
+
+	var pressure float64
+	if capacity > 0 {
+		pressure = float64(buffered) / float64(capacity)
+	}
+
+	if b.LoadShedding.Load != nil {
+		pressure = math.Max(pressure, b.LoadShedding.Load())
+	}
+
+	return pressure
+}
+
+// returns whether the incoming message should be dropped or deferred
+func (b *Broker) shed(topic string, qos byte) (drop bool, deferred bool) {
+	level := b.shedLevel()
+	if level == ShedNone {
+		return false, false
+	}
+
+	// check class
+	switch b.LoadShedding.Classify(topic) {
+	case CriticalClass:
+		return false, false
+	case NormalClass:
+		if level < ShedNormal {
+			return false, false
+		}
+	}
+
+	b.shedder.mutex.Lock()
+	if qos == 0 {
+		b.shedder.status.Dropped++
+	} else {
+		b.shedder.status.Deferred++
+	}
+	b.shedder.mutex.Unlock()
+
+	if qos == 0 {
+		b.count(&b.counters.ShedMessages)
+	} else {
+		b.count(&b.counters.DeferredPublishes)
+	}
+
+	return qos == 0, qos > 0
+}
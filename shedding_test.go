@@ -0,0 +1,161 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadSheddingClassify(t *testing.T) {
+	shedding := NewLoadShedding(
+		TopicClassRule{Filter: "alarms/#", Class: CriticalClass},
+		TopicClassRule{Filter: "logs/+", Class: BulkClass},
+	)
+
+	assert.Equal(t, CriticalClass, shedding.Classify("alarms/fire"))
+	assert.Equal(t, BulkClass, shedding.Classify("logs/app"))
+	assert.Equal(t, NormalClass, shedding.Classify("logs/app/debug"))
+	assert.Equal(t, NormalClass, shedding.Classify("sensors/1"))
+}
+
+func TestLoadSheddingLevels(t *testing.T) {
+	load := 0.0
+
+	broker := New()
+	broker.LoadShedding = NewLoadShedding(
+		TopicClassRule{Filter: "critical", Class: CriticalClass},
+		TopicClassRule{Filter: "bulk", Class: BulkClass},
+	)
+	broker.LoadShedding.Load = func() float64 {
+		return load
+	}
+	broker.LoadShedding.Interval = 0
+
+	var events []SheddingStatus
+	broker.OnEvent(func(event *Event) {
+		if event.Type == SheddingChanged {
+			events = append(events, event.Shedding)
+		}
+	})
+
+	drop, deferred := broker.shed("bulk", 0)
+	assert.False(t, drop)
+	assert.False(t, deferred)
+
+	// overloaded
+	load = 0.8
+
+	drop, deferred = broker.shed("bulk", 0)
+	assert.True(t, drop)
+	assert.False(t, deferred)
+
+	drop, deferred = broker.shed("bulk", 1)
+	assert.False(t, drop)
+	assert.True(t, deferred)
+
+	drop, deferred = broker.shed("normal", 0)
+	assert.False(t, drop)
+	assert.False(t, deferred)
+
+	// severely overloaded
+	load = 0.95
+
+	drop, deferred = broker.shed("normal", 0)
+	assert.True(t, drop)
+	assert.False(t, deferred)
+
+	drop, deferred = broker.shed("critical", 0)
+	assert.False(t, drop)
+	assert.False(t, deferred)
+
+	status := broker.Shedding()
+	assert.Equal(t, ShedNormal, status.Level)
+	assert.Equal(t, ShedBulk, status.Previous)
+	assert.Equal(t, int64(1), status.Dropped)
+
+	// recovered
+	load = 0
+
+	drop, deferred = broker.shed("bulk", 0)
+	assert.False(t, drop)
+	assert.False(t, deferred)
+
+	assert.Len(t, events, 3)
+	assert.Equal(t, ShedBulk, events[0].Level)
+	assert.Equal(t, ShedNormal, events[1].Level)
+	assert.Equal(t, ShedNone, events[2].Level)
+	assert.Equal(t, ShedNormal, events[2].Previous)
+
+	counters := broker.Counters()
+	assert.Equal(t, int64(2), counters.ShedMessages)
+	assert.Equal(t, int64(1), counters.DeferredPublishes)
+}
+
+func TestLoadShedding(t *testing.T) {
+	connect := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "#"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	bulk := packet.NewPublishPacket()
+	bulk.Message.Topic = "bulk"
+	bulk.Message.Payload = []byte("bulk")
+
+	critical := packet.NewPublishPacket()
+	critical.Message.Topic = "critical"
+	critical.Message.Payload = []byte("critical")
+
+	broker := New()
+	broker.LoadShedding = NewLoadShedding(
+		TopicClassRule{Filter: "critical", Class: CriticalClass},
+		TopicClassRule{Filter: "bulk", Class: BulkClass},
+	)
+	broker.LoadShedding.Load = func() float64 {
+		return 1
+	}
+	broker.LoadShedding.DeferDelay = time.Millisecond
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(bulk).
+		Send(critical).
+		Receive(critical).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// A SPIFFEBackend wraps another Backend and authenticates clients using the
+// X.509 SVIDs they present over mutual TLS (see CertificateConn). The SVIDs
+// are validated against the trust bundle of the configured trust domain and
+// the SPIFFE ID of the client is mapped to the topic namespaces it may use.
+// All other calls are forwarded to the wrapped Backend.
+type SPIFFEBackend struct {
+	Backend
+
+	// The trust domain the SPIFFE IDs must belong to, e.g. "example.org".
+	TrustDomain string
+
+	// The Templates describe the topic filters an authenticated client may
+	// publish and subscribe to. The placeholders "{id}", "{trust_domain}" and
+	// "{path}" are replaced with the complete SPIFFE ID, its trust domain and
+	// its path without the leading slash.
+	Templates []string
+
+	// If Fallback is set to true, clients that do not present a certificate
+	// are authenticated and authorized by the wrapped Backend. They are
+	// refused otherwise.
+	Fallback bool
+
+	bundle *x509.CertPool
+	mutex  sync.RWMutex
+}
+
+// NewSPIFFEBackend returns a new SPIFFEBackend that wraps the specified
+// Backend and validates SVIDs against the specified trust bundle.
+func NewSPIFFEBackend(backend Backend, trustDomain string, bundle *x509.CertPool) *SPIFFEBackend {
+	return &SPIFFEBackend{
+		Backend:     backend,
+		TrustDomain: trustDomain,
+		bundle:      bundle,
+	}
+}
+
+// UpdateBundle will replace the trust bundle, which allows rotating the trust
+// bundle without restarting the broker. Already authenticated clients are not
+// validated again.
+func (s *SPIFFEBackend) UpdateBundle(bundle *x509.CertPool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.bundle = bundle
+}
+
+// Authenticate will validate the SVID presented by the client and store the
+// SPIFFE ID as "spiffe_id" in the clients context. The user and password are
+// ignored for clients that present a certificate.
+func (s *SPIFFEBackend) Authenticate(client Client, user, password string) (bool, error) {
+	certs, _ := client.Context().Get("certificates").([]*x509.Certificate)
+
+	// check certificates
+	if len(certs) == 0 {
+		if s.Fallback {
+			return s.Backend.Authenticate(client, user, password)
+		}
+
+		return false, nil
+	}
+
+	// validate svid
+	id, err := s.verify(certs)
+	if err != nil {
+		return false, nil
+	}
+
+	client.Context().Set("spiffe_id", id.String())
+
+	return true, nil
+}
+
+// AuthenticateCertificate will validate the SVID and store the SPIFFE ID as
+// "spiffe_id" in the clients context. Invalid SVIDs are refused by Authenticate
+// afterwards.
+func (s *SPIFFEBackend) AuthenticateCertificate(client Client, chain []*x509.Certificate) (bool, error) {
+	id, err := s.verify(chain)
+	if err != nil {
+		return false, nil
+	}
+
+	client.Context().Set("spiffe_id", id.String())
+
+	return true, nil
+}
+
+// Authorize will allow the action if the topic is covered by one of the
+// templates expanded with the clients SPIFFE ID and the wrapped Backend allows
+// the action as well.
+func (s *SPIFFEBackend) Authorize(client Client, topic string, action Action) (bool, error) {
+	id, ok := client.Context().Get("spiffe_id").(string)
+	if !ok {
+		if s.Fallback {
+			return s.Backend.Authorize(client, topic, action)
+		}
+
+		return false, nil
+	}
+
+	// parse id
+	uri, err := url.Parse(id)
+	if err != nil {
+		return false, err
+	}
+
+	// check templates
+	for _, template := range s.Templates {
+		if matchFilter(expandTemplate(template, uri), topic) {
+			return s.Backend.Authorize(client, topic, action)
+		}
+	}
+
+	return false, nil
+}
+
+// verifies the certificate chain and returns the SPIFFE ID of the leaf
+func (s *SPIFFEBackend) verify(certs []*x509.Certificate) (*url.URL, error) {
+	s.mutex.RLock()
+	bundle := s.bundle
+	s.mutex.RUnlock()
+
+	// check bundle
+	if bundle == nil {
+		return nil, fmt.Errorf("missing trust bundle")
+	}
+
+	// prepare intermediates
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	// verify chain
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         bundle,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// an svid must contain exactly one uri san
+	if len(certs[0].URIs) != 1 {
+		return nil, fmt.Errorf("expected exactly one uri san")
+	}
+
+	// check id
+	id := certs[0].URIs[0]
+	if id.Scheme != "spiffe" || id.Host != s.TrustDomain {
+		return nil, fmt.Errorf("invalid spiffe id %s", id)
+	}
+
+	return id, nil
+}
+
+// replaces the placeholders in the template with the parts of the id
+func expandTemplate(template string, id *url.URL) string {
+	return strings.NewReplacer(
+		"{id}", id.String(),
+		"{trust_domain}", id.Host,
+		"{path}", strings.TrimPrefix(id.Path, "/"),
+	).Replace(template)
+}
+
+// checks if the topic is covered by the filter, wildcards in the topic are
+// treated as literal levels and therefore only match wildcards in the filter
+func matchFilter(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
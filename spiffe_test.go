@@ -0,0 +1,120 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/x509"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func generateSVID(t *testing.T, id string) (*x509.CertPool, *x509.Certificate) {
+	pool, ca, caKey := generateCA(t)
+
+	uri, err := url.Parse(id)
+	assert.NoError(t, err)
+
+	leaf, _ := generateCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	return pool, leaf
+}
+
+func TestSPIFFEBackend(t *testing.T) {
+	bundle, svid := generateSVID(t, "spiffe://example.org/billing")
+
+	backend := NewSPIFFEBackend(NewMemoryBackend(), "example.org", bundle)
+	backend.Templates = []string{"services/{path}/#"}
+
+	// without certificate
+	client := newFakeClient()
+
+	ok, err := backend.Authenticate(client, "", "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// with certificate
+	client.Context().Set("certificates", []*x509.Certificate{svid})
+
+	ok, err = backend.Authenticate(client, "", "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "spiffe://example.org/billing", client.Context().Get("spiffe_id"))
+
+	// namespace
+	ok, err = backend.Authorize(client, "services/billing/invoices", PublishAction)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = backend.Authorize(client, "services/billing/#", SubscribeAction)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = backend.Authorize(client, "services/+/invoices", SubscribeAction)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = backend.Authorize(client, "services/shipping/orders", PublishAction)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// rotated bundle
+	otherBundle, _ := generateSVID(t, "spiffe://example.org/other")
+	backend.UpdateBundle(otherBundle)
+
+	ok, err = backend.Authenticate(newFakeClientWithCertificate(svid), "", "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// foreign trust domain
+	foreignBundle, foreignSVID := generateSVID(t, "spiffe://foreign.org/billing")
+	backend.UpdateBundle(foreignBundle)
+
+	ok, err = backend.Authenticate(newFakeClientWithCertificate(foreignSVID), "", "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestSPIFFEBackendFallback(t *testing.T) {
+	memory := NewMemoryBackend()
+	memory.Logins = map[string]string{"allow": "allow"}
+
+	backend := NewSPIFFEBackend(memory, "example.org", nil)
+	backend.Fallback = true
+
+	ok, err := backend.Authenticate(newFakeClient(), "allow", "allow")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = backend.Authorize(newFakeClient(), "foo", PublishAction)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func newFakeClientWithCertificate(cert *x509.Certificate) *fakeClient {
+	client := newFakeClient()
+	client.Context().Set("certificates", []*x509.Certificate{cert})
+	return client
+}
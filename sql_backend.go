@@ -0,0 +1,822 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+)
+
+// An SQLDialect selects the SQL variant spoken by the database of an
+// SQLBackend.
+type SQLDialect int
+
+const (
+	// PostgreSQL is the dialect of PostgreSQL databases.
+	PostgreSQL SQLDialect = iota
+
+	// MySQL is the dialect of MySQL and MariaDB databases.
+	MySQL
+)
+
+// the schema migrations of the SQLBackend, every statement is a version
+var sqlMigrations = []string{
+	`CREATE TABLE {prefix}sessions (
+		id VARCHAR(255) NOT NULL,
+		counter INTEGER NOT NULL,
+		will {blob},
+		PRIMARY KEY (id)
+	)`,
+	`CREATE TABLE {prefix}packets (
+		session_id VARCHAR(255) NOT NULL,
+		direction VARCHAR(3) NOT NULL,
+		packet_id INTEGER NOT NULL,
+		data {blob} NOT NULL,
+		PRIMARY KEY (session_id, direction, packet_id)
+	)`,
+	`CREATE TABLE {prefix}subscriptions (
+		session_id VARCHAR(255) NOT NULL,
+		topic VARCHAR(512) NOT NULL,
+		qos SMALLINT NOT NULL,
+		PRIMARY KEY (session_id, topic)
+	)`,
+	`CREATE TABLE {prefix}offline (
+		seq {serial},
+		session_id VARCHAR(255) NOT NULL,
+		data {blob} NOT NULL
+	)`,
+	`CREATE INDEX {prefix}offline_session ON {prefix}offline (session_id, seq)`,
+	`CREATE TABLE {prefix}retained (
+		topic VARCHAR(512) NOT NULL,
+		data {blob} NOT NULL,
+		PRIMARY KEY (topic)
+	)`,
+	`CREATE TABLE {prefix}wills (
+		uuid VARCHAR(255) NOT NULL,
+		data {blob} NOT NULL,
+		PRIMARY KEY (uuid)
+	)`,
+}
+
+// An SQLBackend stores sessions, subscriptions, offline messages and retained
+// messages in a PostgreSQL or MySQL database, which allows persistent sessions
+// and retained messages to survive a restart of the broker. It also implements
+// the WillStore interface, so the wills of clients that have been connected
+// during a crash are published when the broker starts again. The tables are
+// created and migrated in Start. The connected clients and their subscriptions
+// are routed in memory like in the MemoryBackend.
+//
+// The backend only depends on database/sql, the driver of the database has to
+// be imported by the application.
+type SQLBackend struct {
+	// The DB is the database used to store the state.
+	DB *sql.DB
+
+	// The Dialect of the database, defaults to PostgreSQL.
+	Dialect SQLDialect
+
+	// The TablePrefix is prepended to the names of all tables, which allows
+	// multiple brokers to share a database. Defaults to "gomqtt_".
+	TablePrefix string
+
+	Logins map[string]string
+
+	// The Passwords checker verifies the passwords of users that are not
+	// listed in Logins against stored hashes, e.g. a password file of the
+	// passwd package. A checker that implements the Reloader interface is
+	// reloaded by Reload.
+	Passwords PasswordChecker
+
+	// The Authorizer callback decides if a client may perform an action on a
+	// topic. All actions are allowed if no callback is set.
+	Authorizer func(client Client, topic string, action Action) bool
+
+	// The OfflineLimit is the maximum number of missed messages stored per
+	// session. The oldest messages are dropped first. Defaults to 100.
+	OfflineLimit int
+
+	queue        *tools.Tree
+	retained     *tools.Tree
+	offlineQueue *tools.Tree
+
+	retainedMutex sync.Mutex
+
+	sessions      map[string]*SQLSession
+	started       bool
+	sessionsMutex sync.Mutex
+
+	offlineMutex sync.RWMutex
+	clientsMutex sync.RWMutex
+}
+
+// NewSQLBackend returns a new SQLBackend that uses the specified database.
+func NewSQLBackend(db *sql.DB, dialect SQLDialect) *SQLBackend {
+	return &SQLBackend{
+		DB:           db,
+		Dialect:      dialect,
+		TablePrefix:  "gomqtt_",
+		OfflineLimit: 100,
+		queue:        tools.NewTree(),
+		retained:     tools.NewTree(),
+		offlineQueue: tools.NewTree(),
+		sessions:     make(map[string]*SQLSession),
+	}
+}
+
+// Start will migrate the schema and load the retained messages and the
+// offline subscriptions of all stored sessions.
+func (m *SQLBackend) Start(broker *Broker) error {
+	m.sessionsMutex.Lock()
+	defer m.sessionsMutex.Unlock()
+
+	err := m.Migrate()
+	if err != nil {
+		return err
+	}
+
+	// load retained messages
+	rows, err := m.query("SELECT data FROM {prefix}retained")
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return err
+		}
+
+		var msg packet.Message
+		err = json.Unmarshal(data, &msg)
+		if err != nil {
+			return err
+		}
+
+		m.retained.Set(msg.Topic, &msg)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	rows.Close()
+
+	// all stored sessions are offline after a restart
+	rows, err = m.query("SELECT session_id, topic FROM {prefix}subscriptions WHERE qos >= 1")
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, topic string
+		err = rows.Scan(&id, &topic)
+		if err != nil {
+			return err
+		}
+
+		m.offlineQueue.Add(topic, id)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	m.started = true
+
+	return nil
+}
+
+// Stop will stop the backend. The database is not closed.
+func (m *SQLBackend) Stop() error {
+	m.sessionsMutex.Lock()
+	defer m.sessionsMutex.Unlock()
+
+	// check if started
+	if !m.started {
+		return fmt.Errorf("backend not started")
+	}
+
+	m.started = false
+
+	return nil
+}
+
+// Migrate will create the schema version table if missing and apply all
+// migrations that have not yet been applied. It is called by Start.
+func (m *SQLBackend) Migrate() error {
+	_, err := m.exec("CREATE TABLE IF NOT EXISTS {prefix}schema (version INTEGER NOT NULL)")
+	if err != nil {
+		return err
+	}
+
+	// get current version
+	var version int
+	err = m.queryRow("SELECT COALESCE(MAX(version), 0) FROM {prefix}schema").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	// apply missing migrations
+	for i := version; i < len(sqlMigrations); i++ {
+		err = m.transaction(func(tx *sql.Tx) error {
+			_, err := m.execTx(tx, sqlMigrations[i])
+			if err != nil {
+				return fmt.Errorf("migration %d failed: %v", i+1, err)
+			}
+
+			_, err = m.execTx(tx, "INSERT INTO {prefix}schema (version) VALUES (?)", i+1)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reload will reload the Passwords if they implement the Reloader interface.
+func (m *SQLBackend) Reload() error {
+	if reloader, ok := m.Passwords.(Reloader); ok {
+		return reloader.Reload()
+	}
+
+	return nil
+}
+
+// Authenticate authenticates a clients credentials by matching them to the
+// saved Logins map or the hashes of the Passwords checker.
+func (m *SQLBackend) Authenticate(client Client, user, password string) (bool, error) {
+	// allow all if there are no logins
+	if m.Logins == nil && m.Passwords == nil {
+		return true, nil
+	}
+
+	// check login
+	if pw, ok := m.Logins[user]; ok {
+		return subtle.ConstantTimeCompare([]byte(pw), []byte(password)) == 1, nil
+	}
+
+	// check password hash
+	if m.Passwords != nil {
+		_, valid := m.Passwords.CheckPassword(user, password)
+		return valid, nil
+	}
+
+	return false, nil
+}
+
+// AuthenticateCertificate will always return false, so clients are
+// authenticated using Authenticate.
+func (m *SQLBackend) AuthenticateCertificate(client Client, chain []*x509.Certificate) (bool, error) {
+	return false, nil
+}
+
+// Authorize will call the configured Authorizer callback to authorize the
+// action. It will allow all actions if no callback has been set.
+func (m *SQLBackend) Authorize(client Client, topic string, action Action) (bool, error) {
+	// allow all if there is no authorizer
+	if m.Authorizer == nil {
+		return true, nil
+	}
+
+	return m.Authorizer(client, topic, action), nil
+}
+
+// Setup returns the already stored session for the supplied id or creates
+// and returns a new one. If clean is set to true it will additionally reset
+// the session. If the supplied id has a zero length, a new MemorySession is
+// returned that is not stored. If an existing session has been found it will
+// retrieve all missed messages and begin with forwarding them in a separate
+// goroutine. Furthermore, it will disconnect any client connected with the
+// same client id.
+func (m *SQLBackend) Setup(client Client, id string, clean bool) (Session, bool, error) {
+	m.sessionsMutex.Lock()
+	defer m.sessionsMutex.Unlock()
+
+	// save clean flag
+	client.Context().Set("clean", clean)
+
+	// return a new temporary session if id is zero
+	if len(id) == 0 {
+		sess := NewMemorySession()
+		client.Context().Set("session", sess)
+		return sess, false, nil
+	}
+
+	// get loaded session or load stored session
+	sess, ok := m.sessions[id]
+	if !ok {
+		var err error
+		sess, ok, err = openSQLSession(m, id)
+		if err != nil {
+			return nil, false, err
+		}
+
+		m.sessions[id] = sess
+	}
+
+	// close existing client
+	if sess.currentClient != nil {
+		sess.currentClient.Close(true)
+	}
+
+	m.offlineMutex.Lock()
+	defer m.offlineMutex.Unlock()
+
+	// set current client
+	sess.currentClient = client
+	client.Context().Set("session", sess)
+
+	if !ok {
+		return sess, false, nil
+	}
+
+	// reset session if clean is true
+	if clean {
+		err := sess.Reset()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	// remove session from the offline queue
+	m.offlineQueue.Clear(id)
+
+	// retrieve missed messages
+	msgs, err := sess.missed()
+	if err != nil {
+		return nil, false, err
+	}
+
+	// send all missed messages as a batch in another goroutine
+	go func() {
+		n, err := PublishBatch(client, msgs)
+		if err == ErrClientOffline {
+			for _, msg := range msgs[n:] {
+				m.miss(client, msg)
+			}
+		}
+	}()
+
+	return sess, true, nil
+}
+
+// SessionExists will return whether a session is stored for the client id.
+func (m *SQLBackend) SessionExists(client Client, id string) (bool, error) {
+	m.sessionsMutex.Lock()
+	_, ok := m.sessions[id]
+	m.sessionsMutex.Unlock()
+
+	if ok {
+		return true, nil
+	}
+
+	var counter int
+	err := m.queryRow("SELECT counter FROM {prefix}sessions WHERE id = ?", id).Scan(&counter)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Subscribe will subscribe the passed client to the specified topic and
+// begin to forward messages by calling the clients Publish method.
+// It will also return the stored retained messages matching the supplied
+// topic.
+func (m *SQLBackend) Subscribe(client Client, topic string) ([]*packet.Message, error) {
+	m.clientsMutex.RLock()
+	defer m.clientsMutex.RUnlock()
+
+	// ignore subscriptions that arrive after the client has been terminated
+	if terminated, _ := client.Context().Get("terminated").(bool); terminated {
+		return nil, nil
+	}
+
+	// add client to queue
+	m.queue.Add(topic, client)
+
+	// get retained messages
+	values := m.retained.Search(topic)
+	var msgs []*packet.Message
+
+	// convert types
+	for _, value := range values {
+		if msg, ok := value.(*packet.Message); ok {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	return msgs, nil
+}
+
+// Unsubscribe will unsubscribe the passed client from the specified topic.
+func (m *SQLBackend) Unsubscribe(client Client, topic string) error {
+	m.queue.Remove(topic, client)
+
+	return nil
+}
+
+// Publish will forward the passed message to all other subscribed clients.
+// QOS 1 and 2 messages that could not be queued because a client with a
+// persistent session went offline are added to its session. It will also
+// store the message if Retain is set to true. If the supplied message has
+// additionally a zero length payload, the backend removes the currently
+// retained message. Finally, it will also add the message to all sessions that
+// have an offline subscription.
+func (m *SQLBackend) Publish(client Client, msg *packet.Message) error {
+	_, err := m.publish(client, msg)
+	return err
+}
+
+// ClearRetained will publish the empty retained message and return whether a
+// retained message has been removed.
+func (m *SQLBackend) ClearRetained(client Client, msg *packet.Message) (bool, error) {
+	if !msg.Retain || len(msg.Payload) > 0 {
+		return false, fmt.Errorf("message does not clear a retained message")
+	}
+
+	return m.publish(client, msg)
+}
+
+// publishes the message and returns whether a retained message has been
+// removed
+func (m *SQLBackend) publish(client Client, msg *packet.Message) (bool, error) {
+	removed := false
+
+	// check retain flag
+	if msg.Retain {
+		var err error
+		removed, err = m.retain(msg)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	var err error
+
+	// publish directly to clients
+	for _, v := range m.queue.Match(msg.Topic) {
+		if client, ok := v.(Client); ok {
+			if client.Publish(msg) == ErrClientOffline {
+				_err := m.miss(client, msg)
+				if err == nil {
+					err = _err
+				}
+			}
+		}
+	}
+
+	// queue for offline sessions
+	m.offlineMutex.RLock()
+	for _, v := range m.offlineQueue.Match(msg.Topic) {
+		if id, ok := v.(string); ok {
+			_err := m.queueMessage(id, msg)
+			if err == nil {
+				err = _err
+			}
+		}
+	}
+	m.offlineMutex.RUnlock()
+
+	return removed, err
+}
+
+// Terminate will unsubscribe the passed client from all previously subscribed
+// topics. If the client connect with clean=true it will also remove the
+// session. Otherwise it will create offline subscriptions for all QOS 1 and
+// QOS 2 subscriptions. Sessions that have already been resumed by another
+// client are left untouched.
+func (m *SQLBackend) Terminate(client Client) error {
+	m.sessionsMutex.Lock()
+	defer m.sessionsMutex.Unlock()
+
+	// remove client from queue and refuse further subscriptions
+	m.clientsMutex.Lock()
+	client.Context().Set("terminated", true)
+	m.queue.Clear(client)
+	m.clientsMutex.Unlock()
+
+	// get session
+	session, ok := client.Context().Get("session").(*SQLSession)
+	if !ok || session.currentClient != client {
+		return nil
+	}
+
+	m.offlineMutex.Lock()
+	defer m.offlineMutex.Unlock()
+
+	// reset stored client
+	session.currentClient = nil
+
+	// check if the client connected with clean=true
+	clean, ok := client.Context().Get("clean").(bool)
+	if ok && clean {
+		err := session.Reset()
+		if err != nil {
+			return err
+		}
+
+		delete(m.sessions, session.id)
+
+		_, err = m.exec("DELETE FROM {prefix}sessions WHERE id = ?", session.id)
+		return err
+	}
+
+	// otherwise get stored subscriptions
+	subscriptions, err := session.AllSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	// iterate through stored subscriptions
+	for _, sub := range subscriptions {
+		if sub.QOS >= 1 {
+			// session to offline queue
+			m.offlineQueue.Add(sub.Topic, session.id)
+		}
+	}
+
+	return nil
+}
+
+// StoreWill will store the will of the client with the specified uuid.
+func (m *SQLBackend) StoreWill(uuid string, will *packet.Message) error {
+	data, err := json.Marshal(will)
+	if err != nil {
+		return err
+	}
+
+	return m.transaction(func(tx *sql.Tx) error {
+		_, err := m.execTx(tx, "DELETE FROM {prefix}wills WHERE uuid = ?", uuid)
+		if err != nil {
+			return err
+		}
+
+		_, err = m.execTx(tx, "INSERT INTO {prefix}wills (uuid, data) VALUES (?, ?)", uuid, data)
+		return err
+	})
+}
+
+// DiscardWill will remove the will of the client with the specified uuid.
+func (m *SQLBackend) DiscardWill(uuid string) error {
+	_, err := m.exec("DELETE FROM {prefix}wills WHERE uuid = ?", uuid)
+	return err
+}
+
+// StoredWills will return all stored wills by uuid.
+func (m *SQLBackend) StoredWills() (map[string]*packet.Message, error) {
+	rows, err := m.query("SELECT uuid, data FROM {prefix}wills")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	wills := make(map[string]*packet.Message)
+
+	for rows.Next() {
+		var uuid string
+		var data []byte
+		err = rows.Scan(&uuid, &data)
+		if err != nil {
+			return nil, err
+		}
+
+		var will packet.Message
+		err = json.Unmarshal(data, &will)
+		if err != nil {
+			return nil, err
+		}
+
+		wills[uuid] = &will
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return wills, nil
+}
+
+// adds a message that could not be queued to the persistent session of the
+// client that went offline or forwards it to the client that has already
+// resumed the session
+func (m *SQLBackend) miss(client Client, msg *packet.Message) error {
+	if msg.QOS == 0 {
+		return nil
+	}
+
+	clean, _ := client.Context().Get("clean").(bool)
+	session, ok := client.Context().Get("session").(*SQLSession)
+	if !ok || clean {
+		return nil
+	}
+
+	m.offlineMutex.RLock()
+	defer m.offlineMutex.RUnlock()
+
+	// forward to the client that resumed the session
+	if current := session.currentClient; current != nil && current != client {
+		if clean, _ := current.Context().Get("clean").(bool); clean {
+			return nil
+		}
+
+		if current.Publish(msg) == nil {
+			return nil
+		}
+	}
+
+	return session.queue(msg)
+}
+
+// stores or clears a retained message and returns whether a retained message
+// has been removed
+func (m *SQLBackend) retain(msg *packet.Message) (bool, error) {
+	m.retainedMutex.Lock()
+	defer m.retainedMutex.Unlock()
+
+	// clear message
+	if len(msg.Payload) == 0 {
+		_, err := m.exec("DELETE FROM {prefix}retained WHERE topic = ?", msg.Topic)
+		if err != nil {
+			return false, err
+		}
+
+		removed := len(m.retained.Get(msg.Topic)) > 0
+		m.retained.Empty(msg.Topic)
+
+		return removed, nil
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return false, err
+	}
+
+	err = m.transaction(func(tx *sql.Tx) error {
+		_, err := m.execTx(tx, "DELETE FROM {prefix}retained WHERE topic = ?", msg.Topic)
+		if err != nil {
+			return err
+		}
+
+		_, err = m.execTx(tx, "INSERT INTO {prefix}retained (topic, data) VALUES (?, ?)", msg.Topic, data)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	m.retained.Set(msg.Topic, msg)
+	return false, nil
+}
+
+// adds a missed message to a stored session and drops the oldest messages if
+// the offline limit is exceeded
+func (m *SQLBackend) queueMessage(id string, msg *packet.Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return m.transaction(func(tx *sql.Tx) error {
+		_, err := m.execTx(tx, "INSERT INTO {prefix}offline (session_id, data) VALUES (?, ?)", id, data)
+		if err != nil {
+			return err
+		}
+
+		// check limit
+		if m.OfflineLimit <= 0 {
+			return nil
+		}
+
+		var count int
+		err = m.queryRowTx(tx, "SELECT COUNT(*) FROM {prefix}offline WHERE session_id = ?", id).Scan(&count)
+		if err != nil || count <= m.OfflineLimit {
+			return err
+		}
+
+		// get newest message that is dropped
+		var seq int64
+		err = m.queryRowTx(tx, "SELECT seq FROM {prefix}offline WHERE session_id = ? ORDER BY seq LIMIT 1 OFFSET ?", id, count-m.OfflineLimit-1).Scan(&seq)
+		if err != nil {
+			return err
+		}
+
+		_, err = m.execTx(tx, "DELETE FROM {prefix}offline WHERE session_id = ? AND seq <= ?", id, seq)
+		return err
+	})
+}
+
+// runs the function in a transaction that is committed if no error is
+// returned
+func (m *SQLBackend) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// executes a statement
+func (m *SQLBackend) exec(query string, args ...interface{}) (sql.Result, error) {
+	return m.DB.Exec(m.statement(query), args...)
+}
+
+// runs a query
+func (m *SQLBackend) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return m.DB.Query(m.statement(query), args...)
+}
+
+// runs a query that returns a single row
+func (m *SQLBackend) queryRow(query string, args ...interface{}) *sql.Row {
+	return m.DB.QueryRow(m.statement(query), args...)
+}
+
+// executes a statement in the transaction
+func (m *SQLBackend) execTx(tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	return tx.Exec(m.statement(query), args...)
+}
+
+// runs a query in the transaction
+func (m *SQLBackend) queryTx(tx *sql.Tx, query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Query(m.statement(query), args...)
+}
+
+// runs a query in the transaction that returns a single row
+func (m *SQLBackend) queryRowTx(tx *sql.Tx, query string, args ...interface{}) *sql.Row {
+	return tx.QueryRow(m.statement(query), args...)
+}
+
+// converts a query to the dialect of the database by inserting the table
+// prefix and the column types and numbering the placeholders for PostgreSQL
+func (m *SQLBackend) statement(query string) string {
+	blob, serial := "BYTEA", "BIGSERIAL PRIMARY KEY"
+	if m.Dialect == MySQL {
+		blob, serial = "LONGBLOB", "BIGINT AUTO_INCREMENT PRIMARY KEY"
+	}
+
+	query = strings.NewReplacer(
+		"{prefix}", m.TablePrefix,
+		"{blob}", blob,
+		"{serial}", serial,
+	).Replace(query)
+
+	if m.Dialect != PostgreSQL {
+		return query
+	}
+
+	// number placeholders
+	var buf strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			buf.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+
+		buf.WriteRune(r)
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"database/sql"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+// opens the database configured using SQL_BACKEND_DRIVER and SQL_BACKEND_DSN
+// and drops the tables of previous runs, the driver has to be registered by
+// a test file of the application
+func openSQLTestDB(t *testing.T) (*sql.DB, SQLDialect) {
+	driver := os.Getenv("SQL_BACKEND_DRIVER")
+	dsn := os.Getenv("SQL_BACKEND_DSN")
+	if driver == "" || dsn == "" {
+		t.Skip("SQL_BACKEND_DRIVER and SQL_BACKEND_DSN are not set")
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		t.Skip(err.Error())
+	}
+
+	dialect := PostgreSQL
+	if driver == "mysql" {
+		dialect = MySQL
+	}
+
+	for _, table := range []string{"schema", "sessions", "packets", "subscriptions", "offline", "retained", "wills"} {
+		_, err = db.Exec("DROP TABLE IF EXISTS gomqtt_test_" + table)
+		assert.NoError(t, err)
+	}
+
+	return db, dialect
+}
+
+func TestSQLBackendStatement(t *testing.T) {
+	backend := NewSQLBackend(nil, PostgreSQL)
+	assert.Equal(t, "SELECT data FROM gomqtt_packets WHERE session_id = $1 AND packet_id = $2",
+		backend.statement("SELECT data FROM {prefix}packets WHERE session_id = ? AND packet_id = ?"))
+	assert.Equal(t, "CREATE TABLE gomqtt_offline (seq BIGSERIAL PRIMARY KEY, data BYTEA)",
+		backend.statement("CREATE TABLE {prefix}offline (seq {serial}, data {blob})"))
+
+	backend = NewSQLBackend(nil, MySQL)
+	backend.TablePrefix = "test_"
+	assert.Equal(t, "SELECT data FROM test_packets WHERE session_id = ? AND packet_id = ?",
+		backend.statement("SELECT data FROM {prefix}packets WHERE session_id = ? AND packet_id = ?"))
+	assert.Equal(t, "CREATE TABLE test_offline (seq BIGINT AUTO_INCREMENT PRIMARY KEY, data LONGBLOB)",
+		backend.statement("CREATE TABLE {prefix}offline (seq {serial}, data {blob})"))
+}
+
+func TestSQLBackendValidate(t *testing.T) {
+	backend := NewSQLBackend(nil, SQLDialect(7))
+	backend.TablePrefix = "gomqtt;"
+	backend.OfflineLimit = -1
+
+	assert.Equal(t, ValidationError{
+		"DB must be set",
+		"Dialect is unknown",
+		"TablePrefix must only contain letters, digits and underscores",
+		"OfflineLimit must not be negative",
+	}, backend.Validate())
+}
+
+func TestSQLBackendAuthenticate(t *testing.T) {
+	passwords := &fakePasswords{passwords: map[string]string{"hashed": "hashed"}}
+
+	backend := NewSQLBackend(nil, PostgreSQL)
+
+	ok, err := backend.Authenticate(newFakeClient(), "foo", "bar")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	backend.Logins = map[string]string{"allow": "allow"}
+	backend.Passwords = passwords
+
+	for user, password := range map[string]string{"allow": "allow", "hashed": "hashed"} {
+		ok, err = backend.Authenticate(newFakeClient(), user, password)
+		assert.NoError(t, err)
+		assert.True(t, ok, user)
+
+		ok, err = backend.Authenticate(newFakeClient(), user, "deny")
+		assert.NoError(t, err)
+		assert.False(t, ok, user)
+	}
+
+	ok, err = backend.Authenticate(newFakeClient(), "deny", "deny")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	err = backend.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, passwords.reloads)
+}
+
+func TestSQLBackend(t *testing.T) {
+	db, dialect := openSQLTestDB(t)
+	defer db.Close()
+
+	build := func() *SQLBackend {
+		openSQLTestDB(t)
+
+		backend := NewSQLBackend(db, dialect)
+		backend.TablePrefix = "gomqtt_test_"
+		return backend
+	}
+
+	BackendSpec(t, func() Backend {
+		backend := build()
+		backend.Logins = map[string]string{"allow": "allow"}
+		assert.NoError(t, backend.Start(nil))
+		return backend
+	})
+
+	AuthorizationSpec(t, func() Backend {
+		backend := build()
+		backend.Authorizer = func(client Client, topic string, action Action) bool {
+			return topic != "deny"
+		}
+		assert.NoError(t, backend.Start(nil))
+		return backend
+	})
+
+	i := 0
+
+	SessionSpec(t, func() Session {
+		i++
+
+		backend := build()
+		assert.NoError(t, backend.Migrate())
+
+		session, _, err := openSQLSession(backend, strconv.Itoa(i))
+		assert.NoError(t, err)
+
+		return session
+	})
+
+	Spec(t, func(secure bool) *Broker {
+		backend := build()
+
+		broker := New()
+		broker.Backend = backend
+
+		if secure {
+			backend.Logins = map[string]string{
+				"allow": "allow",
+			}
+		}
+
+		return broker
+	}, true, true)
+
+	RestartSpec(t, func(previous *Broker) *Broker {
+		// restarted brokers load the state from the same tables
+		backend := NewSQLBackend(db, dialect)
+		backend.TablePrefix = "gomqtt_test_"
+		if previous == nil {
+			backend = build()
+		}
+
+		broker := New()
+		broker.Backend = backend
+
+		return broker
+	})
+}
+
+func TestSQLBackendRestore(t *testing.T) {
+	db, dialect := openSQLTestDB(t)
+	defer db.Close()
+
+	backend1 := NewSQLBackend(db, dialect)
+	backend1.TablePrefix = "gomqtt_test_"
+	assert.NoError(t, backend1.Start(nil))
+
+	client := newFakeClient()
+
+	session, resumed, err := backend1.Setup(client, "foo", false)
+	assert.NoError(t, err)
+	assert.False(t, resumed)
+	assert.NoError(t, session.SaveSubscription(&packet.Subscription{Topic: "foo", QOS: 1}))
+	assert.NoError(t, backend1.Publish(client, &packet.Message{Topic: "bar", Payload: []byte("bar"), Retain: true}))
+	assert.NoError(t, backend1.Terminate(client))
+	assert.NoError(t, backend1.Stop())
+
+	// missed messages are queued after the restart
+	backend2 := NewSQLBackend(db, dialect)
+	backend2.TablePrefix = "gomqtt_test_"
+	assert.NoError(t, backend2.Start(nil))
+
+	msg := &packet.Message{Topic: "foo", Payload: []byte("foo"), QOS: 1}
+	assert.NoError(t, backend2.Publish(newFakeClient(), msg))
+
+	msgs, err := backend2.Subscribe(client, "bar")
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+
+	restored, resumed, err := openSQLSession(backend2, "foo")
+	assert.NoError(t, err)
+	assert.True(t, resumed)
+
+	sub, err := restored.LookupSubscription("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(1), sub.QOS)
+
+	missed, err := restored.missed()
+	assert.NoError(t, err)
+	assert.Equal(t, []*packet.Message{msg}, missed)
+}
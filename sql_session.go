@@ -0,0 +1,408 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+)
+
+// An SQLSession stores packets, subscriptions, the will and missed messages
+// of a session in the tables of an SQLBackend. Packets are stored in the same
+// serialized form as in a FileSession. The packet id counter and the
+// subscriptions are additionally kept in memory, as they are consulted for
+// every delivered message.
+type SQLSession struct {
+	id      string
+	backend *SQLBackend
+
+	counter       uint16
+	subscriptions *tools.Tree
+
+	currentClient Client
+
+	mutex sync.Mutex
+}
+
+// loads the session with the specified id or creates it, the boolean is true
+// if the session already existed
+func openSQLSession(backend *SQLBackend, id string) (*SQLSession, bool, error) {
+	s := &SQLSession{
+		id:            id,
+		backend:       backend,
+		subscriptions: tools.NewTree(),
+	}
+
+	// load session
+	var counter int
+	err := backend.queryRow("SELECT counter FROM {prefix}sessions WHERE id = ?", id).Scan(&counter)
+	if err == sql.ErrNoRows {
+		_, err = backend.exec("INSERT INTO {prefix}sessions (id, counter) VALUES (?, 0)", id)
+		return s, false, err
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	s.counter = uint16(counter)
+
+	// load subscriptions
+	rows, err := backend.query("SELECT topic, qos FROM {prefix}subscriptions WHERE session_id = ?", id)
+	if err != nil {
+		return nil, false, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		sub := &packet.Subscription{}
+		err = rows.Scan(&sub.Topic, &sub.QOS)
+		if err != nil {
+			return nil, false, err
+		}
+
+		s.subscriptions.Set(sub.Topic, sub)
+	}
+
+	return s, true, rows.Err()
+}
+
+// PacketID will return the next id for outgoing packets.
+func (s *SQLSession) PacketID() uint16 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// increment counter and skip the zero id
+	s.counter++
+	if s.counter == 0 {
+		s.counter = 1
+	}
+
+	// the counter gets persisted along with the packet that uses the id
+	return s.counter
+}
+
+// SavePacket will store a packet in the session. An eventual existing
+// packet with the same id gets quietly overwritten. Only PublishPackets
+// and PubrelPackets can be stored.
+func (s *SQLSession) SavePacket(direction string, pkt packet.Packet) error {
+	// check type
+	switch pkt.(type) {
+	case *packet.PublishPacket, *packet.PubrelPacket:
+	default:
+		return fmt.Errorf("unsupported packet type %s", pkt.Type())
+	}
+
+	stored := encodeFileSessionPacket(pkt)
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	id := stored.PacketID
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.backend.transaction(func(tx *sql.Tx) error {
+		_, err := s.backend.execTx(tx, "DELETE FROM {prefix}packets WHERE session_id = ? AND direction = ? AND packet_id = ?", s.id, direction, id)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.backend.execTx(tx, "INSERT INTO {prefix}packets (session_id, direction, packet_id, data) VALUES (?, ?, ?, ?)", s.id, direction, id, data)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.backend.execTx(tx, "UPDATE {prefix}sessions SET counter = ? WHERE id = ?", s.counter, s.id)
+		return err
+	})
+}
+
+// ReleasePacket will replace the stored outgoing PublishPacket with the
+// specified id by a PubrelPacket in a transaction.
+func (s *SQLSession) ReleasePacket(id uint16) (bool, error) {
+	pubrel := packet.NewPubrelPacket()
+	pubrel.PacketID = id
+
+	data, err := json.Marshal(encodeFileSessionPacket(pubrel))
+	if err != nil {
+		return false, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var stored int
+
+	err = s.backend.transaction(func(tx *sql.Tx) error {
+		_, err := s.backend.execTx(tx, "UPDATE {prefix}packets SET data = ? WHERE session_id = ? AND direction = ? AND packet_id = ?", data, s.id, outgoing, id)
+		if err != nil {
+			return err
+		}
+
+		// mysql only reports changed rows
+		return s.backend.queryRowTx(tx, "SELECT COUNT(*) FROM {prefix}packets WHERE session_id = ? AND direction = ? AND packet_id = ?", s.id, outgoing, id).Scan(&stored)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return stored > 0, nil
+}
+
+// LookupPacket will retrieve a packet from the session using a packet id.
+func (s *SQLSession) LookupPacket(direction string, id uint16) (packet.Packet, error) {
+	var data []byte
+	err := s.backend.queryRow("SELECT data FROM {prefix}packets WHERE session_id = ? AND direction = ? AND packet_id = ?", s.id, direction, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return decodeSQLPacket(data)
+}
+
+// DeletePacket will remove a packet from the session. The method will not
+// return an error if no packet with the specified id exists.
+func (s *SQLSession) DeletePacket(direction string, id uint16) error {
+	_, err := s.backend.exec("DELETE FROM {prefix}packets WHERE session_id = ? AND direction = ? AND packet_id = ?", s.id, direction, id)
+	return err
+}
+
+// AllPackets will return all packets currently saved in the session.
+func (s *SQLSession) AllPackets(direction string) ([]packet.Packet, error) {
+	rows, err := s.backend.query("SELECT data FROM {prefix}packets WHERE session_id = ? AND direction = ? ORDER BY packet_id", s.id, direction)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var pkts []packet.Packet
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, err
+		}
+
+		pkt, err := decodeSQLPacket(data)
+		if err != nil {
+			return nil, err
+		}
+
+		pkts = append(pkts, pkt)
+	}
+
+	return pkts, rows.Err()
+}
+
+// SaveSubscription will store the subscription in the session. An eventual
+// subscription with the same topic gets quietly overwritten.
+func (s *SQLSession) SaveSubscription(sub *packet.Subscription) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.backend.transaction(func(tx *sql.Tx) error {
+		_, err := s.backend.execTx(tx, "DELETE FROM {prefix}subscriptions WHERE session_id = ? AND topic = ?", s.id, sub.Topic)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.backend.execTx(tx, "INSERT INTO {prefix}subscriptions (session_id, topic, qos) VALUES (?, ?, ?)", s.id, sub.Topic, sub.QOS)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.subscriptions.Set(sub.Topic, sub)
+	return nil
+}
+
+// LookupSubscription will match a topic against the stored subscriptions and
+// eventually return the first found subscription.
+func (s *SQLSession) LookupSubscription(topic string) (*packet.Subscription, error) {
+	values := s.subscriptions.Match(topic)
+
+	if len(values) > 0 {
+		if sub, ok := values[0].(*packet.Subscription); ok {
+			return sub, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// DeleteSubscription will remove the subscription from the session. The
+// method will not return an error if no subscription with the specified
+// topic does exist.
+func (s *SQLSession) DeleteSubscription(topic string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.backend.exec("DELETE FROM {prefix}subscriptions WHERE session_id = ? AND topic = ?", s.id, topic)
+	if err != nil {
+		return err
+	}
+
+	s.subscriptions.Empty(topic)
+	return nil
+}
+
+// AllSubscriptions will return all subscriptions currently saved in the session.
+func (s *SQLSession) AllSubscriptions() ([]*packet.Subscription, error) {
+	var all []*packet.Subscription
+
+	for _, value := range s.subscriptions.All() {
+		if sub, ok := value.(*packet.Subscription); ok {
+			all = append(all, sub)
+		}
+	}
+
+	return all, nil
+}
+
+// SaveWill will store the will message.
+func (s *SQLSession) SaveWill(msg *packet.Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.backend.exec("UPDATE {prefix}sessions SET will = ? WHERE id = ?", data, s.id)
+	return err
+}
+
+// LookupWill will retrieve the will message.
+func (s *SQLSession) LookupWill() (*packet.Message, error) {
+	var data []byte
+	err := s.backend.queryRow("SELECT will FROM {prefix}sessions WHERE id = ?", s.id).Scan(&data)
+	if err == sql.ErrNoRows || (err == nil && data == nil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var msg packet.Message
+	err = json.Unmarshal(data, &msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+// ClearWill will remove the will message from the store.
+func (s *SQLSession) ClearWill() error {
+	_, err := s.backend.exec("UPDATE {prefix}sessions SET will = NULL WHERE id = ?", s.id)
+	return err
+}
+
+// Reset will completely reset the session.
+func (s *SQLSession) Reset() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.backend.transaction(func(tx *sql.Tx) error {
+		for _, query := range []string{
+			"DELETE FROM {prefix}packets WHERE session_id = ?",
+			"DELETE FROM {prefix}subscriptions WHERE session_id = ?",
+			"DELETE FROM {prefix}offline WHERE session_id = ?",
+			"UPDATE {prefix}sessions SET counter = 0, will = NULL WHERE id = ?",
+		} {
+			_, err := s.backend.execTx(tx, query, s.id)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.counter = 0
+	s.subscriptions.Reset()
+
+	return nil
+}
+
+// queues an offline message and drops the oldest messages if the limit of
+// the backend is exceeded
+func (s *SQLSession) queue(msg *packet.Message) error {
+	return s.backend.queueMessage(s.id, msg)
+}
+
+// retrieves and removes all offline messages
+func (s *SQLSession) missed() ([]*packet.Message, error) {
+	var msgs []*packet.Message
+
+	err := s.backend.transaction(func(tx *sql.Tx) error {
+		rows, err := s.backend.queryTx(tx, "SELECT data FROM {prefix}offline WHERE session_id = ? ORDER BY seq", s.id)
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			var data []byte
+			err = rows.Scan(&data)
+			if err != nil {
+				return err
+			}
+
+			var msg packet.Message
+			err = json.Unmarshal(data, &msg)
+			if err != nil {
+				return err
+			}
+
+			msgs = append(msgs, &msg)
+		}
+
+		err = rows.Err()
+		if err != nil {
+			return err
+		}
+
+		rows.Close()
+
+		_, err = s.backend.execTx(tx, "DELETE FROM {prefix}offline WHERE session_id = ?", s.id)
+		return err
+	})
+
+	return msgs, err
+}
+
+// decodes a packet stored by SavePacket
+func decodeSQLPacket(data []byte) (packet.Packet, error) {
+	var p fileSessionPacket
+	err := json.Unmarshal(data, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.decode()
+}
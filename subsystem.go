@@ -0,0 +1,80 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+// A Subsystem is an optional component that runs alongside the broker, like a
+// Bridge, a KafkaExporter or the servers of the admin and metrics packages.
+// Heavy subsystems live in sub-packages, so embedders only pay for the
+// subsystems they import.
+type Subsystem interface {
+	// Start should start the subsystem. It is called once the backend has
+	// been started.
+	Start() error
+
+	// Stop should stop the subsystem. It is called before the backend is
+	// stopped.
+	Stop() error
+}
+
+// Attach will register the subsystem with the broker. The subsystem is started
+// with the broker or immediately if the broker is already running, and
+// stopped by Stop and Close.
+func (b *Broker) Attach(subsystem Subsystem) error {
+	b.clientsMutex.Lock()
+	defer b.clientsMutex.Unlock()
+
+	b.subsystems = append(b.subsystems, subsystem)
+
+	// start immediately if running
+	if b.started {
+		return subsystem.Start()
+	}
+
+	return nil
+}
+
+// Subsystems returns the attached subsystems.
+func (b *Broker) Subsystems() []Subsystem {
+	b.clientsMutex.Lock()
+	defer b.clientsMutex.Unlock()
+
+	return append([]Subsystem{}, b.subsystems...)
+}
+
+// starts all attached subsystems, the mutex must be held
+func (b *Broker) startSubsystems() error {
+	for _, subsystem := range b.subsystems {
+		err := subsystem.Start()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stops all attached subsystems in reverse order, the mutex must be held
+func (b *Broker) stopSubsystems() error {
+	var err error
+
+	for i := len(b.subsystems) - 1; i >= 0; i-- {
+		_err := b.subsystems[i].Stop()
+		if err == nil {
+			err = _err
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sync"
+
+	"github.com/gomqtt/packet"
+)
+
+// SystemClientID is the client id of the virtual client that publishes the
+// messages injected using Broker.Publish. Authorizers and event handlers may
+// recognize it using IsSystemClient.
+const SystemClientID = "$broker"
+
+// the lazily created virtual client of the broker
+type systemIdentity struct {
+	client *LocalClient
+	once   sync.Once
+}
+
+// IsSystemClient returns whether the client is the virtual client that
+// publishes the messages injected using Broker.Publish.
+func IsSystemClient(client Client) bool {
+	system, _ := client.Context().Get("system").(bool)
+	return system
+}
+
+// returns the lazily created virtual client
+func (b *Broker) systemClient() *LocalClient {
+	b.system.once.Do(func() {
+		b.system.client = NewLocalClient(func(*packet.Message) {})
+		b.system.client.Context().Set("client_id", SystemClientID)
+		b.system.client.Context().Set("system", true)
+	})
+
+	return b.system.client
+}
+
+// Publish will publish the message as the virtual system client, which allows
+// embedding applications to inject notifications into the topic space. The
+// message is not authorized and may be published to reserved topics, like
+// "$SYS/". The MessageExpiry and the Provenance are applied and a
+// MessagePublished event is emitted like for the messages of clients. The
+// message itself is not modified, but its metadata is consumed.
+func (b *Broker) Publish(msg *packet.Message) error {
+	client := b.systemClient()
+
+	// work on a copy that takes over the metadata
+	copied := *msg
+	b.annotations().move(msg, &copied)
+	msg = &copied
+
+	// attach default expiry
+	b.defaultExpiry(msg)
+
+	// stamp origin
+	err := b.stamp(client, msg)
+	if err != nil {
+		b.annotations().release(msg)
+		return err
+	}
+
+	err = b.Backend.Publish(client, msg)
+	b.annotations().release(msg)
+	if err != nil {
+		return err
+	}
+
+	b.log(LogDebug, "message_injected", map[string]interface{}{
+		"client_id": SystemClientID,
+		"topic":     msg.Topic,
+	})
+
+	b.emit(&Event{
+		Type:    MessagePublished,
+		Client:  client,
+		Message: msg,
+	})
+
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBrokerPublish(t *testing.T) {
+	broker := New()
+
+	var received []*packet.Message
+	client := NewLocalClient(func(msg *packet.Message) {
+		received = append(received, msg)
+	})
+
+	_, err := broker.Backend.Subscribe(client, "$SYS/#")
+	assert.NoError(t, err)
+
+	var publisher string
+	broker.OnEvent(func(event *Event) {
+		if event.Type == MessagePublished {
+			assert.True(t, IsSystemClient(event.Client))
+			publisher, _ = event.Client.Context().Get("client_id").(string)
+		}
+	})
+
+	msg := &packet.Message{
+		Topic:   "$SYS/app/ready",
+		Payload: []byte("1"),
+	}
+
+	err = broker.Publish(msg)
+	assert.NoError(t, err)
+	assert.Len(t, received, 1)
+	assert.Equal(t, "$SYS/app/ready", received[0].Topic)
+	assert.Equal(t, []byte("1"), received[0].Payload)
+	assert.Equal(t, SystemClientID, publisher)
+
+	assert.False(t, IsSystemClient(client))
+}
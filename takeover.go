@@ -0,0 +1,96 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import "sync"
+
+// A TakeoverPolicy describes how a client is handled that connects with the
+// client id of an already connected client.
+type TakeoverPolicy int
+
+const (
+	// CloseOld closes the connected client and hands its session over to the
+	// new client right away. Messages buffered by the closed client are
+	// stored in the session while it is already being resumed and may only be
+	// sent on the next resume.
+	CloseOld TakeoverPolicy = iota
+
+	// RejectNew keeps the connected client and refuses the new client with an
+	// "identifier rejected" return code. Clients that lost their connection
+	// unnoticed can only reconnect once the keep alive of the previous
+	// connection expired.
+	RejectNew
+
+	// CloseOldAndMigrate closes the connected client and waits until its
+	// buffered and unacknowledged messages have been stored in the session
+	// before the new client resumes it, so that no message is left behind. The
+	// wait is bounded by the TakeoverTimeout of the broker.
+	CloseOldAndMigrate
+)
+
+// serializes the takeovers per client id
+type takeoverLocks struct {
+	locks map[string]*takeoverLock
+	mutex sync.Mutex
+}
+
+// a lock of a client id that is shared by the pending connections
+type takeoverLock struct {
+	mutex sync.Mutex
+	refs  int
+}
+
+// locks the client id and returns a function that unlocks it again, which
+// may be called multiple times
+func (t *takeoverLocks) lock(id string) func() {
+	if id == "" {
+		return func() {}
+	}
+
+	t.mutex.Lock()
+
+	// lazily allocate locks
+	if t.locks == nil {
+		t.locks = make(map[string]*takeoverLock)
+	}
+
+	l, ok := t.locks[id]
+	if !ok {
+		l = &takeoverLock{}
+		t.locks[id] = l
+	}
+
+	l.refs++
+
+	t.mutex.Unlock()
+
+	l.mutex.Lock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mutex.Unlock()
+
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+
+			l.refs--
+
+			if l.refs <= 0 {
+				delete(t.locks, id)
+			}
+		})
+	}
+}
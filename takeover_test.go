@@ -0,0 +1,115 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTakeoverLocks(t *testing.T) {
+	var locks takeoverLocks
+
+	unlock := locks.lock("test")
+
+	locked := make(chan struct{})
+	go func() {
+		locks.lock("test")()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		assert.Fail(t, "lock should be held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// other ids are not blocked
+	locks.lock("other")()
+
+	unlock()
+	unlock()
+	<-locked
+
+	assert.Empty(t, locks.locks)
+}
+
+func TestTakeoverConcurrentConnects(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+	connect.CleanSession = false
+
+	broker := New()
+	broker.TakeoverPolicy = CloseOldAndMigrate
+
+	port, done := runBroker(t, broker, 20)
+
+	start := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		conn, err := transport.Dial(port.URL())
+		assert.NoError(t, err)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			<-start
+
+			// the connection is either accepted or taken over
+			err := conn.Send(connect)
+			if err == nil {
+				conn.Receive()
+			}
+		}()
+
+		defer conn.Close()
+	}
+
+	close(start)
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "connects deadlocked")
+	}
+
+	<-done
+
+	// only the last client remains
+	connected := func() int {
+		broker.clientsMutex.Lock()
+		defer broker.clientsMutex.Unlock()
+
+		return broker.connected
+	}
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return connected() == 1
+	})
+	assert.Equal(t, 1, connected())
+}
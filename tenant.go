@@ -0,0 +1,313 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"github.com/gomqtt/packet"
+)
+
+// A TenantQuota limits the resources used by a single tenant. A zero value
+// disables the respective limit.
+type TenantQuota struct {
+	// The maximum number of connected clients. Further clients are refused.
+	MaxClients int
+
+	// The maximum number of subscriptions of all connected clients. Further
+	// subscriptions are denied.
+	MaxSubscriptions int
+
+	// The maximum number of retained messages and bytes of all retained
+	// topics and payloads. The oldest retained messages of the tenant are
+	// evicted if a limit is exceeded (see RetainedQuota).
+	MaxRetainedMessages int
+	MaxRetainedBytes    int
+}
+
+// TenantByUsername returns a callback for MemoryBackend.Tenants that uses the
+// part of the username before the separator as the tenant, e.g. "acme" for
+// the username "acme:device1" and the separator ":". Users without the
+// separator are isolated in the default tenant.
+func TenantByUsername(separator string) func(Client) string {
+	return func(client Client) string {
+		username, _ := client.Context().Get("username").(string)
+
+		i := strings.Index(username, separator)
+		if i <= 0 {
+			return ""
+		}
+
+		return username[:i]
+	}
+}
+
+// TenantByCertificate returns a callback for MemoryBackend.Tenants that uses
+// the first organization of the presented client certificate as the tenant.
+// Clients without a certificate are isolated in the default tenant.
+func TenantByCertificate() func(Client) string {
+	return func(client Client) string {
+		chain, _ := client.Context().Get("certificates").([]*x509.Certificate)
+		if len(chain) == 0 || len(chain[0].Subject.Organization) == 0 {
+			return ""
+		}
+
+		return chain[0].Subject.Organization[0]
+	}
+}
+
+// TenantByContext returns a callback for MemoryBackend.Tenants that uses the
+// string stored under the key in the clients context as the tenant, e.g. a
+// token claim stored by a custom Authenticate implementation.
+func TenantByContext(key string) func(Client) string {
+	return func(client Client) string {
+		tenant, _ := client.Context().Get(key).(string)
+		return tenant
+	}
+}
+
+// the tenant of clients without a tenant if no DefaultTenant is configured
+const defaultTenant = "default"
+
+// returns the cached tenant of the client or an empty string if the client is
+// not isolated
+func (m *MemoryBackend) tenant(client Client) string {
+	if m.Tenants == nil {
+		return ""
+	}
+
+	if tenant, ok := client.Context().Get("tenant").(string); ok {
+		return tenant
+	}
+
+	// only the system client and admins see all tenants
+	tenant := ""
+	if !IsSystemClient(client) && (m.TenantAdmins == nil || !m.TenantAdmins(client)) {
+		tenant = m.Tenants(client)
+		if tenant == "" {
+			tenant = m.DefaultTenant
+		}
+		if tenant == "" {
+			tenant = defaultTenant
+		}
+	}
+
+	client.Context().Set("tenant", tenant)
+
+	return tenant
+}
+
+// returns the topic prefix of the clients tenant or an empty string if the
+// client is not isolated
+func (m *MemoryBackend) namespace(client Client) string {
+	tenant := m.tenant(client)
+	if tenant == "" {
+		return ""
+	}
+
+	return m.TenantPrefix + tenant + "/"
+}
+
+// returns the key of a stored session, sessions of isolated clients are
+// stored as "<tenant>/<client id>"
+func (m *MemoryBackend) sessionKey(client Client, id string) string {
+	tenant := m.tenant(client)
+	if tenant == "" || id == "" {
+		return id
+	}
+
+	return tenant + "/" + id
+}
+
+// returns the quota of the tenant
+func (m *MemoryBackend) tenantQuota(tenant string) TenantQuota {
+	if quota, ok := m.TenantQuotas[tenant]; ok {
+		return quota
+	}
+
+	return m.TenantQuota
+}
+
+// checks the tenant and registers the connected client, the sessions mutex
+// must be held
+func (m *MemoryBackend) admit(client Client, replaced Client) error {
+	tenant := m.tenant(client)
+	if tenant == "" {
+		return nil
+	}
+
+	// check tenant
+	if strings.ContainsAny(tenant, "/+#") {
+		return fmt.Errorf("invalid tenant %q", tenant)
+	}
+
+	// lazily allocate clients
+	if m.tenantClients == nil {
+		m.tenantClients = make(map[string]map[Client]bool)
+	}
+
+	clients := m.tenantClients[tenant]
+	if clients == nil {
+		clients = make(map[Client]bool)
+		m.tenantClients[tenant] = clients
+	}
+
+	// check quota, a client that takes over a session replaces its client
+	connected := len(clients)
+	if clients[replaced] {
+		connected--
+	}
+
+	if max := m.tenantQuota(tenant).MaxClients; max > 0 && connected >= max {
+		return fmt.Errorf("tenant %s exceeded its client quota", tenant)
+	}
+
+	clients[client] = true
+
+	return nil
+}
+
+// unregisters a disconnected client, the sessions mutex must be held
+func (m *MemoryBackend) dismiss(client Client) {
+	tenant := m.tenant(client)
+	if tenant == "" {
+		return
+	}
+
+	delete(m.tenantClients[tenant], client)
+	if len(m.tenantClients[tenant]) == 0 {
+		delete(m.tenantClients, tenant)
+	}
+}
+
+// returns whether the tenant of the client may add the subscription
+func (m *MemoryBackend) admitSubscription(client Client, topic string) bool {
+	tenant := m.tenant(client)
+	if tenant == "" {
+		return true
+	}
+
+	max := m.tenantQuota(tenant).MaxSubscriptions
+	if max <= 0 {
+		return true
+	}
+
+	m.sessionsMutex.Lock()
+	defer m.sessionsMutex.Unlock()
+
+	m.routesMutex.Lock()
+	defer m.routesMutex.Unlock()
+
+	// existing subscriptions are always allowed
+	if m.routes[client][m.namespace(client)+topic] {
+		return true
+	}
+
+	subscriptions := 0
+	for c := range m.tenantClients[tenant] {
+		subscriptions += len(m.routes[c])
+	}
+
+	return subscriptions < max
+}
+
+// starts tracking the retained quota of the tenant, the retained mutex must be
+// held
+func (m *MemoryBackend) trackRetained(tenant string) {
+	quota := m.tenantQuota(tenant)
+	if quota.MaxRetainedMessages <= 0 && quota.MaxRetainedBytes <= 0 {
+		return
+	}
+
+	// lazily allocate tracked tenants
+	if m.trackedTenants == nil {
+		m.trackedTenants = make(map[string]bool)
+	}
+
+	if m.trackedTenants[tenant] {
+		return
+	}
+
+	m.trackedTenants[tenant] = true
+
+	// ensure configured quotas are allocated
+	quotas := m.retainedQuotas()
+
+	prefix := m.TenantPrefix + tenant + "/"
+	usage := newRetainedQuotas([]RetainedQuota{{
+		Prefix:      prefix,
+		MaxMessages: quota.MaxRetainedMessages,
+		MaxBytes:    quota.MaxRetainedBytes,
+	}})
+
+	m.quotas = append(quotas, usage...)
+
+	// account already retained messages
+	for _, value := range m.retained.Search(prefix + "#") {
+		if msg, ok := value.(*packet.Message); ok {
+			for _, topic := range usage.add(msg) {
+				m.evictRetained(topic)
+			}
+		}
+	}
+}
+
+// returns a copy of the message with the namespace added to the topic
+func namespaced(ns string, msg *packet.Message) *packet.Message {
+	if ns == "" {
+		return msg
+	}
+
+	copied := *msg
+	copied.Topic = ns + msg.Topic
+
+	return &copied
+}
+
+// returns a copy of the message with the namespace removed from the topic
+func localized(ns string, msg *packet.Message) *packet.Message {
+	if ns == "" || !strings.HasPrefix(msg.Topic, ns) {
+		return msg
+	}
+
+	copied := *msg
+	copied.Topic = msg.Topic[len(ns):]
+
+	return &copied
+}
+
+// publishes the message to the client without the namespace of its tenant
+func (m *MemoryBackend) deliver(client Client, msg *packet.Message) error {
+	ns := m.namespace(client)
+	if ns == "" || !strings.HasPrefix(msg.Topic, ns) {
+		return m.dispatch(client, msg)
+	}
+
+	// the copy carries the metadata until it has been enqueued
+	local := m.annotations().fork(msg)
+	if local == msg {
+		copied := *msg
+		local = &copied
+	}
+
+	local.Topic = msg.Topic[len(ns):]
+
+	err := m.dispatch(client, local)
+	m.annotations().release(local)
+
+	return err
+}
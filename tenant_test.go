@@ -0,0 +1,144 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTenantClient(username string) *fakeClient {
+	client := newFakeClient()
+	client.Context().Set("username", username)
+	return client
+}
+
+func TestMemoryBackendTenants(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.Tenants = TenantByUsername(":")
+
+	backend.TenantAdmins = func(client Client) bool {
+		return client.Context().Get("username") == "admin"
+	}
+
+	acme := newTenantClient("acme:device")
+	other := newTenantClient("other:device")
+	admin := newTenantClient("admin")
+	anonymous := newFakeClient()
+
+	for _, client := range []*fakeClient{acme, other, admin, anonymous} {
+		_, _, err := backend.Setup(client, "device", true)
+		assert.NoError(t, err)
+
+		_, err = backend.Subscribe(client, "#")
+		assert.NoError(t, err)
+	}
+
+	// clients without a tenant cannot escape the default tenant
+	_, err := backend.Subscribe(anonymous, "tenants/#")
+	assert.NoError(t, err)
+
+	err = backend.Publish(acme, &packet.Message{Topic: "foo", Payload: []byte("acme"), Retain: true})
+	assert.NoError(t, err)
+
+	// tenants only receive their own messages without the namespace
+	assert.Equal(t, []*packet.Message{{Topic: "foo", Payload: []byte("acme"), Retain: true}}, acme.in)
+	assert.Empty(t, other.in)
+	assert.Equal(t, []*packet.Message{{Topic: "tenants/acme/foo", Payload: []byte("acme"), Retain: true}}, admin.in)
+	assert.Empty(t, anonymous.in)
+
+	// the default tenant is isolated as well
+	err = backend.Publish(anonymous, &packet.Message{Topic: "foo", Payload: []byte("anonymous")})
+	assert.NoError(t, err)
+	assert.Equal(t, []*packet.Message{{Topic: "foo", Payload: []byte("anonymous")}}, anonymous.in)
+	assert.Len(t, acme.in, 1)
+	assert.Equal(t, "tenants/default/foo", admin.in[1].Topic)
+
+	// retained messages are localized
+	msgs, err := backend.Subscribe(acme, "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, []*packet.Message{{Topic: "foo", Payload: []byte("acme"), Retain: true}}, msgs)
+
+	msgs, err = backend.Subscribe(other, "foo")
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	// sessions are separated by tenant
+	backend.sessionsMutex.Lock()
+	assert.Len(t, backend.sessions, 4)
+	assert.NotNil(t, backend.sessions["acme/device"])
+	assert.NotNil(t, backend.sessions["default/device"])
+	backend.sessionsMutex.Unlock()
+}
+
+func TestMemoryBackendTenantQuota(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.Tenants = TenantByUsername(":")
+	backend.TenantQuota = TenantQuota{MaxClients: 1, MaxSubscriptions: 1, MaxRetainedMessages: 1}
+	backend.TenantQuotas = map[string]TenantQuota{"big": {}}
+
+	client1 := newTenantClient("acme:one")
+	client2 := newTenantClient("acme:two")
+
+	_, _, err := backend.Setup(client1, "one", true)
+	assert.NoError(t, err)
+
+	_, _, err = backend.Setup(client2, "two", true)
+	assert.Error(t, err)
+
+	// unlisted tenants use their own quota
+	_, _, err = backend.Setup(newTenantClient("big:one"), "one", true)
+	assert.NoError(t, err)
+
+	_, _, err = backend.Setup(newTenantClient("big:two"), "two", true)
+	assert.NoError(t, err)
+
+	// subscriptions
+	ok, err := backend.Authorize(client1, "foo", SubscribeAction)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	_, err = backend.Subscribe(client1, "foo")
+	assert.NoError(t, err)
+
+	ok, err = backend.Authorize(client1, "foo", SubscribeAction)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = backend.Authorize(client1, "bar", SubscribeAction)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// retained messages
+	err = backend.Publish(client1, &packet.Message{Topic: "a", Payload: []byte("a"), Retain: true})
+	assert.NoError(t, err)
+
+	err = backend.Publish(client1, &packet.Message{Topic: "b", Payload: []byte("b"), Retain: true})
+	assert.NoError(t, err)
+
+	msgs, err := backend.RetainedMessages("tenants/acme/#")
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, "tenants/acme/b", msgs[0].Topic)
+
+	// terminated clients release their quota
+	err = backend.Terminate(client1)
+	assert.NoError(t, err)
+
+	_, _, err = backend.Setup(client2, "two", true)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+// A TerminateMode describes whether the teardown of a connection waits for
+// Backend.Terminate.
+type TerminateMode int
+
+const (
+	// TerminateSync calls Terminate on the goroutine of the connection. The
+	// connection is closed and unregistered once Terminate has returned, so
+	// a slow backend delays the teardown of every connection.
+	TerminateSync TerminateMode = iota
+
+	// TerminateAsync calls Terminate on a separate goroutine, while the
+	// connection is closed and unregistered right away. The will has been
+	// published and the buffered messages have been stored in the session
+	// before Terminate is called. The ClientDisconnected event is emitted
+	// once Terminate has returned and errors are passed to the ErrorHandler.
+	// Stop and Close wait for pending terminations before the backend is
+	// stopped.
+	TerminateAsync
+)
+
+// terminates the client in the backend according to the TerminateMode
+func (c *remoteClient) terminate(clientID string) error {
+	if c.broker.TerminateMode != TerminateAsync {
+		return c.finishTermination(clientID)
+	}
+
+	c.broker.terminations.Add(1)
+
+	go func() {
+		defer c.broker.terminations.Done()
+
+		err := c.finishTermination(clientID)
+		if err != nil {
+			c.log(LogError, "internal_error", map[string]interface{}{
+				"error": err,
+			})
+
+			c.broker.reportError(c, err)
+		}
+	}()
+
+	return nil
+}
+
+// removes the client from the backend and releases the session
+func (c *remoteClient) finishTermination(clientID string) error {
+	// remove client from the queue
+	err := c.broker.Backend.Terminate(c)
+
+	// the client has only been connected with a session
+	if c.session != nil {
+		c.broker.emit(&Event{
+			Type:   ClientDisconnected,
+			Client: c,
+		})
+	}
+
+	// release session ownership if the session has been discarded
+	clean, _ := c.Context().Get("clean").(bool)
+	if c.session != nil && c.broker.AffinitySink != nil && len(clientID) > 0 && clean {
+		_err := c.broker.AffinitySink.Release(clientID, c.broker.NodeID)
+		if err == nil {
+			err = _err
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+// a backend that blocks Terminate until it is released
+type slowTerminateBackend struct {
+	*MemoryBackend
+	release chan struct{}
+}
+
+func (b *slowTerminateBackend) Terminate(client Client) error {
+	<-b.release
+	return b.MemoryBackend.Terminate(client)
+}
+
+func TestTerminateAsync(t *testing.T) {
+	backend := &slowTerminateBackend{
+		MemoryBackend: NewMemoryBackend(),
+		release:       make(chan struct{}),
+	}
+
+	broker := New()
+	broker.Backend = backend
+	broker.TerminateMode = TerminateAsync
+
+	disconnected := make(chan struct{})
+	broker.OnEvent(func(event *Event) {
+		if event.Type == ClientDisconnected {
+			close(disconnected)
+		}
+	})
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(packet.NewConnackPacket()).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	// the connection is unregistered while terminating
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return len(broker.currentClients()) == 0
+	})
+	assert.Empty(t, broker.currentClients())
+
+	select {
+	case <-disconnected:
+		t.Fatal("unexpected event")
+	default:
+	}
+
+	close(backend.release)
+
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("missing event")
+	}
+
+	<-done
+}
+
+func TestStopWaitsWithoutLock(t *testing.T) {
+	backend := &slowTerminateBackend{
+		MemoryBackend: NewMemoryBackend(),
+		release:       make(chan struct{}),
+	}
+
+	broker := New()
+	broker.Backend = backend
+	broker.TerminateMode = TerminateAsync
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(packet.NewConnectPacket()).
+		Receive(packet.NewConnackPacket()).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return len(broker.currentClients()) == 0
+	})
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- broker.Stop()
+	}()
+
+	// the broker remains accessible while the termination is pending
+	checked := make(chan struct{})
+	go func() {
+		broker.await(time.Now().Add(time.Second), func() bool {
+			return broker.Ready() != nil
+		})
+
+		broker.Subsystems()
+		close(checked)
+	}()
+
+	select {
+	case <-checked:
+	case <-time.After(time.Second):
+		t.Fatal("broker locked while stopping")
+	}
+
+	close(backend.release)
+
+	select {
+	case err = <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("stop did not return")
+	}
+}
@@ -0,0 +1,489 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/transport"
+)
+
+const (
+	traceIncoming = "in"
+	traceOutgoing = "out"
+	traceClose    = "close"
+)
+
+// A TraceRecord is a single packet that has been recorded on a connection.
+type TraceRecord struct {
+	// The number of the connection.
+	Conn int `json:"conn"`
+
+	// The time since the start of the recording.
+	Time time.Duration `json:"time"`
+
+	// The direction of the packet: "in" for packets sent by the client, "out"
+	// for packets sent by the broker and "close" if the connection has been
+	// closed.
+	Direction string `json:"direction"`
+
+	// The type and the JSON encoded packet.
+	Type   packet.Type     `json:"type,omitempty"`
+	Packet json.RawMessage `json:"packet,omitempty"`
+}
+
+// A Trace is an ordered list of recorded packets.
+type Trace struct {
+	Records []TraceRecord `json:"records"`
+}
+
+// ReadTrace will decode a trace previously written using Trace.Write.
+func ReadTrace(r io.Reader) (*Trace, error) {
+	var trace Trace
+	err := json.NewDecoder(r).Decode(&trace)
+	if err != nil {
+		return nil, err
+	}
+
+	return &trace, nil
+}
+
+// Write will encode the trace to the specified writer.
+func (t *Trace) Write(w io.Writer) error {
+	return json.NewEncoder(w).Encode(t)
+}
+
+// A Recorder records the packets of connections handled by a broker.
+type Recorder struct {
+	// If Anonymize is set to true, the payloads of publish packets and wills
+	// and the usernames of connect packets are replaced with their
+	// HMAC-SHA-256 before they are recorded. The key is generated randomly
+	// per recorder and never recorded, so that equal values remain equal
+	// within a trace without being recoverable by hashing guesses. Passwords
+	// are never recorded.
+	Anonymize bool
+
+	start time.Time
+	key   []byte
+	conns int
+	trace Trace
+	mutex sync.Mutex
+}
+
+// NewRecorder returns a new Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{
+		start: time.Now(),
+		key:   newTraceKey(),
+	}
+}
+
+// returns a random key for the anonymization of a trace
+func newTraceKey() []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(err)
+	}
+
+	return key
+}
+
+// Wrap will return a connection that records all packets of the specified
+// connection. The returned connection can then be passed to Broker.Handle.
+func (r *Recorder) Wrap(conn transport.Conn) transport.Conn {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.conns++
+
+	return &recordingConn{
+		Conn:     conn,
+		recorder: r,
+		number:   r.conns,
+	}
+}
+
+// Trace returns a copy of the recorded trace.
+func (r *Recorder) Trace() *Trace {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return &Trace{
+		Records: append([]TraceRecord(nil), r.trace.Records...),
+	}
+}
+
+// adds a record to the trace
+func (r *Recorder) record(conn int, direction string, pkt packet.Packet) {
+	record := TraceRecord{
+		Conn:      conn,
+		Direction: direction,
+	}
+
+	if pkt != nil {
+		var key []byte
+		if r.Anonymize {
+			key = r.anonymizationKey()
+		}
+
+		data, err := encodeTracePacket(pkt, key)
+		if err != nil {
+			return
+		}
+
+		record.Type = pkt.Type()
+		record.Packet = data
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	record.Time = time.Since(r.start)
+	r.trace.Records = append(r.trace.Records, record)
+}
+
+// returns the anonymization key and lazily generates it for recorders that
+// have not been created using NewRecorder
+func (r *Recorder) anonymizationKey() []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.key == nil {
+		r.key = newTraceKey()
+	}
+
+	return r.key
+}
+
+// a connection wrapper that records all packets
+type recordingConn struct {
+	transport.Conn
+
+	recorder *Recorder
+	number   int
+	closed   sync.Once
+}
+
+func (c *recordingConn) Send(pkt packet.Packet) error {
+	err := c.Conn.Send(pkt)
+	if err == nil {
+		c.recorder.record(c.number, traceOutgoing, pkt)
+	}
+
+	return err
+}
+
+func (c *recordingConn) Receive() (packet.Packet, error) {
+	pkt, err := c.Conn.Receive()
+	if err != nil {
+		c.closed.Do(func() {
+			c.recorder.record(c.number, traceClose, nil)
+		})
+
+		return nil, err
+	}
+
+	c.recorder.record(c.number, traceIncoming, pkt)
+
+	return pkt, nil
+}
+
+// ReplayCredentials returns the username and password that are used to replay
+// the connect packet of the specified connection, which has been recorded with
+// the specified and eventually anonymized username.
+type ReplayCredentials func(conn int, username string) (string, string)
+
+// Replay will replay the incoming packets of the trace against the broker
+// available at the specified url and returns the resulting trace. To make the
+// replay deterministic, all outgoing packets that have been recorded before an
+// incoming packet are awaited (at most for the specified timeout) before the
+// incoming packet is sent.
+//
+// As passwords are never recorded, connect packets are replayed without a
+// password and will be refused by brokers that require authentication unless
+// the optional credentials substitute the username and password.
+func Replay(url string, trace *Trace, timeout time.Duration, credentials ReplayCredentials) (*Trace, error) {
+	recorder := NewRecorder()
+
+	conns := make(map[int]transport.Conn)
+	expected := make(map[int]int)
+	received := make(map[int]int)
+	cond := sync.NewCond(&recorder.mutex)
+
+	var wg sync.WaitGroup
+
+	// closes all connections and waits for the receivers
+	cleanup := func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+
+		wg.Wait()
+	}
+
+	// waits until all expected packets have been received
+	await := func() {
+		deadline := time.Now().Add(timeout)
+		timer := time.AfterFunc(timeout, cond.Broadcast)
+		defer timer.Stop()
+
+		recorder.mutex.Lock()
+		defer recorder.mutex.Unlock()
+
+		for time.Now().Before(deadline) {
+			done := true
+			for conn, num := range expected {
+				if received[conn] < num {
+					done = false
+				}
+			}
+
+			if done {
+				return
+			}
+
+			cond.Wait()
+		}
+	}
+
+	for _, record := range trace.Records {
+		switch record.Direction {
+		case traceOutgoing:
+			expected[record.Conn]++
+		case traceIncoming:
+			await()
+
+			pkt, err := decodeTracePacket(record.Type, record.Packet)
+			if err != nil {
+				cleanup()
+				return nil, err
+			}
+
+			// substitute credentials
+			if connect, ok := pkt.(*packet.ConnectPacket); ok && credentials != nil {
+				connect.Username, connect.Password = credentials(record.Conn, connect.Username)
+			}
+
+			// open connection on first packet
+			conn, ok := conns[record.Conn]
+			if !ok {
+				dialed, err := transport.Dial(url)
+				if err != nil {
+					cleanup()
+					return nil, err
+				}
+
+				conn = dialed
+				conns[record.Conn] = conn
+
+				// start receiver
+				wg.Add(1)
+				go func(number int, conn transport.Conn) {
+					defer wg.Done()
+
+					for {
+						pkt, err := conn.Receive()
+						if err != nil {
+							return
+						}
+
+						recorder.record(number, traceOutgoing, pkt)
+
+						recorder.mutex.Lock()
+						received[number]++
+						recorder.mutex.Unlock()
+						cond.Broadcast()
+					}
+				}(record.Conn, conn)
+			}
+
+			err = conn.Send(pkt)
+			if err != nil {
+				cleanup()
+				return nil, err
+			}
+
+			recorder.record(record.Conn, traceIncoming, pkt)
+		case traceClose:
+			await()
+
+			if conn, ok := conns[record.Conn]; ok {
+				conn.Close()
+				recorder.record(record.Conn, traceClose, nil)
+			}
+		}
+	}
+
+	await()
+	cleanup()
+
+	return recorder.Trace(), nil
+}
+
+// CompareRoutes will compare the messages that have been delivered to each
+// connection in the two traces and returns a description of every difference.
+// Packet ids and timings are ignored.
+func CompareRoutes(expected, actual *Trace) []string {
+	var diffs []string
+
+	exp := deliveredMessages(expected)
+	act := deliveredMessages(actual)
+
+	for conn, msgs := range exp {
+		other := act[conn]
+
+		for i, msg := range msgs {
+			if i >= len(other) {
+				diffs = append(diffs, fmt.Sprintf("conn %d: missing message %d %s", conn, i, msg))
+			} else if other[i] != msg {
+				diffs = append(diffs, fmt.Sprintf("conn %d: expected message %d %s, got %s", conn, i, msg, other[i]))
+			}
+		}
+
+		for i := len(msgs); i < len(other); i++ {
+			diffs = append(diffs, fmt.Sprintf("conn %d: unexpected message %d %s", conn, i, other[i]))
+		}
+	}
+
+	for conn, msgs := range act {
+		if _, ok := exp[conn]; !ok {
+			for i, msg := range msgs {
+				diffs = append(diffs, fmt.Sprintf("conn %d: unexpected message %d %s", conn, i, msg))
+			}
+		}
+	}
+
+	return diffs
+}
+
+// returns a description of all delivered messages per connection
+func deliveredMessages(trace *Trace) map[int][]string {
+	msgs := make(map[int][]string)
+
+	for _, record := range trace.Records {
+		if record.Direction != traceOutgoing || record.Type != packet.PUBLISH {
+			continue
+		}
+
+		pkt, err := decodeTracePacket(record.Type, record.Packet)
+		if err != nil {
+			continue
+		}
+
+		msg := pkt.(*packet.PublishPacket).Message
+		msgs[record.Conn] = append(msgs[record.Conn], fmt.Sprintf("%s (qos=%d, retain=%t, payload=%x)",
+			msg.Topic, msg.QOS, msg.Retain, msg.Payload))
+	}
+
+	return msgs
+}
+
+// encodes a packet without its password and anonymizes payloads and usernames
+// if a key is specified
+func encodeTracePacket(pkt packet.Packet, key []byte) (json.RawMessage, error) {
+	switch p := pkt.(type) {
+	case *packet.PublishPacket:
+		if key != nil {
+			publish := *p
+			publish.Message.Payload = anonymizePayload(key, p.Message.Payload)
+			pkt = &publish
+		}
+	case *packet.ConnectPacket:
+		connect := *p
+		connect.Password = ""
+
+		if key != nil {
+			if connect.Username != "" {
+				connect.Username = hex.EncodeToString(anonymizePayload(key, []byte(connect.Username)))
+			}
+
+			if p.Will != nil {
+				will := *p.Will
+				will.Payload = anonymizePayload(key, will.Payload)
+				connect.Will = &will
+			}
+		}
+
+		pkt = &connect
+	}
+
+	return json.Marshal(pkt)
+}
+
+// replaces a payload with its keyed hash
+func anonymizePayload(key, payload []byte) []byte {
+	if len(payload) == 0 {
+		return payload
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// decodes a previously encoded packet
+func decodeTracePacket(t packet.Type, data json.RawMessage) (packet.Packet, error) {
+	var pkt packet.Packet
+
+	switch t {
+	case packet.CONNECT:
+		pkt = packet.NewConnectPacket()
+	case packet.CONNACK:
+		pkt = packet.NewConnackPacket()
+	case packet.PUBLISH:
+		pkt = packet.NewPublishPacket()
+	case packet.PUBACK:
+		pkt = packet.NewPubackPacket()
+	case packet.PUBREC:
+		pkt = packet.NewPubrecPacket()
+	case packet.PUBREL:
+		pkt = packet.NewPubrelPacket()
+	case packet.PUBCOMP:
+		pkt = packet.NewPubcompPacket()
+	case packet.SUBSCRIBE:
+		pkt = packet.NewSubscribePacket()
+	case packet.SUBACK:
+		pkt = packet.NewSubackPacket()
+	case packet.UNSUBSCRIBE:
+		pkt = packet.NewUnsubscribePacket()
+	case packet.UNSUBACK:
+		pkt = packet.NewUnsubackPacket()
+	case packet.PINGREQ:
+		pkt = packet.NewPingreqPacket()
+	case packet.PINGRESP:
+		pkt = packet.NewPingrespPacket()
+	case packet.DISCONNECT:
+		pkt = packet.NewDisconnectPacket()
+	default:
+		return nil, fmt.Errorf("unknown packet type %d", t)
+	}
+
+	err := json.Unmarshal(data, pkt)
+	if err != nil {
+		return nil, err
+	}
+
+	return pkt, nil
+}
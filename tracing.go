@@ -0,0 +1,86 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"github.com/gomqtt/packet"
+)
+
+// SpanAnnotation is the metadata key of the span that is attached to messages
+// while they are published (see Broker.Annotate).
+//
+// An inbound Middleware may attach the span of the sender, e.g. a trace
+// context decoded from the payload, to make it the parent of the publish span.
+// During the fan-out it is replaced by the publish span, which an outbound
+// Middleware may then inject into the delivered message.
+const SpanAnnotation = "span"
+
+// A Tracer starts spans for the lifecycle of incoming messages. A "publish"
+// span covers every incoming message including wills, with an "authorize"
+// child span covering the authorization and a "deliver" child span covering
+// the hand over to every subscribed client. The otel package provides an
+// implementation that is backed by OpenTelemetry.
+type Tracer interface {
+	// Start should start a span with the specified name and attributes. The
+	// span should be a child of the parent span if it is not nil.
+	Start(name string, parent Span, attributes map[string]interface{}) Span
+}
+
+// A Span is a unit of work started by a Tracer.
+type Span interface {
+	// SetError should mark the span as failed.
+	SetError(err error)
+
+	// End should finish the span.
+	End()
+}
+
+// a span that is used if no tracer is configured
+type nopSpan struct{}
+
+func (nopSpan) SetError(error) {}
+func (nopSpan) End()           {}
+
+// starts a span using the configured tracer
+func (b *Broker) startSpan(name string, parent Span, attributes map[string]interface{}) Span {
+	if b.Tracer == nil {
+		return nopSpan{}
+	}
+
+	return b.Tracer.Start(name, parent, attributes)
+}
+
+// returns the span attached to the message by the sender
+func (b *Broker) parentSpan(msg *packet.Message) Span {
+	span, _ := b.Annotations(msg)[SpanAnnotation].(Span)
+	return span
+}
+
+// returns the attributes of a message and a client
+func spanAttributes(msg *packet.Message, client Client) map[string]interface{} {
+	attributes := map[string]interface{}{
+		"messaging.system":            "mqtt",
+		"messaging.destination.name":  msg.Topic,
+		"messaging.message.body.size": len(msg.Payload),
+		"messaging.mqtt.qos":          int(msg.QOS),
+		"messaging.mqtt.retain":       msg.Retain,
+	}
+
+	if clientID, ok := client.Context().Get("client_id").(string); ok {
+		attributes["messaging.client.id"] = clientID
+	}
+
+	return attributes
+}
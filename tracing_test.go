@@ -0,0 +1,154 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSpan struct {
+	tracer     *testTracer
+	name       string
+	parent     *testSpan
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+func (s *testSpan) SetError(err error) {
+	s.tracer.mutex.Lock()
+	s.err = err
+	s.tracer.mutex.Unlock()
+}
+
+func (s *testSpan) End() {
+	s.tracer.mutex.Lock()
+	s.ended = true
+	s.tracer.mutex.Unlock()
+}
+
+type testTracer struct {
+	spans []*testSpan
+	mutex sync.Mutex
+}
+
+func (t *testTracer) Start(name string, parent Span, attributes map[string]interface{}) Span {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	span := &testSpan{tracer: t, name: name, attributes: attributes}
+	if parent != nil {
+		span.parent = parent.(*testSpan)
+	}
+
+	t.spans = append(t.spans, span)
+
+	return span
+}
+
+type spanMiddleware struct {
+	broker *Broker
+	span   Span
+}
+
+func (m *spanMiddleware) Inbound(client Client, pkt packet.Packet) (packet.Packet, error) {
+	if p, ok := pkt.(*packet.PublishPacket); ok {
+		m.broker.Annotate(&p.Message, SpanAnnotation, m.span)
+	}
+
+	return pkt, nil
+}
+
+func (m *spanMiddleware) Outbound(client Client, pkt packet.Packet) (packet.Packet, error) {
+	return pkt, nil
+}
+
+func TestTracer(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("test")
+
+	sender := &testSpan{name: "sender"}
+
+	tracer := &testTracer{}
+
+	broker := New()
+	broker.Tracer = tracer
+	broker.Use(&spanMiddleware{broker: broker, span: sender})
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(publish).
+		Receive(publish).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	// the publish span ends after the delivery
+	broker.await(time.Now().Add(time.Second), func() bool {
+		tracer.mutex.Lock()
+		defer tracer.mutex.Unlock()
+
+		return len(tracer.spans) == 3 && tracer.spans[0].ended
+	})
+
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+
+	names := map[string]*testSpan{}
+	for _, span := range tracer.spans {
+		assert.True(t, span.ended)
+		assert.NoError(t, span.err)
+		names[span.name] = span
+	}
+
+	assert.Len(t, tracer.spans, 3)
+	assert.Equal(t, sender, names["publish"].parent)
+	assert.Equal(t, "test", names["publish"].attributes["messaging.destination.name"])
+	assert.Equal(t, "test", names["publish"].attributes["messaging.client.id"])
+	assert.Equal(t, names["publish"], names["authorize"].parent)
+	assert.Equal(t, names["publish"], names["deliver"].parent)
+	assert.Equal(t, 4, names["deliver"].attributes["messaging.message.body.size"])
+}
@@ -0,0 +1,386 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gomqtt/tools"
+)
+
+// the number of shards of a sharded tree
+const treeShards = 64
+
+// A shardedTree is a topic tree that is split into shards by the first level
+// of the topic filters, so that publishes to different top-level topics match
+// in parallel and subscriptions only lock the shard of their filter. Filters
+// that start with a wildcard are stored in a separate shard that is matched
+// against every topic if it is not empty. Every shard indexes the filters of
+// its values, so that clearing a value only visits its own filters.
+type shardedTree struct {
+	shards    [treeShards]*treeShard
+	wildcard  *treeShard
+	wildcards int64
+}
+
+// a shard of a sharded tree
+type treeShard struct {
+	*tools.Tree
+
+	filters map[interface{}]map[string]bool
+	mutex   sync.Mutex
+}
+
+// returns a new shard
+func newTreeShard() *treeShard {
+	return &treeShard{
+		Tree:    tools.NewTree(),
+		filters: make(map[interface{}]map[string]bool),
+	}
+}
+
+// returns a new sharded tree
+func newShardedTree() *shardedTree {
+	t := &shardedTree{
+		wildcard: newTreeShard(),
+	}
+
+	for i := range t.shards {
+		t.shards[i] = newTreeShard()
+	}
+
+	return t
+}
+
+// returns the shard of the topic or filter
+func (t *shardedTree) shard(topic string) *treeShard {
+	first := topic
+	if i := strings.IndexByte(topic, '/'); i >= 0 {
+		first = topic[:i]
+	}
+
+	// check wildcard
+	if first == "+" || first == "#" {
+		return t.wildcard
+	}
+
+	// hash first level using fnv-1a
+	hash := uint32(2166136261)
+	for i := 0; i < len(first); i++ {
+		hash ^= uint32(first[i])
+		hash *= 16777619
+	}
+
+	return t.shards[hash%treeShards]
+}
+
+// adds the value to the filter
+func (t *shardedTree) Add(filter string, value interface{}) {
+	shard := t.shard(filter)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	shard.Tree.Add(filter, value)
+
+	filters, ok := shard.filters[value]
+	if !ok {
+		filters = make(map[string]bool)
+		shard.filters[value] = filters
+	}
+
+	if !filters[filter] && shard == t.wildcard {
+		atomic.AddInt64(&t.wildcards, 1)
+	}
+
+	filters[filter] = true
+}
+
+// removes the value from the filter
+func (t *shardedTree) Remove(filter string, value interface{}) {
+	shard := t.shard(filter)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	t.forget(shard, filter, value)
+
+	if filters := shard.filters[value]; len(filters) == 0 {
+		delete(shard.filters, value)
+	}
+}
+
+// removes the value from all filters
+func (t *shardedTree) Clear(value interface{}) {
+	t.clear(t.wildcard, value)
+
+	for _, shard := range t.shards {
+		t.clear(shard, value)
+	}
+}
+
+// removes the value from all filters of the shard
+func (t *shardedTree) clear(shard *treeShard, value interface{}) {
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	for filter := range shard.filters[value] {
+		t.forget(shard, filter, value)
+	}
+
+	delete(shard.filters, value)
+}
+
+// removes the value from the filter and the index of the shard, the mutex of
+// the shard must be held
+func (t *shardedTree) forget(shard *treeShard, filter string, value interface{}) {
+	shard.Tree.Remove(filter, value)
+
+	if filters := shard.filters[value]; filters[filter] {
+		delete(filters, filter)
+
+		if shard == t.wildcard {
+			atomic.AddInt64(&t.wildcards, -1)
+		}
+	}
+}
+
+// returns the unique values of all filters matching the topic
+func (t *shardedTree) Match(topic string) []interface{} {
+	values := t.shard(topic).Match(topic)
+
+	// skip empty wildcard shard
+	if atomic.LoadInt64(&t.wildcards) == 0 {
+		return values
+	}
+
+	more := t.wildcard.Match(topic)
+	if len(more) == 0 {
+		return values
+	} else if len(values) == 0 {
+		return more
+	}
+
+	return appendUnique(values, more)
+}
+
+// returns the unique values of all filters
+func (t *shardedTree) All() []interface{} {
+	values := t.wildcard.All()
+	for _, shard := range t.shards {
+		values = append(values, shard.All()...)
+	}
+
+	return appendUnique(nil, values)
+}
+
+// appends the values that are not yet in the list of unique values
+func appendUnique(list, values []interface{}) []interface{} {
+	seen := make(map[interface{}]bool, len(list)+len(values))
+	for _, value := range list {
+		seen[value] = true
+	}
+
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			list = append(list, value)
+		}
+	}
+
+	return list
+}
+
+// a node of a retained tree
+type retainedNode struct {
+	children map[string]*retainedNode
+	value    interface{}
+}
+
+// A retainedTree stores a single value per topic and supports searches that
+// visit a limited number of nodes, so that pathological filters like deeply
+// nested "+" levels do not walk huge trees unboundedly.
+type retainedTree struct {
+	root  *retainedNode
+	mutex sync.RWMutex
+}
+
+// returns a new retained tree
+func newRetainedTree() *retainedTree {
+	return &retainedTree{
+		root: &retainedNode{},
+	}
+}
+
+// sets the value of the topic
+func (t *retainedTree) Set(topic string, value interface{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	n := t.root
+	for _, level := range strings.Split(topic, "/") {
+		child, ok := n.children[level]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*retainedNode)
+			}
+
+			child = &retainedNode{}
+			n.children[level] = child
+		}
+
+		n = child
+	}
+
+	n.value = value
+}
+
+// returns the value of the topic
+func (t *retainedTree) Get(topic string) []interface{} {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	n := t.root
+	for _, level := range strings.Split(topic, "/") {
+		n = n.children[level]
+		if n == nil {
+			return nil
+		}
+	}
+
+	if n.value == nil {
+		return nil
+	}
+
+	return []interface{}{n.value}
+}
+
+// removes the value of the topic and prunes the emptied nodes
+func (t *retainedTree) Empty(topic string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.empty(t.root, strings.Split(topic, "/"))
+}
+
+// removes the value below the node and returns whether the node is empty
+func (t *retainedTree) empty(n *retainedNode, levels []string) bool {
+	if len(levels) == 0 {
+		n.value = nil
+	} else if child, ok := n.children[levels[0]]; ok && t.empty(child, levels[1:]) {
+		delete(n.children, levels[0])
+	}
+
+	return n.value == nil && len(n.children) == 0
+}
+
+// returns the values of the topics that match the filter
+func (t *retainedTree) Search(filter string) []interface{} {
+	values, _ := t.search(filter, 0)
+	return values
+}
+
+// returns the values of the topics that match the filter and false if more
+// nodes than the positive budget had to be visited
+func (t *retainedTree) search(filter string, budget int) ([]interface{}, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	s := &retainedSearch{budget: budget, limited: budget > 0}
+	if !s.search(t.root, strings.Split(filter, "/")) {
+		return nil, false
+	}
+
+	return s.values, true
+}
+
+// returns all values
+func (t *retainedTree) All() []interface{} {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	s := &retainedSearch{}
+	s.all(t.root)
+
+	return s.values
+}
+
+// the state of a search that counts the visited nodes
+type retainedSearch struct {
+	budget  int
+	limited bool
+	values  []interface{}
+}
+
+// accounts the visit of a node and returns false if the budget is exhausted
+func (s *retainedSearch) visit() bool {
+	if s.limited {
+		s.budget--
+		if s.budget < 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// collects the values below the node that match the levels
+func (s *retainedSearch) search(n *retainedNode, levels []string) bool {
+	if !s.visit() {
+		return false
+	}
+
+	if len(levels) == 0 {
+		if n.value != nil {
+			s.values = append(s.values, n.value)
+		}
+
+		return true
+	}
+
+	switch levels[0] {
+	case "#":
+		return s.all(n)
+	case "+":
+		for _, child := range n.children {
+			if !s.search(child, levels[1:]) {
+				return false
+			}
+		}
+	default:
+		if child, ok := n.children[levels[0]]; ok {
+			return s.search(child, levels[1:])
+		}
+	}
+
+	return true
+}
+
+// collects all values below the node including its own
+func (s *retainedSearch) all(n *retainedNode) bool {
+	if n.value != nil {
+		s.values = append(s.values, n.value)
+	}
+
+	for _, child := range n.children {
+		if !s.visit() || !s.all(child) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/gomqtt/tools"
+	"github.com/stretchr/testify/assert"
+)
+
+// a tree as used by the backend
+type matchingTree interface {
+	Add(filter string, value interface{})
+	Match(topic string) []interface{}
+	Clear(value interface{})
+}
+
+// the compared tree implementations
+var benchmarkTrees = []struct {
+	name string
+	new  func() matchingTree
+}{
+	{"single", func() matchingTree { return tools.NewTree() }},
+	{"sharded", func() matchingTree { return newShardedTree() }},
+}
+
+func sortedValues(values []interface{}) []string {
+	list := make([]string, 0, len(values))
+	for _, value := range values {
+		list = append(list, value.(string))
+	}
+
+	sort.Strings(list)
+
+	return list
+}
+
+func TestShardedTree(t *testing.T) {
+	tree := newShardedTree()
+
+	tree.Add("foo/bar", "a")
+	tree.Add("foo/+", "a")
+	tree.Add("+/bar", "b")
+	tree.Add("#", "c")
+	tree.Add("baz/#", "d")
+	tree.Add("foo/bar", "d")
+
+	assert.Equal(t, []string{"a", "b", "c", "d"}, sortedValues(tree.Match("foo/bar")))
+	assert.Equal(t, []string{"a", "c"}, sortedValues(tree.Match("foo/baz")))
+	assert.Equal(t, []string{"c", "d"}, sortedValues(tree.Match("baz/qux")))
+	assert.Equal(t, []string{"a", "b", "c", "d"}, sortedValues(tree.All()))
+
+	tree.Remove("foo/bar", "d")
+	assert.Equal(t, []string{"a", "b", "c"}, sortedValues(tree.Match("foo/bar")))
+
+	tree.Clear("a")
+	assert.Equal(t, []string{"b", "c"}, sortedValues(tree.Match("foo/bar")))
+	assert.Equal(t, []string{"c"}, sortedValues(tree.Match("foo/baz")))
+	assert.Equal(t, []string{"b", "c", "d"}, sortedValues(tree.All()))
+	assert.Empty(t, tree.shard("foo/bar").filters["a"])
+}
+
+func TestShardedTreeConcurrency(t *testing.T) {
+	tree := newShardedTree()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			value := fmt.Sprintf("v%d", i)
+			for j := 0; j < 100; j++ {
+				tree.Add(fmt.Sprintf("t%d/%d", i, j), value)
+				tree.Add("+/"+value, value)
+				tree.Match(fmt.Sprintf("t%d/%d", i, j))
+				tree.Remove(fmt.Sprintf("t%d/%d", i, j), value)
+			}
+			tree.Clear(value)
+		}(i)
+	}
+
+	wg.Wait()
+
+	assert.Empty(t, tree.All())
+	assert.Equal(t, int64(0), tree.wildcards)
+}
+
+func TestRetainedTree(t *testing.T) {
+	tree := newRetainedTree()
+
+	tree.Set("foo", "a")
+	tree.Set("foo/bar", "b")
+	tree.Set("foo/baz", "c")
+	tree.Set("qux/bar", "d")
+
+	assert.Equal(t, []interface{}{"b"}, tree.Get("foo/bar"))
+	assert.Empty(t, tree.Get("foo/qux"))
+	assert.Equal(t, []string{"a", "b", "c"}, sortedValues(tree.Search("foo/#")))
+	assert.Equal(t, []string{"b", "d"}, sortedValues(tree.Search("+/bar")))
+	assert.Equal(t, []string{"a", "b", "c", "d"}, sortedValues(tree.All()))
+
+	// the search is aborted once the budget is exhausted
+	values, ok := tree.search("+/bar", 3)
+	assert.False(t, ok)
+	assert.Empty(t, values)
+
+	values, ok = tree.search("+/bar", 5)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"b", "d"}, sortedValues(values))
+
+	// emptied nodes are pruned
+	tree.Empty("qux/bar")
+	tree.Empty("foo")
+	assert.Equal(t, []string{"b", "c"}, sortedValues(tree.All()))
+	assert.Nil(t, tree.root.children["qux"])
+	assert.NotNil(t, tree.root.children["foo"])
+}
+
+func BenchmarkTreeMatch(b *testing.B) {
+	for _, tree := range benchmarkTrees {
+		b.Run(tree.name, func(b *testing.B) {
+			benchmarkTreeMatch(b, tree.new())
+		})
+	}
+}
+
+// measures the parallel fan-out matching with many subscriptions
+func benchmarkTreeMatch(b *testing.B, tree matchingTree) {
+	for i := 0; i < 100000; i++ {
+		tree.Add(fmt.Sprintf("devices/%d/+", i), i)
+		tree.Add(fmt.Sprintf("site%d/%d/state", i%100, i), i)
+	}
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			tree.Match(fmt.Sprintf("site%d/%d/state", i%100, i%100000))
+			i++
+		}
+	})
+}
+
+func BenchmarkTreeChurn(b *testing.B) {
+	for _, tree := range benchmarkTrees {
+		b.Run(tree.name, func(b *testing.B) {
+			benchmarkTreeChurn(b, tree.new())
+		})
+	}
+}
+
+// measures the parallel matching while subscriptions are added and cleared
+func benchmarkTreeChurn(b *testing.B, tree matchingTree) {
+	for i := 0; i < 100000; i++ {
+		tree.Add(fmt.Sprintf("site%d/%d/state", i%100, i), i)
+	}
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			topic := fmt.Sprintf("site%d/%d/state", i%100, i%100000)
+			if i%10 == 0 {
+				tree.Add(topic, topic)
+				tree.Clear(topic)
+			} else {
+				tree.Match(topic)
+			}
+			i++
+		}
+	})
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// AutoTuning describes the bounds within which the outgoing buffer and the
+// inflight window of every client are adjusted to its observed delivery rate
+// (see Broker.AutoTuning).
+//
+// The outgoing buffer of a client is allocated with MaxBuffer slots. QOS 0
+// messages are dropped while the buffer holds at least the tuned number of
+// messages, which is derived from the messages delivered in the last
+// interval, while QOS 1 and 2 messages may use all slots. The inflight window
+// starts at MinInflight and is doubled if it held back the delivery in the
+// last interval or halved if less than half of it has been used.
+type AutoTuning struct {
+	// The bounds of the tuned outgoing buffer.
+	MinBuffer int
+	MaxBuffer int
+
+	// The bounds of the tuned inflight window.
+	MinInflight int
+	MaxInflight int
+
+	// The interval after which the sizes are adjusted.
+	Interval time.Duration
+}
+
+// NewAutoTuning returns an AutoTuning with default bounds.
+func NewAutoTuning() *AutoTuning {
+	return &AutoTuning{
+		MinBuffer:   10,
+		MaxBuffer:   1000,
+		MinInflight: 1,
+		MaxInflight: 100,
+		Interval:    time.Second,
+	}
+}
+
+// the tuned sizes and the statistics of a client
+type tuner struct {
+	bounds    AutoTuning
+	buffer    int
+	inflight  int
+	delivered int
+	peak      int
+	blocked   bool
+	since     time.Time
+	mutex     sync.Mutex
+}
+
+// returns a new tuner that starts with a full buffer and the smallest window
+func newTuner(bounds AutoTuning) *tuner {
+	return &tuner{
+		bounds:   bounds,
+		buffer:   bounds.MaxBuffer,
+		inflight: bounds.MinInflight,
+		since:    time.Now(),
+	}
+}
+
+// returns the tuned buffer size and inflight window
+func (t *tuner) sizes() (int, int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.buffer, t.inflight
+}
+
+// records a delivery and adjusts the sizes if the interval has elapsed,
+// returns whether the sizes have been changed
+func (t *tuner) record(now time.Time, inflight int, blocked bool) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// update statistics
+	t.delivered++
+	if inflight > t.peak {
+		t.peak = inflight
+	}
+	if blocked {
+		t.blocked = true
+	}
+
+	// check interval
+	elapsed := now.Sub(t.since)
+	if elapsed < t.bounds.Interval {
+		return false
+	}
+
+	buffer, window := t.buffer, t.inflight
+
+	// buffer the messages delivered in an interval
+	rate := float64(t.delivered) / elapsed.Seconds()
+	t.buffer = clamp(int(math.Ceil(rate*t.bounds.Interval.Seconds())), t.bounds.MinBuffer, t.bounds.MaxBuffer)
+
+	// grow a limiting window and shrink an underused window
+	if t.blocked {
+		t.inflight = clamp(t.inflight*2, t.bounds.MinInflight, t.bounds.MaxInflight)
+	} else if t.peak*2 <= t.inflight {
+		t.inflight = clamp(t.inflight/2, t.bounds.MinInflight, t.bounds.MaxInflight)
+	}
+
+	// reset statistics
+	t.delivered = 0
+	t.peak = 0
+	t.blocked = false
+	t.since = now
+
+	return t.buffer != buffer || t.inflight != window
+}
+
+// limits the value to the bounds
+func clamp(value, min, max int) int {
+	if value < min {
+		return min
+	} else if value > max {
+		return max
+	}
+
+	return value
+}
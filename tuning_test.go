@@ -0,0 +1,107 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTuner(t *testing.T) {
+	bounds := AutoTuning{
+		MinBuffer:   2,
+		MaxBuffer:   100,
+		MinInflight: 1,
+		MaxInflight: 8,
+		Interval:    time.Second,
+	}
+
+	tuner := newTuner(bounds)
+	start := tuner.since
+
+	buffer, inflight := tuner.sizes()
+	assert.Equal(t, 100, buffer)
+	assert.Equal(t, 1, inflight)
+
+	// a limiting window grows
+	for i := 0; i < 9; i++ {
+		assert.False(t, tuner.record(start, 1, true))
+	}
+
+	assert.True(t, tuner.record(start.Add(time.Second), 1, true))
+
+	buffer, inflight = tuner.sizes()
+	assert.Equal(t, 10, buffer)
+	assert.Equal(t, 2, inflight)
+
+	// the window is bounded
+	for i := 2; i < 6; i++ {
+		tuner.record(start.Add(time.Duration(i)*time.Second), 1, true)
+	}
+
+	buffer, inflight = tuner.sizes()
+	assert.Equal(t, 2, buffer)
+	assert.Equal(t, 8, inflight)
+
+	// an underused window shrinks
+	assert.True(t, tuner.record(start.Add(8*time.Second), 2, false))
+
+	_, inflight = tuner.sizes()
+	assert.Equal(t, 4, inflight)
+
+	assert.False(t, tuner.record(start.Add(10*time.Second), 3, false))
+}
+
+func TestAutoTuning(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+
+	connack := packet.NewConnackPacket()
+
+	broker := New()
+	broker.AutoTuning = NewAutoTuning()
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Test(t, conn)
+
+	snapshot, err := broker.Snapshot()
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, snapshot.Clients[0].TunedBuffer)
+	assert.Equal(t, 1, snapshot.Clients[0].TunedInflight)
+
+	tools.NewFlow().
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	broker.AutoTuning.MinInflight = 0
+	assert.Equal(t, ValidationError{
+		"AutoTuning.MinInflight must be between one and MaxInflight",
+	}, broker.Validate())
+}
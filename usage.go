@@ -0,0 +1,152 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+// A SubscriptionUsage summarizes the messages delivered to a subscription of
+// a client during an aggregation window (see Broker.UsageInterval).
+type SubscriptionUsage struct {
+	// The client id of the client and the matched topic filter.
+	ClientID string
+	Filter   string
+
+	// The number of delivered messages and their payload bytes.
+	Messages int64
+	Bytes    int64
+
+	// The aggregation window.
+	Start time.Time
+	End   time.Time
+}
+
+// identifies the subscription of a client
+type usageKey struct {
+	client Client
+	filter string
+}
+
+// the state of the usage loop
+type usageMeter struct {
+	usage map[usageKey]*SubscriptionUsage
+	start time.Time
+	quit  chan struct{}
+	done  chan struct{}
+	mutex sync.Mutex
+}
+
+// records a delivered message
+func (m *usageMeter) record(client Client, filter string, bytes int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// lazily allocate usage
+	if m.usage == nil {
+		m.usage = make(map[usageKey]*SubscriptionUsage)
+	}
+
+	key := usageKey{client: client, filter: filter}
+
+	usage, ok := m.usage[key]
+	if !ok {
+		clientID, _ := client.Context().Get("client_id").(string)
+		usage = &SubscriptionUsage{
+			ClientID: clientID,
+			Filter:   filter,
+		}
+
+		m.usage[key] = usage
+	}
+
+	usage.Messages++
+	usage.Bytes += int64(bytes)
+}
+
+// starts the usage loop if enabled
+func (b *Broker) startUsage() {
+	if b.UsageInterval <= 0 {
+		return
+	}
+
+	b.usage.mutex.Lock()
+	b.usage.start = time.Now()
+	b.usage.quit = make(chan struct{})
+	b.usage.done = make(chan struct{})
+	quit, done := b.usage.quit, b.usage.done
+	b.usage.mutex.Unlock()
+
+	go b.runUsage(quit, done)
+}
+
+// stops the usage loop, waits until it has returned and reports the usage of
+// the unfinished window
+func (b *Broker) stopUsage() {
+	b.usage.mutex.Lock()
+	quit, done := b.usage.quit, b.usage.done
+	b.usage.quit = nil
+	b.usage.done = nil
+	b.usage.mutex.Unlock()
+
+	if quit == nil {
+		return
+	}
+
+	close(quit)
+	<-done
+
+	b.reportUsage(time.Now())
+}
+
+// periodically reports the aggregated usage
+func (b *Broker) runUsage(quit, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(b.UsageInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case now := <-ticker.C:
+			b.reportUsage(now)
+		}
+	}
+}
+
+// emits an event for every subscription that received messages in the
+// current window and starts a new window
+func (b *Broker) reportUsage(now time.Time) {
+	b.usage.mutex.Lock()
+	usage, start := b.usage.usage, b.usage.start
+	b.usage.usage = nil
+	b.usage.start = now
+	b.usage.mutex.Unlock()
+
+	for key, u := range usage {
+		u.Start = start
+		u.End = now
+
+		b.emit(&Event{
+			Type:   UsageReported,
+			Client: key.client,
+			Topic:  key.filter,
+			Usage:  *u,
+		})
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageReported(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test/+"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	publish1 := packet.NewPublishPacket()
+	publish1.Message.Topic = "test/1"
+	publish1.Message.Payload = []byte("test")
+
+	publish2 := packet.NewPublishPacket()
+	publish2.Message.Topic = "test/2"
+	publish2.Message.Payload = []byte("foo")
+
+	broker := New()
+	broker.UsageInterval = time.Hour
+
+	reports := make(chan Event, 10)
+	broker.OnEvent(func(event *Event) {
+		if event.Type == UsageReported {
+			reports <- *event
+		}
+	})
+
+	err := broker.Start()
+	assert.NoError(t, err)
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Send(publish1).
+		Receive(publish1).
+		Send(publish2).
+		Receive(publish2).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	// the unfinished window is reported on close
+	err = broker.Close(time.Second)
+	assert.NoError(t, err)
+
+	report := <-reports
+	assert.Equal(t, "test/+", report.Topic)
+	assert.Equal(t, "test", report.Usage.ClientID)
+	assert.Equal(t, "test/+", report.Usage.Filter)
+	assert.Equal(t, int64(2), report.Usage.Messages)
+	assert.Equal(t, int64(7), report.Usage.Bytes)
+	assert.False(t, report.Usage.End.Before(report.Usage.Start))
+	assert.Empty(t, reports)
+}
@@ -0,0 +1,296 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gomqtt/packet"
+)
+
+// A ValidationError lists all problems found in a configuration.
+type ValidationError []string
+
+// Error returns all problems as a single message.
+func (e ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(e, "; ")
+}
+
+// A Validator is a Backend that is able to validate its configuration.
+type Validator interface {
+	// Validate should check the configuration and return a ValidationError
+	// listing all found problems.
+	Validate() error
+}
+
+// Validate will check the configuration of the broker and its backend and
+// return a ValidationError listing all found problems. It is called by Start
+// before the backend is started.
+func (b *Broker) Validate() error {
+	var problems ValidationError
+
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+
+	check(b.Backend != nil, "Backend must be set")
+	check(b.ConnectTimeout >= 0, "ConnectTimeout must not be negative")
+	check(b.SessionExpiry >= 0, "SessionExpiry must not be negative")
+	check(b.MessageExpiry >= 0, "MessageExpiry must not be negative")
+	check(b.UsageInterval >= 0, "UsageInterval must not be negative")
+	check(b.MQTT31ClientIDLength >= 0, "MQTT31ClientIDLength must not be negative")
+	check(b.AuthorizationCacheTTL >= 0, "AuthorizationCacheTTL must not be negative")
+	check(b.AuthorizationCacheSize >= 0, "AuthorizationCacheSize must not be negative")
+	check(b.ClientIDPolicy == nil || b.ClientIDPolicy.MaxLength >= 0, "ClientIDPolicy.MaxLength must not be negative")
+	check(b.MaxConnections >= 0, "MaxConnections must not be negative")
+	check(b.MaxPendingConnects >= 0, "MaxPendingConnects must not be negative")
+	check(b.RefusalDelay >= 0, "RefusalDelay must not be negative")
+	check(b.RefusalDelay == 0 || b.MaxConnections > 0, "RefusalDelay requires MaxConnections")
+	check(b.MaxPublishRate >= 0, "MaxPublishRate must not be negative")
+	check(!b.RateLimitDisconnect || b.MaxPublishRate > 0, "RateLimitDisconnect requires MaxPublishRate")
+	check(b.MaxPayloadSize >= 0, "MaxPayloadSize must not be negative")
+	check(b.MaxPacketSize >= 0, "MaxPacketSize must not be negative")
+
+	for _, q := range b.Quotas {
+		check(q.Key == QuotaAccount || q.Key == QuotaClientID, "Quotas contains an unknown key")
+		check(q.Window > 0, "Quotas contains a window that is not positive")
+		check(q.MaxMessages >= 0 && q.MaxBytes >= 0, "Quotas contains a negative limit")
+		check(q.MaxMessages > 0 || q.MaxBytes > 0, "Quotas contains a quota without limits")
+	}
+
+	check(b.MaxInflight >= 0, "MaxInflight must not be negative")
+	check(b.ServerKeepAlive >= 0 && b.ServerKeepAlive <= math.MaxUint16*time.Second, "ServerKeepAlive must be between zero and 65535 seconds")
+	check(!b.AdvertiseLimits || len(b.middleware) > 0, "AdvertiseLimits requires a Middleware")
+	check(b.WillDelay >= 0, "WillDelay must not be negative")
+	check(b.StallTimeout >= 0, "StallTimeout must not be negative")
+	check(b.StallPolicy == StallClose || b.StallPolicy == StallDropQOS0, "StallPolicy is unknown")
+	check(b.TerminateMode == TerminateSync || b.TerminateMode == TerminateAsync, "TerminateMode is unknown")
+	check(b.TakeoverPolicy >= CloseOld && b.TakeoverPolicy <= CloseOldAndMigrate, "TakeoverPolicy is unknown")
+	check(b.Provenance >= ProvenanceOff && b.Provenance <= ProvenanceEnvelope, "Provenance is unknown")
+	check(b.OutgoingBuffer >= 0, "OutgoingBuffer must not be negative")
+
+	// the buffer is replaced by auto tuning
+	buffer := b.OutgoingBuffer
+	if t := b.AutoTuning; t != nil {
+		buffer = t.MaxBuffer
+
+		check(t.MinBuffer > 0 && t.MinBuffer <= t.MaxBuffer, "AutoTuning.MinBuffer must be between one and MaxBuffer")
+		check(t.MinInflight > 0 && t.MinInflight <= t.MaxInflight, "AutoTuning.MinInflight must be between one and MaxInflight")
+		check(t.Interval > 0, "AutoTuning.Interval must be positive")
+	}
+
+	if s := b.LoadShedding; s != nil {
+		for _, rule := range s.Classes {
+			check(rule.Class >= NormalClass && rule.Class <= BulkClass, "LoadShedding.Classes contains an unknown class")
+		}
+
+		check(s.BulkThreshold > 0 && s.BulkThreshold <= s.NormalThreshold, "LoadShedding.BulkThreshold must be between zero and NormalThreshold")
+		check(s.DeferDelay >= 0, "LoadShedding.DeferDelay must not be negative")
+		check(s.Interval >= 0, "LoadShedding.Interval must not be negative")
+	}
+
+	if a := b.TopicAliasing; a != nil {
+		check(a.Hot > 0, "TopicAliasing.Hot must be positive")
+		check(a.MinLength >= 0, "TopicAliasing.MinLength must not be negative")
+		check(len(b.middleware) > 0, "TopicAliasing requires a Middleware")
+	}
+
+	check(b.LowWatermark >= 0 && b.LowWatermark <= buffer, "LowWatermark must be between zero and OutgoingBuffer")
+	check(b.HighWatermark >= 0 && b.HighWatermark <= buffer, "HighWatermark must be between zero and OutgoingBuffer")
+	check(b.LowWatermark == 0 || b.HighWatermark == 0 || b.LowWatermark < b.HighWatermark, "LowWatermark must be below HighWatermark")
+	check(b.CanaryInterval >= 0, "CanaryInterval must not be negative")
+	check(b.CanaryTimeout >= 0, "CanaryTimeout must not be negative")
+	check(b.CanaryInterval == 0 || b.CanaryTopic != "", "CanaryInterval requires CanaryTopic")
+	check(!strings.ContainsAny(b.CanaryTopic, "+#"), "CanaryTopic must not contain wildcards")
+	check(b.ConnectionHistory >= 0, "ConnectionHistory must not be negative")
+	check(b.AffinitySink == nil || b.NodeID != "", "AffinitySink requires NodeID")
+	check(b.ReplayPrefix == "" || strings.HasSuffix(b.ReplayPrefix, "/"), "ReplayPrefix must end with a slash")
+
+	// validate backend
+	if validator, ok := b.Backend.(Validator); ok {
+		err := validator.Validate()
+		if list, ok := err.(ValidationError); ok {
+			problems = append(problems, list...)
+		} else if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	return nil
+}
+
+// Validate will check the configuration of the listener and return a
+// ValidationError listing all found problems. It is called by Listen before
+// the listener is launched.
+func (l *Listener) Validate() error {
+	var problems ValidationError
+
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, l.URL+": "+problem)
+		}
+	}
+
+	// check url
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		check(false, "URL is invalid")
+	} else {
+		switch u.Scheme {
+		case "tcp", "ws":
+			check(l.TLSConfig == nil, "TLSConfig requires a tls or wss scheme")
+		case "tls", "wss":
+			check(l.TLSConfig != nil, "TLSConfig is missing")
+			check(l.TLSConfig == nil || len(l.TLSConfig.Certificates) > 0 || l.TLSConfig.GetCertificate != nil, "TLSConfig has no certificates")
+		default:
+			check(false, "URL scheme must be tcp, tls, ws or wss")
+		}
+	}
+
+	check(l.MaxConnections >= 0, "MaxConnections must not be negative")
+	check(l.FirstMessageTimeout >= 0, "FirstMessageTimeout must not be negative")
+
+	for _, version := range l.ProtocolVersions {
+		check(version == packet.Version31 || version == packet.Version311, "ProtocolVersions contains an unknown version")
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	return nil
+}
+
+// Validate will check the configuration of the backend and return a
+// ValidationError listing all found problems.
+func (m *MemoryBackend) Validate() error {
+	var problems ValidationError
+
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+
+	check(m.ReapInterval > 0, "ReapInterval must be positive")
+	check(m.RetainedSyncInterval >= 0, "RetainedSyncInterval must not be negative")
+	check(m.HistorySize >= 0, "HistorySize must not be negative")
+	check(m.MaxRetainedMessages >= 0, "MaxRetainedMessages must not be negative")
+	check(m.RetainedTTL >= 0, "RetainedTTL must not be negative")
+	check(m.CleanPolicy != CleanDeadLetter || m.DeadLetterHandler != nil, "DeadLetterHandler must be set for the CleanDeadLetter policy")
+
+	if m.RetainedTTL > 0 {
+		check(m.RetainedSweepInterval > 0, "RetainedSweepInterval must be positive")
+	}
+
+	for _, quota := range m.RetainedQuotas {
+		check(quota.MaxMessages >= 0 && quota.MaxBytes >= 0, fmt.Sprintf("RetainedQuota %q must not have negative limits", quota.Prefix))
+		check(quota.MaxMessages > 0 || quota.MaxBytes > 0, fmt.Sprintf("RetainedQuota %q must have a limit", quota.Prefix))
+	}
+
+	// check tenants
+	if m.Tenants != nil {
+		check(strings.HasSuffix(m.TenantPrefix, "/"), "TenantPrefix must end with a slash")
+		check(!strings.ContainsAny(m.DefaultTenant, "/+#"), "DefaultTenant must not contain a slash or wildcards")
+	}
+
+	quotas := []TenantQuota{m.TenantQuota}
+	for _, quota := range m.TenantQuotas {
+		quotas = append(quotas, quota)
+	}
+
+	for _, quota := range quotas {
+		check(quota.MaxClients >= 0 && quota.MaxSubscriptions >= 0 && quota.MaxRetainedMessages >= 0 && quota.MaxRetainedBytes >= 0, "TenantQuota must not have negative limits")
+	}
+
+	// check session path
+	if m.SessionPath != "" {
+		info, err := os.Stat(m.SessionPath)
+		check(err == nil && info.IsDir(), "SessionPath must be an existing directory")
+	}
+
+	// check retained path
+	if m.RetainedPath != "" {
+		info, err := os.Stat(filepath.Dir(m.RetainedPath))
+		check(err == nil && info.IsDir(), "RetainedPath must be located in an existing directory")
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	return nil
+}
+
+// Validate will check the configuration of the backend and return a
+// ValidationError listing all found problems.
+func (m *SQLBackend) Validate() error {
+	var problems ValidationError
+
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+
+	check(m.DB != nil, "DB must be set")
+	check(m.Dialect == PostgreSQL || m.Dialect == MySQL, "Dialect is unknown")
+	check(strings.Trim(strings.ToLower(m.TablePrefix), "abcdefghijklmnopqrstuvwxyz0123456789_") == "", "TablePrefix must only contain letters, digits and underscores")
+	check(m.OfflineLimit >= 0, "OfflineLimit must not be negative")
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	return nil
+}
+
+// Validate will check the configuration of the backend and return a
+// ValidationError listing all found problems.
+func (r *ReplicatedBackend) Validate() error {
+	var problems ValidationError
+
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+
+	if list, ok := r.MemoryBackend.Validate().(ValidationError); ok {
+		problems = append(problems, list...)
+	}
+
+	check(r.NodeID != "", "NodeID must be set")
+	check(r.Log != nil, "Log must be set")
+	check(r.Timeout > 0, "Timeout must be positive")
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	return nil
+}
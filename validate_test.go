@@ -0,0 +1,64 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBrokerValidate(t *testing.T) {
+	broker := New()
+	assert.NoError(t, broker.Validate())
+
+	broker.MaxConnections = -1
+	broker.RateLimitDisconnect = true
+	broker.Quotas = []Quota{{Key: QuotaClientID}}
+	broker.ServerKeepAlive = 24 * time.Hour
+	broker.AdvertiseLimits = true
+	broker.Backend.(*MemoryBackend).ReapInterval = 0
+
+	err := broker.Validate()
+	assert.Equal(t, ValidationError{
+		"MaxConnections must not be negative",
+		"RateLimitDisconnect requires MaxPublishRate",
+		"Quotas contains a window that is not positive",
+		"Quotas contains a quota without limits",
+		"ServerKeepAlive must be between zero and 65535 seconds",
+		"AdvertiseLimits requires a Middleware",
+		"ReapInterval must be positive",
+	}, err)
+
+	assert.Equal(t, err, broker.Start())
+}
+
+func TestListenerValidate(t *testing.T) {
+	assert.NoError(t, (&Listener{URL: "tcp://0.0.0.0:1883"}).Validate())
+
+	assert.Equal(t, ValidationError{
+		"udp://0.0.0.0:1883: URL scheme must be tcp, tls, ws or wss",
+	}, (&Listener{URL: "udp://0.0.0.0:1883"}).Validate())
+
+	assert.Equal(t, ValidationError{
+		"tls://0.0.0.0:8883: TLSConfig is missing",
+	}, (&Listener{URL: "tls://0.0.0.0:8883"}).Validate())
+
+	assert.Equal(t, ValidationError{
+		"wss://0.0.0.0:443: TLSConfig has no certificates",
+	}, (&Listener{URL: "wss://0.0.0.0:443", TLSConfig: &tls.Config{}}).Validate())
+}
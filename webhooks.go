@@ -0,0 +1,378 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/tomb.v2"
+)
+
+// The names of the events that can be delivered to webhooks.
+const (
+	WebhookClientConnected    = "client.connected"
+	WebhookClientDisconnected = "client.disconnected"
+	WebhookMessagePublished   = "message.published"
+	WebhookAuthFailed         = "auth.failed"
+)
+
+// WebhookSignatureHeader is the header that carries the HMAC-SHA256 signature
+// of the body in the form "sha256=<hex>" if the webhook has a secret.
+const WebhookSignatureHeader = "X-Gomqtt-Signature"
+
+// A Webhook is a user-defined URL that receives the selected events.
+type Webhook struct {
+	URL string
+
+	// The names of the delivered events, e.g. WebhookClientConnected. All
+	// events are delivered if empty.
+	Events []string
+
+	// The topic filters that select the delivered message.published events.
+	// Messages of all topics are delivered if empty.
+	Topics []string
+
+	// If a Secret is set, the requests are signed using HMAC-SHA256 (see
+	// WebhookSignatureHeader).
+	Secret string
+}
+
+// A WebhookEvent is the representation of an event in the body of a webhook
+// request. Each request carries a JSON array of events.
+type WebhookEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+
+	// The identity of the client, if any.
+	ClientID string `json:"client_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	RemoteIP string `json:"remote_ip,omitempty"`
+
+	// The published message of a message.published event. The payload is
+	// encoded using base64.
+	Topic   string `json:"topic,omitempty"`
+	Payload []byte `json:"payload,omitempty"`
+	QOS     byte   `json:"qos,omitempty"`
+	Retain  bool   `json:"retain,omitempty"`
+}
+
+// A WebhookNotifier posts the connects, disconnects, published messages and
+// authentication failures of clients as JSON to webhooks, which is a common
+// integration point for serverless pipelines. Every webhook is served by a
+// separate goroutine, so that a slow webhook does not delay the others. The
+// WebhookNotifier can be attached to a broker as a Subsystem.
+type WebhookNotifier struct {
+	// The webhooks that receive the events.
+	Hooks []Webhook
+
+	// The client used for the requests, defaults to a client with a timeout
+	// of ten seconds.
+	Client *http.Client
+
+	// Events are posted in batches of up to BatchSize events. A batch is
+	// posted once it is full or the BatchInterval elapsed since its first
+	// event has been added.
+	BatchSize     int
+	BatchInterval time.Duration
+
+	// The maximum number of events per webhook that wait to be batched.
+	// Further events are dropped as the notifier must not block the broker.
+	QueueSize int
+
+	// Failed requests are retried up to MaxRetries times, unless the webhook
+	// responded with a client error other than 429. The delay between the
+	// attempts starts at RetryBackoff and doubles up to MaxBackoff.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+
+	Logger Logger
+
+	broker  *Broker
+	remove  func()
+	queues  []chan WebhookEvent
+	dropped int64
+
+	tomb tomb.Tomb
+}
+
+// NewWebhookNotifier returns a new WebhookNotifier that posts the events of
+// the broker to the specified webhooks.
+func NewWebhookNotifier(broker *Broker, hooks ...Webhook) *WebhookNotifier {
+	return &WebhookNotifier{
+		Hooks:         hooks,
+		Client:        &http.Client{Timeout: 10 * time.Second},
+		BatchSize:     100,
+		BatchInterval: time.Second,
+		QueueSize:     1000,
+		MaxRetries:    5,
+		RetryBackoff:  100 * time.Millisecond,
+		MaxBackoff:    10 * time.Second,
+		broker:        broker,
+	}
+}
+
+// Start will start observing the events of the broker and launch the
+// goroutines that post the batches.
+func (n *WebhookNotifier) Start() error {
+	n.queues = make([]chan WebhookEvent, len(n.Hooks))
+
+	for i := range n.Hooks {
+		hook := n.Hooks[i]
+		queue := make(chan WebhookEvent, n.QueueSize)
+		n.queues[i] = queue
+
+		n.tomb.Go(func() error {
+			return n.sender(hook, queue)
+		})
+	}
+
+	n.remove = n.broker.OnEvent(n.enqueue)
+
+	return nil
+}
+
+// Stop will stop observing the broker and post the remaining events.
+func (n *WebhookNotifier) Stop() error {
+	n.remove()
+
+	n.tomb.Kill(nil)
+	n.tomb.Wait()
+
+	return nil
+}
+
+// Dropped returns the number of events that have been dropped because a queue
+// was full or the batch could not be posted.
+func (n *WebhookNotifier) Dropped() int64 {
+	return atomic.LoadInt64(&n.dropped)
+}
+
+// converts and queues an event for all interested webhooks
+func (n *WebhookNotifier) enqueue(event *Event) {
+	wev := WebhookEvent{
+		Time: time.Now(),
+	}
+
+	switch event.Type {
+	case ClientConnected:
+		wev.Event = WebhookClientConnected
+	case ClientDisconnected:
+		wev.Event = WebhookClientDisconnected
+	case MessagePublished:
+		wev.Event = WebhookMessagePublished
+		wev.Topic = event.Message.Topic
+		wev.Payload = event.Message.Payload
+		wev.QOS = event.Message.QOS
+		wev.Retain = event.Message.Retain
+	case AuthenticationFailed:
+		wev.Event = WebhookAuthFailed
+	default:
+		return
+	}
+
+	// add identity
+	if event.Client != nil {
+		ctx := event.Client.Context()
+		wev.ClientID, _ = ctx.Get("client_id").(string)
+		wev.Username, _ = ctx.Get("username").(string)
+		wev.RemoteIP, _ = ctx.Get("remote_ip").(string)
+	}
+
+	for i, hook := range n.Hooks {
+		if !hook.selects(wev) {
+			continue
+		}
+
+		select {
+		case n.queues[i] <- wev:
+		default:
+			atomic.AddInt64(&n.dropped, 1)
+			n.log(LogWarn, "webhook_event_dropped", map[string]interface{}{
+				"url":   hook.URL,
+				"event": wev.Event,
+			})
+		}
+	}
+}
+
+// batches and posts the queued events of a webhook
+func (n *WebhookNotifier) sender(hook Webhook, queue chan WebhookEvent) error {
+	var batch []WebhookEvent
+	var timeout <-chan time.Time
+
+	for {
+		select {
+		case wev := <-queue:
+			batch = append(batch, wev)
+
+			// start batch interval
+			if len(batch) == 1 {
+				timeout = time.After(n.BatchInterval)
+			}
+
+			if len(batch) < n.BatchSize {
+				continue
+			}
+		case <-timeout:
+		case <-n.tomb.Dying():
+			// post remaining events
+			for len(queue) > 0 {
+				batch = append(batch, <-queue)
+			}
+
+			for len(batch) > 0 {
+				size := len(batch)
+				if size > n.BatchSize {
+					size = n.BatchSize
+				}
+
+				n.send(hook, batch[:size])
+				batch = batch[size:]
+			}
+
+			return tomb.ErrDying
+		}
+
+		n.send(hook, batch)
+		batch = nil
+		timeout = nil
+	}
+}
+
+// posts a batch and retries with an exponential backoff
+func (n *WebhookNotifier) send(hook Webhook, batch []WebhookEvent) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		atomic.AddInt64(&n.dropped, int64(len(batch)))
+		n.log(LogError, "webhook_post_failed", map[string]interface{}{
+			"url":   hook.URL,
+			"error": err,
+		})
+
+		return
+	}
+
+	backoff := n.RetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		retry, err := n.post(hook, body)
+		if err == nil {
+			return
+		}
+
+		// check attempts
+		if !retry || attempt >= n.MaxRetries {
+			atomic.AddInt64(&n.dropped, int64(len(batch)))
+			n.log(LogError, "webhook_post_failed", map[string]interface{}{
+				"url":    hook.URL,
+				"events": len(batch),
+				"error":  err,
+			})
+
+			return
+		}
+
+		n.log(LogWarn, "webhook_post_retried", map[string]interface{}{
+			"url":     hook.URL,
+			"attempt": attempt + 1,
+			"error":   err,
+		})
+
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > n.MaxBackoff {
+			backoff = n.MaxBackoff
+		}
+	}
+}
+
+// posts the signed body and returns whether a failed request may be retried
+func (n *WebhookNotifier) post(hook Webhook, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	// sign body
+	if hook.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(hook.Secret, body))
+	}
+
+	res, err := n.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		retry := res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+
+	return false, nil
+}
+
+// logs a notifier event
+func (n *WebhookNotifier) log(level LogLevel, event string, fields map[string]interface{}) {
+	logEvent(n.Logger, level, event, fields)
+}
+
+// SignWebhook returns the value of the WebhookSignatureHeader for the body
+// signed with the secret, which receivers may use to verify requests.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checks if the webhook is interested in the event
+func (h Webhook) selects(wev WebhookEvent) bool {
+	if len(h.Events) > 0 {
+		selected := false
+		for _, name := range h.Events {
+			selected = selected || name == wev.Event
+		}
+
+		if !selected {
+			return false
+		}
+	}
+
+	if wev.Event != WebhookMessagePublished || len(h.Topics) == 0 {
+		return true
+	}
+
+	for _, filter := range h.Topics {
+		if matchFilter(filter, wev.Topic) {
+			return true
+		}
+	}
+
+	return false
+}
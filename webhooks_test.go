@@ -0,0 +1,168 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+type webhookReceiver struct {
+	batches map[string][][]WebhookEvent
+	mutex   sync.Mutex
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+
+	// verify signature
+	if req.URL.Path == "/signed" && req.Header.Get(WebhookSignatureHeader) != SignWebhook("secret", body) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var batch []WebhookEvent
+	json.Unmarshal(body, &batch)
+
+	r.mutex.Lock()
+	r.batches[req.URL.Path] = append(r.batches[req.URL.Path], batch)
+	r.mutex.Unlock()
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	connect := packet.NewConnectPacket()
+	connect.ClientID = "test"
+
+	connack := packet.NewConnackPacket()
+
+	publish1 := packet.NewPublishPacket()
+	publish1.Message = packet.Message{Topic: "foo/bar", Payload: []byte("test")}
+
+	publish2 := packet.NewPublishPacket()
+	publish2.Message = packet.Message{Topic: "baz", Payload: []byte("test")}
+
+	receiver := &webhookReceiver{batches: make(map[string][][]WebhookEvent)}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	broker := New()
+
+	notifier := NewWebhookNotifier(broker,
+		Webhook{
+			URL:    server.URL + "/signed",
+			Events: []string{WebhookClientConnected, WebhookClientDisconnected, WebhookMessagePublished},
+			Topics: []string{"foo/#"},
+			Secret: "secret",
+		},
+		Webhook{URL: server.URL + "/auth", Events: []string{WebhookAuthFailed}},
+	)
+
+	err := broker.Attach(notifier)
+	assert.NoError(t, err)
+
+	port, done := runBroker(t, broker, 1)
+
+	conn, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect).
+		Receive(connack).
+		Send(publish1).
+		Send(publish2).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn)
+
+	<-done
+
+	broker.await(time.Now().Add(time.Second), func() bool {
+		return len(broker.currentClients()) == 0
+	})
+
+	broker.emit(&Event{Type: AuthenticationFailed, Client: newFakeClient()})
+
+	// remaining events are posted when stopped
+	err = broker.Close(time.Second)
+	assert.NoError(t, err)
+
+	signed := receiver.batches["/signed"]
+	assert.Len(t, signed, 1)
+
+	var names []string
+	for _, wev := range signed[0] {
+		names = append(names, wev.Event)
+	}
+
+	assert.Equal(t, []string{WebhookClientConnected, WebhookMessagePublished, WebhookClientDisconnected}, names)
+	assert.Equal(t, "test", signed[0][0].ClientID)
+	assert.Equal(t, "foo/bar", signed[0][1].Topic)
+	assert.Equal(t, []byte("test"), signed[0][1].Payload)
+
+	auth := receiver.batches["/auth"]
+	assert.Len(t, auth, 1)
+	assert.Len(t, auth[0], 1)
+	assert.Equal(t, WebhookAuthFailed, auth[0][0].Event)
+	assert.Equal(t, int64(0), notifier.Dropped())
+}
+
+func TestWebhookNotifierRetries(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := map[string]int{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		attempts[req.URL.Path]++
+
+		// fail the first attempt temporarily and reject permanently
+		if req.URL.Path == "/rejected" {
+			w.WriteHeader(http.StatusBadRequest)
+		} else if attempts[req.URL.Path] == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	broker := New()
+
+	notifier := NewWebhookNotifier(broker,
+		Webhook{URL: server.URL + "/retried"},
+		Webhook{URL: server.URL + "/rejected"},
+	)
+	notifier.RetryBackoff = time.Millisecond
+
+	err := notifier.Start()
+	assert.NoError(t, err)
+
+	broker.emit(&Event{Type: ClientConnected, Client: newFakeClient()})
+
+	err = notifier.Stop()
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]int{"/retried": 2, "/rejected": 1}, attempts)
+	assert.Equal(t, int64(1), notifier.Dropped())
+}
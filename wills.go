@@ -0,0 +1,250 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gomqtt/packet"
+)
+
+// A WillStore is a Backend that durably stores the wills of connected clients.
+// The broker stores the will when a client connects and discards it after the
+// client has disconnected and the will has been published if necessary. Wills
+// that are still stored when the broker starts belong to clients that have
+// been connected during a crash and are published by RecoverWills.
+type WillStore interface {
+	// StoreWill should durably store the will of the client with the
+	// specified uuid.
+	StoreWill(uuid string, will *packet.Message) error
+
+	// DiscardWill should remove the will of the client with the specified
+	// uuid. It should not return an error if no will is stored.
+	DiscardWill(uuid string) error
+
+	// StoredWills should return all currently stored wills by uuid.
+	StoredWills() (map[string]*packet.Message, error)
+}
+
+// RecoverWills will publish and discard all wills that are still stored by
+// the backend. It is called automatically when the broker starts and has no
+// effect if the backend does not implement the WillStore interface.
+func (b *Broker) RecoverWills() error {
+	store, ok := b.Backend.(WillStore)
+	if !ok {
+		return nil
+	}
+
+	// get orphaned wills
+	wills, err := store.StoredWills()
+	if err != nil {
+		return err
+	}
+
+	// wills are published on behalf of a local client
+	client := NewLocalClient(func(*packet.Message) {})
+
+	// publish and discard wills
+	for uuid, will := range wills {
+		err = b.Backend.Publish(client, will)
+		if err != nil {
+			return err
+		}
+
+		err = store.DiscardWill(uuid)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A FileWillStore stores wills in a file on disk. It may be embedded in a
+// Backend to implement the WillStore interface.
+type FileWillStore struct {
+	path  string
+	wills map[string]*packet.Message
+	mutex sync.Mutex
+}
+
+// OpenFileWillStore returns a new FileWillStore that persists the wills to
+// the file at the specified path. If the file already exists, the previously
+// stored wills are restored.
+func OpenFileWillStore(path string) (*FileWillStore, error) {
+	s := &FileWillStore{
+		path:  path,
+		wills: make(map[string]*packet.Message),
+	}
+
+	// read existing file
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// decode wills
+	err = json.Unmarshal(data, &s.wills)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// StoreWill will store the will and persist the change.
+func (s *FileWillStore) StoreWill(uuid string, will *packet.Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.wills[uuid] = will
+	return s.persist()
+}
+
+// DiscardWill will remove the will and persist the change.
+func (s *FileWillStore) DiscardWill(uuid string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// check existence
+	if _, ok := s.wills[uuid]; !ok {
+		return nil
+	}
+
+	delete(s.wills, uuid)
+	return s.persist()
+}
+
+// StoredWills will return all stored wills.
+func (s *FileWillStore) StoredWills() (map[string]*packet.Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	wills := make(map[string]*packet.Message, len(s.wills))
+	for uuid, will := range s.wills {
+		wills[uuid] = will
+	}
+
+	return wills, nil
+}
+
+// writes the wills atomically to disk, the mutex must be held
+func (s *FileWillStore) persist() error {
+	data, err := json.Marshal(s.wills)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first and replace the old file afterwards
+	err = ioutil.WriteFile(s.path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+// a pending will that is published after the will delay
+type pendingWill struct {
+	timer   *time.Timer
+	publish func()
+	discard func()
+}
+
+// schedules the publication of delayed wills by client id
+type willScheduler struct {
+	pending map[string]*pendingWill
+	mutex   sync.Mutex
+}
+
+// schedules the publication of a will, an already pending will of the same
+// client is canceled
+func (s *willScheduler) schedule(clientID string, delay time.Duration, publish, discard func()) {
+	s.cancel(clientID)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// lazily allocate pending wills
+	if s.pending == nil {
+		s.pending = make(map[string]*pendingWill)
+	}
+
+	will := &pendingWill{
+		publish: publish,
+		discard: discard,
+	}
+
+	will.timer = time.AfterFunc(delay, func() {
+		if s.remove(clientID, will) {
+			will.publish()
+		}
+	})
+
+	s.pending[clientID] = will
+}
+
+// cancels and discards a pending will and returns true if one was pending
+func (s *willScheduler) cancel(clientID string) bool {
+	s.mutex.Lock()
+	will, ok := s.pending[clientID]
+	s.mutex.Unlock()
+
+	if !ok || !s.remove(clientID, will) {
+		return false
+	}
+
+	will.timer.Stop()
+	will.discard()
+
+	return true
+}
+
+// immediately publishes all pending wills
+func (s *willScheduler) flush() {
+	s.mutex.Lock()
+	pending := make(map[string]*pendingWill, len(s.pending))
+	for clientID, will := range s.pending {
+		pending[clientID] = will
+	}
+	s.mutex.Unlock()
+
+	for clientID, will := range pending {
+		if s.remove(clientID, will) {
+			will.timer.Stop()
+			will.publish()
+		}
+	}
+}
+
+// removes the pending will and returns false if it has already been removed
+func (s *willScheduler) remove(clientID string, will *pendingWill) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.pending[clientID] != will {
+		return false
+	}
+
+	delete(s.pending, clientID)
+
+	return true
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2014 The gomqtt Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gomqtt/packet"
+	"github.com/gomqtt/tools"
+	"github.com/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+type willStoreBackend struct {
+	*MemoryBackend
+	*FileWillStore
+}
+
+func TestRecoverWills(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-broker")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wills.json")
+
+	// simulate crash with a connected client
+	store, err := OpenFileWillStore(path)
+	assert.NoError(t, err)
+
+	err = store.StoreWill("foo", &packet.Message{Topic: "will", Payload: []byte("gone")})
+	assert.NoError(t, err)
+
+	// restart
+	store, err = OpenFileWillStore(path)
+	assert.NoError(t, err)
+
+	backend := &willStoreBackend{
+		MemoryBackend: NewMemoryBackend(),
+		FileWillStore: store,
+	}
+
+	subscriber := newFakeClient()
+	_, err = backend.Subscribe(subscriber, "will")
+	assert.NoError(t, err)
+
+	broker := New()
+	broker.Backend = backend
+
+	err = broker.Start()
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, len(subscriber.in))
+	assert.Equal(t, "will", subscriber.in[0].Topic)
+
+	wills, err := store.StoredWills()
+	assert.NoError(t, err)
+	assert.Empty(t, wills)
+
+	err = broker.Stop()
+	assert.NoError(t, err)
+}
+
+func TestWillDelay(t *testing.T) {
+	connect1 := packet.NewConnectPacket()
+	connect1.ClientID = "test"
+	connect1.CleanSession = true
+	connect1.Will = &packet.Message{Topic: "will", Payload: []byte("will")}
+
+	connect2 := packet.NewConnectPacket()
+
+	connack := packet.NewConnackPacket()
+
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "will"}}
+	subscribe.PacketID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.PacketID = 1
+
+	will := packet.NewPublishPacket()
+	will.Message = *connect1.Will
+
+	broker := New()
+	broker.WillDelay = 50 * time.Millisecond
+
+	port, done := runBroker(t, broker, 4)
+
+	// subscriber
+	conn1, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect2).
+		Receive(connack).
+		Send(subscribe).
+		Receive(suback).
+		Test(t, conn1)
+
+	// client dies and reconnects quickly
+	conn2, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect1).
+		Receive(connack).
+		Close().
+		Test(t, conn2)
+
+	conn3, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect1).
+		Receive(connack).
+		Test(t, conn3)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// client dies and stays away
+	tools.NewFlow().
+		Close().
+		Test(t, conn3)
+
+	// only the second will is published
+	tools.NewFlow().
+		Receive(will).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn1)
+
+	conn4, err := transport.Dial(port.URL())
+	assert.NoError(t, err)
+
+	tools.NewFlow().
+		Send(connect2).
+		Receive(connack).
+		Send(packet.NewDisconnectPacket()).
+		Close().
+		Test(t, conn4)
+
+	<-done
+}
+
+func TestRecoverWillsSpec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt-broker")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := OpenFileWillStore(filepath.Join(dir, "wills.json"))
+	assert.NoError(t, err)
+
+	broker := New()
+	broker.Backend = &willStoreBackend{
+		MemoryBackend: NewMemoryBackend(),
+		FileWillStore: store,
+	}
+
+	brokerRecoverWillsTest(t, broker)
+}